@@ -259,6 +259,32 @@ func runCompact(
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+
+	var lock *compact.Lock
+	if conf.lockTTL > 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "get hostname")
+		}
+		lock = compact.NewLock(logger, bkt, conf.lockName, fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()), conf.lockTTL)
+		// Refuse to start if another compactor operates on the bucket.
+		if err := lock.Acquire(ctx); err != nil {
+			cancel()
+			return errors.Wrap(err, "acquire compactor lock")
+		}
+	}
+	// Release the lock if we fail to start. Once added, the compaction actor owns the lock and releases it on exit.
+	releaseLock := lock != nil
+	defer func() {
+		if !releaseLock {
+			return
+		}
+		if err := lock.Release(context.Background()); err != nil {
+			level.Warn(logger).Log("msg", "failed to release compactor lock", "err", err)
+		}
+	}()
+
 	// Instantiate the compactor with different time slices. Timestamps in TSDB
 	// are in milliseconds.
 	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, levels, downsample.NewPool())
@@ -279,7 +305,7 @@ func runCompact(
 
 	grouper := compact.NewDefaultGrouper(logger, bkt, conf.acceptMalformedIndex, enableVerticalCompaction, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
 	blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, deleteDelay, blocksCleaned, blockCleanupFailures)
-	compactor, err := compact.NewBucketCompactor(logger, sy, grouper, comp, compactDir, bkt, conf.compactionConcurrency)
+	compactor, err := compact.NewBucketCompactor(logger, sy, grouper, comp, compactDir, bkt, conf.compactionConcurrency, conf.compactionConcurrencyPerLabelSet)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create bucket compactor")
@@ -320,7 +346,7 @@ func runCompact(
 				downsampleMetrics.downsamples.WithLabelValues(groupKey)
 				downsampleMetrics.downsampleFailures.WithLabelValues(groupKey)
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency); err != nil {
 				return errors.Wrap(err, "first pass of downsampling failed")
 			}
 
@@ -328,7 +354,7 @@ func runCompact(
 			if err := sy.SyncMetas(ctx); err != nil {
 				return errors.Wrap(err, "sync before second pass of downsampling")
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency); err != nil {
 				return errors.Wrap(err, "second pass of downsampling failed")
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
@@ -353,8 +379,16 @@ func runCompact(
 		return nil
 	}
 
+	releaseLock = false
 	g.Add(func() error {
 		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+		if lock != nil {
+			defer func() {
+				if err := lock.Release(context.Background()); err != nil {
+					level.Warn(logger).Log("msg", "failed to release compactor lock", "err", err)
+				}
+			}()
+		}
 
 		if !conf.wait {
 			return compactMainFn()
@@ -395,6 +429,23 @@ func runCompact(
 		cancel()
 	})
 
+	if lock != nil {
+		g.Add(func() error {
+			return runutil.Repeat(conf.lockTTL/3, ctx.Done(), func() error {
+				if err := lock.Renew(ctx); err != nil {
+					if errors.Cause(err) == compact.ErrLockLost {
+						return err
+					}
+					// Transient errors are retried on the next renewal, until the lease expires.
+					level.Warn(logger).Log("msg", "failed to renew compactor lock", "err", err)
+				}
+				return nil
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	if conf.wait {
 		r := route.New()
 
@@ -461,14 +512,18 @@ type compactConfig struct {
 	wait                                           bool
 	waitInterval                                   time.Duration
 	disableDownsampling                            bool
+	downsampleConcurrency                          int
 	blockSyncConcurrency                           int
 	blockViewerSyncBlockInterval                   time.Duration
 	compactionConcurrency                          int
+	compactionConcurrencyPerLabelSet               int
 	deleteDelay                                    model.Duration
 	dedupReplicaLabels                             []string
 	selectorRelabelConf                            extflag.PathOrContent
 	webConf                                        webConfig
 	label                                          string
+	lockTTL                                        time.Duration
+	lockName                                       string
 }
 
 func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
@@ -507,6 +562,8 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("downsampling.disable", "Disables downsampling. This is not recommended "+
 		"as querying long time ranges without non-downsampled data is not efficient and useful e.g it is not possible to render all samples for a human eye anyway").
 		Default("false").BoolVar(&cc.disableDownsampling)
+	cmd.Flag("downsample.concurrency", "Number of goroutines to use when downsampling series of a block. Downsampled blocks are the same regardless of the concurrency.").
+		Default("1").IntVar(&cc.downsampleConcurrency)
 
 	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
 		Default("20").IntVar(&cc.blockSyncConcurrency)
@@ -515,6 +572,16 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 
 	cmd.Flag("compact.concurrency", "Number of goroutines to use when compacting groups.").
 		Default("1").IntVar(&cc.compactionConcurrency)
+	cmd.Flag("compact.concurrency-per-label-set", "Maximum number of groups with the same external labels, e.g. of different resolutions, compacted concurrently. "+
+		"Limits memory used by compactions of a single label set, so it does not starve others, independently of --compact.concurrency. 0 means no limit.").
+		Default("0").IntVar(&cc.compactionConcurrencyPerLabelSet)
+
+	cmd.Flag("compact.lock-ttl", "Lease of the lock object the compactor acquires in the bucket before operating and renews every third of the lease. "+
+		"Compactor refuses to start while another compactor holds the lock with the same name. Lock of a crashed compactor is taken over once its lease expires. "+
+		"0 disables locking.").
+		Default("0s").DurationVar(&cc.lockTTL)
+	cmd.Flag("compact.lock-name", "Name of the lock object acquired when --compact.lock-ttl is set. Compactors operating on disjoint sets of blocks of the same bucket, e.g. sharded with --selector.relabel-config, have to use different names.").
+		Default("default").StringVar(&cc.lockName)
 
 	cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket. "+
 		"If delete-delay is non zero, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
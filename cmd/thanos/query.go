@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,11 +20,15 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/discovery/file"
 	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/remote"
+	"google.golang.org/grpc"
 
 	"github.com/thanos-io/thanos/pkg/extkingpin"
 
@@ -30,6 +36,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/discovery/cache"
 	"github.com/thanos-io/thanos/pkg/discovery/dns"
+	"github.com/thanos-io/thanos/pkg/extflag"
 	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -59,6 +66,8 @@ func registerQuery(app *extkingpin.App) {
 	key := cmd.Flag("grpc-client-tls-key", "TLS Key for the client's certificate").Default("").String()
 	caCert := cmd.Flag("grpc-client-tls-ca", "TLS CA Certificates to use to verify gRPC servers").Default("").String()
 	serverName := cmd.Flag("grpc-client-server-name", "Server name to verify the hostname on the returned gRPC certificates. See https://tools.ietf.org/html/rfc4366#section-3.1").Default("").String()
+	compressionPreference := cmd.Flag("grpc-client-compression", fmt.Sprintf("gRPC compressor to use when talking to StoreAPIs (repeated), in order of preference. The first one supported by the StoreAPI is used, if none is, requests are not compressed. Possible options: [%s]. lz4 and zstd are not supported yet.", strings.Join(extgrpc.RegisteredCompressors(), ", "))).
+		PlaceHolder("<compressor>").Strings()
 
 	webRoutePrefix := cmd.Flag("web.route-prefix", "Prefix for API and UI endpoints. This allows thanos UI to be served on a sub-path. Defaults to the value of --web.external-prefix. This option is analogous to --web.route-prefix of Prometheus.").Default("").String()
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the UI query web interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
@@ -69,17 +78,97 @@ func registerQuery(app *extkingpin.App) {
 	queryTimeout := extkingpin.ModelDuration(cmd.Flag("query.timeout", "Maximum time to process query by query node.").
 		Default("2m"))
 
+	mergeTimeout := extkingpin.ModelDuration(cmd.Flag("query.merge-timeout", "Maximum time to merge, deduplicate and evaluate series of a single select once all StoreAPIs responded. Unlike --store.response-timeout, it does not include time of fetching data from StoreAPIs. Selects exceeding it fail with a timeout error. 0 disables the timeout.").
+		Default("0s"))
+
 	maxConcurrentQueries := cmd.Flag("query.max-concurrent", "Maximum number of queries processed concurrently by query node.").
 		Default("20").Int()
 
+	admissionMaxInFlight := cmd.Flag("query.admission.max-in-flight", "Maximum number of queries admitted at once, including queries waiting for --query.max-concurrent. Queries above it are shed with HTTP 429, or queued if --query.admission.queue is set. 0 disables the threshold.").
+		Default("0").Int()
+
+	admissionMaxHeapBytes := cmd.Flag("query.admission.max-heap-bytes", "Heap size above which no new queries are admitted. Queries are shed with HTTP 429, or queued if --query.admission.queue is set. 0 disables the threshold.").
+		Default("0B").Bytes()
+
+	admissionQueue := cmd.Flag("query.admission.queue", "Queue queries exceeding admission thresholds until load drops or the query times out, instead of rejecting them.").
+		Default("false").Bool()
+
+	tenantHeader := cmd.Flag("query.tenant-header", "HTTP header required by data endpoints, whose value is forwarded to StoreAPIs as gRPC metadata with the same key, e.g. to be served by the per-tenant buckets of Store Gateway. Tenant is not required if empty.").
+		Default("").String()
+
+	resultTransformerNames := cmd.Flag("query.result-transformer", fmt.Sprintf("Name of a transformer post-processing results of query, query_range, query_last and query_points APIs after evaluation (repeated), applied in the given order. Possible options: [%s].", strings.Join(v1.RegisteredResultTransformers(), ", "))).
+		PlaceHolder("<transformer>").Strings()
+
 	lookbackDelta := cmd.Flag("query.lookback-delta", "The maximum lookback duration for retrieving metrics during expression evaluations. PromQL always evaluates the query for the certain timestamp (query range timestamps are deduced by step). Since scrape intervals might be different, PromQL looks back for given amount of time to get latest sample. If it exceeds the maximum lookback delta it assumes series is stale and returns none (a gap). This is why lookback delta should be set to at least 2 times of the slowest scrape interval. If unset it will use the promql default of 5m.").Duration()
 
 	maxConcurrentSelects := cmd.Flag("query.max-concurrent-select", "Maximum number of select requests made concurrently per a query.").
 		Default("4").Int()
 
-	queryReplicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter. Data includes time series, recording rules, and alerting rules.").
+	maxRangeQueryPoints := cmd.Flag("query.max-range-query-points", "Maximum number of points (range / step) per timeseries a range query can return. Range queries exceeding it are rejected before evaluation. 0 disables the limit.").
+		Default("11000").Int()
+
+	maxSeries := cmd.Flag("query.max-series", "Maximum number of series a single select of a query can fetch. Which series count towards it is set by --query.max-series.accounting. Queries exceeding it fail, unless --query.max-series.sample is set. 0 disables the limit.").
+		Default("0").Int()
+
+	seriesLimitAccounting := cmd.Flag("query.max-series.accounting", "Which series count towards --query.max-series when deduplication is enabled. 'deduplicated' counts series differing only in replica labels as one, 'fetched' counts every replica separately, bounding the data fetched before deduplication.").
+		Default(string(query.SeriesLimitDeduplicated)).Enum(string(query.SeriesLimitDeduplicated), string(query.SeriesLimitFetched))
+
+	maxOutputSeries := cmd.Flag("query.max-output-series", "Maximum number of series a query can produce. Unlike --query.max-series, it limits series produced by evaluation, e.g. the number of groups of `sum by (label)`: aggregations over a select, directly or through functions keeping its labels, are aborted before evaluation if their grouping exceeds it, other queries once their result exceeds it. 0 disables the limit.").
+		Default("0").Int()
+
+	sampleOverSeriesLimit := cmd.Flag("query.max-series.sample", "Instead of failing queries exceeding --query.max-series, return a deterministic, hash based sample of the limit number of matching series together with a warning.").
+		Default("false").Bool()
+
+	negativeCacheTTL := extkingpin.ModelDuration(cmd.Flag("query.negative-cache-ttl", "Time for which selects that returned no series are answered from the negative cache without querying StoreAPIs. Entries are invalidated earlier once StoreAPIs covering their time range change, e.g. new blocks arrive. 0 disables the cache.").
+		Default("0s"))
+
+	negativeCacheMaxEntries := cmd.Flag("query.negative-cache-max-entries", "Maximum number of selects kept in the negative cache. Least recently used entries are evicted first.").
+		Default("10000").Int()
+
+	ignoreNewerThan := extkingpin.ModelDuration(cmd.Flag("query.ignore-newer-than", "Ignore data newer than this duration by trimming the time range of selects and label requests, so that StoreAPIs holding only the freshest data are not queried. Useful for trading freshness for stable results, as the most recent data may be still incomplete. 0 disables trimming.").
+		Default("0s"))
+
+	dedupWindow := extkingpin.ModelDuration(cmd.Flag("query.dedup-window", "Maximum time deduplication skips ahead in replicas other than the one the last sample was taken from. Deduplication skips samples of other replicas closer than twice the last sample interval, which gets unbounded after long gaps, e.g. when all replicas were down. A larger window deduplicates replicas with irregular scrape intervals more reliably, a smaller one bounds the data skipped and the work of skipping it, but yields extra samples if shorter than twice the scrape interval. 0 disables the limit.").
+		Default("0s"))
+
+	dedupWarnSingleReplica := cmd.Flag("query.dedup-warn-single-replica", "If true, deduplicated responses warn about series with replica labels present in one replica only, counted also by thanos_query_dedup_single_replica_series_total metric. Such series are returned unchanged, but they often indicate scraping asymmetry, e.g. a target reachable by one replica of an HA pair only.").
+		Default("false").Bool()
+
+	dedupWarnCounterResets := cmd.Flag("query.dedup-warn-counter-resets", "If true, deduplicated responses warn about counter series with counter resets caused by switching between replicas rather than by restarts, counted also by thanos_query_dedup_replica_counter_reset_series_total metric. Such series are returned unchanged, but they often indicate misconfigured replica labels or replicas drifting apart, which overestimates rate(). Counters are recognized by _total, _count, _sum and _bucket name suffixes, downsampled counter aggregates are checked regardless of names. Resets are detected while series are evaluated, so only instant and range queries warn about them.").
+		Default("false").Bool()
+
+	metricAliasesConfig := extflag.RegisterPathOrContent(cmd, "query.metric-aliases.config",
+		"YAML list of metric names aliased to the names they were renamed to. Selects of an aliased name are rewritten to select the new name, or both names in union mode, and the series are returned under the aliased name. See format details: https://thanos.io/tip/components/query.md/#metric-aliases",
+		false)
+
+	clustersConfig := extflag.RegisterPathOrContent(cmd, "query.clusters.config",
+		"YAML list of remote Thanos clusters queried through the StoreAPI of their queriers, each with own TLS, bearer token auth and external labels added to all its series. See format details: https://thanos.io/tip/components/query.md/#remote-clusters",
+		false)
+
+	maxLabelValueLength := cmd.Flag("query.max-label-value-length", "Maximum length in bytes of label values of series returned by StoreAPIs. Series with longer label values, e.g. produced by a misbehaving exporter, are handled according to --query.label-value-length-mode, and a warning is returned with the response. 0 disables the limit.").
+		Default("0").Int()
+
+	labelValueLengthMode := cmd.Flag("query.label-value-length-mode", "What happens to series with label values longer than --query.max-label-value-length. 'truncate' keeps the beginning of too long values followed by a hash of the whole value, so that truncated series do not collide. 'reject' drops such series.").
+		Default(string(store.LabelValueLengthTruncate)).Enum(string(store.LabelValueLengthTruncate), string(store.LabelValueLengthReject))
+
+	exportRemoteWriteURL := cmd.Flag("query.export.remote-write-url", "URL of the Prometheus remote write endpoint to which the /api/v1/export endpoint sends merged series matching requested selectors. Export endpoint is disabled if empty.").
+		Default("").String()
+
+	exportRemoteWriteTimeout := extkingpin.ModelDuration(cmd.Flag("query.export.remote-write-timeout", "Timeout of a single remote write request sent by the export endpoint.").
+		Default("30s"))
+
+	exportMaxSamplesPerBatch := cmd.Flag("query.export.max-samples-per-batch", "Maximum number of samples in a single remote write request sent by the export endpoint.").
+		Default("500").Int()
+
+	exportMaxRetries := cmd.Flag("query.export.max-retries", "Maximum number of retries of a remote write request failed with a recoverable error, i.e. network error or 5xx response.").
+		Default("3").Int()
+
+	queryReplicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter. Data includes time series, recording rules, and alerting rules. If not specified, see --query.default-replica-labels.").
 		Strings()
 
+	useDefaultReplicaLabels := cmd.Flag("query.default-replica-labels", fmt.Sprintf("If true and no --query.replica-label is specified, data is deduplicated along the default replica labels: %s. --no-query.default-replica-labels for disabling.", strings.Join(defaultReplicaLabels, ", "))).
+		Default("true").Bool()
+
 	instantDefaultMaxSourceResolution := extkingpin.ModelDuration(cmd.Flag("query.instant.default.max_source_resolution", "default value for max_source_resolution for instant queries. If not set, defaults to 0s only taking raw resolution into account. 1h can be a good value if you use instant queries over time ranges that incorporate times outside of your raw-retention.").Default("0s").Hidden())
 
 	defaultMetadataTimeRange := cmd.Flag("query.metadata.default-time-range", "The default metadata time range duration for retrieving labels through Labels and Series API when the range parameters are not specified. The zero value means range covers the time since the beginning.").Default("0s").Duration()
@@ -112,12 +201,45 @@ func registerQuery(app *extkingpin.App) {
 
 	unhealthyStoreTimeout := extkingpin.ModelDuration(cmd.Flag("store.unhealthy-timeout", "Timeout before an unhealthy store is cleaned from the store UI page.").Default("5m"))
 
+	connPoolSize := cmd.Flag("store.connection-pool-size", "Number of gRPC connections opened to each StoreAPI. Series requests are round-robined across them, so that concurrent queries are not limited by the maximum number of concurrent streams of a single HTTP/2 connection.").
+		Default("1").Int()
+
+	maxClockSkew := extkingpin.ModelDuration(cmd.Flag("store.max-clock-skew", "Maximum duration by which times advertised by StoreAPIs can be in the future. Time ranges of StoreAPIs exceeding it, e.g. because of their clock skew, are clamped, so they are not wrongly pruned from queries. Clamped StoreAPIs are reported by thanos_store_nodes_clock_skewed metric. 0 disables clamping.").
+		Default("1h"))
+
 	enableAutodownsampling := cmd.Flag("query.auto-downsampling", "Enable automatic adjustment (step / 5) to what source of data should be used in store gateways if no max_source_resolution param is specified.").
 		Default("false").Bool()
 
+	autoDownsamplingClampRatio := cmd.Flag("query.auto-downsampling.clamp-ratio", "Range queries with range/step ratio, i.e. number of steps, at most this value are clamped to the coarsest downsampling resolution that fits at least 5 samples between steps, if no max_source_resolution param is specified. Explicit max_source_resolution=0 forces raw data. 0 disables clamping.").
+		Default(strconv.Itoa(v1.DefaultAutoDownsamplingClampRatio)).Int()
+
+	resolutionOverlapPolicy := cmd.Flag("query.resolution-overlap-policy", "Policy used when raw and downsampled data of the same series overlap in time, e.g. before raw blocks are removed after downsampling. 'prefer-raw' drops overlapping downsampled data (accuracy), 'prefer-downsampled' drops overlapping raw data (cost), 'none' merges both as they are.").
+		Default(string(query.ResolutionOverlapNone)).Enum(string(query.ResolutionOverlapNone), string(query.ResolutionOverlapPreferRaw), string(query.ResolutionOverlapPreferDownsampled))
+
+	instantPreferRaw := cmd.Flag("query.instant-prefer-raw", "If true, instant queries use only raw data of series having any raw data within the lookback window, regardless of --query.resolution-overlap-policy. This makes results at boundaries of raw and downsampled data deterministic: the latest sample is always taken from the finest available resolution.").
+		Default("false").Bool()
+
+	dropDuplicateBlocks := cmd.Flag("query.drop-duplicate-blocks", "If true, StoreAPIs are asked for block IDs of returned chunks and chunks of blocks returned by more than one StoreAPI, e.g. by store gateways with overlapping shards during resharding, are dropped when series of StoreAPIs are merged. Only one copy of each block is used, which is cheaper than deduplicating its samples. Slightly increases the size of StoreAPI responses.").
+		Default("false").Bool()
+
+	corruptChunkPolicy := cmd.Flag("query.corrupt-chunk-policy", "Policy used when chunks returned by StoreAPIs fail to decode, e.g. because of a corrupted block. 'fail' fails the query, 'skip' drops such chunks for queries with partial response enabled, returning their series with gaps and a warning. Chunks are skipped from the first sample failing to decode, samples decoded before are kept.").
+		Default(string(query.CorruptChunkFail)).Enum(string(query.CorruptChunkFail), string(query.CorruptChunkSkip))
+
 	enableQueryPartialResponse := cmd.Flag("query.partial-response", "Enable partial response for queries if no partial_response param is specified. --no-query.partial-response for disabling.").
 		Default("true").Bool()
 
+	partialResponseFailOnUnavailable := cmd.Flag("query.partial-response.fail-on-unavailable", "If true, queries fail even with partial response enabled if any StoreAPI is unreachable or times out, instead of returning a warning.").
+		Default("false").Bool()
+
+	partialResponseFailOnStoreFailure := cmd.Flag("query.partial-response.fail-on-store-failure", "If true, queries fail even with partial response enabled if any StoreAPI returns an error, e.g. because a limit is exceeded or the request is invalid, instead of returning a warning. Unreachable StoreAPIs and timeouts are controlled by --query.partial-response.fail-on-unavailable.").
+		Default("false").Bool()
+
+	fdExhaustionRetries := cmd.Flag("store.fd-exhaustion-retries", "Number of times requests to StoreAPIs failing because the querier ran out of file descriptors (too many open files) are retried. Requests to all StoreAPIs are paused for --store.fd-exhaustion-backoff before each retry, doubled with every retry of the same request.").
+		Default("3").Int()
+
+	fdExhaustionBackoff := extkingpin.ModelDuration(cmd.Flag("store.fd-exhaustion-backoff", "Time requests to all StoreAPIs are paused for once the querier ran out of file descriptors, so that finishing requests release them before new connections are opened.").
+		Default("100ms"))
+
 	enableRulePartialResponse := cmd.Flag("rule.partial-response", "Enable partial response for rules endpoint. --no-rule.partial-response for disabling.").
 		Hidden().Default("true").Bool()
 
@@ -125,6 +247,9 @@ func registerQuery(app *extkingpin.App) {
 
 	storeResponseTimeout := extkingpin.ModelDuration(cmd.Flag("store.response-timeout", "If a Store doesn't send any data in this specified duration then a Store will be ignored and partial data will be returned if it's enabled. 0 disables timeout.").Default("0ms"))
 
+	warnCoverageGaps := cmd.Flag("query.warn-coverage-gaps", "If true, queries return warnings about parts of the queried time range not covered by any StoreAPI, e.g. data no longer available due to retention or not uploaded yet, so that such gaps are not mistaken for missing scrapes.").
+		Default("false").Bool()
+
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
 		selectorLset, err := parseFlagLabels(*selectorLabels)
 		if err != nil {
@@ -148,6 +273,11 @@ func registerQuery(app *extkingpin.App) {
 			fileSD = file.NewDiscovery(conf, logger)
 		}
 
+		resultTransformer, err := v1.NewResultTransformer(*resultTransformerNames)
+		if err != nil {
+			return errors.Wrap(err, "result transformer")
+		}
+
 		if *webRoutePrefix == "" {
 			*webRoutePrefix = *webExternalPrefix
 		}
@@ -183,7 +313,7 @@ func registerQuery(app *extkingpin.App) {
 			*lookbackDelta,
 			time.Duration(*defaultEvaluationInterval),
 			time.Duration(*storeResponseTimeout),
-			*queryReplicaLabels,
+			replicaLabelsOrDefault(logger, *queryReplicaLabels, *useDefaultReplicaLabels),
 			selectorLset,
 			getFlagsMap(cmd.Flags()),
 			*stores,
@@ -198,11 +328,85 @@ func registerQuery(app *extkingpin.App) {
 			time.Duration(*instantDefaultMaxSourceResolution),
 			*defaultMetadataTimeRange,
 			*strictStores,
+			queryConfig{
+				compressionPreference: *compressionPreference,
+				admissionConfig: gate.AdmissionConfig{
+					MaxInFlight:  *admissionMaxInFlight,
+					MaxHeapBytes: uint64(*admissionMaxHeapBytes),
+					Queue:        *admissionQueue,
+				},
+				tenantHeader:               *tenantHeader,
+				resultTransformer:          resultTransformer,
+				maxRangeQueryPoints:        *maxRangeQueryPoints,
+				autoDownsamplingClampRatio: *autoDownsamplingClampRatio,
+				negativeCacheTTL:           time.Duration(*negativeCacheTTL),
+				negativeCacheMaxEntries:    *negativeCacheMaxEntries,
+				metricAliasesConfig:        metricAliasesConfig,
+				clustersConfig:             clustersConfig,
+				maxLabelValueLength:        *maxLabelValueLength,
+				labelValueLengthMode:       store.LabelValueLengthMode(*labelValueLengthMode),
+				queryableOpts: query.QueryableCreatorOpts{
+					MergeTimeout:            time.Duration(*mergeTimeout),
+					ResolutionOverlapPolicy: query.ResolutionOverlapPolicy(*resolutionOverlapPolicy),
+					MaxSeries:               *maxSeries,
+					SampleOverSeriesLimit:   *sampleOverSeriesLimit,
+					SeriesLimitAccounting:   query.SeriesLimitAccounting(*seriesLimitAccounting),
+					MaxOutputSeries:         *maxOutputSeries,
+					IgnoreNewerThan:         time.Duration(*ignoreNewerThan),
+					DedupWindow:             time.Duration(*dedupWindow),
+					FlagSingleReplica:       *dedupWarnSingleReplica,
+					FlagCounterResets:       *dedupWarnCounterResets,
+					InstantPreferRaw:        *instantPreferRaw,
+					CorruptChunkPolicy:      query.CorruptChunkPolicy(*corruptChunkPolicy),
+				},
+				exportRemoteWriteURL:     *exportRemoteWriteURL,
+				exportRemoteWriteTimeout: time.Duration(*exportRemoteWriteTimeout),
+				exportMaxSamplesPerBatch: *exportMaxSamplesPerBatch,
+				exportMaxRetries:         *exportMaxRetries,
+				proxyOpts: store.ProxyStoreOpts{
+					WarnCoverageGaps:    *warnCoverageGaps,
+					DropDuplicateBlocks: *dropDuplicateBlocks,
+					PartialResponsePolicy: store.PartialResponsePolicy{
+						FailOnUnavailable:  *partialResponseFailOnUnavailable,
+						FailOnStoreFailure: *partialResponseFailOnStoreFailure,
+					},
+					FDExhaustionBackoff: store.FDExhaustionBackoff{
+						Retries: *fdExhaustionRetries,
+						Backoff: time.Duration(*fdExhaustionBackoff),
+					},
+				},
+				connPoolSize: *connPoolSize,
+				maxClockSkew: time.Duration(*maxClockSkew),
+			},
 			component.Query,
 		)
 	})
 }
 
+// queryConfig holds options of StoreAPI connections, selects and the query API of the querier.
+type queryConfig struct {
+	compressionPreference      []string
+	admissionConfig            gate.AdmissionConfig
+	tenantHeader               string
+	resultTransformer          v1.ResultTransformer
+	maxRangeQueryPoints        int
+	autoDownsamplingClampRatio int
+	negativeCacheTTL           time.Duration
+	negativeCacheMaxEntries    int
+	metricAliasesConfig        *extflag.PathOrContent
+	clustersConfig             *extflag.PathOrContent
+	maxLabelValueLength        int
+	labelValueLengthMode       store.LabelValueLengthMode
+	queryableOpts              query.QueryableCreatorOpts
+	exportRemoteWriteURL       string
+	exportRemoteWriteTimeout   time.Duration
+	exportMaxSamplesPerBatch   int
+	exportMaxRetries           int
+	proxyOpts                  store.ProxyStoreOpts
+	connPoolSize               int
+	maxClockSkew               time.Duration
+}
+
 // runQuery starts a server that exposes PromQL Query API. It is responsible for querying configured
 // store nodes, merging and duplicating the data to satisfy user query.
 func runQuery(
@@ -247,6 +451,7 @@ func runQuery(
 	instantDefaultMaxSourceResolution time.Duration,
 	defaultMetadataTimeRange time.Duration,
 	strictStores []string,
+	conf queryConfig,
 	comp component.Component,
 ) error {
 	// TODO(bplotka in PR #513 review): Move arguments into struct.
@@ -255,10 +460,15 @@ func runQuery(
 		Help: "The number of times a duplicated store addresses is detected from the different configs in query",
 	})
 
-	dialOpts, err := extgrpc.StoreClientGRPCOpts(logger, reg, tracer, secure, cert, key, caCert, serverName)
+	baseDialOpts := extgrpc.StoreClientBaseGRPCOpts(reg, tracer)
+	transportOpt, err := extgrpc.ClientTransportGRPCOpt(logger, secure, cert, key, caCert, serverName)
 	if err != nil {
 		return errors.Wrap(err, "building gRPC client")
 	}
+	dialOpts := append(append([]grpc.DialOption{}, baseDialOpts...), transportOpt)
+	if err := extgrpc.ValidateCompressors(conf.compressionPreference); err != nil {
+		return errors.Wrap(err, "gRPC client compression")
+	}
 
 	fileSDCache := cache.New()
 	dnsStoreProvider := dns.NewProvider(
@@ -273,6 +483,25 @@ func runQuery(
 		}
 	}
 
+	clustersYaml, err := conf.clustersConfig.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of clusters configuration")
+	}
+	var clusterSpecs []query.StoreSpec
+	if len(clustersYaml) > 0 {
+		clusters, err := query.ParseClusterConfigs(clustersYaml)
+		if err != nil {
+			return err
+		}
+		for _, c := range clusters {
+			spec, err := query.NewClusterStoreSpec(logger, c, baseDialOpts)
+			if err != nil {
+				return err
+			}
+			clusterSpecs = append(clusterSpecs, spec)
+		}
+	}
+
 	dnsRuleProvider := dns.NewProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_querier_rule_apis_", reg),
@@ -293,6 +522,8 @@ func runQuery(
 				for _, addr := range dnsStoreProvider.Addresses() {
 					specs = append(specs, query.NewGRPCStoreSpec(addr, false))
 				}
+				// Add remote clusters.
+				specs = append(specs, clusterSpecs...)
 				return removeDuplicateStoreSpecs(logger, duplicatedStores, specs)
 			},
 			func() (specs []query.RuleSpec) {
@@ -306,16 +537,70 @@ func runQuery(
 				return specs
 			},
 			dialOpts,
+			conf.compressionPreference,
+			conf.connPoolSize,
+			conf.maxClockSkew,
 			unhealthyStoreTimeout,
 		)
-		proxy            = store.NewProxyStore(logger, reg, stores.Get, component.Query, selectorLset, storeResponseTimeout)
-		rulesProxy       = rules.NewProxy(logger, stores.GetRulesClients)
+		proxy      = store.NewProxyStore(logger, reg, stores.Get, component.Query, selectorLset, storeResponseTimeout, conf.proxyOpts)
+		rulesProxy = rules.NewProxy(logger, stores.GetRulesClients)
+	)
+
+	var negativeCache *query.NegativeCache
+	if conf.negativeCacheTTL > 0 {
+		negativeCache, err = query.NewNegativeCache(reg, conf.negativeCacheTTL, conf.negativeCacheMaxEntries, stores.Get)
+		if err != nil {
+			return errors.Wrap(err, "create negative cache")
+		}
+	}
+
+	metricAliasesYaml, err := conf.metricAliasesConfig.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of metric aliases configuration")
+	}
+	var metricAliases *query.MetricAliases
+	if len(metricAliasesYaml) > 0 {
+		if metricAliases, err = query.ParseMetricAliases(metricAliasesYaml); err != nil {
+			return err
+		}
+	}
+
+	var labelValueGuard *store.LabelValueLengthGuard
+	if conf.maxLabelValueLength > 0 {
+		labelValueGuard, err = store.NewLabelValueLengthGuard(extprom.WrapRegistererWithPrefix("thanos_query_", reg), conf.maxLabelValueLength, conf.labelValueLengthMode)
+		if err != nil {
+			return errors.Wrap(err, "create label value length guard")
+		}
+	}
+
+	conf.queryableOpts.NegativeCache = negativeCache
+	conf.queryableOpts.MetricAliases = metricAliases
+	conf.queryableOpts.LabelValueGuard = labelValueGuard
+
+	var exporter *query.RemoteWriteExporter
+	if conf.exportRemoteWriteURL != "" {
+		u, err := url.Parse(conf.exportRemoteWriteURL)
+		if err != nil {
+			return errors.Wrap(err, "parse export remote write url")
+		}
+		client, err := remote.NewWriteClient("export", &remote.ClientConfig{
+			URL:     &config_util.URL{URL: u},
+			Timeout: model.Duration(conf.exportRemoteWriteTimeout),
+		})
+		if err != nil {
+			return errors.Wrap(err, "create export remote write client")
+		}
+		exporter = query.NewRemoteWriteExporter(logger, reg, client, conf.exportMaxSamplesPerBatch, conf.exportMaxRetries)
+	}
+
+	var (
 		queryableCreator = query.NewQueryableCreator(
 			logger,
 			extprom.WrapRegistererWithPrefix("thanos_query_", reg),
 			proxy,
 			maxConcurrentSelects,
 			queryTimeout,
+			conf.queryableOpts,
 		)
 		engine = promql.NewEngine(
 			promql.EngineOpts{
@@ -437,6 +722,14 @@ func runQuery(
 		// TODO(bplotka in PR #513 review): pass all flags, not only the flags needed by prefix rewriting.
 		ui.NewQueryUI(logger, stores, webExternalPrefix, webPrefixHeaderName).Register(router, ins)
 
+		queryGate := gate.New(
+			extprom.WrapRegistererWithPrefix("thanos_query_concurrent_", reg),
+			maxConcurrentQueries,
+		)
+		if conf.admissionConfig.MaxInFlight > 0 || conf.admissionConfig.MaxHeapBytes > 0 {
+			queryGate = gate.NewAdmissionGate(extprom.WrapRegistererWithPrefix("thanos_query_admission_", reg), queryGate, conf.admissionConfig)
+		}
+
 		api := v1.NewQueryAPI(
 			logger,
 			stores,
@@ -451,10 +744,16 @@ func runQuery(
 			flagsMap,
 			instantDefaultMaxSourceResolution,
 			defaultMetadataTimeRange,
-			gate.New(
-				extprom.WrapRegistererWithPrefix("thanos_query_concurrent_", reg),
-				maxConcurrentQueries,
-			),
+			queryGate,
+			v1.QueryAPIOpts{
+				AutoDownsamplingClampRatio: conf.autoDownsamplingClampRatio,
+				DefaultLookbackDelta:       lookbackDelta,
+				MaxRangeQueryPoints:        conf.maxRangeQueryPoints,
+				MaxOutputSeries:            conf.queryableOpts.MaxOutputSeries,
+				Exporter:                   exporter,
+				TenantHeader:               conf.tenantHeader,
+				ResultTransformer:          conf.resultTransformer,
+			},
 		)
 
 		api.Register(router.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
@@ -536,3 +835,21 @@ func firstDuplicate(ss []string) string {
 
 	return ""
 }
+
+// defaultReplicaLabels are replica labels used by common HA setups, e.g. Prometheus Operator.
+var defaultReplicaLabels = []string{"replica", "prometheus_replica"}
+
+// replicaLabelsOrDefault returns the configured replica labels, or the default ones if none are configured and defaults
+// are enabled, so that deduplication of HA data works without configuration.
+func replicaLabelsOrDefault(logger log.Logger, replicaLabels []string, useDefault bool) []string {
+	switch {
+	case len(replicaLabels) > 0:
+		level.Info(logger).Log("msg", "deduplicating along configured replica labels", "labels", strings.Join(replicaLabels, ","))
+	case useDefault:
+		replicaLabels = defaultReplicaLabels
+		level.Info(logger).Log("msg", "no replica labels configured, deduplicating along default replica labels; use --query.replica-label to override", "labels", strings.Join(replicaLabels, ","))
+	default:
+		level.Info(logger).Log("msg", "no replica labels configured, deduplication has no effect")
+	}
+	return replicaLabels
+}
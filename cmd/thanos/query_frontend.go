@@ -53,6 +53,9 @@ func registerQueryFrontend(app *extkingpin.App) {
 	cmd.Flag("query-range.split-interval", "Split queries by an interval and execute in parallel, it should be greater than 0 when response-cache-config is configured.").
 		Default("24h").DurationVar(&cfg.SplitQueriesByInterval)
 
+	cmd.Flag("query-range.align-range-with-step", "Mutate incoming queries to align their start and end with their step, so that queries differing in start or end by less than the step, e.g. by milliseconds, share results cache entries. Results of aligned queries are evaluated at timestamps shifted by less than the step. If false, queries are evaluated at their exact start and end, and only queries on the same step grid share results cache entries.").
+		Default("true").BoolVar(&cfg.AlignRangeWithStep)
+
 	cmd.Flag("query-range.max-retries-per-request", "Maximum number of retries for a single request; beyond this, the downstream error is returned.").
 		Default("5").IntVar(&cfg.MaxRetries)
 
@@ -0,0 +1,37 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func Test_replicaLabelsOrDefault(t *testing.T) {
+	for _, tcase := range []struct {
+		replicaLabels []string
+		useDefault    bool
+		expected      []string
+	}{
+		{
+			useDefault: true,
+			expected:   []string{"replica", "prometheus_replica"},
+		},
+		{
+			replicaLabels: []string{"rule_replica"},
+			useDefault:    true,
+			expected:      []string{"rule_replica"},
+		},
+		{
+			replicaLabels: []string{"rule_replica"},
+			expected:      []string{"rule_replica"},
+		},
+		{},
+	} {
+		testutil.Equals(t, tcase.expected, replicaLabelsOrDefault(log.NewNopLogger(), tcase.replicaLabels, tcase.useDefault))
+	}
+}
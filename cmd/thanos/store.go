@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -15,10 +16,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/route"
+	"gopkg.in/yaml.v2"
 
 	blocksAPI "github.com/thanos-io/thanos/pkg/api/blocks"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/indexheader"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/extflag"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
@@ -27,6 +31,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/logging"
 	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -34,6 +39,7 @@ import (
 	httpserver "github.com/thanos-io/thanos/pkg/server/http"
 	"github.com/thanos-io/thanos/pkg/store"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/tls"
 	"github.com/thanos-io/thanos/pkg/ui"
 )
@@ -68,9 +74,23 @@ func registerStore(app *extkingpin.App) {
 		"Maximum amount of samples returned via a single Series call. The Series call fails if this limit is exceeded. 0 means no limit. NOTE: For efficiency the limit is internally implemented as 'chunks limit' considering each chunk contains 120 samples (it's the max number of samples each chunk can contain), so the actual number of samples might be lower, even though the maximum could be hit.").
 		Default("0").Uint()
 
+	seriesResponseBudget := cmd.Flag("store.grpc.series-response-budget", "Soft limit of the size of series returned via a single Series call. Once series sent so far exceed it, the Series call stops early: with partial response enabled, series sent so far are returned with a 'response budget exceeded' warning, otherwise the call fails. 0 means no limit.").
+		Default("0B").Bytes()
+
 	maxConcurrent := cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").Int()
 
-	objStoreConfig := extkingpin.RegisterCommonObjStoreFlags(cmd, "", true)
+	objStoreConfig := extkingpin.RegisterCommonObjStoreFlags(cmd, "", false)
+
+	tenantBucketsConfig := extflag.RegisterPathOrContent(cmd, "store.tenant-buckets.config",
+		"YAML list of tenants and buckets holding their blocks, used instead of --objstore.config. Requests are served only from the bucket of their tenant and rejected if the tenant is unknown. See format details: https://thanos.io/tip/components/store.md/#per-tenant-buckets",
+		false)
+
+	warmupConfig := extflag.RegisterPathOrContent(cmd, "store.warmup.config",
+		"YAML with representative queries replayed at startup after the initial sync, before the store becomes ready, to populate index-headers, index cache and caching bucket with data they touch. See format details: https://thanos.io/tip/components/store.md/#warmup",
+		false)
+
+	tenantHeader := cmd.Flag("store.tenant-header", "gRPC metadata key carrying the tenant of requests if --store.tenant-buckets.config is set.").
+		Default(store.DefaultTenantHeader).String()
 
 	syncInterval := cmd.Flag("sync-block-duration", "Repeat interval for syncing the blocks between local and remote view.").
 		Default("3m").Duration()
@@ -94,6 +114,36 @@ func registerStore(app *extkingpin.App) {
 		"On the contrary, smaller value will increase baseline memory usage, but improve latency slightly. 1 will keep all in memory. Default value is the same as in Prometheus which gives a good balance.").
 		Hidden().Default(fmt.Sprintf("%v", store.DefaultPostingOffsetInMemorySampling)).Int()
 
+	indexHeaderMemoryBudget := cmd.Flag("store.index-header-memory-budget", "Maximum total size of index-headers held in memory. Index-headers are loaded on first use and least recently used ones are unloaded once the budget is exceeded. 0 disables lazy loading and keeps index-headers of all blocks loaded.").
+		Default("0B").Bytes()
+
+	sharedIndexDir := cmd.Flag("store.shared-index-dir", "Directory with index-headers shared by multiple store gateways, e.g. a read-only volume mounted by all of them, laid out like the data directory of a store gateway: <dir>/<block ID>/index-header. If set, index-headers are read from it, and memory-mapped pages are shared by all store gateways on the host, instead of each building and loading its own copy. It has to be populated by another process, e.g. a store gateway using it as its data directory. Blocks without index-header in it fail to load until it appears. Takes precedence over --store.index-header-memory-budget.").
+		Default("").String()
+
+	expandedPostingsCacheTTL := extkingpin.ModelDuration(cmd.Flag("store.expanded-postings-cache.ttl", "How long series of a block matching a set of matchers are cached, so that repeated queries with the same matchers, e.g. from dashboards, do not resolve and intersect the same postings again. Entries of a block are removed once the block is unloaded. 0 disables the cache.").
+		Default("0s"))
+
+	expandedPostingsCacheSize := cmd.Flag("store.expanded-postings-cache.size", "Maximum total size of postings held in the expanded postings cache.").
+		Default("100MB").Bytes()
+
+	maxLabelValueLength := cmd.Flag("store.max-label-value-length", "Maximum length in bytes of label values of series loaded from blocks. Series with longer label values, e.g. produced by a misbehaving exporter, are handled according to --store.label-value-length-mode, and a warning is returned with the response. 0 disables the limit.").
+		Default("0").Int()
+
+	labelValueLengthMode := cmd.Flag("store.label-value-length-mode", "What happens to series with label values longer than --store.max-label-value-length. 'truncate' keeps the beginning of too long values followed by a hash of the whole value, so that truncated series do not collide. 'reject' drops such series.").
+		Default(string(store.LabelValueLengthTruncate)).Enum(string(store.LabelValueLengthTruncate), string(store.LabelValueLengthReject))
+
+	blockVerification := cmd.Flag("store.block-verification", "Integrity verification of blocks before they are loaded. 'quick' checks index TOC checksum, segment file headers and CRC of the first chunk of each segment file. 'full' additionally checks the whole index and CRC of all chunks, reading the whole block. Corrupted blocks are not loaded.").
+		Default(string(block.VerificationNone)).Enum(string(block.VerificationNone), string(block.VerificationQuick), string(block.VerificationFull))
+
+	tailChunksMinSamples := cmd.Flag("store.tail-chunks.min-samples", "For requests asking only for the latest sample of series, e.g. from /api/v1/query_last of Querier, return only tail chunks of series holding at least this many samples. Sparser series are returned with all their chunks within the requested time range. 0 disables trimming.").
+		Default("0").Int()
+
+	autoResolution5mMinAge := extkingpin.ModelDuration(cmd.Flag("store.auto-resolution.5m-min-age", "Minimum age of blocks served in 5m resolution, if available, even if requests ask for raw data, so that old parts of requests spanning data of different ages are served from downsampled blocks and recent parts from raw ones. Age of a block is the time since its end. Each part of a request is still served in one resolution only. 0 disables it.").
+		Default("0s"))
+
+	autoResolution1hMinAge := extkingpin.ModelDuration(cmd.Flag("store.auto-resolution.1h-min-age", "Minimum age of blocks served in 1h resolution, if available, even if requests ask for finer resolution. See --store.auto-resolution.5m-min-age. 0 disables it.").
+		Default("0s"))
+
 	enablePostingsCompression := cmd.Flag("experimental.enable-index-cache-postings-compression", "If true, Store Gateway will reencode and compress postings before storing them into cache. Compressed postings take about 10% of the original size.").
 		Hidden().Default("false").Bool()
 
@@ -110,6 +160,8 @@ func registerStore(app *extkingpin.App) {
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the bucket web UI interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos bucket web UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
 	webPrefixHeaderName := cmd.Flag("web.prefix-header", "Name of HTTP request header used for dynamic prefixing of UI links and redirects. This option is ignored if web.external-prefix argument is set. Security risk: enable this option only if a reverse proxy in front of thanos is resetting the header. The --web.prefix-header=X-Forwarded-Prefix option can be useful, for example, if Thanos UI is served via Traefik reverse proxy with PathPrefixStrip option enabled, which sends the stripped prefix value in X-Forwarded-Prefix header. This allows thanos UI to be served on a sub-path.").Default("").String()
 
+	webEnableAdminAPI := cmd.Flag("web.enable-admin-api", "Enable API endpoints for admin control actions, e.g. evicting blocks from memory.").Default("false").Bool()
+
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, debugLogging bool) error {
 		if minTime.PrometheusTimestamp() > maxTime.PrometheusTimestamp() {
 			return errors.Errorf("invalid argument: --min-time '%s' can't be greater than --max-time '%s'",
@@ -149,13 +201,48 @@ func registerStore(app *extkingpin.App) {
 			time.Duration(*ignoreDeletionMarksDelay),
 			*webExternalPrefix,
 			*webPrefixHeaderName,
+			*webEnableAdminAPI,
 			*postingOffsetsInMemSampling,
 			cachingBucketConfig,
+			storeConfig{
+				indexHeaderMemoryBudget:   int64(*indexHeaderMemoryBudget),
+				sharedIndexDir:            *sharedIndexDir,
+				expandedPostingsCacheTTL:  time.Duration(*expandedPostingsCacheTTL),
+				expandedPostingsCacheSize: int64(*expandedPostingsCacheSize),
+				maxLabelValueLength:       *maxLabelValueLength,
+				labelValueLengthMode:      store.LabelValueLengthMode(*labelValueLengthMode),
+				blockVerification:         block.VerificationLevel(*blockVerification),
+				tailChunksMinSamples:      *tailChunksMinSamples,
+				seriesResponseBudget:      int64(*seriesResponseBudget),
+				autoResolution5mMinAge:    time.Duration(*autoResolution5mMinAge),
+				autoResolution1hMinAge:    time.Duration(*autoResolution1hMinAge),
+				tenantBucketsConfig:       tenantBucketsConfig,
+				warmupConfig:              warmupConfig,
+				tenantHeader:              *tenantHeader,
+			},
 			getFlagsMap(cmd.Flags()),
 		)
 	})
 }
 
+// storeConfig holds options of bucket stores served by the store gateway.
+type storeConfig struct {
+	indexHeaderMemoryBudget   int64
+	sharedIndexDir            string
+	expandedPostingsCacheTTL  time.Duration
+	expandedPostingsCacheSize int64
+	maxLabelValueLength       int
+	labelValueLengthMode      store.LabelValueLengthMode
+	blockVerification         block.VerificationLevel
+	tailChunksMinSamples      int
+	seriesResponseBudget      int64
+	autoResolution5mMinAge    time.Duration
+	autoResolution1hMinAge    time.Duration
+	tenantBucketsConfig       *extflag.PathOrContent
+	warmupConfig              *extflag.PathOrContent
+	tenantHeader              string
+}
+
 // runStore starts a daemon that serves queries to cluster peers using data from an object store.
 func runStore(
 	g *run.Group,
@@ -181,8 +268,10 @@ func runStore(
 	consistencyDelay time.Duration,
 	ignoreDeletionMarksDelay time.Duration,
 	externalPrefix, prefixHeader string,
+	enableAdminAPI bool,
 	postingOffsetsInMemSampling int,
 	cachingBucketConfig *extflag.PathOrContent,
+	conf storeConfig,
 	flagsMap map[string]string,
 ) error {
 	grpcProbe := prober.NewGRPC()
@@ -214,21 +303,23 @@ func runStore(
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, reg, component.String())
+	tenantBucketsYaml, err := conf.tenantBucketsConfig.Content()
 	if err != nil {
-		return errors.Wrap(err, "create bucket client")
+		return errors.Wrap(err, "get content of tenant buckets configuration")
+	}
+	var tenantBuckets []store.TenantBucketConfig
+	if len(tenantBucketsYaml) > 0 {
+		if tenantBuckets, err = store.ParseTenantBucketsConfig(tenantBucketsYaml); err != nil {
+			return err
+		}
+	} else if len(confContentYaml) == 0 {
+		return errors.New("no bucket configured, either --objstore.config or --store.tenant-buckets.config is required")
 	}
 
 	cachingBucketConfigYaml, err := cachingBucketConfig.Content()
 	if err != nil {
 		return errors.Wrap(err, "get caching bucket configuration")
 	}
-	if len(cachingBucketConfigYaml) > 0 {
-		bkt, err = storecache.NewCachingBucketFromYaml(cachingBucketConfigYaml, bkt, logger, reg)
-		if err != nil {
-			return errors.Wrap(err, "create caching bucket")
-		}
-	}
 
 	relabelContentYaml, err := selectorRelabelConf.Content()
 	if err != nil {
@@ -240,20 +331,25 @@ func runStore(
 		return err
 	}
 
+	warmupYaml, err := conf.warmupConfig.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of warmup configuration")
+	}
+	var warmer *store.Warmer
+	if len(warmupYaml) > 0 {
+		if warmer, err = store.NewWarmer(logger, reg, warmupYaml); err != nil {
+			return err
+		}
+	}
+
 	indexCacheContentYaml, err := indexCacheConfig.Content()
 	if err != nil {
 		return errors.Wrap(err, "get content of index cache configuration")
 	}
 
-	// Ensure we close up everything properly.
-	defer func() {
-		if err != nil {
-			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
-		}
-	}()
-
 	// Create the index cache loading its config from config file, while keeping
 	// backward compatibility with the pre-config file era.
+	// The cache is shared by stores of all tenants, as its items are keyed by block IDs.
 	var indexCache storecache.IndexCache
 	if len(indexCacheContentYaml) > 0 {
 		indexCache, err = storecache.NewIndexCache(logger, indexCacheContentYaml, reg)
@@ -267,19 +363,6 @@ func runStore(
 		return errors.Wrap(err, "create index cache")
 	}
 
-	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, ignoreDeletionMarksDelay)
-	metaFetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, bkt, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg),
-		[]block.MetadataFilter{
-			block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
-			block.NewLabelShardedMetaFilter(relabelConfig),
-			block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
-			ignoreDeletionMarkFilter,
-			block.NewDeduplicateFilter(),
-		}, nil)
-	if err != nil {
-		return errors.Wrap(err, "meta fetcher")
-	}
-
 	// Limit the concurrency on queries against the Thanos store.
 	if maxConcurrency < 0 {
 		return errors.Errorf("max concurrency value cannot be lower than 0 (got %v)", maxConcurrency)
@@ -287,26 +370,157 @@ func runStore(
 
 	queriesGate := gate.New(extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg), maxConcurrency)
 
-	bs, err := store.NewBucketStore(
-		logger,
-		reg,
-		bkt,
-		metaFetcher,
-		dataDir,
-		indexCache,
-		queriesGate,
-		chunkPoolSizeBytes,
-		store.NewChunksLimiterFactory(maxSampleCount/store.MaxSamplesPerChunk), // The samples limit is an approximation based on the max number of samples per chunk.
-		verbose,
-		blockSyncConcurrency,
-		filterConf,
-		advertiseCompatibilityLabel,
-		enablePostingsCompression,
-		postingOffsetsInMemSampling,
-		false,
+	var indexHeaderPool *indexheader.ReaderPool
+	if conf.indexHeaderMemoryBudget > 0 {
+		indexHeaderPool = indexheader.NewReaderPool(logger, reg, conf.indexHeaderMemoryBudget)
+	}
+	var postingsCache *store.ExpandedPostingsCache
+	if conf.expandedPostingsCacheTTL > 0 {
+		postingsCache, err = store.NewExpandedPostingsCache(reg, conf.expandedPostingsCacheTTL, conf.expandedPostingsCacheSize)
+		if err != nil {
+			return errors.Wrap(err, "create expanded postings cache")
+		}
+	}
+	var autoResolutions []store.AutoResolution
+	if conf.autoResolution1hMinAge > 0 {
+		autoResolutions = append(autoResolutions, store.AutoResolution{Resolution: downsample.ResLevel2, MinAge: conf.autoResolution1hMinAge})
+	}
+	if conf.autoResolution5mMinAge > 0 {
+		autoResolutions = append(autoResolutions, store.AutoResolution{Resolution: downsample.ResLevel1, MinAge: conf.autoResolution5mMinAge})
+	}
+
+	var labelValueGuard *store.LabelValueLengthGuard
+	if conf.maxLabelValueLength > 0 {
+		labelValueGuard, err = store.NewLabelValueLengthGuard(extprom.WrapRegistererWithPrefix("thanos_bucket_store_", reg), conf.maxLabelValueLength, conf.labelValueLengthMode)
+		if err != nil {
+			return errors.Wrap(err, "create label value length guard")
+		}
+	}
+	var sharedIndex *indexheader.SharedDirIndex
+	if conf.sharedIndexDir != "" {
+		sharedIndex = indexheader.NewSharedDirIndex(conf.sharedIndexDir, postingOffsetsInMemSampling)
+	}
+
+	// newBucketStore creates the bucket client, meta fetcher and store of blocks in the given bucket.
+	newBucketStore := func(reg prometheus.Registerer, bucketConfYaml []byte, dataDir string) (objstore.InstrumentedBucket, *block.MetaFetcher, *store.BucketStore, error) {
+		bkt, err := client.NewBucket(logger, bucketConfYaml, reg, component.String())
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "create bucket client")
+		}
+		if len(cachingBucketConfigYaml) > 0 {
+			bkt, err = storecache.NewCachingBucketFromYaml(cachingBucketConfigYaml, bkt, logger, reg)
+			if err != nil {
+				runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+				return nil, nil, nil, errors.Wrap(err, "create caching bucket")
+			}
+		}
+
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, ignoreDeletionMarksDelay)
+		duplicateBlocksFilter := block.NewDeduplicateFilter()
+		// Blocks are discovered by iterating over the bucket. Other discovery can be plugged in as a block.MetadataSource.
+		baseFetcher, err := block.NewBaseFetcherWithSource(logger, fetcherConcurrency, block.NewBucketMetadataSource(logger, bkt), dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg))
+		if err != nil {
+			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			return nil, nil, nil, errors.Wrap(err, "meta fetcher")
+		}
+		metaFetcher := baseFetcher.NewMetaFetcher(extprom.WrapRegistererWithPrefix("thanos_", reg),
+			[]block.MetadataFilter{
+				block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
+				block.NewLabelShardedMetaFilter(relabelConfig),
+				block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
+				ignoreDeletionMarkFilter,
+				duplicateBlocksFilter,
+			}, nil)
+
+		bs, err := store.NewBucketStore(
+			logger,
+			reg,
+			bkt,
+			metaFetcher,
+			dataDir,
+			indexCache,
+			queriesGate,
+			chunkPoolSizeBytes,
+			store.NewChunksLimiterFactory(maxSampleCount/store.MaxSamplesPerChunk), // The samples limit is an approximation based on the max number of samples per chunk.
+			verbose,
+			blockSyncConcurrency,
+			filterConf,
+			advertiseCompatibilityLabel,
+			enablePostingsCompression,
+			postingOffsetsInMemSampling,
+			false,
+		)
+		if err != nil {
+			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			return nil, nil, nil, errors.Wrap(err, "create object storage store")
+		}
+		bs.SetDuplicateBlocksFilter(duplicateBlocksFilter)
+		if indexHeaderPool != nil {
+			bs.SetIndexHeaderReaderPool(indexHeaderPool)
+		}
+		if sharedIndex != nil {
+			bs.SetSharedIndex(sharedIndex)
+		}
+		if postingsCache != nil {
+			bs.SetExpandedPostingsCache(postingsCache)
+		}
+		if labelValueGuard != nil {
+			bs.SetLabelValueLengthGuard(labelValueGuard)
+		}
+		bs.SetBlockVerification(conf.blockVerification)
+		bs.SetTailChunksMinSamples(conf.tailChunksMinSamples)
+		bs.SetResponseBudget(conf.seriesResponseBudget)
+		if len(autoResolutions) > 0 {
+			bs.SetAutoResolutions(autoResolutions...)
+		}
+		return bkt, metaFetcher, bs, nil
+	}
+
+	var (
+		bkts         []objstore.InstrumentedBucket
+		bucketStores []*store.BucketStore
+		metaFetcher  *block.MetaFetcher
+		storeServer  storepb.StoreServer
 	)
-	if err != nil {
-		return errors.Wrap(err, "create object storage store")
+	// Ensure we close up everything properly.
+	defer func() {
+		if err != nil {
+			for _, bkt := range bkts {
+				runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			}
+		}
+	}()
+
+	if len(tenantBuckets) == 0 {
+		var (
+			bkt objstore.InstrumentedBucket
+			bs  *store.BucketStore
+		)
+		if bkt, metaFetcher, bs, err = newBucketStore(reg, confContentYaml, dataDir); err != nil {
+			return err
+		}
+		bkts, bucketStores, storeServer = append(bkts, bkt), append(bucketStores, bs), bs
+	} else {
+		// Each tenant has its own bucket and store, so requests of a tenant never read other tenants' buckets.
+		tenantStores := make(map[string]storepb.StoreServer, len(tenantBuckets))
+		for _, tb := range tenantBuckets {
+			var (
+				bucketConfYaml []byte
+				bkt            objstore.InstrumentedBucket
+				bs             *store.BucketStore
+			)
+			if bucketConfYaml, err = yaml.Marshal(tb.Bucket); err != nil {
+				return errors.Wrapf(err, "marshal bucket config of tenant %s", tb.Tenant)
+			}
+			tenantReg := extprom.WrapRegistererWith(prometheus.Labels{"tenant": tb.Tenant}, reg)
+			if bkt, _, bs, err = newBucketStore(tenantReg, bucketConfYaml, filepath.Join(dataDir, "tenants", tb.Tenant)); err != nil {
+				return errors.Wrapf(err, "tenant %s", tb.Tenant)
+			}
+			bkts, bucketStores = append(bkts, bkt), append(bucketStores, bs)
+			tenantStores[tb.Tenant] = bs
+		}
+		storeServer = store.NewTenantStore(conf.tenantHeader, tenantStores)
+		level.Info(logger).Log("msg", "serving blocks from per-tenant buckets", "tenants", len(tenantStores), "header", conf.tenantHeader)
 	}
 
 	// bucketStoreReady signals when bucket store is ready.
@@ -314,25 +528,40 @@ func runStore(
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			defer func() {
+				for _, bkt := range bkts {
+					runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+				}
+			}()
 
 			level.Info(logger).Log("msg", "initializing bucket store")
 			begin := time.Now()
-			if err := bs.InitialSync(ctx); err != nil {
-				close(bucketStoreReady)
-				return errors.Wrap(err, "bucket store initial sync")
+			for _, bs := range bucketStores {
+				if err := bs.InitialSync(ctx); err != nil {
+					close(bucketStoreReady)
+					return errors.Wrap(err, "bucket store initial sync")
+				}
+			}
+			if warmer != nil {
+				for _, bs := range bucketStores {
+					warmer.Warmup(ctx, bs)
+				}
 			}
 			level.Info(logger).Log("msg", "bucket store ready", "init_duration", time.Since(begin).String())
 			close(bucketStoreReady)
 
 			err := runutil.Repeat(syncInterval, ctx.Done(), func() error {
-				if err := bs.SyncBlocks(ctx); err != nil {
-					level.Warn(logger).Log("msg", "syncing blocks failed", "err", err)
+				for _, bs := range bucketStores {
+					if err := bs.SyncBlocks(ctx); err != nil {
+						level.Warn(logger).Log("msg", "syncing blocks failed", "err", err)
+					}
 				}
 				return nil
 			})
 
-			runutil.CloseWithLogOnErr(logger, bs, "bucket store")
+			for _, bs := range bucketStores {
+				runutil.CloseWithLogOnErr(logger, bs, "bucket store")
+			}
 			return err
 		}, func(error) {
 			cancel()
@@ -346,7 +575,7 @@ func runStore(
 		}
 
 		s := grpcserver.New(logger, reg, tracer, component, grpcProbe,
-			grpcserver.WithServer(store.RegisterStoreServer(bs)),
+			grpcserver.WithServer(store.RegisterStoreServer(storeServer)),
 			grpcserver.WithListen(grpcBindAddr),
 			grpcserver.WithGracePeriod(grpcGracePeriod),
 			grpcserver.WithTLSConfig(tlsCfg),
@@ -375,12 +604,18 @@ func runStore(
 		})}
 		logMiddleware := logging.NewHTTPServerMiddleware(logger, opts...)
 		api := blocksAPI.NewBlocksAPI(logger, "", flagsMap)
+		// Blocks of per-tenant buckets are not listed, nor evicted, to keep tenants isolated.
+		if enableAdminAPI && len(bucketStores) == 1 && metaFetcher != nil {
+			api.EnableEviction(bucketStores[0])
+		}
 		api.Register(r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
 
-		metaFetcher.UpdateOnChange(func(blocks []metadata.Meta, err error) {
-			compactorView.Set(blocks, err)
-			api.SetLoaded(blocks, err)
-		})
+		if metaFetcher != nil {
+			metaFetcher.UpdateOnChange(func(blocks []metadata.Meta, err error) {
+				compactorView.Set(blocks, err)
+				api.SetLoaded(blocks, err)
+			})
+		}
 		srv.Handle("/", r)
 	}
 
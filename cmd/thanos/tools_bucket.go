@@ -78,6 +78,7 @@ func registerBucket(app extkingpin.AppClause) {
 	registerBucketReplicate(cmd, objStoreConfig)
 	registerBucketDownsample(cmd, objStoreConfig)
 	registerBucketCleanup(cmd, objStoreConfig)
+	registerBucketRewriteLabels(cmd, objStoreConfig)
 }
 
 func registerBucketVerify(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
@@ -481,9 +482,11 @@ func registerBucketDownsample(app extkingpin.AppClause, objStoreConfig *extflag.
 	httpAddr, httpGracePeriod := extkingpin.RegisterHTTPFlags(cmd)
 	dataDir := cmd.Flag("data-dir", "Data directory in which to cache blocks and process downsamplings.").
 		Default("./data").String()
+	downsampleConcurrency := cmd.Flag("downsample.concurrency", "Number of goroutines to use when downsampling series of a block. Downsampled blocks are the same regardless of the concurrency.").
+		Default("1").Int()
 
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
-		return RunDownsample(g, logger, reg, *httpAddr, time.Duration(*httpGracePeriod), *dataDir, objStoreConfig, component.Downsample)
+		return RunDownsample(g, logger, reg, *httpAddr, time.Duration(*httpGracePeriod), *dataDir, objStoreConfig, component.Downsample, *downsampleConcurrency)
 	})
 }
 
@@ -576,6 +579,97 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 	})
 }
 
+func registerBucketRewriteLabels(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("rewrite-labels", fmt.Sprintf("Rewrite external labels in %s of blocks in the bucket. Block data is not rewritten, as external labels are stored in %s only.", block.MetaFilename, block.MetaFilename))
+	ids := cmd.Flag("id", "Block IDs to rewrite external labels of. If none is specified, all blocks selected by --selector.relabel-config are rewritten. Repeated flag.").Strings()
+	selectorRelabelConf := extkingpin.RegisterSelectorRelabelFlags(cmd)
+	rewriteRelabelConf := extflag.RegisterPathOrContent(cmd, "rewrite.relabel-config", "YAML file that contains relabeling configuration applied to external labels of blocks, e.g. a replace action copying team label to squad label followed by a labeldrop action of team label. It follows native Prometheus relabel-config syntax. See format details: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config ", true)
+	dryRun := cmd.Flag("dry-run", "Only print rewritten external labels of blocks without uploading them. Use --no-dry-run to rewrite them.").Default("true").Bool()
+	timeout := cmd.Flag("timeout", "Timeout to fetch metadata of blocks and rewrite their external labels.").Default("5m").Duration()
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		selectorContentYaml, err := selectorRelabelConf.Content()
+		if err != nil {
+			return errors.Wrap(err, "get content of selector relabel configuration")
+		}
+		selectorConfig, err := block.ParseRelabelConfig(selectorContentYaml)
+		if err != nil {
+			return err
+		}
+
+		rewriteContentYaml, err := rewriteRelabelConf.Content()
+		if err != nil {
+			return errors.Wrap(err, "get content of rewrite relabel configuration")
+		}
+		rewriteConfig, err := block.ParseRewriteRelabelConfig(rewriteContentYaml)
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, component.Bucket.String())
+		if err != nil {
+			return err
+		}
+
+		fetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, bkt, "", extprom.WrapRegistererWithPrefix(extpromPrefix, reg), []block.MetadataFilter{
+			block.NewLabelShardedMetaFilter(selectorConfig),
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+
+		metas, _, err := fetcher.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		var blockIDs []ulid.ULID
+		if len(*ids) == 0 {
+			for id := range metas {
+				blockIDs = append(blockIDs, id)
+			}
+			sort.Slice(blockIDs, func(i, j int) bool { return blockIDs[i].Compare(blockIDs[j]) < 0 })
+		}
+		for _, idStr := range *ids {
+			id, err := ulid.Parse(idStr)
+			if err != nil {
+				return errors.Wrapf(err, "invalid ULID found %s", idStr)
+			}
+			if _, ok := metas[id]; !ok {
+				return errors.Errorf("block %s not found or not selected", id)
+			}
+			blockIDs = append(blockIDs, id)
+		}
+
+		var rewritten int
+		for _, id := range blockIDs {
+			from, to, err := block.RewriteExternalLabels(ctx, logger, bkt, id, rewriteConfig, *dryRun)
+			if err != nil {
+				return errors.Wrapf(err, "rewrite external labels of block %s", id)
+			}
+			if labels.Equal(from, to) {
+				continue
+			}
+			rewritten++
+			fmt.Fprintf(os.Stdout, "%s: %s -> %s\n", id, from, to)
+		}
+		level.Info(logger).Log("msg", "rewrite of external labels done", "blocks", len(blockIDs), "rewritten", rewritten, "dryRun", *dryRun)
+		return nil
+	})
+}
+
 func printTable(blockMetas []*metadata.Meta, selectorLabels labels.Labels, sortBy []string) error {
 	header := inspectColumns
 
@@ -20,6 +20,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -31,8 +32,11 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/common/version"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
 
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -56,8 +60,47 @@ const (
 	ErrorExec     ErrorType = "execution"
 	ErrorBadData  ErrorType = "bad_data"
 	ErrorInternal ErrorType = "internal"
+	// ErrorUnavailable means that one of the required StoreAPIs was not reachable. Such requests can be retried.
+	ErrorUnavailable ErrorType = "unavailable"
+	// ErrorLimitExceeded means that the request hit one of the configured limits. Such requests should not be retried
+	// without narrowing them down.
+	ErrorLimitExceeded ErrorType = "limit_exceeded"
+	// ErrorOverloaded means that the request was not admitted because of the current load. Such requests can be retried
+	// later.
+	ErrorOverloaded ErrorType = "overloaded"
 )
 
+// StoreErrorType returns ErrorType for the error returned from the StoreAPI fan-out and merge path, based on the gRPC
+// status code or context error found in its chain. The given fallback is returned if the error is not recognized.
+func StoreErrorType(err error, fallback ErrorType) ErrorType {
+	if errors.Is(err, context.Canceled) {
+		return ErrorCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTimeout
+	}
+
+	var grpcErr interface{ GRPCStatus() *grpcstatus.Status }
+	if !errors.As(err, &grpcErr) {
+		return fallback
+	}
+	switch grpcErr.GRPCStatus().Code() {
+	case codes.Canceled:
+		return ErrorCanceled
+	case codes.DeadlineExceeded:
+		return ErrorTimeout
+	case codes.InvalidArgument:
+		return ErrorBadData
+	case codes.Unavailable:
+		return ErrorUnavailable
+	case codes.ResourceExhausted:
+		return ErrorLimitExceeded
+	case codes.Internal, codes.DataLoss:
+		return ErrorInternal
+	}
+	return fallback
+}
+
 var corsHeaders = map[string]string{
 	"Access-Control-Allow-Headers":  "Accept, Accept-Encoding, Authorization, Content-Type, Origin",
 	"Access-Control-Allow-Methods":  "GET, OPTIONS",
@@ -243,8 +286,12 @@ func RespondError(w http.ResponseWriter, apiErr *ApiError, data interface{}) {
 		code = http.StatusBadRequest
 	case ErrorExec:
 		code = 422
-	case ErrorCanceled, ErrorTimeout:
+	case ErrorCanceled, ErrorTimeout, ErrorUnavailable:
 		code = http.StatusServiceUnavailable
+	case ErrorLimitExceeded:
+		code = http.StatusUnprocessableEntity
+	case ErrorOverloaded:
+		code = http.StatusTooManyRequests
 	case ErrorInternal:
 		code = http.StatusInternalServerError
 	default:
@@ -17,6 +17,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -28,6 +29,8 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/route"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
 
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -110,6 +113,71 @@ func TestRespondError(t *testing.T) {
 	}
 }
 
+func TestStoreErrorType(t *testing.T) {
+	for _, tcase := range []struct {
+		name         string
+		err          error
+		expectedTyp  ErrorType
+		expectedCode int
+	}{
+		{
+			name:         "unknown error",
+			err:          errors.New("some error"),
+			expectedTyp:  ErrorExec,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "store unavailable",
+			err:          errors.Wrap(grpcstatus.Error(codes.Unavailable, "connection refused"), "proxy Series()"),
+			expectedTyp:  ErrorUnavailable,
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "limit exceeded",
+			err:          errors.Wrap(grpcstatus.Error(codes.ResourceExhausted, "exceeded chunks limit"), "receive series from store"),
+			expectedTyp:  ErrorLimitExceeded,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "bad matcher",
+			err:          grpcstatus.Error(codes.InvalidArgument, "no matchers specified (excluding external labels)"),
+			expectedTyp:  ErrorBadData,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "store internal error",
+			err:          errors.Wrap(grpcstatus.Error(codes.Internal, "failed"), "proxy Series()"),
+			expectedTyp:  ErrorInternal,
+			expectedCode: http.StatusInternalServerError,
+		},
+		{
+			name:         "deadline exceeded",
+			err:          errors.Wrap(context.DeadlineExceeded, "failed to receive any data in 1s from store"),
+			expectedTyp:  ErrorTimeout,
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "canceled",
+			err:          grpcstatus.Error(codes.Canceled, "context canceled"),
+			expectedTyp:  ErrorCanceled,
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			typ := StoreErrorType(tcase.err, ErrorExec)
+			testutil.Equals(t, tcase.expectedTyp, typ)
+
+			w := httptest.NewRecorder()
+			RespondError(w, &ApiError{Typ: typ, Err: tcase.err}, nil)
+			testutil.Equals(t, tcase.expectedCode, w.Code)
+
+			var res response
+			testutil.Ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+			testutil.Equals(t, tcase.expectedTyp, res.ErrorType)
+		})
+	}
+}
+
 func TestOptionsMethod(t *testing.T) {
 	r := route.New()
 	api := &BaseAPI{}
@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/route"
 	"github.com/thanos-io/thanos/pkg/api"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -22,6 +24,24 @@ type BlocksAPI struct {
 	logger           log.Logger
 	globalBlocksInfo *BlocksInfo
 	loadedBlocksInfo *BlocksInfo
+	evictor          BlockEvictor
+}
+
+// EvictedBlock is the response of the block eviction endpoint.
+type EvictedBlock struct {
+	ID ulid.ULID `json:"id"`
+	// Loaded is false if the block was not served when evicted.
+	Loaded bool `json:"loaded"`
+}
+
+// BlockEvictor evicts blocks from memory of the component serving them, e.g. Store Gateway.
+type BlockEvictor interface {
+	// EvictBlock stops serving the block until it is restored. It returns false if the block was not loaded.
+	EvictBlock(id ulid.ULID) (bool, error)
+	// RestoreBlock allows the evicted block to be served again. It returns false if the block was not evicted.
+	RestoreBlock(id ulid.ULID) bool
+	// EvictedBlocks returns IDs of all evicted blocks.
+	EvictedBlocks() []ulid.ULID
 }
 
 type BlocksInfo struct {
@@ -53,6 +73,54 @@ func (bapi *BlocksAPI) Register(r *route.Router, tracer opentracing.Tracer, logg
 	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
 
 	r.Get("/blocks", instr("blocks", bapi.blocks))
+
+	if bapi.evictor != nil {
+		r.Get("/admin/blocks/evicted", instr("evicted_blocks", bapi.evictedBlocks))
+		r.Post("/admin/blocks/:id/evict", instr("evict_block", bapi.evictBlock))
+		r.Post("/admin/blocks/:id/restore", instr("restore_block", bapi.restoreBlock))
+	}
+}
+
+// EnableEviction registers admin endpoints evicting and restoring blocks with the given evictor.
+// It has to be called before Register.
+func (bapi *BlocksAPI) EnableEviction(evictor BlockEvictor) {
+	bapi.evictor = evictor
+}
+
+func parseBlockID(r *http.Request) (ulid.ULID, *api.ApiError) {
+	id, err := ulid.Parse(route.Param(r.Context(), "id"))
+	if err != nil {
+		return ulid.ULID{}, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "invalid block ID")}
+	}
+	return id, nil
+}
+
+func (bapi *BlocksAPI) evictedBlocks(_ *http.Request) (interface{}, []error, *api.ApiError) {
+	return bapi.evictor.EvictedBlocks(), nil, nil
+}
+
+func (bapi *BlocksAPI) evictBlock(r *http.Request) (interface{}, []error, *api.ApiError) {
+	id, apiErr := parseBlockID(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	loaded, err := bapi.evictor.EvictBlock(id)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}
+	}
+	// Block not loaded yet is still marked as evicted, so it will not be loaded later on.
+	return &EvictedBlock{ID: id, Loaded: loaded}, nil, nil
+}
+
+func (bapi *BlocksAPI) restoreBlock(r *http.Request) (interface{}, []error, *api.ApiError) {
+	id, apiErr := parseBlockID(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if !bapi.evictor.RestoreBlock(id) {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("block %s is not evicted", id)}
+	}
+	return nil, nil, nil
 }
 
 func (bapi *BlocksAPI) blocks(r *http.Request) (interface{}, []error, *api.ApiError) {
@@ -0,0 +1,147 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ResultTransformer post-processes results of PromQL queries after evaluation and before serialization, e.g. to convert
+// units, add synthetic labels or clamp values, which does not belong in PromQL itself.
+type ResultTransformer interface {
+	// Transform returns the transformed result, which is a matrix, vector, scalar or string. The given result can be
+	// modified in place. Returned error fails the query.
+	Transform(ctx context.Context, v parser.Value) (parser.Value, error)
+}
+
+// NopResultTransformer returns results as they are. It is used unless other transformer is set.
+type NopResultTransformer struct{}
+
+// Transform implements ResultTransformer.
+func (NopResultTransformer) Transform(_ context.Context, v parser.Value) (parser.Value, error) {
+	return v, nil
+}
+
+// resultTransformers are transformers registered by name, so they can be enabled at startup.
+var resultTransformers = map[string]ResultTransformer{}
+
+func init() {
+	RegisterResultTransformer(BytesToGiBTransformerName, BytesToGiBTransformer{})
+}
+
+// RegisterResultTransformer registers the transformer with the given name. Transformers registered by custom builds
+// can be enabled with the query.result-transformer flag. It has to be called from init functions.
+func RegisterResultTransformer(name string, t ResultTransformer) {
+	resultTransformers[name] = t
+}
+
+// RegisteredResultTransformers returns sorted names of registered transformers.
+func RegisteredResultTransformers() []string {
+	names := make([]string, 0, len(resultTransformers))
+	for name := range resultTransformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewResultTransformer returns transformer applying registered transformers with the given names in order.
+// NopResultTransformer is returned if no names are given.
+func NewResultTransformer(names []string) (ResultTransformer, error) {
+	if len(names) == 0 {
+		return NopResultTransformer{}, nil
+	}
+	ts := make([]ResultTransformer, 0, len(names))
+	for _, name := range names {
+		t, ok := resultTransformers[name]
+		if !ok {
+			return nil, errors.Errorf("result transformer %q is not registered, registered transformers: %s", name, strings.Join(RegisteredResultTransformers(), ", "))
+		}
+		ts = append(ts, t)
+	}
+	return ChainResultTransformers(ts...), nil
+}
+
+type chainedResultTransformer []ResultTransformer
+
+// ChainResultTransformers returns transformer applying all the given transformers in order.
+func ChainResultTransformers(ts ...ResultTransformer) ResultTransformer {
+	return chainedResultTransformer(ts)
+}
+
+func (c chainedResultTransformer) Transform(ctx context.Context, v parser.Value) (parser.Value, error) {
+	var err error
+	for _, t := range c {
+		if v, err = t.Transform(ctx, v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+const (
+	// BytesToGiBTransformerName is the name BytesToGiBTransformer is registered with.
+	BytesToGiBTransformerName = "bytes-to-gib"
+
+	bytesSuffix     = "_bytes"
+	gibibytesSuffix = "_gibibytes"
+	bytesInGiB      = 1 << 30
+)
+
+// BytesToGiBTransformer is an example transformer converting values of series with metric name ending in _bytes to
+// GiB and renaming them to end in _gibibytes. Series without metric name, like results of most functions, are left
+// untouched.
+type BytesToGiBTransformer struct{}
+
+// Transform implements ResultTransformer.
+func (BytesToGiBTransformer) Transform(_ context.Context, v parser.Value) (parser.Value, error) {
+	switch val := v.(type) {
+	case promql.Matrix:
+		for i := range val {
+			lset, ok := bytesToGiBLabels(val[i].Metric)
+			if !ok {
+				continue
+			}
+			val[i].Metric = lset
+			for j := range val[i].Points {
+				val[i].Points[j].V /= bytesInGiB
+			}
+		}
+		// Renamed series can collide with series named as converted ones already.
+		if val.ContainsSameLabelset() {
+			return nil, errors.New("converting bytes to GiB: result contains series with the same labels")
+		}
+		// Matrices are sorted by labels.
+		sort.Sort(val)
+	case promql.Vector:
+		for i := range val {
+			lset, ok := bytesToGiBLabels(val[i].Metric)
+			if !ok {
+				continue
+			}
+			val[i].Metric = lset
+			val[i].V /= bytesInGiB
+		}
+		if val.ContainsSameLabelset() {
+			return nil, errors.New("converting bytes to GiB: result contains series with the same labels")
+		}
+	}
+	return v, nil
+}
+
+// bytesToGiBLabels returns the given labels with metric name suffix renamed to _gibibytes, if it is _bytes.
+func bytesToGiBLabels(lset labels.Labels) (labels.Labels, bool) {
+	name := lset.Get(labels.MetricName)
+	if !strings.HasSuffix(name, bytesSuffix) {
+		return nil, false
+	}
+	return labels.NewBuilder(lset).Set(labels.MetricName, strings.TrimSuffix(name, bytesSuffix)+gibibytesSuffix).Labels(), true
+}
@@ -23,6 +23,7 @@ import (
 	"context"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -34,11 +35,15 @@ import (
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/thanos-io/thanos/pkg/api"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -46,7 +51,9 @@ import (
 	"github.com/thanos-io/thanos/pkg/rules"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/strutil"
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
@@ -56,8 +63,39 @@ const (
 	MaxSourceResolutionParam = "max_source_resolution"
 	ReplicaLabelsParam       = "replicaLabels[]"
 	StoreMatcherParam        = "storeMatch[]"
+	LookbackDeltaParam       = "lookback_delta"
+	ReplicaInfoParam         = "replica_info"
+	SeriesSourcesParam       = "series_sources"
+	SignificantDigitsParam   = "significant_digits"
+	DecimalPlacesParam       = "decimal_places"
+	SoftDeadlineParam        = "soft_deadline"
+	NoCacheParam             = "nocache"
+	ExplainParam             = "explain"
+	ExplainEstimateParam     = "explain_estimate"
 )
 
+// seriesSourcesLimit is the maximum number of sources listed per series in responses to requests with series_sources.
+const seriesSourcesLimit = 10
+
+// softDeadlineSubRanges is the number of sub-ranges range queries with soft_deadline are split into.
+const softDeadlineSubRanges = 10
+
+// DefaultAutoDownsamplingClampRatio is the default maximum range/step ratio of range queries clamped to downsampled data,
+// e.g. 30d range with 6h step, or 7d range with 1h step (ratio 168), use 1h or 5m resolution, while a 1d range with 5m
+// step (ratio 288) keeps raw data.
+const DefaultAutoDownsamplingClampRatio = 250
+
+// defaultLookbackDelta is the PromQL default lookback used when none is configured.
+const defaultLookbackDelta = 5 * time.Minute
+
+// gateErrorType returns ErrorType for the error of a query waiting at the gate.
+func gateErrorType(err error) api.ErrorType {
+	if errors.Is(err, gate.ErrOverloaded) {
+		return api.ErrorOverloaded
+	}
+	return api.StoreErrorType(err, api.ErrorExec)
+}
+
 // QueryAPI is an API used by Thanos Query.
 type QueryAPI struct {
 	baseAPI         *api.BaseAPI
@@ -68,6 +106,7 @@ type QueryAPI struct {
 	ruleGroups      rules.UnaryClient
 
 	enableAutodownsampling     bool
+	autoDownsamplingClampRatio int
 	enableQueryPartialResponse bool
 	enableRulePartialResponse  bool
 
@@ -76,6 +115,39 @@ type QueryAPI struct {
 
 	defaultInstantQueryMaxSourceResolution time.Duration
 	defaultMetadataTimeRange               time.Duration
+	defaultLookbackDelta                   time.Duration
+	maxRangeQueryPoints                    int
+	// maxOutputSeries limits the number of series of query results, 0 means no limit.
+	maxOutputSeries int
+
+	exporter *query.RemoteWriteExporter
+	// resultTransformer post-processes results of queries before they are returned.
+	resultTransformer ResultTransformer
+
+	// tenantHeader is the header whose value is required by data endpoints and forwarded to stores, if set.
+	tenantHeader string
+}
+
+// QueryAPIOpts configures the QueryAPI. Zero value of each field disables the respective feature or keeps the default
+// behaviour.
+type QueryAPIOpts struct {
+	// AutoDownsamplingClampRatio, if positive, clamps range queries with at most that many steps to downsampled data,
+	// see DefaultAutoDownsamplingClampRatio.
+	AutoDownsamplingClampRatio int
+	// DefaultLookbackDelta is the lookback delta of query_last and query_points without lookback_delta param, the
+	// PromQL default if 0.
+	DefaultLookbackDelta time.Duration
+	// MaxRangeQueryPoints limits the number of points per series of range queries and timestamps of query_points,
+	// 0 means no limit.
+	MaxRangeQueryPoints int
+	// MaxOutputSeries limits the number of series of query results, 0 means no limit.
+	MaxOutputSeries int
+	// Exporter, if not nil, serves the export endpoint.
+	Exporter *query.RemoteWriteExporter
+	// TenantHeader is the header whose value is required by data endpoints and forwarded to stores, if set.
+	TenantHeader string
+	// ResultTransformer, if not nil, post-processes results of query, query_range, query_last and query_points.
+	ResultTransformer ResultTransformer
 }
 
 // NewQueryAPI returns an initialized QueryAPI type.
@@ -93,7 +165,12 @@ func NewQueryAPI(
 	defaultInstantQueryMaxSourceResolution time.Duration,
 	defaultMetadataTimeRange time.Duration,
 	gate gate.Gate,
+	opts QueryAPIOpts,
 ) *QueryAPI {
+	resultTransformer := opts.ResultTransformer
+	if resultTransformer == nil {
+		resultTransformer = NopResultTransformer{}
+	}
 	return &QueryAPI{
 		baseAPI:         api.NewBaseAPI(logger, flagsMap),
 		logger:          logger,
@@ -103,13 +180,53 @@ func NewQueryAPI(
 		ruleGroups:      ruleGroups,
 
 		enableAutodownsampling:                 enableAutodownsampling,
+		autoDownsamplingClampRatio:             opts.AutoDownsamplingClampRatio,
 		enableQueryPartialResponse:             enableQueryPartialResponse,
 		enableRulePartialResponse:              enableRulePartialResponse,
 		replicaLabels:                          replicaLabels,
 		storeSet:                               storeSet,
 		defaultInstantQueryMaxSourceResolution: defaultInstantQueryMaxSourceResolution,
 		defaultMetadataTimeRange:               defaultMetadataTimeRange,
+		defaultLookbackDelta:                   opts.DefaultLookbackDelta,
+		maxRangeQueryPoints:                    opts.MaxRangeQueryPoints,
+		maxOutputSeries:                        opts.MaxOutputSeries,
+		exporter:                               opts.Exporter,
+		resultTransformer:                      resultTransformer,
+		tenantHeader:                           opts.TenantHeader,
+	}
+}
+
+// withOutputGroupings returns the context with aggregations grouping series of selects of the query, so that the
+// querier can check them against the output series limit before they are evaluated.
+func (qapi *QueryAPI) withOutputGroupings(ctx context.Context, qs string) context.Context {
+	if qapi.maxOutputSeries <= 0 {
+		return ctx
+	}
+	// Invalid queries are reported by the engine.
+	expr, err := parser.ParseExpr(qs)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, query.OutputGroupingsKey, query.NewOutputGroupings(expr))
+}
+
+// checkOutputSeries returns an error if the query result has more series than allowed. Aggregations grouping series of
+// selects are already checked by the querier before they are evaluated, others can be checked on results only.
+func (qapi *QueryAPI) checkOutputSeries(v parser.Value) error {
+	if qapi.maxOutputSeries <= 0 {
+		return nil
 	}
+	var n int
+	switch r := v.(type) {
+	case promql.Matrix:
+		n = len(r)
+	case promql.Vector:
+		n = len(r)
+	}
+	if n > qapi.maxOutputSeries {
+		return errors.Errorf("exceeded output series limit: query produced %d series while the limit is %d", n, qapi.maxOutputSeries)
+	}
+	return nil
 }
 
 // Register the API's endpoints in the given router.
@@ -118,31 +235,212 @@ func (qapi *QueryAPI) Register(r *route.Router, tracer opentracing.Tracer, logge
 
 	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
 
-	r.Get("/query", instr("query", qapi.query))
-	r.Post("/query", instr("query", qapi.query))
+	r.Get("/query", instr("query", qapi.withTenant(qapi.transformResults(qapi.query))))
+	r.Post("/query", instr("query", qapi.withTenant(qapi.transformResults(qapi.query))))
+
+	r.Get("/query_range", instr("query_range", qapi.withTenant(qapi.transformResults(qapi.queryRange))))
+	r.Post("/query_range", instr("query_range", qapi.withTenant(qapi.transformResults(qapi.queryRange))))
+
+	r.Get("/query_last", instr("query_last", qapi.withTenant(qapi.transformResults(qapi.queryLast))))
+	r.Post("/query_last", instr("query_last", qapi.withTenant(qapi.transformResults(qapi.queryLast))))
 
-	r.Get("/query_range", instr("query_range", qapi.queryRange))
-	r.Post("/query_range", instr("query_range", qapi.queryRange))
+	r.Get("/query_points", instr("query_points", qapi.withTenant(qapi.transformResults(qapi.queryPoints))))
+	r.Post("/query_points", instr("query_points", qapi.withTenant(qapi.transformResults(qapi.queryPoints))))
 
-	r.Get("/label/:name/values", instr("label_values", qapi.labelValues))
+	r.Get("/label/:name/values", instr("label_values", qapi.withTenant(qapi.labelValues)))
 
-	r.Get("/series", instr("series", qapi.series))
-	r.Post("/series", instr("series", qapi.series))
+	r.Get("/series", instr("series", qapi.withTenant(qapi.series)))
+	r.Post("/series", instr("series", qapi.withTenant(qapi.series)))
 
-	r.Get("/labels", instr("label_names", qapi.labelNames))
-	r.Post("/labels", instr("label_names", qapi.labelNames))
+	r.Get("/labels", instr("label_names", qapi.withTenant(qapi.labelNames)))
+	r.Post("/labels", instr("label_names", qapi.withTenant(qapi.labelNames)))
 
 	r.Get("/stores", instr("stores", qapi.stores))
 
+	if qapi.exporter != nil {
+		r.Post("/export", instr("export", qapi.withTenant(qapi.export)))
+	}
+
 	r.Get("/rules", instr("rules", NewRulesHandler(qapi.ruleGroups, qapi.enableRulePartialResponse)))
 }
 
+// withTenant rejects requests without the tenant header and forwards its value to stores as gRPC metadata, so stores
+// serve only data of that tenant. It is a no-op if the tenant header is not configured.
+func (qapi *QueryAPI) withTenant(f api.ApiFunc) api.ApiFunc {
+	if qapi.tenantHeader == "" {
+		return f
+	}
+	return func(r *http.Request) (interface{}, []error, *api.ApiError) {
+		tenant := r.Header.Get(qapi.tenantHeader)
+		if tenant == "" {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("missing tenant header %s", qapi.tenantHeader)}
+		}
+		ctx := metadata.AppendToOutgoingContext(r.Context(), strings.ToLower(qapi.tenantHeader), tenant)
+		return f(r.WithContext(ctx))
+	}
+}
+
+// transformResults applies the result transformer to results of the given handler, which are then rounded if requested.
+// Results of query_points are transformed as a matrix of their series with points at the requested timestamps.
+func (qapi *QueryAPI) transformResults(f api.ApiFunc) api.ApiFunc {
+	return func(r *http.Request) (interface{}, []error, *api.ApiError) {
+		res, warnings, apiErr := f(r)
+		if apiErr != nil {
+			return nil, nil, apiErr
+		}
+
+		var err error
+		switch data := res.(type) {
+		case *queryData:
+			if qapi.resultTransformer != nil {
+				if data.Result, err = qapi.resultTransformer.Transform(r.Context(), data.Result); err != nil {
+					return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: errors.Wrap(err, "transform result")}
+				}
+				data.ResultType = data.Result.Type()
+			}
+			if data.round != nil {
+				data.Result, data.round = roundValue(data.Result, data.round), nil
+			}
+		case *pointsData:
+			if qapi.resultTransformer != nil {
+				if err = data.transform(r.Context(), qapi.resultTransformer); err != nil {
+					return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: errors.Wrap(err, "transform result")}
+				}
+			}
+		}
+		return res, warnings, nil
+	}
+}
+
 type queryData struct {
 	ResultType parser.ValueType `json:"resultType"`
 	Result     parser.Value     `json:"result"`
+	// round rounds values of the result once it is transformed, if set.
+	round func(float64) float64
 
 	// Additional Thanos Response field.
 	Warnings []error `json:"warnings,omitempty"`
+	// ReplicaInfo is set only if requested with replica_info param and deduplication is enabled.
+	ReplicaInfo *replicaInfo `json:"replicaInfo,omitempty"`
+	// SeriesSources is set only if requested with series_sources param.
+	SeriesSources []query.SeriesSources `json:"seriesSources,omitempty"`
+	// Completeness is set only for range queries with soft_deadline param.
+	Completeness *completeness `json:"completeness,omitempty"`
+}
+
+// completeness describes which parts of a range query evaluated with a soft deadline are missing in its result.
+type completeness struct {
+	// Complete is true if the whole time range was evaluated before the soft deadline and no StoreAPI failed.
+	Complete bool `json:"complete"`
+	// MissingRanges are time ranges not evaluated before the soft deadline. The result has no points within them.
+	MissingRanges []missingRange `json:"missingRanges,omitempty"`
+	// MissingStores are StoreAPIs that failed or did not respond before the soft deadline.
+	MissingStores []string `json:"missingStores,omitempty"`
+}
+
+// missingRange is a range of evaluation timestamps, in seconds, both inclusive.
+type missingRange struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// replicaInfo describes which replicas of HA groups contributed to the deduplicated result.
+type replicaInfo struct {
+	// Degraded is true if any replica of any queried group failed or is missing.
+	Degraded bool               `json:"degraded"`
+	Groups   []replicaGroupInfo `json:"groups"`
+}
+
+// replicaGroupInfo describes a single HA group, identified by external labels without replica labels.
+type replicaGroupInfo struct {
+	Labels labels.Labels `json:"labels"`
+	// Contributed is the number of replicas that responded successfully.
+	Contributed int `json:"contributed"`
+	// Failed replicas were queried, but at least one of their StoreAPIs failed.
+	Failed []string `json:"failed,omitempty"`
+	// Missing replicas are known to the querier, but were not queried as their StoreAPIs are unhealthy.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// newReplicaInfo groups StoreAPIs queried during fan-out by external labels without replica labels. Unhealthy StoreAPIs
+// are reported as missing replicas of the queried groups only, as there is no way to tell if other groups hold any
+// data for the query.
+func newReplicaInfo(queried []store.FanoutStoreStatus, unhealthy []labels.Labels, replicaLabels []string) *replicaInfo {
+	type group struct {
+		info     replicaGroupInfo
+		replicas map[string]bool // Replica to whether it failed.
+		missing  map[string]struct{}
+	}
+	var (
+		groups = map[string]*group{}
+		keys   []string
+	)
+	split := func(lset labels.Labels) (labels.Labels, string) {
+		b := labels.NewBuilder(lset)
+		var replica labels.Labels
+		for _, l := range replicaLabels {
+			if v := lset.Get(l); v != "" {
+				replica = append(replica, labels.Label{Name: l, Value: v})
+				b.Del(l)
+			}
+		}
+		if len(replica) == 0 {
+			return nil, ""
+		}
+		sort.Sort(replica)
+		return b.Labels(), replica.String()
+	}
+
+	for _, st := range queried {
+		for _, lset := range st.LabelSets {
+			glset, replica := split(lset)
+			if replica == "" {
+				continue
+			}
+			g, ok := groups[glset.String()]
+			if !ok {
+				g = &group{info: replicaGroupInfo{Labels: glset}, replicas: map[string]bool{}, missing: map[string]struct{}{}}
+				groups[glset.String()] = g
+				keys = append(keys, glset.String())
+			}
+			g.replicas[replica] = g.replicas[replica] || st.Failed
+		}
+	}
+	for _, lset := range unhealthy {
+		glset, replica := split(lset)
+		if replica == "" {
+			continue
+		}
+		g, ok := groups[glset.String()]
+		if !ok {
+			continue
+		}
+		if _, ok := g.replicas[replica]; ok {
+			continue
+		}
+		g.missing[replica] = struct{}{}
+	}
+
+	sort.Strings(keys)
+	ret := &replicaInfo{Groups: make([]replicaGroupInfo, 0, len(keys))}
+	for _, k := range keys {
+		g := groups[k]
+		for replica, failed := range g.replicas {
+			if failed {
+				g.info.Failed = append(g.info.Failed, replica)
+				continue
+			}
+			g.info.Contributed++
+		}
+		for replica := range g.missing {
+			g.info.Missing = append(g.info.Missing, replica)
+		}
+		sort.Strings(g.info.Failed)
+		sort.Strings(g.info.Missing)
+		ret.Degraded = ret.Degraded || len(g.info.Failed) > 0 || len(g.info.Missing) > 0
+		ret.Groups = append(ret.Groups, g.info)
+	}
+	return ret
 }
 
 func (qapi *QueryAPI) parseEnableDedupParam(r *http.Request) (enableDeduplication bool, _ *api.ApiError) {
@@ -158,6 +456,150 @@ func (qapi *QueryAPI) parseEnableDedupParam(r *http.Request) (enableDeduplicatio
 	return enableDeduplication, nil
 }
 
+func (qapi *QueryAPI) parseReplicaInfoParam(r *http.Request) (enableReplicaInfo bool, _ *api.ApiError) {
+	if val := r.FormValue(ReplicaInfoParam); val != "" {
+		var err error
+		enableReplicaInfo, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", ReplicaInfoParam)}
+		}
+	}
+	return enableReplicaInfo, nil
+}
+
+func (qapi *QueryAPI) parseSeriesSourcesParam(r *http.Request) (enableSeriesSources bool, _ *api.ApiError) {
+	if val := r.FormValue(SeriesSourcesParam); val != "" {
+		var err error
+		enableSeriesSources, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", SeriesSourcesParam)}
+		}
+	}
+	return enableSeriesSources, nil
+}
+
+func (qapi *QueryAPI) parseNoCacheParam(r *http.Request) (noCache bool, _ *api.ApiError) {
+	if val := r.FormValue(NoCacheParam); val != "" {
+		var err error
+		noCache, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", NoCacheParam)}
+		}
+	}
+	return noCache, nil
+}
+
+func (qapi *QueryAPI) parseExplainParam(r *http.Request) (explain, estimate bool, _ *api.ApiError) {
+	if val := r.FormValue(ExplainParam); val != "" {
+		var err error
+		explain, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", ExplainParam)}
+		}
+	}
+	if val := r.FormValue(ExplainEstimateParam); val != "" {
+		var err error
+		estimate, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", ExplainEstimateParam)}
+		}
+	}
+	return explain, estimate, nil
+}
+
+func (qapi *QueryAPI) parseSoftDeadlineParam(r *http.Request) (time.Duration, *api.ApiError) {
+	val := r.FormValue(SoftDeadlineParam)
+	if val == "" {
+		return 0, nil
+	}
+	softDeadline, err := parseDuration(val)
+	if err != nil {
+		return 0, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", SoftDeadlineParam)}
+	}
+	if softDeadline <= 0 {
+		return 0, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("'%s' parameter has to be positive", SoftDeadlineParam)}
+	}
+	return softDeadline, nil
+}
+
+// maxRoundingDigits is the maximum number of significant digits or decimal places accepted for rounding. float64
+// values have at most 17 significant decimal digits, so higher values would not change anything.
+const maxRoundingDigits = 17
+
+// parseRoundingParam returns a function rounding sample values to the number of significant digits or decimal places
+// given by significant_digits or decimal_places parameters, or nil if none of them is specified.
+func (qapi *QueryAPI) parseRoundingParam(r *http.Request) (round func(float64) float64, _ *api.ApiError) {
+	sig, dec := r.FormValue(SignificantDigitsParam), r.FormValue(DecimalPlacesParam)
+	if sig != "" && dec != "" {
+		return nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("'%s' and '%s' parameters are mutually exclusive", SignificantDigitsParam, DecimalPlacesParam)}
+	}
+
+	var (
+		param, val string
+		format     byte
+		minDigits  int
+	)
+	switch {
+	case sig != "":
+		param, val, format, minDigits = SignificantDigitsParam, sig, 'g', 1
+	case dec != "":
+		param, val, format, minDigits = DecimalPlacesParam, dec, 'f', 0
+	default:
+		return nil, nil
+	}
+
+	digits, err := strconv.Atoi(val)
+	if err != nil || digits < minDigits || digits > maxRoundingDigits {
+		return nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("'%s' parameter must be an integer between %d and %d, got %q", param, minDigits, maxRoundingDigits, val)}
+	}
+	return func(v float64) float64 {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return v
+		}
+		// Formatting rounds half to even in decimal, parsing back gives the closest float64, which is serialized
+		// with the shortest representation, i.e. at most the requested number of digits.
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, format, digits, 64), 64)
+		if err != nil {
+			return v
+		}
+		return rounded
+	}, nil
+}
+
+// roundValue rounds sample values of the given query result in place. Timestamps are left untouched.
+func roundValue(v parser.Value, round func(float64) float64) parser.Value {
+	switch val := v.(type) {
+	case promql.Matrix:
+		for _, series := range val {
+			for i := range series.Points {
+				series.Points[i].V = round(series.Points[i].V)
+			}
+		}
+	case promql.Vector:
+		for i := range val {
+			val[i].V = round(val[i].V)
+		}
+	case promql.Scalar:
+		val.V = round(val.V)
+		return val
+	}
+	return v
+}
+
+// unhealthyStoreLabelSets returns label sets of all StoreAPIs known to the querier that failed the last health check.
+func (qapi *QueryAPI) unhealthyStoreLabelSets() []labels.Labels {
+	if qapi.storeSet == nil {
+		return nil
+	}
+	var ret []labels.Labels
+	for _, st := range qapi.storeSet.GetStoreStatus() {
+		if st.LastError != nil {
+			ret = append(ret, st.LabelSets...)
+		}
+	}
+	return ret
+}
+
 func (qapi *QueryAPI) parseReplicaLabelsParam(r *http.Request) (replicaLabels []string, _ *api.ApiError) {
 	if err := r.ParseForm(); err != nil {
 		return nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
@@ -188,6 +630,9 @@ func (qapi *QueryAPI) parseStoreDebugMatchersParam(r *http.Request) (storeMatche
 	return storeMatchers, nil
 }
 
+// parseDownsamplingParamMillis returns the max source resolution requested by the max_source_resolution param: "raw"
+// for raw data only, "auto" for the given default, usually derived from the step, or a duration, e.g. "5m" or "1h".
+// Without the param, the default is used only if auto downsampling is enabled.
 func (qapi *QueryAPI) parseDownsamplingParamMillis(r *http.Request, defaultVal time.Duration) (maxResolutionMillis int64, _ *api.ApiError) {
 	maxSourceResolution := 0 * time.Second
 
@@ -195,11 +640,15 @@ func (qapi *QueryAPI) parseDownsamplingParamMillis(r *http.Request, defaultVal t
 	if qapi.enableAutodownsampling || (val == "auto") {
 		maxSourceResolution = defaultVal
 	}
-	if val != "" && val != "auto" {
+	switch val {
+	case "", "auto":
+	case "raw":
+		maxSourceResolution = 0
+	default:
 		var err error
 		maxSourceResolution, err = parseDuration(val)
 		if err != nil {
-			return 0, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", MaxSourceResolutionParam)}
+			return 0, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter must be one of 'raw', 'auto' or a duration", MaxSourceResolutionParam)}
 		}
 	}
 
@@ -210,6 +659,24 @@ func (qapi *QueryAPI) parseDownsamplingParamMillis(r *http.Request, defaultVal t
 	return int64(maxSourceResolution / time.Millisecond), nil
 }
 
+// clampDownsamplingMillis clamps the max source resolution of range queries with range/step ratio, i.e. the number of
+// steps, at most the configured clamp ratio to the coarsest downsampling resolution that still fits at least 5 samples
+// between steps. Such queries show a coarse overview not needing raw data. It is applied only if no
+// max_source_resolution param is specified, so an explicit max_source_resolution=0 always forces raw data.
+func (qapi *QueryAPI) clampDownsamplingMillis(r *http.Request, maxResolutionMillis int64, queryRange, step time.Duration) int64 {
+	if qapi.autoDownsamplingClampRatio <= 0 || step <= 0 || queryRange > time.Duration(qapi.autoDownsamplingClampRatio)*step || r.FormValue(MaxSourceResolutionParam) != "" {
+		return maxResolutionMillis
+	}
+
+	fit := int64(step/time.Millisecond) / 5
+	for _, res := range []int64{downsample.ResLevel2, downsample.ResLevel1} {
+		if res <= fit && res > maxResolutionMillis {
+			return res
+		}
+	}
+	return maxResolutionMillis
+}
+
 func (qapi *QueryAPI) parsePartialResponseParam(r *http.Request, defaultEnablePartialResponse bool) (enablePartialResponse bool, _ *api.ApiError) {
 	// Overwrite the cli flag when provided as a query parameter.
 	if val := r.FormValue(PartialResponseParam); val != "" {
@@ -265,11 +732,70 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 		return nil, nil, apiErr
 	}
 
+	enableReplicaInfo, apiErr := qapi.parseReplicaInfoParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enableSeriesSources, apiErr := qapi.parseSeriesSourcesParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	noCache, apiErr := qapi.parseNoCacheParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	explain, estimate, apiErr := qapi.parseExplainParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	round, apiErr := qapi.parseRoundingParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	var tracker *store.FanoutTracker
+	if enableReplicaInfo && enableDedup {
+		tracker = store.NewFanoutTracker()
+		ctx = context.WithValue(ctx, store.FanoutTrackerKey, tracker)
+	}
+	var sourcesTracker *query.SeriesSourcesTracker
+	if enableSeriesSources {
+		sourcesTracker = query.NewSeriesSourcesTracker(seriesSourcesLimit)
+		ctx = context.WithValue(ctx, query.SeriesSourcesTrackerKey, sourcesTracker)
+	}
+	var counterResetsTracker *query.CounterResetsTracker
+	if enableDedup {
+		counterResetsTracker = query.NewCounterResetsTracker()
+		ctx = context.WithValue(ctx, query.CounterResetsTrackerKey, counterResetsTracker)
+	}
+	corruptChunksTracker := query.NewCorruptChunksTracker()
+	ctx = context.WithValue(ctx, query.CorruptChunksTrackerKey, corruptChunksTracker)
+	ctx = qapi.withOutputGroupings(ctx, r.FormValue("query"))
+	if noCache {
+		ctx = store.WithNoCache(ctx)
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_instant_query")
 	defer span.Finish()
 
-	qry, err := qapi.queryEngine.NewInstantQuery(qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false), r.FormValue("query"), ts)
+	queryable := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false)
+	if explain {
+		return qapi.explain(ctx, queryable, &queryPlan{
+			Query:               r.FormValue("query"),
+			Start:               ts,
+			End:                 ts,
+			Deduplicate:         enableDedup,
+			ReplicaLabels:       replicaLabels,
+			MaxSourceResolution: maxSourceResolution,
+			PartialResponse:     enablePartialResponse,
+		}, 0, estimate)
+	}
+
+	qry, err := qapi.queryEngine.NewInstantQuery(queryable, r.FormValue("query"), ts)
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
@@ -278,7 +804,7 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 		err = qapi.gate.Start(ctx)
 	})
 	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+		return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
 	}
 	defer qapi.gate.Done()
 
@@ -289,16 +815,33 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 			return nil, nil, &api.ApiError{Typ: api.ErrorCanceled, Err: res.Err}
 		case promql.ErrQueryTimeout:
 			return nil, nil, &api.ApiError{Typ: api.ErrorTimeout, Err: res.Err}
+		case promql.ErrTooManySamples:
+			return nil, nil, &api.ApiError{Typ: api.ErrorLimitExceeded, Err: res.Err}
 		case promql.ErrStorage:
 			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: res.Err}
 		}
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: res.Err}
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(res.Err, api.ErrorExec), Err: res.Err}
+	}
+	if err := qapi.checkOutputSeries(res.Value); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorLimitExceeded, Err: err}
 	}
 
-	return &queryData{
+	data := &queryData{
 		ResultType: res.Value.Type(),
 		Result:     res.Value,
-	}, res.Warnings, nil
+		round:      round,
+	}
+	if tracker != nil {
+		data.ReplicaInfo = newReplicaInfo(tracker.Stores(), qapi.unhealthyStoreLabelSets(), replicaLabels)
+	}
+	if sourcesTracker != nil {
+		data.SeriesSources = sourcesTracker.Series()
+	}
+	if counterResetsTracker != nil {
+		res.Warnings = append(res.Warnings, counterResetsTracker.Warnings()...)
+	}
+	res.Warnings = append(res.Warnings, corruptChunksTracker.Warnings()...)
+	return data, res.Warnings, nil
 }
 
 func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.ApiError) {
@@ -325,14 +868,20 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
 
-	// For safety, limit the number of returned points per timeseries.
-	// This is sufficient for 60s resolution for a week or 1h resolution for a year.
-	if end.Sub(start)/step > 11000 {
-		err := errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
+	// For safety, limit the number of returned points per timeseries before evaluating anything.
+	// The default of 11000 is sufficient for 60s resolution for a week or 1h resolution for a year.
+	if qapi.maxRangeQueryPoints > 0 && end.Sub(start)/step > time.Duration(qapi.maxRangeQueryPoints) {
+		err := errors.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", qapi.maxRangeQueryPoints)
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
 
 	ctx := r.Context()
+	// The soft deadline counts from the time the request was received, including the time waiting at the gate.
+	softDeadline, apiErr := qapi.parseSoftDeadlineParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	softDeadlineTime := time.Now().Add(softDeadline)
 	if to := r.FormValue("timeout"); to != "" {
 		var cancel context.CancelFunc
 		timeout, err := parseDuration(to)
@@ -364,18 +913,79 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
+	maxSourceResolution = qapi.clampDownsamplingMillis(r, maxSourceResolution, end.Sub(start), step)
 
 	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
 
+	enableReplicaInfo, apiErr := qapi.parseReplicaInfoParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enableSeriesSources, apiErr := qapi.parseSeriesSourcesParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	noCache, apiErr := qapi.parseNoCacheParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	explain, estimate, apiErr := qapi.parseExplainParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	round, apiErr := qapi.parseRoundingParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	var tracker *store.FanoutTracker
+	if (enableReplicaInfo && enableDedup) || softDeadline > 0 {
+		tracker = store.NewFanoutTracker()
+		ctx = context.WithValue(ctx, store.FanoutTrackerKey, tracker)
+	}
+	var sourcesTracker *query.SeriesSourcesTracker
+	if enableSeriesSources {
+		sourcesTracker = query.NewSeriesSourcesTracker(seriesSourcesLimit)
+		ctx = context.WithValue(ctx, query.SeriesSourcesTrackerKey, sourcesTracker)
+	}
+	var counterResetsTracker *query.CounterResetsTracker
+	if enableDedup {
+		counterResetsTracker = query.NewCounterResetsTracker()
+		ctx = context.WithValue(ctx, query.CounterResetsTrackerKey, counterResetsTracker)
+	}
+	corruptChunksTracker := query.NewCorruptChunksTracker()
+	ctx = context.WithValue(ctx, query.CorruptChunksTrackerKey, corruptChunksTracker)
+	ctx = qapi.withOutputGroupings(ctx, r.FormValue("query"))
+	if noCache {
+		ctx = store.WithNoCache(ctx)
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_range_query")
 	defer span.Finish()
 
+	queryable := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false)
+	if explain {
+		return qapi.explain(ctx, queryable, &queryPlan{
+			Query:               r.FormValue("query"),
+			Start:               start,
+			End:                 end,
+			Step:                step.String(),
+			Deduplicate:         enableDedup,
+			ReplicaLabels:       replicaLabels,
+			MaxSourceResolution: maxSourceResolution,
+			PartialResponse:     enablePartialResponse,
+		}, step, estimate)
+	}
+
 	qry, err := qapi.queryEngine.NewRangeQuery(
-		qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false),
+		queryable,
 		r.FormValue("query"),
 		start,
 		end,
@@ -389,66 +999,624 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		err = qapi.gate.Start(ctx)
 	})
 	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+		return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
 	}
 	defer qapi.gate.Done()
 
-	res := qry.Exec(ctx)
+	var (
+		res           *promql.Result
+		missingRanges []missingRange
+	)
+	if softDeadline > 0 {
+		res, missingRanges = qapi.execWithSoftDeadline(ctx, queryable, r.FormValue("query"), start, end, step, softDeadlineTime)
+	} else {
+		res = qry.Exec(ctx)
+	}
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
 			return nil, nil, &api.ApiError{Typ: api.ErrorCanceled, Err: res.Err}
 		case promql.ErrQueryTimeout:
 			return nil, nil, &api.ApiError{Typ: api.ErrorTimeout, Err: res.Err}
+		case promql.ErrTooManySamples:
+			return nil, nil, &api.ApiError{Typ: api.ErrorLimitExceeded, Err: res.Err}
 		}
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: res.Err}
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(res.Err, api.ErrorExec), Err: res.Err}
+	}
+	if err := qapi.checkOutputSeries(res.Value); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorLimitExceeded, Err: err}
 	}
 
-	return &queryData{
+	data := &queryData{
 		ResultType: res.Value.Type(),
 		Result:     res.Value,
-	}, res.Warnings, nil
+		round:      round,
+	}
+	if enableReplicaInfo && enableDedup {
+		data.ReplicaInfo = newReplicaInfo(tracker.Stores(), qapi.unhealthyStoreLabelSets(), replicaLabels)
+	}
+	if softDeadline > 0 {
+		data.Completeness = newCompleteness(missingRanges, tracker.Stores())
+	}
+	if sourcesTracker != nil {
+		data.SeriesSources = sourcesTracker.Series()
+	}
+	if counterResetsTracker != nil {
+		res.Warnings = append(res.Warnings, counterResetsTracker.Warnings()...)
+	}
+	res.Warnings = append(res.Warnings, corruptChunksTracker.Warnings()...)
+	return data, res.Warnings, nil
 }
 
-func (qapi *QueryAPI) labelValues(r *http.Request) (interface{}, []error, *api.ApiError) {
-	ctx := r.Context()
-	name := route.Param(ctx, "name")
+// queryPlan is returned instead of the result by queries with explain.
+type queryPlan struct {
+	Query               string    `json:"query"`
+	Start               time.Time `json:"start"`
+	End                 time.Time `json:"end"`
+	Step                string    `json:"step,omitempty"`
+	Deduplicate         bool      `json:"deduplicate"`
+	ReplicaLabels       []string  `json:"replicaLabels,omitempty"`
+	MaxSourceResolution int64     `json:"maxSourceResolution"`
+	PartialResponse     bool      `json:"partialResponse"`
+	// Selects are plans of selects of the query, in the order the engine makes them.
+	Selects []query.SelectPlan `json:"selects"`
+}
 
-	if !model.LabelNameRE.MatchString(name) {
-		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("invalid label name: %q", name)}
-	}
+// explain evaluates the query against a planning queryable, which records plans of selects instead of querying
+// StoreAPIs, and returns the plan. As no data is fetched, it doesn't wait at the query gate, unless selects are
+// estimated, which fetches labels of their series from StoreAPIs.
+func (qapi *QueryAPI) explain(ctx context.Context, queryable storage.Queryable, plan *queryPlan, step time.Duration, estimate bool) (interface{}, []error, *api.ApiError) {
+	pq := query.NewPlanningQueryable(queryable, estimate)
 
-	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	var (
+		qry promql.Query
+		err error
+	)
+	if step == 0 {
+		qry, err = qapi.queryEngine.NewInstantQuery(pq, plan.Query, plan.Start)
+	} else {
+		qry, err = qapi.queryEngine.NewRangeQuery(pq, plan.Query, plan.Start, plan.End, step)
+	}
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
+	defer qry.Close()
 
-	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
-	if apiErr != nil {
-		return nil, nil, apiErr
+	if estimate {
+		tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
+			err = qapi.gate.Start(ctx)
+		})
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
+		}
+		defer qapi.gate.Done()
 	}
 
-	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
-	if apiErr != nil {
-		return nil, nil, apiErr
+	res := qry.Exec(ctx)
+	if res.Err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: errors.Wrap(res.Err, "plan query")}
 	}
+	plan.Selects = pq.Plans()
+	return plan, res.Warnings, nil
+}
 
-	q, err := qapi.queryableCreate(true, nil, storeDebugMatchers, 0, enablePartialResponse, false).
-		Querier(ctx, timestamp.FromTime(start), timestamp.FromTime(end))
-	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
-	}
-	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable labelValues")
+// execWithSoftDeadline evaluates the range query in sub-ranges, newest first, until the soft deadline. Results of
+// sub-ranges evaluated in time are merged, while the remaining older sub-ranges are returned as missing. Errors other
+// than hitting the soft deadline fail the whole query.
+func (qapi *QueryAPI) execWithSoftDeadline(ctx context.Context, queryable storage.Queryable, qs string, start, end time.Time, step time.Duration, softDeadline time.Time) (*promql.Result, []missingRange) {
+	softCtx, cancel := context.WithDeadline(ctx, softDeadline)
+	defer cancel()
 
-	// TODO(fabxc): add back request context.
+	steps := int64(end.Sub(start)/step) + 1
+	stepsPerRange := (steps + softDeadlineSubRanges - 1) / softDeadlineSubRanges
 
-	vals, warnings, err := q.LabelValues(name)
-	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
-	}
+	var (
+		results  []promql.Matrix
+		warnings storage.Warnings
+		missing  []missingRange
+	)
+	for last := steps - 1; last >= 0; last -= stepsPerRange {
+		first := last - stepsPerRange + 1
+		if first < 0 {
+			first = 0
+		}
+		rangeStart, rangeEnd := start.Add(time.Duration(first)*step), start.Add(time.Duration(last)*step)
 
-	if vals == nil {
-		vals = make([]string, 0)
+		qry, err := qapi.queryEngine.NewRangeQuery(queryable, qs, rangeStart, rangeEnd, step)
+		if err != nil {
+			return &promql.Result{Err: err}, nil
+		}
+		res := qry.Exec(softCtx)
+		if res.Err != nil {
+			// Selects may fail on the soft deadline before the context is canceled, so the clock is checked instead.
+			if ctx.Err() != nil || time.Now().Before(softDeadline) {
+				return res, nil
+			}
+			// All older sub-ranges are missing as well, as the soft deadline passed.
+			missing = append(missing, missingRange{Start: float64(start.UnixNano()) / 1e9, End: float64(rangeEnd.UnixNano()) / 1e9})
+			break
+		}
+		m, err := res.Matrix()
+		if err != nil {
+			return &promql.Result{Err: err}, nil
+		}
+		results = append(results, m)
+		warnings = append(warnings, res.Warnings...)
+	}
+
+	// Sub-ranges were evaluated newest first, so their points are merged in reverse order.
+	var (
+		merged promql.Matrix
+		series = map[uint64]int{}
+	)
+	for i := len(results) - 1; i >= 0; i-- {
+		for _, s := range results[i] {
+			h := s.Metric.Hash()
+			if j, ok := series[h]; ok {
+				merged[j].Points = append(merged[j].Points, s.Points...)
+				continue
+			}
+			series[h] = len(merged)
+			merged = append(merged, s)
+		}
+	}
+	sort.Sort(merged)
+	return &promql.Result{Value: merged, Warnings: warnings}, missing
+}
+
+// newCompleteness returns the completeness of a query result given its missing time ranges and StoreAPIs queried
+// during its evaluation.
+func newCompleteness(missingRanges []missingRange, queried []store.FanoutStoreStatus) *completeness {
+	c := &completeness{MissingRanges: missingRanges}
+	for _, st := range queried {
+		if st.Failed {
+			c.MissingStores = append(c.MissingStores, st.Name)
+		}
+	}
+	c.Complete = len(c.MissingRanges) == 0 && len(c.MissingStores) == 0
+	return c
+}
+
+// queryLast returns the most recent sample of every series matching the given match[] selectors, looking back
+// at most lookback_delta from the evaluation time. Stores are asked for the given window only and each series
+// is trimmed to its tail chunks, which makes it much cheaper than an equivalent instant query.
+func (qapi *QueryAPI) queryLast(r *http.Request) (interface{}, []error, *api.ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}
+	}
+
+	ts, err := parseTimeParam(r, "time", qapi.baseAPI.Now())
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+
+	lookbackDelta := qapi.defaultLookbackDelta
+	if lookbackDelta == 0 {
+		lookbackDelta = defaultLookbackDelta
+	}
+	if val := r.FormValue(LookbackDeltaParam); val != "" {
+		lookbackDelta, err = parseDuration(val)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", LookbackDeltaParam)}
+		}
+		if lookbackDelta <= 0 {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("zero or negative '%s' is not accepted. Try a positive duration", LookbackDeltaParam)}
+		}
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	enableDedup, apiErr := qapi.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	replicaLabels, apiErr := qapi.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	// Same as for instant queries, raw data is used unless requested otherwise.
+	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, qapi.defaultInstantQueryMaxSourceResolution)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	ctx := r.Context()
+	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
+		err = qapi.gate.Start(ctx)
+	})
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
+	}
+	defer qapi.gate.Done()
+
+	// Similar to PromQL, the lookback window is left-open.
+	mint, maxt := timestamp.FromTime(ts.Add(-lookbackDelta))+1, timestamp.FromTime(ts)
+	q, err := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false).
+		Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable queryLast")
+
+	var (
+		vector = promql.Vector{}
+		sets   []storage.SeriesSet
+		hints  = &storage.SelectHints{Start: mint, End: maxt, Func: query.LastSampleFunc}
+	)
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(true, hints, mset...))
+	}
+
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	for set.Next() {
+		series := set.At()
+
+		var (
+			it    = series.Iterator()
+			found bool
+			p     promql.Point
+		)
+		for it.Next() {
+			t, v := it.At()
+			if value.IsStaleNaN(v) {
+				found = false
+				continue
+			}
+			p, found = promql.Point{T: t, V: v}, true
+		}
+		if it.Err() != nil {
+			return nil, nil, &api.ApiError{Typ: api.StoreErrorType(it.Err(), api.ErrorExec), Err: it.Err()}
+		}
+		if !found {
+			continue
+		}
+		vector = append(vector, promql.Sample{Metric: series.Labels(), Point: p})
+	}
+	if set.Err() != nil {
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(set.Err(), api.ErrorExec), Err: set.Err()}
+	}
+
+	return &queryData{
+		ResultType: parser.ValueTypeVector,
+		Result:     vector,
+	}, set.Warnings(), nil
+}
+
+// pointsData is the response of the query_points endpoint.
+type pointsData struct {
+	Result []pointsSeries `json:"result"`
+}
+
+// transform transforms series of the result as a matrix. Transformed points are placed back at their timestamps.
+// Timestamps without a value in any series stay without values.
+func (d *pointsData) transform(ctx context.Context, t ResultTransformer) error {
+	if len(d.Result) == 0 {
+		return nil
+	}
+	var (
+		m = make(promql.Matrix, 0, len(d.Result))
+		// ts are requested timestamps, known for positions with a value in any series.
+		ts    = make([]int64, len(d.Result[0].Values))
+		known = make([]bool, len(ts))
+	)
+	for _, s := range d.Result {
+		series := promql.Series{Metric: s.Metric}
+		for i, p := range s.Values {
+			if p != nil {
+				series.Points = append(series.Points, *p)
+				ts[i], known[i] = p.T, true
+			}
+		}
+		m = append(m, series)
+	}
+
+	v, err := t.Transform(ctx, m)
+	if err != nil {
+		return err
+	}
+	transformed, ok := v.(promql.Matrix)
+	if !ok {
+		return errors.Errorf("transformer returned %s instead of matrix", v.Type())
+	}
+	result := make([]pointsSeries, 0, len(transformed))
+	for _, series := range transformed {
+		points := make(map[int64]promql.Point, len(series.Points))
+		for _, p := range series.Points {
+			points[p.T] = p
+		}
+		values := make([]*promql.Point, len(ts))
+		for i, t := range ts {
+			if p, ok := points[t]; known[i] && ok {
+				values[i] = &p
+			}
+		}
+		result = append(result, pointsSeries{Metric: series.Metric, Values: values})
+	}
+	d.Result = result
+	return nil
+}
+
+// pointsSeries holds values of a series at requested timestamps.
+type pointsSeries struct {
+	Metric labels.Labels `json:"metric"`
+	// Values has an item for each requested timestamp, in the order of the request. The item is nil if the series
+	// has no sample within the lookback delta before the timestamp.
+	Values []*promql.Point `json:"values"`
+}
+
+// queryPoints evaluates series selectors at an explicit, arbitrarily spaced list of timestamps.
+func (qapi *QueryAPI) queryPoints(r *http.Request) (interface{}, []error, *api.ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}
+	}
+	if len(r.Form["time[]"]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no time[] parameter provided")}
+	}
+	if qapi.maxRangeQueryPoints > 0 && len(r.Form["time[]"]) > qapi.maxRangeQueryPoints {
+		err := errors.Errorf("exceeded maximum resolution of %d points per timeseries. Try requesting fewer timestamps", qapi.maxRangeQueryPoints)
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+
+	ts := make([]int64, 0, len(r.Form["time[]"]))
+	for _, s := range r.Form["time[]"] {
+		t, err := parseTime(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "param time[]")}
+		}
+		ts = append(ts, timestamp.FromTime(t))
+	}
+
+	lookbackDelta := qapi.defaultLookbackDelta
+	if lookbackDelta == 0 {
+		lookbackDelta = defaultLookbackDelta
+	}
+	if val := r.FormValue(LookbackDeltaParam); val != "" {
+		var err error
+		lookbackDelta, err = parseDuration(val)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", LookbackDeltaParam)}
+		}
+		if lookbackDelta <= 0 {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("zero or negative '%s' is not accepted. Try a positive duration", LookbackDeltaParam)}
+		}
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	enableDedup, apiErr := qapi.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	replicaLabels, apiErr := qapi.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, qapi.defaultInstantQueryMaxSourceResolution)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	// Timestamps are evaluated in ascending order, so each series is iterated only once.
+	order := make([]int, len(ts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return ts[order[i]] < ts[order[j]] })
+
+	var (
+		ctx = r.Context()
+		err error
+	)
+	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
+		err = qapi.gate.Start(ctx)
+	})
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
+	}
+	defer qapi.gate.Done()
+
+	lookback := lookbackDelta.Milliseconds()
+	mint, maxt := ts[order[0]]-lookback+1, ts[order[len(order)-1]]
+	q, err := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false).
+		Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable queryPoints")
+
+	var (
+		data  = &pointsData{Result: []pointsSeries{}}
+		sets  []storage.SeriesSet
+		hints = &storage.SelectHints{Start: mint, End: maxt}
+	)
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(true, hints, mset...))
+	}
+
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	for set.Next() {
+		series := set.At()
+
+		values, found, err := pointsAt(series.Iterator(), ts, order, lookback)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.StoreErrorType(err, api.ErrorExec), Err: err}
+		}
+		if !found {
+			continue
+		}
+		data.Result = append(data.Result, pointsSeries{Metric: series.Labels(), Values: values})
+	}
+	if set.Err() != nil {
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(set.Err(), api.ErrorExec), Err: set.Err()}
+	}
+	return data, set.Warnings(), nil
+}
+
+// pointsAt returns the value of the series at each of given timestamps, i.e. its most recent sample within the
+// lookback window before the timestamp, same as PromQL instant vector selectors do. Timestamps are visited in the
+// ascending order given by order, and the iterator is moved to each lookback window with Seek.
+func pointsAt(it chunkenc.Iterator, ts []int64, order []int, lookback int64) (_ []*promql.Point, found bool, _ error) {
+	var (
+		values = make([]*promql.Point, len(ts))
+
+		// last is the most recent sample at or before the previous timestamp, next is the sample the iterator is at.
+		lastT, nextT int64
+		lastV, nextV float64
+		hasLast      bool
+		hasNext      = it.Next()
+	)
+	if hasNext {
+		nextT, nextV = it.At()
+	}
+	for _, i := range order {
+		t := ts[i]
+
+		// Similar to PromQL, the lookback window is left-open.
+		if hasNext && nextT <= t-lookback {
+			hasLast = false
+			if hasNext = it.Seek(t - lookback + 1); hasNext {
+				nextT, nextV = it.At()
+			}
+		}
+		for hasNext && nextT <= t {
+			lastT, lastV, hasLast = nextT, nextV, true
+			if hasNext = it.Next(); hasNext {
+				nextT, nextV = it.At()
+			}
+		}
+		if !hasLast || lastT <= t-lookback || value.IsStaleNaN(lastV) {
+			continue
+		}
+		values[i] = &promql.Point{T: t, V: lastV}
+		found = true
+	}
+	if it.Err() != nil {
+		return nil, false, it.Err()
+	}
+	return values, found, nil
+}
+
+func (qapi *QueryAPI) labelValues(r *http.Request) (interface{}, []error, *api.ApiError) {
+	ctx := r.Context()
+	name := route.Param(ctx, "name")
+
+	if !model.LabelNameRE.MatchString(name) {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("invalid label name: %q", name)}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	q, err := qapi.queryableCreate(true, nil, storeDebugMatchers, 0, enablePartialResponse, false).
+		Querier(ctx, timestamp.FromTime(start), timestamp.FromTime(end))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable labelValues")
+
+	// TODO(fabxc): add back request context.
+
+	var (
+		vals     []string
+		warnings storage.Warnings
+	)
+	if len(matcherSets) == 0 {
+		vals, warnings, err = q.LabelValues(name)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.StoreErrorType(err, api.ErrorExec), Err: err}
+		}
+	} else {
+		lq, ok := q.(query.LabelValuesQuerier)
+		if !ok {
+			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.New("querier does not support match[] for label values")}
+		}
+
+		// Values of series matching any of the given selectors are returned.
+		sets := make([][]string, 0, len(matcherSets))
+		for _, matchers := range matcherSets {
+			v, w, err := lq.LabelValuesWithMatchers(name, matchers...)
+			if err != nil {
+				return nil, nil, &api.ApiError{Typ: api.StoreErrorType(err, api.ErrorExec), Err: err}
+			}
+			warnings = append(warnings, w...)
+			sets = append(sets, v)
+		}
+		vals = strutil.MergeSlices(sets...)
+	}
+
+	if vals == nil {
+		vals = make([]string, 0)
 	}
 
 	return vals, warnings, nil
@@ -517,11 +1685,89 @@ func (qapi *QueryAPI) series(r *http.Request) (interface{}, []error, *api.ApiErr
 		metrics = append(metrics, set.At().Labels())
 	}
 	if set.Err() != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: set.Err()}
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(set.Err(), api.ErrorExec), Err: set.Err()}
 	}
 	return metrics, set.Warnings(), nil
 }
 
+// export sends merged series matching given selectors to the configured remote write endpoint.
+func (qapi *QueryAPI) export(r *http.Request) (interface{}, []error, *api.ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	enableDedup, apiErr := qapi.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	replicaLabels, apiErr := qapi.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, 0)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	ctx := r.Context()
+	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
+		err = qapi.gate.Start(ctx)
+	})
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: gateErrorType(err), Err: err}
+	}
+	defer qapi.gate.Done()
+
+	q, err := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false).
+		Querier(ctx, timestamp.FromTime(start), timestamp.FromTime(end))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable export")
+
+	var sets []storage.SeriesSet
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(true, nil, mset...))
+	}
+
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	stats, err := qapi.exporter.Export(ctx, set)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(err, api.ErrorExec), Err: err}
+	}
+	return stats, set.Warnings(), nil
+}
+
 func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.ApiError) {
 	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
 	if err != nil {
@@ -547,7 +1793,7 @@ func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.Ap
 
 	names, warnings, err := q.LabelNames()
 	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+		return nil, nil, &api.ApiError{Typ: api.StoreErrorType(err, api.ErrorExec), Err: err}
 	}
 
 	return names, warnings, nil
@@ -27,10 +27,12 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/route"
 	promgate "github.com/prometheus/prometheus/pkg/gate"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -40,6 +42,8 @@ import (
 	"github.com/prometheus/prometheus/rules"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
+	"google.golang.org/grpc/metadata"
+
 	"github.com/thanos-io/thanos/pkg/compact"
 
 	baseAPI "github.com/thanos-io/thanos/pkg/api"
@@ -171,14 +175,15 @@ func TestQueryEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout),
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout, query.QueryableCreatorOpts{}),
 		queryEngine: promql.NewEngine(promql.EngineOpts{
 			Logger:     nil,
 			Reg:        nil,
 			MaxSamples: 10000,
 			Timeout:    timeout,
 		}),
-		gate: gate.New(nil, 4),
+		gate:                gate.New(nil, 4),
+		maxRangeQueryPoints: 100,
 	}
 
 	start := time.Unix(0, 0)
@@ -198,6 +203,70 @@ func TestQueryEndpoints(t *testing.T) {
 				},
 			},
 		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":        []string{"2"},
+				"time":         []string{"123.4"},
+				"replica_info": []string{"true"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+				ReplicaInfo: &replicaInfo{Groups: []replicaGroupInfo{}},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":        []string{"2"},
+				"time":         []string{"123.4"},
+				"replica_info": []string{"true"},
+				"dedup":        []string{"false"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":        []string{"2"},
+				"replica_info": []string{"maybe"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":          []string{"2"},
+				"time":           []string{"123.4"},
+				"series_sources": []string{"true"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+				SeriesSources: []query.SeriesSources{},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":          []string{"2"},
+				"series_sources": []string{"maybe"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		{
 			endpoint: api.query,
 			query: url.Values{
@@ -475,6 +544,90 @@ func TestQueryEndpoints(t *testing.T) {
 				},
 			},
 		},
+		// Rounding of sample values.
+		{
+			endpoint: api.transformResults(api.queryRange),
+			query: url.Values{
+				"query":          []string{"time() / 3"},
+				"start":          []string{"0"},
+				"end":            []string{"2"},
+				"step":           []string{"1"},
+				"decimal_places": []string{"2"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeMatrix,
+				Result: promql.Matrix{
+					promql.Series{
+						Points: []promql.Point{
+							{V: 0, T: timestamp.FromTime(start)},
+							{V: 0.33, T: timestamp.FromTime(start.Add(1 * time.Second))},
+							{V: 0.67, T: timestamp.FromTime(start.Add(2 * time.Second))},
+						},
+						Metric: nil,
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.transformResults(api.query),
+			query: url.Values{
+				"query":              []string{"20000 / 3"},
+				"time":               []string{"123.4"},
+				"significant_digits": []string{"3"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 6670,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.transformResults(api.query),
+			query: url.Values{
+				"query":              []string{"vector(-1 / 0)"},
+				"time":               []string{"123.4"},
+				"significant_digits": []string{"1"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeVector,
+				Result: promql.Vector{
+					{
+						Metric: labels.Labels{},
+						Point:  promql.Point{V: math.Inf(-1), T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond))},
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":              []string{"2"},
+				"significant_digits": []string{"2"},
+				"decimal_places":     []string{"2"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":              []string{"2"},
+				"significant_digits": []string{"0"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query":          []string{"time()"},
+				"start":          []string{"0"},
+				"end":            []string{"2"},
+				"step":           []string{"1"},
+				"decimal_places": []string{"18"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		// Missing query params in range queries.
 		{
 			endpoint: api.queryRange,
@@ -533,6 +686,17 @@ func TestQueryEndpoints(t *testing.T) {
 			},
 			errType: baseAPI.ErrorBadData,
 		},
+		// Too many points per timeseries.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"end":   []string{"101"},
+				"step":  []string{"1"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		// Start after end.
 		{
 			endpoint: api.queryRange,
@@ -555,6 +719,134 @@ func TestQueryEndpoints(t *testing.T) {
 			},
 			errType: baseAPI.ErrorBadData,
 		},
+		// Latest sample of each deduplicated series.
+		{
+			endpoint: api.queryLast,
+			query: url.Values{
+				"match[]":         []string{"test_metric_replica1"},
+				"time":            []string{"1970-01-01T00:02:30Z"},
+				"replicaLabels[]": []string{"replica", "replica1"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeVector,
+				Result: promql.Vector{
+					{
+						Metric: labels.FromStrings("__name__", "test_metric_replica1", "foo", "bar"),
+						Point:  promql.Point{T: 120000, V: 2},
+					},
+					{
+						Metric: labels.FromStrings("__name__", "test_metric_replica1", "foo", "boo"),
+						Point:  promql.Point{T: 120000, V: 2},
+					},
+				},
+			},
+		},
+		// Latest sample with custom lookback delta.
+		{
+			endpoint: api.queryLast,
+			query: url.Values{
+				"match[]":        []string{`test_metric1{foo="bar"}`},
+				"time":           []string{"1970-01-01T00:20:00Z"},
+				"lookback_delta": []string{"15m"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeVector,
+				Result: promql.Vector{
+					{
+						Metric: labels.FromStrings("__name__", "test_metric1", "foo", "bar"),
+						Point:  promql.Point{T: 540000, V: 9},
+					},
+				},
+			},
+		},
+		// No sample within the default lookback delta.
+		{
+			endpoint: api.queryLast,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+				"time":    []string{"1970-01-01T00:20:00Z"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeVector,
+				Result:     promql.Vector{},
+			},
+		},
+		{
+			endpoint: api.queryLast,
+			query: url.Values{
+				"time": []string{"1970-01-01T00:20:00Z"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.queryLast,
+			query: url.Values{
+				"match[]":        []string{"test_metric1"},
+				"lookback_delta": []string{"-1s"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		// Values at arbitrary, out-of-order and duplicated timestamps, in the order of the request.
+		{
+			endpoint: api.queryPoints,
+			query: url.Values{
+				"match[]": []string{`test_metric1{foo="bar"}`, "test_metric2"},
+				"time[]":  []string{"330", "60", "1200", "0", "330", "59.999"},
+			},
+			response: &pointsData{
+				Result: []pointsSeries{
+					{
+						Metric: labels.FromStrings("__name__", "test_metric1", "foo", "bar"),
+						Values: []*promql.Point{{T: 330000, V: 5}, {T: 60000, V: 1}, nil, {T: 0, V: 0}, {T: 330000, V: 5}, {T: 59999, V: 0}},
+					},
+					{
+						Metric: labels.FromStrings("__name__", "test_metric2", "foo", "boo"),
+						Values: []*promql.Point{{T: 330000, V: 5}, {T: 60000, V: 1}, nil, {T: 0, V: 0}, {T: 330000, V: 5}, {T: 59999, V: 0}},
+					},
+				},
+			},
+		},
+		// Custom lookback delta, timestamps far apart are evaluated within their own windows.
+		{
+			endpoint: api.queryPoints,
+			query: url.Values{
+				"match[]":        []string{`test_metric1{foo="bar"}`},
+				"time[]":         []string{"1200", "30", "599"},
+				"lookback_delta": []string{"1m"},
+			},
+			response: &pointsData{
+				Result: []pointsSeries{
+					{
+						Metric: labels.FromStrings("__name__", "test_metric1", "foo", "bar"),
+						Values: []*promql.Point{nil, {T: 30000, V: 0}, {T: 599000, V: 9}},
+					},
+				},
+			},
+		},
+		// Series without values at any timestamp are not returned.
+		{
+			endpoint: api.queryPoints,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+				"time[]":  []string{"1200"},
+			},
+			response: &pointsData{Result: []pointsSeries{}},
+		},
+		{
+			endpoint: api.queryPoints,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.queryPoints,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+				"time[]":  []string{"abc"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		// Bad dedup parameter.
 		{
 			endpoint: api.queryRange,
@@ -574,6 +866,59 @@ func TestQueryEndpoints(t *testing.T) {
 			return
 		}
 	}
+
+	// Queries are shed once the admission gate is saturated.
+	admissionGate := gate.NewAdmissionGate(nil, gate.New(nil, 4), gate.AdmissionConfig{MaxInFlight: 1})
+	testutil.Ok(t, admissionGate.Start(context.Background()))
+	defer admissionGate.Done()
+
+	overloadedAPI := *api
+	overloadedAPI.gate = admissionGate
+	for i, test := range []endpointTestCase{
+		{
+			endpoint: overloadedAPI.query,
+			query: url.Values{
+				"query": []string{"2"},
+			},
+			errType: baseAPI.ErrorOverloaded,
+		},
+		{
+			endpoint: overloadedAPI.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"end":   []string{"2"},
+				"step":  []string{"1"},
+			},
+			errType: baseAPI.ErrorOverloaded,
+		},
+		{
+			endpoint: overloadedAPI.queryLast,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+			},
+			errType: baseAPI.ErrorOverloaded,
+		},
+		{
+			endpoint: overloadedAPI.queryPoints,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+				"time[]":  []string{"0", "60"},
+			},
+			errType: baseAPI.ErrorOverloaded,
+		},
+		{
+			endpoint: overloadedAPI.export,
+			query: url.Values{
+				"match[]": []string{"test_metric1"},
+			},
+			errType: baseAPI.ErrorOverloaded,
+		},
+	} {
+		if ok := testEndpoint(t, test, fmt.Sprintf("overloaded #%d %s", i, test.query.Encode())); !ok {
+			return
+		}
+	}
 }
 
 func TestMetadataEndpoints(t *testing.T) {
@@ -661,7 +1006,7 @@ func TestMetadataEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout),
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout, query.QueryableCreatorOpts{}),
 		queryEngine: promql.NewEngine(promql.EngineOpts{
 			Logger:     nil,
 			Reg:        nil,
@@ -674,7 +1019,7 @@ func TestMetadataEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout),
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout, query.QueryableCreatorOpts{}),
 		queryEngine: promql.NewEngine(promql.EngineOpts{
 			Logger:     nil,
 			Reg:        nil,
@@ -788,6 +1133,52 @@ func TestMetadataEndpoints(t *testing.T) {
 				"foo",
 			},
 		},
+		// Label values scoped by matchers.
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+			},
+			params: map[string]string{
+				"name": "foo",
+			},
+			response: []string{
+				"boo",
+			},
+		},
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"match[]": []string{`test_metric2`, `test_metric_replica1{foo="bar"}`},
+			},
+			params: map[string]string{
+				"name": "foo",
+			},
+			response: []string{
+				"bar",
+				"boo",
+			},
+		},
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"match[]": []string{`{foo="bar"}`},
+			},
+			params: map[string]string{
+				"name": "replica1",
+			},
+			response: []string{},
+		},
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"match[]": []string{`{foo`},
+			},
+			params: map[string]string{
+				"name": "foo",
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		// Bad name parameter.
 		{
 			endpoint: api.labelValues,
@@ -1264,6 +1655,647 @@ func TestParseDownsamplingParamMillis(t *testing.T) {
 	}
 }
 
+func TestClampDownsamplingMillis(t *testing.T) {
+	for i, tc := range []struct {
+		maxSourceResolutionParam string
+		enableAutodownsampling   bool
+		clampRatio               int
+		queryRange               time.Duration
+		step                     time.Duration
+		result                   int64
+	}{
+		// Clamped by default: ratio of 30d range and 6h step is 120, 1h resolution fits 5 samples between steps.
+		{clampRatio: DefaultAutoDownsamplingClampRatio, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevel1h)},
+		{clampRatio: DefaultAutoDownsamplingClampRatio, queryRange: 7 * 24 * time.Hour, step: time.Hour, result: int64(compact.ResolutionLevel5m)},
+		// Ratio of 1d range and 5m step is 288, above the default.
+		{clampRatio: DefaultAutoDownsamplingClampRatio, queryRange: 24 * time.Hour, step: 5 * time.Minute, result: int64(compact.ResolutionLevelRaw)},
+		// Clamping disabled.
+		{clampRatio: 0, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		// Ratio of 30d range and 6h step is 120, clamped to the coarsest resolution fitting 5 samples between steps.
+		{clampRatio: 120, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevel1h)},
+		{clampRatio: 119, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		{clampRatio: 120, queryRange: 30*24*time.Hour + time.Millisecond, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		{clampRatio: 720, queryRange: 30 * 24 * time.Hour, step: time.Hour, result: int64(compact.ResolutionLevel5m)},
+		// Step too small for any downsampled resolution, regardless of ratio.
+		{clampRatio: 1000, queryRange: 24 * time.Hour, step: 10 * time.Minute, result: int64(compact.ResolutionLevelRaw)},
+		// Explicit max_source_resolution param overrides clamping.
+		{maxSourceResolutionParam: "0s", clampRatio: DefaultAutoDownsamplingClampRatio, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		{maxSourceResolutionParam: "0s", clampRatio: 120, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		{maxSourceResolutionParam: "5m", clampRatio: 120, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevel5m)},
+		{maxSourceResolutionParam: "raw", clampRatio: 120, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(compact.ResolutionLevelRaw)},
+		// Auto downsampling already picks coarser resolution.
+		{enableAutodownsampling: true, clampRatio: 120, queryRange: 30 * 24 * time.Hour, step: 6 * time.Hour, result: int64(6*time.Hour/time.Millisecond) / 5},
+	} {
+		api := QueryAPI{
+			enableAutodownsampling:     tc.enableAutodownsampling,
+			autoDownsamplingClampRatio: tc.clampRatio,
+			gate:                       gate.New(nil, 4),
+		}
+		v := url.Values{}
+		if tc.maxSourceResolutionParam != "" {
+			v.Set(MaxSourceResolutionParam, tc.maxSourceResolutionParam)
+		}
+		r := http.Request{PostForm: v}
+
+		maxResMillis, apiErr := api.parseDownsamplingParamMillis(&r, tc.step/5)
+		testutil.Assert(t, apiErr == nil, "case %v: unexpected error %v", i, apiErr)
+		maxResMillis = api.clampDownsamplingMillis(&r, maxResMillis, tc.queryRange, tc.step)
+		testutil.Assert(t, maxResMillis == tc.result, "case %v: expected %v to be equal to %v", i, maxResMillis, tc.result)
+	}
+}
+
+func TestParseRoundingParam(t *testing.T) {
+	for i, tc := range []struct {
+		param, value string
+		input        float64
+		result       float64
+	}{
+		{param: SignificantDigitsParam, value: "3", input: 1234.5678, result: 1230},
+		{param: SignificantDigitsParam, value: "3", input: 0.00123456, result: 0.00123},
+		{param: SignificantDigitsParam, value: "17", input: 0.1 + 0.2, result: 0.1 + 0.2},
+		{param: DecimalPlacesParam, value: "2", input: 1234.5678, result: 1234.57},
+		{param: DecimalPlacesParam, value: "0", input: -2.5, result: -2},
+		{param: DecimalPlacesParam, value: "2", input: 0.001, result: 0},
+		// Special values are preserved.
+		{param: DecimalPlacesParam, value: "2", input: math.Inf(1), result: math.Inf(1)},
+		{param: SignificantDigitsParam, value: "2", input: math.Inf(-1), result: math.Inf(-1)},
+		{param: SignificantDigitsParam, value: "2", input: math.NaN(), result: math.NaN()},
+	} {
+		api := QueryAPI{}
+		r := http.Request{PostForm: url.Values{tc.param: []string{tc.value}}}
+
+		round, apiErr := api.parseRoundingParam(&r)
+		testutil.Assert(t, apiErr == nil, "case %v: unexpected error %v", i, apiErr)
+		res := round(tc.input)
+		if math.IsNaN(tc.result) {
+			testutil.Assert(t, math.IsNaN(res), "case %v: expected NaN, got %v", i, res)
+			continue
+		}
+		testutil.Assert(t, res == tc.result, "case %v: expected %v to be equal to %v", i, res, tc.result)
+	}
+
+	// No rounding without parameters.
+	round, apiErr := (&QueryAPI{}).parseRoundingParam(&http.Request{PostForm: url.Values{}})
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Assert(t, round == nil, "expected no rounding")
+}
+
+// resolutionCapturingStore records the max resolution window of Series requests.
+type resolutionCapturingStore struct {
+	storepb.StoreServer
+
+	maxResolutionWindows []int64
+}
+
+func (s *resolutionCapturingStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.maxResolutionWindows = append(s.maxResolutionWindows, r.MaxResolutionWindow)
+	return s.StoreServer.Series(r, srv)
+}
+
+func TestQueryEndpoints_MaxSourceResolution(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	st := &resolutionCapturingStore{StoreServer: store.NewTSDBStore(nil, nil, db, component.Query, nil)}
+	timeout := 100 * time.Second
+	api := &QueryAPI{
+		baseAPI: &baseAPI.BaseAPI{
+			Now: func() time.Time { return time.Unix(0, 0) },
+		},
+		queryableCreate: query.NewQueryableCreator(nil, nil, st, 2, timeout, query.QueryableCreatorOpts{}),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: 10000,
+			Timeout:    timeout,
+		}),
+		gate:                                   gate.New(nil, 4),
+		defaultInstantQueryMaxSourceResolution: 5 * time.Minute,
+	}
+
+	for _, tc := range []struct {
+		param string
+		// Expected max resolution window of instant and range (with 1h step) queries.
+		instant, rng int64
+		fail         bool
+	}{
+		{param: "", instant: int64(compact.ResolutionLevelRaw), rng: int64(compact.ResolutionLevelRaw)},
+		{param: "raw", instant: int64(compact.ResolutionLevelRaw), rng: int64(compact.ResolutionLevelRaw)},
+		{param: "0s", instant: int64(compact.ResolutionLevelRaw), rng: int64(compact.ResolutionLevelRaw)},
+		{param: "5m", instant: int64(compact.ResolutionLevel5m), rng: int64(compact.ResolutionLevel5m)},
+		{param: "1h", instant: int64(compact.ResolutionLevel1h), rng: int64(compact.ResolutionLevel1h)},
+		// Instant queries use the configured default, range queries fit at least 5 samples between steps.
+		{param: "auto", instant: int64(compact.ResolutionLevel5m), rng: int64(12 * time.Minute / time.Millisecond)},
+		{param: "RAW", fail: true},
+		{param: "fine", fail: true},
+		{param: "-5m", fail: true},
+	} {
+		t.Run(tc.param, func(t *testing.T) {
+			instant := url.Values{"query": []string{"up"}, "time": []string{"7200"}}
+			rng := url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"7200"}, "step": []string{"3600"}}
+			if tc.param != "" {
+				instant.Set(MaxSourceResolutionParam, tc.param)
+				rng.Set(MaxSourceResolutionParam, tc.param)
+			}
+
+			for _, c := range []struct {
+				endpoint baseAPI.ApiFunc
+				query    url.Values
+				expected int64
+			}{
+				{endpoint: api.query, query: instant, expected: tc.instant},
+				{endpoint: api.queryRange, query: rng, expected: tc.rng},
+			} {
+				st.maxResolutionWindows = nil
+
+				r, err := http.NewRequest(http.MethodGet, "http://example.com?"+c.query.Encode(), nil)
+				testutil.Ok(t, err)
+				_, _, apiErr := c.endpoint(r)
+				if tc.fail {
+					testutil.Assert(t, apiErr != nil, "expected error")
+					testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+					testutil.Equals(t, 0, len(st.maxResolutionWindows))
+					continue
+				}
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Assert(t, len(st.maxResolutionWindows) > 0, "expected store to be queried")
+				for _, w := range st.maxResolutionWindows {
+					testutil.Equals(t, c.expected, w)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryEndpoints_Explain(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender(context.Background())
+	for _, replica := range []string{"r1", "r2"} {
+		_, err = app.Add(labels.FromStrings("__name__", "up", "job", "a", "replica", replica), 7000000, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	st := &resolutionCapturingStore{StoreServer: store.NewTSDBStore(nil, nil, db, component.Query, nil)}
+	timeout := 100 * time.Second
+	api := &QueryAPI{
+		baseAPI: &baseAPI.BaseAPI{
+			Now: func() time.Time { return time.Unix(0, 0) },
+		},
+		queryableCreate: query.NewQueryableCreator(nil, nil, st, 2, timeout, query.QueryableCreatorOpts{}),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: 10000,
+			Timeout:    timeout,
+		}),
+		gate:          gate.New(nil, 4),
+		replicaLabels: []string{"replica"},
+	}
+
+	q := `sum by (job) (rate(up{job="a"}[5m]))`
+	for _, c := range []struct {
+		name     string
+		endpoint baseAPI.ApiFunc
+		query    url.Values
+		estimate bool
+		expected *queryPlan
+	}{
+		{
+			name:     "instant",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{q}, "time": []string{"7200"}, "explain": []string{"true"}},
+			expected: &queryPlan{
+				Query:         q,
+				Start:         time.Unix(7200, 0),
+				End:           time.Unix(7200, 0),
+				Deduplicate:   true,
+				ReplicaLabels: []string{"replica"},
+				Selects: []query.SelectPlan{{
+					Matchers:      []string{`job="a"`, `__name__="up"`},
+					Start:         6900000,
+					End:           7200000,
+					Func:          "rate",
+					Aggregates:    []string{"COUNTER"},
+					Deduplicate:   true,
+					ReplicaLabels: []string{"replica"},
+					Optimizations: []string{},
+				}},
+			},
+		},
+		{
+			name:     "range",
+			endpoint: api.queryRange,
+			query: url.Values{"query": []string{q}, "start": []string{"0"}, "end": []string{"7200"}, "step": []string{"3600"},
+				"explain": []string{"1"}, "dedup": []string{"false"}, "max_source_resolution": []string{"1h"}},
+			expected: &queryPlan{
+				Query:               q,
+				Start:               time.Unix(0, 0),
+				End:                 time.Unix(7200, 0),
+				Step:                "1h0m0s",
+				ReplicaLabels:       []string{"replica"},
+				MaxSourceResolution: int64(compact.ResolutionLevel1h),
+				Selects: []query.SelectPlan{{
+					Matchers:            []string{`job="a"`, `__name__="up"`},
+					Start:               -300000,
+					End:                 7200000,
+					Func:                "rate",
+					MaxSourceResolution: int64(compact.ResolutionLevel1h),
+					Aggregates:          []string{"COUNTER"},
+					Optimizations:       []string{query.OptimizationAggregatesPushdown},
+				}},
+			},
+		},
+		{
+			// Estimates fetch labels of matching series.
+			name:     "instant with estimate",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{q}, "time": []string{"7200"}, "explain": []string{"true"}, "explain_estimate": []string{"true"}},
+			estimate: true,
+			expected: &queryPlan{
+				Query:         q,
+				Start:         time.Unix(7200, 0),
+				End:           time.Unix(7200, 0),
+				Deduplicate:   true,
+				ReplicaLabels: []string{"replica"},
+				Selects: []query.SelectPlan{{
+					Matchers:      []string{`job="a"`, `__name__="up"`},
+					Start:         6900000,
+					End:           7200000,
+					Func:          "rate",
+					Aggregates:    []string{"COUNTER"},
+					Deduplicate:   true,
+					ReplicaLabels: []string{"replica"},
+					Optimizations: []string{},
+					Estimate:      &query.SelectEstimate{Series: 2, DeduplicatedSeries: 1, Chunks: 2},
+				}},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			st.maxResolutionWindows = nil
+
+			r, err := http.NewRequest(http.MethodGet, "http://example.com?"+c.query.Encode(), nil)
+			testutil.Ok(t, err)
+			res, _, apiErr := c.endpoint(r)
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, c.expected, res)
+			if !c.estimate {
+				testutil.Equals(t, 0, len(st.maxResolutionWindows))
+			}
+		})
+	}
+
+	for _, params := range []string{"explain=maybe", "explain=true&explain_estimate=maybe"} {
+		r, err := http.NewRequest(http.MethodGet, "http://example.com?query=up&"+params, nil)
+		testutil.Ok(t, err)
+		_, _, apiErr := api.query(r)
+		testutil.Assert(t, apiErr != nil, "expected error")
+		testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+	}
+}
+
+type failingResultTransformer struct{}
+
+func (failingResultTransformer) Transform(context.Context, parser.Value) (parser.Value, error) {
+	return nil, errors.New("unsupported result")
+}
+
+func TestQueryEndpoints_ResultTransformer(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender(context.Background())
+	_, err = app.Add(labels.FromStrings("__name__", "node_memory_bytes", "node", "a"), 0, 2*(1<<30))
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	timeout := 100 * time.Second
+	api := &QueryAPI{
+		baseAPI: &baseAPI.BaseAPI{
+			Now: func() time.Time { return time.Unix(0, 0) },
+		},
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout, query.QueryableCreatorOpts{}),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: 10000,
+			Timeout:    timeout,
+		}),
+		gate: gate.New(nil, 4),
+	}
+	api.resultTransformer = ChainResultTransformers(NopResultTransformer{}, BytesToGiBTransformer{})
+
+	instant := url.Values{"query": []string{"node_memory_bytes"}, "time": []string{"0"}}
+	rng := url.Values{"query": []string{"node_memory_bytes"}, "start": []string{"0"}, "end": []string{"0"}, "step": []string{"1"}}
+	do := func(endpoint baseAPI.ApiFunc, query url.Values) (interface{}, *baseAPI.ApiError) {
+		r, err := http.NewRequest(http.MethodGet, "http://example.com?"+query.Encode(), nil)
+		testutil.Ok(t, err)
+		res, _, apiErr := api.transformResults(endpoint)(r)
+		return res, apiErr
+	}
+	converted := labels.FromStrings("__name__", "node_memory_gibibytes", "node", "a")
+
+	res, apiErr := do(api.query, instant)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Vector{{Metric: converted, Point: promql.Point{T: 0, V: 2}}}, res.(*queryData).Result)
+
+	res, apiErr = do(api.queryRange, rng)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Matrix{{Metric: converted, Points: []promql.Point{{T: 0, V: 2}}}}, res.(*queryData).Result)
+
+	softDeadline := url.Values{SoftDeadlineParam: []string{"1m"}}
+	for k, v := range rng {
+		softDeadline[k] = v
+	}
+	res, apiErr = do(api.queryRange, softDeadline)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Matrix{{Metric: converted, Points: []promql.Point{{T: 0, V: 2}}}}, res.(*queryData).Result)
+
+	res, apiErr = do(api.queryLast, url.Values{"match[]": []string{"node_memory_bytes"}, "time": []string{"0"}})
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Vector{{Metric: converted, Point: promql.Point{T: 0, V: 2}}}, res.(*queryData).Result)
+
+	// Timestamps without values stay without values.
+	res, apiErr = do(api.queryPoints, url.Values{"match[]": []string{"node_memory_bytes"}, "time[]": []string{"0", "-1"}})
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, []pointsSeries{{Metric: converted, Values: []*promql.Point{{T: 0, V: 2}, nil}}}, res.(*pointsData).Result)
+
+	// Transformed values are rounded.
+	res, apiErr = do(api.query, url.Values{"query": []string{"node_memory_bytes / 3"}, "time": []string{"0"}, DecimalPlacesParam: []string{"2"}})
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Vector{{Metric: labels.FromStrings("node", "a"), Point: promql.Point{T: 0, V: 715827882.67}}}, res.(*queryData).Result)
+
+	// Results of functions dropping the metric name are not converted.
+	res, apiErr = do(api.query, url.Values{"query": []string{"sum(node_memory_bytes)"}, "time": []string{"0"}})
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Vector{{Metric: labels.Labels{}, Point: promql.Point{T: 0, V: 2 * (1 << 30)}}}, res.(*queryData).Result)
+
+	api.resultTransformer = failingResultTransformer{}
+	_, apiErr = do(api.query, instant)
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, baseAPI.ErrorExec, apiErr.Typ)
+
+	_, apiErr = do(api.queryPoints, url.Values{"match[]": []string{"node_memory_bytes"}, "time[]": []string{"0"}})
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, baseAPI.ErrorExec, apiErr.Typ)
+}
+
+func TestNewResultTransformer(t *testing.T) {
+	testutil.Equals(t, []string{BytesToGiBTransformerName}, RegisteredResultTransformers())
+
+	tr, err := NewResultTransformer(nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, NopResultTransformer{}, tr)
+
+	tr, err = NewResultTransformer([]string{BytesToGiBTransformerName})
+	testutil.Ok(t, err)
+	testutil.Equals(t, ChainResultTransformers(BytesToGiBTransformer{}), tr)
+
+	_, err = NewResultTransformer([]string{"unknown"})
+	testutil.NotOk(t, err)
+}
+
+func TestQueryEndpoints_MaxOutputSeries(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender(context.Background())
+	for i := 0; i < 20; i++ {
+		_, err = app.Add(labels.FromStrings("__name__", "requests", "job", "api", "high_card", strconv.Itoa(i)), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	timeout := 100 * time.Second
+	api := &QueryAPI{
+		baseAPI: &baseAPI.BaseAPI{
+			Now: func() time.Time { return time.Unix(0, 0) },
+		},
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, timeout, query.QueryableCreatorOpts{MaxOutputSeries: 5}),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: 10000,
+			Timeout:    timeout,
+		}),
+		gate:            gate.New(nil, 4),
+		maxOutputSeries: 5,
+	}
+
+	for _, tcase := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			// Aborted by the querier before evaluation, based on the grouping of the query.
+			query:    "sum by (high_card) (requests)",
+			expected: "exceeded output series limit: sum by (high_card) would produce more than 5 series",
+		},
+		{
+			query:    "count without (job) (requests)",
+			expected: "exceeded output series limit: count without (job) would produce more than 5 series",
+		},
+		{
+			// Aggregations over functions keeping labels of series are aborted before evaluation too.
+			query:    "sum by (high_card) (abs(requests))",
+			expected: "exceeded output series limit: sum by (high_card) would produce more than 5 series",
+		},
+		{
+			query:    "max by (high_card) (rate(requests[1m]) * 2)",
+			expected: "exceeded output series limit: max by (high_card) would produce more than 5 series",
+		},
+		{
+			// Functions changing labels of series are aborted based on their results.
+			query:    `sum by (high_card) (label_replace(requests, "foo", "bar", "", ""))`,
+			expected: "exceeded output series limit: query produced 20 series while the limit is 5",
+		},
+		{
+			// Only the number of output series is limited, not the number of input series.
+			query: "sum by (job) (requests)",
+		},
+		{
+			query: "count without (high_card) (requests)",
+		},
+		{
+			query: "sum by (job) (rate(requests[1m]))",
+		},
+		{
+			// Grouping by the metric name dropped by the function does not split series.
+			query: "sum by (__name__, job) (abs(requests))",
+		},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			for _, endpoint := range []baseAPI.ApiFunc{api.query, api.queryRange} {
+				query := url.Values{"query": []string{tcase.query}, "time": []string{"0"}, "start": []string{"0"}, "end": []string{"60"}, "step": []string{"30"}}
+				r, err := http.NewRequest(http.MethodGet, "http://example.com?"+query.Encode(), nil)
+				testutil.Ok(t, err)
+
+				_, _, apiErr := endpoint(r)
+				if tcase.expected == "" {
+					testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+					continue
+				}
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, baseAPI.ErrorLimitExceeded, apiErr.Typ)
+				testutil.Assert(t, strings.Contains(apiErr.Err.Error(), tcase.expected), "unexpected error %v", apiErr.Err)
+			}
+		})
+	}
+}
+
+// slowStoreServer blocks Series requests of data older than the given time until they are canceled.
+type slowStoreServer struct {
+	storepb.StoreServer
+
+	slowBefore int64
+}
+
+func (s *slowStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	if r.MaxTime < s.slowBefore {
+		<-srv.Context().Done()
+		return srv.Context().Err()
+	}
+	return s.StoreServer.Series(r, srv)
+}
+
+func TestQueryRangeEndpoint_SoftDeadline(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender(context.Background())
+	for i := int64(0); i <= 10; i++ {
+		_, err = app.Add(labels.FromStrings("__name__", "up", "job", "a"), i*60000, float64(i))
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("__name__", "up", "job", "b"), i*60000, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	timeout := 100 * time.Second
+	newAPI := func(proxy storepb.StoreServer) *QueryAPI {
+		return &QueryAPI{
+			baseAPI: &baseAPI.BaseAPI{
+				Now: func() time.Time { return time.Unix(0, 0) },
+			},
+			queryableCreate: query.NewQueryableCreator(nil, nil, proxy, 2, timeout, query.QueryableCreatorOpts{}),
+			queryEngine: promql.NewEngine(promql.EngineOpts{
+				MaxSamples: 10000,
+				Timeout:    timeout,
+			}),
+			gate: gate.New(nil, 4),
+		}
+	}
+	do := func(t *testing.T, api *QueryAPI, query url.Values) *queryData {
+		r, err := http.NewRequest(http.MethodGet, "http://example.com?"+query.Encode(), nil)
+		testutil.Ok(t, err)
+		res, _, apiErr := api.queryRange(r)
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		return res.(*queryData)
+	}
+	points := func(from, to int64) []promql.Point {
+		var ps []promql.Point
+		for i := from; i <= to; i++ {
+			ps = append(ps, promql.Point{T: i * 60000, V: float64(i)})
+		}
+		return ps
+	}
+	query := url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"600"}, "step": []string{"60"}, SoftDeadlineParam: []string{"100ms"}}
+
+	t.Run("complete", func(t *testing.T) {
+		res := do(t, newAPI(store.NewTSDBStore(nil, nil, db, component.Query, nil)), query)
+		testutil.Equals(t, &completeness{Complete: true}, res.Completeness)
+		testutil.Equals(t, promql.Matrix{
+			{Metric: labels.FromStrings("__name__", "up", "job", "a"), Points: points(0, 10)},
+			{Metric: labels.FromStrings("__name__", "up", "job", "b"), Points: points(0, 10)},
+		}, res.Result)
+	})
+	t.Run("soft deadline", func(t *testing.T) {
+		// Sub-ranges of 2 steps are evaluated newest first, sub-ranges ending before 200s do not finish in time. The first
+		// sub-range holds the single remaining step.
+		res := do(t, newAPI(&slowStoreServer{StoreServer: store.NewTSDBStore(nil, nil, db, component.Query, nil), slowBefore: 200000}), query)
+		testutil.Equals(t, &completeness{Complete: false, MissingRanges: []missingRange{{Start: 0, End: 120}}}, res.Completeness)
+		testutil.Equals(t, promql.Matrix{
+			{Metric: labels.FromStrings("__name__", "up", "job", "a"), Points: points(3, 10)},
+			{Metric: labels.FromStrings("__name__", "up", "job", "b"), Points: points(3, 10)},
+		}, res.Result)
+	})
+	t.Run("invalid soft deadline", func(t *testing.T) {
+		q := url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"600"}, "step": []string{"60"}, SoftDeadlineParam: []string{"-1s"}}
+		r, err := http.NewRequest(http.MethodGet, "http://example.com?"+q.Encode(), nil)
+		testutil.Ok(t, err)
+		_, _, apiErr := newAPI(store.NewTSDBStore(nil, nil, db, component.Query, nil)).queryRange(r)
+		testutil.Assert(t, apiErr != nil, "expected error")
+		testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+	})
+}
+
+func TestBytesToGiBTransformer(t *testing.T) {
+	v, err := BytesToGiBTransformer{}.Transform(context.Background(), promql.Vector{
+		{Metric: labels.FromStrings("__name__", "heap_bytes"), Point: promql.Point{V: 1 << 29}},
+		{Metric: labels.FromStrings("__name__", "up"), Point: promql.Point{V: 1}},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, promql.Vector{
+		{Metric: labels.FromStrings("__name__", "heap_gibibytes"), Point: promql.Point{V: 0.5}},
+		{Metric: labels.FromStrings("__name__", "up"), Point: promql.Point{V: 1}},
+	}, v)
+
+	// Scalars have no metric name.
+	v, err = BytesToGiBTransformer{}.Transform(context.Background(), promql.Scalar{V: 1 << 30})
+	testutil.Ok(t, err)
+	testutil.Equals(t, promql.Scalar{V: 1 << 30}, v)
+
+	_, err = BytesToGiBTransformer{}.Transform(context.Background(), promql.Matrix{
+		{Metric: labels.FromStrings("__name__", "heap_bytes")},
+		{Metric: labels.FromStrings("__name__", "heap_gibibytes")},
+	})
+	testutil.NotOk(t, err)
+}
+
+func TestNewReplicaInfo(t *testing.T) {
+	queried := []store.FanoutStoreStatus{
+		{Name: "sidecar-a", LabelSets: []labels.Labels{labels.FromStrings("cluster", "eu", "replica", "a")}},
+		{Name: "sidecar-b", LabelSets: []labels.Labels{labels.FromStrings("cluster", "eu", "replica", "b")}, Failed: true},
+		{Name: "sidecar-us-a", LabelSets: []labels.Labels{labels.FromStrings("cluster", "us", "replica", "a")}},
+		{Name: "store-gateway", LabelSets: []labels.Labels{
+			labels.FromStrings("cluster", "eu", "replica", "a"),
+			labels.FromStrings("cluster", "us", "replica", "a"),
+			labels.FromStrings("cluster", "us", "replica", "b"),
+		}},
+		// Store without replica label is not part of any HA group.
+		{Name: "rule", LabelSets: []labels.Labels{labels.FromStrings("cluster", "eu")}},
+	}
+	unhealthy := []labels.Labels{
+		labels.FromStrings("cluster", "eu", "replica", "c"),
+		labels.FromStrings("cluster", "eu", "replica", "c"),
+		// Already queried through store gateway.
+		labels.FromStrings("cluster", "us", "replica", "b"),
+		// Group that was not queried.
+		labels.FromStrings("cluster", "asia", "replica", "a"),
+	}
+
+	t.Run("missing and failed replica", func(t *testing.T) {
+		testutil.Equals(t, &replicaInfo{
+			Degraded: true,
+			Groups: []replicaGroupInfo{
+				{Labels: labels.FromStrings("cluster", "eu"), Contributed: 1, Failed: []string{`{replica="b"}`}, Missing: []string{`{replica="c"}`}},
+				{Labels: labels.FromStrings("cluster", "us"), Contributed: 2},
+			},
+		}, newReplicaInfo(queried, unhealthy, []string{"replica"}))
+	})
+	t.Run("healthy", func(t *testing.T) {
+		testutil.Equals(t, &replicaInfo{
+			Groups: []replicaGroupInfo{
+				{Labels: labels.FromStrings("cluster", "eu"), Contributed: 1},
+				{Labels: labels.FromStrings("cluster", "us"), Contributed: 2},
+			},
+		}, newReplicaInfo(queried[2:4], nil, []string{"replica"}))
+	})
+	t.Run("no replica labels", func(t *testing.T) {
+		testutil.Equals(t, &replicaInfo{Groups: []replicaGroupInfo{}}, newReplicaInfo(queried, unhealthy, nil))
+	})
+}
+
 func TestParseStoreDebugMatchersParam(t *testing.T) {
 	for i, tc := range []struct {
 		storeMatchers string
@@ -1626,3 +2658,29 @@ type mockedRulesClient struct {
 func (c mockedRulesClient) Rules(_ context.Context, req *rulespb.RulesRequest) (*rulespb.RuleGroups, storage.Warnings, error) {
 	return &rulespb.RuleGroups{Groups: c.g[req.Type]}, c.w, c.err
 }
+
+func TestWithTenant(t *testing.T) {
+	var forwarded []string
+	f := func(r *http.Request) (interface{}, []error, *baseAPI.ApiError) {
+		md, _ := metadata.FromOutgoingContext(r.Context())
+		forwarded = md.Get("thanos-tenant")
+		return nil, nil, nil
+	}
+
+	// Tenant is not required without configured header.
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	testutil.Ok(t, err)
+	_, _, apiErr := (&QueryAPI{}).withTenant(f)(r)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, 0, len(forwarded))
+
+	api := &QueryAPI{tenantHeader: "THANOS-TENANT"}
+	_, _, apiErr = api.withTenant(f)(r)
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+
+	r.Header.Set("Thanos-Tenant", "team-a")
+	_, _, apiErr = api.withTenant(f)(r)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, []string{"team-a"}, forwarded)
+}
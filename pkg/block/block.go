@@ -22,10 +22,13 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -218,6 +221,73 @@ func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, i
 	return m, nil
 }
 
+// ParseRewriteRelabelConfig parses relabel configuration of RewriteExternalLabels. Only actions changing labels are
+// supported, as blocks are selected separately.
+func ParseRewriteRelabelConfig(contentYaml []byte) ([]*relabel.Config, error) {
+	var relabelConfig []*relabel.Config
+	if err := yaml.Unmarshal(contentYaml, &relabelConfig); err != nil {
+		return nil, errors.Wrap(err, "parsing relabel configuration")
+	}
+	supportedActions := map[relabel.Action]struct{}{relabel.Replace: {}, relabel.LabelMap: {}, relabel.LabelDrop: {}, relabel.LabelKeep: {}}
+
+	for _, cfg := range relabelConfig {
+		if _, ok := supportedActions[cfg.Action]; !ok {
+			return nil, errors.Errorf("unsupported relabel action: %v", cfg.Action)
+		}
+	}
+
+	return relabelConfig, nil
+}
+
+// RewriteExternalLabels rewrites external labels in meta.json of the given block with the given relabel configs and
+// returns the labels before and after the rewrite. External labels are not part of the block data, so only meta.json
+// is uploaded again: the previous one is backed up to DebugMetas first and the uploaded one is read back to verify it.
+// Nothing is uploaded if the labels do not change or dryRun is set.
+func RewriteExternalLabels(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, relabelConfigs []*relabel.Config, dryRun bool) (labels.Labels, labels.Labels, error) {
+	meta, err := DownloadMeta(ctx, logger, bkt, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	from := labels.FromMap(meta.Thanos.Labels)
+	to := relabel.Process(from, relabelConfigs...)
+	if len(to) == 0 {
+		return nil, nil, errors.Errorf("rewrite of external labels %s of block %s leaves no external labels", from, id)
+	}
+	if labels.Equal(from, to) || dryRun {
+		return from, to, nil
+	}
+
+	metaFile := path.Join(id.String(), MetaFilename)
+	prev, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "json encode previous meta")
+	}
+	backupFile := path.Join(DebugMetas, fmt.Sprintf("%s-%d.json", id, time.Now().Unix()))
+	if err := bkt.Upload(ctx, backupFile, bytes.NewReader(prev)); err != nil {
+		return nil, nil, errors.Wrapf(err, "upload backup of %s to %s", metaFile, backupFile)
+	}
+
+	meta.Thanos.Labels = to.Map()
+	rewritten, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "json encode rewritten meta")
+	}
+	if err := bkt.Upload(ctx, metaFile, bytes.NewReader(rewritten)); err != nil {
+		return nil, nil, errors.Wrapf(err, "upload rewritten %s", metaFile)
+	}
+
+	uploaded, err := DownloadMeta(ctx, logger, bkt, id)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "verify rewritten meta")
+	}
+	if !labels.Equal(labels.FromMap(uploaded.Thanos.Labels), to) {
+		return nil, nil, errors.Errorf("verify rewritten meta: external labels of block %s are %s, expected %s; previous meta is backed up in %s", id, labels.FromMap(uploaded.Thanos.Labels), to, backupFile)
+	}
+	level.Info(logger).Log("msg", "rewrote external labels of block", "block", id, "from", from, "to", to)
+	return from, to, nil
+}
+
 func IsBlockDir(path string) (id ulid.ULID, ok bool) {
 	id, err := ulid.Parse(filepath.Base(path))
 	return id, err == nil
@@ -277,3 +277,95 @@ func TestMarkForDeletion(t *testing.T) {
 		})
 	}
 }
+
+func TestRewriteExternalLabels(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-rewrite-external-labels")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "team", Value: "foo"}, {Name: "replica", Value: "r1"}}, 124)
+	testutil.Ok(t, err)
+
+	renameTeam, err := ParseRewriteRelabelConfig([]byte(`
+- action: replace
+  source_labels: [team]
+  regex: (.+)
+  target_label: squad
+- action: labeldrop
+  regex: team
+`))
+	testutil.Ok(t, err)
+
+	upload := func(t *testing.T) objstore.Bucket {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+		return bkt
+	}
+	debugMetas := func(t *testing.T, bkt objstore.Bucket) []string {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, DebugMetas, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		return names
+	}
+	expFrom := labels.FromStrings("replica", "r1", "team", "foo")
+	expTo := labels.FromStrings("replica", "r1", "squad", "foo")
+
+	t.Run("labels rewritten", func(t *testing.T) {
+		bkt := upload(t)
+		from, to, err := RewriteExternalLabels(ctx, log.NewNopLogger(), bkt, id, renameTeam, false)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expFrom, from)
+		testutil.Equals(t, expTo, to)
+
+		meta, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expTo.Map(), meta.Thanos.Labels)
+		testutil.Equals(t, id, meta.ULID)
+		testutil.Equals(t, uint64(2), meta.Stats.NumSeries)
+
+		// The previous meta is backed up next to the one of the upload.
+		testutil.Equals(t, 2, len(debugMetas(t, bkt)))
+
+		// Rewriting again changes nothing.
+		from, to, err = RewriteExternalLabels(ctx, log.NewNopLogger(), bkt, id, renameTeam, false)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expTo, from)
+		testutil.Equals(t, expTo, to)
+		testutil.Equals(t, 2, len(debugMetas(t, bkt)))
+	})
+	t.Run("dry run", func(t *testing.T) {
+		bkt := upload(t)
+		from, to, err := RewriteExternalLabels(ctx, log.NewNopLogger(), bkt, id, renameTeam, true)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expFrom, from)
+		testutil.Equals(t, expTo, to)
+
+		meta, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expFrom.Map(), meta.Thanos.Labels)
+		testutil.Equals(t, 1, len(debugMetas(t, bkt)))
+	})
+	t.Run("no labels left", func(t *testing.T) {
+		dropAll, err := ParseRewriteRelabelConfig([]byte(`
+- action: labeldrop
+  regex: .+
+`))
+		testutil.Ok(t, err)
+
+		bkt := upload(t)
+		_, _, err = RewriteExternalLabels(ctx, log.NewNopLogger(), bkt, id, dropAll, false)
+		testutil.NotOk(t, err)
+
+		meta, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expFrom.Map(), meta.Thanos.Labels)
+	})
+}
@@ -137,22 +137,122 @@ type MetadataModifier interface {
 	Modify(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, modified *extprom.TxGaugeVec) error
 }
 
+// MetadataSource discovers blocks and reads their metadata for BaseFetcher. By default blocks are discovered by
+// iterating over the bucket, but any other source, e.g. a database of block metadata, can be plugged in without
+// changing filters, modifiers or readers of the blocks.
+type MetadataSource interface {
+	// Iter calls f with the ID of each block of the source.
+	Iter(ctx context.Context, f func(id ulid.ULID) error) error
+	// Exists returns true if metadata of the given block exists. It is checked on every sync, even for cached metadata.
+	Exists(ctx context.Context, id ulid.ULID) (bool, error)
+	// Get returns metadata of the given block. Errors caused by ErrorSyncMetaNotFound or ErrorSyncMetaCorrupted mark
+	// the block as partial, other errors make the fetched view incomplete.
+	Get(ctx context.Context, id ulid.ULID) (*metadata.Meta, error)
+}
+
+// ModifiedMetadataSource is a MetadataSource able to tell when metadata of a block was last modified. BaseFetcher
+// reads metadata of such sources again once it is modified after being cached, e.g. once external labels of the block
+// are rewritten, instead of serving it from its cache as long as the block exists.
+type ModifiedMetadataSource interface {
+	MetadataSource
+	// Modified returns the time metadata of the given block was last modified. It is checked on every sync instead of
+	// Exists, and returns ErrorSyncMetaNotFound if metadata of the block does not exist.
+	Modified(ctx context.Context, id ulid.ULID) (time.Time, error)
+}
+
+// bucketMetadataSource discovers blocks by iterating over the bucket and reads their meta.json files.
+type bucketMetadataSource struct {
+	logger log.Logger
+	bkt    objstore.InstrumentedBucketReader
+}
+
+// NewBucketMetadataSource returns the default metadata source, discovering blocks by iterating over the given bucket.
+func NewBucketMetadataSource(logger log.Logger, bkt objstore.InstrumentedBucketReader) MetadataSource {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &bucketMetadataSource{logger: logger, bkt: bkt}
+}
+
+func (s *bucketMetadataSource) Iter(ctx context.Context, f func(id ulid.ULID) error) error {
+	return s.bkt.Iter(ctx, "", func(name string) error {
+		id, ok := IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		return f(id)
+	})
+}
+
+func (s *bucketMetadataSource) Exists(ctx context.Context, id ulid.ULID) (bool, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+	ok, err := s.bkt.Exists(ctx, metaFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
+	}
+	return ok, nil
+}
+
+func (s *bucketMetadataSource) Modified(ctx context.Context, id ulid.ULID) (time.Time, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+	attrs, err := s.bkt.ReaderWithExpectedErrs(s.bkt.IsObjNotFoundErr).Attributes(ctx, metaFile)
+	if s.bkt.IsObjNotFoundErr(err) {
+		return time.Time{}, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "meta.json file attributes: %v", metaFile)
+	}
+	return attrs.LastModified, nil
+}
+
+func (s *bucketMetadataSource) Get(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+	r, err := s.bkt.ReaderWithExpectedErrs(s.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
+	if s.bkt.IsObjNotFoundErr(err) {
+		// Meta.json was deleted between bkt.Exists and here.
+		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get meta file: %v", metaFile)
+	}
+
+	defer runutil.CloseWithLogOnErr(s.logger, r, "close bkt meta get")
+
+	metaContent, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
+	}
+
+	m := &metadata.Meta{}
+	if err := json.Unmarshal(metaContent, m); err != nil {
+		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
+	}
+	return m, nil
+}
+
 // BaseFetcher is a struct that synchronizes filtered metadata of all block in the object storage with the local state.
 // Go-routine safe.
 type BaseFetcher struct {
 	logger      log.Logger
 	concurrency int
-	bkt         objstore.InstrumentedBucketReader
+	source      MetadataSource
 
 	// Optional local directory to cache meta.json files.
 	cacheDir string
 	cached   map[ulid.ULID]*metadata.Meta
-	syncs    prometheus.Counter
-	g        singleflight.Group
+	// cachedModified is the modification time of cached metadata of ModifiedMetadataSource sources.
+	cachedModified map[ulid.ULID]time.Time
+	syncs          prometheus.Counter
+	g              singleflight.Group
 }
 
-// NewBaseFetcher constructs BaseFetcher.
+// NewBaseFetcher constructs BaseFetcher discovering blocks by iterating over the given bucket.
 func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer) (*BaseFetcher, error) {
+	return NewBaseFetcherWithSource(logger, concurrency, NewBucketMetadataSource(logger, bkt), dir, reg)
+}
+
+// NewBaseFetcherWithSource constructs BaseFetcher discovering blocks from the given metadata source.
+func NewBaseFetcherWithSource(logger log.Logger, concurrency int, source MetadataSource, dir string, reg prometheus.Registerer) (*BaseFetcher, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -166,11 +266,12 @@ func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.Instrumente
 	}
 
 	return &BaseFetcher{
-		logger:      log.With(logger, "component", "block.BaseFetcher"),
-		concurrency: concurrency,
-		bkt:         bkt,
-		cacheDir:    cacheDir,
-		cached:      map[ulid.ULID]*metadata.Meta{},
+		logger:         log.With(logger, "component", "block.BaseFetcher"),
+		concurrency:    concurrency,
+		source:         source,
+		cacheDir:       cacheDir,
+		cached:         map[ulid.ULID]*metadata.Meta{},
+		cachedModified: map[ulid.ULID]time.Time{},
 		syncs: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Subsystem: fetcherSubSys,
 			Name:      "base_syncs_total",
@@ -198,34 +299,43 @@ var (
 	ErrorSyncMetaCorrupted = errors.New("meta.json corrupted")
 )
 
-// loadMeta returns metadata from object storage or error.
+// loadMeta returns metadata from the metadata source or error.
 // It returns `ErrorSyncMetaNotFound` and `ErrorSyncMetaCorrupted` sentinel errors in those cases.
-func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
+func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta, time.Time, error) {
 	var (
 		metaFile       = path.Join(id.String(), MetaFilename)
 		cachedBlockDir = filepath.Join(f.cacheDir, id.String())
+		modified       time.Time
 	)
 
 	// TODO(bwplotka): If that causes problems (obj store rate limits), add longer ttl to cached items.
 	// For 1y and 100 block sources this generates ~1.5-3k HEAD RPM. AWS handles 330k RPM per prefix.
 	// TODO(bwplotka): Consider filtering by consistency delay here (can't do until compactor healthyOverride work).
-	ok, err := f.bkt.Exists(ctx, metaFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
-	}
-	if !ok {
-		return nil, ErrorSyncMetaNotFound
+	if ms, ok := f.source.(ModifiedMetadataSource); ok {
+		var err error
+		modified, err = ms.Modified(ctx, id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	} else {
+		ok, err := f.source.Exists(ctx, id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if !ok {
+			return nil, time.Time{}, ErrorSyncMetaNotFound
+		}
 	}
 
-	if m, seen := f.cached[id]; seen {
-		return m, nil
+	if m, seen := f.cached[id]; seen && !modified.After(f.cachedModified[id]) {
+		return m, modified, nil
 	}
 
 	// Best effort load from local dir.
 	if f.cacheDir != "" {
-		m, err := metadata.Read(cachedBlockDir)
+		m, err := readCachedMeta(cachedBlockDir, modified)
 		if err == nil {
-			return m, nil
+			return m, modified, nil
 		}
 
 		if !errors.Is(err, os.ErrNotExist) {
@@ -236,29 +346,13 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 		}
 	}
 
-	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
-	if f.bkt.IsObjNotFoundErr(err) {
-		// Meta.json was deleted between bkt.Exists and here.
-		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
-	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "get meta file: %v", metaFile)
-	}
-
-	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
-
-	metaContent, err := ioutil.ReadAll(r)
+	m, err := f.source.Get(ctx, id)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
-	}
-
-	m := &metadata.Meta{}
-	if err := json.Unmarshal(metaContent, m); err != nil {
-		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
+		return nil, time.Time{}, err
 	}
 
 	if m.Version != metadata.MetaVersion1 {
-		return nil, errors.Errorf("unexpected meta file: %s version: %d", metaFile, m.Version)
+		return nil, time.Time{}, errors.Errorf("unexpected meta file: %s version: %d", metaFile, m.Version)
 	}
 
 	// Best effort cache in local dir.
@@ -269,14 +363,38 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 
 		if err := metadata.Write(f.logger, cachedBlockDir, m); err != nil {
 			level.Warn(f.logger).Log("msg", "best effort save of the meta.json to local dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+		} else if !modified.IsZero() {
+			// The cached file carries the modification time of the metadata it was read from, so it is read again
+			// once the metadata is modified, also after restarts.
+			cachedMetaFile := filepath.Join(cachedBlockDir, MetaFilename)
+			if err := os.Chtimes(cachedMetaFile, modified, modified); err != nil {
+				level.Warn(f.logger).Log("msg", "best effort set of the meta.json modification time failed; ignoring", "file", cachedMetaFile, "err", err)
+			}
 		}
 	}
-	return m, nil
+	return m, modified, nil
+}
+
+// readCachedMeta reads metadata cached in the given dir. It returns an error wrapping os.ErrNotExist if the cached
+// metadata is older than the given modification time of the metadata.
+func readCachedMeta(dir string, modified time.Time) (*metadata.Meta, error) {
+	if !modified.IsZero() {
+		fi, err := os.Stat(filepath.Join(dir, MetaFilename))
+		if err != nil {
+			return nil, err
+		}
+		// File systems storing modification times at a lower precision only cost reading metadata from the source again.
+		if fi.ModTime().Before(modified) {
+			return nil, errors.Wrapf(os.ErrNotExist, "cached meta.json in %s modified", dir)
+		}
+	}
+	return metadata.Read(dir)
 }
 
 type response struct {
-	metas   map[ulid.ULID]*metadata.Meta
-	partial map[ulid.ULID]error
+	metas    map[ulid.ULID]*metadata.Meta
+	modified map[ulid.ULID]time.Time
+	partial  map[ulid.ULID]error
 	// If metaErr > 0 it means incomplete view, so some metas, failed to be loaded.
 	metaErrs tsdberrors.MultiError
 
@@ -289,8 +407,9 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 
 	var (
 		resp = response{
-			metas:   make(map[ulid.ULID]*metadata.Meta),
-			partial: make(map[ulid.ULID]error),
+			metas:    make(map[ulid.ULID]*metadata.Meta),
+			modified: make(map[ulid.ULID]time.Time),
+			partial:  make(map[ulid.ULID]error),
 		}
 		eg  errgroup.Group
 		ch  = make(chan ulid.ULID, f.concurrency)
@@ -299,10 +418,11 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	for i := 0; i < f.concurrency; i++ {
 		eg.Go(func() error {
 			for id := range ch {
-				meta, err := f.loadMeta(ctx, id)
+				meta, modified, err := f.loadMeta(ctx, id)
 				if err == nil {
 					mtx.Lock()
 					resp.metas[id] = meta
+					resp.modified[id] = modified
 					mtx.Unlock()
 					continue
 				}
@@ -334,12 +454,7 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	// Workers scheduled, distribute blocks.
 	eg.Go(func() error {
 		defer close(ch)
-		return f.bkt.Iter(ctx, "", func(name string) error {
-			id, ok := IsBlockDir(name)
-			if !ok {
-				return nil
-			}
-
+		return f.source.Iter(ctx, func(id ulid.ULID) error {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
@@ -351,7 +466,7 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	})
 
 	if err := eg.Wait(); err != nil {
-		return nil, errors.Wrap(err, "BaseFetcher: iter bucket")
+		return nil, errors.Wrap(err, "BaseFetcher: iter blocks")
 	}
 
 	if len(resp.metaErrs) > 0 {
@@ -364,6 +479,7 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 		cached[id] = m
 	}
 	f.cached = cached
+	f.cachedModified = resp.modified
 
 	// Best effort cleanup of disk-cached metas.
 	if f.cacheDir != "" {
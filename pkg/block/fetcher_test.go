@@ -295,6 +295,145 @@ func TestMetaFetcher_Fetch(t *testing.T) {
 	})
 }
 
+// testMetadataSource serves metas from memory, like a database of block metadata would.
+type testMetadataSource struct {
+	metas map[ulid.ULID]*metadata.Meta
+	// ids are iterated over, including blocks without metas.
+	ids []ulid.ULID
+	// getErrs are returned by Get of the given blocks.
+	getErrs map[ulid.ULID]error
+}
+
+func (s *testMetadataSource) Iter(_ context.Context, f func(id ulid.ULID) error) error {
+	for _, id := range s.ids {
+		if err := f(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *testMetadataSource) Exists(_ context.Context, id ulid.ULID) (bool, error) {
+	_, ok := s.metas[id]
+	return ok, nil
+}
+
+func (s *testMetadataSource) Get(_ context.Context, id ulid.ULID) (*metadata.Meta, error) {
+	if err := s.getErrs[id]; err != nil {
+		return nil, err
+	}
+	return s.metas[id], nil
+}
+
+func TestMetaFetcher_Fetch_MetadataSource(t *testing.T) {
+	meta := func(i int) *metadata.Meta {
+		m := &metadata.Meta{}
+		m.Version = metadata.MetaVersion1
+		m.ULID = ULID(i)
+		return m
+	}
+	source := &testMetadataSource{
+		metas:   map[ulid.ULID]*metadata.Meta{ULID(1): meta(1), ULID(2): meta(2), ULID(3): meta(3), ULID(4): meta(4)},
+		ids:     ULIDs(1, 2, 3, 4, 5),
+		getErrs: map[ulid.ULID]error{ULID(3): errors.Wrap(ErrorSyncMetaCorrupted, "bad row")},
+	}
+
+	r := prometheus.NewRegistry()
+	baseFetcher, err := NewBaseFetcherWithSource(log.NewNopLogger(), 2, source, "", r)
+	testutil.Ok(t, err)
+	ulidToDelete := ULID(4)
+	fetcher := baseFetcher.NewMetaFetcher(r, []MetadataFilter{&ulidFilter{ulidToDelete: &ulidToDelete}}, nil)
+
+	metas, partial, err := fetcher.Fetch(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(1): meta(1), ULID(2): meta(2)}, metas)
+	testutil.Equals(t, 2, len(partial))
+	testutil.Equals(t, ErrorSyncMetaCorrupted, errors.Cause(partial[ULID(3)]))
+	testutil.Equals(t, ErrorSyncMetaNotFound, errors.Cause(partial[ULID(5)]))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.synced.WithLabelValues(corruptedMeta)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.synced.WithLabelValues(noMeta)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.synced.WithLabelValues("filtered")))
+
+	// Failures of the source other than missing or corrupted metas make the view incomplete.
+	source.getErrs[ULID(1)] = errors.New("connection refused")
+	baseFetcher.cached = map[ulid.ULID]*metadata.Meta{}
+	metas, _, err = fetcher.Fetch(context.Background())
+	testutil.NotOk(t, err)
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(2): meta(2)}, metas)
+}
+
+// modifiedMetadataSource additionally tells modification times of metas.
+type modifiedMetadataSource struct {
+	testMetadataSource
+
+	modified map[ulid.ULID]time.Time
+}
+
+func (s *modifiedMetadataSource) Modified(_ context.Context, id ulid.ULID) (time.Time, error) {
+	if _, ok := s.metas[id]; !ok {
+		return time.Time{}, ErrorSyncMetaNotFound
+	}
+	return s.modified[id], nil
+}
+
+func TestMetaFetcher_Fetch_ModifiedMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-meta-fetcher-modified")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	meta := func(i int, team string) *metadata.Meta {
+		m := &metadata.Meta{}
+		m.Version = metadata.MetaVersion1
+		m.ULID = ULID(i)
+		m.Thanos.Labels = map[string]string{"team": team}
+		return m
+	}
+	uploaded := time.Unix(1600000000, 0)
+	source := &modifiedMetadataSource{
+		testMetadataSource: testMetadataSource{
+			metas: map[ulid.ULID]*metadata.Meta{ULID(1): meta(1, "foo"), ULID(2): meta(2, "bar")},
+			ids:   ULIDs(1, 2, 3),
+		},
+		modified: map[ulid.ULID]time.Time{ULID(1): uploaded, ULID(2): uploaded},
+	}
+	fetch := func(t *testing.T) map[ulid.ULID]*metadata.Meta {
+		baseFetcher, err := NewBaseFetcherWithSource(log.NewNopLogger(), 2, source, dir, nil)
+		testutil.Ok(t, err)
+		metas, partial, err := baseFetcher.NewMetaFetcher(nil, nil, nil).Fetch(context.Background())
+		testutil.Ok(t, err)
+		testutil.Equals(t, ErrorSyncMetaNotFound, errors.Cause(partial[ULID(3)]))
+		return metas
+	}
+
+	baseFetcher, err := NewBaseFetcherWithSource(log.NewNopLogger(), 2, source, dir, nil)
+	testutil.Ok(t, err)
+	fetcher := baseFetcher.NewMetaFetcher(nil, nil, nil)
+	metas, _, err := fetcher.Fetch(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "foo", metas[ULID(1)].Thanos.Labels["team"])
+
+	// Unmodified metas are served from the cache, also after restarts.
+	source.metas[ULID(1)] = meta(1, "changed-without-modification")
+	metas, _, err = fetcher.Fetch(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "foo", metas[ULID(1)].Thanos.Labels["team"])
+	testutil.Equals(t, "foo", fetch(t)[ULID(1)].Thanos.Labels["team"])
+
+	// Modified metas are read again, also after restarts.
+	source.metas[ULID(1)] = meta(1, "baz")
+	source.modified[ULID(1)] = uploaded.Add(time.Hour)
+	metas, _, err = fetcher.Fetch(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "baz", metas[ULID(1)].Thanos.Labels["team"])
+	testutil.Equals(t, "bar", metas[ULID(2)].Thanos.Labels["team"])
+
+	source.metas[ULID(2)] = meta(2, "qux")
+	source.modified[ULID(2)] = uploaded.Add(time.Hour)
+	metas = fetch(t)
+	testutil.Equals(t, "baz", metas[ULID(1)].Thanos.Labels["team"])
+	testutil.Equals(t, "qux", metas[ULID(2)].Thanos.Labels["team"])
+}
+
 func TestLabelShardedMetaFilter_Filter_Basic(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
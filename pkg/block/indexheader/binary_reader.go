@@ -68,9 +68,10 @@ type BinaryTOC struct {
 	PostingsOffsetTable uint64
 }
 
-// WriteBinary build index-header file from the pieces of index in object storage.
-func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, filename string) (err error) {
-	ir, indexVersion, err := newChunkedIndexReader(ctx, bkt, id)
+// WriteBinary build index-header file from the pieces of index in object storage. The pieces are downloaded next to
+// the index-header file with objstore.DownloadRangeResumable first, so an interrupted build resumes their download.
+func WriteBinary(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID, filename string) (err error) {
+	ir, indexVersion, err := newChunkedIndexReader(ctx, logger, bkt, id)
 	if err != nil {
 		return errors.Wrap(err, "new index reader")
 	}
@@ -89,7 +90,7 @@ func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, f
 		return errors.Wrap(err, "add index meta")
 	}
 
-	if err := ir.CopySymbols(bw.SymbolsWriter(), buf); err != nil {
+	if err := ir.CopySymbols(bw.SymbolsWriter(), buf, filename+".symbols"); err != nil {
 		return err
 	}
 
@@ -97,7 +98,7 @@ func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, f
 		return errors.Wrap(err, "flush")
 	}
 
-	if err := ir.CopyPostingsOffsets(bw.PostingOffsetsWriter(), buf); err != nil {
+	if err := ir.CopyPostingsOffsets(bw.PostingOffsetsWriter(), buf, filename+".postings-offsets"); err != nil {
 		return err
 	}
 
@@ -122,14 +123,15 @@ func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, f
 }
 
 type chunkedIndexReader struct {
-	ctx  context.Context
-	path string
-	size uint64
-	bkt  objstore.BucketReader
-	toc  *index.TOC
+	ctx    context.Context
+	logger log.Logger
+	path   string
+	size   uint64
+	bkt    objstore.BucketReader
+	toc    *index.TOC
 }
 
-func newChunkedIndexReader(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) (*chunkedIndexReader, int, error) {
+func newChunkedIndexReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID) (*chunkedIndexReader, int, error) {
 	indexFilepath := filepath.Join(id.String(), block.IndexFilename)
 	attrs, err := bkt.Attributes(ctx, indexFilepath)
 	if err != nil {
@@ -162,10 +164,11 @@ func newChunkedIndexReader(ctx context.Context, bkt objstore.BucketReader, id ul
 	}
 
 	ir := &chunkedIndexReader{
-		ctx:  ctx,
-		path: indexFilepath,
-		size: uint64(attrs.Size),
-		bkt:  bkt,
+		ctx:    ctx,
+		logger: logger,
+		path:   indexFilepath,
+		size:   uint64(attrs.Size),
+		bkt:    bkt,
 	}
 
 	toc, err := ir.readTOC()
@@ -200,32 +203,36 @@ func (r *chunkedIndexReader) readTOC() (*index.TOC, error) {
 	return toc, nil
 }
 
-func (r *chunkedIndexReader) CopySymbols(w io.Writer, buf []byte) (err error) {
-	rc, err := r.bkt.GetRange(r.ctx, r.path, int64(r.toc.Symbols), int64(r.toc.Series-r.toc.Symbols))
-	if err != nil {
-		return errors.Wrapf(err, "get symbols from object storage of %s", r.path)
-	}
-	defer runutil.CloseWithErrCapture(&err, rc, "close symbol reader")
-
-	if _, err := io.CopyBuffer(w, rc, buf); err != nil {
-		return errors.Wrap(err, "copy symbols")
-	}
+// CopySymbols copies the symbols section of the index to w. The section is downloaded to stageFile first.
+func (r *chunkedIndexReader) CopySymbols(w io.Writer, buf []byte, stageFile string) error {
+	return errors.Wrap(r.copyRange(w, buf, int64(r.toc.Symbols), int64(r.toc.Series-r.toc.Symbols), stageFile), "copy symbols")
+}
 
-	return nil
+// CopyPostingsOffsets copies the postings offset table of the index to w. The table is downloaded to stageFile first.
+func (r *chunkedIndexReader) CopyPostingsOffsets(w io.Writer, buf []byte, stageFile string) error {
+	return errors.Wrap(r.copyRange(w, buf, int64(r.toc.PostingsTable), int64(r.size-r.toc.PostingsTable), stageFile), "copy posting offsets")
 }
 
-func (r *chunkedIndexReader) CopyPostingsOffsets(w io.Writer, buf []byte) (err error) {
-	rc, err := r.bkt.GetRange(r.ctx, r.path, int64(r.toc.PostingsTable), int64(r.size-r.toc.PostingsTable))
-	if err != nil {
-		return errors.Wrapf(err, "get posting offset table from object storage of %s", r.path)
+// copyRange downloads the given range of the index to stageFile, resuming an interrupted download of the range if
+// any, and copies it to w. The stage file is removed once copied.
+func (r *chunkedIndexReader) copyRange(w io.Writer, buf []byte, off, length int64, stageFile string) (err error) {
+	if err := objstore.DownloadRangeResumable(r.ctx, r.logger, r.bkt, r.path, off, length, stageFile); err != nil {
+		return errors.Wrapf(err, "download from object storage of %s", r.path)
 	}
-	defer runutil.CloseWithErrCapture(&err, rc, "close posting offsets reader")
+	defer func() {
+		if rerr := os.Remove(stageFile); rerr != nil {
+			level.Warn(r.logger).Log("msg", "failed to remove downloaded index section", "file", stageFile, "err", rerr)
+		}
+	}()
 
-	if _, err := io.CopyBuffer(w, rc, buf); err != nil {
-		return errors.Wrap(err, "copy posting offsets")
+	f, err := os.Open(stageFile)
+	if err != nil {
+		return errors.Wrap(err, "open downloaded index section")
 	}
+	defer runutil.CloseWithErrCapture(&err, f, "close downloaded index section")
 
-	return nil
+	_, err = io.CopyBuffer(w, f, buf)
+	return err
 }
 
 // TODO(bwplotka): Add padding for efficient read.
@@ -456,7 +463,7 @@ func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.Bucket
 	level.Debug(logger).Log("msg", "failed to read index-header from disk; recreating", "path", binfn, "err", err)
 
 	start := time.Now()
-	if err := WriteBinary(ctx, bkt, id, binfn); err != nil {
+	if err := WriteBinary(ctx, logger, bkt, id, binfn); err != nil {
 		return nil, errors.Wrap(err, "write index header")
 	}
 
@@ -871,7 +878,7 @@ func yoloString(b []byte) string {
 	return *((*string)(unsafe.Pointer(&b)))
 }
 
-func (r BinaryReader) LabelNames() []string {
+func (r BinaryReader) LabelNames() ([]string, error) {
 	allPostingsKeyName, _ := index.AllPostingsKey()
 	labelNames := make([]string, 0, len(r.postings))
 	for name := range r.postings {
@@ -882,7 +889,7 @@ func (r BinaryReader) LabelNames() []string {
 		labelNames = append(labelNames, name)
 	}
 	sort.Strings(labelNames)
-	return labelNames
+	return labelNames, nil
 }
 
 func (r *BinaryReader) Close() error { return r.c.Close() }
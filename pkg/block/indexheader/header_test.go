@@ -5,10 +5,12 @@ package indexheader
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -98,7 +100,7 @@ func TestReaders(t *testing.T) {
 
 			t.Run("binary", func(t *testing.T) {
 				fn := filepath.Join(tmpDir, id.String(), block.IndexHeaderFilename)
-				testutil.Ok(t, WriteBinary(ctx, bkt, id, fn))
+				testutil.Ok(t, WriteBinary(ctx, log.NewNopLogger(), bkt, id, fn))
 
 				br, err := NewBinaryReader(ctx, log.NewNopLogger(), nil, tmpDir, id, 3)
 				testutil.Ok(t, err)
@@ -211,7 +213,9 @@ func compareIndexToHeader(t *testing.T, indexByteSlice index.ByteSlice, headerRe
 
 	expLabelNames, err := indexReader.LabelNames()
 	testutil.Ok(t, err)
-	testutil.Equals(t, expLabelNames, headerReader.LabelNames())
+	actualLabelNames, err := headerReader.LabelNames()
+	testutil.Ok(t, err)
+	testutil.Equals(t, expLabelNames, actualLabelNames)
 
 	expRanges, err := indexReader.PostingsRanges()
 	testutil.Ok(t, err)
@@ -311,6 +315,68 @@ func prepareIndexV2Block(t testing.TB, tmpDir string, bkt objstore.Bucket) *meta
 	return m
 }
 
+// interruptingBucket records GetRange calls and fails reading ranges after failAfter bytes, if set.
+type interruptingBucket struct {
+	objstore.Bucket
+
+	ranges    [][2]int64
+	failAfter int64
+}
+
+func (b *interruptingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.ranges = append(b.ranges, [2]int64{off, length})
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil || b.failAfter == 0 || length <= b.failAfter {
+		return rc, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(rc, b.failAfter), failingReader{})), nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestWriteBinary_ResumesInterruptedDownload(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-indexheader-resume")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	fsBkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, fsBkt.Close()) }()
+
+	m := prepareIndexV2Block(t, tmpDir, fsBkt)
+	expectedFn := filepath.Join(tmpDir, "expected", block.IndexHeaderFilename)
+	testutil.Ok(t, WriteBinary(ctx, log.NewNopLogger(), fsBkt, m.ULID, expectedFn))
+
+	ir, _, err := newChunkedIndexReader(ctx, log.NewNopLogger(), fsBkt, m.ULID)
+	testutil.Ok(t, err)
+	symbolsLen := int64(ir.toc.Series - ir.toc.Symbols)
+
+	bkt := &interruptingBucket{Bucket: fsBkt, failAfter: 100}
+	fn := filepath.Join(tmpDir, m.ULID.String(), block.IndexHeaderFilename)
+	testutil.NotOk(t, WriteBinary(ctx, log.NewNopLogger(), bkt, m.ULID, fn))
+
+	// Next build downloads only the rest of the interrupted symbols section.
+	bkt.failAfter, bkt.ranges = 0, nil
+	testutil.Ok(t, WriteBinary(ctx, log.NewNopLogger(), bkt, m.ULID, fn))
+	testutil.Equals(t, [2]int64{int64(ir.toc.Symbols) + 100, symbolsLen - 100}, bkt.ranges[2])
+
+	expected, err := ioutil.ReadFile(expectedFn)
+	testutil.Ok(t, err)
+	got, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, got)
+
+	files, err := ioutil.ReadDir(filepath.Dir(fn))
+	testutil.Ok(t, err)
+	for _, f := range files {
+		testutil.Assert(t, !strings.HasPrefix(f.Name(), block.IndexHeaderFilename+"."), "unexpected leftover file %s", f.Name())
+	}
+}
+
 func BenchmarkBinaryWrite(t *testing.B) {
 	ctx := context.Background()
 
@@ -327,7 +393,7 @@ func BenchmarkBinaryWrite(t *testing.B) {
 
 	t.ResetTimer()
 	for i := 0; i < t.N; i++ {
-		testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
+		testutil.Ok(t, WriteBinary(ctx, log.NewNopLogger(), bkt, m.ULID, fn))
 	}
 }
 
@@ -342,7 +408,7 @@ func BenchmarkBinaryReader(t *testing.B) {
 
 	m := prepareIndexV2Block(t, tmpDir, bkt)
 	fn := filepath.Join(tmpDir, m.ULID.String(), block.IndexHeaderFilename)
-	testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
+	testutil.Ok(t, WriteBinary(ctx, log.NewNopLogger(), bkt, m.ULID, fn))
 
 	t.ResetTimer()
 	for i := 0; i < t.N; i++ {
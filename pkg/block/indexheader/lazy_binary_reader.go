@@ -0,0 +1,315 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package indexheader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+var errReaderClosed = errors.New("index-header reader is closed")
+
+// ReaderPool creates index-header readers. If memory budget is set, readers are loaded lazily on first use, and least
+// recently used readers are unloaded once the total size of loaded index-headers exceeds the budget.
+type ReaderPool struct {
+	logger log.Logger
+	budget int64
+
+	// clock is incremented on every use of a reader, to order readers by the time of their last use.
+	clock uint64
+
+	mtx         sync.Mutex
+	loaded      map[*LazyBinaryReader]struct{}
+	loadedBytes int64
+
+	loads            prometheus.Counter
+	loadFailures     prometheus.Counter
+	evictions        prometheus.Counter
+	loadedBytesGauge prometheus.Gauge
+}
+
+// NewReaderPool returns a ReaderPool keeping the total size of loaded index-headers within the given budget in bytes.
+// Budget 0 disables lazy loading, all readers are loaded once created.
+func NewReaderPool(logger log.Logger, reg prometheus.Registerer, budget int64) *ReaderPool {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &ReaderPool{
+		logger: logger,
+		budget: budget,
+		loaded: map[*LazyBinaryReader]struct{}{},
+		loads: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_indexheader_lazy_load_total",
+			Help: "Total number of index-header lazy load operations.",
+		}),
+		loadFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_indexheader_lazy_load_failed_total",
+			Help: "Total number of failed index-header lazy load operations.",
+		}),
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_indexheader_evictions_total",
+			Help: "Total number of index-headers unloaded to keep loaded index-headers within the memory budget.",
+		}),
+		loadedBytesGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_bucket_store_indexheader_loaded_bytes",
+			Help: "Total size of lazily loaded index-headers.",
+		}),
+	}
+}
+
+// NewBinaryReader builds the index-header of the given block if not present on disk and returns a reader for it.
+func (p *ReaderPool) NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID, postingOffsetsInMemSampling int) (Reader, error) {
+	br, err := NewBinaryReader(ctx, logger, bkt, dir, id, postingOffsetsInMemSampling)
+	if err != nil || p.budget <= 0 {
+		return br, err
+	}
+
+	// Index-header is present on disk now, so it can be loaded on demand.
+	r := &LazyBinaryReader{
+		pool:                        p,
+		path:                        filepath.Join(dir, id.String(), block.IndexHeaderFilename),
+		postingOffsetsInMemSampling: postingOffsetsInMemSampling,
+		indexVersion:                br.IndexVersion(),
+	}
+	if err := br.Close(); err != nil {
+		return nil, errors.Wrap(err, "close index-header")
+	}
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat index-header")
+	}
+	r.size = fi.Size()
+	return r, nil
+}
+
+// register adds the newly loaded reader to the pool and returns least recently used readers which have to be unloaded
+// to fit into the budget. Victims are unloaded by the caller without holding any lock, as unloading waits for calls
+// in flight.
+func (p *ReaderPool) register(r *LazyBinaryReader) []*LazyBinaryReader {
+	p.loads.Inc()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, ok := p.loaded[r]; !ok {
+		p.loaded[r] = struct{}{}
+		p.loadedBytes += r.size
+		p.loadedBytesGauge.Set(float64(p.loadedBytes))
+	}
+	return p.victims(r)
+}
+
+// unregister removes the unloaded reader from the pool.
+func (p *ReaderPool) unregister(r *LazyBinaryReader) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, ok := p.loaded[r]; !ok {
+		return
+	}
+	delete(p.loaded, r)
+	p.loadedBytes -= r.size
+	p.loadedBytesGauge.Set(float64(p.loadedBytes))
+}
+
+// victims returns least recently used readers, which have to be unloaded so that loaded readers fit into the budget.
+// The just loaded reader is never evicted, so a single index-header larger than the budget can still be used.
+func (p *ReaderPool) victims(loaded *LazyBinaryReader) []*LazyBinaryReader {
+	excess := p.loadedBytes - p.budget
+	if excess <= 0 {
+		return nil
+	}
+
+	candidates := make([]*LazyBinaryReader, 0, len(p.loaded))
+	for r := range p.loaded {
+		if r != loaded {
+			candidates = append(candidates, r)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return atomic.LoadUint64(&candidates[i].lastUsed) < atomic.LoadUint64(&candidates[j].lastUsed)
+	})
+
+	var victims []*LazyBinaryReader
+	for _, r := range candidates {
+		if excess <= 0 {
+			break
+		}
+		excess -= r.size
+		victims = append(victims, r)
+	}
+	return victims
+}
+
+// evict unloads given readers.
+func (p *ReaderPool) evict(victims []*LazyBinaryReader) {
+	for _, v := range victims {
+		if v.unload() {
+			p.evictions.Inc()
+			level.Debug(p.logger).Log("msg", "evicted index-header", "path", v.path)
+		}
+	}
+}
+
+// LazyBinaryReader is a BinaryReader loaded on first use, which can be unloaded by its ReaderPool when idle.
+// Calls in flight while the reader is being unloaded are finished before the underlying memory is released.
+type LazyBinaryReader struct {
+	pool                        *ReaderPool
+	path                        string
+	postingOffsetsInMemSampling int
+	indexVersion                int
+	size                        int64
+
+	lastUsed uint64
+
+	mtx    sync.RWMutex
+	reader *BinaryReader
+	closed bool
+}
+
+// acquire returns the loaded reader, loading it if needed. The returned function has to be called once the reader,
+// including any memory returned by it, is no longer used.
+func (r *LazyBinaryReader) acquire() (*BinaryReader, func(), error) {
+	atomic.StoreUint64(&r.lastUsed, atomic.AddUint64(&r.pool.clock, 1))
+	for {
+		r.mtx.RLock()
+		if r.closed {
+			r.mtx.RUnlock()
+			return nil, nil, errReaderClosed
+		}
+		if r.reader != nil {
+			return r.reader, r.mtx.RUnlock, nil
+		}
+		r.mtx.RUnlock()
+
+		if err := r.load(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (r *LazyBinaryReader) load() error {
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return errReaderClosed
+	}
+	if r.reader != nil {
+		r.mtx.Unlock()
+		return nil
+	}
+	br, err := newFileBinaryReader(r.path, r.postingOffsetsInMemSampling)
+	if err != nil {
+		r.mtx.Unlock()
+		r.pool.loadFailures.Inc()
+		return errors.Wrapf(err, "lazy load index-header %s", r.path)
+	}
+	r.reader = br
+	victims := r.pool.register(r)
+	r.mtx.Unlock()
+
+	r.pool.evict(victims)
+	return nil
+}
+
+// unload releases the loaded reader, once calls in flight are finished. It returns false if the reader was not loaded.
+func (r *LazyBinaryReader) unload() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.reader == nil {
+		return false
+	}
+	if err := r.reader.Close(); err != nil {
+		level.Warn(r.pool.logger).Log("msg", "failed to close index-header", "path", r.path, "err", err)
+	}
+	r.reader = nil
+	r.pool.unregister(r)
+	return true
+}
+
+// IndexVersion implements Reader.
+func (r *LazyBinaryReader) IndexVersion() int {
+	return r.indexVersion
+}
+
+// PostingsOffset implements Reader.
+func (r *LazyBinaryReader) PostingsOffset(name string, value string) (index.Range, error) {
+	br, done, err := r.acquire()
+	if err != nil {
+		return index.Range{}, err
+	}
+	defer done()
+	return br.PostingsOffset(name, value)
+}
+
+// LookupSymbol implements Reader.
+func (r *LazyBinaryReader) LookupSymbol(o uint32) (string, error) {
+	br, done, err := r.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return br.LookupSymbol(o)
+}
+
+// LabelValues implements Reader. Values are copied, as they would otherwise point to memory released once the reader
+// is unloaded.
+func (r *LazyBinaryReader) LabelValues(name string) ([]string, error) {
+	br, done, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	values, err := br.LabelValues(name)
+	if err != nil {
+		return nil, err
+	}
+	copied := make([]string, 0, len(values))
+	for _, v := range values {
+		copied = append(copied, string(append([]byte(nil), v...)))
+	}
+	return copied, nil
+}
+
+// LabelNames implements Reader.
+func (r *LazyBinaryReader) LabelNames() ([]string, error) {
+	br, done, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return br.LabelNames()
+}
+
+// Close implements Reader.
+func (r *LazyBinaryReader) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.closed = true
+	if r.reader == nil {
+		return nil
+	}
+	err := r.reader.Close()
+	r.reader = nil
+	r.pool.unregister(r)
+	return err
+}
@@ -0,0 +1,209 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package indexheader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore/filesystem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func prepareLazyReaders(t *testing.T, ctx context.Context, tmpDir string, pool *ReaderPool, n int) []*LazyBinaryReader {
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+
+	var readers []*LazyBinaryReader
+	for i := 0; i < n; i++ {
+		var series []labels.Labels
+		for j := 0; j < 10; j++ {
+			series = append(series, labels.FromStrings("a", fmt.Sprintf("%d", j), "block", fmt.Sprintf("%d", i)))
+		}
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, series, 10, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String())))
+
+		r, err := pool.NewBinaryReader(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, "headers"), id, 1)
+		testutil.Ok(t, err)
+		lr, ok := r.(*LazyBinaryReader)
+		testutil.Assert(t, ok, "expected lazy reader")
+		readers = append(readers, lr)
+	}
+	return readers
+}
+
+func isLoaded(r *LazyBinaryReader) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.reader != nil
+}
+
+func TestReaderPool_DisabledBudget(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-lazy-indexheader")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{labels.FromStrings("a", "1")}, 10, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String())))
+
+	r, err := NewReaderPool(nil, prometheus.NewRegistry(), 0).NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, id, 1)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, r.Close()) }()
+
+	_, ok := r.(*BinaryReader)
+	testutil.Assert(t, ok, "expected eagerly loaded reader if budget is disabled")
+}
+
+func TestReaderPool_Eviction(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-lazy-indexheader")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	pool := NewReaderPool(nil, prometheus.NewRegistry(), 1)
+	readers := prepareLazyReaders(t, ctx, tmpDir, pool, 3)
+	defer func() {
+		for _, r := range readers {
+			testutil.Ok(t, r.Close())
+		}
+	}()
+
+	// Readers are not loaded until used.
+	for _, r := range readers {
+		testutil.Assert(t, !isLoaded(r), "reader loaded before first use")
+	}
+	testutil.Equals(t, 0.0, promtest.ToFloat64(pool.loadedBytesGauge))
+
+	// Budget fits all but one of the index-headers.
+	pool.budget = readers[0].size + readers[1].size + readers[2].size - 1
+
+	for i, r := range readers {
+		vals, err := r.LabelValues("block")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{fmt.Sprintf("%d", i)}, vals)
+	}
+	testutil.Equals(t, 3.0, promtest.ToFloat64(pool.loads))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(pool.evictions))
+	testutil.Assert(t, !isLoaded(readers[0]), "least recently used reader was not evicted")
+	testutil.Assert(t, isLoaded(readers[1]) && isLoaded(readers[2]), "recently used readers were evicted")
+	testutil.Equals(t, float64(readers[1].size+readers[2].size), promtest.ToFloat64(pool.loadedBytesGauge))
+
+	// Using reader 1 makes reader 2 the least recently used one.
+	_, err = readers[1].LookupSymbol(0)
+	testutil.Ok(t, err)
+
+	// Evicted reader is transparently loaded again.
+	vals, err := readers[0].LabelValues("block")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"0"}, vals)
+	testutil.Equals(t, 4.0, promtest.ToFloat64(pool.loads))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(pool.evictions))
+	testutil.Assert(t, isLoaded(readers[0]) && isLoaded(readers[1]), "recently used readers were evicted")
+	testutil.Assert(t, !isLoaded(readers[2]), "least recently used reader was not evicted")
+
+	// Index version is available without loading the reader.
+	testutil.Equals(t, 2, readers[2].IndexVersion())
+	testutil.Assert(t, !isLoaded(readers[2]), "reader loaded for index version")
+
+	// Closed reader is unregistered and cannot be used anymore.
+	testutil.Ok(t, readers[0].Close())
+	testutil.Equals(t, float64(readers[1].size), promtest.ToFloat64(pool.loadedBytesGauge))
+	_, err = readers[0].LabelValues("block")
+	testutil.NotOk(t, err)
+	_, err = readers[0].LabelNames()
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(pool.loadFailures))
+}
+
+func TestReaderPool_EvictionWithConcurrentQueries(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-lazy-indexheader")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	// Budget fits a single index-header, so nearly every call evicts readers used by other calls in flight.
+	pool := NewReaderPool(nil, prometheus.NewRegistry(), 1)
+	readers := prepareLazyReaders(t, ctx, tmpDir, pool, 4)
+	defer func() {
+		for _, r := range readers {
+			testutil.Ok(t, r.Close())
+		}
+	}()
+	pool.budget = readers[0].size
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(readers)*10)
+	)
+	for w := 0; w < 10; w++ {
+		for i, r := range readers {
+			wg.Add(1)
+			go func(i int, r *LazyBinaryReader) {
+				defer wg.Done()
+
+				for k := 0; k < 20; k++ {
+					vals, err := r.LabelValues("block")
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(vals) != 1 || vals[0] != fmt.Sprintf("%d", i) {
+						errs <- fmt.Errorf("unexpected values of block %d: %v", i, vals)
+						return
+					}
+					if _, err := r.PostingsOffset("a", "1"); err != nil {
+						errs <- err
+						return
+					}
+					names, err := r.LabelNames()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(names) != 2 {
+						errs <- fmt.Errorf("unexpected label names of block %d: %v", i, names)
+						return
+					}
+				}
+			}(i, r)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		testutil.Ok(t, err)
+	}
+
+	testutil.Assert(t, promtest.ToFloat64(pool.evictions) > 0, "expected evictions")
+	testutil.Equals(t, 0.0, promtest.ToFloat64(pool.loadFailures))
+
+	var loaded int64
+	for _, r := range readers {
+		if isLoaded(r) {
+			loaded += r.size
+		}
+	}
+	testutil.Equals(t, float64(loaded), promtest.ToFloat64(pool.loadedBytesGauge))
+}
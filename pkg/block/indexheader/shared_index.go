@@ -0,0 +1,102 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package indexheader
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+// SharedIndex provides index-header readers from an index shared by multiple store gateways, e.g. index-headers on a
+// shared read-only volume or a remote index service, so that each of them does not have to build and hold its own
+// copy of index-headers of all blocks.
+type SharedIndex interface {
+	// Reader returns index-header reader of the given block. Closing the reader releases it, but not the shared index.
+	Reader(ctx context.Context, id ulid.ULID) (Reader, error)
+}
+
+// SharedDirIndex is a SharedIndex reading index-headers from a directory laid out like the data directory of a store
+// gateway, i.e. <dir>/<block ID>/index-header, which it never writes to. Index-headers are memory-mapped, so the page
+// cache holding them is shared by all processes reading the directory, and a single reader per block is shared by all
+// users within the process.
+type SharedDirIndex struct {
+	dir                         string
+	postingOffsetsInMemSampling int
+
+	mtx     sync.Mutex
+	readers map[ulid.ULID]*sharedReader
+}
+
+// NewSharedDirIndex returns SharedDirIndex reading index-headers from the given directory.
+func NewSharedDirIndex(dir string, postingOffsetsInMemSampling int) *SharedDirIndex {
+	return &SharedDirIndex{
+		dir:                         dir,
+		postingOffsetsInMemSampling: postingOffsetsInMemSampling,
+		readers:                     map[ulid.ULID]*sharedReader{},
+	}
+}
+
+// Reader implements SharedIndex. It fails if the index-header of the block is not in the directory.
+func (i *SharedDirIndex) Reader(_ context.Context, id ulid.ULID) (Reader, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	r, ok := i.readers[id]
+	if !ok {
+		br, err := newFileBinaryReader(filepath.Join(i.dir, id.String(), block.IndexHeaderFilename), i.postingOffsetsInMemSampling)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open shared index-header of block %s", id)
+		}
+		r = &sharedReader{BinaryReader: br}
+		i.readers[id] = r
+	}
+	r.refs++
+	return &sharedReaderRef{sharedReader: r, release: func() error { return i.release(id) }}, nil
+}
+
+// Opened returns the number of index-headers currently opened.
+func (i *SharedDirIndex) Opened() int {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return len(i.readers)
+}
+
+func (i *SharedDirIndex) release(id ulid.ULID) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	r := i.readers[id]
+	r.refs--
+	if r.refs > 0 {
+		return nil
+	}
+	delete(i.readers, id)
+	return r.BinaryReader.Close()
+}
+
+// sharedReader is an index-header reader with the number of its users.
+type sharedReader struct {
+	*BinaryReader
+
+	refs int
+}
+
+// sharedReaderRef is a reference to a shared reader, releasing it once closed.
+type sharedReaderRef struct {
+	*sharedReader
+
+	once    sync.Once
+	release func() error
+}
+
+func (r *sharedReaderRef) Close() (err error) {
+	r.once.Do(func() { err = r.release() })
+	return err
+}
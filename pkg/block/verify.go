@@ -0,0 +1,254 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// VerificationLevel controls how thoroughly VerifyInBucket checks a block.
+type VerificationLevel string
+
+const (
+	// VerificationNone skips verification.
+	VerificationNone VerificationLevel = "none"
+	// VerificationQuick checks the index TOC checksum, presence and headers of all segment files and CRC of the first
+	// chunk of each segment file. It reads only a few bytes per file.
+	VerificationQuick VerificationLevel = "quick"
+	// VerificationFull additionally checks invariants of the whole index and CRC of all chunks. It reads the whole block.
+	VerificationFull VerificationLevel = "full"
+)
+
+const (
+	// indexTOCLen is the size of index TOC, including its checksum.
+	indexTOCLen = 6*8 + crc32.Size
+	// maxChunkLen is the length above which chunk length is considered corrupted. Chunks are far smaller in practice,
+	// but this avoids huge allocations caused by corrupted length.
+	maxChunkLen = 16 * 1024 * 1024
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted is the cause of VerifyInBucket errors caused by corrupted or missing block files, as opposed to failures
+// of reading them.
+var ErrCorrupted = errors.New("block corrupted")
+
+// corruptedErr wraps ErrCorrupted with the given message, while keeping the message of the cause if any.
+func corruptedErr(cause error, format string, args ...interface{}) error {
+	if cause != nil {
+		return errors.Wrapf(ErrCorrupted, "%s: %s", errors.Errorf(format, args...), cause)
+	}
+	return errors.Wrapf(ErrCorrupted, format, args...)
+}
+
+// isTruncated returns true if the error means that file ended prematurely.
+func isTruncated(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// VerifyInBucket checks integrity of the block with given meta in the bucket. The index is downloaded to the given
+// scratch directory for full verification. Errors caused by corrupted block have ErrCorrupted as their cause.
+func VerifyInBucket(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, meta *metadata.Meta, scratchDir string, lvl VerificationLevel) error {
+	if lvl == VerificationNone || lvl == "" {
+		return nil
+	}
+	if lvl != VerificationQuick && lvl != VerificationFull {
+		return errors.Errorf("unknown verification level %q", lvl)
+	}
+
+	if err := verifyIndexTOC(ctx, bkt, path.Join(meta.ULID.String(), IndexFilename)); err != nil {
+		return errors.Wrap(err, "verify index")
+	}
+
+	segments := make([]string, 0, len(meta.Thanos.SegmentFiles))
+	for _, sf := range meta.Thanos.SegmentFiles {
+		segments = append(segments, path.Join(meta.ULID.String(), ChunksDirname, sf))
+	}
+	if len(segments) == 0 {
+		if err := bkt.Iter(ctx, path.Join(meta.ULID.String(), ChunksDirname), func(n string) error {
+			segments = append(segments, n)
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "list segment files")
+		}
+	}
+
+	maxChunks := 1
+	if lvl == VerificationFull {
+		maxChunks = -1
+	}
+	for _, s := range segments {
+		if err := verifySegmentFile(ctx, logger, bkt, s, maxChunks); err != nil {
+			return errors.Wrapf(err, "verify segment file %s", s)
+		}
+	}
+
+	if lvl != VerificationFull {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir(scratchDir, "verify-"+meta.ULID.String())
+	if err != nil {
+		return errors.Wrap(err, "create scratch dir")
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	fn := filepath.Join(dir, IndexFilename)
+	if err := objstore.DownloadFile(ctx, logger, bkt, path.Join(meta.ULID.String(), IndexFilename), fn); err != nil {
+		return errors.Wrap(err, "download index")
+	}
+	stats, err := GatherIndexIssueStats(logger, fn, meta.MinTime, meta.MaxTime)
+	if err != nil {
+		return corruptedErr(err, "gather index issues")
+	}
+	if err := stats.CriticalErr(); err != nil {
+		return corruptedErr(err, "verify index")
+	}
+	return nil
+}
+
+// verifyIndexTOC checks the magic number and TOC checksum of the given index file.
+func verifyIndexTOC(ctx context.Context, bkt objstore.BucketReader, name string) error {
+	attrs, err := bkt.Attributes(ctx, name)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return corruptedErr(err, "index not found")
+		}
+		return errors.Wrap(err, "get attributes")
+	}
+	if attrs.Size < index.HeaderLen+indexTOCLen {
+		return corruptedErr(nil, "index of %d bytes is too small", attrs.Size)
+	}
+
+	b, err := readRange(ctx, bkt, name, 0, index.HeaderLen)
+	if err != nil {
+		return err
+	}
+	if m := binary.BigEndian.Uint32(b[:4]); m != index.MagicIndex {
+		return corruptedErr(nil, "invalid magic number %x", m)
+	}
+
+	b, err = readRange(ctx, bkt, name, attrs.Size-indexTOCLen, indexTOCLen)
+	if err != nil {
+		return err
+	}
+	toc, err := index.NewTOCFromByteSlice(byteSlice(b))
+	if err != nil {
+		return corruptedErr(err, "read TOC")
+	}
+	for _, off := range []uint64{toc.Symbols, toc.Series, toc.LabelIndices, toc.LabelIndicesTable, toc.Postings, toc.PostingsTable} {
+		if off > uint64(attrs.Size-indexTOCLen) {
+			return corruptedErr(nil, "TOC offset %d beyond index size %d", off, attrs.Size)
+		}
+	}
+	return nil
+}
+
+// verifySegmentFile checks the header of the given segment file and CRC of up to maxChunks chunks. All chunks are
+// checked if maxChunks is negative.
+func verifySegmentFile(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, name string, maxChunks int) error {
+	rc, err := bkt.Get(ctx, name)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return corruptedErr(err, "segment file not found")
+		}
+		return errors.Wrap(err, "get segment file")
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "close segment file reader")
+
+	r := bufio.NewReader(rc)
+	header := make([]byte, chunks.SegmentHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if isTruncated(err) {
+			return corruptedErr(err, "read header")
+		}
+		return errors.Wrap(err, "read header")
+	}
+	if m := binary.BigEndian.Uint32(header[:chunks.MagicChunksSize]); m != chunks.MagicChunks {
+		return corruptedErr(nil, "invalid magic number %x", m)
+	}
+
+	var (
+		buf  []byte
+		lbuf [binary.MaxVarintLen64]byte
+		crc  = make([]byte, crc32.Size)
+		off  = int64(chunks.SegmentHeaderSize)
+	)
+	for i := 0; maxChunks < 0 || i < maxChunks; i++ {
+		l, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return corruptedErr(err, "read length of chunk at offset %d", off)
+			}
+			return errors.Wrapf(err, "read length of chunk at offset %d", off)
+		}
+		if l > maxChunkLen {
+			return corruptedErr(nil, "invalid length %d of chunk at offset %d", l, off)
+		}
+
+		// Checksum covers the encoding and data of the chunk.
+		if uint64(cap(buf)) < l+chunks.ChunkEncodingSize {
+			buf = make([]byte, l+chunks.ChunkEncodingSize)
+		}
+		buf = buf[:l+chunks.ChunkEncodingSize]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if isTruncated(err) {
+				return corruptedErr(err, "read chunk at offset %d", off)
+			}
+			return errors.Wrapf(err, "read chunk at offset %d", off)
+		}
+		if _, err := io.ReadFull(r, crc); err != nil {
+			if isTruncated(err) {
+				return corruptedErr(err, "read checksum of chunk at offset %d", off)
+			}
+			return errors.Wrapf(err, "read checksum of chunk at offset %d", off)
+		}
+		if exp, got := binary.BigEndian.Uint32(crc), crc32.Checksum(buf, castagnoliTable); exp != got {
+			return corruptedErr(nil, "checksum mismatch of chunk at offset %d: expected %x, got %x", off, exp, got)
+		}
+		off += int64(binary.PutUvarint(lbuf[:], l) + len(buf) + crc32.Size)
+	}
+	return nil
+}
+
+func readRange(ctx context.Context, bkt objstore.BucketReader, name string, off, length int64) (_ []byte, err error) {
+	rc, err := bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get range %d-%d", off, off+length)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "close range reader")
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return nil, errors.Wrapf(err, "read range %d-%d", off, off+length)
+	}
+	return b, nil
+}
+
+type byteSlice []byte
+
+func (b byteSlice) Len() int                    { return len(b) }
+func (b byteSlice) Range(start, end int) []byte { return b[start:end] }
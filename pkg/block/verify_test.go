@@ -0,0 +1,123 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// corruptObject flips the byte at the given offset of the object. Negative offset counts from the end of the object.
+func corruptObject(t *testing.T, bkt objstore.Bucket, name string, off int) {
+	ctx := context.Background()
+
+	r, err := bkt.Get(ctx, name)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+
+	if off < 0 {
+		off += len(b)
+	}
+	b[off] ^= 0xff
+	testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader(b)))
+}
+
+type failingGetBucket struct {
+	objstore.Bucket
+}
+
+func (b failingGetBucket) Get(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestVerifyInBucket(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-verify")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	meta, err := metadata.Read(filepath.Join(tmpDir, id.String()))
+	testutil.Ok(t, err)
+
+	segment := path.Join(id.String(), ChunksDirname, "000001")
+	upload := func(t *testing.T) objstore.Bucket {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, Upload(ctx, logger, bkt, filepath.Join(tmpDir, id.String())))
+		return bkt
+	}
+	expectCorrupted := func(t *testing.T, err error) {
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Cause(err) == ErrCorrupted, "expected corruption, got %v", err)
+	}
+
+	t.Run("healthy block", func(t *testing.T) {
+		bkt := upload(t)
+		for _, lvl := range []VerificationLevel{VerificationNone, VerificationQuick, VerificationFull} {
+			testutil.Ok(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, lvl))
+		}
+		testutil.NotOk(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, "unknown"))
+	})
+	t.Run("corrupted index TOC", func(t *testing.T) {
+		bkt := upload(t)
+		corruptObject(t, bkt, path.Join(id.String(), IndexFilename), -10)
+
+		testutil.Ok(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationNone))
+		expectCorrupted(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationQuick))
+	})
+	t.Run("corrupted first chunk", func(t *testing.T) {
+		bkt := upload(t)
+		// Data of the first chunk follows the segment header, its length and encoding.
+		corruptObject(t, bkt, segment, chunks.SegmentHeaderSize+4)
+
+		expectCorrupted(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationQuick))
+		expectCorrupted(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationFull))
+	})
+	t.Run("corrupted last chunk", func(t *testing.T) {
+		bkt := upload(t)
+		corruptObject(t, bkt, segment, -1)
+
+		// Only the first chunk is checked by quick verification.
+		testutil.Ok(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationQuick))
+		expectCorrupted(t, VerifyInBucket(ctx, logger, bkt, meta, tmpDir, VerificationFull))
+	})
+	t.Run("missing segment file", func(t *testing.T) {
+		bkt := upload(t)
+		testutil.Ok(t, bkt.Delete(ctx, segment))
+
+		m := *meta
+		m.Thanos.SegmentFiles = []string{"000001"}
+		expectCorrupted(t, VerifyInBucket(ctx, logger, bkt, &m, tmpDir, VerificationQuick))
+	})
+	t.Run("read failure", func(t *testing.T) {
+		err := VerifyInBucket(ctx, logger, failingGetBucket{Bucket: upload(t)}, meta, tmpDir, VerificationQuick)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Cause(err) != ErrCorrupted, "read failure reported as corruption: %v", err)
+	})
+}
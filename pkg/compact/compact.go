@@ -848,6 +848,52 @@ func (cg *Group) deleteBlock(b string) error {
 	return nil
 }
 
+// labelSetLimiter limits the number of groups with the same external labels compacted concurrently, e.g. groups of
+// different resolutions of one tenant. Zero limit means no limit.
+type labelSetLimiter struct {
+	limit int
+
+	mtx     sync.Mutex
+	running map[string]int
+	// released is notified whenever a group is released.
+	released chan struct{}
+}
+
+func newLabelSetLimiter(limit int) *labelSetLimiter {
+	return &labelSetLimiter{limit: limit, running: map[string]int{}, released: make(chan struct{}, 1)}
+}
+
+// acquireNext returns the index of the first of the given groups that can be compacted now and counts it as running.
+// It returns -1 if all groups have to wait for a running group of their external labels to be released.
+func (l *labelSetLimiter) acquireNext(groups []*Group) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for i, g := range groups {
+		key := g.Labels().String()
+		if l.limit > 0 && l.running[key] >= l.limit {
+			continue
+		}
+		l.running[key]++
+		return i
+	}
+	return -1
+}
+
+func (l *labelSetLimiter) release(g *Group) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	key := g.Labels().String()
+	if l.running[key]--; l.running[key] <= 0 {
+		delete(l.running, key)
+	}
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
 // BucketCompactor compacts blocks in a bucket.
 type BucketCompactor struct {
 	logger      log.Logger
@@ -857,9 +903,12 @@ type BucketCompactor struct {
 	compactDir  string
 	bkt         objstore.Bucket
 	concurrency int
+	// concurrencyPerLabelSet limits the number of groups with the same external labels compacted concurrently.
+	concurrencyPerLabelSet int
 }
 
-// NewBucketCompactor creates a new bucket compactor.
+// NewBucketCompactor creates a new bucket compactor. Zero concurrencyPerLabelSet means groups are limited only by
+// the global concurrency.
 func NewBucketCompactor(
 	logger log.Logger,
 	sy *Syncer,
@@ -868,18 +917,23 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	concurrencyPerLabelSet int,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
 	}
+	if concurrencyPerLabelSet < 0 {
+		return nil, errors.Errorf("invalid concurrency level per label set (%d), concurrency level per label set must be >= 0", concurrencyPerLabelSet)
+	}
 	return &BucketCompactor{
-		logger:      logger,
-		sy:          sy,
-		grouper:     grouper,
-		comp:        comp,
-		compactDir:  compactDir,
-		bkt:         bkt,
-		concurrency: concurrency,
+		logger:                 logger,
+		sy:                     sy,
+		grouper:                grouper,
+		comp:                   comp,
+		compactDir:             compactDir,
+		bkt:                    bkt,
+		concurrency:            concurrency,
+		concurrencyPerLabelSet: concurrencyPerLabelSet,
 	}, nil
 }
 
@@ -903,6 +957,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 			errChan                = make(chan error, c.concurrency)
 			finishedAllGroups      = true
 			mtx                    sync.Mutex
+			limiter                = newLabelSetLimiter(c.concurrencyPerLabelSet)
 		)
 		defer workCtxCancel()
 
@@ -914,6 +969,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 				defer wg.Done()
 				for g := range groupChan {
 					shouldRerunGroup, _, err := g.Compact(workCtx, c.compactDir, c.comp)
+					limiter.release(g)
 					if err == nil {
 						if shouldRerunGroup {
 							mtx.Lock()
@@ -961,16 +1017,32 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 
 		level.Info(c.logger).Log("msg", "start of compactions")
 
-		// Send all groups found during this pass to the compaction workers.
-		var groupErrs terrors.MultiError
+		// Send all groups found during this pass to the compaction workers. Groups whose external labels have reached
+		// the limit of concurrently compacted groups wait for one of them to finish.
+		var (
+			groupErrs terrors.MultiError
+			pending   = append([]*Group(nil), groups...)
+		)
 	groupLoop:
-		for _, g := range groups {
+		for len(pending) > 0 {
+			i := limiter.acquireNext(pending)
+			if i < 0 {
+				select {
+				case groupErr := <-errChan:
+					groupErrs.Add(groupErr)
+					break groupLoop
+				case <-limiter.released:
+				}
+				continue
+			}
+
 			select {
 			case groupErr := <-errChan:
 				groupErrs.Add(groupErr)
 				break groupLoop
-			case groupChan <- g:
+			case groupChan <- pending[i]:
 			}
+			pending = append(pending[:i], pending[i+1:]...)
 		}
 		close(groupChan)
 		wg.Wait()
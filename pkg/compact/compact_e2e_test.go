@@ -196,7 +196,7 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 
 		grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
-		bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 2)
+		bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 2, 0)
 		testutil.Ok(t, err)
 
 		// Compaction on empty should not fail.
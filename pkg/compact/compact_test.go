@@ -4,9 +4,23 @@
 package compact
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
-
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
 
 	"github.com/pkg/errors"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
@@ -111,3 +125,103 @@ func TestGroupKey(t *testing.T) {
 		}
 	}
 }
+
+type staticGrouper []*Group
+
+func (g staticGrouper) Groups(map[ulid.ULID]*metadata.Meta) ([]*Group, error) { return g, nil }
+
+// concurrencyTrackingCompactor plans nothing, tracking the maximum number of groups planned concurrently in total
+// and per external labels of the group.
+type concurrencyTrackingCompactor struct {
+	tsdb.Compactor
+
+	labelsByKey map[string]string
+
+	mtx               sync.Mutex
+	running           int
+	runningPerLabels  map[string]int
+	maxRunning        int
+	maxRunningByLabel int
+	planned           int
+}
+
+func (c *concurrencyTrackingCompactor) Plan(dir string) ([]string, error) {
+	lset := c.labelsByKey[filepath.Base(dir)]
+
+	c.mtx.Lock()
+	c.running++
+	c.runningPerLabels[lset]++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+	if c.runningPerLabels[lset] > c.maxRunningByLabel {
+		c.maxRunningByLabel = c.runningPerLabels[lset]
+	}
+	c.mtx.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.mtx.Lock()
+	c.running--
+	c.runningPerLabels[lset]--
+	c.planned++
+	c.mtx.Unlock()
+	return nil, nil
+}
+
+func TestBucketCompactor_Compact_ConcurrencyPerLabelSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-compact-concurrency")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 1, bkt, "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter, duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+	counter := func() prometheus.Counter { return prometheus.NewCounter(prometheus.CounterOpts{}) }
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, counter(), counter(), 1)
+	testutil.Ok(t, err)
+
+	// Many groups of tenants a and b, and a single group of tenant c.
+	var (
+		groups      staticGrouper
+		labelsByKey = map[string]string{}
+	)
+	for _, tenant := range []string{"a", "b"} {
+		for i := 0; i < 5; i++ {
+			lset := labels.FromStrings("tenant", tenant)
+			key := fmt.Sprintf("%s-%d", tenant, i)
+			g, err := NewGroup(nil, bkt, key, lset, int64(i), false, false, counter(), counter(), counter(), counter(), counter(), counter(), counter())
+			testutil.Ok(t, err)
+			groups, labelsByKey[key] = append(groups, g), lset.String()
+		}
+	}
+	g, err := NewGroup(nil, bkt, "c-0", labels.FromStrings("tenant", "c"), 0, false, false, counter(), counter(), counter(), counter(), counter(), counter(), counter())
+	testutil.Ok(t, err)
+	groups, labelsByKey["c-0"] = append(groups, g), labels.FromStrings("tenant", "c").String()
+
+	for _, tcase := range []struct {
+		concurrency, concurrencyPerLabelSet int
+		expectedMaxRunningByLabel           int
+	}{
+		{concurrency: 4, concurrencyPerLabelSet: 0, expectedMaxRunningByLabel: 4},
+		{concurrency: 4, concurrencyPerLabelSet: 2, expectedMaxRunningByLabel: 2},
+		{concurrency: 4, concurrencyPerLabelSet: 1, expectedMaxRunningByLabel: 1},
+		{concurrency: 1, concurrencyPerLabelSet: 2, expectedMaxRunningByLabel: 1},
+	} {
+		t.Run(fmt.Sprintf("concurrency %d per label set %d", tcase.concurrency, tcase.concurrencyPerLabelSet), func(t *testing.T) {
+			comp := &concurrencyTrackingCompactor{labelsByKey: labelsByKey, runningPerLabels: map[string]int{}}
+			bComp, err := NewBucketCompactor(log.NewNopLogger(), sy, groups, comp, dir, bkt, tcase.concurrency, tcase.concurrencyPerLabelSet)
+			testutil.Ok(t, err)
+			testutil.Ok(t, bComp.Compact(context.Background()))
+
+			testutil.Equals(t, len(groups), comp.planned)
+			testutil.Assert(t, comp.maxRunning <= tcase.concurrency, "expected at most %d groups compacted concurrently, got %d", tcase.concurrency, comp.maxRunning)
+			testutil.Assert(t, comp.maxRunningByLabel <= tcase.expectedMaxRunningByLabel, "expected at most %d groups of a label set compacted concurrently, got %d", tcase.expectedMaxRunningByLabel, comp.maxRunningByLabel)
+		})
+	}
+
+	_, err = NewBucketCompactor(log.NewNopLogger(), sy, groups, &concurrencyTrackingCompactor{}, dir, bkt, 1, -1)
+	testutil.NotOk(t, err)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"golang.org/x/sync/errgroup"
 )
 
 // Standard downsampling resolution levels in Thanos.
@@ -38,12 +39,14 @@ const (
 )
 
 // Downsample downsamples the given block. It writes a new block into dir and returns its ID.
+// Series are downsampled by up to concurrency goroutines.
 func Downsample(
 	logger log.Logger,
 	origMeta *metadata.Meta,
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
+	concurrency int,
 ) (id ulid.ULID, err error) {
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
 		return id, errors.New("target resolution not lower than existing one")
@@ -98,87 +101,151 @@ func Downsample(
 		return id, errors.Wrap(err, "get all postings list")
 	}
 
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Series are read and written in the postings order, but downsampled concurrently in batches, so that the output
+	// block is the same regardless of the concurrency.
 	var (
-		aggrChunks []*AggrChunk
-		all        []sample
-		chks       []chunks.Meta
-		lset       labels.Labels
-		reuseIt    chunkenc.Iterator
+		downsamplers = make([]seriesDownsampler, concurrency)
+		batch        = make([]downsampleSeries, 0, concurrency*downsampleBatchSizePerWorker)
 	)
+	for i := range downsamplers {
+		downsamplers[i].inRes, downsamplers[i].outRes = origMeta.Thanos.Downsample.Resolution, resolution
+	}
+	flush := func() error {
+		g := errgroup.Group{}
+		for w := range downsamplers {
+			w := w
+			g.Go(func() error {
+				for i := w; i < len(batch); i += len(downsamplers) {
+					if err := downsamplers[w].downsample(&batch[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		for _, s := range batch {
+			if err := streamedBlockWriter.WriteSeries(s.lset, s.out); err != nil {
+				return errors.Wrapf(err, "write series: %d", s.ref)
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
 	for postings.Next() {
-		lset = lset[:0]
-		chks = chks[:0]
-		all = all[:0]
-		aggrChunks = aggrChunks[:0]
+		batch = batch[:len(batch)+1]
+		s := &batch[len(batch)-1]
+		s.ref = postings.At()
+		s.lset = s.lset[:0]
+		s.chks = s.chks[:0]
 
 		// Get series labels and chunks. Downsampled data is sensitive to chunk boundaries
 		// and we need to preserve them to properly downsample previously downsampled data.
-		if err := indexr.Series(postings.At(), &lset, &chks); err != nil {
-			return id, errors.Wrapf(err, "get series %d", postings.At())
+		if err := indexr.Series(s.ref, &s.lset, &s.chks); err != nil {
+			return id, errors.Wrapf(err, "get series %d", s.ref)
 		}
 
-		for i, c := range chks[1:] {
-			if chks[i].MaxTime >= c.MinTime {
-				return id, errors.Errorf("found overlapping chunks within series %d. Chunks expected to be ordered by min time and non-overlapping, got: %v", postings.At(), chks)
+		for i, c := range s.chks[1:] {
+			if s.chks[i].MaxTime >= c.MinTime {
+				return id, errors.Errorf("found overlapping chunks within series %d. Chunks expected to be ordered by min time and non-overlapping, got: %v", s.ref, s.chks)
 			}
 		}
 
 		// While #183 exists, we sanitize the chunks we retrieved from the block
 		// before retrieving their samples.
-		for i, c := range chks {
+		for i, c := range s.chks {
 			chk, err := chunkr.Chunk(c.Ref)
 			if err != nil {
-				return id, errors.Wrapf(err, "get chunk %d, series %d", c.Ref, postings.At())
+				return id, errors.Wrapf(err, "get chunk %d, series %d", c.Ref, s.ref)
 			}
-			chks[i].Chunk = chk
+			s.chks[i].Chunk = chk
 		}
 
-		// Raw and already downsampled data need different processing.
-		if origMeta.Thanos.Downsample.Resolution == 0 {
-			for _, c := range chks {
-				// TODO(bwplotka): We can optimze this further by using in WriteSeries iterators of each chunk instead of
-				// samples. Also ensure 120 sample limit, otherwise we have gigantic chunks.
-				// https://github.com/thanos-io/thanos/issues/2542.
-				if err := expandChunkIterator(c.Chunk.Iterator(reuseIt), &all); err != nil {
-					return id, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, postings.At())
-				}
-			}
-			if err := streamedBlockWriter.WriteSeries(lset, downsampleRaw(all, resolution)); err != nil {
-				return id, errors.Wrapf(err, "downsample raw data, series: %d", postings.At())
-			}
-		} else {
-			// Downsample a block that contains aggregated chunks already.
-			for _, c := range chks {
-				ac, ok := c.Chunk.(*AggrChunk)
-				if !ok {
-					return id, errors.Errorf("expected downsampled chunk (*downsample.AggrChunk) got %T instead for series: %d", c.Chunk, postings.At())
-				}
-				aggrChunks = append(aggrChunks, ac)
-			}
-			downsampledChunks, err := downsampleAggr(
-				aggrChunks,
-				&all,
-				chks[0].MinTime,
-				chks[len(chks)-1].MaxTime,
-				origMeta.Thanos.Downsample.Resolution,
-				resolution,
-			)
-			if err != nil {
-				return id, errors.Wrapf(err, "downsample aggregate block, series: %d", postings.At())
-			}
-			if err := streamedBlockWriter.WriteSeries(lset, downsampledChunks); err != nil {
-				return id, errors.Wrapf(err, "write series: %d", postings.At())
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return id, err
 			}
 		}
 	}
 	if postings.Err() != nil {
 		return id, errors.Wrap(postings.Err(), "iterate series set")
 	}
+	if err := flush(); err != nil {
+		return id, err
+	}
 
 	id = uid
 	return
 }
 
+// downsampleBatchSizePerWorker is the number of series each of the concurrent downsamplers gets per batch.
+const downsampleBatchSizePerWorker = 64
+
+// downsampleSeries is a series of the downsampled block with its chunks.
+type downsampleSeries struct {
+	ref  uint64
+	lset labels.Labels
+	chks []chunks.Meta
+	// out are the downsampled chunks.
+	out []chunks.Meta
+}
+
+// seriesDownsampler downsamples series one at a time, reusing its buffers. It is not safe for concurrent use.
+type seriesDownsampler struct {
+	inRes, outRes int64
+
+	aggrChunks []*AggrChunk
+	all        []sample
+	reuseIt    chunkenc.Iterator
+}
+
+func (d *seriesDownsampler) downsample(s *downsampleSeries) (err error) {
+	d.all = d.all[:0]
+	d.aggrChunks = d.aggrChunks[:0]
+
+	// Raw and already downsampled data need different processing.
+	if d.inRes == 0 {
+		for _, c := range s.chks {
+			// TODO(bwplotka): We can optimze this further by using in WriteSeries iterators of each chunk instead of
+			// samples. Also ensure 120 sample limit, otherwise we have gigantic chunks.
+			// https://github.com/thanos-io/thanos/issues/2542.
+			d.reuseIt = c.Chunk.Iterator(d.reuseIt)
+			if err := expandChunkIterator(d.reuseIt, &d.all); err != nil {
+				return errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, s.ref)
+			}
+		}
+		s.out = downsampleRaw(d.all, d.outRes)
+		return nil
+	}
+
+	// Downsample a block that contains aggregated chunks already.
+	for _, c := range s.chks {
+		ac, ok := c.Chunk.(*AggrChunk)
+		if !ok {
+			return errors.Errorf("expected downsampled chunk (*downsample.AggrChunk) got %T instead for series: %d", c.Chunk, s.ref)
+		}
+		d.aggrChunks = append(d.aggrChunks, ac)
+	}
+	s.out, err = downsampleAggr(
+		d.aggrChunks,
+		&d.all,
+		s.chks[0].MinTime,
+		s.chks[len(s.chks)-1].MaxTime,
+		d.inRes,
+		d.outRes,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "downsample aggregate block, series: %d", s.ref)
+	}
+	return nil
+}
+
 // currentWindow returns the end timestamp of the window that t falls into.
 func currentWindow(t, r int64) int64 {
 	// The next timestamp is the next number after s.t that's aligned with window.
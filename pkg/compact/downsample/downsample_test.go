@@ -4,11 +4,13 @@
 package downsample
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -447,7 +449,7 @@ func TestDownsample(t *testing.T) {
 				fakeMeta.Thanos.Downsample.Resolution = tcase.resolution - 1
 			}
 
-			id, err := Downsample(logger, fakeMeta, mb, dir, tcase.resolution)
+			id, err := Downsample(logger, fakeMeta, mb, dir, tcase.resolution, 1)
 			if tcase.expectedDownsamplingErr != nil {
 				testutil.NotOk(t, err)
 				testutil.Equals(t, tcase.expectedDownsamplingErr(ser.chunks).Error(), err.Error())
@@ -505,6 +507,92 @@ func TestDownsample(t *testing.T) {
 	}
 }
 
+func TestDownsample_Concurrency(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "downsample-concurrency")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	for _, tcase := range []struct {
+		name                     string
+		inResolution, resolution int64
+		newSeries                func(i int) *series
+	}{
+		{
+			name:       "raw",
+			resolution: ResLevel1,
+			newSeries: func(i int) *series {
+				var in [][]sample
+				for c := 0; c < 3; c++ {
+					var chk []sample
+					for j := 0; j < 120; j++ {
+						ts := int64(c*120+j) * 15 * 1000
+						chk = append(chk, sample{t: ts, v: float64(i*j%17) + float64(c)})
+					}
+					in = append(in, chk)
+				}
+				return &series{lset: labels.FromStrings("__name__", "a", "i", strconv.Itoa(i)), chunks: chunksToSeriesIteratable(t, in, nil).chunks}
+			},
+		},
+		{
+			name:         "aggregated",
+			inResolution: ResLevel1,
+			resolution:   ResLevel2,
+			newSeries: func(i int) *series {
+				var in []map[AggrType][]sample
+				for c := 0; c < 4; c++ {
+					m := map[AggrType][]sample{}
+					for j := 0; j < 12; j++ {
+						ts := (int64(c*12+j) + 1) * ResLevel1
+						m[AggrCount] = append(m[AggrCount], sample{t: ts, v: 20})
+						m[AggrSum] = append(m[AggrSum], sample{t: ts, v: float64(i + j)})
+						m[AggrMin] = append(m[AggrMin], sample{t: ts, v: float64(j)})
+						m[AggrMax] = append(m[AggrMax], sample{t: ts, v: float64(i + 2*j)})
+						m[AggrCounter] = append(m[AggrCounter], sample{t: ts, v: float64(i + (c*12+j)*10)})
+					}
+					in = append(in, m)
+				}
+				return &series{lset: labels.FromStrings("__name__", "a", "i", strconv.Itoa(i)), chunks: chunksToSeriesIteratable(t, nil, in).chunks}
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// More series than a single batch of all downsamplers.
+			mb := newMemBlock()
+			for i := 0; i < 1000; i++ {
+				mb.addSeries(tcase.newSeries(i))
+			}
+			fakeMeta := &metadata.Meta{}
+			fakeMeta.Thanos.Downsample.Resolution = tcase.inResolution
+
+			var expected *metadata.Meta
+			for _, concurrency := range []int{1, 3, 8} {
+				id, err := Downsample(logger, fakeMeta, mb, dir, tcase.resolution, concurrency)
+				testutil.Ok(t, err)
+
+				meta, err := metadata.Read(filepath.Join(dir, id.String()))
+				testutil.Ok(t, err)
+				testutil.Equals(t, uint64(1000), meta.Stats.NumSeries)
+				if expected == nil {
+					expected = meta
+					continue
+				}
+				testutil.Equals(t, expected.Stats, meta.Stats)
+
+				// The downsampled block has to be the same as the serially downsampled one, byte by byte.
+				for _, f := range []string{block.IndexFilename, filepath.Join(block.ChunksDirname, "000001")} {
+					exp, err := ioutil.ReadFile(filepath.Join(dir, expected.ULID.String(), f))
+					testutil.Ok(t, err)
+					got, err := ioutil.ReadFile(filepath.Join(dir, id.String(), f))
+					testutil.Ok(t, err)
+					testutil.Assert(t, bytes.Equal(exp, got), "%s of block downsampled with concurrency %d differs", f, concurrency)
+				}
+			}
+		})
+	}
+}
+
 func chunksToSeriesIteratable(t *testing.T, inRaw [][]sample, inAggr []map[AggrType][]sample) *series {
 	if len(inRaw) > 0 && len(inAggr) > 0 {
 		t.Fatalf("test must not have raw and aggregate input data at once")
@@ -0,0 +1,183 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// LockDir is the directory in the bucket holding compactor lock objects.
+const LockDir = "compactor-locks"
+
+var (
+	// ErrLockHeld is returned when the lock is held by another, still active, holder.
+	ErrLockHeld = errors.New("compactor lock is held by another compactor")
+	// ErrLockLost is returned when the lock was taken over by another holder or could not be renewed before it expired.
+	ErrLockLost = errors.New("compactor lock lost")
+)
+
+// lockMeta is the content of the lock object.
+type lockMeta struct {
+	Holder string `json:"holder"`
+	// Expires is the unix time in milliseconds after which the lock can be taken over by another holder.
+	Expires int64 `json:"expires"`
+}
+
+// Lock is a lease based lock stored as an object in the bucket. It prevents multiple compactors from operating
+// on the same bucket at the same time.
+//
+// The holder has to renew the lock before its lease expires. Lock of a crashed holder can be acquired by another
+// holder once the lease expires. Object storages do not provide compare-and-swap, so the lock object is read back after
+// each write to detect holders racing for it.
+type Lock struct {
+	logger log.Logger
+	bkt    objstore.Bucket
+	name   string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mtx     sync.Mutex
+	expires time.Time
+}
+
+// NewLock returns a Lock with the given name, acquired for the given holder for ttl at a time.
+func NewLock(logger log.Logger, bkt objstore.Bucket, name, holder string, ttl time.Duration) *Lock {
+	return &Lock{
+		logger: logger,
+		bkt:    bkt,
+		name:   path.Join(LockDir, name+".json"),
+		holder: holder,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// Acquire acquires the lock. It returns ErrLockHeld if the lock is held by another holder whose lease did not expire yet.
+func (l *Lock) Acquire(ctx context.Context) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	m, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if m != nil && m.Holder != l.holder {
+		if expires := timestamp.Time(m.Expires); l.now().Before(expires) {
+			return errors.Wrapf(ErrLockHeld, "holder %s, expires at %s", m.Holder, expires.UTC().Format(time.RFC3339))
+		}
+		level.Warn(l.logger).Log("msg", "taking over expired compactor lock", "lock", l.name, "previousHolder", m.Holder)
+	}
+
+	if err := l.write(ctx); err != nil {
+		if errors.Cause(err) == ErrLockLost {
+			return errors.Wrap(ErrLockHeld, "lock taken by concurrent holder")
+		}
+		return err
+	}
+	level.Info(l.logger).Log("msg", "acquired compactor lock", "lock", l.name, "holder", l.holder, "expires", l.expires)
+	return nil
+}
+
+// Renew extends the lease of the lock. It returns ErrLockLost if the lock is now held by another holder, or if the
+// lease expired before it could be renewed, as in such case another holder could have operated on the bucket meanwhile.
+func (l *Lock) Renew(ctx context.Context) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.expires.IsZero() {
+		return errors.New("compactor lock was not acquired")
+	}
+	if !l.now().Before(l.expires) {
+		return errors.Wrap(ErrLockLost, "lease expired before renewal")
+	}
+
+	m, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.Holder != l.holder {
+		return errors.Wrap(ErrLockLost, "lock object was removed or taken over")
+	}
+	return l.write(ctx)
+}
+
+// Release deletes the lock object, if it is still held by this holder.
+func (l *Lock) Release(ctx context.Context) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.expires = time.Time{}
+
+	m, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.Holder != l.holder {
+		return nil
+	}
+	if err := l.bkt.Delete(ctx, l.name); err != nil {
+		return errors.Wrapf(err, "delete lock %s", l.name)
+	}
+	level.Info(l.logger).Log("msg", "released compactor lock", "lock", l.name, "holder", l.holder)
+	return nil
+}
+
+// read returns the content of the lock object, or nil if it does not exist.
+func (l *Lock) read(ctx context.Context) (*lockMeta, error) {
+	r, err := l.bkt.Get(ctx, l.name)
+	if err != nil {
+		if l.bkt.IsObjNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "get lock %s", l.name)
+	}
+	defer runutil.CloseWithLogOnErr(l.logger, r, "close lock reader")
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read lock %s", l.name)
+	}
+	m := &lockMeta{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal lock %s", l.name)
+	}
+	return m, nil
+}
+
+// write writes the lock object with a new lease and verifies it was not overwritten by another holder.
+func (l *Lock) write(ctx context.Context) error {
+	expires := l.now().Add(l.ttl)
+	b, err := json.Marshal(lockMeta{Holder: l.holder, Expires: timestamp.FromTime(expires)})
+	if err != nil {
+		return errors.Wrap(err, "marshal lock")
+	}
+	if err := l.bkt.Upload(ctx, l.name, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload lock %s", l.name)
+	}
+
+	m, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.Holder != l.holder {
+		return errors.Wrap(ErrLockLost, "lock overwritten by concurrent holder")
+	}
+	l.expires = expires
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestLock_MutualExclusion(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	now := time.Unix(1000, 0)
+	newLock := func(holder string) *Lock {
+		l := NewLock(log.NewNopLogger(), bkt, "test", holder, time.Minute)
+		l.now = func() time.Time { return now }
+		return l
+	}
+	a, b := newLock("a"), newLock("b")
+
+	testutil.Ok(t, a.Acquire(ctx))
+	testutil.Equals(t, ErrLockHeld, errors.Cause(b.Acquire(ctx)))
+
+	// Holder renews its lease, so the lock is still held after the original lease would expire.
+	now = now.Add(50 * time.Second)
+	testutil.Ok(t, a.Renew(ctx))
+	now = now.Add(50 * time.Second)
+	testutil.Equals(t, ErrLockHeld, errors.Cause(b.Acquire(ctx)))
+
+	// Release by a non-holder does not remove the lock.
+	testutil.Ok(t, b.Release(ctx))
+	testutil.Equals(t, ErrLockHeld, errors.Cause(b.Acquire(ctx)))
+
+	// Released lock can be acquired by another holder.
+	testutil.Ok(t, a.Release(ctx))
+	testutil.Ok(t, b.Acquire(ctx))
+	testutil.Equals(t, ErrLockHeld, errors.Cause(a.Acquire(ctx)))
+	testutil.NotOk(t, a.Renew(ctx))
+}
+
+func TestLock_Expiry(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	now := time.Unix(1000, 0)
+	newLock := func(holder string) *Lock {
+		l := NewLock(log.NewNopLogger(), bkt, "test", holder, time.Minute)
+		l.now = func() time.Time { return now }
+		return l
+	}
+	crashed, b := newLock("crashed"), newLock("b")
+
+	testutil.Ok(t, crashed.Acquire(ctx))
+
+	// Lock of a crashed holder is taken over once its lease expires.
+	now = now.Add(59 * time.Second)
+	testutil.Equals(t, ErrLockHeld, errors.Cause(b.Acquire(ctx)))
+	now = now.Add(time.Second)
+	testutil.Ok(t, b.Acquire(ctx))
+
+	// Previous holder coming back finds its lease expired and the lock lost.
+	testutil.Equals(t, ErrLockLost, errors.Cause(crashed.Renew(ctx)))
+
+	// Lease expired before renewal is lost even if no other holder took the lock.
+	now = now.Add(2 * time.Minute)
+	testutil.Equals(t, ErrLockLost, errors.Cause(b.Renew(ctx)))
+	testutil.Ok(t, b.Acquire(ctx))
+
+	// Locks with different names do not exclude each other.
+	other := NewLock(log.NewNopLogger(), bkt, "other", "c", time.Minute)
+	other.now = func() time.Time { return now }
+	testutil.Ok(t, other.Acquire(ctx))
+}
@@ -20,6 +20,16 @@ import (
 
 // StoreClientGRPCOpts creates gRPC dial options for connecting to a store client.
 func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, secure bool, cert, key, caCert, serverName string) ([]grpc.DialOption, error) {
+	transportOpt, err := ClientTransportGRPCOpt(logger, secure, cert, key, caCert, serverName)
+	if err != nil {
+		return nil, err
+	}
+	return append(StoreClientBaseGRPCOpts(reg, tracer), transportOpt), nil
+}
+
+// StoreClientBaseGRPCOpts creates gRPC dial options for connecting to a store client without the transport option, so
+// that they can be shared by clients with different transport security.
+func StoreClientBaseGRPCOpts(reg *prometheus.Registry, tracer opentracing.Tracer) []grpc.DialOption {
 	grpcMets := grpc_prometheus.NewClientMetrics()
 	grpcMets.EnableClientHandlingTimeHistogram(
 		grpc_prometheus.WithHistogramBuckets([]float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120}),
@@ -46,9 +56,13 @@ func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer ope
 	if reg != nil {
 		reg.MustRegister(grpcMets)
 	}
+	return dialOpts
+}
 
+// ClientTransportGRPCOpt creates the gRPC dial option of the transport security for connecting to a store client.
+func ClientTransportGRPCOpt(logger log.Logger, secure bool, cert, key, caCert, serverName string) (grpc.DialOption, error) {
 	if !secure {
-		return append(dialOpts, grpc.WithInsecure()), nil
+		return grpc.WithInsecure(), nil
 	}
 
 	level.Info(logger).Log("msg", "enabling client to server TLS")
@@ -57,5 +71,5 @@ func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer ope
 	if err != nil {
 		return nil, err
 	}
-	return append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))), nil
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)), nil
 }
@@ -0,0 +1,118 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// CompressorsHeader is the gRPC header used by servers to advertise compressors they support.
+	CompressorsHeader = "thanos-grpc-compressors"
+
+	// NoCompression is the name used when no compressor is negotiated.
+	NoCompression = "none"
+
+	Gzip   = gzip.Name
+	Snappy = "snappy"
+)
+
+// knownCompressors lists compressors in the order they are advertised. Only registered ones are supported.
+var knownCompressors = []string{Snappy, Gzip}
+
+func init() {
+	encoding.RegisterCompressor(snappyCompressor{})
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return Snappy }
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// RegisteredCompressors returns names of known compressors registered in this binary.
+func RegisteredCompressors() []string {
+	var names []string
+	for _, name := range knownCompressors {
+		if encoding.GetCompressor(name) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateCompressors returns error if any of given compressors is not registered.
+func ValidateCompressors(names []string) error {
+	for _, name := range names {
+		if encoding.GetCompressor(name) == nil {
+			return errors.Errorf("gRPC compressor %q is not supported, supported compressors: %s", name, strings.Join(RegisteredCompressors(), ", "))
+		}
+	}
+	return nil
+}
+
+// NegotiateCompressor returns the first compressor from preference list that is supported by the peer.
+// NoCompression is returned if none of them is.
+func NegotiateCompressor(preference []string, peerSupported []string) string {
+	for _, name := range preference {
+		for _, supported := range peerSupported {
+			if name == supported {
+				return name
+			}
+		}
+	}
+	return NoCompression
+}
+
+// CompressorsFromHeader returns compressors advertised by the server in the given header metadata.
+func CompressorsFromHeader(md metadata.MD) []string {
+	var names []string
+	for _, v := range md.Get(CompressorsHeader) {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func compressorsHeader() metadata.MD {
+	return metadata.Pairs(CompressorsHeader, strings.Join(RegisteredCompressors(), ","))
+}
+
+// CompressorsUnaryServerInterceptor advertises compressors registered in this binary on every unary call.
+func CompressorsUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := grpc.SetHeader(ctx, compressorsHeader()); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// CompressorsStreamServerInterceptor advertises compressors registered in this binary on every stream.
+func CompressorsStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := ss.SetHeader(compressorsHeader()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package gate
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrOverloaded is returned by admission gates rejecting requests because of the current load.
+var ErrOverloaded = errors.New("overloaded")
+
+const (
+	// heapStatsInterval is the minimum interval between reads of heap stats, as these stop the world.
+	heapStatsInterval = 100 * time.Millisecond
+	// admissionRetryInterval is the interval in which queued requests check whether load has dropped.
+	admissionRetryInterval = 50 * time.Millisecond
+)
+
+// AdmissionConfig configures thresholds of the admission gate. Zero values disable the respective threshold.
+type AdmissionConfig struct {
+	// MaxInFlight is the maximum number of admitted requests, including those waiting in the wrapped gate.
+	MaxInFlight int
+	// MaxHeapBytes is the maximum heap size, above which no new requests are admitted.
+	MaxHeapBytes uint64
+	// Queue makes requests wait until load drops below thresholds or their context is done, instead of rejecting
+	// them with ErrOverloaded.
+	Queue bool
+}
+
+type admissionGate struct {
+	g   Gate
+	cfg AdmissionConfig
+
+	// heapBytes returns the current heap size. Replaced in tests.
+	heapBytes func() uint64
+
+	mtx           sync.Mutex
+	inFlight      int
+	heap          uint64
+	heapUpdatedAt time.Time
+
+	rejected *prometheus.CounterVec
+}
+
+// NewAdmissionGate returns a gate shedding load before the given gate once the number of in-flight requests or the
+// heap size exceed configured thresholds. It is meant as a backstop protecting the process from running out of memory,
+// beyond limits of individual requests.
+func NewAdmissionGate(reg prometheus.Registerer, g Gate, cfg AdmissionConfig) Gate {
+	a := &admissionGate{
+		g:         g,
+		cfg:       cfg,
+		heapBytes: readHeapBytes,
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "rejected_total",
+			Help: "Total number of requests rejected or queued by the admission gate, by the exceeded threshold.",
+		}, []string{"reason"}),
+	}
+	a.rejected.WithLabelValues("in_flight")
+	a.rejected.WithLabelValues("memory")
+	return a
+}
+
+func readHeapBytes() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// admit reserves a slot for a request if thresholds allow it. Otherwise it returns the reason of refusal.
+func (a *admissionGate) admit() (reason string, err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cfg.MaxInFlight > 0 && a.inFlight >= a.cfg.MaxInFlight {
+		return "in_flight", errors.Wrapf(ErrOverloaded, "%d requests in flight reached the limit of %d", a.inFlight, a.cfg.MaxInFlight)
+	}
+	if a.cfg.MaxHeapBytes > 0 {
+		if now := time.Now(); now.Sub(a.heapUpdatedAt) >= heapStatsInterval {
+			a.heap = a.heapBytes()
+			a.heapUpdatedAt = now
+		}
+		if a.heap > a.cfg.MaxHeapBytes {
+			return "memory", errors.Wrapf(ErrOverloaded, "heap size of %d bytes exceeds the limit of %d bytes", a.heap, a.cfg.MaxHeapBytes)
+		}
+	}
+	a.inFlight++
+	return "", nil
+}
+
+// Start implements the Gate interface.
+func (a *admissionGate) Start(ctx context.Context) error {
+	reason, err := a.admit()
+	if err != nil {
+		a.rejected.WithLabelValues(reason).Inc()
+		if !a.cfg.Queue {
+			return err
+		}
+
+		t := time.NewTicker(admissionRetryInterval)
+		defer t.Stop()
+		for err != nil {
+			select {
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "waiting for admission: %s", err)
+			case <-t.C:
+			}
+			_, err = a.admit()
+		}
+	}
+
+	if err := a.g.Start(ctx); err != nil {
+		a.release()
+		return err
+	}
+	return nil
+}
+
+// Done implements the Gate interface.
+func (a *admissionGate) Done() {
+	a.g.Done()
+	a.release()
+}
+
+func (a *admissionGate) release() {
+	a.mtx.Lock()
+	a.inFlight--
+	a.mtx.Unlock()
+}
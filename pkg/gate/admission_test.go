@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package gate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAdmissionGate_MaxInFlight(t *testing.T) {
+	ctx := context.Background()
+	g := NewAdmissionGate(prometheus.NewRegistry(), New(nil, 10), AdmissionConfig{MaxInFlight: 2}).(*admissionGate)
+
+	testutil.Ok(t, g.Start(ctx))
+	testutil.Ok(t, g.Start(ctx))
+
+	err := g.Start(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, ErrOverloaded), "expected overloaded error, got %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.rejected.WithLabelValues("in_flight")))
+
+	// Finished requests free their slot.
+	g.Done()
+	testutil.Ok(t, g.Start(ctx))
+	g.Done()
+	g.Done()
+	testutil.Equals(t, 0, g.inFlight)
+}
+
+func TestAdmissionGate_MaxHeapBytes(t *testing.T) {
+	ctx := context.Background()
+	g := NewAdmissionGate(prometheus.NewRegistry(), New(nil, 10), AdmissionConfig{MaxHeapBytes: 1000}).(*admissionGate)
+
+	heap := uint64(2000)
+	g.heapBytes = func() uint64 { return heap }
+
+	err := g.Start(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, ErrOverloaded), "expected overloaded error, got %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.rejected.WithLabelValues("memory")))
+	testutil.Equals(t, 0, g.inFlight)
+
+	// Heap size is read again once the cached value is stale.
+	heap = 500
+	g.heapUpdatedAt = time.Time{}
+	testutil.Ok(t, g.Start(ctx))
+	g.Done()
+}
+
+func TestAdmissionGate_Queue(t *testing.T) {
+	g := NewAdmissionGate(prometheus.NewRegistry(), New(nil, 10), AdmissionConfig{MaxInFlight: 1, Queue: true}).(*admissionGate)
+	testutil.Ok(t, g.Start(context.Background()))
+
+	// Queued request times out if load does not drop.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*admissionRetryInterval)
+	defer cancel()
+	err := g.Start(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+
+	// Queued request is admitted once load drops.
+	admitted := make(chan error)
+	go func() { admitted <- g.Start(context.Background()) }()
+
+	select {
+	case err := <-admitted:
+		t.Fatalf("request admitted while overloaded: %v", err)
+	case <-time.After(2 * admissionRetryInterval):
+	}
+	g.Done()
+	testutil.Ok(t, <-admitted)
+	g.Done()
+
+	testutil.Equals(t, 2.0, promtest.ToFloat64(g.rejected.WithLabelValues("in_flight")))
+	testutil.Equals(t, 0, g.inFlight)
+}
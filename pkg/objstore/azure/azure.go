@@ -31,6 +31,8 @@ type Config struct {
 	ContainerName      string `yaml:"container"`
 	Endpoint           string `yaml:"endpoint"`
 	MaxRetries         int    `yaml:"max_retries"`
+	// ListPageSize is the maximum number of blobs returned by a single list request. 0 means the default of 5000.
+	ListPageSize int32 `yaml:"list_page_size"`
 }
 
 // Bucket implements the store.Bucket interface against Azure APIs.
@@ -61,6 +63,9 @@ func (conf *Config) validate() error {
 	if conf.MaxRetries < 0 {
 		return errors.New("the value of maxretries must be greater than or equal to 0 in the config file")
 	}
+	if conf.ListPageSize < 0 {
+		return errors.New("the value of list_page_size must be greater than or equal to 0 in the config file")
+	}
 	return nil
 }
 
@@ -118,7 +123,8 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 
 	for i := 1; ; i++ {
 		list, err := b.containerURL.ListBlobsHierarchySegment(ctx, marker, DirDelim, blob.ListBlobsSegmentOptions{
-			Prefix: prefix,
+			Prefix:     prefix,
+			MaxResults: b.config.ListPageSize,
 		})
 
 		if err != nil {
@@ -247,6 +253,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         props.ContentLength(),
 		LastModified: props.LastModified(),
+		ETag:         string(props.ETag()),
 	}, nil
 }
 
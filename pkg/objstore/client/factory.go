@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -38,6 +39,8 @@ const (
 type BucketConfig struct {
 	Type   ObjProvider `yaml:"type"`
 	Config interface{} `yaml:"config"`
+	// Hedging of reads, applied to all providers.
+	Hedging objstore.HedgingConfig `yaml:"hedging,omitempty"`
 }
 
 // NewBucket initializes and returns new object storage clients.
@@ -76,5 +79,8 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("create %s client", bucketConf.Type))
 	}
+	if bucketConf.Hedging.Delay > 0 {
+		bucket = objstore.NewHedgingBucket(bucket, time.Duration(bucketConf.Hedging.Delay), reg)
+	}
 	return objstore.NewTracingBucket(objstore.BucketWithMetrics(bucket.Name(), bucket, reg)), nil
 }
@@ -27,9 +27,10 @@ const dirDelim = "/"
 
 // Bucket implements the store.Bucket interface against cos-compatible(Tencent Object Storage) APIs.
 type Bucket struct {
-	logger log.Logger
-	client *cos.Client
-	name   string
+	logger       log.Logger
+	client       *cos.Client
+	name         string
+	listPageSize int
 }
 
 // Config encapsulates the necessary config values to instantiate an cos client.
@@ -39,6 +40,8 @@ type Config struct {
 	AppId     string `yaml:"app_id"`
 	SecretKey string `yaml:"secret_key"`
 	SecretId  string `yaml:"secret_id"`
+	// ListPageSize is the maximum number of objects returned by a single list request. 0 means the default of 1000.
+	ListPageSize int `yaml:"list_page_size"`
 }
 
 // Validate checks to see if mandatory cos config options are set.
@@ -50,6 +53,9 @@ func (conf *Config) validate() error {
 		conf.SecretKey == "" {
 		return errors.New("insufficient cos configuration information")
 	}
+	if conf.ListPageSize < 0 {
+		return errors.New("list_page_size must not be negative")
+	}
 	return nil
 }
 
@@ -82,9 +88,10 @@ func NewBucket(logger log.Logger, conf []byte, component string) (*Bucket, error
 	})
 
 	bkt := &Bucket{
-		logger: logger,
-		client: client,
-		name:   config.Bucket,
+		logger:       logger,
+		client:       client,
+		name:         config.Bucket,
+		listPageSize: config.ListPageSize,
 	}
 	return bkt, nil
 }
@@ -116,6 +123,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         size,
 		LastModified: mod,
+		ETag:         resp.Header.Get("ETag"),
 	}, nil
 }
 
@@ -229,11 +237,15 @@ func (b *Bucket) listObjects(ctx context.Context, objectPrefix string) <-chan ob
 
 	go func(objectsCh chan<- objectInfo) {
 		defer close(objectsCh)
+		maxKeys := 1000
+		if b.listPageSize > 0 {
+			maxKeys = b.listPageSize
+		}
 		var marker string
 		for {
 			result, _, err := b.client.Bucket.Get(ctx, &cos.BucketGetOptions{
 				Prefix:    objectPrefix,
-				MaxKeys:   1000,
+				MaxKeys:   maxKeys,
 				Marker:    marker,
 				Delimiter: dirDelim,
 			})
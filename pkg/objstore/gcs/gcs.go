@@ -30,6 +30,12 @@ const DirDelim = "/"
 type Config struct {
 	Bucket         string `yaml:"bucket"`
 	ServiceAccount string `yaml:"service_account"`
+	// RequesterPays marks requests as accepting the charges of a bucket with requester pays enabled. Charges are billed
+	// to UserProject or, if not set, to the project of the service account.
+	RequesterPays bool   `yaml:"requester_pays"`
+	UserProject   string `yaml:"user_project"`
+	// ListPageSize is the maximum number of objects returned by a single list request. 0 means the default of 1000.
+	ListPageSize int `yaml:"list_page_size"`
 }
 
 // Bucket implements the store.Bucket and shipper.Bucket interfaces against GCS.
@@ -38,7 +44,8 @@ type Bucket struct {
 	bkt    *storage.BucketHandle
 	name   string
 
-	closer io.Closer
+	closer       io.Closer
+	listPageSize int
 }
 
 // NewBucket returns a new Bucket against the given bucket handle.
@@ -60,21 +67,39 @@ func NewBucket(ctx context.Context, logger log.Logger, conf []byte, component st
 			return nil, errors.Wrap(err, "failed to create credentials from JSON")
 		}
 		opts = append(opts, option.WithCredentials(credentials))
+
+		if gc.RequesterPays && gc.UserProject == "" {
+			gc.UserProject = credentials.ProjectID
+		}
+	}
+	if gc.RequesterPays && gc.UserProject == "" {
+		return nil, errors.New("user_project must be set for requester pays if the project cannot be taken from the service account")
+	}
+	if gc.ListPageSize < 0 {
+		return nil, errors.New("list_page_size must not be negative")
 	}
 
 	opts = append(opts,
 		option.WithUserAgent(fmt.Sprintf("thanos-%s/%s (%s)", component, version.Version, runtime.Version())),
 	)
+	return newBucket(ctx, logger, gc, opts)
+}
 
+func newBucket(ctx context.Context, logger log.Logger, gc Config, opts []option.ClientOption) (*Bucket, error) {
 	gcsClient, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 	bkt := &Bucket{
-		logger: logger,
-		bkt:    gcsClient.Bucket(gc.Bucket),
-		closer: gcsClient,
-		name:   gc.Bucket,
+		logger:       logger,
+		bkt:          gcsClient.Bucket(gc.Bucket),
+		closer:       gcsClient,
+		name:         gc.Bucket,
+		listPageSize: gc.ListPageSize,
+	}
+	if gc.RequesterPays {
+		// Sets the billed project on all requests, e.g. as userProject parameter or X-Goog-User-Project header.
+		bkt.bkt = bkt.bkt.UserProject(gc.UserProject)
 	}
 	return bkt, nil
 }
@@ -96,6 +121,8 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		Prefix:    dir,
 		Delimiter: DirDelim,
 	})
+	// Following pages are requested with the token of the previous one by the iterator.
+	it.PageInfo().MaxSize = b.listPageSize
 	for {
 		select {
 		case <-ctx.Done():
@@ -135,6 +162,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         attrs.Size,
 		LastModified: attrs.Updated,
+		ETag:         attrs.Etag,
 	}, nil
 }
 
@@ -0,0 +1,170 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/api/option"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestNewBucket_RequesterPaysWithoutProject(t *testing.T) {
+	_, err := NewBucket(context.Background(), log.NewNopLogger(), []byte(`bucket: test
+requester_pays: true`), "test")
+	testutil.NotOk(t, err)
+}
+
+func TestBucket_RequesterPays(t *testing.T) {
+	for _, requesterPays := range []bool{false, true} {
+		var (
+			mtx  sync.Mutex
+			reqs []*http.Request
+		)
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			reqs = append(reqs, r)
+			mtx.Unlock()
+
+			switch {
+			case r.URL.Path == "/storage/v1/b/test/o":
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"kind": "storage#objects", "items": [{"kind": "storage#object", "name": "obj", "bucket": "test", "size": "4"}]}`))
+			case r.URL.Path == "/storage/v1/b/test/o/obj":
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"kind": "storage#object", "name": "obj", "bucket": "test", "size": "4"}`))
+			case strings.HasPrefix(r.URL.Path, "/test/obj"):
+				http.ServeContent(w, r, "obj", time.Time{}, strings.NewReader("data"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		ctx := context.Background()
+		bkt, err := newBucket(ctx, log.NewNopLogger(), Config{Bucket: "test", RequesterPays: requesterPays, UserProject: "billed"}, []option.ClientOption{
+			option.WithEndpoint(srv.URL + "/storage/v1/"),
+			option.WithHTTPClient(srv.Client()),
+		})
+		testutil.Ok(t, err)
+
+		r, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.Close())
+		testutil.Equals(t, "data", string(b))
+
+		r, err = bkt.GetRange(ctx, "obj", 1, 2)
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.Close())
+
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		testutil.Equals(t, []string{"obj"}, names)
+
+		_, err = bkt.Attributes(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Close())
+		srv.Close()
+
+		testutil.Equals(t, 4, len(reqs))
+		for _, r := range reqs {
+			// Object data is read through the XML API, which takes the billed project as header.
+			project := r.URL.Query().Get("userProject")
+			if strings.HasPrefix(r.URL.Path, "/test/") {
+				project = r.Header.Get("X-Goog-User-Project")
+			}
+			if !requesterPays {
+				testutil.Equals(t, "", project, "%s %s", r.Method, r.URL)
+				continue
+			}
+			testutil.Equals(t, "billed", project, "%s %s", r.Method, r.URL)
+		}
+	}
+}
+
+func TestBucket_IterPages(t *testing.T) {
+	var names []string
+	for i := 0; i < 7; i++ {
+		names = append(names, fmt.Sprintf("dir/obj-%d", i))
+	}
+
+	var (
+		mtx        sync.Mutex
+		maxResults []string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/test/o" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		mtx.Lock()
+		maxResults = append(maxResults, q.Get("maxResults"))
+		mtx.Unlock()
+
+		// Page token is the index of the first object of the page.
+		start := 0
+		if token := q.Get("pageToken"); token != "" {
+			var err error
+			if start, err = strconv.Atoi(token); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		size, err := strconv.Atoi(q.Get("maxResults"))
+		if err != nil || size <= 0 || size > 1000 {
+			size = 1000
+		}
+		end := start + size
+		if end > len(names) {
+			end = len(names)
+		}
+
+		var items []string
+		for _, n := range names[start:end] {
+			items = append(items, fmt.Sprintf(`{"kind": "storage#object", "name": %q, "bucket": "test", "size": "4"}`, n))
+		}
+		next := ""
+		if end < len(names) {
+			next = fmt.Sprintf(`, "nextPageToken": "%d"`, end)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"kind": "storage#objects", "items": [%s]%s}`, strings.Join(items, ", "), next)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	bkt, err := newBucket(ctx, log.NewNopLogger(), Config{Bucket: "test", ListPageSize: 3}, []option.ClientOption{
+		option.WithEndpoint(srv.URL + "/storage/v1/"),
+		option.WithHTTPClient(srv.Client()),
+	})
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	var got []string
+	testutil.Ok(t, bkt.Iter(ctx, "dir", func(name string) error {
+		got = append(got, name)
+		return nil
+	}))
+	testutil.Equals(t, names, got)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	testutil.Equals(t, []string{"3", "3", "3"}, maxResults)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+// HedgingConfig configures hedging of reads from object storage.
+type HedgingConfig struct {
+	// Delay after which a Get or GetRange request that has not responded yet is sent again. 0 disables hedging.
+	Delay model.Duration `yaml:"delay"`
+}
+
+// hedgingBucket sends Get and GetRange requests not responded within the delay once more and uses the response of the
+// request succeeding first, which cuts the tail latency caused by slow individual requests.
+type hedgingBucket struct {
+	Bucket
+
+	delay time.Duration
+
+	hedged *prometheus.CounterVec
+	wins   *prometheus.CounterVec
+}
+
+// NewHedgingBucket returns the bucket hedging Get and GetRange requests of the given bucket after the given delay. The
+// request not used is canceled and its reader, if returned at all, closed.
+func NewHedgingBucket(b Bucket, delay time.Duration, reg prometheus.Registerer) Bucket {
+	hb := &hedgingBucket{
+		Bucket: b,
+		delay:  delay,
+		hedged: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_hedged_operations_total",
+			Help:        "Total number of operations against a bucket sent again as they did not respond within the hedging delay.",
+			ConstLabels: prometheus.Labels{"bucket": b.Name()},
+		}, []string{"operation"}),
+		wins: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_hedged_operation_wins_total",
+			Help:        "Total number of hedged operations against a bucket whose second request succeeded first.",
+			ConstLabels: prometheus.Labels{"bucket": b.Name()},
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpGet, OpGetRange} {
+		hb.hedged.WithLabelValues(op)
+		hb.wins.WithLabelValues(op)
+	}
+	return hb
+}
+
+func (b *hedgingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.hedge(ctx, OpGet, func(ctx context.Context) (io.ReadCloser, error) {
+		return b.Bucket.Get(ctx, name)
+	})
+}
+
+func (b *hedgingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.hedge(ctx, OpGetRange, func(ctx context.Context) (io.ReadCloser, error) {
+		return b.Bucket.GetRange(ctx, name, off, length)
+	})
+}
+
+type hedgedResponse struct {
+	rc  io.ReadCloser
+	err error
+	// req is the index of the request, 1 for the hedged one.
+	req int
+}
+
+func (b *hedgingBucket) hedge(ctx context.Context, op string, get func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	var (
+		resps   = make(chan hedgedResponse, 2)
+		cancels []context.CancelFunc
+		pending int
+	)
+	send := func() {
+		reqCtx, cancel := context.WithCancel(ctx)
+		req := len(cancels)
+		cancels = append(cancels, cancel)
+		pending++
+		go func() {
+			rc, err := get(reqCtx)
+			resps <- hedgedResponse{rc: rc, err: err, req: req}
+		}()
+	}
+	// cleanup cancels all requests but the used one and closes readers of pending ones once they return.
+	cleanup := func(used int) {
+		for i, cancel := range cancels {
+			if i != used {
+				cancel()
+			}
+		}
+		go func(pending int) {
+			for i := 0; i < pending; i++ {
+				if r := <-resps; r.rc != nil {
+					_ = r.rc.Close()
+				}
+			}
+		}(pending)
+	}
+
+	send()
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			b.hedged.WithLabelValues(op).Inc()
+			send()
+		case r := <-resps:
+			pending--
+			if r.err != nil {
+				cancels[r.req]()
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				// Failed requests are not retried: the error is returned once no other request is pending.
+				if pending == 0 {
+					return nil, firstErr
+				}
+				continue
+			}
+			if r.req > 0 {
+				b.wins.WithLabelValues(op).Inc()
+			}
+			cleanup(r.req)
+			// The context of the used request is canceled once its reader is closed.
+			return &cancelingReadCloser{ReadCloser: r.rc, cancel: cancels[r.req]}, nil
+		case <-ctx.Done():
+			cleanup(-1)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// cancelingReadCloser cancels the context of the request it reads the response of once closed.
+type cancelingReadCloser struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+func (rc *cancelingReadCloser) Close() error {
+	defer rc.cancel()
+	return rc.ReadCloser.Close()
+}
@@ -0,0 +1,176 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// slowRequest is the delay of a fake request and whether it ignores cancellation.
+type slowRequest struct {
+	delay        time.Duration
+	ignoreCancel bool
+}
+
+// slowBucket delays consecutive Get and GetRange requests of the in-memory bucket as configured. It reports canceled
+// requests and closed readers on its channels.
+type slowBucket struct {
+	Bucket
+
+	mtx  sync.Mutex
+	reqs []slowRequest
+
+	canceled chan struct{}
+	closed   chan struct{}
+}
+
+func newSlowBucket(bkt Bucket, reqs ...slowRequest) *slowBucket {
+	return &slowBucket{Bucket: bkt, reqs: reqs, canceled: make(chan struct{}, len(reqs)), closed: make(chan struct{}, len(reqs))}
+}
+
+func (b *slowBucket) wait(ctx context.Context) error {
+	b.mtx.Lock()
+	req := b.reqs[0]
+	b.reqs = b.reqs[1:]
+	b.mtx.Unlock()
+
+	if req.ignoreCancel {
+		time.Sleep(req.delay)
+		return nil
+	}
+	select {
+	case <-time.After(req.delay):
+		return nil
+	case <-ctx.Done():
+		b.canceled <- struct{}{}
+		return ctx.Err()
+	}
+}
+
+func (b *slowBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyingReadCloser{ReadCloser: rc, closed: b.closed}, nil
+}
+
+func (b *slowBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyingReadCloser{ReadCloser: rc, closed: b.closed}, nil
+}
+
+type closeNotifyingReadCloser struct {
+	io.ReadCloser
+
+	closed chan struct{}
+}
+
+func (rc *closeNotifyingReadCloser) Close() error {
+	rc.closed <- struct{}{}
+	return rc.ReadCloser.Close()
+}
+
+func waitForSignal(t *testing.T, c <-chan struct{}, what string) {
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestHedgingBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("hello world")))
+
+	read := func(t *testing.T, rc io.ReadCloser) string {
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		return string(b)
+	}
+
+	t.Run("fast request is not hedged", func(t *testing.T) {
+		bkt := NewHedgingBucket(newSlowBucket(inmem, slowRequest{}), time.Hour, nil).(*hedgingBucket)
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "hello world", read(t, rc))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.hedged.WithLabelValues(OpGet)))
+	})
+	t.Run("slow request is hedged and canceled", func(t *testing.T) {
+		slow := newSlowBucket(inmem, slowRequest{delay: time.Hour}, slowRequest{})
+		bkt := NewHedgingBucket(slow, 10*time.Millisecond, nil).(*hedgingBucket)
+
+		rc, err := bkt.GetRange(ctx, "obj", 6, 5)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "world", read(t, rc))
+		waitForSignal(t, slow.canceled, "slow request to be canceled")
+		testutil.Equals(t, 1.0, promtest.ToFloat64(bkt.hedged.WithLabelValues(OpGetRange)))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(bkt.wins.WithLabelValues(OpGetRange)))
+	})
+	t.Run("reader of request returned after hedged one is closed", func(t *testing.T) {
+		slow := newSlowBucket(inmem, slowRequest{delay: 100 * time.Millisecond, ignoreCancel: true}, slowRequest{})
+		bkt := NewHedgingBucket(slow, 10*time.Millisecond, nil).(*hedgingBucket)
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "hello world", read(t, rc))
+		// Closed by the caller above.
+		waitForSignal(t, slow.closed, "used reader to be closed")
+		waitForSignal(t, slow.closed, "unused reader to be closed")
+	})
+	t.Run("original request succeeding first is used", func(t *testing.T) {
+		slow := newSlowBucket(inmem, slowRequest{delay: 50 * time.Millisecond}, slowRequest{delay: time.Hour})
+		bkt := NewHedgingBucket(slow, 10*time.Millisecond, nil).(*hedgingBucket)
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "hello world", read(t, rc))
+		waitForSignal(t, slow.canceled, "hedged request to be canceled")
+		testutil.Equals(t, 1.0, promtest.ToFloat64(bkt.hedged.WithLabelValues(OpGet)))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.wins.WithLabelValues(OpGet)))
+	})
+	t.Run("failed request is not retried", func(t *testing.T) {
+		bkt := NewHedgingBucket(newSlowBucket(inmem, slowRequest{}), time.Hour, nil).(*hedgingBucket)
+
+		_, err := bkt.Get(ctx, "missing")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.hedged.WithLabelValues(OpGet)))
+	})
+	t.Run("canceled context", func(t *testing.T) {
+		slow := newSlowBucket(inmem, slowRequest{delay: time.Hour}, slowRequest{delay: time.Hour})
+		bkt := NewHedgingBucket(slow, 10*time.Millisecond, nil)
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := bkt.Get(ctx, "obj")
+		testutil.Equals(t, context.DeadlineExceeded, err)
+		waitForSignal(t, slow.canceled, "request to be canceled")
+		waitForSignal(t, slow.canceled, "hedged request to be canceled")
+	})
+
+	AcceptanceTest(t, NewHedgingBucket(NewInMemBucket(), time.Millisecond, nil))
+}
@@ -6,6 +6,8 @@ package objstore
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sort"
@@ -172,6 +174,7 @@ func (b *InMemBucket) Upload(_ context.Context, name string, r io.Reader) error
 	b.attrs[name] = ObjectAttributes{
 		Size:         int64(len(body)),
 		LastModified: time.Now(),
+		ETag:         fmt.Sprintf("%x", md5.Sum(body)),
 	}
 	return nil
 }
@@ -6,7 +6,11 @@ package objstore
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -101,6 +105,10 @@ type ObjectAttributes struct {
 
 	// LastModified is the timestamp the object was last modified.
 	LastModified time.Time `json:"last_modified"`
+
+	// ETag identifies the version of the object, if provided by the object storage. It changes whenever the object
+	// is overwritten.
+	ETag string `json:"etag,omitempty"`
 }
 
 // TryToGetSize tries to get upfront size from reader.
@@ -200,7 +208,270 @@ func DownloadFile(ctx context.Context, logger log.Logger, bkt BucketReader, src,
 	return nil
 }
 
-// DownloadDir downloads all object found in the directory into the local directory.
+const (
+	// partialDownloadSuffix is the suffix of the file holding the data of an interrupted resumable download.
+	partialDownloadSuffix = ".partial"
+	// partialDownloadStateSuffix is the suffix of the file holding the state of a partial download.
+	partialDownloadStateSuffix = ".partial.json"
+	// resumeCheckpointBytes is the number of downloaded bytes after which the state of a resumable download is saved,
+	// so that the download can be resumed even if the process is killed.
+	resumeCheckpointBytes = 8 << 20
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// resumableDownloadState is the state of a partial download saved next to its data.
+type resumableDownloadState struct {
+	// Object holds attributes of the downloaded object, to detect it changed in the meantime.
+	Object ObjectAttributes `json:"object"`
+	// Offset and Length describe the downloaded range of the object.
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Downloaded is the number of bytes of the range safely written to the partial file and Checksum is their CRC32
+	// (Castagnoli) checksum.
+	Downloaded int64  `json:"downloaded"`
+	Checksum   uint32 `json:"checksum"`
+}
+
+// DownloadFileResumable downloads the src file from the bucket to dst like DownloadFile, but keeps the data of an
+// interrupted download in dst.partial and its state in dst.partial.json. Next download of the same file fetches only
+// the rest of the object, if the object has not changed in the meantime and the size and checksum of the partial data
+// match the saved state. Otherwise the file is downloaded from the beginning.
+func DownloadFileResumable(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string) error {
+	if fi, err := os.Stat(dst); err == nil {
+		if fi.IsDir() {
+			dst = filepath.Join(dst, filepath.Base(src))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	attrs, err := bkt.Attributes(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of file %s", src)
+	}
+	return downloadResumable(ctx, logger, bkt, src, attrs, 0, attrs.Size, dst)
+}
+
+// DownloadRangeResumable downloads length bytes of the src file starting at off to dst. Interrupted downloads are
+// resumed like in DownloadFileResumable.
+func DownloadRangeResumable(ctx context.Context, logger log.Logger, bkt BucketReader, src string, off, length int64, dst string) error {
+	attrs, err := bkt.Attributes(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of file %s", src)
+	}
+	if off < 0 || length < 0 || off+length > attrs.Size {
+		return errors.Errorf("range %d+%d is out of file %s of size %d", off, length, src, attrs.Size)
+	}
+	return downloadResumable(ctx, logger, bkt, src, attrs, off, length, dst)
+}
+
+func downloadResumable(ctx context.Context, logger log.Logger, bkt BucketReader, src string, attrs ObjectAttributes, off, length int64, dst string) error {
+	partial, statePath := dst+partialDownloadSuffix, dst+partialDownloadStateSuffix
+	w, err := resumePartialDownload(logger, src, partial, statePath, resumableDownloadState{Object: attrs, Offset: off, Length: length})
+	if err != nil {
+		return err
+	}
+	if w.state.Downloaded > 0 {
+		level.Info(logger).Log("msg", "resuming partial download", "file", src, "offset", off, "length", length, "downloaded", w.state.Downloaded)
+	}
+
+	if err := downloadRange(ctx, logger, bkt, src, w, off+w.state.Downloaded, length-w.state.Downloaded); err != nil {
+		// Save what was downloaded, so the next attempt does not start from the beginning.
+		if cerr := w.checkpoint(); cerr != nil {
+			level.Warn(logger).Log("msg", "failed to save state of partial download", "file", src, "err", cerr)
+		}
+		runutil.CloseWithLogOnErr(logger, w.f, "partially downloaded file")
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "close downloaded file")
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		return errors.Wrap(err, "rename downloaded file")
+	}
+	if err := os.Remove(statePath); err != nil {
+		level.Warn(logger).Log("msg", "failed to remove download state", "file", statePath, "err", err)
+	}
+	return nil
+}
+
+// downloadRange appends length bytes of src starting at off to w. Data written before an error is kept, so the
+// download can be resumed.
+func downloadRange(ctx context.Context, logger log.Logger, bkt BucketReader, src string, w io.Writer, off, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	rc, err := bkt.GetRange(ctx, src, off, length)
+	if err != nil {
+		return errors.Wrapf(err, "get range of file %s", src)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "download file range reader")
+
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		return errors.Wrap(err, "copy object to file")
+	}
+	if n != length {
+		// The object was most likely replaced after getting its attributes, so the partial download is useless.
+		return errors.Errorf("got %d bytes of file %s from offset %d, expected %d", n, src, off, length)
+	}
+	return nil
+}
+
+// resumePartialDownload returns a writer appending to the partial download of the object range described by the given
+// state. The partial data is kept only if its saved state describes the same range of the same object version and
+// the size and checksum of the data match the state. Otherwise the download starts from the beginning.
+func resumePartialDownload(logger log.Logger, src, partial, statePath string, state resumableDownloadState) (*checkpointWriter, error) {
+	w := &checkpointWriter{statePath: statePath, state: state, crc: crc32.New(castagnoliTable)}
+
+	prev, ok := readDownloadState(logger, src, statePath)
+	if ok && (!sameObjectVersion(prev.Object, state.Object) || prev.Offset != state.Offset || prev.Length != state.Length) {
+		level.Info(logger).Log("msg", "object changed since partial download, downloading from the beginning", "file", src)
+		ok = false
+	}
+	if ok && prev.Downloaded > 0 {
+		f, err := os.OpenFile(partial, os.O_RDWR, 0)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "open partially downloaded file")
+		}
+		if err == nil {
+			if verifyPartialDownload(logger, src, f, prev, w.crc) {
+				w.f, w.state.Downloaded, w.state.Checksum = f, prev.Downloaded, prev.Checksum
+				return w, nil
+			}
+			runutil.CloseWithLogOnErr(logger, f, "partially downloaded file")
+			w.crc.Reset()
+		}
+	}
+
+	// Save the state before creating the data file, so a partial file is never left without a state.
+	if err := w.writeState(); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(partial)
+	if err != nil {
+		return nil, errors.Wrap(err, "create file")
+	}
+	w.f = f
+	return w, nil
+}
+
+// readDownloadState reads the saved state of a partial download. It returns false if there is no usable state.
+func readDownloadState(logger log.Logger, src, statePath string) (resumableDownloadState, bool) {
+	var state resumableDownloadState
+	b, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, false
+	}
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to read download state, downloading from the beginning", "file", src, "err", err)
+		return state, false
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		level.Warn(logger).Log("msg", "failed to parse download state, downloading from the beginning", "file", src, "err", err)
+		return state, false
+	}
+	return state, true
+}
+
+// verifyPartialDownload checks that the partial file holds at least the downloaded bytes of the state and that their
+// checksum matches. Data written after the last saved state is truncated, as it is not covered by the checksum. The
+// verified data is written to crc, so the checksum can be continued.
+func verifyPartialDownload(logger log.Logger, src string, f *os.File, state resumableDownloadState, crc hash.Hash32) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to stat partially downloaded file, downloading from the beginning", "file", src, "err", err)
+		return false
+	}
+	if fi.Size() < state.Downloaded {
+		level.Warn(logger).Log("msg", "partially downloaded file is shorter than its saved state, downloading from the beginning", "file", src, "size", fi.Size(), "downloaded", state.Downloaded)
+		return false
+	}
+	if _, err := io.Copy(crc, io.LimitReader(f, state.Downloaded)); err != nil {
+		level.Warn(logger).Log("msg", "failed to read partially downloaded file, downloading from the beginning", "file", src, "err", err)
+		return false
+	}
+	if crc.Sum32() != state.Checksum {
+		level.Warn(logger).Log("msg", "checksum of partially downloaded file does not match its saved state, downloading from the beginning", "file", src)
+		return false
+	}
+	if err := f.Truncate(state.Downloaded); err != nil {
+		level.Warn(logger).Log("msg", "failed to truncate partially downloaded file, downloading from the beginning", "file", src, "err", err)
+		return false
+	}
+	if _, err := f.Seek(state.Downloaded, io.SeekStart); err != nil {
+		level.Warn(logger).Log("msg", "failed to seek partially downloaded file, downloading from the beginning", "file", src, "err", err)
+		return false
+	}
+	return true
+}
+
+// checkpointWriter writes downloaded data to the partial file and saves the size and checksum of the written data in
+// the state file every resumeCheckpointBytes.
+type checkpointWriter struct {
+	f         *os.File
+	statePath string
+	state     resumableDownloadState
+	crc       hash.Hash32
+	// unsaved is the number of bytes written since the state was saved.
+	unsaved int64
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	_, _ = w.crc.Write(p[:n])
+	w.state.Downloaded += int64(n)
+	w.unsaved += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.unsaved >= resumeCheckpointBytes {
+		if err := w.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkpoint syncs the written data and saves its size and checksum.
+func (w *checkpointWriter) checkpoint() error {
+	if err := w.f.Sync(); err != nil {
+		return errors.Wrap(err, "sync partially downloaded file")
+	}
+	w.state.Checksum = w.crc.Sum32()
+	if err := w.writeState(); err != nil {
+		return err
+	}
+	w.unsaved = 0
+	return nil
+}
+
+// writeState atomically replaces the state file.
+func (w *checkpointWriter) writeState() error {
+	b, err := json.Marshal(w.state)
+	if err != nil {
+		return errors.Wrap(err, "marshal download state")
+	}
+	tmp := w.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrap(err, "write download state")
+	}
+	return errors.Wrap(os.Rename(tmp, w.statePath), "rename download state")
+}
+
+// sameObjectVersion returns true if both attributes describe the same version of an object. ETags are compared if
+// provided, otherwise size and modification time.
+func sameObjectVersion(a, b ObjectAttributes) bool {
+	if a.ETag != "" && b.ETag != "" {
+		return a.ETag == b.ETag
+	}
+	return a.Size == b.Size && a.LastModified.Equal(b.LastModified)
+}
+
+// DownloadDir downloads all object found in the directory into the local directory. Files are downloaded with
+// DownloadFileResumable, so interrupted downloads of large files, e.g. of block index and chunks, are resumed by the
+// next attempt.
 func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string) error {
 	if err := os.MkdirAll(dst, 0777); err != nil {
 		return errors.Wrap(err, "create dir")
@@ -211,7 +482,7 @@ func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src,
 		if strings.HasSuffix(name, DirDelim) {
 			return DownloadDir(ctx, logger, bkt, name, filepath.Join(dst, filepath.Base(name)))
 		}
-		if err := DownloadFile(ctx, logger, bkt, name, dst); err != nil {
+		if err := DownloadFileResumable(ctx, logger, bkt, name, dst); err != nil {
 			return err
 		}
 
@@ -4,8 +4,16 @@
 package objstore
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -63,3 +71,141 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsDuration))
 	testutil.Assert(t, promtest.ToFloat64(bkt.lastSuccessfulUploadTime) > lastUpload)
 }
+
+// rangeRecordingBucket records GetRange calls and fails reading after failAfter bytes, if set.
+type rangeRecordingBucket struct {
+	Bucket
+
+	ranges    [][2]int64
+	failAfter int64
+}
+
+func (b *rangeRecordingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.ranges = append(b.ranges, [2]int64{off, length})
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil || b.failAfter == 0 {
+		return rc, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(rc, b.failAfter), failingReader{})), nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestDownloadFileResumable(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "download-resumable")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", bytes.NewReader(data)))
+	bkt := &rangeRecordingBucket{Bucket: inmem}
+	dst := filepath.Join(dir, "obj")
+
+	// Interrupted download keeps the downloaded data.
+	bkt.failAfter = 6000
+	testutil.NotOk(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+	testutil.Equals(t, [][2]int64{{0, 10000}}, bkt.ranges)
+	_, err = os.Stat(dst)
+	testutil.Assert(t, os.IsNotExist(err), "expected no downloaded file")
+	fi, err := os.Stat(dst + partialDownloadSuffix)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(6000), fi.Size())
+
+	// Download continues from the partial file after verifying its size and checksum.
+	bkt.failAfter, bkt.ranges = 0, nil
+	testutil.Ok(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+	testutil.Equals(t, [][2]int64{{6000, 4000}}, bkt.ranges)
+	got, err := ioutil.ReadFile(dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, data, got)
+	for _, f := range []string{dst + partialDownloadSuffix, dst + partialDownloadStateSuffix} {
+		_, err = os.Stat(f)
+		testutil.Assert(t, os.IsNotExist(err), "expected %s removed", f)
+	}
+
+	t.Run("changed object is downloaded from the beginning", func(t *testing.T) {
+		bkt.failAfter, bkt.ranges = 6000, nil
+		testutil.NotOk(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+
+		changed := append([]byte("changed"), data...)
+		testutil.Ok(t, inmem.Upload(ctx, "obj", bytes.NewReader(changed)))
+		bkt.failAfter, bkt.ranges = 0, nil
+		testutil.Ok(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		testutil.Equals(t, [][2]int64{{0, int64(len(changed))}}, bkt.ranges)
+		got, err := ioutil.ReadFile(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, changed, got)
+	})
+	t.Run("corrupted partial file is downloaded from the beginning", func(t *testing.T) {
+		testutil.Ok(t, inmem.Upload(ctx, "obj", bytes.NewReader(data)))
+		bkt.failAfter, bkt.ranges = 6000, nil
+		testutil.NotOk(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+
+		f, err := os.OpenFile(dst+partialDownloadSuffix, os.O_WRONLY, 0)
+		testutil.Ok(t, err)
+		_, err = f.WriteAt([]byte("corrupted"), 5990)
+		testutil.Ok(t, err)
+		testutil.Ok(t, f.Close())
+
+		bkt.failAfter, bkt.ranges = 0, nil
+		testutil.Ok(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		testutil.Equals(t, [][2]int64{{0, 10000}}, bkt.ranges)
+		got, err := ioutil.ReadFile(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, data, got)
+	})
+	t.Run("truncated partial file is downloaded from the beginning", func(t *testing.T) {
+		bkt.failAfter, bkt.ranges = 6000, nil
+		testutil.NotOk(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		testutil.Ok(t, os.Truncate(dst+partialDownloadSuffix, 5000))
+
+		bkt.failAfter, bkt.ranges = 0, nil
+		testutil.Ok(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		testutil.Equals(t, [][2]int64{{0, 10000}}, bkt.ranges)
+		got, err := ioutil.ReadFile(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, data, got)
+	})
+	t.Run("data written after the saved state is truncated", func(t *testing.T) {
+		bkt.failAfter, bkt.ranges = 6000, nil
+		testutil.NotOk(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		f, err := os.OpenFile(dst+partialDownloadSuffix, os.O_WRONLY|os.O_APPEND, 0)
+		testutil.Ok(t, err)
+		_, err = f.Write([]byte("unsaved"))
+		testutil.Ok(t, err)
+		testutil.Ok(t, f.Close())
+
+		bkt.failAfter, bkt.ranges = 0, nil
+		testutil.Ok(t, DownloadFileResumable(ctx, log.NewNopLogger(), bkt, "obj", dst))
+		testutil.Equals(t, [][2]int64{{6000, 4000}}, bkt.ranges)
+		got, err := ioutil.ReadFile(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, data, got)
+	})
+	t.Run("range", func(t *testing.T) {
+		rdst := filepath.Join(dir, "range")
+		bkt.failAfter, bkt.ranges = 1000, nil
+		testutil.NotOk(t, DownloadRangeResumable(ctx, log.NewNopLogger(), bkt, "obj", 2000, 3000, rdst))
+
+		// State of a different range is not resumed.
+		bkt.failAfter, bkt.ranges = 0, nil
+		testutil.Ok(t, DownloadRangeResumable(ctx, log.NewNopLogger(), bkt, "obj", 2000, 2500, rdst+"-other"))
+		testutil.Equals(t, [][2]int64{{2000, 2500}}, bkt.ranges)
+
+		bkt.ranges = nil
+		testutil.Ok(t, DownloadRangeResumable(ctx, log.NewNopLogger(), bkt, "obj", 2000, 3000, rdst))
+		testutil.Equals(t, [][2]int64{{3000, 2000}}, bkt.ranges)
+		got, err := ioutil.ReadFile(rdst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, data[2000:5000], got)
+
+		testutil.NotOk(t, DownloadRangeResumable(ctx, log.NewNopLogger(), bkt, "obj", 9000, 2000, rdst))
+	})
+}
@@ -35,6 +35,8 @@ type Config struct {
 	Bucket          string `yaml:"bucket"`
 	AccessKeyID     string `yaml:"access_key_id"`
 	AccessKeySecret string `yaml:"access_key_secret"`
+	// ListPageSize is the maximum number of objects returned by a single list request. 0 means the default of 100.
+	ListPageSize int `yaml:"list_page_size"`
 }
 
 // Bucket implements the store.Bucket interface.
@@ -154,6 +156,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         size,
 		LastModified: mod,
+		ETag:         m.Get("ETag"),
 	}, nil
 }
 
@@ -168,6 +171,9 @@ func NewBucket(logger log.Logger, conf []byte, component string) (*Bucket, error
 		return nil, errors.New("aliyun oss endpoint or bucket or access_key_id or access_key_secret " +
 			"is not present in config file")
 	}
+	if config.ListPageSize < 0 {
+		return nil, errors.New("aliyun oss list_page_size must not be negative")
+	}
 
 	client, err := alioss.New(config.Endpoint, config.AccessKeyID, config.AccessKeySecret)
 	if err != nil {
@@ -200,7 +206,11 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		if err := ctx.Err(); err != nil {
 			return errors.Wrap(err, "context closed while iterating bucket")
 		}
-		objects, err := b.bucket.ListObjects(alioss.Prefix(dir), alioss.Delimiter(objstore.DirDelim), marker)
+		opts := []alioss.Option{alioss.Prefix(dir), alioss.Delimiter(objstore.DirDelim), marker}
+		if b.config.ListPageSize > 0 {
+			opts = append(opts, alioss.MaxKeys(b.config.ListPageSize))
+		}
+		objects, err := b.bucket.ListObjects(opts...)
 		if err != nil {
 			return errors.Wrap(err, "listing aliyun oss bucket failed")
 		}
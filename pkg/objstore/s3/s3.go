@@ -24,6 +24,7 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/signer"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
@@ -44,6 +45,9 @@ const (
 
 	// SSES3 is the name of the SSE-S3 method for objstore encryption.
 	SSES3 = "SSE-S3"
+
+	// amzRequestPayer is the header confirming that the requester pays for requests to a requester pays bucket.
+	amzRequestPayer = "X-Amz-Request-Payer"
 )
 
 var DefaultConfig = Config{
@@ -72,6 +76,10 @@ type Config struct {
 	// PartSize used for multipart upload. Only used if uploaded object size is known and larger than configured PartSize.
 	PartSize  uint64    `yaml:"part_size"`
 	SSEConfig SSEConfig `yaml:"sse_config"`
+	// RequesterPays marks read requests as accepting the charges of a bucket with requester pays enabled.
+	RequesterPays bool `yaml:"requester_pays"`
+	// ListPageSize is the maximum number of keys returned by a single list request. 0 means the default of 1000.
+	ListPageSize int `yaml:"list_page_size"`
 }
 
 // SSEConfig deals with the configuration of SSE for Minio. The following options are valid:
@@ -129,6 +137,50 @@ func DefaultTransport(config Config) *http.Transport {
 	}
 }
 
+// requesterPaysTransport adds the requester pays header to all read requests. The minio client does not allow setting
+// headers for all requests, e.g. listing objects, and AWS requires all x-amz-* headers to be signed, so requests signed
+// with signature v4 are signed again with the header in place.
+type requesterPaysTransport struct {
+	rt    http.RoundTripper
+	creds *credentials.Credentials
+}
+
+func (t *requesterPaysTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.rt.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(amzRequestPayer, "requester")
+
+	region, ok := signatureV4Region(req.Header.Get("Authorization"))
+	if !ok {
+		// Anonymous request, nothing to sign.
+		return t.rt.RoundTrip(req)
+	}
+	v, err := t.creds.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "get s3 credentials")
+	}
+	req.Header.Del("Authorization")
+	return t.rt.RoundTrip(signer.SignV4(*req, v.AccessKeyID, v.SecretAccessKey, v.SessionToken, region))
+}
+
+// signatureV4Region returns the region of the credential scope of the given signature v4 authorization header, e.g.
+// "AWS4-HMAC-SHA256 Credential=<access key>/20200101/us-east-1/s3/aws4_request, SignedHeaders=..., Signature=...".
+func signatureV4Region(auth string) (string, bool) {
+	const credentialPrefix = "AWS4-HMAC-SHA256 Credential="
+
+	if !strings.HasPrefix(auth, credentialPrefix) {
+		return "", false
+	}
+	scope := strings.Split(strings.SplitN(strings.TrimPrefix(auth, credentialPrefix), ",", 2)[0], "/")
+	if len(scope) != 5 {
+		return "", false
+	}
+	return scope[2], true
+}
+
 // Bucket implements the store.Bucket interface against s3-compatible APIs.
 type Bucket struct {
 	logger          log.Logger
@@ -137,6 +189,7 @@ type Bucket struct {
 	sse             encrypt.ServerSide
 	putUserMetadata map[string]string
 	partSize        uint64
+	listPageSize    int
 }
 
 // parseConfig unmarshals a buffer into a Config with default HTTPConfig values.
@@ -201,8 +254,13 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		rt = DefaultTransport(config)
 	}
 
+	creds := credentials.NewChainCredentials(chain)
+	if config.RequesterPays {
+		rt = &requesterPaysTransport{rt: rt, creds: creds}
+	}
+
 	client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:     credentials.NewChainCredentials(chain),
+		Creds:     creds,
 		Secure:    !config.Insecure,
 		Region:    config.Region,
 		Transport: rt,
@@ -253,6 +311,7 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		sse:             sse,
 		putUserMetadata: config.PutUserMetadata,
 		partSize:        config.PartSize,
+		listPageSize:    config.ListPageSize,
 	}
 	return bkt, nil
 }
@@ -284,6 +343,14 @@ func validate(conf Config) error {
 		return errors.New("kms_key_id must be set if sse_config.type is set to 'SSE-KMS'")
 	}
 
+	if conf.RequesterPays && conf.SignatureV2 {
+		return errors.New("requester_pays is not supported with signature_version2")
+	}
+
+	if conf.ListPageSize < 0 {
+		return errors.New("list_page_size must not be negative")
+	}
+
 	return nil
 }
 
@@ -306,9 +373,11 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
 
+	// Following pages are requested with the continuation token of the previous one by the client.
 	opts := minio.ListObjectsOptions{
 		Prefix:    dir,
 		Recursive: false,
+		MaxKeys:   b.listPageSize,
 	}
 
 	for object := range b.client.ListObjects(ctx, b.name, opts) {
@@ -425,6 +494,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         objInfo.Size,
 		LastModified: objInfo.LastModified,
+		ETag:         objInfo.ETag,
 	}, nil
 }
 
@@ -4,9 +4,20 @@
 package s3
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
+
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -233,3 +244,187 @@ http_config:
 	_, err := parseConfig(input)
 	testutil.NotOk(t, err)
 }
+
+func TestBucket_RequesterPays(t *testing.T) {
+	for _, requesterPays := range []bool{false, true} {
+		t.Run(strconv.FormatBool(requesterPays), func(t *testing.T) {
+			var (
+				mtx  sync.Mutex
+				reqs []*http.Request
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				reqs = append(reqs, r)
+				mtx.Unlock()
+
+				if r.URL.Query().Get("list-type") == "2" {
+					w.Header().Set("Content-Type", "application/xml")
+					_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>test</Name><Prefix></Prefix><KeyCount>1</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated><Contents><Key>obj</Key><Size>4</Size></Contents></ListBucketResult>`))
+					return
+				}
+				w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+				w.Header().Set("ETag", `"etag"`)
+				w.Header().Set("Content-Length", "4")
+				if r.Method == http.MethodGet {
+					_, _ = w.Write([]byte("data"))
+				}
+			}))
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			testutil.Ok(t, err)
+
+			cfg := DefaultConfig
+			cfg.Bucket = "test"
+			cfg.Endpoint = u.Host
+			cfg.Region = "us-east-1"
+			cfg.Insecure = true
+			cfg.AccessKey = "access"
+			cfg.SecretKey = "secret"
+			cfg.RequesterPays = requesterPays
+
+			bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+			testutil.Ok(t, err)
+
+			ctx := context.Background()
+			r, err := bkt.Get(ctx, "obj")
+			testutil.Ok(t, err)
+			b, err := ioutil.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+			testutil.Equals(t, "data", string(b))
+
+			r, err = bkt.GetRange(ctx, "obj", 1, 2)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+
+			var names []string
+			testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+				names = append(names, name)
+				return nil
+			}))
+			testutil.Equals(t, []string{"obj"}, names)
+
+			_, err = bkt.Attributes(ctx, "obj")
+			testutil.Ok(t, err)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			testutil.Assert(t, len(reqs) >= 4, "expected at least 4 requests, got %d", len(reqs))
+			for _, r := range reqs {
+				if !requesterPays {
+					testutil.Equals(t, "", r.Header.Get(amzRequestPayer))
+					continue
+				}
+				testutil.Equals(t, "requester", r.Header.Get(amzRequestPayer), "%s %s", r.Method, r.URL)
+				testutil.Assert(t, strings.Contains(r.Header.Get("Authorization"), "x-amz-request-payer"), "header not signed in %s %s", r.Method, r.URL)
+			}
+		})
+	}
+}
+
+func TestSignatureV4Region(t *testing.T) {
+	region, ok := signatureV4Region("AWS4-HMAC-SHA256 Credential=access/20200101/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=abc")
+	testutil.Assert(t, ok, "expected signature v4")
+	testutil.Equals(t, "eu-west-1", region)
+
+	_, ok = signatureV4Region("AWS access:signature")
+	testutil.Assert(t, !ok, "unexpected signature v4")
+
+	_, ok = signatureV4Region("")
+	testutil.Assert(t, !ok, "unexpected signature v4")
+}
+
+func TestBucket_IterPages(t *testing.T) {
+	var keys []string
+	for i := 0; i < 7; i++ {
+		keys = append(keys, fmt.Sprintf("dir/obj-%d", i))
+	}
+
+	var (
+		mtx      sync.Mutex
+		maxKeys  []string
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("list-type") != "2" {
+			http.NotFound(w, r)
+			return
+		}
+		mtx.Lock()
+		maxKeys = append(maxKeys, q.Get("max-keys"))
+		requests++
+		mtx.Unlock()
+
+		// Continuation token is the index of the first key of the page.
+		start := 0
+		if token := q.Get("continuation-token"); token != "" {
+			var err error
+			if start, err = strconv.Atoi(token); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		size, err := strconv.Atoi(q.Get("max-keys"))
+		if err != nil || size <= 0 || size > 1000 {
+			size = 1000
+		}
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>test</Name>`)
+		fmt.Fprintf(&b, `<Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys>`, q.Get("prefix"), end-start, size)
+		if end < len(keys) {
+			fmt.Fprintf(&b, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, end)
+		} else {
+			b.WriteString(`<IsTruncated>false</IsTruncated>`)
+		}
+		for _, k := range keys[start:end] {
+			fmt.Fprintf(&b, `<Contents><Key>%s</Key><Size>4</Size></Contents>`, k)
+		}
+		b.WriteString(`</ListBucketResult>`)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(b.String()))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	cfg := DefaultConfig
+	cfg.Bucket = "test"
+	cfg.Endpoint = u.Host
+	cfg.Region = "us-east-1"
+	cfg.Insecure = true
+	cfg.AccessKey = "access"
+	cfg.SecretKey = "secret"
+	cfg.ListPageSize = 3
+
+	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	testutil.Ok(t, err)
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(context.Background(), "dir", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, keys, names)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	testutil.Equals(t, 3, requests)
+	testutil.Equals(t, []string{"3", "3", "3"}, maxKeys)
+}
+
+func TestParseConfig_ListPageSize(t *testing.T) {
+	cfg, err := parseConfig([]byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+list_page_size: -1`))
+	testutil.Ok(t, err)
+	testutil.NotOk(t, validate(cfg))
+}
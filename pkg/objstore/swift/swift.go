@@ -42,12 +42,15 @@ type SwiftConfig struct {
 	ProjectDomainName string `yaml:"project_domain_name"`
 	RegionName        string `yaml:"region_name"`
 	ContainerName     string `yaml:"container_name"`
+	// ListPageSize is the maximum number of objects returned by a single list request. 0 means the default of 10000.
+	ListPageSize int `yaml:"list_page_size"`
 }
 
 type Container struct {
-	logger log.Logger
-	client *gophercloud.ServiceClient
-	name   string
+	logger       log.Logger
+	client       *gophercloud.ServiceClient
+	name         string
+	listPageSize int
 }
 
 func NewContainer(logger log.Logger, conf []byte) (*Container, error) {
@@ -69,9 +72,10 @@ func NewContainer(logger log.Logger, conf []byte) (*Container, error) {
 	}
 
 	return &Container{
-		logger: logger,
-		client: client,
-		name:   sc.ContainerName,
+		logger:       logger,
+		client:       client,
+		name:         sc.ContainerName,
+		listPageSize: sc.ListPageSize,
 	}, nil
 }
 
@@ -89,7 +93,8 @@ func (c *Container) Iter(ctx context.Context, dir string, f func(string) error)
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
 
-	options := &objects.ListOpts{Full: true, Prefix: dir, Delimiter: DirDelim}
+	// Following pages are requested with the marker of the last object of the previous one by the pager.
+	options := &objects.ListOpts{Full: true, Prefix: dir, Delimiter: DirDelim, Limit: c.listPageSize}
 	return objects.List(c.client, c.name, options).EachPage(func(page pagination.Page) (bool, error) {
 		objectNames, err := objects.ExtractNames(page)
 		if err != nil {
@@ -143,6 +148,7 @@ func (c *Container) Attributes(ctx context.Context, name string) (objstore.Objec
 	return objstore.ObjectAttributes{
 		Size:         headers.ContentLength,
 		LastModified: headers.LastModified,
+		ETag:         headers.ETag,
 	}, nil
 }
 
@@ -185,8 +191,13 @@ func (*Container) Close() error {
 
 func parseConfig(conf []byte) (*SwiftConfig, error) {
 	var sc SwiftConfig
-	err := yaml.UnmarshalStrict(conf, &sc)
-	return &sc, err
+	if err := yaml.UnmarshalStrict(conf, &sc); err != nil {
+		return nil, err
+	}
+	if sc.ListPageSize < 0 {
+		return nil, errors.New("list_page_size must not be negative")
+	}
+	return &sc, nil
 }
 
 func authOptsFromConfig(sc *SwiftConfig) gophercloud.AuthOptions {
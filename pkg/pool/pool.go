@@ -7,6 +7,8 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type BytesPool interface {
@@ -115,3 +117,59 @@ func (p *BucketedBytesPool) Put(b *[]byte) {
 		p.usedTotal -= sz
 	}
 }
+
+// InstrumentedPool is a sync.Pool exposing metrics of its effectiveness, so that pool sizing and usage can be tuned.
+type InstrumentedPool struct {
+	pool sync.Pool
+	new  func() interface{}
+
+	gets   prometheus.Counter
+	puts   prometheus.Counter
+	allocs prometheus.Counter
+	pooled prometheus.Gauge
+}
+
+// NewInstrumentedPool returns a new InstrumentedPool allocating objects with the given function if the pool is empty.
+// Metric names are not prefixed, so the given registerer is expected to prefix them with the pool purpose.
+func NewInstrumentedPool(reg prometheus.Registerer, new func() interface{}) *InstrumentedPool {
+	return &InstrumentedPool{
+		new: new,
+		gets: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "pool_gets_total",
+			Help: "Total number of objects obtained from the pool.",
+		}),
+		puts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "pool_puts_total",
+			Help: "Total number of objects returned to the pool.",
+		}),
+		allocs: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "pool_allocations_total",
+			Help: "Total number of objects allocated because the pool had none to reuse.",
+		}),
+		pooled: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "pool_objects",
+			Help: "Number of objects returned to the pool and not obtained again. Objects released by garbage collection are not accounted for, so it is an upper bound.",
+		}),
+	}
+}
+
+// Get returns an object from the pool or a new one if the pool is empty.
+func (p *InstrumentedPool) Get() interface{} {
+	p.gets.Inc()
+	if x := p.pool.Get(); x != nil {
+		p.pooled.Dec()
+		return x
+	}
+	p.allocs.Inc()
+	return p.new()
+}
+
+// Put returns the object to the pool.
+func (p *InstrumentedPool) Put(x interface{}) {
+	if x == nil {
+		return
+	}
+	p.puts.Inc()
+	p.pooled.Inc()
+	p.pool.Put(x)
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/goleak"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -124,3 +126,35 @@ func TestRacePutGet(t *testing.T) {
 	default:
 	}
 }
+
+func TestInstrumentedPool(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p := NewInstrumentedPool(reg, func() interface{} {
+		b := make([]byte, 0, 10)
+		return &b
+	})
+
+	b := p.Get().(*[]byte)
+	testutil.Equals(t, 10, cap(*b))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.gets))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.allocs))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(p.pooled))
+
+	p.Put(b)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.puts))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.pooled))
+
+	// sync.Pool may drop pooled objects at any time, so the object is either reused or allocated again.
+	_ = p.Get()
+	testutil.Equals(t, 2.0, promtest.ToFloat64(p.gets))
+	reused := promtest.ToFloat64(p.allocs) == 1
+	if reused {
+		testutil.Equals(t, 0.0, promtest.ToFloat64(p.pooled))
+	} else {
+		testutil.Equals(t, 2.0, promtest.ToFloat64(p.allocs))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(p.pooled))
+	}
+
+	p.Put(nil)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.puts))
+}
@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/extgrpc"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// ClusterTLSConfig configures TLS of connections to a remote cluster.
+type ClusterTLSConfig struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
+// ClusterConfig configures a remote Thanos cluster queried through the StoreAPI of its querier, which proxies all
+// StoreAPIs of the cluster.
+type ClusterConfig struct {
+	Address string `yaml:"address"`
+	// ExternalLabels are added to all series of the cluster, so that series of different clusters can be told apart.
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	// TLSConfig enables TLS of connections to the cluster. Connections are insecure if not set.
+	TLSConfig *ClusterTLSConfig `yaml:"tls_config"`
+	// BearerToken or the token read from BearerTokenFile on each request is sent in the authorization header.
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+}
+
+// ParseClusterConfigs parses the YAML list of remote clusters.
+func ParseClusterConfigs(confYaml []byte) ([]ClusterConfig, error) {
+	var conf []ClusterConfig
+	if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse clusters config")
+	}
+
+	addrs := make(map[string]struct{}, len(conf))
+	for _, c := range conf {
+		if c.Address == "" {
+			return nil, errors.New("address of cluster is empty")
+		}
+		if _, ok := addrs[c.Address]; ok {
+			return nil, errors.Errorf("duplicate cluster address %q", c.Address)
+		}
+		addrs[c.Address] = struct{}{}
+
+		for n, v := range c.ExternalLabels {
+			if !model.LabelName(n).IsValid() {
+				return nil, errors.Errorf("invalid external label name %q of cluster %q", n, c.Address)
+			}
+			if v == "" {
+				return nil, errors.Errorf("empty value of external label %q of cluster %q", n, c.Address)
+			}
+		}
+		if c.BearerToken != "" && c.BearerTokenFile != "" {
+			return nil, errors.Errorf("both bearer_token and bearer_token_file set for cluster %q", c.Address)
+		}
+		// Tokens are never sent over insecure connections.
+		if (c.BearerToken != "" || c.BearerTokenFile != "") && c.TLSConfig == nil {
+			return nil, errors.Errorf("bearer token of cluster %q requires tls_config", c.Address)
+		}
+	}
+	return conf, nil
+}
+
+// clusterStoreSpec is the store spec of a remote cluster, connected with its own TLS and auth options and tagging all
+// its data with its external labels.
+type clusterStoreSpec struct {
+	grpcStoreSpec
+
+	dialOpts []grpc.DialOption
+	extLset  labels.Labels
+}
+
+// NewClusterStoreSpec returns the store spec of the given remote cluster. Connections use the given base dial options
+// extended with the transport and auth options of the cluster.
+func NewClusterStoreSpec(logger log.Logger, conf ClusterConfig, baseDialOpts []grpc.DialOption) (StoreSpec, error) {
+	var tlsConf ClusterTLSConfig
+	if conf.TLSConfig != nil {
+		tlsConf = *conf.TLSConfig
+	}
+	transportOpt, err := extgrpc.ClientTransportGRPCOpt(logger, conf.TLSConfig != nil, tlsConf.CertFile, tlsConf.KeyFile, tlsConf.CAFile, tlsConf.ServerName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "TLS config of cluster %q", conf.Address)
+	}
+
+	dialOpts := append(append(make([]grpc.DialOption, 0, len(baseDialOpts)+2), baseDialOpts...), transportOpt)
+	if conf.BearerToken != "" || conf.BearerTokenFile != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(&bearerTokenCredentials{token: conf.BearerToken, tokenFile: conf.BearerTokenFile}))
+	}
+
+	return &clusterStoreSpec{
+		grpcStoreSpec: grpcStoreSpec{addr: conf.Address},
+		dialOpts:      dialOpts,
+		extLset:       labels.FromMap(conf.ExternalLabels),
+	}, nil
+}
+
+func (s *clusterStoreSpec) dialOptions() []grpc.DialOption {
+	return s.dialOpts
+}
+
+func (s *clusterStoreSpec) wrapClient(client storepb.StoreClient) storepb.StoreClient {
+	if len(s.extLset) == 0 {
+		return client
+	}
+	return store.NewExternalLabelsClient(client, s.extLset)
+}
+
+// bearerTokenCredentials sends the bearer token in the authorization header of each request. The token file is read
+// on each request, so that rotated tokens are picked up.
+type bearerTokenCredentials struct {
+	token     string
+	tokenFile string
+}
+
+func (c *bearerTokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	token := c.token
+	if c.tokenFile != "" {
+		b, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read bearer token file %s", c.tokenFile)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c *bearerTokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,216 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/gate"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseClusterConfigs(t *testing.T) {
+	c, err := ParseClusterConfigs([]byte(`
+- address: eu.example.com:10901
+  external_labels:
+    cluster: eu
+  tls_config:
+    ca_file: /etc/ca.pem
+  bearer_token_file: /etc/token
+- address: us.example.com:10901
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ClusterConfig{
+		{
+			Address:         "eu.example.com:10901",
+			ExternalLabels:  map[string]string{"cluster": "eu"},
+			TLSConfig:       &ClusterTLSConfig{CAFile: "/etc/ca.pem"},
+			BearerTokenFile: "/etc/token",
+		},
+		{Address: "us.example.com:10901"},
+	}, c)
+
+	for _, tcase := range []struct {
+		name string
+		conf string
+	}{
+		{name: "empty address", conf: `[{external_labels: {cluster: eu}}]`},
+		{name: "duplicate address", conf: `[{address: "a:1"}, {address: "a:1"}]`},
+		{name: "invalid label name", conf: `[{address: "a:1", external_labels: {"1a": eu}}]`},
+		{name: "empty label value", conf: `[{address: "a:1", external_labels: {cluster: ""}}]`},
+		{name: "token and token file", conf: `[{address: "a:1", tls_config: {}, bearer_token: t, bearer_token_file: /t}]`},
+		{name: "token without TLS", conf: `[{address: "a:1", bearer_token: t}]`},
+		{name: "unknown field", conf: `[{address: "a:1", foo: bar}]`},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := ParseClusterConfigs([]byte(tcase.conf))
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+// clusterStoreServer serves series of a remote cluster like the StoreAPI of its querier does.
+type clusterStoreServer struct {
+	storeServer
+}
+
+func (s *clusterStoreServer) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	return &storepb.InfoResponse{StoreType: component.Query.ToProto(), MinTime: math.MinInt64, MaxTime: math.MaxInt64}, nil
+}
+
+// startClusterStoreServer serves the given responses on a local address, requiring the given bearer token if not empty.
+func startClusterStoreServer(t *testing.T, resps []*storepb.SeriesResponse, token string, opts ...grpc.ServerOption) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+
+	if token != "" {
+		auth := func(ctx context.Context) error {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if v := md.Get("authorization"); len(v) != 1 || v[0] != "Bearer "+token {
+				return status.Error(codes.Unauthenticated, "invalid token")
+			}
+			return nil
+		}
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, h grpc.UnaryHandler) (interface{}, error) {
+				if err := auth(ctx); err != nil {
+					return nil, err
+				}
+				return h(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+				if err := auth(ss.Context()); err != nil {
+					return err
+				}
+				return h(srv, ss)
+			}),
+		)
+	}
+	srv := grpc.NewServer(opts...)
+	storepb.RegisterStoreServer(srv, &clusterStoreServer{storeServer: storeServer{resps: resps}})
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	return l.Addr().String()
+}
+
+// writeSelfSignedCert writes the self-signed certificate of localhost and its key to the given directory.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	testutil.Ok(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	testutil.Ok(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	testutil.Ok(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	testutil.Ok(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestQuerier_Select_Clusters(t *testing.T) {
+	dir := t.TempDir()
+
+	// The EU cluster requires TLS and a bearer token, the US one is insecure.
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	testutil.Ok(t, err)
+	tokenFile := filepath.Join(dir, "token")
+	testutil.Ok(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	euAddr := startClusterStoreServer(t, []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "cluster", "remote", "job", "a"), []sample{{100, 1}}),
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "b"), []sample{{100, 2}}),
+	}, "secret", grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	usAddr := startClusterStoreServer(t, []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "a"), []sample{{100, 3}}),
+	}, "")
+
+	var specs []StoreSpec
+	for _, c := range []ClusterConfig{
+		{
+			Address:         euAddr,
+			ExternalLabels:  map[string]string{"cluster": "eu"},
+			TLSConfig:       &ClusterTLSConfig{CAFile: certFile, ServerName: "localhost"},
+			BearerTokenFile: tokenFile,
+		},
+		{Address: usAddr, ExternalLabels: map[string]string{"cluster": "us"}},
+	} {
+		spec, err := NewClusterStoreSpec(log.NewNopLogger(), c, testGRPCOpts[:1])
+		testutil.Ok(t, err)
+		specs = append(specs, spec)
+	}
+
+	storeSet := NewStoreSet(nil, nil,
+		func() []StoreSpec { return specs },
+		func() []RuleSpec { return nil },
+		testGRPCOpts, nil, 1, 0, time.Minute)
+	defer storeSet.Close()
+
+	storeSet.Update(context.Background())
+	testutil.Equals(t, 2, len(storeSet.Get()))
+
+	proxy := store.NewProxyStore(nil, nil, storeSet.Get, component.Query, nil, 0, store.ProxyStoreOpts{})
+	q := newQuerier(context.Background(), nil, 0, 1000, nil, nil, proxy, false, 0, false, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{})
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	t.Run("all clusters", func(t *testing.T) {
+		// External labels of clusters override labels of the same name returned by the cluster.
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000}, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up"))
+		testSelectResponse(t, []series{
+			{lset: labels.FromStrings("__name__", "up", "cluster", "eu", "job", "a"), samples: []sample{{100, 1}}},
+			{lset: labels.FromStrings("__name__", "up", "cluster", "eu", "job", "b"), samples: []sample{{100, 2}}},
+			{lset: labels.FromStrings("__name__", "up", "cluster", "us", "job", "a"), samples: []sample{{100, 3}}},
+		}, res)
+	})
+	t.Run("one cluster", func(t *testing.T) {
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000}, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up"), labels.MustNewMatcher(labels.MatchEqual, "cluster", "us"))
+		testSelectResponse(t, []series{
+			{lset: labels.FromStrings("__name__", "up", "cluster", "us", "job", "a"), samples: []sample{{100, 3}}},
+		}, res)
+	})
+	t.Run("label values", func(t *testing.T) {
+		vals, _, err := q.LabelValues("cluster")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"eu", "us"}, vals)
+	})
+}
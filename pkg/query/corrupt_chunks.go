@@ -0,0 +1,101 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// CorruptChunksTrackerKey is the context key for the *CorruptChunksTracker recording chunks of a query skipped as they
+// failed to decode.
+const CorruptChunksTrackerKey = ctxKey(3)
+
+// CorruptChunksTracker records chunks skipped with CorruptChunkSkip. Chunks are decoded while samples of series are
+// iterated, i.e. during evaluation of a query, after warnings of its selects were read, so skipped chunks are reported
+// by the tracker once the query is evaluated. Chunks are skipped only by selects of queries with a tracker. It is safe
+// for concurrent use, so a single tracker can be shared by all selects of a query.
+type CorruptChunksTracker struct {
+	mtx    sync.Mutex
+	chunks map[corruptChunk]struct{}
+	series map[uint64]struct{}
+}
+
+type corruptChunk struct {
+	series     uint64
+	mint, maxt int64
+}
+
+// NewCorruptChunksTracker returns an empty tracker.
+func NewCorruptChunksTracker() *CorruptChunksTracker {
+	return &CorruptChunksTracker{chunks: map[corruptChunk]struct{}{}, series: map[uint64]struct{}{}}
+}
+
+func corruptChunksTrackerFromContext(ctx context.Context) *CorruptChunksTracker {
+	t, _ := ctx.Value(CorruptChunksTrackerKey).(*CorruptChunksTracker)
+	return t
+}
+
+// record records the chunk of the series with the given time range. Chunks iterated more than once, e.g. by
+// subqueries, are recorded once.
+func (t *CorruptChunksTracker) record(lset labels.Labels, mint, maxt int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h := lset.Hash()
+	t.chunks[corruptChunk{series: h, mint: mint, maxt: maxt}] = struct{}{}
+	t.series[h] = struct{}{}
+}
+
+// Warnings returns a warning about recorded chunks, if any.
+func (t *CorruptChunksTracker) Warnings() storage.Warnings {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if len(t.chunks) == 0 {
+		return nil
+	}
+	return storage.Warnings{errors.Errorf("skipped %d chunks of %d series that failed to decode, e.g. because of a corrupted block; these series have gaps", len(t.chunks), len(t.series))}
+}
+
+// corruptChunkSkippingIterator iterates over samples of a single chunk. Once the chunk fails to decode, the rest of it
+// is skipped and the failure is passed to onCorrupt instead of being returned by Err. Samples decoded before are kept.
+// Chunk iterators are only advanced with Next, so Seek is not overridden.
+type corruptChunkSkippingIterator struct {
+	chunkenc.Iterator
+
+	onCorrupt func()
+	skipped   bool
+}
+
+func (it *corruptChunkSkippingIterator) Next() bool {
+	if it.skipped {
+		return false
+	}
+	if it.Iterator.Next() {
+		return true
+	}
+	it.skipIfCorrupt()
+	return false
+}
+
+func (it *corruptChunkSkippingIterator) skipIfCorrupt() {
+	// Chunks without the requested aggregate are not corrupt, StoreAPIs returned wrong data.
+	if err := it.Iterator.Err(); err != nil && err != errNoValidChunk {
+		it.skipped = true
+		it.onCorrupt()
+	}
+}
+
+func (it *corruptChunkSkippingIterator) Err() error {
+	if it.skipped {
+		return nil
+	}
+	return it.Iterator.Err()
+}
@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// CounterResetsTrackerKey is the context key for the *CounterResetsTracker recording deduplicated counter series of a
+// query with resets caused by switching between replicas.
+const CounterResetsTrackerKey = ctxKey(1)
+
+// CounterResetsTracker records deduplicated counter series with resets caused by switching between replicas rather
+// than by restarts. Resets are detected while samples of series are iterated, i.e. during evaluation of a query, after
+// warnings of its selects were read, so they are reported by the tracker once the query is evaluated. It is safe for
+// concurrent use, so a single tracker can be shared by all selects of a query.
+type CounterResetsTracker struct {
+	mtx    sync.Mutex
+	series map[uint64]struct{}
+}
+
+// NewCounterResetsTracker returns an empty tracker.
+func NewCounterResetsTracker() *CounterResetsTracker {
+	return &CounterResetsTracker{series: map[uint64]struct{}{}}
+}
+
+func counterResetsTrackerFromContext(ctx context.Context) *CounterResetsTracker {
+	t, _ := ctx.Value(CounterResetsTrackerKey).(*CounterResetsTracker)
+	return t
+}
+
+// record records the series and returns true if it was not recorded before, e.g. by another select of the same query.
+func (t *CounterResetsTracker) record(lset labels.Labels) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h := lset.Hash()
+	if _, ok := t.series[h]; ok {
+		return false
+	}
+	t.series[h] = struct{}{}
+	return true
+}
+
+// Warnings returns a warning about recorded series, if any.
+func (t *CounterResetsTracker) Warnings() storage.Warnings {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if len(t.series) == 0 {
+		return nil
+	}
+	return storage.Warnings{errors.Errorf("%d counter series have resets caused by switching between replicas rather than by restarts, which may indicate misconfigured replica labels or replicas drifting apart; rate() and increase() of these series are overestimated", len(t.series))}
+}
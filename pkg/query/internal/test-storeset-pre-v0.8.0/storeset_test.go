@@ -55,6 +55,10 @@ func (s *testStore) LabelValues(ctx context.Context, r *storepb.LabelValuesReque
 	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
+func (s *testStore) LabelValuesStream(*storepb.LabelValuesRequest, storepb.Store_LabelValuesStreamServer) error {
+	return status.Error(codes.Unimplemented, "not implemented")
+}
+
 type testStoreMeta struct {
 	extlsetFn func(addr string) []storepb.LabelSet
 	storeType component.StoreAPI
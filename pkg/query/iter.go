@@ -4,10 +4,16 @@
 package query
 
 import (
+	"context"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -29,10 +35,30 @@ type promSeriesSet struct {
 	currLset   labels.Labels
 	currChunks []storepb.AggrChunk
 
+	// tailOnly drops all chunks that cannot contain the latest sample before maxt.
+	tailOnly bool
+	// overlapPolicy decides which chunks are used when raw and downsampled chunks overlap.
+	overlapPolicy ResolutionOverlapPolicy
+	currTrimmed   []bool
+	// rawOnlyWithin, if not nil, drops downsampled chunks of series having any raw chunk within the range.
+	rawOnlyWithin *timeRange
+	// corruptChunks, if not nil, records chunks skipped as they fail to decode instead of failing the query.
+	corruptChunks *CorruptChunksTracker
+
 	warns storage.Warnings
 }
 
 func (s *promSeriesSet) Next() bool {
+	for s.next() {
+		// Series without any chunk left can be skipped altogether.
+		if !s.tailOnly || len(s.currChunks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *promSeriesSet) next() bool {
 	if !s.initiated {
 		s.initiated = true
 		s.done = s.set.Next()
@@ -68,9 +94,202 @@ func (s *promSeriesSet) Next() bool {
 	// Proxy handles duplicates between different series, let's handle duplicates within single series now as well.
 	// We don't need to decode those.
 	s.currChunks = removeExactDuplicates(s.currChunks)
+	if s.rawOnlyWithin != nil {
+		s.currChunks = rawChunksIfAny(s.currChunks, *s.rawOnlyWithin)
+	}
+	s.currChunks, s.currTrimmed = resolveResolutionOverlaps(s.currChunks, s.overlapPolicy)
+	if s.tailOnly {
+		start, end := tailChunks(s.currChunks, s.maxt)
+		s.currChunks = s.currChunks[start:end]
+		if s.currTrimmed != nil {
+			s.currTrimmed = s.currTrimmed[start:end]
+		}
+	}
 	return true
 }
 
+// tailChunks returns the bounds of the smallest suffix of chunks that is guaranteed to hold the latest sample
+// not newer than maxt.
+// NOTE: input chunks has to be sorted by minTime.
+func tailChunks(chks []storepb.AggrChunk, maxt int64) (start, end int) {
+	// Chunks starting after maxt cannot contain any sample we are interested in.
+	end = len(chks)
+	for end > 0 && chks[end-1].MinTime > maxt {
+		end--
+	}
+	if end == 0 {
+		return 0, 0
+	}
+
+	// The newest remaining chunk holds a sample at its MinTime, so the latest sample is there or in any
+	// chunk still overlapping with it.
+	lastMinTime := chks[end-1].MinTime
+	start = end - 1
+	for i := end - 2; i >= 0; i-- {
+		if chks[i].MaxTime >= lastMinTime {
+			start = i
+		}
+	}
+	return start, end
+}
+
+// CorruptChunkPolicy decides what happens to chunks returned by StoreAPIs that fail to decode.
+type CorruptChunkPolicy string
+
+const (
+	// CorruptChunkFail fails the query.
+	CorruptChunkFail CorruptChunkPolicy = "fail"
+	// CorruptChunkSkip drops such chunks with a warning for queries with partial response enabled, so that one
+	// corrupted chunk leaves a gap in its series instead of failing the whole query.
+	CorruptChunkSkip CorruptChunkPolicy = "skip"
+)
+
+// ResolutionOverlapPolicy decides which data is used when raw and downsampled chunks of the same series overlap in time,
+// e.g. when raw blocks were not yet deleted after being downsampled.
+type ResolutionOverlapPolicy string
+
+const (
+	// ResolutionOverlapNone merges overlapping raw and downsampled chunks as they are.
+	ResolutionOverlapNone ResolutionOverlapPolicy = "none"
+	// ResolutionOverlapPreferRaw drops downsampled data where raw data is available. This favours accuracy.
+	ResolutionOverlapPreferRaw ResolutionOverlapPolicy = "prefer-raw"
+	// ResolutionOverlapPreferDownsampled drops raw data where downsampled data is available. This favours cost.
+	ResolutionOverlapPreferDownsampled ResolutionOverlapPolicy = "prefer-downsampled"
+)
+
+// overlapGapTolerance is the maximum gap between two chunks of the preferred resolution that is still treated as covered.
+// Such gaps come from the scrape interval and are always smaller than the lowest downsampling resolution.
+const overlapGapTolerance = downsample.ResLevel1
+
+// timeRange is a closed range of milliseconds timestamps.
+type timeRange struct {
+	mint, maxt int64
+}
+
+// resolveResolutionOverlaps applies the given policy on chunks of a single series. Chunks of the non-preferred resolution
+// that are fully covered by chunks of the preferred one are dropped. Partially covered chunks are split into copies
+// with MinTime and MaxTime narrowed to the uncovered ranges. Returned trimmed slice marks such copies, which have
+// to be bounded to their time range during iteration. Nil is returned if no chunk was trimmed.
+// NOTE: input chunks has to be sorted by minTime. Output chunks are sorted by minTime as well.
+func resolveResolutionOverlaps(chks []storepb.AggrChunk, policy ResolutionOverlapPolicy) ([]storepb.AggrChunk, []bool) {
+	if policy != ResolutionOverlapPreferRaw && policy != ResolutionOverlapPreferDownsampled {
+		return chks, nil
+	}
+
+	preferred := func(c storepb.AggrChunk) bool {
+		return (c.Raw != nil) == (policy == ResolutionOverlapPreferRaw)
+	}
+
+	var (
+		covered []timeRange
+		others  int
+	)
+	for _, c := range chks {
+		if !preferred(c) {
+			others++
+			continue
+		}
+		if l := len(covered); l > 0 && c.MinTime <= covered[l-1].maxt+overlapGapTolerance {
+			if c.MaxTime > covered[l-1].maxt {
+				covered[l-1].maxt = c.MaxTime
+			}
+			continue
+		}
+		covered = append(covered, timeRange{mint: c.MinTime, maxt: c.MaxTime})
+	}
+	if len(covered) == 0 || others == 0 {
+		return chks, nil
+	}
+
+	var (
+		ret     = make([]storepb.AggrChunk, 0, len(chks))
+		trimmed = make([]bool, 0, len(chks))
+		split   bool
+	)
+	for _, c := range chks {
+		if preferred(c) {
+			ret = append(ret, c)
+			trimmed = append(trimmed, false)
+			continue
+		}
+
+		// Walk through covered ranges and keep only the uncovered parts of the chunk.
+		mint, changed := c.MinTime, false
+		for _, r := range covered {
+			if r.maxt < mint || r.mint > c.MaxTime {
+				continue
+			}
+			changed = true
+			if r.mint > mint {
+				part := c
+				part.MinTime, part.MaxTime = mint, r.mint-1
+				ret = append(ret, part)
+				trimmed = append(trimmed, true)
+				split = true
+			}
+			mint = r.maxt + 1
+		}
+		if !changed {
+			ret = append(ret, c)
+			trimmed = append(trimmed, false)
+			continue
+		}
+		if mint <= c.MaxTime {
+			part := c
+			part.MinTime = mint
+			ret = append(ret, part)
+			trimmed = append(trimmed, true)
+			split = true
+		}
+	}
+	if !split {
+		return ret, nil
+	}
+
+	sort.Stable(&chunksWithTrimmed{chks: ret, trimmed: trimmed})
+	return ret, trimmed
+}
+
+// rawChunksIfAny returns only raw chunks if any of them overlaps with the given range. Otherwise, all chunks are returned.
+// It makes instant evaluations at boundaries of raw and downsampled data deterministic: the latest sample within the
+// lookback is always taken from the finest available resolution, never from whichever chunk happens to be iterated first.
+// NOTE: input chunks has to be sorted by minTime. Output chunks are sorted by minTime as well.
+func rawChunksIfAny(chks []storepb.AggrChunk, r timeRange) []storepb.AggrChunk {
+	var raw, others int
+	for _, c := range chks {
+		if c.Raw == nil {
+			others++
+			continue
+		}
+		if c.MinTime <= r.maxt && c.MaxTime >= r.mint {
+			raw++
+		}
+	}
+	if raw == 0 || others == 0 {
+		return chks
+	}
+
+	ret := make([]storepb.AggrChunk, 0, len(chks)-others)
+	for _, c := range chks {
+		if c.Raw != nil {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+type chunksWithTrimmed struct {
+	chks    []storepb.AggrChunk
+	trimmed []bool
+}
+
+func (c *chunksWithTrimmed) Len() int           { return len(c.chks) }
+func (c *chunksWithTrimmed) Less(i, j int) bool { return c.chks[i].MinTime < c.chks[j].MinTime }
+func (c *chunksWithTrimmed) Swap(i, j int) {
+	c.chks[i], c.chks[j] = c.chks[j], c.chks[i]
+	c.trimmed[i], c.trimmed[j] = c.trimmed[j], c.trimmed[i]
+}
+
 // removeExactDuplicates returns chunks without 1:1 duplicates.
 // NOTE: input chunks has to be sorted by minTime.
 func removeExactDuplicates(chks []storepb.AggrChunk) []storepb.AggrChunk {
@@ -94,7 +313,9 @@ func (s *promSeriesSet) At() storage.Series {
 	if !s.initiated || s.set.Err() != nil {
 		return nil
 	}
-	return newChunkSeries(s.currLset, s.currChunks, s.mint, s.maxt, s.aggrs)
+	cs := newChunkSeries(s.currLset, s.currChunks, s.currTrimmed, s.mint, s.maxt, s.aggrs)
+	cs.corruptChunks = s.corruptChunks
+	return cs
 }
 
 func (s *promSeriesSet) Err() error {
@@ -138,19 +359,45 @@ type chunkSeries struct {
 	chunks     []storepb.AggrChunk
 	mint, maxt int64
 	aggrs      []storepb.Aggr
+
+	// trimmed marks, if not nil, chunks that have to be bounded to their MinTime and MaxTime.
+	trimmed []bool
+	// merge is true if samples of overlapping chunks have to be merged instead of skipping the overlapped range.
+	merge bool
+	// corruptChunks, if not nil, records chunks skipped as they fail to decode instead of failing the iteration.
+	corruptChunks *CorruptChunksTracker
 }
 
-// newChunkSeries allows to iterate over samples for each sorted and non-overlapped chunks.
-func newChunkSeries(lset labels.Labels, chunks []storepb.AggrChunk, mint, maxt int64, aggrs []storepb.Aggr) *chunkSeries {
+// newChunkSeries allows to iterate over samples for each sorted chunks. Overlapping raw chunks are merged sample by sample.
+func newChunkSeries(lset labels.Labels, chunks []storepb.AggrChunk, trimmed []bool, mint, maxt int64, aggrs []storepb.Aggr) *chunkSeries {
 	return &chunkSeries{
-		lset:   lset,
-		chunks: chunks,
-		mint:   mint,
-		maxt:   maxt,
-		aggrs:  aggrs,
+		lset:    lset,
+		chunks:  chunks,
+		trimmed: trimmed,
+		merge:   overlappingRawChunks(chunks),
+		mint:    mint,
+		maxt:    maxt,
+		aggrs:   aggrs,
 	}
 }
 
+// overlappingRawChunks returns true if chunks consist of raw chunks only and at least two of them overlap in time.
+// This happens e.g. for blocks written by Prometheus with out-of-order ingestion enabled.
+// Downsampled chunks are never merged, as counter aggregates carry special samples that must not be deduplicated.
+// NOTE: input chunks has to be sorted by minTime.
+func overlappingRawChunks(chks []storepb.AggrChunk) bool {
+	overlap := false
+	for i, c := range chks {
+		if c.Raw == nil {
+			return false
+		}
+		if i > 0 && c.MinTime <= chks[i-1].MaxTime {
+			overlap = true
+		}
+	}
+	return overlap
+}
+
 func (s *chunkSeries) Labels() labels.Labels {
 	return s.lset
 }
@@ -162,28 +409,32 @@ func (s *chunkSeries) Iterator() chunkenc.Iterator {
 	if len(s.aggrs) == 1 {
 		switch s.aggrs[0] {
 		case storepb.Aggr_COUNT:
-			for _, c := range s.chunks {
-				its = append(its, getFirstIterator(c.Count, c.Raw))
+			for i, c := range s.chunks {
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Count, c.Raw))))
 			}
-			sit = newChunkSeriesIterator(its)
+			sit = s.chunksIterator(its)
 		case storepb.Aggr_SUM:
-			for _, c := range s.chunks {
-				its = append(its, getFirstIterator(c.Sum, c.Raw))
+			for i, c := range s.chunks {
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Sum, c.Raw))))
 			}
-			sit = newChunkSeriesIterator(its)
+			sit = s.chunksIterator(its)
 		case storepb.Aggr_MIN:
-			for _, c := range s.chunks {
-				its = append(its, getFirstIterator(c.Min, c.Raw))
+			for i, c := range s.chunks {
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Min, c.Raw))))
 			}
-			sit = newChunkSeriesIterator(its)
+			sit = s.chunksIterator(its)
 		case storepb.Aggr_MAX:
-			for _, c := range s.chunks {
-				its = append(its, getFirstIterator(c.Max, c.Raw))
+			for i, c := range s.chunks {
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Max, c.Raw))))
 			}
-			sit = newChunkSeriesIterator(its)
+			sit = s.chunksIterator(its)
 		case storepb.Aggr_COUNTER:
-			for _, c := range s.chunks {
-				its = append(its, getFirstIterator(c.Counter, c.Raw))
+			for i, c := range s.chunks {
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Counter, c.Raw))))
+			}
+			if s.merge {
+				// Counter resets have to be applied on samples already merged in time order.
+				its = []chunkenc.Iterator{newMergedChunkSeriesIterator(its)}
 			}
 			sit = downsample.NewApplyCounterResetsIterator(its...)
 		default:
@@ -200,21 +451,78 @@ func (s *chunkSeries) Iterator() chunkenc.Iterator {
 	case s.aggrs[0] == storepb.Aggr_SUM && s.aggrs[1] == storepb.Aggr_COUNT,
 		s.aggrs[0] == storepb.Aggr_COUNT && s.aggrs[1] == storepb.Aggr_SUM:
 
-		for _, c := range s.chunks {
+		for i, c := range s.chunks {
 			if c.Raw != nil {
-				its = append(its, getFirstIterator(c.Raw))
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, getFirstIterator(c.Raw))))
 			} else {
 				sum, cnt := getFirstIterator(c.Sum), getFirstIterator(c.Count)
-				its = append(its, downsample.NewAverageChunkIterator(cnt, sum))
+				its = append(its, s.boundTrimmed(i, s.skipCorrupt(c, downsample.NewAverageChunkIterator(cnt, sum))))
 			}
 		}
-		sit = newChunkSeriesIterator(its)
+		sit = s.chunksIterator(its)
 	default:
 		return errSeriesIterator{err: errors.Errorf("unexpected result aggregate type %v", s.aggrs)}
 	}
 	return newBoundedSeriesIterator(sit, s.mint, s.maxt)
 }
 
+// chunksIterator returns an iterator over samples of all given chunk iterators.
+func (s *chunkSeries) chunksIterator(its []chunkenc.Iterator) chunkenc.Iterator {
+	if s.merge {
+		return newMergedChunkSeriesIterator(its)
+	}
+	return newChunkSeriesIterator(its, s.maxTimes())
+}
+
+// maxTimes returns the maximum time of each chunk.
+func (s *chunkSeries) maxTimes() []int64 {
+	ts := make([]int64, len(s.chunks))
+	for i, c := range s.chunks {
+		ts[i] = c.MaxTime
+	}
+	return ts
+}
+
+// skipCorrupt makes the iterator of the chunk skip the rest of the chunk once it fails to decode, if corrupt chunks
+// are skipped.
+func (s *chunkSeries) skipCorrupt(c storepb.AggrChunk, it chunkenc.Iterator) chunkenc.Iterator {
+	if s.corruptChunks == nil {
+		return it
+	}
+	return &corruptChunkSkippingIterator{Iterator: it, onCorrupt: func() {
+		s.corruptChunks.record(s.lset, c.MinTime, c.MaxTime)
+	}}
+}
+
+// boundTrimmed bounds the iterator of the i-th chunk to the chunk's time range if the chunk was trimmed.
+func (s *chunkSeries) boundTrimmed(i int, it chunkenc.Iterator) chunkenc.Iterator {
+	if s.trimmed == nil || !s.trimmed[i] {
+		return it
+	}
+	return &trimmedChunkIterator{Iterator: it, mint: s.chunks[i].MinTime, maxt: s.chunks[i].MaxTime}
+}
+
+// trimmedChunkIterator emits samples of a single chunk only within a fixed time range.
+// In contrast to boundedSeriesIterator it never calls Seek on the underlying iterator, as not all chunk iterators
+// (e.g. downsample.AverageChunkIterator) implement it. Chunk iterators are only advanced with Next, so Seek is not
+// bounded.
+type trimmedChunkIterator struct {
+	chunkenc.Iterator
+
+	mint, maxt int64
+}
+
+func (it *trimmedChunkIterator) Next() bool {
+	for it.Iterator.Next() {
+		t, _ := it.Iterator.At()
+		if t < it.mint {
+			continue
+		}
+		return t <= it.maxt
+	}
+	return false
+}
+
 func getFirstIterator(cs ...*storepb.Chunk) chunkenc.Iterator {
 	for _, c := range cs {
 		if c == nil {
@@ -226,9 +534,11 @@ func getFirstIterator(cs ...*storepb.Chunk) chunkenc.Iterator {
 		}
 		return chk.Iterator(nil)
 	}
-	return errSeriesIterator{errors.New("no valid chunk found")}
+	return errSeriesIterator{errNoValidChunk}
 }
 
+var errNoValidChunk = errors.New("no valid chunk found")
+
 func chunkEncoding(e storepb.Chunk_Encoding) chunkenc.Encoding {
 	switch e {
 	case storepb.Chunk_XOR:
@@ -292,25 +602,77 @@ func (it *boundedSeriesIterator) Err() error {
 	return it.it.Err()
 }
 
+// sampleIterator is a chunkenc.Iterator that can only be advanced with Next.
+type sampleIterator interface {
+	Next() bool
+	At() (int64, float64)
+	Err() error
+}
+
 // chunkSeriesIterator implements a series iterator on top
 // of a list of time-sorted, non-overlapping chunks.
 type chunkSeriesIterator struct {
-	chunks []chunkenc.Iterator
-	i      int
+	chunks []sampleIterator
+	// maxTimes holds the maximum sample time of each chunk, if known, so that Seek can skip chunks without decoding them.
+	maxTimes []int64
+	i        int
+	started  bool
+	// done is true once all chunks are exhausted or one of them failed.
+	done bool
 }
 
-func newChunkSeriesIterator(cs []chunkenc.Iterator) chunkenc.Iterator {
+func newChunkSeriesIterator(cs []chunkenc.Iterator, maxTimes []int64) chunkenc.Iterator {
 	if len(cs) == 0 {
 		// This should not happen. StoreAPI implementations should not send empty results.
 		return errSeriesIterator{err: errors.Errorf("store returned an empty result")}
 	}
-	return &chunkSeriesIterator{chunks: cs}
+	chunks := make([]sampleIterator, 0, len(cs))
+	for _, c := range cs {
+		chunks = append(chunks, c)
+	}
+	return &chunkSeriesIterator{chunks: chunks, maxTimes: maxTimes}
+}
+
+// seekByNext returns a series iterator over samples of the given iterator, implementing Seek by calling Next
+// until the requested time is reached.
+func seekByNext(it sampleIterator) chunkenc.Iterator {
+	return &chunkSeriesIterator{chunks: []sampleIterator{it}}
 }
 
 func (it *chunkSeriesIterator) Seek(t int64) (ok bool) {
+	if it.done {
+		return false
+	}
+	// Chunks ending before t cannot hold the sample we look for. Skipping them based on their time bounds avoids
+	// decoding all samples in between, which matters for sparse series when the engine seeks to every step.
+	if it.maxTimes != nil && it.maxTimes[it.i] < t {
+		for i := it.i + 1; ; i++ {
+			if i == len(it.chunks) {
+				it.done = true
+				return false
+			}
+			if it.maxTimes[i] < t {
+				continue
+			}
+			it.i = i
+			it.started = true
+			if it.chunks[i].Next() {
+				break
+			}
+			if it.Err() != nil {
+				it.done = true
+				return false
+			}
+			// The chunk has no samples at all, e.g. it was trimmed to a range without any, so look further.
+		}
+	}
+
 	// We generally expect the chunks already to be cut down
 	// to the range we are interested in. There's not much to be gained from
-	// hopping across chunks so we just call next until we reach t.
+	// hopping within a chunk so we just call next until we reach t.
+	if !it.started && !it.Next() {
+		return false
+	}
 	for {
 		ct, _ := it.At()
 		if ct >= t {
@@ -327,15 +689,20 @@ func (it *chunkSeriesIterator) At() (t int64, v float64) {
 }
 
 func (it *chunkSeriesIterator) Next() bool {
-	lastT, _ := it.At()
+	if it.done {
+		return false
+	}
+	var lastT int64
+	if it.started {
+		lastT, _ = it.At()
+	}
+	it.started = true
 
 	if it.chunks[it.i].Next() {
 		return true
 	}
-	if it.Err() != nil {
-		return false
-	}
-	if it.i >= len(it.chunks)-1 {
+	if it.Err() != nil || it.i >= len(it.chunks)-1 {
+		it.done = true
 		return false
 	}
 	// Chunks are guaranteed to be ordered but not generally guaranteed to not overlap.
@@ -348,19 +715,181 @@ func (it *chunkSeriesIterator) Err() error {
 	return it.chunks[it.i].Err()
 }
 
+// mergedChunkSeriesIterator implements a series iterator on top of a list of possibly overlapping chunks
+// with out-of-order samples between them. Samples are merged on the fly in time order. Samples with the same
+// timestamp are emitted only once, taking the value of the earliest chunk.
+type mergedChunkSeriesIterator struct {
+	chunks []chunkenc.Iterator
+	// ok marks chunks that still have a sample available at At.
+	ok []bool
+	// curr is the index of the chunk holding the current sample, -1 before the first Next.
+	curr int
+	// done is true once all chunks are exhausted or one of them failed.
+	done bool
+	err  error
+}
+
+func newMergedChunkSeriesIterator(cs []chunkenc.Iterator) chunkenc.Iterator {
+	if len(cs) == 0 {
+		// This should not happen. StoreAPI implementations should not send empty results.
+		return errSeriesIterator{err: errors.Errorf("store returned an empty result")}
+	}
+	// Not all chunk iterators implement Seek (e.g. downsample.AverageChunkIterator), so we just call next until we reach t.
+	return seekByNext(&mergedChunkSeriesIterator{chunks: cs, ok: make([]bool, len(cs)), curr: -1})
+}
+
+func (it *mergedChunkSeriesIterator) At() (t int64, v float64) {
+	if it.curr < 0 {
+		return 0, 0
+	}
+	return it.chunks[it.curr].At()
+}
+
+func (it *mergedChunkSeriesIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	if it.curr < 0 {
+		for i, c := range it.chunks {
+			it.ok[i] = it.advance(c)
+		}
+	} else {
+		// Move all chunks past the current sample. This drops samples with the same timestamp in other chunks.
+		lastT, _ := it.At()
+		for i, c := range it.chunks {
+			for it.ok[i] {
+				if t, _ := c.At(); t > lastT {
+					break
+				}
+				it.ok[i] = it.advance(c)
+			}
+		}
+	}
+	if it.err != nil {
+		it.done = true
+		return false
+	}
+
+	next := -1
+	var nextT int64
+	for i, c := range it.chunks {
+		if !it.ok[i] {
+			continue
+		}
+		if t, _ := c.At(); next < 0 || t < nextT {
+			next, nextT = i, t
+		}
+	}
+	if next < 0 {
+		it.done = true
+		return false
+	}
+	it.curr = next
+	return true
+}
+
+func (it *mergedChunkSeriesIterator) advance(c chunkenc.Iterator) bool {
+	if c.Next() {
+		return true
+	}
+	if err := c.Err(); err != nil && it.err == nil {
+		it.err = err
+	}
+	return false
+}
+
+func (it *mergedChunkSeriesIterator) Err() error {
+	return it.err
+}
+
+// maxReplicaIndex is the highest replica index tracked separately by dedup metrics. Samples of replicas with higher
+// index are accounted together, to keep cardinality bounded regardless of the number of replicas.
+const maxReplicaIndex = 3
+
+// dedupMetrics describe how effective deduplication is. A collapse ratio close to 1 for data expected to be replicated
+// suggests misconfigured replica labels.
+type dedupMetrics struct {
+	inputSeries   prometheus.Counter
+	outputSeries  prometheus.Counter
+	collapseRatio prometheus.Histogram
+	// singleReplicaSeries counts series present in one replica only, if flagging them is enabled.
+	singleReplicaSeries prometheus.Counter
+	// counterResetSeries counts counter series with resets caused by switching replicas, if flagging them is enabled.
+	counterResetSeries prometheus.Counter
+	// chosenSamples are indexed by replica index, capped at maxReplicaIndex.
+	chosenSamples []prometheus.Counter
+}
+
+func newDedupMetrics(reg prometheus.Registerer) *dedupMetrics {
+	m := &dedupMetrics{
+		inputSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_input_series_total",
+			Help: "Total number of series entering deduplication.",
+		}),
+		outputSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_output_series_total",
+			Help: "Total number of series returned by deduplication.",
+		}),
+		collapseRatio: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "thanos_query_dedup_collapse_ratio",
+			Help:    "Ratio of series entering and returned by deduplication of a single select.",
+			Buckets: []float64{1, 1.25, 1.5, 2, 2.5, 3, 4, 6},
+		}),
+		singleReplicaSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_single_replica_series_total",
+			Help: "Total number of series with replica labels returned by deduplication that were present in one replica only. Counted only if flagging such series is enabled.",
+		}),
+		counterResetSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_replica_counter_reset_series_total",
+			Help: "Total number of deduplicated counter series with counter resets caused by switching between replicas rather than by restarts. Counted only if flagging such series is enabled.",
+		}),
+	}
+	samples := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_query_dedup_chosen_samples_total",
+		Help: "Total number of samples chosen by deduplication of series with multiple replicas, by index of the replica in the order of replica label values.",
+	}, []string{"replica_index"})
+	for i := 0; i <= maxReplicaIndex; i++ {
+		v := strconv.Itoa(i)
+		if i == maxReplicaIndex {
+			v += "+"
+		}
+		m.chosenSamples = append(m.chosenSamples, samples.WithLabelValues(v))
+	}
+	return m
+}
+
 type dedupSeriesSet struct {
 	set           storage.SeriesSet
 	replicaLabels map[string]struct{}
 	isCounter     bool
+	maxPenalty    int64
 
 	replicas []storage.Series
 	lset     labels.Labels
 	peek     storage.Series
 	ok       bool
+
+	metrics                   *dedupMetrics
+	inputSeries, outputSeries int
+
+	// flagSingleReplica enables counting series present in one replica only.
+	flagSingleReplica   bool
+	singleReplicaSeries int
+	// counterResets, if not nil, records counter series with resets caused by switching between replicas.
+	counterResets *CounterResetsTracker
+	exhausted     bool
 }
 
-func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}, isCounter bool) storage.SeriesSet {
-	s := &dedupSeriesSet{set: set, replicaLabels: replicaLabels, isCounter: isCounter}
+// newDedupSeriesSet returns a SeriesSet deduplicating series of the given set, which differ only in replica labels.
+// If maxPenalty is positive, it caps the penalty, in milliseconds, by which replicas not chosen are skipped ahead.
+// If flagSingleReplica is true, series with replica labels present in one replica only are passed through as usual,
+// but reported with a warning, as they often indicate targets scraped by some replicas only.
+// If counterResets is not nil, counter series with resets caused by switching between replicas, see
+// counterResetsIterator, are passed through as usual, but recorded in it while they are iterated.
+// If metrics is not nil, it is updated with the effectiveness of the deduplication.
+func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}, isCounter bool, maxPenalty int64, flagSingleReplica bool, counterResets *CounterResetsTracker, metrics *dedupMetrics) storage.SeriesSet {
+	s := &dedupSeriesSet{set: set, replicaLabels: replicaLabels, isCounter: isCounter, maxPenalty: maxPenalty, flagSingleReplica: flagSingleReplica, counterResets: counterResets, metrics: metrics}
 	s.ok = s.set.Next()
 	if s.ok {
 		s.peek = s.set.At()
@@ -370,13 +899,37 @@ func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{},
 
 func (s *dedupSeriesSet) Next() bool {
 	if !s.ok {
+		s.observe()
 		return false
 	}
 	// Set the label set we are currently gathering to the peek element
 	// without the replica label if it exists.
 	s.lset = s.peekLset()
 	s.replicas = append(s.replicas[:0], s.peek)
-	return s.next()
+	if !s.next() {
+		s.observe()
+		return false
+	}
+	s.inputSeries += len(s.replicas)
+	s.outputSeries++
+	// Series without replica labels, e.g. recorded by a single ruler, are not replicated at all.
+	if s.flagSingleReplica && len(s.replicas) == 1 && len(s.replicas[0].Labels()) > len(s.lset) {
+		s.singleReplicaSeries++
+	}
+	return true
+}
+
+// observe updates metrics once the set is exhausted.
+func (s *dedupSeriesSet) observe() {
+	s.exhausted = true
+	if s.metrics == nil || s.outputSeries == 0 {
+		return
+	}
+	s.metrics.singleReplicaSeries.Add(float64(s.singleReplicaSeries))
+	s.metrics.inputSeries.Add(float64(s.inputSeries))
+	s.metrics.outputSeries.Add(float64(s.outputSeries))
+	s.metrics.collapseRatio.Observe(float64(s.inputSeries) / float64(s.outputSeries))
+	s.inputSeries, s.outputSeries = 0, 0
 }
 
 // peekLset returns the label set of the current peek element stripped from the
@@ -427,7 +980,20 @@ func (s *dedupSeriesSet) At() storage.Series {
 	// Clients may store the series, so we must make a copy of the slice before advancing.
 	repl := make([]storage.Series, len(s.replicas))
 	copy(repl, s.replicas)
-	return newDedupSeries(s.lset, repl, s.isCounter)
+	ds := newDedupSeries(s.lset, repl, s.isCounter)
+	ds.maxPenalty = s.maxPenalty
+	if s.metrics != nil {
+		ds.chosenSamples = s.metrics.chosenSamples
+	}
+	if s.counterResets != nil && (s.isCounter || isCounterName(s.lset.Get(labels.MetricName))) {
+		lset, tracker, metrics := s.lset, s.counterResets, s.metrics
+		ds.onCounterReset = func() {
+			if tracker.record(lset) && metrics != nil {
+				metrics.counterResetSeries.Inc()
+			}
+		}
+	}
+	return ds
 }
 
 func (s *dedupSeriesSet) Err() error {
@@ -435,7 +1001,21 @@ func (s *dedupSeriesSet) Err() error {
 }
 
 func (s *dedupSeriesSet) Warnings() storage.Warnings {
-	return s.set.Warnings()
+	ws := s.set.Warnings()
+	if !s.exhausted || s.singleReplicaSeries == 0 {
+		return ws
+	}
+	return append(append(storage.Warnings{}, ws...), errors.Errorf("%d series are present in one replica only, which may indicate targets scraped by some replicas only", s.singleReplicaSeries))
+}
+
+// isCounterName returns true if the metric name follows naming conventions of counters.
+func isCounterName(name string) bool {
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
 type seriesWithLabels struct {
@@ -450,6 +1030,13 @@ type dedupSeries struct {
 	replicas []storage.Series
 
 	isCounter bool
+	// maxPenalty, if positive, caps the penalty of replicas not chosen.
+	maxPenalty int64
+	// chosenSamples, if not nil, count samples chosen from each replica, indexed by replica index.
+	chosenSamples []prometheus.Counter
+	// onCounterReset, if not nil, is called once per iterator at the first counter reset caused by switching between
+	// replicas.
+	onCounterReset func()
 }
 
 func newDedupSeries(lset labels.Labels, replicas []storage.Series, isCounter bool) *dedupSeries {
@@ -461,25 +1048,122 @@ func (s *dedupSeries) Labels() labels.Labels {
 }
 
 func (s *dedupSeries) Iterator() chunkenc.Iterator {
-	var it adjustableSeriesIterator
-	if s.isCounter {
-		it = &counterErrAdjustSeriesIterator{Iterator: s.replicas[0].Iterator()}
-	} else {
-		it = noopAdjustableSeriesIterator{Iterator: s.replicas[0].Iterator()}
+	its := make([]chunkenc.Iterator, 0, len(s.replicas))
+	if s.onCounterReset == nil {
+		for _, r := range s.replicas {
+			its = append(its, r.Iterator())
+		}
+		return s.dedupIterator(its, s.chosenSamples != nil)
+	}
+
+	resetIts := make([]*resetTrackingIterator, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		it := newResetTrackingIterator(r.Iterator())
+		resetIts = append(resetIts, it)
+		its = append(its, seekByNext(it))
 	}
+	// Iterate over Next, like the deduplicating iterator does, so no switch between replicas is missed.
+	return seekByNext(&counterResetsIterator{Iterator: s.dedupIterator(its, true), resetIts: resetIts, onReset: s.onCounterReset, lastReplica: -1})
+}
 
-	for _, o := range s.replicas[1:] {
-		var replicaIter adjustableSeriesIterator
+// dedupIterator returns an iterator deduplicating the given iterators of replicas. If indexReplicas is true, it
+// implements replicaIndexer.
+func (s *dedupSeries) dedupIterator(its []chunkenc.Iterator, indexReplicas bool) chunkenc.Iterator {
+	replicaIterator := func(i int) adjustableSeriesIterator {
+		var it adjustableSeriesIterator
 		if s.isCounter {
-			replicaIter = &counterErrAdjustSeriesIterator{Iterator: o.Iterator()}
+			it = &counterErrAdjustSeriesIterator{Iterator: its[i]}
 		} else {
-			replicaIter = noopAdjustableSeriesIterator{Iterator: o.Iterator()}
+			it = noopAdjustableSeriesIterator{Iterator: its[i]}
 		}
-		it = newDedupSeriesIterator(it, replicaIter)
+		if indexReplicas {
+			it = replicaSeriesIterator{adjustableSeriesIterator: it, replica: i}
+		}
+		return it
+	}
+
+	it := replicaIterator(0)
+	for i := range s.replicas[1:] {
+		d := newDedupSeriesIterator(it, replicaIterator(i+1))
+		d.maxPenalty = s.maxPenalty
+		it = d
+	}
+	if d, ok := it.(*dedupSeriesIterator); ok {
+		d.chosenSamples = s.chosenSamples
 	}
 	return it
 }
 
+// counterResetsIterator is chunkenc.Iterator of a deduplicated counter series detecting counter resets caused by
+// switching between replicas while the series is iterated. Such a reset is a decrease of the value at a switch to a
+// replica which did not decrease itself since the previous sample of the deduplicated series, e.g. because replicas lag
+// behind each other or scrape different targets. Decreases with the replica switched to decreasing too are genuine
+// restarts seen by both replicas. Values are compared before adjusting for obsolete counter values, so resets masked by
+// counterErrAdjustSeriesIterator are detected too.
+type counterResetsIterator struct {
+	// Iterator is the deduplicating iterator of resetIts, implementing replicaIndexer.
+	chunkenc.Iterator
+
+	resetIts []*resetTrackingIterator
+	// onReset is called at the first detected reset.
+	onReset  func()
+	reported bool
+
+	lastReplica int
+	lastT       int64
+	lastV       float64
+}
+
+func (it *counterResetsIterator) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	i := it.Iterator.(replicaIndexer).currentReplica()
+	r := it.resetIts[i]
+	t, v := r.At()
+	if !it.reported && it.lastReplica >= 0 && i != it.lastReplica && v < it.lastV && r.firstT <= it.lastT && r.lastResetT <= it.lastT {
+		it.reported = true
+		it.onReset()
+	}
+	it.lastReplica, it.lastT, it.lastV = i, t, v
+	return true
+}
+
+// resetTrackingIterator is chunkenc.Iterator remembering when its values decreased the last time. It is advanced
+// with Next only, so no samples are skipped.
+type resetTrackingIterator struct {
+	chunkenc.Iterator
+
+	// firstT is the timestamp of the first sample.
+	firstT int64
+	// lastResetT is the timestamp of the last sample with value lower than the previous one.
+	lastResetT int64
+	prevV      float64
+}
+
+func newResetTrackingIterator(it chunkenc.Iterator) *resetTrackingIterator {
+	return &resetTrackingIterator{Iterator: it, firstT: math.MaxInt64, lastResetT: math.MinInt64, prevV: math.NaN()}
+}
+
+func (it *resetTrackingIterator) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	t, v := it.Iterator.At()
+	if t < it.firstT {
+		it.firstT = t
+	}
+	// Stale markers are not compared with.
+	if math.IsNaN(v) {
+		return true
+	}
+	if v < it.prevV {
+		it.lastResetT = t
+	}
+	it.prevV = v
+	return true
+}
+
 // adjustableSeriesIterator iterates over the data of a time series and allows to adjust current value based on
 // given lastValue iterated.
 type adjustableSeriesIterator interface {
@@ -490,6 +1174,20 @@ type adjustableSeriesIterator interface {
 	adjustAtValue(lastValue float64)
 }
 
+// replicaIndexer is implemented by iterators able to tell which replica the current sample comes from.
+type replicaIndexer interface {
+	currentReplica() int
+}
+
+// replicaSeriesIterator is adjustableSeriesIterator of a single replica with a known index.
+type replicaSeriesIterator struct {
+	adjustableSeriesIterator
+
+	replica int
+}
+
+func (it replicaSeriesIterator) currentReplica() int { return it.replica }
+
 type noopAdjustableSeriesIterator struct {
 	chunkenc.Iterator
 }
@@ -549,6 +1247,14 @@ type dedupSeriesIterator struct {
 
 	penA, penB int64
 	useA       bool
+	// maxPenalty, if positive, caps penalties, so a replica is never skipped further ahead than that after the last
+	// sample. It bounds the data of a replica, and the work of seeking over it, skipped after a long gap between
+	// samples, e.g. when both replicas were down. Penalties are meant to skip samples of the replica not chosen closer
+	// than a scrape interval though, so a window shorter than twice the scrape interval results in more samples.
+	maxPenalty int64
+
+	// chosenSamples, if not nil, count samples chosen from each replica, indexed by replica index.
+	chosenSamples []prometheus.Counter
 }
 
 func newDedupSeriesIterator(a, b adjustableSeriesIterator) *dedupSeriesIterator {
@@ -563,6 +1269,29 @@ func newDedupSeriesIterator(a, b adjustableSeriesIterator) *dedupSeriesIterator
 }
 
 func (it *dedupSeriesIterator) Next() bool {
+	if !it.next() {
+		return false
+	}
+	if it.chosenSamples != nil {
+		i := it.currentReplica()
+		if i > maxReplicaIndex {
+			i = maxReplicaIndex
+		}
+		it.chosenSamples[i].Inc()
+	}
+	return true
+}
+
+// currentReplica returns the index of the replica the current sample comes from. It requires replica iterators
+// to implement replicaIndexer.
+func (it *dedupSeriesIterator) currentReplica() int {
+	if it.useA {
+		return it.a.(replicaIndexer).currentReplica()
+	}
+	return it.b.(replicaIndexer).currentReplica()
+}
+
+func (it *dedupSeriesIterator) next() bool {
 	lastValue := it.lastV
 	lastUseA := it.useA
 	defer func() {
@@ -616,9 +1345,9 @@ func (it *dedupSeriesIterator) Next() bool {
 
 	if it.useA {
 		if it.lastT != math.MinInt64 {
-			it.penB = 2 * (ta - it.lastT)
+			it.penB = it.capPenalty(2 * (ta - it.lastT))
 		} else {
-			it.penB = initialPenalty
+			it.penB = it.capPenalty(initialPenalty)
 		}
 		it.penA = 0
 		it.lastT = ta
@@ -626,9 +1355,9 @@ func (it *dedupSeriesIterator) Next() bool {
 		return true
 	}
 	if it.lastT != math.MinInt64 {
-		it.penA = 2 * (tb - it.lastT)
+		it.penA = it.capPenalty(2 * (tb - it.lastT))
 	} else {
-		it.penA = initialPenalty
+		it.penA = it.capPenalty(initialPenalty)
 	}
 	it.penB = 0
 	it.lastT = tb
@@ -636,6 +1365,13 @@ func (it *dedupSeriesIterator) Next() bool {
 	return true
 }
 
+func (it *dedupSeriesIterator) capPenalty(pen int64) int64 {
+	if it.maxPenalty > 0 && pen > it.maxPenalty {
+		return it.maxPenalty
+	}
+	return pen
+}
+
 func (it *dedupSeriesIterator) adjustAtValue(lastValue float64) {
 	if it.aok {
 		it.a.adjustAtValue(lastValue)
@@ -708,3 +1444,85 @@ func (c *lazySeriesSet) Warnings() storage.Warnings {
 	}
 	return nil
 }
+
+// mergeTimeoutCheckInterval is the number of samples iterated between checks of the merge deadline.
+const mergeTimeoutCheckInterval = 128
+
+// mergeTimeoutSeriesSet fails iteration over the underlying set and its series once the merge deadline passed.
+type mergeTimeoutSeriesSet struct {
+	storage.SeriesSet
+
+	deadline time.Time
+	timeout  time.Duration
+	err      error
+}
+
+func newMergeTimeoutSeriesSet(set storage.SeriesSet, deadline time.Time, timeout time.Duration) *mergeTimeoutSeriesSet {
+	return &mergeTimeoutSeriesSet{SeriesSet: set, deadline: deadline, timeout: timeout}
+}
+
+func (s *mergeTimeoutSeriesSet) expired() bool {
+	if s.err == nil && time.Now().After(s.deadline) {
+		s.err = errors.Wrapf(context.DeadlineExceeded, "merging series exceeded merge timeout of %s", s.timeout)
+	}
+	return s.err != nil
+}
+
+func (s *mergeTimeoutSeriesSet) Next() bool {
+	if s.expired() {
+		return false
+	}
+	return s.SeriesSet.Next()
+}
+
+func (s *mergeTimeoutSeriesSet) At() storage.Series {
+	return &mergeTimeoutSeries{Series: s.SeriesSet.At(), set: s}
+}
+
+func (s *mergeTimeoutSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.SeriesSet.Err()
+}
+
+type mergeTimeoutSeries struct {
+	storage.Series
+
+	set *mergeTimeoutSeriesSet
+}
+
+func (s *mergeTimeoutSeries) Iterator() chunkenc.Iterator {
+	return &mergeTimeoutSeriesIterator{Iterator: s.Series.Iterator(), set: s.set}
+}
+
+// mergeTimeoutSeriesIterator stops iterating once the merge timeout expired. The timeout is checked by Next only, so
+// Seek keeps seeking the underlying iterator efficiently; the engine advances iterators with Next within each step.
+type mergeTimeoutSeriesIterator struct {
+	chunkenc.Iterator
+
+	set   *mergeTimeoutSeriesSet
+	calls int
+}
+
+func (it *mergeTimeoutSeriesIterator) expired() bool {
+	it.calls++
+	if it.calls%mergeTimeoutCheckInterval != 0 {
+		return it.set.err != nil
+	}
+	return it.set.expired()
+}
+
+func (it *mergeTimeoutSeriesIterator) Next() bool {
+	if it.expired() {
+		return false
+	}
+	return it.Iterator.Next()
+}
+
+func (it *mergeTimeoutSeriesIterator) Err() error {
+	if it.set.err != nil {
+		return it.set.err
+	}
+	return it.Iterator.Err()
+}
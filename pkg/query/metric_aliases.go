@@ -0,0 +1,137 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// MetricAliasMode decides which series are selected for an aliased metric name.
+type MetricAliasMode string
+
+const (
+	// MetricAliasReplace selects series of the new metric name only.
+	MetricAliasReplace MetricAliasMode = "replace"
+	// MetricAliasUnion selects series of both the old and the new metric name, e.g. while both are ingested
+	// during a rename.
+	MetricAliasUnion MetricAliasMode = "union"
+)
+
+// MetricAlias maps an old metric name to the new one it was renamed to.
+type MetricAlias struct {
+	From string          `yaml:"from"`
+	To   string          `yaml:"to"`
+	Mode MetricAliasMode `yaml:"mode"`
+}
+
+// MetricAliases rewrites selects of old metric names to their new names at query time, so that queries and dashboards
+// using the old name keep working after a rename. Selected series are always returned under the queried old name.
+type MetricAliases struct {
+	byName map[string]MetricAlias
+}
+
+// ParseMetricAliases parses the YAML list of metric aliases.
+func ParseMetricAliases(confYaml []byte) (*MetricAliases, error) {
+	var conf []MetricAlias
+	if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse metric aliases config")
+	}
+
+	a := &MetricAliases{byName: make(map[string]MetricAlias, len(conf))}
+	for _, c := range conf {
+		if !model.IsValidMetricName(model.LabelValue(c.From)) {
+			return nil, errors.Errorf("invalid metric name %q to alias from", c.From)
+		}
+		if !model.IsValidMetricName(model.LabelValue(c.To)) {
+			return nil, errors.Errorf("invalid metric name %q to alias %q to", c.To, c.From)
+		}
+		if c.From == c.To {
+			return nil, errors.Errorf("metric %q aliased to itself", c.From)
+		}
+		switch c.Mode {
+		case "":
+			c.Mode = MetricAliasReplace
+		case MetricAliasReplace, MetricAliasUnion:
+		default:
+			return nil, errors.Errorf("unknown mode %q of metric alias %q, expected %q or %q", c.Mode, c.From, MetricAliasReplace, MetricAliasUnion)
+		}
+		if _, ok := a.byName[c.From]; ok {
+			return nil, errors.Errorf("duplicate metric alias %q", c.From)
+		}
+		a.byName[c.From] = c
+	}
+	// Aliases are not resolved transitively, as the result would depend on the order of rewrites.
+	for _, c := range a.byName {
+		if _, ok := a.byName[c.To]; ok {
+			return nil, errors.Errorf("metric %q aliased to %q which is aliased itself", c.From, c.To)
+		}
+	}
+	return a, nil
+}
+
+// rewriteMatchers returns matchers selecting the series the alias of the queried metric name resolves to. Only
+// equality matchers of the metric name are rewritten. If no alias applies, matchers are returned as they are and
+// the returned alias is nil.
+func (a *MetricAliases) rewriteMatchers(ms []*labels.Matcher) ([]*labels.Matcher, *MetricAlias, error) {
+	if a == nil || len(a.byName) == 0 {
+		return ms, nil, nil
+	}
+	for i, m := range ms {
+		if m.Name != labels.MetricName || m.Type != labels.MatchEqual {
+			continue
+		}
+		alias, ok := a.byName[m.Value]
+		if !ok {
+			return ms, nil, nil
+		}
+
+		var rewritten *labels.Matcher
+		var err error
+		switch alias.Mode {
+		case MetricAliasUnion:
+			rewritten, err = labels.NewMatcher(labels.MatchRegexp, labels.MetricName, regexp.QuoteMeta(alias.From)+"|"+regexp.QuoteMeta(alias.To))
+		default:
+			rewritten, err = labels.NewMatcher(labels.MatchEqual, labels.MetricName, alias.To)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "rewrite matcher of metric alias %q", alias.From)
+		}
+
+		res := make([]*labels.Matcher, len(ms))
+		copy(res, ms)
+		res[i] = rewritten
+		return res, &alias, nil
+	}
+	return ms, nil, nil
+}
+
+// relabel renames series of the new metric name to the old, queried one. Series are re-sorted, so that series with
+// both names and otherwise equal labels become adjacent and are merged into one series like series from different
+// StoreAPIs are.
+func (a *MetricAlias) relabel(set []storepb.Series) {
+	renamed := false
+	for _, s := range set {
+		for i := range s.Labels {
+			if s.Labels[i].Name == labels.MetricName && s.Labels[i].Value == a.To {
+				s.Labels[i].Value = a.From
+				renamed = true
+			}
+		}
+	}
+	if !renamed {
+		return
+	}
+	sort.SliceStable(set, func(i, j int) bool {
+		return labels.Compare(labelpb.LabelsToPromLabels(set[i].Labels), labelpb.LabelsToPromLabels(set[j].Labels)) < 0
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/gate"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseMetricAliases(t *testing.T) {
+	a, err := ParseMetricAliases([]byte(`
+- from: http_requests
+  to: http_requests_total
+- from: node_cpu
+  to: node_cpu_seconds_total
+  mode: union
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]MetricAlias{
+		"http_requests": {From: "http_requests", To: "http_requests_total", Mode: MetricAliasReplace},
+		"node_cpu":      {From: "node_cpu", To: "node_cpu_seconds_total", Mode: MetricAliasUnion},
+	}, a.byName)
+
+	for _, tcase := range []struct {
+		name string
+		conf string
+	}{
+		{name: "invalid from", conf: `[{from: "1a", to: b}]`},
+		{name: "empty to", conf: `[{from: a}]`},
+		{name: "self alias", conf: `[{from: a, to: a}]`},
+		{name: "unknown mode", conf: `[{from: a, to: b, mode: merge}]`},
+		{name: "duplicate", conf: `[{from: a, to: b}, {from: a, to: c}]`},
+		{name: "chained", conf: `[{from: a, to: b}, {from: b, to: c}]`},
+		{name: "unknown field", conf: `[{from: a, to: b, foo: bar}]`},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := ParseMetricAliases([]byte(tcase.conf))
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+func TestMetricAliases_RewriteMatchers(t *testing.T) {
+	a, err := ParseMetricAliases([]byte(`[{from: old, to: new}, {from: "old:rate", to: "new:rate", mode: union}]`))
+	testutil.Ok(t, err)
+
+	other := labels.MustNewMatcher(labels.MatchEqual, "job", "a")
+	for _, tcase := range []struct {
+		name    string
+		ms      []*labels.Matcher
+		exp     []*labels.Matcher
+		aliased bool
+	}{
+		{
+			name:    "replace",
+			ms:      []*labels.Matcher{other, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "old")},
+			exp:     []*labels.Matcher{other, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "new")},
+			aliased: true,
+		},
+		{
+			name:    "union",
+			ms:      []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "old:rate"), other},
+			exp:     []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "old:rate|new:rate"), other},
+			aliased: true,
+		},
+		{
+			name: "not aliased name",
+			ms:   []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "new"), other},
+			exp:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "new"), other},
+		},
+		{
+			name: "regexp matcher",
+			ms:   []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "old")},
+			exp:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "old")},
+		},
+		{
+			name: "other label",
+			ms:   []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "name", "old")},
+			exp:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "name", "old")},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			orig := append([]*labels.Matcher{}, tcase.ms...)
+
+			ms, alias, err := a.rewriteMatchers(tcase.ms)
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(tcase.exp), len(ms))
+			for i := range tcase.exp {
+				testutil.Equals(t, tcase.exp[i].String(), ms[i].String())
+			}
+			testutil.Equals(t, tcase.aliased, alias != nil)
+			// Matchers of the caller must not be modified.
+			testutil.Equals(t, orig, tcase.ms)
+		})
+	}
+
+	t.Run("no aliases", func(t *testing.T) {
+		var none *MetricAliases
+		ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "old")}
+		res, alias, err := none.rewriteMatchers(ms)
+		testutil.Ok(t, err)
+		testutil.Equals(t, ms, res)
+		testutil.Assert(t, alias == nil, "expected no alias")
+	})
+}
+
+// requestStoreServer records the last Series request and responds with the given responses.
+type requestStoreServer struct {
+	storeServer
+
+	req *storepb.SeriesRequest
+}
+
+func (s *requestStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.req = r
+	return s.storeServer.Series(r, srv)
+}
+
+func TestQuerier_Select_MetricAliases(t *testing.T) {
+	a, err := ParseMetricAliases([]byte(`[{from: old, to: new, mode: union}]`))
+	testutil.Ok(t, err)
+
+	for _, dedup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dedup=%v", dedup), func(t *testing.T) {
+			// Responses are sorted by labels like StoreAPIs send them, so series of the new name come first.
+			storeAPI := &requestStoreServer{storeServer: storeServer{resps: []*storepb.SeriesResponse{
+				storeSeriesResponse(t, labels.FromStrings("__name__", "new", "a", "1", "replica", "r1"), []sample{{200, 2}, {300, 3}}),
+				storeSeriesResponse(t, labels.FromStrings("__name__", "new", "a", "2", "replica", "r1"), []sample{{100, 1}}),
+				storeSeriesResponse(t, labels.FromStrings("__name__", "old", "a", "1", "replica", "r1"), []sample{{100, 1}, {200, 2}}),
+				storeSeriesResponse(t, labels.FromStrings("__name__", "old", "a", "3", "replica", "r1"), []sample{{100, 1}}),
+			}}}
+			q := newQuerier(context.Background(), nil, 0, 1000, []string{"replica"}, nil, storeAPI, dedup, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{MetricAliases: a})
+			t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+			res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000}, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "old"))
+			exp := []series{
+				{lset: labels.FromStrings("__name__", "old", "a", "1", "replica", "r1"), samples: []sample{{100, 1}, {200, 2}, {300, 3}}},
+				{lset: labels.FromStrings("__name__", "old", "a", "2", "replica", "r1"), samples: []sample{{100, 1}}},
+				{lset: labels.FromStrings("__name__", "old", "a", "3", "replica", "r1"), samples: []sample{{100, 1}}},
+			}
+			if dedup {
+				for i := range exp {
+					exp[i].lset = labels.NewBuilder(exp[i].lset).Del("replica").Labels()
+				}
+			}
+			testSelectResponse(t, exp, res)
+			testutil.Equals(t, []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: "old|new"}}, storeAPI.req.Matchers)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/store"
+)
+
+// NegativeCache remembers selects that returned no series for a short time, so that repeated queries for missing
+// series (e.g. typos or decommissioned metrics) are answered without fanning out to StoreAPIs.
+//
+// Entry is invalidated once the state of StoreAPIs covering its time range changes, e.g. a store with new blocks
+// extends its time range or a new store appears, as such a change could bring the missing series.
+type NegativeCache struct {
+	mtx sync.Mutex
+
+	lru    *lru.LRU
+	ttl    time.Duration
+	stores func() []store.Client
+	now    func() time.Time
+
+	requests      prometheus.Counter
+	hits          prometheus.Counter
+	added         prometheus.Counter
+	evicted       prometheus.Counter
+	invalidations prometheus.Counter
+	current       prometheus.Gauge
+}
+
+type negativeCacheEntry struct {
+	mint, maxt int64
+	expires    time.Time
+	storesHash uint64
+}
+
+// NewNegativeCache returns a NegativeCache holding at most maxEntries entries, each for at most ttl.
+// stores returns StoreAPIs queried by the querier and is used to detect data that could contain cached series.
+func NewNegativeCache(reg prometheus.Registerer, ttl time.Duration, maxEntries int, stores func() []store.Client) (*NegativeCache, error) {
+	c := &NegativeCache{
+		ttl:    ttl,
+		stores: stores,
+		now:    time.Now,
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_negative_cache_requests_total",
+			Help: "Total number of select requests to the negative cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_negative_cache_hits_total",
+			Help: "Total number of select requests to the negative cache answered without querying StoreAPIs.",
+		}),
+		added: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_negative_cache_items_added_total",
+			Help: "Total number of selects without series that were added to the negative cache.",
+		}),
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_negative_cache_items_evicted_total",
+			Help: "Total number of items that were evicted from the negative cache due to its size limit.",
+		}),
+		invalidations: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_negative_cache_items_invalidated_total",
+			Help: "Total number of items that were removed from the negative cache due to changed StoreAPIs or expired TTL.",
+		}),
+		current: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_query_negative_cache_items",
+			Help: "Current number of items in the negative cache.",
+		}),
+	}
+
+	l, err := lru.NewLRU(maxEntries, func(interface{}, interface{}) {
+		c.current.Dec()
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+	return c, nil
+}
+
+// Contains returns true if a select with the given key is known to return no series.
+func (c *NegativeCache) Contains(key string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.requests.Inc()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return false
+	}
+	e := v.(negativeCacheEntry)
+	if c.now().After(e.expires) || c.storesHash(e.mint, e.maxt) != e.storesHash {
+		c.remove(key)
+		return false
+	}
+	c.hits.Inc()
+	return true
+}
+
+// Add records that a select with the given key and time range returned no series.
+func (c *NegativeCache) Add(key string, mint, maxt int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Replace the entry if present, so its TTL is refreshed.
+	c.lru.Remove(key)
+	c.current.Inc()
+	if c.lru.Add(key, negativeCacheEntry{
+		mint:       mint,
+		maxt:       maxt,
+		expires:    c.now().Add(c.ttl),
+		storesHash: c.storesHash(mint, maxt),
+	}) {
+		c.evicted.Inc()
+	}
+	c.added.Inc()
+}
+
+func (c *NegativeCache) remove(key string) {
+	c.lru.Remove(key)
+	c.invalidations.Inc()
+}
+
+// storesHash returns hash of StoreAPIs overlapping the given time range, including parts of their time ranges within it.
+func (c *NegativeCache) storesHash(mint, maxt int64) uint64 {
+	var hashes []uint64
+	for _, st := range c.stores() {
+		smint, smaxt := st.TimeRange()
+		if smint > maxt || smaxt < mint {
+			continue
+		}
+		if smint < mint {
+			smint = mint
+		}
+		if smaxt > maxt {
+			smaxt = maxt
+		}
+
+		b := make([]byte, 0, 64)
+		b = append(b, st.Addr()...)
+		b = strconv.AppendInt(append(b, '\xff'), smint, 10)
+		b = strconv.AppendInt(append(b, '\xff'), smaxt, 10)
+		for _, lset := range st.LabelSets() {
+			b = append(append(b, '\xff'), lset.String()...)
+		}
+		hashes = append(hashes, xxhash.Sum64(b))
+	}
+
+	// Order of stores is not guaranteed.
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	b := make([]byte, 8*len(hashes))
+	for i, h := range hashes {
+		binary.LittleEndian.PutUint64(b[8*i:], h)
+	}
+	return xxhash.Sum64(b)
+}
+
+// newNegativeCacheKey returns key identifying results of a select.
+func newNegativeCacheKey(mint, maxt, maxResolutionMillis int64, storeDebugMatchers [][]*labels.Matcher, matchers []*labels.Matcher) string {
+	var b strings.Builder
+	b.WriteString(strconv.FormatInt(mint, 10))
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatInt(maxt, 10))
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatInt(maxResolutionMillis, 10))
+	for _, ms := range storeDebugMatchers {
+		b.WriteByte(':')
+		for _, m := range ms {
+			b.WriteString(m.String())
+			b.WriteByte(',')
+		}
+	}
+	b.WriteByte('|')
+	for _, m := range matchers {
+		b.WriteString(m.String())
+		b.WriteByte(',')
+	}
+	return b.String()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/gate"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type negativeCacheTestStore struct {
+	// Just to pass interface check.
+	store.Client
+
+	addr       string
+	mint, maxt int64
+	labelSets  []labels.Labels
+}
+
+func (s *negativeCacheTestStore) TimeRange() (int64, int64)  { return s.mint, s.maxt }
+func (s *negativeCacheTestStore) LabelSets() []labels.Labels { return s.labelSets }
+func (s *negativeCacheTestStore) Addr() string               { return s.addr }
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stores := []store.Client{
+		&negativeCacheTestStore{addr: "store-1", mint: 0, maxt: 100, labelSets: []labels.Labels{labels.FromStrings("ext", "1")}},
+		&negativeCacheTestStore{addr: "store-2", mint: 200, maxt: 300},
+	}
+	newCache := func(t *testing.T, maxEntries int) *NegativeCache {
+		c, err := NewNegativeCache(prometheus.NewRegistry(), time.Minute, maxEntries, func() []store.Client { return stores })
+		testutil.Ok(t, err)
+		c.now = func() time.Time { return now }
+		return c
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		c := newCache(t, 10)
+		testutil.Assert(t, !c.Contains("a"), "expected miss for unknown key")
+
+		c.Add("a", 50, 150)
+		testutil.Assert(t, c.Contains("a"), "expected hit for added key")
+		testutil.Equals(t, 2.0, promtestutil.ToFloat64(c.requests))
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.hits))
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.current))
+	})
+	t.Run("ttl expired", func(t *testing.T) {
+		c := newCache(t, 10)
+		c.Add("a", 50, 150)
+		c.now = func() time.Time { return now.Add(2 * time.Minute) }
+		testutil.Assert(t, !c.Contains("a"), "expected miss for expired key")
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.invalidations))
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(c.current))
+	})
+	t.Run("size is bounded", func(t *testing.T) {
+		c := newCache(t, 2)
+		c.Add("a", 50, 150)
+		c.Add("b", 50, 150)
+		c.Add("c", 50, 150)
+		testutil.Assert(t, !c.Contains("a"), "expected least recently used key to be evicted")
+		testutil.Assert(t, c.Contains("b"), "expected hit")
+		testutil.Assert(t, c.Contains("c"), "expected hit")
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.evicted))
+		testutil.Equals(t, 2.0, promtestutil.ToFloat64(c.current))
+	})
+	t.Run("new block within entry range invalidates it", func(t *testing.T) {
+		c := newCache(t, 10)
+		c.Add("a", 50, 150)
+		c.Add("b", 0, 80)
+
+		// New block extends the time range of the first store.
+		stores[0].(*negativeCacheTestStore).maxt = 120
+		defer func() { stores[0].(*negativeCacheTestStore).maxt = 100 }()
+
+		testutil.Assert(t, !c.Contains("a"), "expected entry overlapping new block to be invalidated")
+		testutil.Assert(t, c.Contains("b"), "expected entry not overlapping new block to be kept")
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.invalidations))
+	})
+	t.Run("new store within entry range invalidates it", func(t *testing.T) {
+		c := newCache(t, 10)
+		c.Add("a", 50, 150)
+		c.Add("b", 250, 280)
+
+		stores = append(stores, &negativeCacheTestStore{addr: "store-3", mint: 0, maxt: 60})
+		defer func() { stores = stores[:2] }()
+
+		testutil.Assert(t, !c.Contains("a"), "expected entry overlapping new store to be invalidated")
+		testutil.Assert(t, c.Contains("b"), "expected entry not overlapping new store to be kept")
+	})
+}
+
+type countingStoreServer struct {
+	storeServer
+
+	calls int
+	// noCache is true if the last request asked to skip caches.
+	noCache bool
+}
+
+func (s *countingStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.calls++
+	s.noCache = store.IsNoCache(srv.Context())
+	return s.storeServer.Series(r, srv)
+}
+
+func TestQuerier_Select_NegativeCache(t *testing.T) {
+	st := &negativeCacheTestStore{addr: "store", mint: 0, maxt: 500}
+	c, err := NewNegativeCache(prometheus.NewRegistry(), time.Minute, 10, func() []store.Client { return []store.Client{st} })
+	testutil.Ok(t, err)
+
+	server := &countingStoreServer{}
+	selectSeriesWithContext := func(ctx context.Context, t *testing.T, matchers ...*labels.Matcher) int {
+		q := newQuerier(ctx, nil, 0, 1000, nil, nil, server, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{NegativeCache: c})
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000}, matchers...)
+		var n int
+		for res.Next() {
+			n++
+		}
+		testutil.Ok(t, res.Err())
+		return n
+	}
+	selectSeries := func(t *testing.T, matchers ...*labels.Matcher) int {
+		return selectSeriesWithContext(context.Background(), t, matchers...)
+	}
+
+	missing := labels.MustNewMatcher(labels.MatchEqual, "__name__", "missing")
+	testutil.Equals(t, 0, selectSeries(t, missing))
+	testutil.Equals(t, 1, server.calls)
+
+	// Repeated miss is answered from the cache.
+	testutil.Equals(t, 0, selectSeries(t, missing))
+	testutil.Equals(t, 1, server.calls)
+
+	// Unless the request skips caches, which is forwarded to StoreAPIs.
+	testutil.Equals(t, 0, selectSeriesWithContext(store.WithNoCache(context.Background()), t, missing))
+	testutil.Equals(t, 2, server.calls)
+	testutil.Assert(t, server.noCache, "expected StoreAPI request to skip caches")
+	testutil.Equals(t, 0, selectSeries(t, missing))
+	testutil.Equals(t, 2, server.calls)
+
+	// Different matchers are not.
+	testutil.Equals(t, 0, selectSeries(t, labels.MustNewMatcher(labels.MatchEqual, "__name__", "other")))
+	testutil.Equals(t, 3, server.calls)
+
+	// New block with the series arrives.
+	st.maxt = 600
+	server.resps = []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("__name__", "missing"), []sample{{550, 1}})}
+	testutil.Equals(t, 1, selectSeries(t, missing))
+	testutil.Equals(t, 4, server.calls)
+
+	// Selects returning series are not cached.
+	testutil.Equals(t, 1, selectSeries(t, missing))
+	testutil.Equals(t, 5, server.calls)
+}
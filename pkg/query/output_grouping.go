@@ -0,0 +1,193 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// OutputGroupingsKey is the context key for the *OutputGroupings of the query evaluated with the context.
+const OutputGroupingsKey = ctxKey(2)
+
+// outputGroupingAggrs are aggregations producing one series per group of their input series.
+var outputGroupingAggrs = map[string]struct{}{
+	"sum": {}, "min": {}, "max": {}, "avg": {}, "group": {}, "stddev": {}, "stdvar": {}, "count": {}, "quantile": {},
+}
+
+// labelChangingFuncs are functions whose output series can't be told from the labels of their input series.
+var labelChangingFuncs = map[string]struct{}{
+	"label_replace": {}, "label_join": {}, "histogram_quantile": {}, "absent": {}, "absent_over_time": {}, "scalar": {},
+}
+
+// outputGrouping is an aggregation grouping series of a select.
+type outputGrouping struct {
+	op string
+	by bool
+	// grouping is sorted.
+	grouping []string
+}
+
+// OutputGroupings holds aggregations grouping series of each selector of a query, found by walking its expression.
+// Unlike hints of selects, which describe only the node directly wrapping a selector, they cover aggregations over
+// functions keeping labels of series, e.g. `sum by (pod) (rate(metric[5m]))`.
+type OutputGroupings struct {
+	// bySelect holds groupings by keys of selects of selectors. A nil grouping stands for a selector whose series are
+	// not grouped by an aggregation.
+	bySelect map[string][]*outputGrouping
+}
+
+// NewOutputGroupings returns the aggregations grouping series of selectors of the given expression.
+func NewOutputGroupings(expr parser.Expr) *OutputGroupings {
+	g := &OutputGroupings{bySelect: map[string][]*outputGrouping{}}
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		// Hints are derived the same way the engine does, so that selects of selectors with the same matchers can be
+		// told apart.
+		hints := &storage.SelectHints{Func: hintedFunc(path)}
+		if len(path) > 0 {
+			switch n := path[len(path)-1].(type) {
+			case *parser.AggregateExpr:
+				hints.By, hints.Grouping = !n.Without, n.Grouping
+			case *parser.MatrixSelector:
+				hints.Range = n.Range.Milliseconds()
+			}
+		}
+		key := selectKey(vs.LabelMatchers, hints)
+		g.bySelect[key] = append(g.bySelect[key], outputGroupingOf(node, path))
+		return nil
+	})
+	return g
+}
+
+func outputGroupingsFromContext(ctx context.Context) *OutputGroupings {
+	g, _ := ctx.Value(OutputGroupingsKey).(*OutputGroupings)
+	return g
+}
+
+// hintedFunc returns the function or aggregation hinted by the engine for a selector with the given ancestors.
+func hintedFunc(path []parser.Node) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		switch n := path[i].(type) {
+		case *parser.AggregateExpr:
+			return n.Op.String()
+		case *parser.Call:
+			return n.Func.Name
+		case *parser.BinaryExpr:
+			return ""
+		}
+	}
+	return ""
+}
+
+// outputGroupingOf returns the aggregation grouping series of the selector node with the given ancestors, or nil if
+// series are not grouped or their labels are changed before.
+func outputGroupingOf(node parser.Node, path []parser.Node) *outputGrouping {
+	// Functions and arithmetic with scalars can drop the metric name of series.
+	keepsName := true
+	for i := len(path) - 1; i >= 0; i-- {
+		switch n := path[i].(type) {
+		case *parser.ParenExpr, *parser.MatrixSelector, *parser.SubqueryExpr:
+		case *parser.UnaryExpr:
+			keepsName = false
+		case *parser.Call:
+			if _, ok := labelChangingFuncs[n.Func.Name]; ok {
+				return nil
+			}
+			keepsName = false
+		case *parser.BinaryExpr:
+			if n.LHS.Type() != parser.ValueTypeScalar && n.RHS.Type() != parser.ValueTypeScalar {
+				return nil
+			}
+			keepsName = false
+		case *parser.AggregateExpr:
+			if _, ok := outputGroupingAggrs[n.Op.String()]; !ok {
+				return nil
+			}
+			// Selectors in the parameter of an aggregation, e.g. of quantile, are not grouped by it.
+			child := node
+			if i+1 < len(path) {
+				child = path[i+1]
+			}
+			if child != parser.Node(n.Expr) {
+				return nil
+			}
+			return newOutputGrouping(n.Op.String(), !n.Without, n.Grouping, keepsName)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// String returns the aggregation as written in PromQL, e.g. `sum by (pod)`.
+func (g *outputGrouping) String() string {
+	grouping := "without"
+	if g.by {
+		grouping = "by"
+	}
+	return fmt.Sprintf("%s %s (%s)", g.op, grouping, strings.Join(g.grouping, ", "))
+}
+
+func newOutputGrouping(op string, by bool, grouping []string, keepsName bool) *outputGrouping {
+	g := &outputGrouping{op: op, by: by}
+	for _, l := range grouping {
+		// Grouping by the dropped metric name does not split series into more groups.
+		if by && !keepsName && l == labels.MetricName {
+			continue
+		}
+		g.grouping = append(g.grouping, l)
+	}
+	sort.Strings(g.grouping)
+	return g
+}
+
+// lookup returns aggregations grouping series of the select with the given matchers and hints. It returns nil if any
+// selector with such a select is not grouped, as their series can't be told apart.
+func (g *OutputGroupings) lookup(ms []*labels.Matcher, hints *storage.SelectHints) []*outputGrouping {
+	if g == nil {
+		return nil
+	}
+	groupings := g.bySelect[selectKey(ms, hints)]
+	for _, og := range groupings {
+		if og == nil {
+			return nil
+		}
+	}
+	return groupings
+}
+
+// hintedOutputGrouping returns the aggregation grouping series of a select according to its hints, used if the
+// expression of the query is not known. Hints describe only the node directly wrapping the selector, so only
+// aggregations directly over a select are found.
+func hintedOutputGrouping(hints *storage.SelectHints) []*outputGrouping {
+	if _, ok := outputGroupingAggrs[hints.Func]; !ok {
+		return nil
+	}
+	// No grouping is hinted for aggregations not directly over the select as well, e.g. `sum((metric))`, so
+	// `without ()` can't be told apart from them.
+	if !hints.By && len(hints.Grouping) == 0 {
+		return nil
+	}
+	return []*outputGrouping{newOutputGrouping(hints.Func, hints.By, hints.Grouping, true)}
+}
+
+func selectKey(ms []*labels.Matcher, hints *storage.SelectHints) string {
+	s := make([]string, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, m.String())
+	}
+	grouping := append([]string(nil), hints.Grouping...)
+	sort.Strings(grouping)
+	return fmt.Sprintf("{%s} %s %t (%s) %d", strings.Join(s, ","), hints.Func, hints.By, strings.Join(grouping, ","), hints.Range)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// selectRecordingQuerier records selects done by the engine and returns no series.
+type selectRecordingQuerier struct {
+	storage.LabelQuerier
+
+	hints    []*storage.SelectHints
+	matchers [][]*labels.Matcher
+}
+
+func (q *selectRecordingQuerier) Querier(context.Context, int64, int64) (storage.Querier, error) {
+	return q, nil
+}
+
+func (q *selectRecordingQuerier) Select(_ bool, hints *storage.SelectHints, ms ...*labels.Matcher) storage.SeriesSet {
+	q.hints = append(q.hints, hints)
+	q.matchers = append(q.matchers, ms)
+	return storage.EmptySeriesSet()
+}
+
+func (q *selectRecordingQuerier) Close() error { return nil }
+
+func TestOutputGroupings(t *testing.T) {
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 100, Timeout: time.Minute})
+
+	for _, tcase := range []struct {
+		query string
+		// expected holds groupings found for each select of the query, in order of selects.
+		expected [][]*outputGrouping
+	}{
+		{
+			query:    "metric",
+			expected: [][]*outputGrouping{nil},
+		},
+		{
+			query:    "sum by (b, a) (metric)",
+			expected: [][]*outputGrouping{{{op: "sum", by: true, grouping: []string{"a", "b"}}}},
+		},
+		{
+			query:    "count without (a) ((metric))",
+			expected: [][]*outputGrouping{{{op: "count", grouping: []string{"a"}}}},
+		},
+		{
+			query:    "sum by (__name__, a) (rate(metric[5m]))",
+			expected: [][]*outputGrouping{{{op: "sum", by: true, grouping: []string{"a"}}}},
+		},
+		{
+			query:    "max by (a) (-metric * 2)",
+			expected: [][]*outputGrouping{{{op: "max", by: true, grouping: []string{"a"}}}},
+		},
+		{
+			query:    "avg by (a) (max_over_time(rate(metric[5m])[1h:1m]))",
+			expected: [][]*outputGrouping{{{op: "avg", by: true, grouping: []string{"a"}}}},
+		},
+		{
+			query:    `sum by (a) (label_replace(metric, "a", "$1", "b", "(.*)"))`,
+			expected: [][]*outputGrouping{nil},
+		},
+		{
+			query:    "sum by (a) (metric / other)",
+			expected: [][]*outputGrouping{nil, nil},
+		},
+		{
+			query:    "topk by (a) (5, metric)",
+			expected: [][]*outputGrouping{nil},
+		},
+		{
+			query:    "count(sum by (a) (metric))",
+			expected: [][]*outputGrouping{{{op: "sum", by: true, grouping: []string{"a"}}}},
+		},
+		{
+			// Selects with different hints are told apart.
+			query: "sum by (a) (metric) / count by (b) (metric)",
+			expected: [][]*outputGrouping{
+				{{op: "sum", by: true, grouping: []string{"a"}}},
+				{{op: "count", by: true, grouping: []string{"b"}}},
+			},
+		},
+		{
+			// Selects with the same hints are not.
+			query: "sum by (a) (abs(metric)) / sum by (b) (abs(metric))",
+			expected: [][]*outputGrouping{
+				{{op: "sum", by: true, grouping: []string{"a"}}, {op: "sum", by: true, grouping: []string{"b"}}},
+				{{op: "sum", by: true, grouping: []string{"a"}}, {op: "sum", by: true, grouping: []string{"b"}}},
+			},
+		},
+		{
+			query:    "sum by (a) (abs(metric)) / abs(metric)",
+			expected: [][]*outputGrouping{nil, nil},
+		},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.query)
+			testutil.Ok(t, err)
+			g := NewOutputGroupings(expr)
+
+			q := &selectRecordingQuerier{}
+			qry, err := engine.NewRangeQuery(q, tcase.query, time.Unix(0, 0), time.Unix(120, 0), time.Minute)
+			testutil.Ok(t, err)
+			testutil.Ok(t, qry.Exec(context.Background()).Err)
+
+			var groupings [][]*outputGrouping
+			for i := range q.hints {
+				groupings = append(groupings, g.lookup(q.matchers[i], q.hints[i]))
+			}
+			testutil.Equals(t, tcase.expected, groupings)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// SelectPlan describes how a select of a query is going to be executed.
+type SelectPlan struct {
+	// Matchers of the select, after rewriting of metric aliases.
+	Matchers []string `json:"matchers"`
+	// Start and End are the time range in milliseconds requested from StoreAPIs.
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Func  string `json:"func,omitempty"`
+	// Skipped is the reason why StoreAPIs are not going to be queried at all, if any.
+	Skipped string `json:"skipped,omitempty"`
+
+	// MaxSourceResolution is the maximum resolution requested from StoreAPIs, after auto downsampling. Store Gateways
+	// choosing resolution of blocks by their age can still serve old blocks in coarser resolution.
+	MaxSourceResolution int64 `json:"maxSourceResolution"`
+	// Aggregates of downsampled data requested based on the function wrapping the select.
+	Aggregates []string `json:"aggregates"`
+	// TailOnly is true if only the last sample of each series is requested.
+	TailOnly bool `json:"tailOnly"`
+	// PreferRaw is true if series having raw data use only raw data, see instantPreferRaw.
+	PreferRaw     bool     `json:"preferRaw"`
+	Deduplicate   bool     `json:"deduplicate"`
+	ReplicaLabels []string `json:"replicaLabels,omitempty"`
+	// Optimizations are names of pushdown and pruning decisions taken for the select, see selectOptimizations.
+	Optimizations []string `json:"optimizations"`
+
+	// MaxSeries is the series limit of the select and SeriesLimitAccounting how series count towards it, if limited.
+	MaxSeries             int    `json:"maxSeries,omitempty"`
+	SeriesLimitAccounting string `json:"seriesLimitAccounting,omitempty"`
+	// MaxOutputSeries is the output series limit and OutputGroupings the aggregations checked against it before
+	// evaluation, e.g. `sum by (pod)`, if limited.
+	MaxOutputSeries int      `json:"maxOutputSeries,omitempty"`
+	OutputGroupings []string `json:"outputGroupings,omitempty"`
+
+	// Stores are StoreAPIs the select is sent to, PrunedStores the ones skipped as they can't match it. Both are nil
+	// if the proxy doesn't expose its StoreAPIs.
+	Stores       []string `json:"stores"`
+	PrunedStores []string `json:"prunedStores"`
+
+	// Estimate of the data fetched by the select, if requested.
+	Estimate *SelectEstimate `json:"estimate,omitempty"`
+}
+
+// SelectEstimate estimates the data a select fetches. Series are counted by fetching labels of matching series from
+// StoreAPIs without their chunks.
+type SelectEstimate struct {
+	// Series is the number of series returned by StoreAPIs, DeduplicatedSeries the number of series left once replicas
+	// are deduplicated.
+	Series             int `json:"series"`
+	DeduplicatedSeries int `json:"deduplicatedSeries"`
+	// Chunks is the estimated number of chunks of all returned series. It assumes chunks of 120 samples, of raw data
+	// scraped every minute or of data downsampled to the maximum source resolution.
+	Chunks int64 `json:"chunks"`
+	// Warnings of StoreAPIs, e.g. ones that failed, which makes the estimate incomplete.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Names of optimizations of selects.
+const (
+	// OptimizationIgnoreNewerThan trims the time range to exclude data newer than ignore-newer-than.
+	OptimizationIgnoreNewerThan = "ignore-newer-than"
+	// OptimizationNegativeCache skips StoreAPIs known to return no series.
+	OptimizationNegativeCache = "negative-cache"
+	// OptimizationAggregatesPushdown requests only aggregates of downsampled data used by the function of the select.
+	OptimizationAggregatesPushdown = "aggregates-pushdown"
+	// OptimizationTailOnlyPushdown requests only the last sample of each series.
+	OptimizationTailOnlyPushdown = "tail-only-pushdown"
+	// OptimizationPreferRaw drops downsampled data of series having raw data.
+	OptimizationPreferRaw = "prefer-raw"
+	// OptimizationStorePruning skips StoreAPIs that can't match the select.
+	OptimizationStorePruning = "store-pruning"
+)
+
+// chunkSamples is the number of samples of a chunk estimates assume.
+const chunkSamples = 120
+
+// storeMatcher is implemented by store.ProxyStore.
+type storeMatcher interface {
+	MatchingStores(ctx context.Context, mint, maxt int64, matchers []storepb.LabelMatcher) (matching, pruned []store.Client, err error)
+}
+
+// plan returns the plan of a select with the given hints and matchers, based on the same decisions as selectFn. If
+// estimate is true, labels of series matching the select are fetched to estimate the data it fetches.
+func (q *querier) plan(hints *storage.SelectHints, estimate bool, ms ...*labels.Matcher) (SelectPlan, error) {
+	if hints == nil {
+		hints = &storage.SelectHints{
+			Start: q.mint,
+			End:   q.maxt,
+		}
+	}
+	d, err := q.decideSelect(q.ctx, hints, ms)
+	if err != nil {
+		return SelectPlan{}, err
+	}
+	p := SelectPlan{
+		Start:               d.req.MinTime,
+		End:                 d.req.MaxTime,
+		Func:                hints.Func,
+		Skipped:             d.skipped,
+		MaxSourceResolution: d.req.MaxResolutionWindow,
+		TailOnly:            d.req.TailOnly,
+		PreferRaw:           d.rawOnlyWithin != nil,
+		Deduplicate:         d.replicaLabels != nil,
+		Optimizations:       []string{},
+		MaxSeries:           q.maxSeries,
+		MaxOutputSeries:     q.maxOutputSeries,
+	}
+	for l := range d.replicaLabels {
+		p.ReplicaLabels = append(p.ReplicaLabels, l)
+	}
+	sort.Strings(p.ReplicaLabels)
+	for _, aggr := range d.aggrs {
+		p.Aggregates = append(p.Aggregates, aggr.String())
+	}
+	for _, m := range d.matchers {
+		p.Matchers = append(p.Matchers, m.String())
+	}
+	if q.maxSeries > 0 {
+		p.SeriesLimitAccounting = string(q.seriesLimitAccounting)
+		if p.SeriesLimitAccounting == "" {
+			p.SeriesLimitAccounting = string(SeriesLimitDeduplicated)
+		}
+	}
+	for _, g := range d.outputGroupings {
+		p.OutputGroupings = append(p.OutputGroupings, g.String())
+	}
+	if d.skipped != "" {
+		p.Optimizations = selectOptimizations(d, nil)
+		return p, nil
+	}
+
+	ctx := context.WithValue(q.ctx, store.StoreMatcherKey, q.storeDebugMatchers)
+	var pruned []store.Client
+	if sm, ok := q.proxy.(storeMatcher); ok {
+		var matching []store.Client
+		matching, pruned, err = sm.MatchingStores(ctx, d.req.MinTime, d.req.MaxTime, d.req.Matchers)
+		if err != nil {
+			return SelectPlan{}, err
+		}
+		p.Stores, p.PrunedStores = []string{}, []string{}
+		for _, st := range matching {
+			p.Stores = append(p.Stores, st.String())
+		}
+		for _, st := range pruned {
+			p.PrunedStores = append(p.PrunedStores, st.String())
+		}
+	}
+	p.Optimizations = selectOptimizations(d, pruned)
+
+	if estimate {
+		if p.Estimate, err = q.estimate(ctx, d); err != nil {
+			return SelectPlan{}, err
+		}
+	}
+	return p, nil
+}
+
+// selectOptimizations returns names of optimizations taken for a select with the given decisions and pruned
+// StoreAPIs.
+func selectOptimizations(d *selectDecision, pruned []store.Client) []string {
+	opts := []string{}
+	if d.trimmed {
+		opts = append(opts, OptimizationIgnoreNewerThan)
+	}
+	if d.skipped != "" {
+		// Other decisions don't apply, as StoreAPIs are not queried.
+		if d.skipped == skippedNegativeCacheHit {
+			opts = append(opts, OptimizationNegativeCache)
+		}
+		return opts
+	}
+	if d.req.MaxResolutionWindow > 0 && len(d.aggrs) > 0 {
+		opts = append(opts, OptimizationAggregatesPushdown)
+	}
+	if d.req.TailOnly {
+		opts = append(opts, OptimizationTailOnlyPushdown)
+	}
+	if d.rawOnlyWithin != nil {
+		opts = append(opts, OptimizationPreferRaw)
+	}
+	if len(pruned) > 0 {
+		opts = append(opts, OptimizationStorePruning)
+	}
+	return opts
+}
+
+// estimate fetches labels of series matching the select without their chunks and estimates the data it fetches.
+func (q *querier) estimate(ctx context.Context, d *selectDecision) (*SelectEstimate, error) {
+	req := *d.req
+	req.SkipChunks = true
+	req.ChunkSources = false
+
+	resp := &seriesServer{ctx: ctx}
+	if err := q.proxy.Series(&req, resp); err != nil {
+		return nil, errors.Wrap(err, "proxy Series()")
+	}
+	e := &SelectEstimate{Series: len(resp.seriesSet), Warnings: resp.warnings}
+	if d.alias != nil {
+		d.alias.relabel(resp.seriesSet)
+	}
+	groups := make(map[uint64]struct{}, len(resp.seriesSet))
+	for _, s := range resp.seriesSet {
+		groups[seriesHashWithoutReplicaLabels(labelpb.LabelsToPromLabels(s.Labels), d.replicaLabels)] = struct{}{}
+	}
+	e.DeduplicatedSeries = len(groups)
+
+	chunks := int64(1)
+	if !req.TailOnly {
+		span := chunkSamples * int64(time.Minute/time.Millisecond)
+		if req.MaxResolutionWindow >= downsample.ResLevel2 {
+			span = chunkSamples * downsample.ResLevel2
+		} else if req.MaxResolutionWindow >= downsample.ResLevel1 {
+			span = chunkSamples * downsample.ResLevel1
+		}
+		chunks = (req.MaxTime - req.MinTime + span - 1) / span
+		if chunks < 1 {
+			chunks = 1
+		}
+	}
+	e.Chunks = int64(e.Series) * chunks
+	return e, nil
+}
+
+// PlanningQueryable wraps a queryable created by a QueryableCreator. Instead of fetching series, its queriers record
+// plans of selects and return no series, so that evaluating a query with it returns plans of selects the query makes
+// without fetching their data. StoreAPIs are contacted only to estimate selects, if requested.
+type PlanningQueryable struct {
+	queryable storage.Queryable
+	estimate  bool
+
+	mtx   sync.Mutex
+	plans []SelectPlan
+}
+
+// NewPlanningQueryable returns a PlanningQueryable wrapping the given queryable. If estimate is true, plans include
+// estimates of data fetched by selects.
+func NewPlanningQueryable(queryable storage.Queryable, estimate bool) *PlanningQueryable {
+	return &PlanningQueryable{queryable: queryable, estimate: estimate}
+}
+
+// Plans returns plans of all selects made so far in the order they were made.
+func (p *PlanningQueryable) Plans() []SelectPlan {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return append([]SelectPlan(nil), p.plans...)
+}
+
+// Querier returns a querier recording plans of its selects.
+func (p *PlanningQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	q, err := p.queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	tq, ok := q.(*querier)
+	if !ok {
+		_ = q.Close()
+		return nil, errors.Errorf("planning is not supported by querier %T", q)
+	}
+	return &planningQuerier{querier: tq, p: p}, nil
+}
+
+type planningQuerier struct {
+	*querier
+	p *PlanningQueryable
+}
+
+func (q *planningQuerier) Select(_ bool, hints *storage.SelectHints, ms ...*labels.Matcher) storage.SeriesSet {
+	plan, err := q.plan(hints, q.p.estimate, ms...)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+
+	q.p.mtx.Lock()
+	defer q.p.mtx.Unlock()
+
+	q.p.plans = append(q.p.plans, plan)
+	return storage.EmptySeriesSet()
+}
@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type planTestStore struct {
+	// Just to pass interface check, planning must not call StoreAPIs.
+	store.Client
+
+	addr       string
+	mint, maxt int64
+	labelSets  []labels.Labels
+}
+
+func (s *planTestStore) TimeRange() (int64, int64)  { return s.mint, s.maxt }
+func (s *planTestStore) LabelSets() []labels.Labels { return s.labelSets }
+func (s *planTestStore) Addr() string               { return s.addr }
+func (s *planTestStore) String() string             { return s.addr }
+
+func TestPlanningQueryable_MatchesSelect(t *testing.T) {
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 10000, Timeout: 10 * time.Second})
+	now := time.Unix(3600, 0)
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		step  time.Duration
+		// Only instant selects without range prefer raw data.
+		preferRaw bool
+	}{
+		{name: "instant rate", query: `sum by (job) (rate(up{job="a"}[5m]))`},
+		{name: "instant plain select", query: `up`, preferRaw: true},
+		{name: "range max_over_time", query: `max_over_time(up{job=~"a|b"}[10m])`, step: time.Minute},
+		{name: "range plain select", query: `up`, step: 5 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := func(t *testing.T, storeAPI storepb.StoreServer, planning bool) *PlanningQueryable {
+				queryable := NewQueryableCreator(nil, nil, storeAPI, 2, 10*time.Second, QueryableCreatorOpts{InstantPreferRaw: true})(true, []string{"replica"}, nil, 300000, true, false)
+				var pq *PlanningQueryable
+				if planning {
+					pq = NewPlanningQueryable(queryable, false)
+					queryable = pq
+				}
+
+				var (
+					qry promql.Query
+					err error
+				)
+				if tc.step == 0 {
+					qry, err = engine.NewInstantQuery(queryable, tc.query, now)
+				} else {
+					qry, err = engine.NewRangeQuery(queryable, tc.query, now.Add(-time.Hour), now, tc.step)
+				}
+				testutil.Ok(t, err)
+				defer qry.Close()
+				testutil.Ok(t, qry.Exec(context.Background()).Err)
+				return pq
+			}
+
+			executed := &requestStoreServer{}
+			exec(t, executed, false)
+			testutil.Assert(t, executed.req != nil, "expected store to be queried")
+
+			planned := &requestStoreServer{}
+			plans := exec(t, planned, true).Plans()
+			testutil.Assert(t, planned.req == nil, "expected store not to be queried while planning")
+			testutil.Equals(t, 1, len(plans))
+
+			// The plan reflects the request actually sent to StoreAPIs.
+			p, req := plans[0], executed.req
+			testutil.Equals(t, req.MinTime, p.Start)
+			testutil.Equals(t, req.MaxTime, p.End)
+			testutil.Equals(t, req.MaxResolutionWindow, p.MaxSourceResolution)
+			testutil.Equals(t, req.TailOnly, p.TailOnly)
+			var aggrs []string
+			for _, a := range req.Aggregates {
+				aggrs = append(aggrs, a.String())
+			}
+			testutil.Equals(t, aggrs, p.Aggregates)
+			var matchers []string
+			for _, m := range req.Matchers {
+				matchers = append(matchers, m.PromString())
+			}
+			testutil.Equals(t, matchers, p.Matchers)
+			testutil.Equals(t, true, p.Deduplicate)
+			testutil.Equals(t, []string{"replica"}, p.ReplicaLabels)
+			testutil.Equals(t, tc.preferRaw, p.PreferRaw)
+			if tc.preferRaw {
+				testutil.Equals(t, []string{OptimizationAggregatesPushdown, OptimizationPreferRaw}, p.Optimizations)
+			} else {
+				testutil.Equals(t, []string{OptimizationAggregatesPushdown}, p.Optimizations)
+			}
+			// The proxy doesn't expose its StoreAPIs.
+			testutil.Equals(t, []string(nil), p.Stores)
+		})
+	}
+}
+
+func TestPlanningQueryable_Stores(t *testing.T) {
+	proxy := store.NewProxyStore(nil, nil, func() []store.Client {
+		return []store.Client{
+			&planTestStore{addr: "store-a", mint: 0, maxt: 7200000, labelSets: []labels.Labels{labels.FromStrings("cluster", "a")}},
+			&planTestStore{addr: "store-b", mint: 0, maxt: 7200000, labelSets: []labels.Labels{labels.FromStrings("cluster", "b")}},
+			&planTestStore{addr: "store-old", mint: 0, maxt: 600000, labelSets: []labels.Labels{labels.FromStrings("cluster", "a")}},
+		}
+	}, component.Query, nil, 0, store.ProxyStoreOpts{})
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 10000, Timeout: 10 * time.Second})
+
+	pq := NewPlanningQueryable(NewQueryableCreator(nil, nil, proxy, 2, 10*time.Second, QueryableCreatorOpts{})(false, nil, nil, 0, true, false), false)
+	qry, err := engine.NewInstantQuery(pq, `count(up{cluster="a"}) / count(up)`, time.Unix(3600, 0))
+	testutil.Ok(t, err)
+	defer qry.Close()
+	testutil.Ok(t, qry.Exec(context.Background()).Err)
+
+	plans := pq.Plans()
+	testutil.Equals(t, 2, len(plans))
+	testutil.Equals(t, []string{`cluster="a"`, `__name__="up"`}, plans[0].Matchers)
+	testutil.Equals(t, []string{"store-a"}, plans[0].Stores)
+	testutil.Equals(t, []string{"store-b", "store-old"}, plans[0].PrunedStores)
+	testutil.Equals(t, []string{`__name__="up"`}, plans[1].Matchers)
+	testutil.Equals(t, []string{"store-a", "store-b"}, plans[1].Stores)
+	testutil.Equals(t, []string{"store-old"}, plans[1].PrunedStores)
+	for _, p := range plans {
+		testutil.Equals(t, []string{"COUNT"}, p.Aggregates)
+		testutil.Equals(t, false, p.Deduplicate)
+		testutil.Equals(t, []string{OptimizationStorePruning}, p.Optimizations)
+	}
+}
+
+func TestPlanningQueryable_EstimateAndLimits(t *testing.T) {
+	storeAPI := &storeServer{resps: []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "a", "replica", "r1")),
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "a", "replica", "r2")),
+		storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "b", "replica", "r1")),
+	}}
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 10000, Timeout: 10 * time.Second})
+	q := `sum by (job) (rate(up[5h]))`
+	expr, err := parser.ParseExpr(q)
+	testutil.Ok(t, err)
+	ctx := context.WithValue(context.Background(), OutputGroupingsKey, NewOutputGroupings(expr))
+
+	for _, estimate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("estimate=%v", estimate), func(t *testing.T) {
+			pq := NewPlanningQueryable(NewQueryableCreator(nil, nil, storeAPI, 2, 10*time.Second, QueryableCreatorOpts{
+				MaxSeries:             10,
+				SeriesLimitAccounting: SeriesLimitFetched,
+				MaxOutputSeries:       5,
+			})(true, []string{"replica"}, nil, 0, true, false), estimate)
+			qry, err := engine.NewInstantQuery(pq, q, time.Unix(36000, 0))
+			testutil.Ok(t, err)
+			defer qry.Close()
+			testutil.Ok(t, qry.Exec(ctx).Err)
+
+			plans := pq.Plans()
+			testutil.Equals(t, 1, len(plans))
+			p := plans[0]
+			testutil.Equals(t, 10, p.MaxSeries)
+			testutil.Equals(t, string(SeriesLimitFetched), p.SeriesLimitAccounting)
+			testutil.Equals(t, 5, p.MaxOutputSeries)
+			testutil.Equals(t, []string{"sum by (job)"}, p.OutputGroupings)
+			if !estimate {
+				testutil.Assert(t, p.Estimate == nil, "expected no estimate")
+				return
+			}
+			// 5h of raw data spans 3 chunks of each series.
+			testutil.Equals(t, &SelectEstimate{Series: 3, DeduplicatedSeries: 2, Chunks: 9}, p.Estimate)
+		})
+	}
+}
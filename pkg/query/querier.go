@@ -5,6 +5,7 @@ package query
 
 import (
 	"context"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -16,7 +17,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promgate "github.com/prometheus/prometheus/pkg/gate"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/gate"
@@ -26,6 +31,11 @@ import (
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
+// LastSampleFunc is a Thanos specific select hint function. When set in storage.SelectHints, every returned series
+// is trimmed to the tail chunks that can contain its most recent sample within the select time range. This allows
+// answering "latest value" lookups without decoding the whole series.
+const LastSampleFunc = "thanos_last_sample"
+
 // QueryableCreator returns implementation of promql.Queryable that fetches data from the proxy store API endpoints.
 // If deduplication is enabled, all data retrieved from it will be deduplicated along all replicaLabels by default.
 // When the replicaLabels argument is not empty it overwrites the global replicaLabels flag. This allows specifying
@@ -34,11 +44,64 @@ import (
 // partialResponse controls `partialResponseDisabled` option of StoreAPI and partial response behavior of proxy.
 type QueryableCreator func(deduplicate bool, replicaLabels []string, storeDebugMatchers [][]*labels.Matcher, maxResolutionMillis int64, partialResponse, skipChunks bool) storage.Queryable
 
+// LabelValuesQuerier is a storage.Querier able to return label values of series matching given matchers only.
+type LabelValuesQuerier interface {
+	storage.Querier
+
+	LabelValuesWithMatchers(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error)
+}
+
+// QueryableCreatorOpts configures queriers created by a QueryableCreator. Zero value of each field disables
+// the respective feature or keeps the default behaviour.
+type QueryableCreatorOpts struct {
+	// MergeTimeout limits the time of merging, deduplicating and evaluating series of a single select once all
+	// StoreAPIs responded, 0 means no limit.
+	MergeTimeout time.Duration
+	// ResolutionOverlapPolicy controls which chunks are used when raw and downsampled data of the same series overlap.
+	ResolutionOverlapPolicy ResolutionOverlapPolicy
+	// MaxSeries limits the number of series a single select can return, 0 means no limit. If SampleOverSeriesLimit
+	// is true, selects exceeding the limit return a deterministic sample of MaxSeries series instead of failing.
+	MaxSeries             int
+	SampleOverSeriesLimit bool
+	// SeriesLimitAccounting decides whether replicas of deduplicated series count towards MaxSeries as one or each
+	// separately.
+	SeriesLimitAccounting SeriesLimitAccounting
+	// MaxOutputSeries limits the number of series an aggregation grouping series of a select can produce, 0 means no
+	// limit. Aggregations are found by OutputGroupings of the query passed in the context under OutputGroupingsKey, or
+	// by hints of selects otherwise, which cover only aggregations directly over a select. Unlike MaxSeries, it limits
+	// distinct groups of the aggregation, e.g. `sum by (pod)` over few input series can't exceed it, while the same
+	// number of series grouped by a high cardinality label can.
+	MaxOutputSeries int
+	// NegativeCache, if not nil, is used to answer selects known to return no series without querying StoreAPIs.
+	NegativeCache *NegativeCache
+	// IgnoreNewerThan, if positive, trims the time range of selects and label requests to exclude data newer than that.
+	IgnoreNewerThan time.Duration
+	// DedupWindow, if positive, caps how far ahead deduplication skips samples of replicas other than the chosen one.
+	DedupWindow time.Duration
+	// MetricAliases, if not nil, rewrites selects of renamed metrics.
+	MetricAliases *MetricAliases
+	// LabelValueGuard, if not nil, truncates or rejects series with too long label values.
+	LabelValueGuard *store.LabelValueLengthGuard
+	// FlagSingleReplica, if true, warns about deduplicated series present in one replica only.
+	FlagSingleReplica bool
+	// FlagCounterResets, if true, warns about counter resets caused by deduplication switching replicas.
+	FlagCounterResets bool
+	// InstantPreferRaw, if true, makes instant selects use only raw data of series having any raw data within the
+	// select time range, so that results at raw and downsampled data boundaries do not depend on which chunk is
+	// iterated first.
+	InstantPreferRaw bool
+	// CorruptChunkPolicy decides whether chunks failing to decode fail queries with partial response enabled or are
+	// skipped. Chunks are skipped only for queries with a CorruptChunksTracker passed in the context under
+	// CorruptChunksTrackerKey, which reports them.
+	CorruptChunkPolicy CorruptChunkPolicy
+}
+
 // NewQueryableCreator creates QueryableCreator.
-func NewQueryableCreator(logger log.Logger, reg prometheus.Registerer, proxy storepb.StoreServer, maxConcurrentSelects int, selectTimeout time.Duration) QueryableCreator {
+func NewQueryableCreator(logger log.Logger, reg prometheus.Registerer, proxy storepb.StoreServer, maxConcurrentSelects int, selectTimeout time.Duration, opts QueryableCreatorOpts) QueryableCreator {
 	duration := promauto.With(
 		extprom.WrapRegistererWithPrefix("concurrent_selects_", reg),
 	).NewHistogram(gate.DurationHistogramOpts)
+	dedupMetrics := newDedupMetrics(reg)
 
 	return func(deduplicate bool, replicaLabels []string, storeDebugMatchers [][]*labels.Matcher, maxResolutionMillis int64, partialResponse, skipChunks bool) storage.Queryable {
 		return &queryable{
@@ -55,6 +118,8 @@ func NewQueryableCreator(logger log.Logger, reg prometheus.Registerer, proxy sto
 			},
 			maxConcurrentSelects: maxConcurrentSelects,
 			selectTimeout:        selectTimeout,
+			dedupMetrics:         dedupMetrics,
+			opts:                 opts,
 		}
 	}
 }
@@ -71,11 +136,13 @@ type queryable struct {
 	gateProviderFn       func() gate.Gate
 	maxConcurrentSelects int
 	selectTimeout        time.Duration
+	dedupMetrics         *dedupMetrics
+	opts                 QueryableCreatorOpts
 }
 
 // Querier returns a new storage querier against the underlying proxy store API.
 func (q *queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
-	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.storeDebugMatchers, q.proxy, q.deduplicate, q.maxResolutionMillis, q.partialResponse, q.skipChunks, q.gateProviderFn(), q.selectTimeout), nil
+	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.storeDebugMatchers, q.proxy, q.deduplicate, q.maxResolutionMillis, q.partialResponse, q.skipChunks, q.gateProviderFn(), q.selectTimeout, q.dedupMetrics, q.opts), nil
 }
 
 type querier struct {
@@ -92,6 +159,24 @@ type querier struct {
 	skipChunks          bool
 	selectGate          gate.Gate
 	selectTimeout       time.Duration
+	mergeTimeout        time.Duration
+
+	resolutionOverlapPolicy ResolutionOverlapPolicy
+	maxSeries               int
+	sampleOverSeriesLimit   bool
+	negativeCache           *NegativeCache
+	dedupMetrics            *dedupMetrics
+	dedupWindow             time.Duration
+	metricAliases           *MetricAliases
+	labelValueGuard         *store.LabelValueLengthGuard
+	flagSingleReplica       bool
+	instantPreferRaw        bool
+	maxOutputSeries         int
+	seriesLimitAccounting   SeriesLimitAccounting
+	corruptChunkPolicy      CorruptChunkPolicy
+	flagCounterResets       bool
+	// maxDataTime is the maximum time of data returned by the querier.
+	maxDataTime int64
 }
 
 // newQuerier creates implementation of storage.Querier that fetches data from the proxy
@@ -108,12 +193,22 @@ func newQuerier(
 	partialResponse, skipChunks bool,
 	selectGate gate.Gate,
 	selectTimeout time.Duration,
+	dedupMetrics *dedupMetrics,
+	opts QueryableCreatorOpts,
 ) *querier {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 	ctx, cancel := context.WithCancel(ctx)
 
+	maxDataTime := int64(math.MaxInt64)
+	if opts.IgnoreNewerThan > 0 {
+		maxDataTime = timestamp.FromTime(time.Now().Add(-opts.IgnoreNewerThan))
+		if maxt > maxDataTime {
+			maxt = maxDataTime
+		}
+	}
+
 	rl := make(map[string]struct{})
 	for _, replicaLabel := range replicaLabels {
 		rl[replicaLabel] = struct{}{}
@@ -124,6 +219,7 @@ func newQuerier(
 		cancel:        cancel,
 		selectGate:    selectGate,
 		selectTimeout: selectTimeout,
+		mergeTimeout:  opts.MergeTimeout,
 
 		mint:                mint,
 		maxt:                maxt,
@@ -134,6 +230,22 @@ func newQuerier(
 		maxResolutionMillis: maxResolutionMillis,
 		partialResponse:     partialResponse,
 		skipChunks:          skipChunks,
+
+		resolutionOverlapPolicy: opts.ResolutionOverlapPolicy,
+		maxSeries:               opts.MaxSeries,
+		sampleOverSeriesLimit:   opts.SampleOverSeriesLimit,
+		negativeCache:           opts.NegativeCache,
+		dedupMetrics:            dedupMetrics,
+		dedupWindow:             opts.DedupWindow,
+		metricAliases:           opts.MetricAliases,
+		labelValueGuard:         opts.LabelValueGuard,
+		flagSingleReplica:       opts.FlagSingleReplica,
+		instantPreferRaw:        opts.InstantPreferRaw,
+		maxOutputSeries:         opts.MaxOutputSeries,
+		seriesLimitAccounting:   opts.SeriesLimitAccounting,
+		corruptChunkPolicy:      opts.CorruptChunkPolicy,
+		flagCounterResets:       opts.FlagCounterResets,
+		maxDataTime:             maxDataTime,
 	}
 }
 
@@ -169,6 +281,30 @@ func (s *seriesServer) Context() context.Context {
 	return s.ctx
 }
 
+// labelValuesServer consumes merged label values batch by batch, as they are merged by the proxy. It stops the merge
+// once the query is canceled, so that remaining values are not fetched from stores.
+type labelValuesServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_LabelValuesStreamServer
+	ctx context.Context
+
+	values   []string
+	warnings []string
+}
+
+func (s *labelValuesServer) Send(r *storepb.LabelValuesStreamResponse) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.values = append(s.values, r.Values...)
+	s.warnings = append(s.warnings, r.Warnings...)
+	return nil
+}
+
+func (s *labelValuesServer) Context() context.Context {
+	return s.ctx
+}
+
 // aggrsFromFunc infers aggregates of the underlying data based on the wrapping
 // function of a series selection.
 func aggrsFromFunc(f string) []storepb.Aggr {
@@ -208,7 +344,21 @@ func (q *querier) Select(_ bool, hints *storage.SelectHints, ms ...*labels.Match
 	// The querier has a context but it gets canceled, as soon as query evaluation is completed, by the engine.
 	// We want to prevent this from happening for the async storea API calls we make while preserving tracing context.
 	ctx := tracing.CopyTraceContext(context.Background(), q.ctx)
-	ctx, cancel := context.WithTimeout(ctx, q.selectTimeout)
+	// The fanout tracker records StoreAPIs queried by all selects of the query, so it has to outlive the query context too.
+	if tracker := q.ctx.Value(store.FanoutTrackerKey); tracker != nil {
+		ctx = context.WithValue(ctx, store.FanoutTrackerKey, tracker)
+	}
+	// Selects don't outlive the deadline of the query though, e.g. a soft deadline of a range query, as its evaluation
+	// fails once it passes.
+	timeout := q.selectTimeout
+	if deadline, ok := q.ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	// Metadata of requests to StoreAPIs, e.g. the tenant, is preserved too.
+	if md, ok := metadata.FromOutgoingContext(q.ctx); ok {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	span, ctx := tracing.StartSpan(ctx, "querier_select", opentracing.Tags{
 		"minTime":  hints.Start,
 		"maxTime":  hints.End,
@@ -254,59 +404,303 @@ func (q *querier) Select(_ bool, hints *storage.SelectHints, ms ...*labels.Match
 	}}
 }
 
-func (q *querier) selectFn(ctx context.Context, hints *storage.SelectHints, ms ...*labels.Matcher) (storage.SeriesSet, error) {
-	sms, err := storepb.TranslatePromMatchers(ms...)
+// selectDecision holds decisions about how a select is executed. They are made by decideSelect for both selectFn and
+// plans of selects, so that plans reflect what selects do.
+type selectDecision struct {
+	// hints are hints of the select with the time range trimmed to exclude data newer than ignore-newer-than.
+	hints   *storage.SelectHints
+	trimmed bool
+	// skipped is the reason why StoreAPIs are not queried at all, if any.
+	skipped string
+
+	// matchers are the matchers of the select after rewriting of metric aliases.
+	matchers []*labels.Matcher
+	alias    *MetricAlias
+	req      *storepb.SeriesRequest
+	aggrs    []storepb.Aggr
+
+	negativeCacheKey string
+	// replicaLabels are the labels series are deduplicated by, nil if deduplication is disabled.
+	replicaLabels map[string]struct{}
+	// limitReplicaLabels are the replica labels ignored when counting series towards the series limit.
+	limitReplicaLabels map[string]struct{}
+	// outputGroupings are aggregations grouping series of the select checked against the output series limit.
+	outputGroupings []*outputGrouping
+	// rawOnlyWithin, if not nil, is the time range in which series having raw data use only raw data.
+	rawOnlyWithin *timeRange
+}
+
+// Reasons why StoreAPIs are not queried for a select.
+const (
+	skippedNewerThanIgnored = "newer than ignore-newer-than"
+	skippedNegativeCacheHit = "negative cache hit"
+)
+
+// decideSelect decides how a select with the given hints and matchers is executed.
+func (q *querier) decideSelect(ctx context.Context, hints *storage.SelectHints, ms []*labels.Matcher) (*selectDecision, error) {
+	d := &selectDecision{hints: hints}
+	if hints.End > q.maxDataTime {
+		h := *hints
+		h.End = q.maxDataTime
+		d.hints, d.trimmed = &h, true
+	}
+
+	// Selects are looked up by matchers of selectors of the query, i.e. before they are rewritten.
+	if q.maxOutputSeries > 0 {
+		if og := outputGroupingsFromContext(q.ctx); og != nil {
+			d.outputGroupings = og.lookup(ms, hints)
+		} else {
+			d.outputGroupings = hintedOutputGrouping(hints)
+		}
+	}
+
+	var err error
+	d.matchers, d.alias, err = q.metricAliases.rewriteMatchers(ms)
+	if err != nil {
+		return nil, err
+	}
+	sms, err := storepb.TranslatePromMatchers(d.matchers...)
 	if err != nil {
 		return nil, errors.Wrap(err, "convert matchers")
 	}
+	d.aggrs = aggrsFromFunc(hints.Func)
+	d.req = &storepb.SeriesRequest{
+		MinTime:                 d.hints.Start,
+		MaxTime:                 d.hints.End,
+		Matchers:                sms,
+		MaxResolutionWindow:     q.maxResolutionMillis,
+		Aggregates:              d.aggrs,
+		PartialResponseDisabled: !q.partialResponse,
+		SkipChunks:              q.skipChunks,
+		TailOnly:                hints.Func == LastSampleFunc,
+		ChunkSources:            seriesSourcesTrackerFromContext(q.ctx) != nil,
+	}
+
+	if q.isDedupEnabled() {
+		d.replicaLabels = q.replicaLabels
+		if q.seriesLimitAccounting != SeriesLimitFetched {
+			d.limitReplicaLabels = q.replicaLabels
+		}
+	}
+	if q.instantPreferRaw && isInstantSelect(d.hints) {
+		d.rawOnlyWithin = &timeRange{mint: d.hints.Start, maxt: d.hints.End}
+	}
+
+	if d.hints.Start > q.maxDataTime {
+		d.skipped = skippedNewerThanIgnored
+		return d, nil
+	}
+	if q.negativeCache != nil {
+		d.negativeCacheKey = newNegativeCacheKey(d.hints.Start, d.hints.End, q.maxResolutionMillis, q.storeDebugMatchers, d.matchers)
+		// Requests skipping caches still populate the negative cache.
+		if !store.IsNoCache(ctx) && q.negativeCache.Contains(d.negativeCacheKey) {
+			d.skipped = skippedNegativeCacheHit
+			return d, nil
+		}
+	}
+	return d, nil
+}
 
-	aggrs := aggrsFromFunc(hints.Func)
+func (q *querier) selectFn(ctx context.Context, hints *storage.SelectHints, ms ...*labels.Matcher) (storage.SeriesSet, error) {
+	d, err := q.decideSelect(ctx, hints, ms)
+	if err != nil {
+		return nil, err
+	}
+	if d.skipped != "" {
+		return storage.EmptySeriesSet(), nil
+	}
+	hints = d.hints
 
 	// TODO(bwplotka): Pass it using the SeriesRequest instead of relying on context.
 	ctx = context.WithValue(ctx, store.StoreMatcherKey, q.storeDebugMatchers)
 
 	resp := &seriesServer{ctx: ctx}
-	if err := q.proxy.Series(&storepb.SeriesRequest{
-		MinTime:                 hints.Start,
-		MaxTime:                 hints.End,
-		Matchers:                sms,
-		MaxResolutionWindow:     q.maxResolutionMillis,
-		Aggregates:              aggrs,
-		PartialResponseDisabled: !q.partialResponse,
-		SkipChunks:              q.skipChunks,
-	}, resp); err != nil {
+	if err := q.proxy.Series(d.req, resp); err != nil {
 		return nil, errors.Wrap(err, "proxy Series()")
 	}
+	mergeStart := time.Now()
 
 	var warns storage.Warnings
 	for _, w := range resp.warnings {
 		warns = append(warns, errors.New(w))
 	}
 
-	if !q.isDedupEnabled() {
-		// Return data without any deduplication.
-		return &promSeriesSet{
-			mint:  q.mint,
-			maxt:  q.maxt,
-			set:   newStoreSeriesSet(resp.seriesSet),
-			aggrs: aggrs,
-			warns: warns,
-		}, nil
+	// Only complete responses are cached, as missing series could come from StoreAPIs that failed.
+	if q.negativeCache != nil && len(resp.seriesSet) == 0 && len(warns) == 0 {
+		q.negativeCache.Add(d.negativeCacheKey, hints.Start, hints.End)
+	}
+
+	if d.alias != nil {
+		d.alias.relabel(resp.seriesSet)
+	}
+	if q.labelValueGuard != nil {
+		var guarded int
+		resp.seriesSet, guarded = guardLabelValues(q.labelValueGuard, resp.seriesSet)
+		if guarded > 0 {
+			warns = append(warns, errors.New(q.labelValueGuard.Warning(guarded)))
+		}
+	}
+
+	if q.maxSeries > 0 {
+		limited, limitWarns, err := limitSeries(resp.seriesSet, q.maxSeries, q.sampleOverSeriesLimit, d.limitReplicaLabels)
+		if err != nil {
+			return nil, err
+		}
+		resp.seriesSet = limited
+		warns = append(warns, limitWarns...)
+	}
+	if q.maxOutputSeries > 0 {
+		if err := limitOutputSeries(resp.seriesSet, d.outputGroupings, q.maxOutputSeries, d.replicaLabels); err != nil {
+			return nil, err
+		}
+	}
+	seriesSourcesTrackerFromContext(q.ctx).record(resp.seriesSet, hints.Start, hints.End, d.replicaLabels)
+
+	pset := &promSeriesSet{
+		mint:     q.mint,
+		maxt:     q.maxt,
+		set:      newStoreSeriesSet(resp.seriesSet),
+		aggrs:    d.aggrs,
+		warns:    warns,
+		tailOnly: d.req.TailOnly,
+
+		overlapPolicy: q.resolutionOverlapPolicy,
+		rawOnlyWithin: d.rawOnlyWithin,
+	}
+	if q.corruptChunkPolicy == CorruptChunkSkip && q.partialResponse {
+		pset.corruptChunks = corruptChunksTrackerFromContext(q.ctx)
+	}
+
+	var set storage.SeriesSet = pset
+	if q.isDedupEnabled() {
+		// TODO(fabxc): this could potentially pushed further down into the store API to make true streaming possible.
+		sortDedupLabels(resp.seriesSet, q.replicaLabels)
+
+		// The merged series set assembles all potentially-overlapping time ranges of the same series into a single one.
+		// TODO(bwplotka): We could potentially dedup on chunk level, use chunk iterator for that when available.
+		var counterResets *CounterResetsTracker
+		if q.flagCounterResets {
+			counterResets = counterResetsTrackerFromContext(q.ctx)
+		}
+		set = newDedupSeriesSet(set, q.replicaLabels, len(d.aggrs) == 1 && d.aggrs[0] == storepb.Aggr_COUNTER, q.dedupWindow.Milliseconds(), q.flagSingleReplica, counterResets, q.dedupMetrics)
+	}
+
+	if q.mergeTimeout > 0 {
+		// Merging is lazy, so the deadline is checked while the engine iterates over the returned set.
+		set = newMergeTimeoutSeriesSet(set, mergeStart.Add(q.mergeTimeout), q.mergeTimeout)
+	}
+	return set, nil
+}
+
+// isInstantSelect returns true if the select serves an instant evaluation: an instant query, a last sample lookup
+// or a select without a step, e.g. of the series or federate APIs.
+func isInstantSelect(hints *storage.SelectHints) bool {
+	return hints.Func == LastSampleFunc || (hints.Step == 0 && hints.Range == 0)
+}
+
+// SeriesLimitAccounting decides which series count towards the series limit of selects.
+type SeriesLimitAccounting string
+
+const (
+	// SeriesLimitDeduplicated counts series as they are after deduplication: series differing only in replica labels
+	// count as one, so HA setups are not penalized for replication.
+	SeriesLimitDeduplicated SeriesLimitAccounting = "deduplicated"
+	// SeriesLimitFetched counts all fetched series, each replica separately, which bounds the data merged by
+	// deduplication.
+	SeriesLimitFetched SeriesLimitAccounting = "fetched"
+)
+
+// limitSeries ensures that at most maxSeries distinct series are returned. Series differing only in replica labels
+// count as one series and are always kept or dropped together. If the limit is exceeded, an error is returned, unless
+// sample is true. Then series with the maxSeries lowest hashes of their labels (without replica labels) are returned
+// with a warning. Such a sample is deterministic and stable: the same series are chosen regardless of the order in which
+// stores responded, and matching more series can only replace part of the sample.
+func limitSeries(set []storepb.Series, maxSeries int, sample bool, replicaLabels map[string]struct{}) ([]storepb.Series, storage.Warnings, error) {
+	hashes := make([]uint64, len(set))
+	groups := make(map[uint64]struct{}, len(set))
+	for i, s := range set {
+		hashes[i] = seriesHashWithoutReplicaLabels(labelpb.LabelsToPromLabels(s.Labels), replicaLabels)
+		groups[hashes[i]] = struct{}{}
+	}
+	if len(groups) <= maxSeries {
+		return set, nil, nil
+	}
+	if !sample {
+		return nil, nil, status.Errorf(codes.ResourceExhausted, "exceeded series limit: %d series matched while the limit is %d", len(groups), maxSeries)
+	}
+
+	sorted := make([]uint64, 0, len(groups))
+	for h := range groups {
+		sorted = append(sorted, h)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	threshold := sorted[maxSeries-1]
+
+	limited := make([]storepb.Series, 0, maxSeries)
+	for i, s := range set {
+		if hashes[i] <= threshold {
+			limited = append(limited, s)
+		}
+	}
+	return limited, storage.Warnings{errors.Errorf("series limit exceeded: returning a sample of %d out of %d matched series", maxSeries, len(groups))}, nil
+}
+
+// limitOutputSeries returns an error if every aggregation grouping series of the select would produce more than
+// maxOutputSeries series, so that e.g. `sum by (high_cardinality_label)` is aborted before it is evaluated. Series
+// differing only in replica labels belong to the same group. Selects without groupings are not checked.
+func limitOutputSeries(set []storepb.Series, groupings []*outputGrouping, maxOutputSeries int, replicaLabels map[string]struct{}) error {
+	if len(groupings) == 0 {
+		return nil
+	}
+	// Series of selectors with the same matchers and hints can't be told apart, so an error is returned only if all
+	// their groupings exceed the limit.
+	for _, g := range groupings {
+		if !exceedsOutputSeries(set, g, maxOutputSeries, replicaLabels) {
+			return nil
+		}
 	}
+	return status.Errorf(codes.ResourceExhausted, "exceeded output series limit: %s would produce more than %d series", groupings[0], maxOutputSeries)
+}
 
-	// TODO(fabxc): this could potentially pushed further down into the store API to make true streaming possible.
-	sortDedupLabels(resp.seriesSet, q.replicaLabels)
-	set := &promSeriesSet{
-		mint:  q.mint,
-		maxt:  q.maxt,
-		set:   newStoreSeriesSet(resp.seriesSet),
-		aggrs: aggrs,
-		warns: warns,
+func exceedsOutputSeries(set []storepb.Series, g *outputGrouping, maxOutputSeries int, replicaLabels map[string]struct{}) bool {
+	var (
+		b      []byte
+		h      uint64
+		groups = make(map[uint64]struct{}, maxOutputSeries+1)
+	)
+	for _, s := range set {
+		lset := withoutReplicaLabels(labelpb.LabelsToPromLabels(s.Labels), replicaLabels)
+		if g.by {
+			h, b = lset.HashForLabels(b, g.grouping...)
+		} else {
+			h, b = lset.HashWithoutLabels(b, g.grouping...)
+		}
+		groups[h] = struct{}{}
+		if len(groups) > maxOutputSeries {
+			return true
+		}
 	}
+	return false
+}
 
-	// The merged series set assembles all potentially-overlapping time ranges of the same series into a single one.
-	// TODO(bwplotka): We could potentially dedup on chunk level, use chunk iterator for that when available.
-	return newDedupSeriesSet(set, q.replicaLabels, len(aggrs) == 1 && aggrs[0] == storepb.Aggr_COUNTER), nil
+func seriesHashWithoutReplicaLabels(lset labels.Labels, replicaLabels map[string]struct{}) uint64 {
+	return withoutReplicaLabels(lset, replicaLabels).Hash()
+}
+
+// withoutReplicaLabels returns labels without the replica labels. The given labels are returned if there is no replica
+// label.
+func withoutReplicaLabels(lset labels.Labels, replicaLabels map[string]struct{}) labels.Labels {
+	if len(replicaLabels) == 0 {
+		return lset
+	}
+	without := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if _, ok := replicaLabels[l.Name]; ok {
+			continue
+		}
+		without = append(without, l)
+	}
+	return without
 }
 
 // sortDedupLabels re-sorts the set so that the same series with different replica
@@ -331,30 +725,69 @@ func sortDedupLabels(set []storepb.Series, replicaLabels map[string]struct{}) {
 	})
 }
 
+// guardLabelValues truncates too long label values of series or drops such series, as decided by the guard. It returns
+// the remaining series, sorted by labels, and the number of truncated or dropped series.
+func guardLabelValues(g *store.LabelValueLengthGuard, set []storepb.Series) ([]storepb.Series, int) {
+	var guarded, truncated int
+	res := set[:0]
+	for _, s := range set {
+		lset, trunc, reject := g.Apply(labelpb.LabelsToPromLabels(s.Labels))
+		if reject {
+			guarded++
+			continue
+		}
+		if trunc {
+			s.Labels = labelpb.LabelsFromPromLabels(lset)
+			truncated++
+		}
+		res = append(res, s)
+	}
+	if truncated > 0 {
+		// Truncated label values may change the order of series.
+		sort.SliceStable(res, func(i, j int) bool {
+			return labels.Compare(labelpb.LabelsToPromLabels(res[i].Labels), labelpb.LabelsToPromLabels(res[j].Labels)) < 0
+		})
+	}
+	return res, guarded + truncated
+}
+
 // LabelValues returns all potential values for a label name.
 func (q *querier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	return q.LabelValuesWithMatchers(name)
+}
+
+// LabelValuesWithMatchers returns potential values for a label name of series matching all given matchers.
+// Matchers are pushed down to StoreAPIs.
+func (q *querier) LabelValuesWithMatchers(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
 	span, ctx := tracing.StartSpan(q.ctx, "querier_label_values")
 	defer span.Finish()
 
+	sms, err := storepb.TranslatePromMatchers(matchers...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "convert matchers")
+	}
+
 	// TODO(bwplotka): Pass it using the SeriesRequest instead of relying on context.
 	ctx = context.WithValue(ctx, store.StoreMatcherKey, q.storeDebugMatchers)
 
-	resp, err := q.proxy.LabelValues(ctx, &storepb.LabelValuesRequest{
+	// Values are streamed, so the proxy merges them incrementally instead of buffering responses of all stores.
+	resp := &labelValuesServer{ctx: ctx}
+	if err := q.proxy.LabelValuesStream(&storepb.LabelValuesRequest{
 		Label:                   name,
 		PartialResponseDisabled: !q.partialResponse,
 		Start:                   q.mint,
 		End:                     q.maxt,
-	})
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "proxy LabelValues()")
+		Matchers:                sms,
+	}, resp); err != nil {
+		return nil, nil, errors.Wrap(err, "proxy LabelValuesStream()")
 	}
 
 	var warns storage.Warnings
-	for _, w := range resp.Warnings {
+	for _, w := range resp.warnings {
 		warns = append(warns, errors.New(w))
 	}
 
-	return resp.Values, warns, nil
+	return resp.values, warns, nil
 }
 
 // LabelNames returns all the unique label names present in the block in sorted order.
@@ -14,11 +14,14 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/gate"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -27,11 +30,15 @@ import (
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
 
 type sample struct {
@@ -41,7 +48,7 @@ type sample struct {
 
 func TestQueryableCreator_MaxResolution(t *testing.T) {
 	testProxy := &storeServer{resps: []*storepb.SeriesResponse{}}
-	queryableCreator := NewQueryableCreator(nil, nil, testProxy, 2, 5*time.Second)
+	queryableCreator := NewQueryableCreator(nil, nil, testProxy, 2, 5*time.Second, QueryableCreatorOpts{})
 
 	oneHourMillis := int64(1*time.Hour) / int64(time.Millisecond)
 	queryable := queryableCreator(false, nil, nil, oneHourMillis, false, false)
@@ -71,7 +78,7 @@ func TestQuerier_DownsampledData(t *testing.T) {
 	}
 
 	timeout := 10 * time.Second
-	q := NewQueryableCreator(nil, nil, testProxy, 2, timeout)(false, nil, nil, 9999999, false, false)
+	q := NewQueryableCreator(nil, nil, testProxy, 2, timeout, QueryableCreatorOpts{})(false, nil, nil, 9999999, false, false)
 	engine := promql.NewEngine(
 		promql.EngineOpts{
 			MaxSamples: math.MaxInt32,
@@ -362,7 +369,7 @@ func TestQuerier_Select_AfterPromQL(t *testing.T) {
 						g := gate.New(2)
 						mq := &mockedQueryable{
 							Creator: func(mint, maxt int64) storage.Querier {
-								return newQuerier(context.Background(), nil, mint, maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout)
+								return newQuerier(context.Background(), nil, mint, maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout, nil, QueryableCreatorOpts{})
 							},
 						}
 						t.Cleanup(func() {
@@ -606,7 +613,7 @@ func TestQuerier_Select(t *testing.T) {
 				{dedup: true, expected: []series{tcase.expectedAfterDedup}},
 			} {
 				g := gate.New(2)
-				q := newQuerier(context.Background(), nil, tcase.mint, tcase.maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout)
+				q := newQuerier(context.Background(), nil, tcase.mint, tcase.maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout, nil, QueryableCreatorOpts{})
 				t.Cleanup(func() { testutil.Ok(t, q.Close()) })
 
 				t.Run(fmt.Sprintf("dedup=%v", sc.dedup), func(t *testing.T) {
@@ -853,7 +860,7 @@ func TestQuerierWithDedupUnderstoodByPromQL_Rate(t *testing.T) {
 
 		timeout := 100 * time.Second
 		g := gate.New(2)
-		q := newQuerier(context.Background(), logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, s, false, 0, true, false, g, timeout)
+		q := newQuerier(context.Background(), logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, s, false, 0, true, false, g, timeout, nil, QueryableCreatorOpts{})
 		t.Cleanup(func() {
 			testutil.Ok(t, q.Close())
 		})
@@ -923,7 +930,7 @@ func TestQuerierWithDedupUnderstoodByPromQL_Rate(t *testing.T) {
 
 		timeout := 5 * time.Second
 		g := gate.New(2)
-		q := newQuerier(context.Background(), logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, s, true, 0, true, false, g, timeout)
+		q := newQuerier(context.Background(), logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, s, true, 0, true, false, g, timeout, nil, QueryableCreatorOpts{})
 		t.Cleanup(func() {
 			testutil.Ok(t, q.Close())
 		})
@@ -1028,6 +1035,857 @@ func TestSortReplicaLabel(t *testing.T) {
 	}
 }
 
+func TestQuerier_Select_LastSample(t *testing.T) {
+	storeAPI := &storeServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "a"), []sample{{0, 0}, {10, 1}}, []sample{{20, 2}, {30, 3}}, []sample{{40, 4}, {50, 5}}),
+			// Overlapping chunk, sent by other store.
+			storeSeriesResponse(t, labels.FromStrings("a", "a"), []sample{{35, 35}, {42, 42}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{0, 0}, {10, 1}}, []sample{{200, 2}, {300, 3}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "c"), []sample{{100, 1}}),
+		},
+	}
+
+	q := newQuerier(context.Background(), nil, 5, 45, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{})
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	res := q.Select(false, &storage.SelectHints{Start: 5, End: 45, Func: LastSampleFunc})
+	testSelectResponse(t, []series{
+		{
+			// Only the newest chunk starting before maxt and chunks overlapping with it are decoded and merged.
+			lset:    labels.FromStrings("a", "a"),
+			samples: []sample{{35, 35}, {40, 4}, {42, 42}},
+		},
+		{
+			lset:    labels.FromStrings("a", "b"),
+			samples: []sample{{10, 1}},
+		},
+	}, res)
+}
+
+func TestQuerier_Select_FanoutTracker(t *testing.T) {
+	tracker := store.NewFanoutTracker()
+	storeAPI := &ctxStoreServer{}
+
+	q := newQuerier(context.WithValue(context.Background(), store.FanoutTrackerKey, tracker), nil, 0, 1000, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{})
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	res := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+	testutil.Assert(t, !res.Next(), "expected no series")
+	testutil.Ok(t, res.Err())
+	// Proxy records StoreAPIs queried by the select in the tracker of the query.
+	testutil.Equals(t, tracker, storeAPI.ctx.Value(store.FanoutTrackerKey))
+}
+
+func TestQuerier_Select_SeriesSources(t *testing.T) {
+	withSources := func(resp *storepb.SeriesResponse, srcs ...storepb.ChunkSource) *storepb.SeriesResponse {
+		for i := range srcs {
+			resp.GetSeries().Chunks[i].Source = &srcs[i]
+		}
+		return resp
+	}
+	storeAPI := &storeServer{resps: []*storepb.SeriesResponse{
+		withSources(
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "r", "1"), []sample{{0, 1}, {10, 1}}, []sample{{20, 1}, {30, 1}}, []sample{{500, 1}}),
+			storepb.ChunkSource{Store: "store-a", BlockId: "block-2"},
+			storepb.ChunkSource{Store: "store-a", BlockId: "block-1"},
+			storepb.ChunkSource{Store: "store-a", BlockId: "block-5"},
+		),
+		withSources(
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "r", "2"), []sample{{0, 1}, {10, 1}}),
+			storepb.ChunkSource{Store: "store-b", BlockId: "block-3"},
+		),
+		withSources(
+			storeSeriesResponse(t, labels.FromStrings("a", "2", "r", "1"), []sample{{0, 1}, {10, 1}}, []sample{{20, 1}, {30, 1}}),
+			storepb.ChunkSource{Store: "store-a", BlockId: "block-1"},
+			storepb.ChunkSource{Store: "store-a", BlockId: "block-1"},
+		),
+	}}
+
+	selectSources := func(t *testing.T, limit int) []SeriesSources {
+		tracker := NewSeriesSourcesTracker(limit)
+		q := newQuerier(context.WithValue(context.Background(), SeriesSourcesTrackerKey, tracker), nil, 0, 100, []string{"r"}, nil, storeAPI, true, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{})
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 100}, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		for res.Next() {
+		}
+		testutil.Ok(t, res.Err())
+		return tracker.Series()
+	}
+
+	t.Run("sources of all replicas within range", func(t *testing.T) {
+		testutil.Equals(t, []SeriesSources{
+			{
+				Labels: labels.FromStrings("a", "1"),
+				Sources: []SeriesSource{
+					{Store: "store-a", Block: "block-1"},
+					{Store: "store-a", Block: "block-2"},
+					{Store: "store-b", Block: "block-3"},
+				},
+			},
+			{
+				Labels:  labels.FromStrings("a", "2"),
+				Sources: []SeriesSource{{Store: "store-a", Block: "block-1"}},
+			},
+		}, selectSources(t, 10))
+	})
+	t.Run("sources over limit are truncated", func(t *testing.T) {
+		testutil.Equals(t, []SeriesSources{
+			{
+				Labels: labels.FromStrings("a", "1"),
+				Sources: []SeriesSource{
+					{Store: "store-a", Block: "block-1"},
+					{Store: "store-a", Block: "block-2"},
+				},
+				Truncated: true,
+			},
+			{
+				Labels:  labels.FromStrings("a", "2"),
+				Sources: []SeriesSource{{Store: "store-a", Block: "block-1"}},
+			},
+		}, selectSources(t, 2))
+	})
+}
+
+func TestQuerier_Select_CounterResetsTracker(t *testing.T) {
+	storeAPI := &storeServer{resps: []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("__name__", "x_total", "replica", "r0"), []sample{{0, 100}, {10000, 110}, {20000, 120}}),
+		storeSeriesResponse(t, labels.FromStrings("__name__", "x_total", "replica", "r1"), []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}, {40000, 90}, {50000, 100}, {60000, 110}}),
+	}}
+	tracker := NewCounterResetsTracker()
+	m := newDedupMetrics(nil)
+	q := newQuerier(context.WithValue(context.Background(), CounterResetsTrackerKey, tracker), nil, 0, 60000, []string{"replica"}, nil, storeAPI, true, 0, true, false, gate.New(2), 10*time.Second, m, QueryableCreatorOpts{FlagCounterResets: true})
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	// Like PromQL, warnings are read once all series are gathered, before their samples are iterated.
+	res := q.Select(false, &storage.SelectHints{Start: 0, End: 60000}, labels.MustNewMatcher(labels.MatchEqual, "__name__", "x_total"))
+	testutil.Assert(t, res.Next(), "expected series")
+	s := res.At()
+	testutil.Assert(t, !res.Next(), "expected single series")
+	testutil.Ok(t, res.Err())
+	testutil.Equals(t, 0, len(res.Warnings()))
+	testutil.Equals(t, 0, len(tracker.Warnings()))
+
+	// Resets are detected during iteration, each series is recorded once.
+	for i := 0; i < 2; i++ {
+		expandSeries(t, s.Iterator())
+	}
+	testutil.Equals(t, 1, len(tracker.Warnings()))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(m.counterResetSeries))
+}
+
+func TestQuerier_Select_IgnoreNewerThan(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, db.Close()) })
+
+	now := time.Now()
+	app := db.Appender(context.Background())
+	for _, ago := range []time.Duration{30 * time.Minute, 20 * time.Minute, 5 * time.Minute, time.Minute} {
+		_, err := app.Add(labels.FromStrings("a", "1"), timestamp.FromTime(now.Add(-ago)), ago.Minutes())
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	selectSamples := func(t *testing.T, ignoreNewerThan time.Duration, start, end time.Time) []sample {
+		q, err := NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), 2, 10*time.Second, QueryableCreatorOpts{IgnoreNewerThan: ignoreNewerThan})(false, nil, nil, 0, true, false).
+			Querier(context.Background(), timestamp.FromTime(start), timestamp.FromTime(end))
+		testutil.Ok(t, err)
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+		res := q.Select(false, &storage.SelectHints{Start: timestamp.FromTime(start), End: timestamp.FromTime(end)}, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		var samples []sample
+		for res.Next() {
+			it := res.At().Iterator()
+			for it.Next() {
+				_, v := it.At()
+				samples = append(samples, sample{v: v})
+			}
+			testutil.Ok(t, it.Err())
+		}
+		testutil.Ok(t, res.Err())
+		return samples
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		testutil.Equals(t, []sample{{v: 30}, {v: 20}, {v: 5}, {v: 1}}, selectSamples(t, 0, now.Add(-time.Hour), now))
+	})
+	t.Run("data newer than threshold is excluded", func(t *testing.T) {
+		testutil.Equals(t, []sample{{v: 30}, {v: 20}}, selectSamples(t, 10*time.Minute, now.Add(-time.Hour), now))
+	})
+	t.Run("range newer than threshold is empty", func(t *testing.T) {
+		testutil.Equals(t, []sample(nil), selectSamples(t, 10*time.Minute, now.Add(-8*time.Minute), now))
+	})
+}
+
+func TestTailChunks(t *testing.T) {
+	chk := func(mint, maxt int64) storepb.AggrChunk { return storepb.AggrChunk{MinTime: mint, MaxTime: maxt} }
+
+	for _, tcase := range []struct {
+		chks     []storepb.AggrChunk
+		maxt     int64
+		expected []storepb.AggrChunk
+	}{
+		{chks: []storepb.AggrChunk{}, maxt: 100, expected: nil},
+		{chks: []storepb.AggrChunk{chk(10, 20)}, maxt: 5, expected: []storepb.AggrChunk{}},
+		{chks: []storepb.AggrChunk{chk(0, 9), chk(10, 19), chk(20, 29)}, maxt: 100, expected: []storepb.AggrChunk{chk(20, 29)}},
+		{chks: []storepb.AggrChunk{chk(0, 9), chk(10, 19), chk(20, 29)}, maxt: 15, expected: []storepb.AggrChunk{chk(10, 19)}},
+		{chks: []storepb.AggrChunk{chk(0, 25), chk(10, 19), chk(20, 29)}, maxt: 100, expected: []storepb.AggrChunk{chk(0, 25), chk(10, 19), chk(20, 29)}},
+		{chks: []storepb.AggrChunk{chk(0, 9), chk(10, 25), chk(20, 29)}, maxt: 100, expected: []storepb.AggrChunk{chk(10, 25), chk(20, 29)}},
+	} {
+		t.Run("", func(t *testing.T) {
+			start, end := tailChunks(tcase.chks, tcase.maxt)
+			res := tcase.chks[start:end]
+			if len(tcase.expected) == 0 {
+				testutil.Equals(t, 0, len(res))
+				return
+			}
+			testutil.Equals(t, tcase.expected, res)
+		})
+	}
+}
+
+func TestQuerier_Select_ResolutionOverlap(t *testing.T) {
+	raw := storeSeriesResponse(t, labels.FromStrings("a", "a"), []sample{{500000, 1}, {600000, 1}, {700000, 1}, {800000, 1}, {900000, 1}, {1000000, 1}})
+	downsampled := downsampledChunk(t, []sample{{300000, 100}, {600000, 100}, {900000, 100}, {1200000, 100}})
+	raw.GetSeries().Chunks = append([]storepb.AggrChunk{downsampled}, raw.GetSeries().Chunks...)
+
+	for _, tcase := range []struct {
+		policy   ResolutionOverlapPolicy
+		expected []sample
+	}{
+		{
+			policy:   ResolutionOverlapNone,
+			expected: []sample{{300000, 100}, {600000, 100}, {900000, 100}, {1200000, 100}},
+		},
+		{
+			policy:   ResolutionOverlapPreferRaw,
+			expected: []sample{{300000, 100}, {500000, 1}, {600000, 1}, {700000, 1}, {800000, 1}, {900000, 1}, {1000000, 1}, {1200000, 100}},
+		},
+		{
+			policy:   ResolutionOverlapPreferDownsampled,
+			expected: []sample{{300000, 100}, {600000, 100}, {900000, 100}, {1200000, 100}},
+		},
+	} {
+		t.Run(string(tcase.policy), func(t *testing.T) {
+			storeAPI := &storeServer{resps: []*storepb.SeriesResponse{raw}}
+
+			q := newQuerier(context.Background(), nil, 0, 2000000, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{ResolutionOverlapPolicy: tcase.policy})
+			t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+			res := q.Select(false, &storage.SelectHints{Start: 0, End: 2000000})
+			testSelectResponse(t, []series{{lset: labels.FromStrings("a", "a"), samples: tcase.expected}}, res)
+		})
+	}
+}
+
+func TestQuerier_Select_InstantPreferRaw(t *testing.T) {
+	// Downsampled chunk starts together with the raw one, so without the rule the sample chosen within the lookback
+	// depends on which of them is iterated first.
+	downsampled := downsampledChunk(t, []sample{{600000, 100}, {900000, 100}, {1200000, 100}})
+	withChunks := func(raw []sample, downsampledFirst bool) *storepb.SeriesResponse {
+		resp := storeSeriesResponse(t, labels.FromStrings("a", "a"), raw)
+		if downsampledFirst {
+			resp.GetSeries().Chunks = append([]storepb.AggrChunk{downsampled}, resp.GetSeries().Chunks...)
+		} else {
+			resp.GetSeries().Chunks = append(resp.GetSeries().Chunks, downsampled)
+		}
+		return resp
+	}
+
+	// Instant query at 950000 with 300000 lookback.
+	instant := &storage.SelectHints{Start: 650000, End: 950000}
+	for _, tcase := range []struct {
+		name     string
+		raw      []sample
+		hints    *storage.SelectHints
+		expected []sample
+	}{
+		{
+			name:     "raw covering evaluation time",
+			raw:      []sample{{600000, 1}, {700000, 1}, {800000, 1}, {900000, 1}, {1000000, 1}},
+			hints:    instant,
+			expected: []sample{{700000, 1}, {800000, 1}, {900000, 1}},
+		},
+		{
+			name:     "raw ending within lookback",
+			raw:      []sample{{600000, 1}, {700000, 1}, {800000, 1}},
+			hints:    instant,
+			expected: []sample{{700000, 1}, {800000, 1}},
+		},
+		{
+			name:     "raw ending before lookback",
+			raw:      []sample{{100000, 1}, {200000, 1}, {300000, 1}},
+			hints:    instant,
+			expected: []sample{{900000, 100}},
+		},
+		{
+			name:     "lookup of the last sample",
+			raw:      []sample{{600000, 1}, {700000, 1}, {800000, 1}, {900000, 1}, {1000000, 1}},
+			hints:    &storage.SelectHints{Start: 650000, End: 950000, Step: 30000, Func: LastSampleFunc},
+			expected: []sample{{700000, 1}, {800000, 1}, {900000, 1}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			for _, downsampledFirst := range []bool{true, false} {
+				storeAPI := &storeServer{resps: []*storepb.SeriesResponse{withChunks(tcase.raw, downsampledFirst)}}
+
+				q := newQuerier(context.Background(), nil, 650000, 950000, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{InstantPreferRaw: true})
+				t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+				res := q.Select(false, tcase.hints)
+				testSelectResponse(t, []series{{lset: labels.FromStrings("a", "a"), samples: tcase.expected}}, res)
+			}
+		})
+	}
+
+	t.Run("range query", func(t *testing.T) {
+		// Range queries keep following the resolution overlap policy.
+		storeAPI := &storeServer{resps: []*storepb.SeriesResponse{withChunks([]sample{{600000, 1}, {700000, 1}, {800000, 1}}, true)}}
+
+		q := newQuerier(context.Background(), nil, 650000, 950000, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{InstantPreferRaw: true})
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+		res := q.Select(false, &storage.SelectHints{Start: 650000, End: 950000, Step: 30000})
+		testSelectResponse(t, []series{{lset: labels.FromStrings("a", "a"), samples: []sample{{900000, 100}}}}, res)
+	})
+}
+
+func TestQuerier_Select_OverlappingChunks(t *testing.T) {
+	resp := storeSeriesResponse(t, labels.FromStrings("a", "a"),
+		[]sample{{100, 1}, {300, 3}, {500, 5}},
+		[]sample{{200, 2}, {300, 30}, {400, 4}},
+		[]sample{{450, 4.5}, {600, 6}},
+	)
+
+	storeAPI := &storeServer{resps: []*storepb.SeriesResponse{resp}}
+	q := newQuerier(context.Background(), nil, 0, 1000, nil, nil, storeAPI, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{})
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000})
+	testSelectResponse(t, []series{{
+		lset:    labels.FromStrings("a", "a"),
+		samples: []sample{{100, 1}, {200, 2}, {300, 3}, {400, 4}, {450, 4.5}, {500, 5}, {600, 6}},
+	}}, res)
+}
+
+func TestQuerier_Select_CorruptChunks(t *testing.T) {
+	newResps := func() []*storepb.SeriesResponse {
+		a := storeSeriesResponse(t, labels.FromStrings("a", "a"),
+			[]sample{{100, 1}, {150, 1.5}},
+			[]sample{{200, 2}, {250, 2.5}, {300, 3}},
+			[]sample{{400, 4}, {450, 4.5}},
+		)
+		b := storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{100, 1}, {200, 2}})
+		// The chunk of a is truncated right after its first sample, the one of b within its first sample.
+		a.GetSeries().Chunks[1].Raw.Data = a.GetSeries().Chunks[1].Raw.Data[:12]
+		b.GetSeries().Chunks[0].Raw.Data = b.GetSeries().Chunks[0].Raw.Data[:3]
+		return []*storepb.SeriesResponse{a, b}
+	}
+	newSet := func(t *testing.T, ctx context.Context, policy CorruptChunkPolicy, partialResponse bool) storage.SeriesSet {
+		q := newQuerier(ctx, nil, 0, 1000, nil, nil, &storeServer{resps: newResps()}, false, 0, partialResponse, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{CorruptChunkPolicy: policy})
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+		return q.Select(false, &storage.SelectHints{Start: 0, End: 1000})
+	}
+	// iterationErr returns the first error of iterating over samples of all series.
+	iterationErr := func(t *testing.T, res storage.SeriesSet) error {
+		var series []storage.Series
+		for res.Next() {
+			series = append(series, res.At())
+		}
+		testutil.Ok(t, res.Err())
+		for _, s := range series {
+			it := s.Iterator()
+			for it.Next() {
+			}
+			if it.Err() != nil {
+				return it.Err()
+			}
+		}
+		return nil
+	}
+	withTracker := func() (context.Context, *CorruptChunksTracker) {
+		tracker := NewCorruptChunksTracker()
+		return context.WithValue(context.Background(), CorruptChunksTrackerKey, tracker), tracker
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		ctx, _ := withTracker()
+		testutil.NotOk(t, iterationErr(t, newSet(t, ctx, CorruptChunkFail, true)))
+	})
+	t.Run("skip without partial response", func(t *testing.T) {
+		ctx, _ := withTracker()
+		testutil.NotOk(t, iterationErr(t, newSet(t, ctx, CorruptChunkSkip, false)))
+	})
+	t.Run("skip without tracker", func(t *testing.T) {
+		testutil.NotOk(t, iterationErr(t, newSet(t, context.Background(), CorruptChunkSkip, true)))
+	})
+	t.Run("skip", func(t *testing.T) {
+		ctx, tracker := withTracker()
+		res := newSet(t, ctx, CorruptChunkSkip, true)
+
+		var series []storage.Series
+		for res.Next() {
+			series = append(series, res.At())
+		}
+		testutil.Ok(t, res.Err())
+		testutil.Equals(t, 0, len(res.Warnings()))
+		// Chunks are decoded only once samples are iterated.
+		testutil.Equals(t, 0, len(tracker.Warnings()))
+
+		// Samples decoded before the failure are kept, the series continues with the chunk after the corrupt one.
+		testutil.Equals(t, 2, len(series))
+		testutil.Equals(t, labels.FromStrings("a", "a"), series[0].Labels())
+		testutil.Equals(t, []sample{{100, 1}, {150, 1.5}, {200, 2}, {400, 4}, {450, 4.5}}, expandSeries(t, series[0].Iterator()))
+		testutil.Equals(t, labels.FromStrings("a", "b"), series[1].Labels())
+		testutil.Equals(t, []sample(nil), expandSeries(t, series[1].Iterator()))
+		// Iterating again doesn't record chunks twice.
+		expandSeries(t, series[0].Iterator())
+
+		testutil.Equals(t, 1, len(tracker.Warnings()))
+		testutil.Equals(t, "skipped 2 chunks of 2 series that failed to decode, e.g. because of a corrupted block; these series have gaps", tracker.Warnings()[0].Error())
+	})
+}
+
+func TestQuerier_Select_SeriesLimit(t *testing.T) {
+	var resps []*storepb.SeriesResponse
+	for i := 0; i < 10; i++ {
+		for _, replica := range []string{"r1", "r2"} {
+			resps = append(resps, storeSeriesResponse(t, labels.FromStrings("a", strconv.Itoa(i), "replica", replica), []sample{{100, 1}}))
+		}
+	}
+	reversed := make([]*storepb.SeriesResponse, 0, len(resps))
+	for i := len(resps) - 1; i >= 0; i-- {
+		reversed = append(reversed, resps[i])
+	}
+
+	selectSeries := func(t *testing.T, resps []*storepb.SeriesResponse, dedup bool, maxSeries int, sample bool, accounting SeriesLimitAccounting) ([]labels.Labels, storage.Warnings, error) {
+		q := newQuerier(context.Background(), nil, 0, 1000, []string{"replica"}, nil, &storeServer{resps: resps}, dedup, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{MaxSeries: maxSeries, SampleOverSeriesLimit: sample, SeriesLimitAccounting: accounting})
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000})
+		var lsets []labels.Labels
+		for res.Next() {
+			lsets = append(lsets, res.At().Labels())
+		}
+		return lsets, res.Warnings(), res.Err()
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		lsets, warns, err := selectSeries(t, resps, true, 10, false, SeriesLimitDeduplicated)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(warns))
+		testutil.Equals(t, 10, len(lsets))
+	})
+	t.Run("exceeded limit fails", func(t *testing.T) {
+		_, _, err := selectSeries(t, resps, false, 10, false, SeriesLimitDeduplicated)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(errors.Cause(err)))
+	})
+	t.Run("replicas counted after deduplication", func(t *testing.T) {
+		lsets, _, err := selectSeries(t, resps, true, 10, false, SeriesLimitDeduplicated)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 10, len(lsets))
+
+		_, _, err = selectSeries(t, resps, true, 9, false, SeriesLimitDeduplicated)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(errors.Cause(err)))
+	})
+	t.Run("replicas counted as fetched", func(t *testing.T) {
+		_, _, err := selectSeries(t, resps, true, 10, false, SeriesLimitFetched)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(errors.Cause(err)))
+
+		lsets, _, err := selectSeries(t, resps, true, 20, false, SeriesLimitFetched)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 10, len(lsets))
+	})
+	t.Run("exceeded limit is sampled", func(t *testing.T) {
+		lsets, warns, err := selectSeries(t, resps, true, 4, true, SeriesLimitDeduplicated)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(warns))
+		testutil.Equals(t, "series limit exceeded: returning a sample of 4 out of 10 matched series", warns[0].Error())
+		testutil.Equals(t, 4, len(lsets))
+
+		// The sample does not depend on the order of responses.
+		lsetsReversed, _, err := selectSeries(t, reversed, true, 4, true, SeriesLimitDeduplicated)
+		testutil.Ok(t, err)
+		testutil.Equals(t, lsets, lsetsReversed)
+
+		// Replicas of the sampled series are kept together.
+		var set []storepb.Series
+		for _, r := range resps {
+			set = append(set, *r.GetSeries())
+		}
+		limited, _, err := limitSeries(set, 4, true, map[string]struct{}{"replica": {}})
+		testutil.Ok(t, err)
+		testutil.Equals(t, 8, len(limited))
+		replicas := map[string]int{}
+		for _, s := range limited {
+			replicas[labelpb.LabelsToPromLabels(s.Labels).Get("a")]++
+		}
+		for _, lset := range lsets {
+			testutil.Equals(t, 2, replicas[lset.Get("a")])
+		}
+	})
+}
+
+type slowSeriesSet struct {
+	storage.SeriesSet
+	delay time.Duration
+}
+
+func (s *slowSeriesSet) At() storage.Series {
+	return slowSeries{series: s.SeriesSet.At().(series), delay: s.delay}
+}
+
+type slowSeries struct {
+	series
+	delay time.Duration
+}
+
+func (s slowSeries) Iterator() chunkenc.Iterator {
+	return &slowSeriesIterator{Iterator: s.series.Iterator(), delay: s.delay}
+}
+
+type slowSeriesIterator struct {
+	chunkenc.Iterator
+	delay time.Duration
+}
+
+func (it *slowSeriesIterator) Next() bool {
+	time.Sleep(it.delay)
+	return it.Iterator.Next()
+}
+
+func TestQuerier_Select_LabelValueLengthGuard(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	resps := []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("a", "1", "b", long+"1"), []sample{{100, 1}}),
+		storeSeriesResponse(t, labels.FromStrings("a", "1", "b", long+"2"), []sample{{100, 2}}),
+		storeSeriesResponse(t, labels.FromStrings("a", "1", "b", strings.Repeat("x", 23)+"y"), []sample{{100, 3}}),
+	}
+
+	for _, tcase := range []struct {
+		mode     store.LabelValueLengthMode
+		expected []float64
+	}{
+		// Truncated values end with "~" and hash after the first 23 bytes, so they sort after the short value.
+		{mode: store.LabelValueLengthTruncate, expected: []float64{3, 1, 2}},
+		{mode: store.LabelValueLengthReject, expected: []float64{3}},
+	} {
+		t.Run(string(tcase.mode), func(t *testing.T) {
+			guard, err := store.NewLabelValueLengthGuard(nil, 40, tcase.mode)
+			testutil.Ok(t, err)
+			q := newQuerier(context.Background(), nil, 0, 1000, nil, nil, &storeServer{resps: resps}, false, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{LabelValueGuard: guard})
+			t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+			res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000})
+			var (
+				vals  []float64
+				lsets []labels.Labels
+			)
+			for res.Next() {
+				lsets = append(lsets, res.At().Labels())
+				for _, s := range expandSeries(t, res.At().Iterator()) {
+					vals = append(vals, s.v)
+				}
+			}
+			testutil.Ok(t, res.Err())
+			testutil.Equals(t, tcase.expected, vals)
+			testutil.Equals(t, 1, len(res.Warnings()))
+			testutil.Equals(t, guard.Warning(2), res.Warnings()[0].Error())
+			for _, lset := range lsets {
+				testutil.Assert(t, len(lset.Get("b")) <= 40, "expected label value within limit, got %d bytes", len(lset.Get("b")))
+			}
+		})
+	}
+}
+
+func TestQuerier_Select_MergeTimeout(t *testing.T) {
+	t.Run("expired before merge", func(t *testing.T) {
+		q := newQuerier(context.Background(), nil, 0, 1000, []string{"replica"}, nil, &storeServer{resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r1"), []sample{{100, 1}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r2"), []sample{{100, 1}}),
+		}}, true, 0, true, false, gate.New(2), 10*time.Second, nil, QueryableCreatorOpts{MergeTimeout: time.Nanosecond})
+		t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+		time.Sleep(time.Millisecond)
+		res := q.Select(false, &storage.SelectHints{Start: 0, End: 1000})
+		testutil.Assert(t, !res.Next(), "expected no series after merge timeout")
+		testutil.NotOk(t, res.Err())
+		testutil.Assert(t, errors.Is(res.Err(), context.DeadlineExceeded), "expected deadline exceeded error, got %v", res.Err())
+	})
+
+	var samples []sample
+	for i := 0; i < 10*mergeTimeoutCheckInterval; i++ {
+		samples = append(samples, sample{int64(i), float64(i)})
+	}
+	slowSet := func() storage.SeriesSet {
+		return &mockedSeriesSet{series: []series{{lset: labels.FromStrings("a", "1"), samples: samples}}}
+	}
+
+	t.Run("slow merge is aborted", func(t *testing.T) {
+		set := newMergeTimeoutSeriesSet(&slowSeriesSet{SeriesSet: slowSet(), delay: 100 * time.Microsecond}, time.Now().Add(10*time.Millisecond), 10*time.Millisecond)
+		testutil.Assert(t, set.Next(), "expected series before merge timeout")
+		it := set.At().Iterator()
+		var n int
+		for it.Next() {
+			n++
+		}
+		testutil.Assert(t, n < len(samples), "expected iteration to be aborted, got all %d samples", n)
+		testutil.Assert(t, errors.Is(it.Err(), context.DeadlineExceeded), "expected deadline exceeded error, got %v", it.Err())
+		testutil.Equals(t, "merging series exceeded merge timeout of 10ms: context deadline exceeded", it.Err().Error())
+		testutil.Assert(t, !set.Next(), "expected no more series after merge timeout")
+		testutil.Equals(t, it.Err(), set.Err())
+	})
+	t.Run("merge within timeout", func(t *testing.T) {
+		set := newMergeTimeoutSeriesSet(slowSet(), time.Now().Add(time.Minute), time.Minute)
+		testutil.Assert(t, set.Next(), "expected series within merge timeout")
+		testutil.Equals(t, samples, expandSeries(t, set.At().Iterator()))
+		testutil.Assert(t, !set.Next(), "expected single series")
+		testutil.Ok(t, set.Err())
+	})
+}
+
+func TestLabelValuesServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &labelValuesServer{ctx: ctx}
+
+	testutil.Ok(t, srv.Send(&storepb.LabelValuesStreamResponse{Values: []string{"a", "b"}, Warnings: []string{"w"}}))
+	testutil.Ok(t, srv.Send(&storepb.LabelValuesStreamResponse{Values: []string{"c"}}))
+	testutil.Equals(t, []string{"a", "b", "c"}, srv.values)
+	testutil.Equals(t, []string{"w"}, srv.warnings)
+
+	// Merge is stopped once the query is canceled.
+	cancel()
+	testutil.Equals(t, context.Canceled, srv.Send(&storepb.LabelValuesStreamResponse{Values: []string{"d"}}))
+	testutil.Equals(t, []string{"a", "b", "c"}, srv.values)
+}
+
+func TestOverlappingRawChunks(t *testing.T) {
+	rawChk := func(mint, maxt int64) storepb.AggrChunk {
+		return storepb.AggrChunk{MinTime: mint, MaxTime: maxt, Raw: &storepb.Chunk{}}
+	}
+	dsChk := func(mint, maxt int64) storepb.AggrChunk {
+		return storepb.AggrChunk{MinTime: mint, MaxTime: maxt, Sum: &storepb.Chunk{}, Count: &storepb.Chunk{}}
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		chks     []storepb.AggrChunk
+		expected bool
+	}{
+		{name: "no chunks"},
+		{name: "single chunk", chks: []storepb.AggrChunk{rawChk(0, 100)}},
+		{name: "adjacent raw chunks", chks: []storepb.AggrChunk{rawChk(0, 100), rawChk(101, 200)}},
+		{name: "overlapping raw chunks", chks: []storepb.AggrChunk{rawChk(0, 100), rawChk(100, 200)}, expected: true},
+		{name: "overlapping raw chunks not adjacent", chks: []storepb.AggrChunk{rawChk(0, 100), rawChk(101, 200), rawChk(150, 160)}, expected: true},
+		{name: "overlapping downsampled chunks", chks: []storepb.AggrChunk{dsChk(0, 100), dsChk(50, 200)}},
+		{name: "overlapping raw and downsampled chunks", chks: []storepb.AggrChunk{dsChk(0, 100), rawChk(50, 200), rawChk(60, 70)}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, overlappingRawChunks(tcase.chks))
+		})
+	}
+}
+
+func TestMergedChunkSeriesIterator(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		chunks   [][]sample
+		expected []sample
+	}{
+		{
+			name:     "single chunk",
+			chunks:   [][]sample{{{1, 1}, {2, 2}, {3, 3}}},
+			expected: []sample{{1, 1}, {2, 2}, {3, 3}},
+		},
+		{
+			name:     "interleaved chunks",
+			chunks:   [][]sample{{{1, 1}, {4, 4}, {7, 7}}, {{2, 2}, {5, 5}}, {{3, 3}, {6, 6}}},
+			expected: []sample{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}, {7, 7}},
+		},
+		{
+			name:     "out of order chunk within another",
+			chunks:   [][]sample{{{1, 1}, {10, 10}}, {{3, 3}, {4, 4}}},
+			expected: []sample{{1, 1}, {3, 3}, {4, 4}, {10, 10}},
+		},
+		{
+			name:     "same timestamps are deduplicated preferring the earliest chunk",
+			chunks:   [][]sample{{{1, 1}, {2, 2}, {3, 3}}, {{2, 20}, {3, 30}, {4, 40}}, {{3, 300}}},
+			expected: []sample{{1, 1}, {2, 2}, {3, 3}, {4, 40}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			newIt := func() chunkenc.Iterator {
+				its := make([]chunkenc.Iterator, 0, len(tcase.chunks))
+				for _, c := range tcase.chunks {
+					its = append(its, newMockedSeriesIterator(c))
+				}
+				return newMergedChunkSeriesIterator(its)
+			}
+			testutil.Equals(t, tcase.expected, expandSeries(t, newIt()))
+
+			// Seek has to reach every sample in order.
+			it := newIt()
+			for _, smpl := range tcase.expected {
+				testutil.Assert(t, it.Seek(smpl.t), "seek to %d", smpl.t)
+				ts, v := it.At()
+				testutil.Equals(t, smpl, sample{ts, v})
+			}
+			testutil.Assert(t, !it.Seek(tcase.expected[len(tcase.expected)-1].t+1), "seek past the end")
+
+			// Once exhausted, the iterator stays exhausted, even when seeking to already iterated samples.
+			it = newIt()
+			expandSeries(t, it)
+			testutil.Assert(t, !it.Seek(tcase.expected[0].t), "seek after exhaustion")
+			testutil.Assert(t, !it.Next(), "next after exhaustion")
+		})
+	}
+}
+
+func TestChunkSeriesIterator_SeekAcrossGaps(t *testing.T) {
+	resp := storeSeriesResponse(t, labels.FromStrings("a", "a"),
+		[]sample{{100, 1}, {200, 2}, {300, 3}},
+		[]sample{{10000, 4}, {10100, 5}},
+		[]sample{{20000, 6}, {20500, 7}},
+		[]sample{{50000, 8}},
+		[]sample{{50100, 9}, {50200, 10}},
+	)
+	chks := resp.GetSeries().Chunks
+	// Trim the third chunk to a range without any sample.
+	chks[2].MinTime, chks[2].MaxTime = 20100, 20400
+	trimmed := []bool{false, false, true, false, false}
+	all := []sample{{100, 1}, {200, 2}, {300, 3}, {10000, 4}, {10100, 5}, {50000, 8}, {50100, 9}, {50200, 10}}
+
+	newIt := func() chunkenc.Iterator {
+		return newChunkSeries(labels.FromStrings("a", "a"), chks, trimmed, math.MinInt64, math.MaxInt64, []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}).Iterator()
+	}
+	expectedSeek := func(ts int64) (sample, bool) {
+		for _, smpl := range all {
+			if smpl.t >= ts {
+				return smpl, true
+			}
+		}
+		return sample{}, false
+	}
+	testutil.Equals(t, all, expandSeries(t, newIt()))
+
+	for _, step := range []int64{1, 99, 1000, 9999} {
+		t.Run(fmt.Sprintf("step=%d", step), func(t *testing.T) {
+			// Seeks of the same iterator in increasing order, like the engine does for each step of a range query.
+			it := newIt()
+			for ts := int64(0); ts <= 51000; ts += step {
+				exp, ok := expectedSeek(ts)
+				testutil.Equals(t, ok, it.Seek(ts), "seek to %d", ts)
+				if !ok {
+					break
+				}
+				gotT, gotV := it.At()
+				testutil.Equals(t, exp, sample{gotT, gotV}, "seek to %d", ts)
+			}
+		})
+	}
+
+	t.Run("seek then next", func(t *testing.T) {
+		it := newIt()
+		testutil.Assert(t, it.Seek(20000), "seek to 20000")
+		var res []sample
+		for {
+			ts, v := it.At()
+			res = append(res, sample{ts, v})
+			if !it.Next() {
+				break
+			}
+		}
+		testutil.Ok(t, it.Err())
+		testutil.Equals(t, []sample{{50000, 8}, {50100, 9}, {50200, 10}}, res)
+	})
+}
+
+func TestResolveResolutionOverlaps(t *testing.T) {
+	rawChk := func(mint, maxt int64) storepb.AggrChunk {
+		return storepb.AggrChunk{MinTime: mint, MaxTime: maxt, Raw: &storepb.Chunk{}}
+	}
+	dsChk := func(mint, maxt int64) storepb.AggrChunk {
+		return storepb.AggrChunk{MinTime: mint, MaxTime: maxt, Count: &storepb.Chunk{}, Sum: &storepb.Chunk{}}
+	}
+
+	for _, tcase := range []struct {
+		name            string
+		chks            []storepb.AggrChunk
+		policy          ResolutionOverlapPolicy
+		expected        []storepb.AggrChunk
+		expectedTrimmed []bool
+	}{
+		{
+			name:     "none policy",
+			chks:     []storepb.AggrChunk{dsChk(0, 100), rawChk(10, 20)},
+			policy:   ResolutionOverlapNone,
+			expected: []storepb.AggrChunk{dsChk(0, 100), rawChk(10, 20)},
+		},
+		{
+			name:     "single resolution",
+			chks:     []storepb.AggrChunk{rawChk(0, 100), rawChk(101, 200)},
+			policy:   ResolutionOverlapPreferDownsampled,
+			expected: []storepb.AggrChunk{rawChk(0, 100), rawChk(101, 200)},
+		},
+		{
+			name:     "prefer raw, fully covered",
+			chks:     []storepb.AggrChunk{rawChk(0, 100), dsChk(10, 90), rawChk(101, 200), dsChk(150, 200)},
+			policy:   ResolutionOverlapPreferRaw,
+			expected: []storepb.AggrChunk{rawChk(0, 100), rawChk(101, 200)},
+		},
+		{
+			name:     "prefer raw, gap within tolerance",
+			chks:     []storepb.AggrChunk{rawChk(0, 100), dsChk(50, 60000), rawChk(60000, 120000)},
+			policy:   ResolutionOverlapPreferRaw,
+			expected: []storepb.AggrChunk{rawChk(0, 100), rawChk(60000, 120000)},
+		},
+		{
+			name:            "prefer raw, partially covered",
+			chks:            []storepb.AggrChunk{dsChk(0, 1000000), rawChk(400000, 600000)},
+			policy:          ResolutionOverlapPreferRaw,
+			expected:        []storepb.AggrChunk{dsChk(0, 399999), rawChk(400000, 600000), dsChk(600001, 1000000)},
+			expectedTrimmed: []bool{true, false, true},
+		},
+		{
+			name:     "prefer downsampled",
+			chks:     []storepb.AggrChunk{dsChk(0, 1000000), rawChk(400000, 600000), rawChk(1000001, 1200000)},
+			policy:   ResolutionOverlapPreferDownsampled,
+			expected: []storepb.AggrChunk{dsChk(0, 1000000), rawChk(1000001, 1200000)},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			res, trimmed := resolveResolutionOverlaps(tcase.chks, tcase.policy)
+			testutil.Equals(t, tcase.expected, res)
+			testutil.Equals(t, tcase.expectedTrimmed, trimmed)
+		})
+	}
+}
+
+// downsampledChunk creates test storepb.AggrChunk with count and sum aggregates, where each sample is counted once.
+func downsampledChunk(t testing.TB, smpls []sample) storepb.AggrChunk {
+	cnt, sum := chunkenc.NewXORChunk(), chunkenc.NewXORChunk()
+	cntApp, err := cnt.Appender()
+	testutil.Ok(t, err)
+	sumApp, err := sum.Appender()
+	testutil.Ok(t, err)
+
+	for _, smpl := range smpls {
+		cntApp.Append(smpl.t, 1)
+		sumApp.Append(smpl.t, smpl.v)
+	}
+	return storepb.AggrChunk{
+		MinTime: smpls[0].t,
+		MaxTime: smpls[len(smpls)-1].t,
+		Count:   &storepb.Chunk{Type: storepb.Chunk_XOR, Data: cnt.Bytes()},
+		Sum:     &storepb.Chunk{Type: storepb.Chunk_XOR, Data: sum.Bytes()},
+	}
+}
+
 const hackyStaleMarker = float64(-99999999)
 
 func expandSeries(t testing.TB, it chunkenc.Iterator) (res []sample) {
@@ -1356,7 +2214,7 @@ func TestDedupSeriesSet(t *testing.T) {
 
 	for _, tcase := range tests {
 		t.Run("", func(t *testing.T) {
-			dedupSet := newDedupSeriesSet(&mockedSeriesSet{series: tcase.input}, tcase.dedupLabels, tcase.isCounter)
+			dedupSet := newDedupSeriesSet(&mockedSeriesSet{series: tcase.input}, tcase.dedupLabels, tcase.isCounter, 0, false, nil, nil)
 			var ats []storage.Series
 			for dedupSet.Next() {
 				ats = append(ats, dedupSet.At())
@@ -1373,6 +2231,203 @@ func TestDedupSeriesSet(t *testing.T) {
 	}
 }
 
+func TestDedupSeriesSet_Metrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newDedupMetrics(reg)
+
+	// Two replicas of the same series, the first one stops being scraped in the middle.
+	set := newDedupSeriesSet(&mockedSeriesSet{series: []series{
+		{
+			lset:    labels.FromStrings("a", "1", "replica", "r0"),
+			samples: []sample{{0, 1}, {10000, 2}},
+		},
+		{
+			lset:    labels.FromStrings("a", "1", "replica", "r1"),
+			samples: []sample{{0, 1}, {10000, 2}, {40000, 3}, {50000, 4}},
+		},
+	}}, map[string]struct{}{"replica": {}}, false, 0, false, nil, m)
+
+	testutil.Assert(t, set.Next(), "expected deduplicated series")
+	testutil.Equals(t, labels.FromStrings("a", "1"), set.At().Labels())
+	testutil.Equals(t, []sample{{0, 1}, {10000, 2}, {40000, 3}, {50000, 4}}, expandSeries(t, set.At().Iterator()))
+	testutil.Assert(t, !set.Next(), "expected single series")
+	testutil.Ok(t, set.Err())
+
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(m.inputSeries))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(m.outputSeries))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(m.chosenSamples[0]))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(m.chosenSamples[1]))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "thanos_query_dedup_collapse_ratio" {
+			continue
+		}
+		found = true
+		testutil.Equals(t, uint64(1), mf.GetMetric()[0].GetHistogram().GetSampleCount())
+		testutil.Equals(t, 2.0, mf.GetMetric()[0].GetHistogram().GetSampleSum())
+	}
+	testutil.Assert(t, found, "collapse ratio histogram not found")
+
+	// Further calls on exhausted set do not observe the select again.
+	testutil.Assert(t, !set.Next(), "expected no more series")
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(m.inputSeries))
+}
+
+func TestDedupSeriesSet_FlagSingleReplica(t *testing.T) {
+	input := []series{
+		{lset: labels.FromStrings("a", "1", "replica", "r0"), samples: []sample{{0, 1}, {10000, 2}}},
+		{lset: labels.FromStrings("a", "1", "replica", "r1"), samples: []sample{{0, 1}, {10000, 2}}},
+		// Target scraped by one replica only.
+		{lset: labels.FromStrings("a", "2", "replica", "r1"), samples: []sample{{0, 3}, {10000, 4}}},
+		// Series not replicated at all, e.g. recorded by a single ruler.
+		{lset: labels.FromStrings("a", "3"), samples: []sample{{0, 5}}},
+	}
+	expected := []series{
+		{lset: labels.FromStrings("a", "1"), samples: []sample{{0, 1}, {10000, 2}}},
+		{lset: labels.FromStrings("a", "2"), samples: []sample{{0, 3}, {10000, 4}}},
+		{lset: labels.FromStrings("a", "3"), samples: []sample{{0, 5}}},
+	}
+
+	for _, flag := range []bool{false, true} {
+		t.Run(fmt.Sprintf("flag=%v", flag), func(t *testing.T) {
+			m := newDedupMetrics(prometheus.NewRegistry())
+			set := newDedupSeriesSet(&mockedSeriesSet{series: input}, map[string]struct{}{"replica": {}}, false, 0, flag, nil, m)
+
+			// Single-replica series are passed through unchanged either way.
+			testSelectResponse(t, expected, set)
+			if !flag {
+				testutil.Equals(t, 0, len(set.Warnings()))
+				testutil.Equals(t, 0.0, promtestutil.ToFloat64(m.singleReplicaSeries))
+				return
+			}
+			testutil.Equals(t, 1, len(set.Warnings()))
+			testutil.Equals(t, "1 series are present in one replica only, which may indicate targets scraped by some replicas only", set.Warnings()[0].Error())
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(m.singleReplicaSeries))
+		})
+	}
+}
+
+func TestDedupSeriesSet_FlagCounterResets(t *testing.T) {
+	for _, tcase := range []struct {
+		name      string
+		isCounter bool
+		input     []series
+		// Output of deduplication, which is not changed by flagging.
+		exp     []sample
+		flagged bool
+	}{
+		{
+			name: "replica lagging behind",
+			input: []series{
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r1"), samples: []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}, {40000, 90}, {50000, 100}, {60000, 110}}},
+			},
+			exp:     []sample{{0, 100}, {10000, 110}, {20000, 120}, {50000, 100}, {60000, 110}},
+			flagged: true,
+		},
+		{
+			name: "restart seen by both replicas",
+			input: []series{
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r1"), samples: []sample{{0, 101}, {10000, 111}, {20000, 121}, {30000, 2}, {40000, 5}, {50000, 8}, {60000, 11}}},
+			},
+			exp: []sample{{0, 100}, {10000, 110}, {20000, 120}, {50000, 8}, {60000, 11}},
+		},
+		{
+			name: "restart without switching replicas",
+			input: []series{
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 1}, {30000, 5}}},
+				{lset: labels.FromStrings("__name__", "x_total", "replica", "r1"), samples: []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}}},
+			},
+			exp: []sample{{0, 100}, {10000, 110}, {20000, 1}, {30000, 5}},
+		},
+		{
+			name: "gauge",
+			input: []series{
+				{lset: labels.FromStrings("__name__", "x", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+				{lset: labels.FromStrings("__name__", "x", "replica", "r1"), samples: []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}, {40000, 90}, {50000, 100}, {60000, 110}}},
+			},
+			exp: []sample{{0, 100}, {10000, 110}, {20000, 120}, {50000, 100}, {60000, 110}},
+		},
+		{
+			// Reset masked by adjusting values of the replica switched to is flagged too.
+			name:      "downsampled counter",
+			isCounter: true,
+			input: []series{
+				{lset: labels.FromStrings("__name__", "x", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+				{lset: labels.FromStrings("__name__", "x", "replica", "r1"), samples: []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}, {40000, 90}, {50000, 100}, {60000, 110}}},
+			},
+			exp:     []sample{{0, 100}, {10000, 110}, {20000, 120}, {50000, 120}, {60000, 130}},
+			flagged: true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			for _, flag := range []bool{false, true} {
+				m := newDedupMetrics(prometheus.NewRegistry())
+				var tracker *CounterResetsTracker
+				if flag {
+					tracker = NewCounterResetsTracker()
+				}
+				set := newDedupSeriesSet(&mockedSeriesSet{series: tcase.input}, map[string]struct{}{"replica": {}}, tcase.isCounter, 0, false, tracker, m)
+
+				testSelectResponse(t, []series{{lset: tcase.input[0].lset[:1], samples: tcase.exp}}, set)
+				testutil.Equals(t, 0, len(set.Warnings()))
+				if !flag || !tcase.flagged {
+					if flag {
+						testutil.Equals(t, 0, len(tracker.Warnings()))
+					}
+					testutil.Equals(t, 0.0, promtestutil.ToFloat64(m.counterResetSeries))
+					continue
+				}
+				testutil.Equals(t, 1, len(tracker.Warnings()))
+				testutil.Equals(t, "1 counter series have resets caused by switching between replicas rather than by restarts, which may indicate misconfigured replica labels or replicas drifting apart; rate() and increase() of these series are overestimated", tracker.Warnings()[0].Error())
+				testutil.Equals(t, 1.0, promtestutil.ToFloat64(m.counterResetSeries))
+			}
+		})
+	}
+}
+
+func TestDedupSeries_CounterResetsSeek(t *testing.T) {
+	r0 := series{lset: labels.FromStrings("__name__", "x_total", "replica", "r0"), samples: []sample{{0, 100}, {10000, 110}, {20000, 120}}}
+	r1 := series{lset: labels.FromStrings("__name__", "x_total", "replica", "r1"), samples: []sample{{0, 50}, {10000, 60}, {20000, 70}, {30000, 80}, {40000, 90}, {50000, 100}, {60000, 110}}}
+
+	for _, tcase := range []struct {
+		name     string
+		replicas []storage.Series
+		seek     int64
+		exp      []sample
+		flagged  bool
+	}{
+		{name: "single replica", replicas: []storage.Series{r0}, seek: 0, exp: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+		{name: "single replica seek before first sample", replicas: []storage.Series{r0}, seek: -10000, exp: []sample{{0, 100}, {10000, 110}, {20000, 120}}},
+		{name: "single replica seek after first sample", replicas: []storage.Series{r0}, seek: 5000, exp: []sample{{10000, 110}, {20000, 120}}},
+		{name: "single replica seek after last sample", replicas: []storage.Series{r0}, seek: 30000},
+		{name: "replicas", replicas: []storage.Series{r0, r1}, seek: 0, exp: []sample{{0, 100}, {10000, 110}, {20000, 120}, {50000, 100}, {60000, 110}}, flagged: true},
+		// The switch between replicas is still checked for resets when seeking over it.
+		{name: "replicas seek after switch", replicas: []storage.Series{r0, r1}, seek: 55000, exp: []sample{{60000, 110}}, flagged: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var flagged bool
+			s := newDedupSeries(labels.FromStrings("__name__", "x_total"), tcase.replicas, false)
+			s.onCounterReset = func() { flagged = true }
+
+			it := s.Iterator()
+			var got []sample
+			if it.Seek(tcase.seek) {
+				ts, v := it.At()
+				got = append(got, sample{ts, v})
+				got = append(got, expandSeries(t, it)...)
+			}
+			testutil.Ok(t, it.Err())
+			testutil.Equals(t, tcase.exp, got)
+			testutil.Equals(t, tcase.flagged, flagged)
+		})
+	}
+}
+
 func TestDedupSeriesIterator(t *testing.T) {
 	// The deltas between timestamps should be at least 10000 to not be affected
 	// by the initial penalty of 5000, that will cause the second iterator to seek
@@ -1417,6 +2472,50 @@ func TestDedupSeriesIterator(t *testing.T) {
 	}
 }
 
+func TestDedupSeriesIterator_MaxPenalty(t *testing.T) {
+	const (
+		interval = int64(10 * time.Second / time.Millisecond)
+		day      = int64(24 * time.Hour / time.Millisecond)
+		window   = int64(time.Minute / time.Millisecond)
+	)
+	// Both replicas are down for a day. Then replica a scrapes once and goes down again, while b scrapes all day.
+	var a, b []sample
+	for ts := int64(0); ts < 10*interval; ts += interval {
+		a = append(a, sample{ts, 1})
+		b = append(b, sample{ts + 100, 2})
+	}
+	a = append(a, sample{day, 1})
+	for ts := day + 100; ts < 2*day; ts += interval {
+		b = append(b, sample{ts, 2})
+	}
+
+	dedup := func(maxPenalty int64) []sample {
+		it := newDedupSeriesIterator(
+			noopAdjustableSeriesIterator{newMockedSeriesIterator(a)},
+			noopAdjustableSeriesIterator{newMockedSeriesIterator(b)},
+		)
+		it.maxPenalty = maxPenalty
+		return expandSeries(t, noopAdjustableSeriesIterator{it})
+	}
+
+	// Without the window, penalty of twice the gap skips all samples of b after it.
+	res := dedup(0)
+	testutil.Equals(t, 11, len(res))
+	testutil.Equals(t, sample{day, 1}, res[len(res)-1])
+
+	// With the window, b is skipped at most that far ahead of the last sample.
+	res = dedup(window)
+	testutil.Equals(t, sample{day, 1}, res[10])
+	testutil.Assert(t, res[11].t-res[10].t <= window+interval, "expected sample within window, got %v", res[11])
+	for i := 1; i < len(res); i++ {
+		if res[i-1].t < day {
+			continue
+		}
+		testutil.Assert(t, res[i].t-res[i-1].t <= window+interval, "expected no gap larger than window, got %v after %v", res[i], res[i-1])
+	}
+	testutil.Equals(t, b[len(b)-1], res[len(res)-1])
+}
+
 func BenchmarkDedupSeriesIterator(b *testing.B) {
 	run := func(b *testing.B, s1, s2 []sample) {
 		it := newDedupSeriesIterator(
@@ -1467,6 +2566,51 @@ func BenchmarkDedupSeriesIterator(b *testing.B) {
 	})
 }
 
+func BenchmarkChunkSeriesIterator_SeekSparse(b *testing.B) {
+	// Series scraped every 15s for two hours every day, cut into chunks of 120 samples.
+	var (
+		smplChunks [][]sample
+		maxTimes   []int64
+	)
+	for day := int64(0); day < 30; day++ {
+		for c := int64(0); c < 4; c++ {
+			var smpls []sample
+			for i := int64(0); i < 120; i++ {
+				smpls = append(smpls, sample{day*24*3600000 + (c*120+i)*15000, 1})
+			}
+			smplChunks = append(smplChunks, smpls)
+			maxTimes = append(maxTimes, smpls[len(smpls)-1].t)
+		}
+	}
+	chks := storeSeriesResponse(b, labels.FromStrings("a", "a"), smplChunks...).GetSeries().Chunks
+
+	for _, step := range []time.Duration{time.Minute, time.Hour, 6 * time.Hour} {
+		for _, tcase := range []struct {
+			name     string
+			maxTimes []int64
+		}{
+			{name: "linear", maxTimes: nil},
+			{name: "chunk bounds", maxTimes: maxTimes},
+		} {
+			b.Run(fmt.Sprintf("step=%v/%s", step, tcase.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					its := make([]chunkenc.Iterator, 0, len(chks))
+					for _, c := range chks {
+						its = append(its, getFirstIterator(c.Raw))
+					}
+					it := newChunkSeriesIterator(its, tcase.maxTimes)
+					for ts := int64(0); ts <= maxTimes[len(maxTimes)-1]; ts += step.Milliseconds() {
+						if !it.Seek(ts) {
+							b.Fatal("unexpected end of series")
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
 type storeServer struct {
 	// This field just exist to pseudo-implement the unused methods of the interface.
 	storepb.StoreServer
@@ -1484,6 +2628,19 @@ func (s *storeServer) Series(_ *storepb.SeriesRequest, srv storepb.Store_SeriesS
 	return nil
 }
 
+// ctxStoreServer records the context of the last Series request.
+type ctxStoreServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.StoreServer
+
+	ctx context.Context
+}
+
+func (s *ctxStoreServer) Series(_ *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.ctx = srv.Context()
+	return nil
+}
+
 // storeSeriesResponse creates test storepb.SeriesResponse that includes series with single chunk that stores all the given samples.
 func storeSeriesResponse(t testing.TB, lset labels.Labels, smplChunks ...[]sample) *storepb.SeriesResponse {
 	var s storepb.Series
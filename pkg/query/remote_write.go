@@ -0,0 +1,180 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jpillora/backoff"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// RemoteWriteExporter sends merged series to a Prometheus remote write endpoint.
+//
+// Series are sent in batches of at most maxSamplesPerBatch samples. Batches are sent one by one in the order of
+// the series set, so samples of each series reach the endpoint in the order of their timestamps.
+type RemoteWriteExporter struct {
+	logger             log.Logger
+	client             remote.WriteClient
+	maxSamplesPerBatch int
+	maxRetries         int
+	backoff            backoff.Backoff
+
+	batches *prometheus.CounterVec
+	samples prometheus.Counter
+	retries prometheus.Counter
+}
+
+// NewRemoteWriteExporter returns a RemoteWriteExporter sending write requests using the given client.
+// Batches failed with a recoverable error (network error or 5xx response) are retried up to maxRetries times.
+func NewRemoteWriteExporter(logger log.Logger, reg prometheus.Registerer, client remote.WriteClient, maxSamplesPerBatch, maxRetries int) *RemoteWriteExporter {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if maxSamplesPerBatch <= 0 {
+		maxSamplesPerBatch = 1
+	}
+	return &RemoteWriteExporter{
+		logger:             logger,
+		client:             client,
+		maxSamplesPerBatch: maxSamplesPerBatch,
+		maxRetries:         maxRetries,
+		backoff: backoff.Backoff{
+			Factor: 2,
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Jitter: true,
+		},
+		batches: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_query_export_batches_total",
+			Help: "Total number of remote write batches sent by the export endpoint.",
+		}, []string{"result"}),
+		samples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_export_samples_total",
+			Help: "Total number of samples successfully exported via remote write.",
+		}),
+		retries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_export_retries_total",
+			Help: "Total number of retried remote write batches.",
+		}),
+	}
+}
+
+// ExportStats describes data sent by a single export.
+type ExportStats struct {
+	Series  int `json:"series"`
+	Samples int `json:"samples"`
+	Batches int `json:"batches"`
+}
+
+// Export translates series from the given set into remote write requests and sends them to the endpoint.
+// Series with more samples than fit into a single batch are split across consecutive batches.
+func (e *RemoteWriteExporter) Export(ctx context.Context, set storage.SeriesSet) (ExportStats, error) {
+	var (
+		stats   ExportStats
+		batch   []prompb.TimeSeries
+		samples int
+	)
+	flush := func() error {
+		if samples == 0 {
+			return nil
+		}
+		if err := e.send(ctx, &prompb.WriteRequest{Timeseries: batch}); err != nil {
+			return err
+		}
+		stats.Batches++
+		stats.Samples += samples
+		batch, samples = nil, 0
+		return nil
+	}
+
+	for set.Next() {
+		series := set.At()
+		lset := labelpb.LabelsFromPromLabels(series.Labels())
+
+		var (
+			ts         = prompb.TimeSeries{Labels: lset}
+			hasSamples bool
+			it         = series.Iterator()
+		)
+		for it.Next() {
+			t, v := it.At()
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: v})
+			hasSamples = true
+			if samples+len(ts.Samples) < e.maxSamplesPerBatch {
+				continue
+			}
+			batch = append(batch, ts)
+			samples += len(ts.Samples)
+			if err := flush(); err != nil {
+				return stats, err
+			}
+			ts = prompb.TimeSeries{Labels: lset}
+		}
+		if err := it.Err(); err != nil {
+			return stats, errors.Wrapf(err, "iterate series %s", series.Labels())
+		}
+		if len(ts.Samples) > 0 {
+			batch = append(batch, ts)
+			samples += len(ts.Samples)
+		}
+		if hasSamples {
+			stats.Series++
+		}
+	}
+	if err := set.Err(); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+func (e *RemoteWriteExporter) send(ctx context.Context, req *prompb.WriteRequest) error {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "marshal write request")
+	}
+	compressed := snappy.Encode(nil, b)
+
+	for attempt := 0; ; attempt++ {
+		err = e.client.Store(ctx, compressed)
+		if err == nil {
+			e.batches.WithLabelValues("success").Inc()
+			e.samples.Add(float64(countSamples(req)))
+			return nil
+		}
+		if _, ok := err.(remote.RecoverableError); !ok || attempt >= e.maxRetries {
+			e.batches.WithLabelValues("error").Inc()
+			return errors.Wrap(err, "send remote write batch")
+		}
+
+		e.retries.Inc()
+		level.Debug(e.logger).Log("msg", "retrying remote write batch", "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			e.batches.WithLabelValues("error").Inc()
+			return errors.Wrap(ctx.Err(), "send remote write batch")
+		case <-time.After(e.backoff.ForAttempt(float64(attempt))):
+		}
+	}
+}
+
+func countSamples(req *prompb.WriteRequest) int {
+	var n int
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+	return n
+}
@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// fakeReceiver is a remote write endpoint recording received write requests.
+type fakeReceiver struct {
+	mtx      sync.Mutex
+	reqs     []prompb.WriteRequest
+	failures []int
+	calls    int
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.calls++
+	if len(f.failures) > 0 {
+		code := f.failures[0]
+		f.failures = f.failures[1:]
+		http.Error(w, "injected failure", code)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.reqs = append(f.reqs, req)
+}
+
+func newTestRemoteWriteExporter(t *testing.T, srv *httptest.Server, maxSamplesPerBatch, maxRetries int) *RemoteWriteExporter {
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	client, err := remote.NewWriteClient("test", &remote.ClientConfig{
+		URL:     &config_util.URL{URL: u},
+		Timeout: model.Duration(5 * time.Second),
+	})
+	testutil.Ok(t, err)
+
+	e := NewRemoteWriteExporter(nil, prometheus.NewRegistry(), client, maxSamplesPerBatch, maxRetries)
+	e.backoff = backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond}
+	return e
+}
+
+func TestRemoteWriteExporter_Export(t *testing.T) {
+	input := []series{
+		{lset: labels.FromStrings("a", "1"), samples: []sample{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}}},
+		{lset: labels.FromStrings("a", "2"), samples: []sample{{1, 10}}},
+		{lset: labels.FromStrings("a", "3")},
+		{lset: labels.FromStrings("a", "4"), samples: []sample{{6, 6}, {7, 7}}},
+	}
+	ts := func(lset labels.Labels, samples ...prompb.Sample) prompb.TimeSeries {
+		return prompb.TimeSeries{Labels: labelpb.LabelsFromPromLabels(lset), Samples: samples}
+	}
+
+	t.Run("batches preserve order", func(t *testing.T) {
+		recv := &fakeReceiver{}
+		srv := httptest.NewServer(recv)
+		defer srv.Close()
+
+		stats, err := newTestRemoteWriteExporter(t, srv, 3, 0).Export(context.Background(), &mockedSeriesSet{series: input})
+		testutil.Ok(t, err)
+		testutil.Equals(t, ExportStats{Series: 3, Samples: 8, Batches: 3}, stats)
+		testutil.Equals(t, []prompb.WriteRequest{
+			{Timeseries: []prompb.TimeSeries{
+				ts(labels.FromStrings("a", "1"), prompb.Sample{Timestamp: 1, Value: 1}, prompb.Sample{Timestamp: 2, Value: 2}, prompb.Sample{Timestamp: 3, Value: 3}),
+			}},
+			{Timeseries: []prompb.TimeSeries{
+				ts(labels.FromStrings("a", "1"), prompb.Sample{Timestamp: 4, Value: 4}, prompb.Sample{Timestamp: 5, Value: 5}),
+				ts(labels.FromStrings("a", "2"), prompb.Sample{Timestamp: 1, Value: 10}),
+			}},
+			{Timeseries: []prompb.TimeSeries{
+				ts(labels.FromStrings("a", "4"), prompb.Sample{Timestamp: 6, Value: 6}, prompb.Sample{Timestamp: 7, Value: 7}),
+			}},
+		}, recv.reqs)
+	})
+	t.Run("recoverable errors are retried", func(t *testing.T) {
+		recv := &fakeReceiver{failures: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+		srv := httptest.NewServer(recv)
+		defer srv.Close()
+
+		stats, err := newTestRemoteWriteExporter(t, srv, 100, 2).Export(context.Background(), &mockedSeriesSet{series: input})
+		testutil.Ok(t, err)
+		testutil.Equals(t, ExportStats{Series: 3, Samples: 8, Batches: 1}, stats)
+		testutil.Equals(t, 3, recv.calls)
+		testutil.Equals(t, 1, len(recv.reqs))
+	})
+	t.Run("retries are limited", func(t *testing.T) {
+		recv := &fakeReceiver{failures: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}}
+		srv := httptest.NewServer(recv)
+		defer srv.Close()
+
+		_, err := newTestRemoteWriteExporter(t, srv, 100, 1).Export(context.Background(), &mockedSeriesSet{series: input})
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 2, recv.calls)
+	})
+	t.Run("unrecoverable errors are not retried", func(t *testing.T) {
+		recv := &fakeReceiver{failures: []int{http.StatusBadRequest}}
+		srv := httptest.NewServer(recv)
+		defer srv.Close()
+
+		stats, err := newTestRemoteWriteExporter(t, srv, 3, 5).Export(context.Background(), &mockedSeriesSet{series: input})
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ExportStats{}, stats)
+		testutil.Equals(t, 1, recv.calls)
+	})
+}
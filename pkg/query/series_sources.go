@@ -0,0 +1,115 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+type ctxKey int
+
+// SeriesSourcesTrackerKey is the context key for the *SeriesSourcesTracker recording sources of series fetched by
+// selects of a query.
+const SeriesSourcesTrackerKey = ctxKey(0)
+
+// SeriesSource is a StoreAPI and, if known, its block that contributed chunks to a series.
+type SeriesSource struct {
+	Store string `json:"store"`
+	Block string `json:"block,omitempty"`
+}
+
+// SeriesSources lists sources of a single series.
+type SeriesSources struct {
+	Labels  labels.Labels  `json:"labels"`
+	Sources []SeriesSource `json:"sources"`
+	// Truncated is true if the series has more sources than the limit of the tracker.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// SeriesSourcesTracker records sources of series fetched by selects of a query. It is safe for concurrent use, so a
+// single tracker can be shared by all selects of a query. Selects ask StoreAPIs for sources of chunks only if the
+// tracker is set in the query context, as it is costly.
+type SeriesSourcesTracker struct {
+	limit int
+
+	mtx    sync.Mutex
+	series map[string]*SeriesSources
+}
+
+// NewSeriesSourcesTracker returns an empty tracker recording up to limit sources per series.
+func NewSeriesSourcesTracker(limit int) *SeriesSourcesTracker {
+	return &SeriesSourcesTracker{limit: limit, series: map[string]*SeriesSources{}}
+}
+
+func seriesSourcesTrackerFromContext(ctx context.Context) *SeriesSourcesTracker {
+	t, _ := ctx.Value(SeriesSourcesTrackerKey).(*SeriesSourcesTracker)
+	return t
+}
+
+// record records sources of chunks overlapping with mint and maxt. Replica labels are removed from labels of the series,
+// so sources of all replicas are recorded for the deduplicated series.
+func (t *SeriesSourcesTracker) record(set []storepb.Series, mint, maxt int64, replicaLabels map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, s := range set {
+		lset := withoutReplicaLabels(labelpb.LabelsToPromLabels(s.Labels), replicaLabels)
+		key := lset.String()
+		ss, ok := t.series[key]
+		if !ok {
+			ss = &SeriesSources{Labels: lset.Copy(), Sources: []SeriesSource{}}
+			t.series[key] = ss
+		}
+
+	Chunks:
+		for _, c := range s.Chunks {
+			if c.Source == nil || c.MaxTime < mint || c.MinTime > maxt {
+				continue
+			}
+			src := SeriesSource{Store: c.Source.Store, Block: c.Source.BlockId}
+			for _, existing := range ss.Sources {
+				if existing == src {
+					continue Chunks
+				}
+			}
+			if len(ss.Sources) >= t.limit {
+				ss.Truncated = true
+				continue
+			}
+			ss.Sources = append(ss.Sources, src)
+		}
+	}
+}
+
+// Series returns the recorded series sorted by labels, with their sources sorted by store and block.
+func (t *SeriesSourcesTracker) Series() []SeriesSources {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ret := make([]SeriesSources, 0, len(t.series))
+	for _, ss := range t.series {
+		s := *ss
+		s.Sources = make([]SeriesSource, len(ss.Sources))
+		copy(s.Sources, ss.Sources)
+		sort.Slice(s.Sources, func(i, j int) bool {
+			if s.Sources[i].Store != s.Sources[j].Store {
+				return s.Sources[i].Store < s.Sources[j].Store
+			}
+			return s.Sources[i].Block < s.Sources[j].Block
+		})
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return labels.Compare(ret[i].Labels, ret[j].Labels) < 0 })
+	return ret
+}
@@ -7,8 +7,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -16,10 +18,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store"
@@ -30,6 +35,27 @@ const (
 	unhealthyStoreMessage = "removing store because it's unhealthy or does not exist"
 )
 
+// clampClockSkew clamps the time range advertised by a store to sane bounds, if any of its times is later than now by
+// more than maxSkew, e.g. because of clock skew of the store. Such max time is clamped to now plus maxSkew, unless it
+// is math.MaxInt64 advertised by stores serving data up to the present. If the min time is implausible, nothing can be
+// assumed about the data of the store, so it is clamped to math.MinInt64 not to exclude the store from any query.
+// It returns whether the range was clamped. Zero maxSkew disables clamping.
+func clampClockSkew(now time.Time, maxSkew time.Duration, mint, maxt int64) (int64, int64, bool) {
+	if maxSkew <= 0 {
+		return mint, maxt, false
+	}
+	bound := timestamp.FromTime(now.Add(maxSkew))
+
+	clamped := false
+	if maxt != math.MaxInt64 && maxt > bound {
+		maxt, clamped = bound, true
+	}
+	if mint > bound {
+		mint, clamped = math.MinInt64, true
+	}
+	return mint, maxt, clamped
+}
+
 type StoreSpec interface {
 	// Addr returns StoreAPI Address for the store spec. It is used as ID for store.
 	Addr() string
@@ -44,6 +70,15 @@ type StoreSpec interface {
 	StrictStatic() bool
 }
 
+// remoteStoreSpec is implemented by store specs of StoreAPIs requiring own connection options, e.g. remote clusters
+// with own TLS and auth, or own handling of their data.
+type remoteStoreSpec interface {
+	// dialOptions returns the gRPC dial options used instead of the default ones of the store set.
+	dialOptions() []grpc.DialOption
+	// wrapClient returns the client used for all calls to the StoreAPI.
+	wrapClient(storepb.StoreClient) storepb.StoreClient
+}
+
 type RuleSpec interface {
 	// Addr returns RulesAPI Address for the rules spec. It is used as its ID.
 	Addr() string
@@ -183,14 +218,23 @@ type StoreSet struct {
 	ruleSpecs           func() []RuleSpec
 	dialOpts            []grpc.DialOption
 	gRPCInfoCallTimeout time.Duration
+	// compressionPreference lists gRPC compressors to negotiate with stores, from the most preferred one.
+	compressionPreference []string
+	// connPoolSize is the number of gRPC connections opened to each store.
+	connPoolSize int
+	// maxClockSkew is the maximum duration by which advertised times of stores can be in the future before they are
+	// clamped. Zero disables clamping.
+	maxClockSkew time.Duration
 
 	updateMtx         sync.Mutex
 	storesMtx         sync.RWMutex
 	storesStatusesMtx sync.RWMutex
 
 	// Main map of stores currently used for fanout.
-	stores       map[string]*storeRef
-	storesMetric *storeSetNodeCollector
+	stores            map[string]*storeRef
+	storesMetric      *storeSetNodeCollector
+	compressorMetric  *prometheus.GaugeVec
+	clockSkewedMetric *prometheus.GaugeVec
 
 	// Map of statuses used only by UI.
 	storeStatuses         map[string]*StoreStatus
@@ -204,11 +248,22 @@ func NewStoreSet(
 	storeSpecs func() []StoreSpec,
 	ruleSpecs func() []RuleSpec,
 	dialOpts []grpc.DialOption,
+	compressionPreference []string,
+	connPoolSize int,
+	maxClockSkew time.Duration,
 	unhealthyStoreTimeout time.Duration,
 ) *StoreSet {
 	storesMetric := newStoreSetNodeCollector()
+	compressorMetric := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thanos_store_nodes_grpc_compressor",
+		Help: "gRPC compressor negotiated with each StoreAPI. Set to 1 for the compressor currently used for the given address.",
+	}, []string{"addr", "compressor"})
+	clockSkewedMetric := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thanos_store_nodes_clock_skewed",
+		Help: "Set to 1 if the time range advertised by the StoreAPI of the given address was clamped because it is implausibly far in the future, 0 otherwise.",
+	}, []string{"addr"})
 	if reg != nil {
-		reg.MustRegister(storesMetric)
+		reg.MustRegister(storesMetric, compressorMetric, clockSkewedMetric)
 	}
 
 	if logger == nil {
@@ -220,13 +275,21 @@ func NewStoreSet(
 	if ruleSpecs == nil {
 		ruleSpecs = func() []RuleSpec { return nil }
 	}
+	if connPoolSize < 1 {
+		connPoolSize = 1
+	}
 
 	ss := &StoreSet{
 		logger:                log.With(logger, "component", "storeset"),
 		storeSpecs:            storeSpecs,
 		ruleSpecs:             ruleSpecs,
 		dialOpts:              dialOpts,
+		compressionPreference: compressionPreference,
+		connPoolSize:          connPoolSize,
+		maxClockSkew:          maxClockSkew,
 		storesMetric:          storesMetric,
+		compressorMetric:      compressorMetric,
+		clockSkewedMetric:     clockSkewedMetric,
 		gRPCInfoCallTimeout:   5 * time.Second,
 		stores:                make(map[string]*storeRef),
 		storeStatuses:         make(map[string]*StoreStatus),
@@ -239,9 +302,13 @@ func NewStoreSet(
 type storeRef struct {
 	storepb.StoreClient
 
-	mtx  sync.RWMutex
-	cc   *grpc.ClientConn
-	addr string
+	mtx   sync.RWMutex
+	conns []*grpc.ClientConn
+	addr  string
+	// seriesClients holds a client for each connection in conns. Series calls are round-robined across them, so
+	// concurrent queries are not limited by the maximum number of concurrent streams of a single connection.
+	seriesClients []storepb.StoreClient
+	nextSeries    uint32
 	// If rule is not nil, then this store also supports rules API.
 	rule rulespb.RulesClient
 
@@ -250,6 +317,10 @@ type storeRef struct {
 	storeType component.StoreAPI
 	minTime   int64
 	maxTime   int64
+	// compressor is the gRPC compressor negotiated with the store.
+	compressor string
+	// clockSkewed is true if the time range advertised by the store was clamped in the last update.
+	clockSkewed bool
 
 	logger log.Logger
 }
@@ -264,6 +335,79 @@ func (s *storeRef) Update(labelSets []labels.Labels, minTime int64, maxTime int6
 	s.maxTime = maxTime
 }
 
+func (s *storeRef) Compressor() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.compressor
+}
+
+func (s *storeRef) setCompressor(compressor string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.compressor = compressor
+}
+
+func (s *storeRef) ClockSkewed() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.clockSkewed
+}
+
+func (s *storeRef) setClockSkewed(clockSkewed bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.clockSkewed = clockSkewed
+}
+
+// callOpts returns given call options extended to use the negotiated compressor, if any.
+func (s *storeRef) callOpts(opts []grpc.CallOption) []grpc.CallOption {
+	compressor := s.Compressor()
+	if compressor == "" || compressor == extgrpc.NoCompression {
+		return opts
+	}
+	return append(append(make([]grpc.CallOption, 0, len(opts)+1), opts...), grpc.UseCompressor(compressor))
+}
+
+func (s *storeRef) Series(ctx context.Context, in *storepb.SeriesRequest, opts ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	return s.seriesClient().Series(ctx, in, s.callOpts(opts)...)
+}
+
+// seriesClient returns the next client from the connection pool.
+func (s *storeRef) seriesClient() storepb.StoreClient {
+	if len(s.seriesClients) == 0 {
+		return s.StoreClient
+	}
+	n := atomic.AddUint32(&s.nextSeries, 1)
+	return s.seriesClients[(n-1)%uint32(len(s.seriesClients))]
+}
+
+func (s *storeRef) LabelNames(ctx context.Context, in *storepb.LabelNamesRequest, opts ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	return s.StoreClient.LabelNames(ctx, in, s.callOpts(opts)...)
+}
+
+func (s *storeRef) LabelValues(ctx context.Context, in *storepb.LabelValuesRequest, opts ...grpc.CallOption) (*storepb.LabelValuesResponse, error) {
+	return s.StoreClient.LabelValues(ctx, in, s.callOpts(opts)...)
+}
+
+func (s *storeRef) LabelValuesStream(ctx context.Context, in *storepb.LabelValuesRequest, opts ...grpc.CallOption) (storepb.Store_LabelValuesStreamClient, error) {
+	return s.StoreClient.LabelValuesStream(ctx, in, s.callOpts(opts)...)
+}
+
+// infoHeaderClient records the header metadata sent by the store in response to the Info call.
+type infoHeaderClient struct {
+	storepb.StoreClient
+
+	header metadata.MD
+}
+
+func (c *infoHeaderClient) Info(ctx context.Context, in *storepb.InfoRequest, opts ...grpc.CallOption) (*storepb.InfoResponse, error) {
+	return c.StoreClient.Info(ctx, in, append(append(make([]grpc.CallOption, 0, len(opts)+1), opts...), grpc.Header(&c.header))...)
+}
+
 func (s *storeRef) StoreType() component.StoreAPI {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -313,7 +457,9 @@ func (s *storeRef) Addr() string {
 }
 
 func (s *storeRef) Close() {
-	runutil.CloseWithLogOnErr(s.logger, s.cc, fmt.Sprintf("store %v connection close", s.addr))
+	for _, cc := range s.conns {
+		runutil.CloseWithLogOnErr(s.logger, cc, fmt.Sprintf("store %v connection close", s.addr))
+	}
 }
 
 func newStoreAPIStats() map[component.StoreAPI]map[string]int {
@@ -352,6 +498,8 @@ func (s *StoreSet) Update(ctx context.Context) {
 		}
 
 		st.Close()
+		s.compressorMetric.DeleteLabelValues(addr, st.Compressor())
+		s.clockSkewedMetric.DeleteLabelValues(addr)
 		delete(stores, addr)
 		s.updateStoreStatus(st, errors.New(unhealthyStoreMessage))
 		level.Info(s.logger).Log("msg", unhealthyStoreMessage, "address", addr, "extLset", labelpb.PromLabelSetsToString(st.LabelSets()))
@@ -430,7 +578,13 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 			st, seenAlready := stores[addr]
 			if !seenAlready {
 				// New store or was unactive and was removed in the past - create new one.
-				conn, err := grpc.DialContext(ctx, addr, s.dialOpts...)
+				dialOpts := s.dialOpts
+				wrap := func(c storepb.StoreClient) storepb.StoreClient { return c }
+				if rs, ok := spec.(remoteStoreSpec); ok {
+					dialOpts = rs.dialOptions()
+					wrap = rs.wrapClient
+				}
+				conns, err := s.dial(ctx, addr, dialOpts)
 				if err != nil {
 					s.updateStoreStatus(&storeRef{addr: addr}, err)
 					level.Warn(s.logger).Log("msg", "update of store node failed", "err", errors.Wrap(err, "dialing connection"), "address", addr)
@@ -438,14 +592,18 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 				}
 				var rule rulespb.RulesClient
 				if _, ok := ruleAddrSet[addr]; ok {
-					rule = rulespb.NewRulesClient(conn)
+					rule = rulespb.NewRulesClient(conns[0])
 				}
 
-				st = &storeRef{StoreClient: storepb.NewStoreClient(conn), storeType: component.UnknownStoreAPI, rule: rule, cc: conn, addr: addr, logger: s.logger}
+				st = &storeRef{StoreClient: wrap(storepb.NewStoreClient(conns[0])), storeType: component.UnknownStoreAPI, rule: rule, conns: conns, addr: addr, logger: s.logger}
+				for _, conn := range conns {
+					st.seriesClients = append(st.seriesClients, wrap(storepb.NewStoreClient(conn)))
+				}
 			}
 
 			// Check existing or new store. Is it healthy? What are current metadata?
-			labelSets, minTime, maxTime, storeType, err := spec.Metadata(ctx, st.StoreClient)
+			client := &infoHeaderClient{StoreClient: st.StoreClient}
+			labelSets, minTime, maxTime, storeType, err := spec.Metadata(ctx, client)
 			if err != nil {
 				if !seenAlready && !spec.StrictStatic() {
 					// Close only if new and not a strict static node.
@@ -467,8 +625,10 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 				return
 			}
 
+			minTime, maxTime = s.clampClockSkew(st, minTime, maxTime)
 			s.updateStoreStatus(st, nil)
 			st.Update(labelSets, minTime, maxTime, storeType)
+			s.updateStoreCompressor(st, extgrpc.NegotiateCompressor(s.compressionPreference, extgrpc.CompressorsFromHeader(client.header)))
 
 			mtx.Lock()
 			defer mtx.Unlock()
@@ -486,6 +646,55 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 	return activeStores
 }
 
+// dial opens the configured number of gRPC connections to the given address.
+func (s *StoreSet) dial(ctx context.Context, addr string, dialOpts []grpc.DialOption) ([]*grpc.ClientConn, error) {
+	conns := make([]*grpc.ClientConn, 0, s.connPoolSize)
+	for i := 0; i < s.connPoolSize; i++ {
+		conn, err := grpc.DialContext(ctx, addr, dialOpts...)
+		if err != nil {
+			for _, cc := range conns {
+				runutil.CloseWithLogOnErr(s.logger, cc, fmt.Sprintf("store %v connection close", addr))
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// updateStoreCompressor switches the store to the given compressor and exposes it in the metric.
+func (s *StoreSet) updateStoreCompressor(st *storeRef, compressor string) {
+	if prev := st.Compressor(); prev != compressor {
+		if prev != "" {
+			s.compressorMetric.DeleteLabelValues(st.addr, prev)
+		}
+		st.setCompressor(compressor)
+		level.Info(s.logger).Log("msg", "negotiated gRPC compressor with storeAPI", "address", st.addr, "compressor", compressor)
+	}
+	s.compressorMetric.WithLabelValues(st.addr, compressor).Set(1)
+}
+
+// clampClockSkew clamps the time range advertised by the given store if it is implausibly far in the future and
+// reports it in the metric. It logs only changes of the state of the store, not to flood logs on every update.
+func (s *StoreSet) clampClockSkew(st *storeRef, mint, maxt int64) (int64, int64) {
+	clampedMint, clampedMaxt, clamped := clampClockSkew(time.Now(), s.maxClockSkew, mint, maxt)
+	if clamped != st.ClockSkewed() {
+		st.setClockSkewed(clamped)
+		if clamped {
+			level.Warn(s.logger).Log("msg", "storeAPI advertises time range implausibly far in the future, probably its clock is skewed; clamping it",
+				"address", st.addr, "mint", mint, "maxt", maxt, "clampedMint", clampedMint, "clampedMaxt", clampedMaxt, "maxClockSkew", s.maxClockSkew)
+		} else {
+			level.Info(s.logger).Log("msg", "storeAPI advertises plausible time range again; no longer clamping it", "address", st.addr, "mint", mint, "maxt", maxt)
+		}
+	}
+	if !clamped {
+		s.clockSkewedMetric.WithLabelValues(st.addr).Set(0)
+		return mint, maxt
+	}
+	s.clockSkewedMetric.WithLabelValues(st.addr).Set(1)
+	return clampedMint, clampedMaxt
+}
+
 func (s *StoreSet) updateStoreStatus(store *storeRef, err error) {
 	s.storesStatusesMtx.Lock()
 	defer s.storesStatusesMtx.Unlock()
@@ -4,20 +4,28 @@
 package query
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -31,6 +39,10 @@ var testGRPCOpts = []grpc.DialOption{
 type testStore struct {
 	infoDelay time.Duration
 	info      storepb.InfoResponse
+
+	mtx sync.Mutex
+	// seriesPeers counts Series calls by address of the calling client connection.
+	seriesPeers map[string]int
 }
 
 func (s *testStore) Info(ctx context.Context, r *storepb.InfoRequest) (*storepb.InfoResponse, error) {
@@ -41,6 +53,14 @@ func (s *testStore) Info(ctx context.Context, r *storepb.InfoRequest) (*storepb.
 }
 
 func (s *testStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	if p, ok := peer.FromContext(srv.Context()); ok {
+		s.mtx.Lock()
+		if s.seriesPeers == nil {
+			s.seriesPeers = map[string]int{}
+		}
+		s.seriesPeers[p.Addr.String()]++
+		s.mtx.Unlock()
+	}
 	return status.Error(codes.Unimplemented, "not implemented")
 }
 
@@ -56,21 +76,29 @@ func (s *testStore) LabelValues(ctx context.Context, r *storepb.LabelValuesReque
 	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
+func (s *testStore) LabelValuesStream(*storepb.LabelValuesRequest, storepb.Store_LabelValuesStreamServer) error {
+	return status.Error(codes.Unimplemented, "not implemented")
+}
+
 type testStoreMeta struct {
 	extlsetFn        func(addr string) []storepb.LabelSet
 	storeType        component.StoreAPI
 	minTime, maxTime int64
 	infoDelay        time.Duration
+	// advertiseCompressors makes the store advertise its gRPC compressors as Thanos servers do.
+	advertiseCompressors bool
 }
 
 type testStores struct {
 	srvs       map[string]*grpc.Server
+	storeSrvs  map[string]*testStore
 	orderAddrs []string
 }
 
 func startTestStores(storeMetas []testStoreMeta) (*testStores, error) {
 	st := &testStores{
-		srvs: map[string]*grpc.Server{},
+		srvs:      map[string]*grpc.Server{},
+		storeSrvs: map[string]*testStore{},
 	}
 
 	for _, meta := range storeMetas {
@@ -81,7 +109,11 @@ func startTestStores(storeMetas []testStoreMeta) (*testStores, error) {
 			return nil, err
 		}
 
-		srv := grpc.NewServer()
+		var opts []grpc.ServerOption
+		if meta.advertiseCompressors {
+			opts = append(opts, grpc.UnaryInterceptor(extgrpc.CompressorsUnaryServerInterceptor()))
+		}
+		srv := grpc.NewServer(opts...)
 
 		storeSrv := &testStore{
 			info: storepb.InfoResponse{
@@ -100,6 +132,7 @@ func startTestStores(storeMetas []testStoreMeta) (*testStores, error) {
 		}()
 
 		st.srvs[listener.Addr().String()] = srv
+		st.storeSrvs[listener.Addr().String()] = storeSrv
 		st.orderAddrs = append(st.orderAddrs, listener.Addr().String())
 	}
 
@@ -195,7 +228,7 @@ func TestStoreSet_Update(t *testing.T) {
 		func() (specs []RuleSpec) {
 			return nil
 		},
-		testGRPCOpts, time.Minute)
+		testGRPCOpts, nil, 1, 0, time.Minute)
 	storeSet.gRPCInfoCallTimeout = 2 * time.Second
 	defer storeSet.Close()
 
@@ -544,7 +577,7 @@ func TestStoreSet_Update_NoneAvailable(t *testing.T) {
 			return specs
 		},
 		func() (specs []RuleSpec) { return nil },
-		testGRPCOpts, time.Minute)
+		testGRPCOpts, nil, 1, 0, time.Minute)
 	storeSet.gRPCInfoCallTimeout = 2 * time.Second
 
 	// Should not matter how many of these we run.
@@ -628,7 +661,7 @@ func TestQuerierStrict(t *testing.T) {
 		}
 	}, func() []RuleSpec {
 		return nil
-	}, testGRPCOpts, time.Minute)
+	}, testGRPCOpts, nil, 1, 0, time.Minute)
 	defer storeSet.Close()
 	storeSet.gRPCInfoCallTimeout = 1 * time.Second
 
@@ -636,7 +669,7 @@ func TestQuerierStrict(t *testing.T) {
 	storeSet.Update(context.Background())
 	testutil.Equals(t, 3, len(storeSet.stores), "three clients must be available for running store nodes")
 
-	testutil.Assert(t, storeSet.stores[st.StoreAddresses()[2]].cc.GetState().String() != "SHUTDOWN", "slow store's connection should not be closed")
+	testutil.Assert(t, storeSet.stores[st.StoreAddresses()[2]].conns[0].GetState().String() != "SHUTDOWN", "slow store's connection should not be closed")
 
 	// The store is statically defined + strict mode is enabled
 	// so its client + information must be retained.
@@ -757,7 +790,7 @@ func TestStoreSet_Update_Rules(t *testing.T) {
 		storeSet := NewStoreSet(nil, nil,
 			tc.storeSpecs,
 			tc.ruleSpecs,
-			testGRPCOpts, time.Minute)
+			testGRPCOpts, nil, 1, 0, time.Minute)
 
 		t.Run(tc.name, func(t *testing.T) {
 			defer storeSet.Close()
@@ -853,3 +886,232 @@ func TestUpdateStoreStateForgetsPreviousErrors(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, `null`, string(b))
 }
+
+func TestStoreSet_Update_CompressorNegotiation(t *testing.T) {
+	stores, err := startTestStores([]testStoreMeta{
+		{
+			storeType:            component.Store,
+			extlsetFn:            func(addr string) []storepb.LabelSet { return nil },
+			advertiseCompressors: true,
+		},
+		{
+			// Older StoreAPI, not advertising any compressor.
+			storeType: component.Store,
+			extlsetFn: func(addr string) []storepb.LabelSet { return nil },
+		},
+	})
+	testutil.Ok(t, err)
+	defer stores.Close()
+
+	advertising, notAdvertising := stores.orderAddrs[0], stores.orderAddrs[1]
+
+	for _, tcase := range []struct {
+		name       string
+		preference []string
+		expected   map[string]string
+	}{
+		{
+			name:     "no preference",
+			expected: map[string]string{advertising: extgrpc.NoCompression, notAdvertising: extgrpc.NoCompression},
+		},
+		{
+			name:       "first preferred compressor",
+			preference: []string{extgrpc.Snappy, extgrpc.Gzip},
+			expected:   map[string]string{advertising: extgrpc.Snappy, notAdvertising: extgrpc.NoCompression},
+		},
+		{
+			name:       "first supported compressor",
+			preference: []string{"unsupported", extgrpc.Gzip},
+			expected:   map[string]string{advertising: extgrpc.Gzip, notAdvertising: extgrpc.NoCompression},
+		},
+		{
+			name:       "no supported compressor",
+			preference: []string{"unsupported"},
+			expected:   map[string]string{advertising: extgrpc.NoCompression, notAdvertising: extgrpc.NoCompression},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			storeSet := NewStoreSet(nil, nil,
+				func() (specs []StoreSpec) {
+					for _, addr := range stores.StoreAddresses() {
+						specs = append(specs, NewGRPCStoreSpec(addr, false))
+					}
+					return specs
+				},
+				func() (specs []RuleSpec) { return nil },
+				testGRPCOpts, tcase.preference, 1, 0, time.Minute)
+			defer storeSet.Close()
+
+			storeSet.Update(context.Background())
+			testutil.Equals(t, 2, len(storeSet.stores))
+
+			for addr, expected := range tcase.expected {
+				testutil.Equals(t, expected, storeSet.stores[addr].Compressor())
+				testutil.Equals(t, 1.0, promtestutil.ToFloat64(storeSet.compressorMetric.WithLabelValues(addr, expected)))
+			}
+		})
+	}
+}
+
+func TestStoreSet_Update_ConnectionPool(t *testing.T) {
+	stores, err := startTestStores([]testStoreMeta{
+		{
+			storeType: component.Sidecar,
+			extlsetFn: func(addr string) []storepb.LabelSet {
+				return []storepb.LabelSet{{Labels: []storepb.Label{{Name: "addr", Value: addr}}}}
+			},
+		},
+	})
+	testutil.Ok(t, err)
+	defer stores.Close()
+
+	addr := stores.orderAddrs[0]
+	for _, poolSize := range []int{1, 3} {
+		t.Run(fmt.Sprintf("pool size %d", poolSize), func(t *testing.T) {
+			storeSet := NewStoreSet(nil, nil,
+				func() (specs []StoreSpec) {
+					return []StoreSpec{NewGRPCStoreSpec(addr, false)}
+				},
+				func() (specs []RuleSpec) { return nil },
+				testGRPCOpts, nil, poolSize, 0, time.Minute)
+			defer storeSet.Close()
+
+			storeSet.Update(context.Background())
+			testutil.Equals(t, 1, len(storeSet.stores))
+			testutil.Equals(t, poolSize, len(storeSet.stores[addr].conns))
+
+			srv := stores.storeSrvs[addr]
+			srv.mtx.Lock()
+			srv.seriesPeers = nil
+			srv.mtx.Unlock()
+
+			const calls = 30
+			var wg sync.WaitGroup
+			for i := 0; i < calls; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					sc, err := storeSet.Get()[0].Series(context.Background(), &storepb.SeriesRequest{})
+					testutil.Ok(t, err)
+					_, err = sc.Recv()
+					testutil.Equals(t, codes.Unimplemented, status.Code(err))
+				}()
+			}
+			wg.Wait()
+
+			srv.mtx.Lock()
+			defer srv.mtx.Unlock()
+
+			// Each connection has its own client address and gets an even share of concurrent calls.
+			testutil.Equals(t, poolSize, len(srv.seriesPeers))
+			for _, n := range srv.seriesPeers {
+				testutil.Equals(t, calls/poolSize, n)
+			}
+		})
+	}
+}
+
+func TestClampClockSkew(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bound := timestamp.FromTime(now.Add(time.Hour))
+
+	for _, tcase := range []struct {
+		name             string
+		maxSkew          time.Duration
+		mint, maxt       int64
+		expMint, expMaxt int64
+		expClamped       bool
+	}{
+		{
+			name: "plausible range", maxSkew: time.Hour,
+			mint: 0, maxt: bound,
+			expMint: 0, expMaxt: bound,
+		},
+		{
+			name: "unbounded max time", maxSkew: time.Hour,
+			mint: 0, maxt: math.MaxInt64,
+			expMint: 0, expMaxt: math.MaxInt64,
+		},
+		{
+			name: "max time in the future", maxSkew: time.Hour,
+			mint: 0, maxt: bound + 1,
+			expMint: 0, expMaxt: bound, expClamped: true,
+		},
+		{
+			name: "whole range in the future", maxSkew: time.Hour,
+			mint: bound + 1, maxt: bound + 1000,
+			expMint: math.MinInt64, expMaxt: bound, expClamped: true,
+		},
+		{
+			name: "min time in the future with unbounded max time", maxSkew: time.Hour,
+			mint: bound + 1, maxt: math.MaxInt64,
+			expMint: math.MinInt64, expMaxt: math.MaxInt64, expClamped: true,
+		},
+		{
+			name: "disabled",
+			mint: bound + 1, maxt: bound + 1000,
+			expMint: bound + 1, expMaxt: bound + 1000,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			mint, maxt, clamped := clampClockSkew(now, tcase.maxSkew, tcase.mint, tcase.maxt)
+			testutil.Equals(t, tcase.expMint, mint)
+			testutil.Equals(t, tcase.expMaxt, maxt)
+			testutil.Equals(t, tcase.expClamped, clamped)
+		})
+	}
+}
+
+func TestStoreSet_Update_ClockSkew(t *testing.T) {
+	future := timestamp.FromTime(time.Now().Add(24 * time.Hour))
+	stores, err := startTestStores([]testStoreMeta{
+		{
+			storeType: component.Store,
+			extlsetFn: func(addr string) []storepb.LabelSet { return nil },
+			minTime:   0,
+			maxTime:   1000,
+		},
+		{
+			// Store with its clock a day ahead.
+			storeType: component.Sidecar,
+			extlsetFn: func(addr string) []storepb.LabelSet { return nil },
+			minTime:   future,
+			maxTime:   future + 1000,
+		},
+	})
+	testutil.Ok(t, err)
+	defer stores.Close()
+
+	healthy, skewed := stores.orderAddrs[0], stores.orderAddrs[1]
+	logs := &bytes.Buffer{}
+	storeSet := NewStoreSet(log.NewLogfmtLogger(log.NewSyncWriter(logs)), nil,
+		func() (specs []StoreSpec) {
+			for _, addr := range stores.StoreAddresses() {
+				specs = append(specs, NewGRPCStoreSpec(addr, false))
+			}
+			return specs
+		},
+		func() (specs []RuleSpec) { return nil },
+		testGRPCOpts, nil, 1, time.Hour, time.Minute)
+	defer storeSet.Close()
+
+	before := time.Now()
+	storeSet.Update(context.Background())
+	testutil.Equals(t, 2, len(storeSet.stores))
+
+	mint, maxt := storeSet.stores[healthy].TimeRange()
+	testutil.Equals(t, int64(0), mint)
+	testutil.Equals(t, int64(1000), maxt)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(storeSet.clockSkewedMetric.WithLabelValues(healthy)))
+
+	mint, maxt = storeSet.stores[skewed].TimeRange()
+	testutil.Equals(t, int64(math.MinInt64), mint)
+	testutil.Assert(t, maxt >= timestamp.FromTime(before.Add(time.Hour)) && maxt <= timestamp.FromTime(time.Now().Add(time.Hour)), "expected max time clamped to an hour from now, got %d", maxt)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(storeSet.clockSkewedMetric.WithLabelValues(skewed)))
+
+	// Clamping is logged only when the store becomes skewed, not on every update.
+	storeSet.Update(context.Background())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(storeSet.clockSkewedMetric.WithLabelValues(skewed)))
+	testutil.Equals(t, 1, strings.Count(logs.String(), "clamping it"))
+}
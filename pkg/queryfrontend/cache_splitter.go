@@ -16,24 +16,43 @@ import (
 type thanosCacheKeyGenerator struct {
 	interval    time.Duration
 	resolutions []int64
+	// alignedWithStep is true if start and end of requests are aligned with their step before the cache is used.
+	alignedWithStep bool
 }
 
-func newThanosCacheKeyGenerator(interval time.Duration) thanosCacheKeyGenerator {
+func newThanosCacheKeyGenerator(interval time.Duration, alignedWithStep bool) thanosCacheKeyGenerator {
 	return thanosCacheKeyGenerator{
-		interval:    interval,
-		resolutions: []int64{downsample.ResLevel2, downsample.ResLevel1, downsample.ResLevel0},
+		interval:        interval,
+		resolutions:     []int64{downsample.ResLevel2, downsample.ResLevel1, downsample.ResLevel0},
+		alignedWithStep: alignedWithStep,
 	}
 }
 
 // TODO(yeya24): Add other request params as request key.
 // GenerateCacheKey generates a cache key based on the Request and interval.
+// Requests aligned with their step share keys regardless of their exact start. Unaligned requests only share keys with
+// requests on the same step grid, as results cached for another grid would be returned at different timestamps.
 func (t thanosCacheKeyGenerator) GenerateCacheKey(_ string, r queryrange.Request) string {
 	currentInterval := r.GetStart() / t.interval.Milliseconds()
+	var key string
 	if tr, ok := r.(*ThanosRequest); ok {
 		i := 0
 		for ; i < len(t.resolutions) && t.resolutions[i] > tr.MaxSourceResolution; i++ {
 		}
-		return fmt.Sprintf("%s:%d:%d:%d", tr.Query, tr.Step, currentInterval, i)
+		key = fmt.Sprintf("%s:%d:%d:%d", tr.Query, tr.Step, currentInterval, i)
+	} else {
+		key = fmt.Sprintf("%s:%d:%d", r.GetQuery(), r.GetStep(), currentInterval)
 	}
-	return fmt.Sprintf("%s:%d:%d", r.GetQuery(), r.GetStep(), currentInterval)
+	if offset := gridOffset(r); !t.alignedWithStep && offset != 0 {
+		key = fmt.Sprintf("%s:%d", key, offset)
+	}
+	return key
+}
+
+// gridOffset returns the offset of the request start from the grid of its step.
+func gridOffset(r queryrange.Request) int64 {
+	if r.GetStep() <= 0 {
+		return 0
+	}
+	return r.GetStart() % r.GetStep()
 }
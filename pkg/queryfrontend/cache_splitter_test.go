@@ -4,15 +4,24 @@
 package queryfrontend
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	cortexcache "github.com/cortexproject/cortex/pkg/chunk/cache"
+	"github.com/cortexproject/cortex/pkg/ingester/client"
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	cortexvalidation "github.com/cortexproject/cortex/pkg/util/validation"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/weaveworks/common/user"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
 func TestGenerateCacheKey(t *testing.T) {
-	splitter := newThanosCacheKeyGenerator(hour)
+	splitter := newThanosCacheKeyGenerator(hour, true)
 
 	for _, tc := range []struct {
 		name     string
@@ -81,3 +90,87 @@ func TestGenerateCacheKey(t *testing.T) {
 		testutil.Equals(t, tc.expected, key)
 	}
 }
+
+func TestGenerateCacheKey_Unaligned(t *testing.T) {
+	aligned, unaligned := newThanosCacheKeyGenerator(time.Hour, true), newThanosCacheKeyGenerator(time.Hour, false)
+	onGrid := &ThanosRequest{Query: "up", Start: 60 * seconds, Step: 10 * seconds}
+	offGrid := &ThanosRequest{Query: "up", Start: 60*seconds + 3, Step: 10 * seconds}
+
+	testutil.Equals(t, "up:10000:0:2", aligned.GenerateCacheKey("", offGrid))
+	// Without alignment, requests on the step grid keep their keys, others get the offset from the grid.
+	testutil.Equals(t, "up:10000:0:2", unaligned.GenerateCacheKey("", onGrid))
+	testutil.Equals(t, "up:10000:0:2:3", unaligned.GenerateCacheKey("", offGrid))
+}
+
+func TestResultsCache_AlignRangeWithStep(t *testing.T) {
+	limits, err := cortexvalidation.NewOverrides(*defaultLimits, nil)
+	testutil.Ok(t, err)
+
+	// Clients sending the same query with bounds differing by milliseconds.
+	first := &ThanosRequest{Path: "/api/v1/query_range", Query: "up", Start: 0, End: 2 * hour, Step: 10 * seconds}
+	second := &ThanosRequest{Path: "/api/v1/query_range", Query: "up", Start: 3, End: 2*hour + 3, Step: 10 * seconds}
+
+	for _, align := range []bool{true, false} {
+		t.Run(fmt.Sprintf("align=%v", align), func(t *testing.T) {
+			cacheMiddleware, _, err := queryrange.NewResultsCacheMiddleware(
+				log.NewNopLogger(),
+				queryrange.ResultsCacheConfig{
+					CacheConfig: cortexcache.Config{
+						EnableFifoCache: true,
+						Fifocache:       cortexcache.FifoCacheConfig{MaxSizeItems: 1000, Validity: time.Hour},
+					},
+				},
+				newThanosCacheKeyGenerator(day, align),
+				limits,
+				NewThanosCodec(true),
+				queryrange.PrometheusResponseExtractor{},
+				nil,
+				shouldCache,
+				nil,
+			)
+			testutil.Ok(t, err)
+			middlewares := []queryrange.Middleware{cacheMiddleware}
+			if align {
+				middlewares = append([]queryrange.Middleware{queryrange.StepAlignMiddleware}, middlewares...)
+			}
+
+			// The downstream handler returns a sample at each step.
+			var downstream int
+			h := queryrange.MergeMiddlewares(middlewares...).Wrap(queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				downstream++
+				var samples []client.Sample
+				for ts := r.GetStart(); ts <= r.GetEnd(); ts += r.GetStep() {
+					samples = append(samples, client.Sample{TimestampMs: ts, Value: float64(ts)})
+				}
+				return &queryrange.PrometheusResponse{
+					Status: queryrange.StatusSuccess,
+					Data: queryrange.PrometheusData{
+						ResultType: string(parser.ValueTypeMatrix),
+						Result:     []queryrange.SampleStream{{Labels: []client.LabelAdapter{{Name: "a", Value: "1"}}, Samples: samples}},
+					},
+				}, nil
+			}))
+			ctx := user.InjectOrgID(context.Background(), "1")
+			do := func(r queryrange.Request) []client.Sample {
+				res, err := h.Do(ctx, r)
+				testutil.Ok(t, err)
+				return res.(*queryrange.PrometheusResponse).Data.Result[0].Samples
+			}
+
+			firstSamples := do(first)
+			testutil.Equals(t, 1, downstream)
+			secondSamples := do(second)
+			if align {
+				// Aligned bounds hit the same cache entry, and results differ only by less than the step.
+				testutil.Equals(t, 1, downstream)
+				testutil.Equals(t, firstSamples, secondSamples)
+				return
+			}
+			// Results on another step grid are not mixed, they are evaluated at exact bounds and cached separately.
+			testutil.Equals(t, 2, downstream)
+			testutil.Equals(t, second.Start, secondSamples[0].TimestampMs)
+			do(second)
+			testutil.Equals(t, 2, downstream)
+		})
+	}
+}
@@ -113,9 +113,17 @@ func (c codec) DecodeRequest(_ context.Context, r *http.Request) (queryrange.Req
 		return nil, err
 	}
 
+	result.NoCache, err = parseNoCacheParam(r.FormValue(queryv1.NoCacheParam))
+	if err != nil {
+		return nil, err
+	}
+
 	result.Query = r.FormValue("query")
 	result.Path = r.URL.Path
 
+	// Requests skipping caches of the querier skip the results cache too.
+	result.CachingOptions.Disabled = result.NoCache
+
 	for _, value := range r.Header.Values(cacheControlHeader) {
 		if strings.Contains(value, noStoreValue) {
 			result.CachingOptions.Disabled = true
@@ -153,6 +161,10 @@ func (c codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.R
 		params[queryv1.StoreMatcherParam] = matchersToStringSlice(thanosReq.StoreMatchers)
 	}
 
+	if thanosReq.NoCache {
+		params[queryv1.NoCacheParam] = []string{"true"}
+	}
+
 	u := &url.URL{
 		Path:     thanosReq.Path,
 		RawQuery: params.Encode(),
@@ -195,6 +207,18 @@ func parseEnableDedupParam(s string) (bool, error) {
 	return enableDeduplication, nil
 }
 
+func parseNoCacheParam(s string) (bool, error) {
+	var noCache bool
+	if s != "" {
+		var err error
+		noCache, err = strconv.ParseBool(s)
+		if err != nil {
+			return false, httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, queryv1.NoCacheParam)
+		}
+	}
+	return noCache, nil
+}
+
 func parseDownsamplingParamMillis(s string) (int64, error) {
 	var maxSourceResolution int64
 	if s != "" {
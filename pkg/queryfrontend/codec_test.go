@@ -166,6 +166,27 @@ func TestCodec_DecodeRequest(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:            "nocache",
+			url:             "/api/v1/query_range?start=123&end=456&step=1&nocache=true",
+			partialResponse: false,
+			expectedRequest: &ThanosRequest{
+				Path:           "/api/v1/query_range",
+				Start:          123000,
+				End:            456000,
+				Step:           1000,
+				Dedup:          true,
+				StoreMatchers:  [][]*labels.Matcher{},
+				NoCache:        true,
+				CachingOptions: queryrange.CachingOptions{Disabled: true},
+			},
+		},
+		{
+			name:            "cannot parse nocache",
+			url:             "/api/v1/query_range?start=123&end=456&step=1&nocache=foo",
+			partialResponse: false,
+			expectedError:   httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, "nocache"),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			r, err := http.NewRequest(http.MethodGet, tc.url, nil)
@@ -208,6 +229,18 @@ func TestCodec_EncodeRequest(t *testing.T) {
 					r.URL.Query().Get("step") == "1"
 			},
 		},
+		{
+			name: "nocache",
+			req: &ThanosRequest{
+				Start:   123000,
+				End:     456000,
+				Step:    1000,
+				NoCache: true,
+			},
+			checkFunc: func(r *http.Request) bool {
+				return r.URL.Query().Get(queryv1.NoCacheParam) == "true"
+			},
+		},
 		{
 			name: "Dedup enabled",
 			req: &ThanosRequest{
@@ -126,6 +126,9 @@ type Config struct {
 
 	SplitQueriesByInterval time.Duration
 	MaxRetries             int
+	// AlignRangeWithStep aligns start and end of range queries with their step, so that queries differing in bounds
+	// by less than the step share results cache entries.
+	AlignRangeWithStep bool
 }
 
 // Validate a fully initialized config.
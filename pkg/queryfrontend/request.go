@@ -26,6 +26,7 @@ type ThanosRequest struct {
 	MaxSourceResolution int64
 	ReplicaLabels       []string
 	StoreMatchers       [][]*labels.Matcher
+	NoCache             bool
 	CachingOptions      queryrange.CachingOptions
 }
 
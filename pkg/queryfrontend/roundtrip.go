@@ -50,11 +50,13 @@ func NewTripperware(
 	queryRangeMiddleware := []queryrange.Middleware{queryrange.LimitsMiddleware(limits)}
 
 	// step align middleware.
-	queryRangeMiddleware = append(
-		queryRangeMiddleware,
-		queryrange.InstrumentMiddleware("step_align", metrics),
-		queryrange.StepAlignMiddleware,
-	)
+	if config.AlignRangeWithStep {
+		queryRangeMiddleware = append(
+			queryRangeMiddleware,
+			queryrange.InstrumentMiddleware("step_align", metrics),
+			queryrange.StepAlignMiddleware,
+		)
+	}
 
 	codec := NewThanosCodec(config.PartialResponseStrategy)
 
@@ -74,7 +76,7 @@ func NewTripperware(
 		queryCacheMiddleware, _, err := queryrange.NewResultsCacheMiddleware(
 			logger,
 			*config.CortexResultsCacheConfig,
-			newThanosCacheKeyGenerator(config.SplitQueriesByInterval),
+			newThanosCacheKeyGenerator(config.SplitQueriesByInterval, config.AlignRangeWithStep),
 			limits,
 			codec,
 			queryrange.PrometheusResponseExtractor{},
@@ -314,6 +314,7 @@ func TestRoundTripCacheMiddleware(t *testing.T) {
 			SplitQueriesByInterval:   day,
 			CortexResultsCacheConfig: cacheConf,
 			CortexLimits:             defaultLimits,
+			AlignRangeWithStep:       true,
 		}, nil, log.NewNopLogger(),
 	)
 	testutil.Ok(t, err)
@@ -27,6 +27,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/encoding"
@@ -92,6 +93,7 @@ type bucketStoreMetrics struct {
 	blocksLoaded          prometheus.Gauge
 	blockLoads            prometheus.Counter
 	blockLoadFailures     prometheus.Counter
+	blockVerifyFailures   prometheus.Counter
 	blockDrops            prometheus.Counter
 	blockDropFailures     prometheus.Counter
 	seriesDataTouched     *prometheus.SummaryVec
@@ -104,6 +106,7 @@ type bucketStoreMetrics struct {
 	resultSeriesCount     prometheus.Summary
 	chunkSizeBytes        prometheus.Histogram
 	queriesDropped        prometheus.Counter
+	responseOverBudget    prometheus.Counter
 	seriesRefetches       prometheus.Counter
 
 	cachedPostingsCompressions           *prometheus.CounterVec
@@ -127,6 +130,10 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_block_load_failures_total",
 		Help: "Total number of failed remote block loading attempts.",
 	})
+	m.blockVerifyFailures = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_block_verification_failures_total",
+		Help: "Total number of blocks refused to be loaded because they failed integrity verification.",
+	})
 	m.blockDrops = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_block_drops_total",
 		Help: "Total number of local blocks that were dropped.",
@@ -189,6 +196,10 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_queries_dropped_total",
 		Help: "Number of queries that were dropped due to the sample limit.",
 	})
+	m.responseOverBudget = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_response_budget_exceeded_total",
+		Help: "Number of Series calls stopped early because their response exceeded the response budget.",
+	})
 	m.seriesRefetches = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_series_refetches_total",
 		Help: fmt.Sprintf("Total number of cases where %v bytes was not enough was to fetch series from index, resulting in refetch.", maxSeriesSize),
@@ -255,10 +266,36 @@ type BucketStore struct {
 	indexCache storecache.IndexCache
 	chunkPool  pool.BytesPool
 
+	// duplicateBlocksFilter, if not nil, is the fetcher's filter used to keep serving blocks compacted into
+	// a new block until the new block is loaded.
+	duplicateBlocksFilter *block.DeduplicateFilter
+	// indexHeaderPool, if not nil, creates index-header readers of loaded blocks, keeping them within its memory budget.
+	indexHeaderPool *indexheader.ReaderPool
+	// sharedIndex, if not nil, provides index-header readers of loaded blocks from an index shared with other stores.
+	sharedIndex indexheader.SharedIndex
+	// postingsCache, if not nil, caches series of blocks matching matchers of requests.
+	postingsCache *ExpandedPostingsCache
+	// labelValueGuard, if not nil, truncates too long label values of loaded series or drops such series.
+	labelValueGuard *LabelValueLengthGuard
+	// blockVerification is the depth of integrity verification of blocks before they are loaded.
+	blockVerification block.VerificationLevel
+	// tailChunksMinSamples is the minimum number of samples of tail chunks returned alone for tail-only requests.
+	// Zero disables trimming of series to their tail chunks.
+	tailChunksMinSamples int
+	// autoResolutions, if not empty, allow serving old blocks in resolutions coarser than requested.
+	autoResolutions []AutoResolution
+	// responseBudget is the soft limit of bytes of series returned by a single Series call. Zero means no limit.
+	responseBudget int64
+
 	// Sets of blocks that have the same labels. They are indexed by a hash over their label set.
 	mtx       sync.RWMutex
 	blocks    map[ulid.ULID]*bucketBlock
 	blockSets map[uint64]*bucketBlockSet
+	// Blocks evicted with EvictBlock. They are neither loaded nor queried until restored.
+	// Meta is nil if the block was not loaded when evicted.
+	evicted map[ulid.ULID]*metadata.Meta
+	// Blocks refused to be loaded because they are corrupted. Blocks are immutable, so they are not verified again.
+	corrupted map[ulid.ULID]struct{}
 
 	// Verbose enabled additional logging.
 	debugLogging bool
@@ -324,6 +361,8 @@ func NewBucketStore(
 		chunkPool:                   chunkPool,
 		blocks:                      map[ulid.ULID]*bucketBlock{},
 		blockSets:                   map[uint64]*bucketBlockSet{},
+		evicted:                     map[ulid.ULID]*metadata.Meta{},
+		corrupted:                   map[ulid.ULID]struct{}{},
 		debugLogging:                debugLogging,
 		blockSyncConcurrency:        blockSyncConcurrency,
 		filterConfig:                filterConfig,
@@ -344,6 +383,77 @@ func NewBucketStore(
 	return s, nil
 }
 
+// SetDuplicateBlocksFilter makes the store serve blocks filtered out by the given filter of its fetcher, because they
+// were compacted into a new block, until the new block is loaded. This avoids gaps in query results while the compacted
+// block is being loaded or fails to load. It has to be called before the first sync.
+func (s *BucketStore) SetDuplicateBlocksFilter(f *block.DeduplicateFilter) {
+	s.duplicateBlocksFilter = f
+}
+
+// SetIndexHeaderReaderPool makes the store create index-header readers using the given pool, which loads them lazily
+// and unloads least recently used ones to keep their total size within the pool's memory budget. It has to be called
+// before the first sync.
+func (s *BucketStore) SetIndexHeaderReaderPool(p *indexheader.ReaderPool) {
+	s.indexHeaderPool = p
+}
+
+// SetSharedIndex makes the store read index-headers from the given index shared with other stores, instead of building
+// and holding its own. It takes precedence over the index-header reader pool. It has to be called before the first
+// sync.
+func (s *BucketStore) SetSharedIndex(i indexheader.SharedIndex) {
+	s.sharedIndex = i
+}
+
+// SetExpandedPostingsCache makes the store cache series of blocks matching matchers of requests in the given cache, so
+// that repeated requests with the same matchers do not resolve the same postings again. It has to be called before
+// the first sync.
+func (s *BucketStore) SetExpandedPostingsCache(c *ExpandedPostingsCache) {
+	s.postingsCache = c
+}
+
+// SetLabelValueLengthGuard makes the store truncate too long label values of series loaded from blocks or drop such
+// series, as decided by the guard. It has to be called before the first sync.
+func (s *BucketStore) SetLabelValueLengthGuard(g *LabelValueLengthGuard) {
+	s.labelValueGuard = g
+}
+
+// SetBlockVerification makes the store verify integrity of blocks with the given depth before loading them. Corrupted
+// blocks are not loaded nor verified again. It has to be called before the first sync.
+func (s *BucketStore) SetBlockVerification(lvl block.VerificationLevel) {
+	s.blockVerification = lvl
+}
+
+// SetTailChunksMinSamples makes the store return only tail chunks of series for requests asking just for their latest
+// sample, as long as the tail chunks hold at least the given number of samples. Sparser series are returned with all
+// their chunks within the requested time range, so callers still get enough history within their lookback window.
+// Zero, the default, disables trimming.
+func (s *BucketStore) SetTailChunksMinSamples(n int) {
+	s.tailChunksMinSamples = n
+}
+
+// AutoResolution allows serving blocks of the given or finer resolution for parts of requests older than MinAge,
+// even if requests ask for finer resolution.
+type AutoResolution struct {
+	// Resolution in milliseconds.
+	Resolution int64
+	MinAge     time.Duration
+}
+
+// SetAutoResolutions makes the store choose the resolution of each block by its age, so that recent parts of
+// requests are served from raw blocks and old parts from downsampled ones, if available, even within one request.
+// Requested max resolution is still honored for blocks too young for any of the given resolutions. Each part of a
+// request is served in one resolution only, as with requested resolution.
+func (s *BucketStore) SetAutoResolutions(rs ...AutoResolution) {
+	s.autoResolutions = rs
+}
+
+// SetResponseBudget makes the store stop sending series of a Series call once they exceed the given number of bytes.
+// The budget is soft: the series exceeding it is still sent whole. Requests with partial response enabled get the
+// series sent so far with a warning, others fail. Zero, the default, disables the budget.
+func (s *BucketStore) SetResponseBudget(bytes int64) {
+	s.responseBudget = bytes
+}
+
 // Close the store.
 func (s *BucketStore) Close() (err error) {
 	s.mtx.Lock()
@@ -381,6 +491,19 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 
 	for id, meta := range metas {
 		if b := s.getBlock(id); b != nil {
+			if labels.Equal(labels.FromMap(b.meta.Thanos.Labels), labels.FromMap(meta.Thanos.Labels)) {
+				continue
+			}
+			// External labels of the block were rewritten in place, load it again with the new ones.
+			level.Info(s.logger).Log("msg", "reloading block with changed external labels", "block", id)
+			if err := s.removeBlock(id); err != nil {
+				level.Warn(s.logger).Log("msg", "drop of block with changed external labels failed", "block", id, "err", err)
+				s.metrics.blockDropFailures.Inc()
+				continue
+			}
+			s.metrics.blockDrops.Inc()
+		}
+		if s.isEvicted(id) || s.isCorrupted(id) {
 			continue
 		}
 		select {
@@ -396,11 +519,25 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		return metaFetchErr
 	}
 
+	replaced := map[ulid.ULID]struct{}{}
+	if s.duplicateBlocksFilter != nil {
+		for _, id := range s.duplicateBlocksFilter.DuplicateIDs() {
+			replaced[id] = struct{}{}
+		}
+	}
+
 	// Drop all blocks that are no longer present in the bucket.
 	for id := range s.blocks {
 		if _, ok := metas[id]; ok {
 			continue
 		}
+		// Blocks compacted into a new block are still served until the new block is loaded, so queries
+		// do not see gaps in the meantime. Blocks marked for deletion longer than the deletion mark delay are
+		// filtered out before deduplication, so they are dropped regardless.
+		if _, ok := replaced[id]; ok && !s.isReplacementLoaded(id, metas) {
+			level.Debug(s.logger).Log("msg", "keeping compacted block until its replacement is loaded", "block", id)
+			continue
+		}
 		if err := s.removeBlock(id); err != nil {
 			level.Warn(s.logger).Log("msg", "drop of outdated block failed", "block", id, "err", err)
 			s.metrics.blockDropFailures.Inc()
@@ -409,6 +546,15 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		s.metrics.blockDrops.Inc()
 	}
 
+	// Forget corrupted blocks which are no longer present in the bucket, e.g. because they were deleted.
+	s.mtx.Lock()
+	for id := range s.corrupted {
+		if _, ok := metas[id]; !ok {
+			delete(s.corrupted, id)
+		}
+	}
+	s.mtx.Unlock()
+
 	// Sync advertise labels.
 	var storeLabels labels.Labels
 	s.mtx.Lock()
@@ -457,6 +603,34 @@ func (s *BucketStore) InitialSync(ctx context.Context) error {
 	return nil
 }
 
+// isReplacementLoaded returns true if any loaded block from metas contains all source blocks of the given block.
+func (s *BucketStore) isReplacementLoaded(id ulid.ULID, metas map[ulid.ULID]*metadata.Meta) bool {
+	b := s.getBlock(id)
+	if b == nil {
+		return true
+	}
+
+	sources := make(map[ulid.ULID]struct{}, len(b.meta.Compaction.Sources))
+	for _, src := range b.meta.Compaction.Sources {
+		sources[src] = struct{}{}
+	}
+	for replacementID, meta := range metas {
+		if meta.Thanos.Downsample.Resolution != b.meta.Thanos.Downsample.Resolution || s.getBlock(replacementID) == nil {
+			continue
+		}
+		contained := 0
+		for _, src := range meta.Compaction.Sources {
+			if _, ok := sources[src]; ok {
+				contained++
+			}
+		}
+		if contained == len(sources) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *BucketStore) getBlock(id ulid.ULID) *bucketBlock {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -481,17 +655,29 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	}()
 	s.metrics.blockLoads.Inc()
 
+	if err = block.VerifyInBucket(ctx, s.logger, s.bkt, meta, s.dir, s.blockVerification); err != nil {
+		if errors.Cause(err) == block.ErrCorrupted {
+			s.metrics.blockVerifyFailures.Inc()
+
+			s.mtx.Lock()
+			s.corrupted[meta.ULID] = struct{}{}
+			s.mtx.Unlock()
+		}
+		return errors.Wrap(err, "verify block")
+	}
+
 	lset := labels.FromMap(meta.Thanos.Labels)
 	h := lset.Hash()
 
-	indexHeaderReader, err := indexheader.NewBinaryReader(
-		ctx,
-		s.logger,
-		s.bkt,
-		s.dir,
-		meta.ULID,
-		s.postingOffsetsInMemSampling,
-	)
+	var indexHeaderReader indexheader.Reader
+	switch {
+	case s.sharedIndex != nil:
+		indexHeaderReader, err = s.sharedIndex.Reader(ctx, meta.ULID)
+	case s.indexHeaderPool != nil:
+		indexHeaderReader, err = s.indexHeaderPool.NewBinaryReader(ctx, s.logger, s.bkt, s.dir, meta.ULID, s.postingOffsetsInMemSampling)
+	default:
+		indexHeaderReader, err = indexheader.NewBinaryReader(ctx, s.logger, s.bkt, s.dir, meta.ULID, s.postingOffsetsInMemSampling)
+	}
 	if err != nil {
 		return errors.Wrap(err, "create index header reader")
 	}
@@ -517,6 +703,7 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	if err != nil {
 		return errors.Wrap(err, "new bucket block")
 	}
+	b.postingsCache = s.postingsCache
 	defer func() {
 		if err != nil {
 			runutil.CloseWithErrCapture(&err, b, "index-header")
@@ -526,6 +713,10 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	if _, ok := s.evicted[meta.ULID]; ok {
+		return errors.New("block was evicted while loading")
+	}
+
 	sort.Sort(lset)
 
 	set, ok := s.blockSets[h]
@@ -549,7 +740,12 @@ func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	b, ok := s.blocks[id]
 	if ok {
 		lset := labels.FromMap(b.meta.Thanos.Labels)
-		s.blockSets[lset.Hash()].remove(id)
+		set := s.blockSets[lset.Hash()]
+		set.remove(id)
+		// Sets without blocks are not advertised anymore, e.g. once external labels of their blocks were rewritten.
+		if set.empty() {
+			delete(s.blockSets, lset.Hash())
+		}
 		delete(s.blocks, id)
 	}
 	s.mtx.Unlock()
@@ -559,12 +755,124 @@ func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	}
 
 	s.metrics.blocksLoaded.Dec()
+	if s.postingsCache != nil {
+		s.postingsCache.InvalidateBlock(id)
+	}
 	if err := b.Close(); err != nil {
 		return errors.Wrap(err, "close block")
 	}
 	return os.RemoveAll(b.dir)
 }
 
+func (s *BucketStore) isEvicted(id ulid.ULID) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	_, ok := s.evicted[id]
+	return ok
+}
+
+func (s *BucketStore) isCorrupted(id ulid.ULID) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	_, ok := s.corrupted[id]
+	return ok
+}
+
+// EvictBlock removes the block from memory and local disk and stops serving it until RestoreBlock is called.
+// Queries touching the time range of the evicted block receive a partial response warning. Queries in progress
+// finish using the block before it is closed. It returns false if the block was not loaded.
+func (s *BucketStore) EvictBlock(id ulid.ULID) (bool, error) {
+	s.mtx.Lock()
+	var meta *metadata.Meta
+	b, ok := s.blocks[id]
+	if ok {
+		meta = b.meta
+	}
+	if _, evicted := s.evicted[id]; !evicted || meta != nil {
+		s.evicted[id] = meta
+	}
+	s.mtx.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	level.Info(s.logger).Log("msg", "evicting block", "block", id)
+	s.metrics.blockDrops.Inc()
+	if err := s.removeBlock(id); err != nil {
+		s.metrics.blockDropFailures.Inc()
+		return true, errors.Wrap(err, "remove block")
+	}
+	return true, nil
+}
+
+// RestoreBlock allows the evicted block to be loaded again with the next SyncBlocks. It returns false
+// if the block was not evicted.
+func (s *BucketStore) RestoreBlock(id ulid.ULID) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.evicted[id]; !ok {
+		return false
+	}
+	delete(s.evicted, id)
+	level.Info(s.logger).Log("msg", "evicted block restored, it will be loaded on next sync", "block", id)
+	return true
+}
+
+// EvictedBlocks returns IDs of all evicted blocks, sorted.
+func (s *BucketStore) EvictedBlocks() []ulid.ULID {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	ids := make([]ulid.ULID, 0, len(s.evicted))
+	for id := range s.evicted {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	return ids
+}
+
+// evictedBlocksWarnings returns warnings for evicted blocks that would be otherwise queried by the given request.
+// NOTE: s.mtx has to be held by the caller.
+func (s *BucketStore) evictedBlocksWarnings(req *storepb.SeriesRequest, matchers []*labels.Matcher) (warns []error) {
+	for id, meta := range s.evicted {
+		if meta == nil || meta.MaxTime <= req.MinTime || meta.MinTime > req.MaxTime || meta.Thanos.Downsample.Resolution > req.MaxResolutionWindow {
+			continue
+		}
+		if _, ok := newBucketBlockSet(labels.FromMap(meta.Thanos.Labels)).labelMatchers(matchers...); !ok {
+			continue
+		}
+		warns = append(warns, errors.Errorf("block %s was evicted from the store, its data is missing in the response", id))
+	}
+	return warns
+}
+
+// blockGapsWarnings returns warnings about parts of the requested range, which are within the time range of blocks
+// of matching block sets, but not covered by any queried block. Such gaps are usually caused by lost or deleted blocks,
+// as opposed to a range where blocks exist but contain no data. Evicted blocks are reported separately.
+func (s *BucketStore) blockGapsWarnings(req *storepb.SeriesRequest, span timeRange, covered []timeRange) (warns []error) {
+	if span.mint >= span.maxt {
+		return nil
+	}
+	for _, meta := range s.evicted {
+		if meta != nil {
+			covered = append(covered, timeRange{mint: meta.MinTime, maxt: meta.MaxTime})
+		}
+	}
+
+	mint, maxt := req.MinTime, req.MaxTime
+	if span.mint > mint {
+		mint = span.mint
+	}
+	if span.maxt-1 < maxt {
+		maxt = span.maxt - 1
+	}
+	for _, g := range coverageGaps(mint, maxt, covered) {
+		warns = append(warns, errors.Errorf("no blocks of the requested resolution cover time range %s of the query: data in this range was compacted away, deleted or failed to load", g))
+	}
+	return warns
+}
+
 // TimeRange returns the minimum and maximum timestamp of data available in the store.
 func (s *BucketStore) TimeRange() (mint, maxt int64) {
 	s.mtx.RLock()
@@ -672,6 +980,12 @@ func (s *bucketSeriesSet) Err() error {
 	return s.err
 }
 
+// limitError marks errors caused by exceeding one of the Series request limits.
+// Such errors are returned with codes.ResourceExhausted, so clients can tell them apart from failures.
+type limitError struct {
+	error
+}
+
 func blockSeries(
 	extLset map[string]string,
 	indexr *bucketIndexReader,
@@ -679,6 +993,8 @@ func blockSeries(
 	matchers []*labels.Matcher,
 	req *storepb.SeriesRequest,
 	chunksLimiter ChunksLimiter,
+	tailMinSamples int,
+	labelValueGuard *LabelValueLengthGuard,
 ) (storepb.SeriesSet, *queryStats, error) {
 	ps, err := indexr.ExpandedPostings(matchers)
 	if err != nil {
@@ -697,11 +1013,15 @@ func blockSeries(
 	}
 
 	// Transform all series into the response types and mark their relevant chunks
-	// for preloading.
+	// for preloading. For tail-only requests, only tail chunks are preloaded first.
 	var (
-		res  []seriesEntry
-		lset labels.Labels
-		chks []chunks.Meta
+		res       []seriesEntry
+		tails     []int
+		lset      labels.Labels
+		chks      []chunks.Meta
+		tailOnly  = req.TailOnly && tailMinSamples > 0 && !req.SkipChunks
+		truncated int
+		rejected  int
 	)
 	for _, id := range ps {
 		if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
@@ -725,6 +1045,14 @@ func blockSeries(
 		}
 		sort.Sort(s.lset)
 
+		if l, trunc, reject := labelValueGuard.Apply(s.lset); reject {
+			rejected++
+			continue
+		} else if trunc {
+			s.lset = l
+			truncated++
+		}
+
 		for _, meta := range chks {
 			if meta.MaxTime < req.MinTime {
 				continue
@@ -733,22 +1061,30 @@ func blockSeries(
 				break
 			}
 
-			if err := chunkr.addPreload(meta.Ref); err != nil {
-				return nil, nil, errors.Wrap(err, "add chunk preload")
-			}
 			s.chks = append(s.chks, storepb.AggrChunk{
 				MinTime: meta.MinTime,
 				MaxTime: meta.MaxTime,
 			})
 			s.refs = append(s.refs, meta.Ref)
 		}
-		if len(s.chks) > 0 {
-			if err := chunksLimiter.Reserve(uint64(len(s.chks))); err != nil {
-				return nil, nil, errors.Wrap(err, "exceeded chunks limit")
-			}
+		if len(s.chks) == 0 {
+			continue
+		}
 
-			res = append(res, s)
+		tail := 0
+		if tailOnly {
+			tail = tailChunksStart(s.chks)
+		}
+		if err := chunksLimiter.Reserve(uint64(len(s.chks) - tail)); err != nil {
+			return nil, nil, errors.Wrap(limitError{err}, "exceeded chunks limit")
 		}
+		for _, ref := range s.refs[tail:] {
+			if err := chunkr.addPreload(ref); err != nil {
+				return nil, nil, errors.Wrap(err, "add chunk preload")
+			}
+		}
+		res = append(res, s)
+		tails = append(tails, tail)
 	}
 
 	// Preload all chunks that were marked in the previous stage.
@@ -757,19 +1093,107 @@ func blockSeries(
 	}
 
 	// Transform all chunks into the response format.
-	for _, s := range res {
-		for i, ref := range s.refs {
-			chk, err := chunkr.Chunk(ref)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "get chunk")
+	for i := range res {
+		if err := populateChunks(chunkr, &res[i], tails[i], len(res[i].refs), req.Aggregates); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if tailOnly {
+		// Series whose tail chunks hold too few samples are sparse, so their latest samples may not give enough history
+		// within the requested window. Load the rest of their chunks, while trimming dense series to their tail.
+		var sparse []int
+		for i := range res {
+			s, tail := &res[i], tails[i]
+			if tail == 0 {
+				continue
 			}
-			if err := populateChunk(&s.chks[i], chk, req.Aggregates); err != nil {
-				return nil, nil, errors.Wrap(err, "populate chunk")
+			if numSamples(s.chks[tail:]) >= tailMinSamples {
+				s.chks, s.refs = s.chks[tail:], s.refs[tail:]
+				continue
+			}
+
+			if err := chunksLimiter.Reserve(uint64(tail)); err != nil {
+				return nil, nil, errors.Wrap(limitError{err}, "exceeded chunks limit")
+			}
+			for _, ref := range s.refs[:tail] {
+				if err := chunkr.addPreload(ref); err != nil {
+					return nil, nil, errors.Wrap(err, "add chunk preload")
+				}
+			}
+			sparse = append(sparse, i)
+		}
+
+		if len(sparse) > 0 {
+			if err := chunkr.preload(); err != nil {
+				return nil, nil, errors.Wrap(err, "preload chunks of sparse series")
+			}
+			for _, i := range sparse {
+				if err := populateChunks(chunkr, &res[i], 0, tails[i], req.Aggregates); err != nil {
+					return nil, nil, err
+				}
 			}
 		}
 	}
 
-	return newBucketSeriesSet(res), indexr.stats.merge(chunkr.stats), nil
+	if truncated > 0 {
+		// Truncated label values may change the order of series.
+		sort.SliceStable(res, func(i, j int) bool {
+			return labels.Compare(res[i].lset, res[j].lset) < 0
+		})
+	}
+
+	stats := indexr.stats.merge(chunkr.stats)
+	stats.labelValueGuardedSeries = truncated + rejected
+	return newBucketSeriesSet(res), stats, nil
+}
+
+// populateChunks populates chunks of the series entry in the given index range with loaded data.
+func populateChunks(chunkr *bucketChunkReader, s *seriesEntry, from, to int, aggrs []storepb.Aggr) error {
+	for i := from; i < to; i++ {
+		chk, err := chunkr.Chunk(s.refs[i])
+		if err != nil {
+			return errors.Wrap(err, "get chunk")
+		}
+		if err := populateChunk(&s.chks[i], chk, aggrs); err != nil {
+			return errors.Wrap(err, "populate chunk")
+		}
+	}
+	return nil
+}
+
+// tailChunksStart returns the index of the first tail chunk, which together with all following chunks is guaranteed
+// to hold the latest sample of the series. The newest chunk holds a sample at its MinTime, so the latest sample is there
+// or in any chunk still overlapping with it.
+// NOTE: input chunks has to be sorted by minTime and cannot start after the requested max time.
+func tailChunksStart(chks []storepb.AggrChunk) int {
+	lastMinTime := chks[len(chks)-1].MinTime
+	start := len(chks) - 1
+	for i := start - 1; i >= 0; i-- {
+		if chks[i].MaxTime >= lastMinTime {
+			start = i
+		}
+	}
+	return start
+}
+
+// numSamples returns the number of samples of the given populated chunks. Downsampled chunks are counted by the number
+// of their aggregated samples.
+func numSamples(chks []storepb.AggrChunk) (n int) {
+	for _, c := range chks {
+		for _, x := range []*storepb.Chunk{c.Raw, c.Count, c.Sum, c.Min, c.Max, c.Counter} {
+			if x == nil {
+				continue
+			}
+			chk, err := chunkenc.FromData(chunkenc.EncXOR, x.Data)
+			if err != nil {
+				continue
+			}
+			n += chk.NumSamples()
+			break
+		}
+	}
+	return n
 }
 
 func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Aggr) error {
@@ -884,6 +1308,8 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		resHints         = &hintspb.SeriesResponseHints{}
 		reqBlockMatchers []*labels.Matcher
 		chunksLimiter    = s.chunksLimiterFactory(s.metrics.queriesDropped)
+		covered          []timeRange
+		span             = timeRange{mint: math.MaxInt64, maxt: math.MinInt64}
 	)
 
 	if req.Hints != nil {
@@ -906,7 +1332,13 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			continue
 		}
 
-		blocks := bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow, reqBlockMatchers)
+		var blocks []*bucketBlock
+		if len(s.autoResolutions) > 0 {
+			blocks = bs.getForAge(req.MinTime, req.MaxTime, req.MaxResolutionWindow, s.autoResolutions, timestamp.FromTime(time.Now()), reqBlockMatchers)
+		} else {
+			blocks = bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow, reqBlockMatchers)
+		}
+		span = bs.extendTimeRange(span)
 
 		if s.debugLogging {
 			debugFoundBlockSetOverview(s.logger, req.MinTime, req.MaxTime, req.MaxResolutionWindow, bs.labels, blocks)
@@ -914,6 +1346,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 
 		for _, b := range blocks {
 			b := b
+			covered = append(covered, timeRange{mint: b.meta.MinTime, maxt: b.meta.MaxTime})
 
 			if s.enableSeriesResponseHints {
 				// Keep track of queried blocks.
@@ -936,10 +1369,15 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 					blockMatchers,
 					req,
 					chunksLimiter,
+					s.tailChunksMinSamples,
+					s.labelValueGuard,
 				)
 				if err != nil {
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
+				if req.ChunkSources {
+					part = storepb.NewChunkSourceSeriesSet(part, storepb.ChunkSource{BlockId: b.meta.ULID.String()})
+				}
 
 				mtx.Lock()
 				res = append(res, part)
@@ -951,8 +1389,20 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		}
 	}
 
+	evictedWarns := s.evictedBlocksWarnings(req, matchers)
+	if req.WarnCoverageGaps && len(reqBlockMatchers) == 0 {
+		// Blocks filtered out by block matchers are excluded on purpose, so the coverage is checked only without them.
+		evictedWarns = append(evictedWarns, s.blockGapsWarnings(req, span, covered)...)
+	}
+
 	s.mtx.RUnlock()
 
+	for _, w := range evictedWarns {
+		if err := srv.Send(storepb.NewWarnSeriesResponse(w)); err != nil {
+			return status.Error(codes.Unknown, errors.Wrap(err, "send warning response").Error())
+		}
+	}
+
 	defer func() {
 		s.metrics.seriesDataTouched.WithLabelValues("postings").Observe(float64(stats.postingsTouched))
 		s.metrics.seriesDataFetched.WithLabelValues("postings").Observe(float64(stats.postingsFetched))
@@ -987,7 +1437,11 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			err = g.Wait()
 		})
 		if err != nil {
-			return status.Error(codes.Aborted, err.Error())
+			code := codes.Aborted
+			if _, ok := errors.Cause(err).(limitError); ok {
+				code = codes.ResourceExhausted
+			}
+			return status.Error(code, err.Error())
 		}
 		stats.blocksQueried = len(res)
 		stats.getAllDuration = time.Since(begin)
@@ -1004,6 +1458,21 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		for set.Next() {
 			var series storepb.Series
 
+			if s.responseBudget > 0 && stats.responseSizeSum >= s.responseBudget {
+				// There are more series to send, so the response is incomplete.
+				s.metrics.responseOverBudget.Inc()
+				budgetErr := errors.Errorf("response budget exceeded: stopped after %d series of %d bytes, the budget is %d bytes", stats.mergedSeriesCount, stats.responseSizeSum, s.responseBudget)
+				if req.PartialResponseDisabled {
+					err = status.Error(codes.ResourceExhausted, budgetErr.Error())
+					return
+				}
+				if err = srv.Send(storepb.NewWarnSeriesResponse(budgetErr)); err != nil {
+					err = status.Error(codes.Unknown, errors.Wrap(err, "send warning response").Error())
+					return
+				}
+				break
+			}
+
 			stats.mergedSeriesCount++
 
 			var lset labels.Labels
@@ -1016,6 +1485,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 				s.metrics.chunkSizeBytes.Observe(float64(chunksSize(series.Chunks)))
 			}
 			series.Labels = labelpb.LabelsFromPromLabels(lset)
+			stats.responseSizeSum += int64(series.Size())
 			if err = srv.Send(storepb.NewSeriesResponse(&series)); err != nil {
 				err = status.Error(codes.Unknown, errors.Wrap(err, "send series response").Error())
 				return
@@ -1030,6 +1500,16 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 
 		err = nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if stats.labelValueGuardedSeries > 0 {
+		if err = srv.Send(storepb.NewWarnSeriesResponse(errors.New(s.labelValueGuard.Warning(stats.labelValueGuardedSeries)))); err != nil {
+			err = status.Error(codes.Unknown, errors.Wrap(err, "send warning response").Error())
+			return
+		}
+	}
 
 	if s.enableSeriesResponseHints {
 		var anyHints *types.Any
@@ -1073,7 +1553,10 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label names")
 
 			// Do it via index reader to have pending reader registered correctly.
-			res := indexr.block.indexHeaderReader.LabelNames()
+			res, err := indexr.block.indexHeaderReader.LabelNames()
+			if err != nil {
+				return errors.Wrap(err, "label names")
+			}
 			sort.Strings(res)
 
 			mtx.Lock()
@@ -1096,29 +1579,88 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 
 // LabelValues implements the storepb.StoreServer interface.
 func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	blockValues, err := s.blocksLabelValues(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([][]string, 0, len(blockValues))
+	for _, vals := range blockValues {
+		sets = append(sets, vals)
+	}
+	return &storepb.LabelValuesResponse{
+		Values: strutil.MergeSlices(sets...),
+	}, nil
+}
+
+// LabelValuesStream implements the storepb.StoreServer interface. Sorted values of blocks are merged batch by batch,
+// so that batches are sent while merging and merged values of all blocks are never held in memory at once.
+func (s *BucketStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	blockValues, err := s.blocksLabelValues(srv.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	sets := make([]*labelValuesSet, 0, len(blockValues))
+	for id, vals := range blockValues {
+		sets = append(sets, newSliceLabelValuesSet(id.String(), vals, nil))
+	}
+	return sendMergedLabelValues(srv, sets)
+}
+
+// blocksLabelValues returns sorted values of the requested label of each block matching the request.
+func (s *BucketStore) blocksLabelValues(ctx context.Context, req *storepb.LabelValuesRequest) (map[ulid.ULID][]string, error) {
+	reqSeriesMatchers, err := storepb.TranslateFromPromMatchers(req.Matchers...)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	g, gctx := errgroup.WithContext(ctx)
 
 	s.mtx.RLock()
 
 	var mtx sync.Mutex
-	var sets [][]string
+	sets := map[ulid.ULID][]string{}
 
 	for _, b := range s.blocks {
 		if !b.overlapsClosedInterval(req.Start, req.End) {
 			continue
 		}
+		extLset := labels.FromMap(b.meta.Thanos.Labels)
+
+		var blockMatchers []*labels.Matcher
+		if len(reqSeriesMatchers) > 0 {
+			var ok bool
+			blockMatchers, ok = s.blockSets[extLset.Hash()].labelMatchers(reqSeriesMatchers...)
+			if !ok {
+				continue
+			}
+		}
+
+		id := b.meta.ULID
 		indexr := b.indexReader(gctx)
 		g.Go(func() error {
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label values")
 
-			// Do it via index reader to have pending reader registered correctly.
-			res, err := indexr.block.indexHeaderReader.LabelValues(req.Label)
-			if err != nil {
-				return errors.Wrap(err, "index header label values")
+			var (
+				res []string
+				err error
+			)
+			if len(blockMatchers) > 0 {
+				res, err = blockLabelValues(indexr, req.Label, blockMatchers, extLset)
+				if err != nil {
+					return errors.Wrap(err, "block label values")
+				}
+			} else {
+				// Do it via index reader to have pending reader registered correctly.
+				res, err = indexr.block.indexHeaderReader.LabelValues(req.Label)
+				if err != nil {
+					return errors.Wrap(err, "index header label values")
+				}
 			}
 
 			mtx.Lock()
-			sets = append(sets, res)
+			sets[id] = res
 			mtx.Unlock()
 
 			return nil
@@ -1130,9 +1672,47 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 	if err := g.Wait(); err != nil {
 		return nil, status.Error(codes.Aborted, err.Error())
 	}
-	return &storepb.LabelValuesResponse{
-		Values: strutil.MergeSlices(sets...),
-	}, nil
+	return sets, nil
+}
+
+// blockLabelValues returns sorted values of the given label of series matching given matchers. Block's external labels
+// take priority over labels of series.
+func blockLabelValues(indexr *bucketIndexReader, name string, matchers []*labels.Matcher, extLset labels.Labels) ([]string, error) {
+	ps, err := indexr.ExpandedPostings(matchers)
+	if err != nil {
+		return nil, errors.Wrap(err, "expanded matching posting")
+	}
+	if len(ps) == 0 {
+		return nil, nil
+	}
+	if v := extLset.Get(name); v != "" {
+		return []string{v}, nil
+	}
+
+	if err := indexr.PreloadSeries(ps); err != nil {
+		return nil, errors.Wrap(err, "preload series")
+	}
+
+	var (
+		vals = map[string]struct{}{}
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for _, id := range ps {
+		if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
+			return nil, errors.Wrap(err, "read series")
+		}
+		if v := lset.Get(name); v != "" {
+			vals[v] = struct{}{}
+		}
+	}
+
+	res := make([]string, 0, len(vals))
+	for v := range vals {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res, nil
 }
 
 // bucketBlockSet holds all blocks of an equal label set. It internally splits
@@ -1144,6 +1724,24 @@ type bucketBlockSet struct {
 	blocks      [][]*bucketBlock // Ordered buckets for the existing resolutions.
 }
 
+// extendTimeRange returns the given time range extended by the time range of blocks in the set, of any resolution.
+func (s *bucketBlockSet) extendTimeRange(r timeRange) timeRange {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, bs := range s.blocks {
+		for _, b := range bs {
+			if b.meta.MinTime < r.mint {
+				r.mint = b.meta.MinTime
+			}
+			if b.meta.MaxTime > r.maxt {
+				r.maxt = b.meta.MaxTime
+			}
+		}
+	}
+	return r
+}
+
 // newBucketBlockSet initializes a new set with the known downsampling windows hard-configured.
 // The set currently does not support arbitrary ranges.
 func newBucketBlockSet(lset labels.Labels) *bucketBlockSet {
@@ -1193,6 +1791,19 @@ func (s *bucketBlockSet) remove(id ulid.ULID) {
 	}
 }
 
+// empty returns true if the set has no blocks of any resolution.
+func (s *bucketBlockSet) empty() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, bs := range s.blocks {
+		if len(bs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func int64index(s []int64, x int64) int {
 	for i, v := range s {
 		if v == x {
@@ -1208,10 +1819,6 @@ func int64index(s []int64, x int64) int {
 //
 // NOTE: s.blocks are expected to be sorted in minTime order.
 func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64, blockMatchers []*labels.Matcher) (bs []*bucketBlock) {
-	if mint > maxt {
-		return nil
-	}
-
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
@@ -1219,6 +1826,35 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64, blockMatc
 	i := 0
 	for ; i < len(s.resolutions) && s.resolutions[i] > maxResolutionMillis; i++ {
 	}
+	return s.getForFn(mint, maxt, i, func(*bucketBlock) bool { return true }, blockMatchers)
+}
+
+// getForAge works like getFor, but blocks with resolution bigger than the given max resolution are returned as well if
+// they are older than the minimum age of one of given auto resolutions not smaller than their resolution. Too young
+// blocks are treated as missing, so that the time range they cover is filled with blocks of smaller resolution.
+func (s *bucketBlockSet) getForAge(mint, maxt, maxResolutionMillis int64, autoResolutions []AutoResolution, now int64, blockMatchers []*labels.Matcher) (bs []*bucketBlock) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.getForFn(mint, maxt, 0, func(b *bucketBlock) bool {
+		if b.meta.Thanos.Downsample.Resolution <= maxResolutionMillis {
+			return true
+		}
+		for _, r := range autoResolutions {
+			if b.meta.Thanos.Downsample.Resolution <= r.Resolution && now-b.meta.MaxTime >= r.MinAge.Milliseconds() {
+				return true
+			}
+		}
+		return false
+	}, blockMatchers)
+}
+
+// getForFn returns a time-ordered list of allowed blocks that cover date between mint and maxt, preferring blocks
+// with the biggest resolution, starting with the i-th one.
+func (s *bucketBlockSet) getForFn(mint, maxt int64, i int, allowed func(*bucketBlock) bool, blockMatchers []*labels.Matcher) (bs []*bucketBlock) {
+	if mint > maxt || i >= len(s.blocks) {
+		return nil
+	}
 
 	// Fill the given interval with the blocks for the current resolution.
 	// Our current resolution might not cover all data, so recursively fill the gaps with higher resolution blocks
@@ -1232,11 +1868,12 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64, blockMatc
 		if b.meta.MinTime > maxt {
 			break
 		}
-
-		if i+1 < len(s.resolutions) {
-			bs = append(bs, s.getFor(start, b.meta.MinTime-1, s.resolutions[i+1], blockMatchers)...)
+		if !allowed(b) {
+			continue
 		}
 
+		bs = append(bs, s.getForFn(start, b.meta.MinTime-1, i+1, allowed, blockMatchers)...)
+
 		// Include the block in the list of matching ones only if there are no block-level matchers
 		// or they actually match.
 		if len(blockMatchers) == 0 || b.matchRelabelLabels(blockMatchers) {
@@ -1246,9 +1883,7 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64, blockMatc
 		start = b.meta.MaxTime
 	}
 
-	if i+1 < len(s.resolutions) {
-		bs = append(bs, s.getFor(start, maxt, s.resolutions[i+1], blockMatchers)...)
-	}
+	bs = append(bs, s.getForFn(start, maxt, i+1, allowed, blockMatchers)...)
 	return bs
 }
 
@@ -1291,6 +1926,9 @@ type bucketBlock struct {
 
 	enablePostingsCompression bool
 
+	// postingsCache, if not nil, caches series of the block matching matchers.
+	postingsCache *ExpandedPostingsCache
+
 	// Block's labels used by block-level matchers to filter blocks to query. These are used to select blocks using
 	// request hints' BlockMatchers.
 	relabelLabels labels.Labels
@@ -1440,14 +2078,18 @@ type bucketIndexReader struct {
 	dec   *index.Decoder
 	stats *queryStats
 
+	// noCache skips lookups of the index and expanded postings caches, which are still populated.
+	noCache bool
+
 	mtx          sync.Mutex
 	loadedSeries map[uint64][]byte
 }
 
 func newBucketIndexReader(ctx context.Context, block *bucketBlock) *bucketIndexReader {
 	r := &bucketIndexReader{
-		ctx:   ctx,
-		block: block,
+		ctx:     ctx,
+		block:   block,
+		noCache: isNoCacheRequest(ctx),
 		dec: &index.Decoder{
 			LookupSymbol: block.indexHeaderReader.LookupSymbol,
 		},
@@ -1466,7 +2108,27 @@ func newBucketIndexReader(ctx context.Context, block *bucketBlock) *bucketIndexR
 // Reminder: A posting is a reference (represented as a uint64) to a series reference, which in turn points to the first
 // chunk where the series contains the matching label-value pair for a given block of data. Postings can be fetched by
 // single label name=value.
+//
+// If the block has expanded postings cache, returned postings can be shared with other requests and must not be modified.
 func (r *bucketIndexReader) ExpandedPostings(ms []*labels.Matcher) ([]uint64, error) {
+	c := r.block.postingsCache
+	if c == nil {
+		return r.expandedPostings(ms)
+	}
+	if !r.noCache {
+		if ps, ok := c.Get(r.block.meta.ULID, ms); ok {
+			return ps, nil
+		}
+	}
+	ps, err := r.expandedPostings(ms)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(r.block.meta.ULID, ms, ps)
+	return ps, nil
+}
+
+func (r *bucketIndexReader) expandedPostings(ms []*labels.Matcher) ([]uint64, error) {
 	var (
 		postingGroups []*postingGroup
 		allRequested  = false
@@ -1655,7 +2317,10 @@ func (r *bucketIndexReader) fetchPostings(keys []labels.Label) ([]index.Postings
 	output := make([]index.Postings, len(keys))
 
 	// Fetch postings from the cache with a single call.
-	fromCache, _ := r.block.indexCache.FetchMultiPostings(r.ctx, r.block.meta.ULID, keys)
+	var fromCache map[labels.Label][]byte
+	if !r.noCache {
+		fromCache, _ = r.block.indexCache.FetchMultiPostings(r.ctx, r.block.meta.ULID, keys)
+	}
 
 	// Iterate over all groups and fetch posting from cache.
 	// If we have a miss, mark key to be fetched in `ptrs` slice.
@@ -1872,9 +2537,12 @@ func (r *bucketIndexReader) PreloadSeries(ids []uint64) error {
 
 	// Load series from cache, overwriting the list of ids to preload
 	// with the missing ones.
-	fromCache, ids := r.block.indexCache.FetchMultiSeries(r.ctx, r.block.meta.ULID, ids)
-	for id, b := range fromCache {
-		r.loadedSeries[id] = b
+	if !r.noCache {
+		var fromCache map[uint64][]byte
+		fromCache, ids = r.block.indexCache.FetchMultiSeries(r.ctx, r.block.meta.ULID, ids)
+		for id, b := range fromCache {
+			r.loadedSeries[id] = b
+		}
 	}
 
 	parts := r.block.partitioner.Partition(len(ids), func(i int) (start, end uint64) {
@@ -2043,11 +2711,13 @@ func (r *bucketChunkReader) addPreload(id uint64) error {
 	return nil
 }
 
-// preload all added chunk IDs. Must be called before the first call to Chunk is made.
+// preload all chunk IDs added since the previous preload. Must be called before Chunk is called for these IDs.
 func (r *bucketChunkReader) preload() error {
 	g, ctx := errgroup.WithContext(r.ctx)
 
 	for seq, offsets := range r.preloads {
+		r.preloads[seq] = nil
+
 		sort.Slice(offsets, func(i, j int) bool {
 			return offsets[i] < offsets[j]
 		})
@@ -2229,6 +2899,10 @@ type queryStats struct {
 	mergedSeriesCount int
 	mergedChunksCount int
 	mergeDuration     time.Duration
+	// responseSizeSum is the size of series sent in response.
+	responseSizeSum int64
+
+	labelValueGuardedSeries int
 }
 
 func (s queryStats) merge(o *queryStats) *queryStats {
@@ -2269,5 +2943,7 @@ func (s queryStats) merge(o *queryStats) *queryStats {
 	s.mergedChunksCount += o.mergedChunksCount
 	s.mergeDuration += o.mergeDuration
 
+	s.labelValueGuardedSeries += o.labelValueGuardedSeries
+
 	return &s
 }
@@ -4,26 +4,36 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/types"
 	"github.com/oklog/ulid"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"google.golang.org/grpc/codes"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/objtesting"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
+	"github.com/thanos-io/thanos/pkg/store/hintspb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
@@ -199,6 +209,14 @@ func testBucketStore_e2e(t *testing.T, ctx context.Context, s *storeSuite) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, []string{"1", "2"}, vals.Values)
 
+	srv := newStoreLabelValuesStreamServer(ctx)
+	testutil.Ok(t, s.store.LabelValuesStream(&storepb.LabelValuesRequest{
+		Label: "a",
+		Start: timestamp.FromTime(minTime),
+		End:   timestamp.FromTime(maxTime),
+	}, srv))
+	testutil.Equals(t, []string{"1", "2"}, srv.Values)
+
 	// TODO(bwplotka): Add those test cases to TSDB querier_test.go as well, there are no tests for matching.
 	for i, tcase := range []struct {
 		req              *storepb.SeriesRequest
@@ -552,6 +570,67 @@ func TestBucketStore_TimePartitioning_e2e(t *testing.T) {
 	}
 }
 
+// hitCountingCache counts items served by the index cache.
+type hitCountingCache struct {
+	storecache.IndexCache
+
+	hits int
+}
+
+func (c *hitCountingCache) FetchMultiPostings(ctx context.Context, blockID ulid.ULID, keys []labels.Label) (map[labels.Label][]byte, []labels.Label) {
+	hits, misses := c.IndexCache.FetchMultiPostings(ctx, blockID, keys)
+	c.hits += len(hits)
+	return hits, misses
+}
+
+func (c *hitCountingCache) FetchMultiSeries(ctx context.Context, blockID ulid.ULID, ids []uint64) (map[uint64][]byte, []uint64) {
+	hits, misses := c.IndexCache.FetchMultiSeries(ctx, blockID, ids)
+	c.hits += len(hits)
+	return hits, misses
+}
+
+func TestBucketStore_Series_NoCache_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+
+	dir, err := ioutil.TempDir("", "test_bucket_nocache_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(s.logger, nil, storecache.InMemoryIndexCacheConfig{
+		MaxItemSize: 1e5,
+		MaxSize:     2e5,
+	})
+	testutil.Ok(t, err)
+	cache := &hitCountingCache{IndexCache: indexCache}
+	s.cache.SwapWith(cache)
+
+	series := func(ctx context.Context) int {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, s.store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:  s.minTime,
+			MaxTime:  s.maxTime,
+		}, srv))
+		return len(srv.SeriesSet)
+	}
+	noCacheCtx := grpcmetadata.NewIncomingContext(ctx, grpcmetadata.Pairs(NoCacheMetadataKey, "true"))
+
+	// Requests skipping caches still populate them.
+	testutil.Equals(t, 4, series(noCacheCtx))
+	testutil.Equals(t, 0, cache.hits)
+
+	testutil.Equals(t, 4, series(ctx))
+	hits := cache.hits
+	testutil.Assert(t, hits > 0, "expected index cache hits")
+
+	// Cached items are read from the bucket again.
+	testutil.Equals(t, 4, series(noCacheCtx))
+	testutil.Equals(t, hits, cache.hits)
+}
+
 func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 	// The query will fetch 2 series from 6 blocks, so we do expect to hit a total of 12 chunks.
 	expectedChunks := uint64(2 * 6)
@@ -599,11 +678,383 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 			} else {
 				testutil.NotOk(t, err)
 				testutil.Assert(t, strings.Contains(err.Error(), testData.expectedErr))
+				testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
 			}
 		})
 	}
 }
 
+func TestBucketStore_Series_ResponseBudget_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+
+	dir, err := ioutil.TempDir("", "test_bucket_response_budget_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	testutil.Ok(t, s.store.SyncBlocks(ctx))
+	s.cache.SwapWith(noopCache{})
+
+	series := func(t *testing.T, partialResponseDisabled bool) (*storeSeriesServer, error) {
+		srv := newStoreSeriesServer(ctx)
+		err := s.store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_RE, Name: "a", Value: "1|2"},
+			},
+			MinTime:                 minTimeDuration.PrometheusTimestamp(),
+			MaxTime:                 maxTimeDuration.PrometheusTimestamp(),
+			PartialResponseDisabled: partialResponseDisabled,
+		}, srv)
+		return srv, err
+	}
+
+	// Chunks of sent series are reused by further calls, so only their labels and sizes are compared.
+	seriesLabels := func(srv *storeSeriesServer) (lsets []labels.Labels, sizes []int) {
+		for _, s := range srv.SeriesSet {
+			lsets = append(lsets, s.PromLabels().Copy())
+			sizes = append(sizes, s.Size())
+		}
+		return lsets, sizes
+	}
+
+	all, err := series(t, false)
+	testutil.Ok(t, err)
+	allLsets, allSizes := seriesLabels(all)
+	testutil.Assert(t, len(allLsets) > 2, "expected more than 2 series, got %d", len(allLsets))
+	testutil.Equals(t, 0, len(all.Warnings))
+
+	t.Run("within budget", func(t *testing.T) {
+		var size int64
+		for _, sz := range allSizes {
+			size += int64(sz)
+		}
+		s.store.SetResponseBudget(size)
+		defer s.store.SetResponseBudget(0)
+
+		srv, err := series(t, false)
+		testutil.Ok(t, err)
+		lsets, sizes := seriesLabels(srv)
+		testutil.Equals(t, allLsets, lsets)
+		testutil.Equals(t, allSizes, sizes)
+		testutil.Equals(t, 0, len(srv.Warnings))
+	})
+	t.Run("exceeded with partial response", func(t *testing.T) {
+		// The budget is soft, the series exceeding it is still sent whole.
+		s.store.SetResponseBudget(int64(allSizes[0] + allSizes[1]/2))
+		defer s.store.SetResponseBudget(0)
+
+		srv, err := series(t, false)
+		testutil.Ok(t, err)
+		lsets, sizes := seriesLabels(srv)
+		testutil.Equals(t, allLsets[:2], lsets)
+		testutil.Equals(t, allSizes[:2], sizes)
+		testutil.Equals(t, 1, len(srv.Warnings))
+		testutil.Assert(t, strings.Contains(srv.Warnings[0], "response budget exceeded"), "unexpected warning %s", srv.Warnings[0])
+	})
+	t.Run("exceeded without partial response", func(t *testing.T) {
+		s.store.SetResponseBudget(1)
+		defer s.store.SetResponseBudget(0)
+
+		_, err := series(t, true)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "response budget exceeded"), "unexpected error %v", err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+	})
+}
+
+func TestBucketStore_EvictBlock_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+
+	dir, err := ioutil.TempDir("", "test_bucket_evict_block_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	testutil.Ok(t, s.store.SyncBlocks(ctx))
+	testutil.Equals(t, 6, len(s.store.blocks))
+	s.cache.SwapWith(noopCache{})
+
+	req := &storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+		MinTime:  minTimeDuration.PrometheusTimestamp(),
+		MaxTime:  maxTimeDuration.PrometheusTimestamp(),
+	}
+	countChunks := func(srv *storeSeriesServer) (chunks int) {
+		for _, series := range srv.SeriesSet {
+			chunks += len(series.Chunks)
+		}
+		return chunks
+	}
+
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+	testutil.Equals(t, 2*6, countChunks(srv))
+
+	var id ulid.ULID
+	for id = range s.store.blocks {
+		break
+	}
+
+	loaded, err := s.store.EvictBlock(id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, loaded, "expected block to be loaded")
+	testutil.Equals(t, []ulid.ULID{id}, s.store.EvictedBlocks())
+	testutil.Assert(t, s.store.getBlock(id) == nil, "expected block to be evicted")
+
+	// Evicted block is neither queried nor loaded again on sync.
+	testutil.Ok(t, s.store.SyncBlocks(ctx))
+	testutil.Assert(t, s.store.getBlock(id) == nil, "expected evicted block not to be loaded")
+
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req, srv))
+	testutil.Equals(t, 1, len(srv.Warnings))
+	testutil.Assert(t, strings.Contains(srv.Warnings[0], id.String()), "expected warning about evicted block, got %v", srv.Warnings)
+	testutil.Equals(t, 2*5, countChunks(srv))
+
+	// Requests not touching the evicted block are not warned.
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(&storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+		MinTime:  0,
+		MaxTime:  s.minTime - 1,
+	}, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+
+	loaded, err = s.store.EvictBlock(id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !loaded, "expected block not to be loaded")
+
+	testutil.Assert(t, s.store.RestoreBlock(id), "expected block to be restored")
+	testutil.Assert(t, !s.store.RestoreBlock(id), "expected block not to be evicted anymore")
+	testutil.Equals(t, []ulid.ULID{}, s.store.EvictedBlocks())
+	testutil.Ok(t, s.store.SyncBlocks(ctx))
+
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+	testutil.Equals(t, 2*6, countChunks(srv))
+}
+
+func TestBucketStore_BlockGapWarnings_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+
+	dir, err := ioutil.TempDir("", "test_bucket_block_gap_warnings_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	s.cache.SwapWith(noopCache{})
+
+	req := func(mint, maxt int64) *storepb.SeriesRequest {
+		return &storepb.SeriesRequest{
+			Matchers:         []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:          mint,
+			MaxTime:          maxt,
+			WarnCoverageGaps: true,
+		}
+	}
+
+	// Ranges outside of blocks are not reported by the store, only gaps between its blocks.
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req(0, math.MaxInt64), srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+
+	// Delete blocks of the middle time slot, as if they were lost.
+	gapMint, gapMaxt := s.minTime+2*time.Hour.Milliseconds(), s.minTime+4*time.Hour.Milliseconds()
+	for id, b := range s.store.blocks {
+		if b.meta.MinTime == gapMint {
+			testutil.Ok(t, block.Delete(ctx, log.NewNopLogger(), bkt, id))
+		}
+	}
+	testutil.Ok(t, s.store.SyncBlocks(ctx))
+	testutil.Equals(t, 4, len(s.store.blocks))
+
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req(s.minTime, s.maxTime), srv))
+	testutil.Equals(t, []string{
+		fmt.Sprintf("no blocks of the requested resolution cover time range %s of the query: data in this range was compacted away, deleted or failed to load", timeRange{mint: gapMint, maxt: gapMaxt - 1}),
+	}, srv.Warnings)
+	testutil.Equals(t, 4, len(srv.SeriesSet))
+
+	// Gaps are not reported unless requested.
+	r := req(s.minTime, s.maxTime)
+	r.WarnCoverageGaps = false
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(r, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+	testutil.Equals(t, 4, len(srv.SeriesSet))
+
+	// Requests not touching the gap are not warned.
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req(s.minTime, gapMint-1), srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+
+	// Gaps of blocks filtered out by block matchers on purpose are not reported.
+	hints, err := types.MarshalAny(&hintspb.SeriesRequestHints{
+		BlockMatchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext1", Value: "value1"}},
+	})
+	testutil.Ok(t, err)
+	r = req(s.minTime, s.maxTime)
+	r.Hints = hints
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(r, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+}
+
+func TestBucketStore_CompactedBlockReplacement_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "test_bucket_compacted_block_replacement_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	blocksDir, storeDir := filepath.Join(dir, "blocks"), filepath.Join(dir, "store")
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	extLset := labels.FromStrings("ext1", "value1")
+	mint := timestamp.FromTime(time.Now().Add(-4 * time.Hour))
+	maxt := mint + 4*time.Hour.Milliseconds()
+
+	// Two source blocks and the block they were compacted into.
+	srcID1, err := e2eutil.CreateBlock(ctx, blocksDir, series, 10, mint, mint+2*time.Hour.Milliseconds(), extLset, 0)
+	testutil.Ok(t, err)
+	srcID2, err := e2eutil.CreateBlock(ctx, blocksDir, series, 10, mint+2*time.Hour.Milliseconds(), maxt, extLset, 0)
+	testutil.Ok(t, err)
+	compactedID, err := e2eutil.CreateBlock(ctx, blocksDir, series, 20, mint, maxt, extLset, 0)
+	testutil.Ok(t, err)
+
+	compactedDir := filepath.Join(blocksDir, compactedID.String())
+	meta, err := metadata.Read(compactedDir)
+	testutil.Ok(t, err)
+	meta.Compaction.Level = 2
+	meta.Compaction.Sources = []ulid.ULID{srcID1, srcID2}
+	testutil.Ok(t, metadata.Write(logger, compactedDir, meta))
+
+	for _, id := range []ulid.ULID{srcID1, srcID2} {
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(blocksDir, id.String())))
+	}
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	fetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), storeDir, nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, objstore.WithNoopInstr(bkt), fetcher, storeDir, noopCache{}, nil, 0, NewChunksLimiterFactory(0), false, 20, allowAllFilterConf, true, true, DefaultPostingOffsetInMemorySampling, true)
+	testutil.Ok(t, err)
+	store.SetDuplicateBlocksFilter(duplicateBlocksFilter)
+	defer func() { testutil.Ok(t, store.Close()) }()
+
+	// Queried data has to cover the whole time range at any point of the compaction.
+	expectContinuousData := func(t *testing.T) {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:  mint,
+			MaxTime:  maxt,
+		}, srv))
+		testutil.Equals(t, 1, len(srv.SeriesSet))
+
+		chks := srv.SeriesSet[0].Chunks
+		testutil.Assert(t, len(chks) > 0, "expected chunks")
+		sort.Slice(chks, func(i, j int) bool { return chks[i].MinTime < chks[j].MinTime })
+		testutil.Equals(t, mint, chks[0].MinTime)
+		last := chks[0].MaxTime
+		for _, c := range chks[1:] {
+			testutil.Assert(t, c.MinTime <= last+time.Hour.Milliseconds(), "gap between %d and %d", last, c.MinTime)
+			if c.MaxTime > last {
+				last = c.MaxTime
+			}
+		}
+		testutil.Assert(t, last >= maxt-time.Hour.Milliseconds(), "data missing after %d", last)
+	}
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 2, len(store.blocks))
+	expectContinuousData(t)
+
+	// Compacted block is uploaded, but cannot be loaded yet. Source blocks have to be still served.
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, compactedDir))
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(compactedID.String(), block.IndexFilename)))
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Assert(t, store.getBlock(compactedID) == nil, "expected compacted block not to be loaded")
+	testutil.Assert(t, store.getBlock(srcID1) != nil && store.getBlock(srcID2) != nil, "expected source blocks to be kept")
+	expectContinuousData(t)
+
+	// Once the compacted block is loaded, source blocks are dropped.
+	testutil.Ok(t, objstore.UploadFile(ctx, logger, bkt, filepath.Join(compactedDir, block.IndexFilename), filepath.Join(compactedID.String(), block.IndexFilename)))
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 1, len(store.blocks))
+	testutil.Assert(t, store.getBlock(compactedID) != nil, "expected compacted block to be loaded")
+	expectContinuousData(t)
+}
+
+func TestBucketStore_BlockVerification_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "test_bucket_block_verification_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	blocksDir, storeDir := filepath.Join(dir, "blocks"), filepath.Join(dir, "store")
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+	extLset := labels.FromStrings("ext1", "value1")
+
+	healthyID, err := e2eutil.CreateBlock(ctx, blocksDir, series, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+	corruptedID, err := e2eutil.CreateBlock(ctx, blocksDir, series, 100, 1000, 2000, extLset, 0)
+	testutil.Ok(t, err)
+	for _, id := range []ulid.ULID{healthyID, corruptedID} {
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(blocksDir, id.String())))
+	}
+
+	// Corrupt chunk data in the middle of the segment file, which would otherwise surface only when queried.
+	segment := filepath.Join(corruptedID.String(), block.ChunksDirname, "000001")
+	r, err := bkt.Get(ctx, segment)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	b[len(b)/2] ^= 0xff
+	testutil.Ok(t, bkt.Upload(ctx, segment, bytes.NewReader(b)))
+
+	fetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), storeDir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, objstore.WithNoopInstr(bkt), fetcher, storeDir, noopCache{}, nil, 0, NewChunksLimiterFactory(0), false, 20, allowAllFilterConf, true, true, DefaultPostingOffsetInMemorySampling, true)
+	testutil.Ok(t, err)
+	store.SetBlockVerification(block.VerificationFull)
+	defer func() { testutil.Ok(t, store.Close()) }()
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Assert(t, store.getBlock(healthyID) != nil, "expected healthy block to be loaded")
+	testutil.Assert(t, store.getBlock(corruptedID) == nil, "expected corrupted block not to be loaded")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.blockVerifyFailures))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.blockLoadFailures))
+
+	// Corrupted block is not verified again.
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.metrics.blockLoads))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.blockVerifyFailures))
+
+	// Corrupted block is forgotten once deleted from the bucket.
+	testutil.Ok(t, block.Delete(ctx, logger, bkt, corruptedID))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Assert(t, !store.isCorrupted(corruptedID), "expected deleted block to be forgotten")
+}
+
 func TestBucketStore_LabelNames_e2e(t *testing.T) {
 	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -659,6 +1110,49 @@ func TestBucketStore_LabelValues_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		testutil.Equals(t, []string{"1", "2"}, vals.Values)
 
+		// Scoped by matchers, including block's external labels.
+		s.cache.SwapWith(noopCache{})
+		for _, tcase := range []struct {
+			label    string
+			matchers []storepb.LabelMatcher
+			expected []string
+		}{
+			{
+				label:    "b",
+				matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "2"}},
+				expected: []string{"1", "2"},
+			},
+			{
+				label:    "b",
+				matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "c", Value: "1"}},
+				expected: []string{},
+			},
+			{
+				label:    "a",
+				matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "c", Value: "1"}, {Type: storepb.LabelMatcher_EQ, Name: "ext2", Value: "value2"}},
+				expected: []string{"1", "2"},
+			},
+			{
+				label:    "a",
+				matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "1"}, {Type: storepb.LabelMatcher_EQ, Name: "ext2", Value: "value2"}},
+				expected: []string{},
+			},
+			{
+				label:    "ext2",
+				matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "c", Value: "2"}},
+				expected: []string{"value2"},
+			},
+		} {
+			vals, err = s.store.LabelValues(ctx, &storepb.LabelValuesRequest{
+				Label:    tcase.label,
+				Start:    timestamp.FromTime(minTime),
+				End:      timestamp.FromTime(maxTime),
+				Matchers: tcase.matchers,
+			})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, vals.Values)
+		}
+
 		// Outside the time range.
 		vals, err = s.store.LabelValues(ctx, &storepb.LabelValuesRequest{
 			Label: "a",
@@ -18,8 +18,10 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gogo/protobuf/proto"
@@ -35,6 +37,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"go.uber.org/atomic"
+	grpcmetadata "google.golang.org/grpc/metadata"
 
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/indexheader"
@@ -392,6 +395,100 @@ func TestBucketBlockSet_addGet(t *testing.T) {
 	}
 }
 
+func TestBucketBlockSet_getForAge(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	set := newBucketBlockSet(labels.Labels{})
+
+	type resBlock struct {
+		window     int64
+		mint, maxt int64
+	}
+	input := []resBlock{
+		{window: downsample.ResLevel0, mint: 0, maxt: 100},
+		{window: downsample.ResLevel0, mint: 100, maxt: 200},
+		{window: downsample.ResLevel0, mint: 200, maxt: 300},
+		{window: downsample.ResLevel0, mint: 300, maxt: 400},
+		{window: downsample.ResLevel1, mint: 0, maxt: 100},
+		{window: downsample.ResLevel1, mint: 100, maxt: 200},
+		{window: downsample.ResLevel1, mint: 200, maxt: 300},
+		{window: downsample.ResLevel2, mint: 0, maxt: 100},
+		{window: downsample.ResLevel2, mint: 100, maxt: 200},
+	}
+	for _, in := range input {
+		var m metadata.Meta
+		m.Thanos.Downsample.Resolution = in.window
+		m.MinTime = in.mint
+		m.MaxTime = in.maxt
+
+		testutil.Ok(t, set.add(&bucketBlock{meta: &m}))
+	}
+
+	// Blocks ending 250ms ago or earlier are served in 1h resolution, ending 150ms ago or earlier in 5m resolution.
+	autoResolutions := []AutoResolution{
+		{Resolution: downsample.ResLevel2, MinAge: 250 * time.Millisecond},
+		{Resolution: downsample.ResLevel1, MinAge: 150 * time.Millisecond},
+	}
+	const now = 400
+
+	for _, c := range []struct {
+		name          string
+		mint, maxt    int64
+		maxResolution int64
+		res           []resBlock
+	}{
+		{
+			name:          "raw requested",
+			mint:          0,
+			maxt:          400,
+			maxResolution: 0,
+			res: []resBlock{
+				{window: downsample.ResLevel2, mint: 0, maxt: 100},
+				{window: downsample.ResLevel1, mint: 100, maxt: 200},
+				{window: downsample.ResLevel0, mint: 200, maxt: 300},
+				{window: downsample.ResLevel0, mint: 300, maxt: 400},
+			},
+		}, {
+			name:          "5m requested",
+			mint:          0,
+			maxt:          400,
+			maxResolution: downsample.ResLevel1,
+			res: []resBlock{
+				{window: downsample.ResLevel2, mint: 0, maxt: 100},
+				{window: downsample.ResLevel1, mint: 100, maxt: 200},
+				{window: downsample.ResLevel1, mint: 200, maxt: 300},
+				{window: downsample.ResLevel0, mint: 300, maxt: 400},
+			},
+		}, {
+			name:          "recent part only",
+			mint:          150,
+			maxt:          400,
+			maxResolution: 0,
+			res: []resBlock{
+				{window: downsample.ResLevel1, mint: 100, maxt: 200},
+				{window: downsample.ResLevel0, mint: 200, maxt: 300},
+				{window: downsample.ResLevel0, mint: 300, maxt: 400},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var exp []*bucketBlock
+			for _, b := range c.res {
+				var m metadata.Meta
+				m.Thanos.Downsample.Resolution = b.window
+				m.MinTime = b.mint
+				m.MaxTime = b.maxt
+				exp = append(exp, &bucketBlock{meta: &m})
+			}
+			testutil.Equals(t, exp, set.getForAge(c.mint, c.maxt, c.maxResolution, autoResolutions, now, nil))
+		})
+	}
+
+	// Without auto resolutions, blocks are chosen as with the requested resolution only.
+	testutil.Equals(t, set.getFor(0, 400, 0, nil), set.getForAge(0, 400, 0, nil, now, nil))
+	testutil.Equals(t, set.getFor(0, 400, downsample.ResLevel1, nil), set.getForAge(0, 400, downsample.ResLevel1, nil, now, nil))
+}
+
 func TestBucketBlockSet_remove(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
 
@@ -1710,6 +1807,428 @@ func TestSeries_ErrorUnmarshallingRequestHints(t *testing.T) {
 	testutil.Equals(t, true, regexp.MustCompile(".*unmarshal series request hints.*").MatchString(err.Error()))
 }
 
+func TestSeries_TailOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-series-tail-only")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+
+	// Head chunks are cut at least every 100ms, so the dense series has many samples per chunk and the sparse one just 2.
+	h, err := tsdb.NewHead(nil, nil, nil, 100, filepath.Join(tmpDir, "head"), nil, tsdb.DefaultStripeSize, nil)
+	testutil.Ok(t, err)
+	app := h.Appender(context.Background())
+	for ts := int64(0); ts < 1000; ts++ {
+		_, err := app.Add(labels.FromStrings("a", "dense"), ts, float64(ts))
+		testutil.Ok(t, err)
+		if ts%50 == 0 {
+			_, err := app.Add(labels.FromStrings("a", "sparse"), ts, float64(ts))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	id := createBlockFromHead(t, bktDir, h)
+	testutil.Ok(t, h.Close())
+	_, err = metadata.InjectThanos(logger, filepath.Join(bktDir, id.String()), metadata.Thanos{
+		Labels:     labels.Labels{{Name: "ext1", Value: "1"}}.Map(),
+		Downsample: metadata.ThanosDownsample{Resolution: 0},
+		Source:     metadata.TestSource,
+	}, nil)
+	testutil.Ok(t, err)
+
+	instrBkt := objstore.WithNoopInstr(bkt)
+	fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, tmpDir, nil, nil, nil)
+	testutil.Ok(t, err)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+	testutil.Ok(t, err)
+	store, err := NewBucketStore(logger, nil, instrBkt, fetcher, tmpDir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(context.Background()))
+
+	series := func(t *testing.T, req *storepb.SeriesRequest) map[string][]storepb.AggrChunk {
+		srv := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, store.Series(req, srv))
+
+		res := map[string][]storepb.AggrChunk{}
+		for _, s := range srv.SeriesSet {
+			res[s.PromLabels().Get("a")] = s.Chunks
+		}
+		return res
+	}
+	req := func(mint, maxt int64, tailOnly bool) *storepb.SeriesRequest {
+		return &storepb.SeriesRequest{
+			MinTime:  mint,
+			MaxTime:  maxt,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			TailOnly: tailOnly,
+		}
+	}
+
+	full := series(t, req(0, 999, false))
+	testutil.Assert(t, len(full["dense"]) > 1, "expected multiple chunks of dense series")
+	testutil.Equals(t, 10, len(full["sparse"]))
+	testutil.Equals(t, 2, numSamples(full["sparse"][9:]))
+
+	// Tail-only requests are served in full until the threshold is set.
+	testutil.Equals(t, full, series(t, req(0, 999, true)))
+
+	store.SetTailChunksMinSamples(10)
+	t.Run("dense series are trimmed to the tail chunk", func(t *testing.T) {
+		res := series(t, req(0, 999, true))
+		testutil.Equals(t, full["dense"][len(full["dense"])-1:], res["dense"])
+		testutil.Assert(t, numSamples(res["dense"]) >= 10, "expected at least 10 samples in tail of dense series")
+	})
+	t.Run("sparse series are returned in full within the requested range", func(t *testing.T) {
+		testutil.Equals(t, full["sparse"], series(t, req(0, 999, true))["sparse"])
+		testutil.Equals(t, full["sparse"][7:], series(t, req(720, 999, true))["sparse"])
+	})
+	t.Run("tail is not newer than requested max time", func(t *testing.T) {
+		res := series(t, req(0, 520, true))
+		testutil.Equals(t, int64(500), res["sparse"][len(res["sparse"])-1].MinTime)
+		testutil.Assert(t, res["dense"][0].MinTime <= 520 && res["dense"][0].MaxTime >= 520, "expected tail of dense series to contain max time, got %v", res["dense"])
+		testutil.Equals(t, 1, len(res["dense"]))
+	})
+	t.Run("regular requests are not trimmed", func(t *testing.T) {
+		testutil.Equals(t, full, series(t, req(0, 999, false)))
+	})
+}
+
+func TestSeries_ChunkSources(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-series-chunk-sources")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+	extLset := labels.Labels{{Name: "ext1", Value: "1"}}
+
+	// Series a=1 is in both blocks, while a=2 and a=3 are in a single block each.
+	id1, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+	id2, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "3"),
+	}, 100, 1000, 2000, extLset, 0)
+	testutil.Ok(t, err)
+
+	instrBkt := objstore.WithNoopInstr(bkt)
+	fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, tmpDir, nil, nil, nil)
+	testutil.Ok(t, err)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+	testutil.Ok(t, err)
+	store, err := NewBucketStore(logger, nil, instrBkt, fetcher, tmpDir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	series := func(t *testing.T, chunkSources bool) map[string][]string {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			MinTime:      0,
+			MaxTime:      2000,
+			Matchers:     []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			ChunkSources: chunkSources,
+		}, srv))
+
+		// Blocks of chunks of each series, in order and without repetitions.
+		res := map[string][]string{}
+		for _, s := range srv.SeriesSet {
+			a := s.PromLabels().Get("a")
+			res[a] = []string{}
+			for _, c := range s.Chunks {
+				if c.Source == nil {
+					continue
+				}
+				testutil.Equals(t, "", c.Source.Store)
+				if blocks := res[a]; len(blocks) == 0 || blocks[len(blocks)-1] != c.Source.BlockId {
+					res[a] = append(blocks, c.Source.BlockId)
+				}
+			}
+		}
+		return res
+	}
+
+	testutil.Equals(t, map[string][]string{
+		"1": {id1.String(), id2.String()},
+		"2": {id1.String()},
+		"3": {id2.String()},
+	}, series(t, true))
+	testutil.Equals(t, map[string][]string{"1": {}, "2": {}, "3": {}}, series(t, false))
+}
+
+// idsMetadataSource discovers only the given blocks of the wrapped source.
+type idsMetadataSource struct {
+	block.MetadataSource
+
+	ids []ulid.ULID
+}
+
+func (s *idsMetadataSource) Iter(_ context.Context, f func(id ulid.ULID) error) error {
+	for _, id := range s.ids {
+		if err := f(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBucketStore_MetadataSource(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-bucket-store-metadata-source")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+	extLset := labels.Labels{{Name: "ext1", Value: "1"}}
+
+	id1, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+	_, err = e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{labels.FromStrings("a", "2")}, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+
+	// Blocks are discovered from the source rather than by iterating over the bucket.
+	instrBkt := objstore.WithNoopInstr(bkt)
+	source := &idsMetadataSource{MetadataSource: block.NewBucketMetadataSource(logger, instrBkt), ids: []ulid.ULID{id1}}
+	baseFetcher, err := block.NewBaseFetcherWithSource(logger, 10, source, tmpDir, nil)
+	testutil.Ok(t, err)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+	testutil.Ok(t, err)
+	store, err := NewBucketStore(logger, nil, instrBkt, baseFetcher.NewMetaFetcher(nil, nil, nil), tmpDir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  1000,
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+	}, srv))
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, "1", srv.SeriesSet[0].PromLabels().Get("a"))
+}
+
+func TestBucketStore_RewrittenExternalLabels(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-bucket-store-rewritten-external-labels")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+
+	id, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, labels.FromStrings("team", "foo"), 0)
+	testutil.Ok(t, err)
+
+	// Stores read metadata through the bucket metadata source and cache it on disk, so that a store created with the
+	// same directory acts as a restarted one.
+	instrBkt := objstore.WithNoopInstr(bkt)
+	newStore := func(t *testing.T) *BucketStore {
+		fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, tmpDir, nil, nil, nil)
+		testutil.Ok(t, err)
+		indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+		testutil.Ok(t, err)
+		store, err := NewBucketStore(logger, nil, instrBkt, fetcher, tmpDir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+		testutil.Ok(t, err)
+		return store
+	}
+
+	series := func(t *testing.T, store *BucketStore) []labels.Labels {
+		testutil.Ok(t, store.SyncBlocks(ctx))
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  1000,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+		}, srv))
+		var lsets []labels.Labels
+		for _, s := range srv.SeriesSet {
+			lsets = append(lsets, s.PromLabels())
+		}
+		return lsets
+	}
+	store := newStore(t)
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1", "team", "foo")}, series(t, store))
+
+	cachedMetaDir := filepath.Join(tmpDir, "meta-syncer", id.String())
+	cached, err := metadata.Read(cachedMetaDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"team": "foo"}, cached.Thanos.Labels)
+
+	renameTeam, err := block.ParseRewriteRelabelConfig([]byte(`
+- action: replace
+  source_labels: [team]
+  regex: (.+)
+  target_label: squad
+- action: labeldrop
+  regex: team
+`))
+	testutil.Ok(t, err)
+	_, _, err = block.RewriteExternalLabels(ctx, logger, bkt, id, renameTeam, false)
+	testutil.Ok(t, err)
+
+	// A restarted store does not use the metadata cached on disk before the rewrite.
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1", "squad", "foo")}, series(t, newStore(t)))
+	cached, err = metadata.Read(cachedMetaDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"squad": "foo"}, cached.Thanos.Labels)
+
+	// A running store loads the block again with the rewritten external labels.
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1", "squad", "foo")}, series(t, store))
+	testutil.Equals(t, []storepb.LabelSet{{Labels: []storepb.Label{{Name: "squad", Value: "foo"}}}}, store.advLabelSets)
+}
+
+func TestBucketStore_SharedIndex(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-bucket-store-shared-index")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+	extLset := labels.Labels{{Name: "ext1", Value: "1"}}
+	instrBkt := objstore.WithNoopInstr(bkt)
+
+	// Index-headers are built into the shared directory once.
+	sharedDir := filepath.Join(tmpDir, "shared")
+	for _, lset := range []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")} {
+		id, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{lset}, 100, 0, 1000, extLset, 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, indexheader.WriteBinary(ctx, logger, instrBkt, id, filepath.Join(sharedDir, id.String(), block.IndexHeaderFilename)))
+	}
+	shared := indexheader.NewSharedDirIndex(sharedDir, DefaultPostingOffsetInMemorySampling)
+
+	var stores []*BucketStore
+	for i := 0; i < 2; i++ {
+		dir := filepath.Join(tmpDir, fmt.Sprintf("store-%d", i))
+		fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, dir, nil, nil, nil)
+		testutil.Ok(t, err)
+		indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+		testutil.Ok(t, err)
+		store, err := NewBucketStore(logger, nil, instrBkt, fetcher, dir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+		testutil.Ok(t, err)
+		store.SetSharedIndex(shared)
+		testutil.Ok(t, store.SyncBlocks(ctx))
+		stores = append(stores, store)
+	}
+	// Both stores use the same readers.
+	testutil.Equals(t, 2, shared.Opened())
+
+	for i, store := range stores {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  1000,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+		}, srv))
+		testutil.Equals(t, 2, len(srv.SeriesSet))
+
+		// No store builds its own index-headers.
+		headers, err := filepath.Glob(filepath.Join(tmpDir, fmt.Sprintf("store-%d", i), "*", block.IndexHeaderFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(headers))
+	}
+
+	// Readers are closed once no store uses them.
+	testutil.Ok(t, stores[0].Close())
+	testutil.Equals(t, 2, shared.Opened())
+	testutil.Ok(t, stores[1].Close())
+	testutil.Equals(t, 0, shared.Opened())
+}
+
+func TestBucketStore_ExpandedPostingsCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-bucket-store-postings-cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+	extLset := labels.Labels{{Name: "ext1", Value: "1"}}
+	instrBkt := objstore.WithNoopInstr(bkt)
+
+	id1, err := e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+
+	dir := filepath.Join(tmpDir, "store")
+	fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+	testutil.Ok(t, err)
+	store, err := NewBucketStore(logger, nil, instrBkt, fetcher, dir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+	testutil.Ok(t, err)
+	cache, err := NewExpandedPostingsCache(nil, time.Hour, 1024*1024)
+	testutil.Ok(t, err)
+	store.SetExpandedPostingsCache(cache)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	seriesCtx := ctx
+	series := func() []string {
+		srv := newStoreSeriesServer(seriesCtx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  1000,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+		}, srv))
+		var vals []string
+		for _, s := range srv.SeriesSet {
+			vals = append(vals, s.PromLabels().Get("a"))
+		}
+		return vals
+	}
+
+	testutil.Equals(t, []string{"1"}, series())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(cache.hits))
+	testutil.Equals(t, []string{"1"}, series())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cache.hits))
+
+	// Block is replaced, e.g. by compaction, with one holding more series.
+	_, err = e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}, 100, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Delete(ctx, logger, bkt, id1))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cache.invalidations))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(cache.currentBytes))
+
+	testutil.Equals(t, []string{"1", "2"}, series())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cache.hits))
+	testutil.Equals(t, []string{"1", "2"}, series())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cache.hits))
+
+	// Requests skipping caches don't look the cache up.
+	seriesCtx = grpcmetadata.NewIncomingContext(ctx, grpcmetadata.Pairs(NoCacheMetadataKey, "true"))
+	testutil.Equals(t, []string{"1", "2"}, series())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cache.hits))
+}
+
 func mustMarshalAny(pb proto.Message) *types.Any {
 	out, err := types.MarshalAny(pb)
 	if err != nil {
@@ -1872,3 +2391,67 @@ func createBlockWithOneSeriesWithStep(t testutil.TB, dir string, lbls labels.Lab
 
 	return createBlockFromHead(t, dir, h)
 }
+
+func TestBucketStore_LabelValueLengthGuard(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-bucket-store-label-value-guard")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bktDir := filepath.Join(tmpDir, "bkt")
+	bkt, err := filesystem.NewBucket(bktDir)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+	instrBkt := objstore.WithNoopInstr(bkt)
+
+	long := strings.Repeat("x", 100)
+	_, err = e2eutil.CreateBlock(ctx, bktDir, []labels.Labels{
+		labels.FromStrings("a", "1", "b", long+"1"),
+		labels.FromStrings("a", "1", "b", long+"2"),
+		// Sorts after the long values, but before them once they are truncated to 23 bytes followed by "~" and hash.
+		labels.FromStrings("a", "1", "b", strings.Repeat("x", 23)+"y"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		mode     LabelValueLengthMode
+		expected int
+	}{
+		{mode: LabelValueLengthTruncate, expected: 3},
+		{mode: LabelValueLengthReject, expected: 1},
+	} {
+		t.Run(string(tcase.mode), func(t *testing.T) {
+			dir := filepath.Join(tmpDir, string(tcase.mode))
+			fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, dir, nil, nil, nil)
+			testutil.Ok(t, err)
+			indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, storecache.InMemoryIndexCacheConfig{})
+			testutil.Ok(t, err)
+			store, err := NewBucketStore(logger, nil, instrBkt, fetcher, dir, indexCache, nil, 1000000, NewChunksLimiterFactory(0), false, 10, nil, false, true, DefaultPostingOffsetInMemorySampling, false)
+			testutil.Ok(t, err)
+			guard, err := NewLabelValueLengthGuard(nil, 40, tcase.mode)
+			testutil.Ok(t, err)
+			store.SetLabelValueLengthGuard(guard)
+			testutil.Ok(t, store.SyncBlocks(ctx))
+
+			srv := newStoreSeriesServer(ctx)
+			testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  1000,
+				Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			}, srv))
+			testutil.Equals(t, tcase.expected, len(srv.SeriesSet))
+			testutil.Equals(t, []string{guard.Warning(2)}, srv.Warnings)
+
+			for i, s := range srv.SeriesSet {
+				for _, l := range s.Labels {
+					testutil.Assert(t, len(l.Value) <= 40, "expected label value within limit, got %d bytes", len(l.Value))
+				}
+				if i > 0 {
+					testutil.Assert(t, labels.Compare(srv.SeriesSet[i-1].PromLabels(), s.PromLabels()) < 0, "expected series sorted by labels")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// timeRange is a time range in milliseconds. Depending on the use, maxt is either exclusive (data coverage, e.g. block
+// time range) or inclusive (requested range, coverage gaps).
+type timeRange struct {
+	mint, maxt int64
+}
+
+func (r timeRange) String() string {
+	return formatMillis(r.mint) + " - " + formatMillis(r.maxt)
+}
+
+func formatMillis(t int64) string {
+	return timestamp.Time(t).UTC().Format(time.RFC3339Nano)
+}
+
+// coverageGaps returns parts of the inclusive range [mint, maxt] not covered by any of the given ranges, which are
+// treated as half-open [mint, maxt). Returned gaps are inclusive and sorted by time.
+func coverageGaps(mint, maxt int64, covered []timeRange) (gaps []timeRange) {
+	if mint > maxt {
+		return nil
+	}
+
+	sorted := make([]timeRange, len(covered))
+	copy(sorted, covered)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].mint < sorted[j].mint })
+
+	start := mint
+	for _, c := range sorted {
+		if c.mint > maxt {
+			break
+		}
+		if c.mint > start {
+			gaps = append(gaps, timeRange{mint: start, maxt: c.mint - 1})
+		}
+		if c.maxt > start {
+			start = c.maxt
+		}
+		if start > maxt {
+			return gaps
+		}
+	}
+	return append(gaps, timeRange{mint: start, maxt: maxt})
+}
+
+// storeCoverageWarnings returns warnings about parts of the requested range not covered by time ranges of any queried
+// StoreAPI. Gaps before or after all StoreAPIs are distinguished from gaps between them, as they usually have different
+// causes: retention, not uploaded data or lost blocks respectively.
+func storeCoverageWarnings(mint, maxt int64, covered []timeRange) (warns []error) {
+	if len(covered) == 0 {
+		return nil
+	}
+	minCovered, maxCovered := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, c := range covered {
+		if c.mint < minCovered {
+			minCovered = c.mint
+		}
+		if c.maxt > maxCovered {
+			maxCovered = c.maxt
+		}
+	}
+
+	for _, g := range coverageGaps(mint, maxt, covered) {
+		switch {
+		case g.maxt < minCovered:
+			warns = append(warns, errors.Errorf("no StoreAPI has data for time range %s of the query: data older than %s is no longer available, e.g. due to retention", g, formatMillis(minCovered)))
+		case g.mint >= maxCovered:
+			warns = append(warns, errors.Errorf("no StoreAPI has data for time range %s of the query: data newer than %s is not available yet", g, formatMillis(maxCovered)))
+		default:
+			warns = append(warns, errors.Errorf("no StoreAPI has data for time range %s of the query: data in this range is not available", g))
+		}
+	}
+	return warns
+}
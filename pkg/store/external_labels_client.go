@@ -0,0 +1,232 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/strutil"
+)
+
+// externalLabelsClient tags all data of a StoreAPI with external labels, e.g. ones identifying a remote cluster
+// the StoreAPI serves data of, like external labels of a Prometheus tag its series. External labels override labels
+// of the same name returned by the StoreAPI. Matchers of external labels are resolved by the client and are not sent
+// to the StoreAPI, which does not know them.
+type externalLabelsClient struct {
+	storepb.StoreClient
+
+	extLset labels.Labels
+}
+
+// NewExternalLabelsClient returns the client of the given StoreAPI tagging all its data with the given labels.
+func NewExternalLabelsClient(client storepb.StoreClient, extLset labels.Labels) storepb.StoreClient {
+	return &externalLabelsClient{StoreClient: client, extLset: extLset}
+}
+
+func (c *externalLabelsClient) Info(ctx context.Context, in *storepb.InfoRequest, opts ...grpc.CallOption) (*storepb.InfoResponse, error) {
+	resp, err := c.StoreClient.Info(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.LabelSets) == 0 && len(resp.Labels) > 0 {
+		resp.LabelSets = []storepb.LabelSet{{Labels: resp.Labels}}
+	}
+	if len(resp.LabelSets) == 0 {
+		resp.LabelSets = []storepb.LabelSet{{}}
+	}
+	for i, ls := range resp.LabelSets {
+		lset := append(labels.Labels{}, ls.PromLabels()...)
+		resp.LabelSets[i] = storepb.LabelSet{Labels: labelpb.LabelsFromPromLabels(labelpb.ExtendLabels(lset, c.extLset))}
+	}
+	resp.Labels = nil
+	return resp, nil
+}
+
+func (c *externalLabelsClient) Series(ctx context.Context, in *storepb.SeriesRequest, opts ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	match, matchers, err := matchesExternalLabels(in.Matchers, c.extLset)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &bufferedSeriesClient{ctx: ctx}, nil
+	}
+
+	r := *in
+	r.Matchers = matchers
+	sc, err := c.StoreClient.Series(ctx, &r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &externalLabelsSeriesClient{Store_SeriesClient: sc, extLset: c.extLset}, nil
+}
+
+func (c *externalLabelsClient) LabelNames(ctx context.Context, in *storepb.LabelNamesRequest, opts ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	resp, err := c.StoreClient.LabelNames(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(c.extLset))
+	for _, l := range c.extLset {
+		names = append(names, l.Name)
+	}
+	resp.Names = strutil.MergeSlices(resp.Names, names)
+	return resp, nil
+}
+
+func (c *externalLabelsClient) LabelValues(ctx context.Context, in *storepb.LabelValuesRequest, opts ...grpc.CallOption) (*storepb.LabelValuesResponse, error) {
+	match, matchers, err := matchesExternalLabels(in.Matchers, c.extLset)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &storepb.LabelValuesResponse{}, nil
+	}
+	if v := c.extLset.Get(in.Label); v != "" {
+		return &storepb.LabelValuesResponse{Values: []string{v}}, nil
+	}
+
+	r := *in
+	r.Matchers = matchers
+	return c.StoreClient.LabelValues(ctx, &r, opts...)
+}
+
+func (c *externalLabelsClient) LabelValuesStream(ctx context.Context, in *storepb.LabelValuesRequest, opts ...grpc.CallOption) (storepb.Store_LabelValuesStreamClient, error) {
+	match, matchers, err := matchesExternalLabels(in.Matchers, c.extLset)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &bufferedLabelValuesStreamClient{ctx: ctx}, nil
+	}
+	if v := c.extLset.Get(in.Label); v != "" {
+		return &bufferedLabelValuesStreamClient{ctx: ctx, resps: []*storepb.LabelValuesStreamResponse{{Values: []string{v}}}}, nil
+	}
+
+	r := *in
+	r.Matchers = matchers
+	return c.StoreClient.LabelValuesStream(ctx, &r, opts...)
+}
+
+// externalLabelsSeriesClient tags series of the wrapped stream with external labels. Adding or overriding labels can
+// change the order of series, so tagged series are held back until no later series of the stream can sort before them,
+// see seriesLowerBound. If tagging does not change the order, each series is passed on as soon as the next one is
+// received.
+type externalLabelsSeriesClient struct {
+	storepb.Store_SeriesClient
+
+	extLset labels.Labels
+	// pending holds tagged series sorted by labels, which can still be preceded by later series.
+	pending []*storepb.SeriesResponse
+	// ready holds tagged series which can be returned.
+	ready []*storepb.SeriesResponse
+	eof   bool
+}
+
+func (c *externalLabelsSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	for len(c.ready) == 0 {
+		if c.eof {
+			return nil, io.EOF
+		}
+		resp, err := c.Store_SeriesClient.Recv()
+		if err == io.EOF {
+			c.eof = true
+			c.ready, c.pending = c.pending, nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := resp.GetSeries()
+		if s == nil {
+			return resp, nil
+		}
+
+		lset := s.PromLabels()
+		lb := seriesLowerBound(lset, c.extLset)
+		s.Labels = labelpb.LabelsFromPromLabels(labelpb.ExtendLabels(lset, c.extLset))
+
+		// Insert after series with equal labels to keep their order.
+		i := sort.Search(len(c.pending), func(i int) bool {
+			return labels.Compare(c.pending[i].GetSeries().PromLabels(), s.PromLabels()) > 0
+		})
+		c.pending = append(c.pending, nil)
+		copy(c.pending[i+1:], c.pending[i:])
+		c.pending[i] = resp
+
+		n := sort.Search(len(c.pending), func(i int) bool {
+			return labels.Compare(c.pending[i].GetSeries().PromLabels(), lb) > 0
+		})
+		c.ready, c.pending = append(c.ready, c.pending[:n]...), c.pending[n:]
+	}
+
+	resp := c.ready[0]
+	c.ready = c.ready[1:]
+	return resp, nil
+}
+
+// seriesLowerBound returns labels which no series following the series of the given labels in a sorted stream sorts
+// before, once tagged with the given external labels. Labels with names sorting before all external labels are not
+// changed by tagging, so a later series either sorts after them or has the same ones. In the latter case the first
+// external label follows them, unless the given series has no other labels and a later one can add labels in between.
+func seriesLowerBound(lset, extLset labels.Labels) labels.Labels {
+	if len(extLset) == 0 {
+		return lset
+	}
+	m := sort.Search(len(lset), func(i int) bool { return lset[i].Name >= extLset[0].Name })
+	if m == len(lset) {
+		return lset
+	}
+	return append(append(make(labels.Labels, 0, m+1), lset[:m]...), extLset[0])
+}
+
+// bufferedSeriesClient returns the given responses as if they were received from a StoreAPI.
+type bufferedSeriesClient struct {
+	storepb.Store_SeriesClient
+
+	ctx   context.Context
+	resps []*storepb.SeriesResponse
+}
+
+func (c *bufferedSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	if len(c.resps) == 0 {
+		return nil, io.EOF
+	}
+	resp := c.resps[0]
+	c.resps = c.resps[1:]
+	return resp, nil
+}
+
+func (c *bufferedSeriesClient) Context() context.Context {
+	return c.ctx
+}
+
+// bufferedLabelValuesStreamClient returns the given responses as if they were received from a StoreAPI.
+type bufferedLabelValuesStreamClient struct {
+	storepb.Store_LabelValuesStreamClient
+
+	ctx   context.Context
+	resps []*storepb.LabelValuesStreamResponse
+}
+
+func (c *bufferedLabelValuesStreamClient) Recv() (*storepb.LabelValuesStreamResponse, error) {
+	if len(c.resps) == 0 {
+		return nil, io.EOF
+	}
+	resp := c.resps[0]
+	c.resps = c.resps[1:]
+	return resp, nil
+}
+
+func (c *bufferedLabelValuesStreamClient) Context() context.Context {
+	return c.ctx
+}
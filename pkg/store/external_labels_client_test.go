@@ -0,0 +1,168 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestExternalLabelsClient_Series(t *testing.T) {
+	api := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("a", "1", "cluster", "a", "z", "1"), []sample{{1, 1}}),
+		storeSeriesResponse(t, labels.FromStrings("a", "1", "cluster", "b"), []sample{{1, 2}}),
+		storepb.NewWarnSeriesResponse(io.ErrUnexpectedEOF),
+	}}
+	c := NewExternalLabelsClient(api, labels.FromStrings("cluster", "eu"))
+
+	sc, err := c.Series(context.Background(), &storepb.SeriesRequest{Matchers: []storepb.LabelMatcher{
+		{Type: storepb.LabelMatcher_EQ, Name: "cluster", Value: "eu"},
+		{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+	}})
+	testutil.Ok(t, err)
+	// Matchers of external labels are not sent to the StoreAPI.
+	testutil.Equals(t, []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}}, api.LastSeriesReq.Matchers)
+
+	var (
+		lsets []labels.Labels
+		warns []string
+	)
+	for {
+		resp, err := sc.Recv()
+		if err == io.EOF {
+			break
+		}
+		testutil.Ok(t, err)
+		if w := resp.GetWarning(); w != "" {
+			warns = append(warns, w)
+			continue
+		}
+		lsets = append(lsets, resp.GetSeries().PromLabels())
+	}
+	testutil.Equals(t, []string{io.ErrUnexpectedEOF.Error()}, warns)
+	// Overridden labels change the order of series, which are sorted again.
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "1", "cluster", "eu"),
+		labels.FromStrings("a", "1", "cluster", "eu", "z", "1"),
+	}, lsets)
+
+	t.Run("not matching external labels", func(t *testing.T) {
+		api.LastSeriesReq = nil
+		sc, err := c.Series(context.Background(), &storepb.SeriesRequest{Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_EQ, Name: "cluster", Value: "us"},
+		}})
+		testutil.Ok(t, err)
+		_, err = sc.Recv()
+		testutil.Equals(t, io.EOF, err)
+		testutil.Assert(t, api.LastSeriesReq == nil, "expected StoreAPI not to be called")
+	})
+}
+
+// countingSeriesClient counts responses received from the wrapped client.
+type countingSeriesClient struct {
+	storepb.Store_SeriesClient
+
+	received int
+}
+
+func (c *countingSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	resp, err := c.Store_SeriesClient.Recv()
+	if err == nil {
+		c.received++
+	}
+	return resp, err
+}
+
+func TestExternalLabelsSeriesClient_Recv(t *testing.T) {
+	for _, tcase := range []struct {
+		name    string
+		extLset labels.Labels
+		in      []labels.Labels
+		// received is the number of series received from the wrapped client before each series is returned.
+		received []int
+		expected []labels.Labels
+	}{
+		{
+			name:     "order not changed",
+			extLset:  labels.FromStrings("cluster", "eu"),
+			in:       []labels.Labels{labels.FromStrings("a", "1", "b", "1"), labels.FromStrings("a", "1", "b", "2"), labels.FromStrings("a", "2", "b", "1")},
+			received: []int{2, 3, 3},
+			expected: []labels.Labels{labels.FromStrings("a", "1", "b", "1", "cluster", "eu"), labels.FromStrings("a", "1", "b", "2", "cluster", "eu"), labels.FromStrings("a", "2", "b", "1", "cluster", "eu")},
+		},
+		{
+			name:     "added label sorts after labels of a longer series",
+			extLset:  labels.FromStrings("c", "1"),
+			in:       []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "1", "b", "1"), labels.FromStrings("a", "2")},
+			received: []int{3, 3, 3},
+			expected: []labels.Labels{labels.FromStrings("a", "1", "b", "1", "c", "1"), labels.FromStrings("a", "1", "c", "1"), labels.FromStrings("a", "2", "c", "1")},
+		},
+		{
+			name:     "overridden label",
+			extLset:  labels.FromStrings("cluster", "eu"),
+			in:       []labels.Labels{labels.FromStrings("a", "1", "cluster", "a", "z", "1"), labels.FromStrings("a", "1", "cluster", "b"), labels.FromStrings("a", "2", "cluster", "a")},
+			received: []int{2, 3, 3},
+			expected: []labels.Labels{labels.FromStrings("a", "1", "cluster", "eu"), labels.FromStrings("a", "1", "cluster", "eu", "z", "1"), labels.FromStrings("a", "2", "cluster", "eu")},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var resps []*storepb.SeriesResponse
+			for _, lset := range tcase.in {
+				resps = append(resps, storeSeriesResponse(t, lset, []sample{{1, 1}}))
+			}
+			upstream := &countingSeriesClient{Store_SeriesClient: &bufferedSeriesClient{ctx: context.Background(), resps: resps}}
+			sc := &externalLabelsSeriesClient{Store_SeriesClient: upstream, extLset: tcase.extLset}
+
+			var (
+				lsets    []labels.Labels
+				received []int
+			)
+			for {
+				resp, err := sc.Recv()
+				if err == io.EOF {
+					break
+				}
+				testutil.Ok(t, err)
+				lsets = append(lsets, resp.GetSeries().PromLabels())
+				received = append(received, upstream.received)
+			}
+			testutil.Equals(t, tcase.expected, lsets)
+			testutil.Equals(t, tcase.received, received)
+		})
+	}
+}
+
+func TestExternalLabelsClient_Labels(t *testing.T) {
+	api := &mockedStoreAPI{
+		RespLabelNames:  &storepb.LabelNamesResponse{Names: []string{"a", "z"}},
+		RespLabelValues: &storepb.LabelValuesResponse{Values: []string{"1", "2"}},
+	}
+	c := NewExternalLabelsClient(api, labels.FromStrings("cluster", "eu"))
+
+	names, err := c.LabelNames(context.Background(), &storepb.LabelNamesRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a", "cluster", "z"}, names.Names)
+
+	vals, err := c.LabelValues(context.Background(), &storepb.LabelValuesRequest{Label: "cluster"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"eu"}, vals.Values)
+
+	vals, err = c.LabelValues(context.Background(), &storepb.LabelValuesRequest{Label: "a", Matchers: []storepb.LabelMatcher{
+		{Type: storepb.LabelMatcher_EQ, Name: "cluster", Value: "eu"},
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1", "2"}, vals.Values)
+	testutil.Equals(t, 0, len(api.LastLabelValuesReq.Matchers))
+
+	vals, err = c.LabelValues(context.Background(), &storepb.LabelValuesRequest{Label: "a", Matchers: []storepb.LabelMatcher{
+		{Type: storepb.LabelMatcher_EQ, Name: "cluster", Value: "us"},
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(vals.Values))
+}
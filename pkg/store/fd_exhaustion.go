@@ -0,0 +1,179 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// fdExhaustionMessage is the message of EMFILE and the prefix of ENFILE errors. gRPC reports errors of dialing
+// StoreAPIs as text only, so they are matched by it.
+const fdExhaustionMessage = "too many open files"
+
+// FDExhaustionBackoff configures how the fan-out to StoreAPIs reacts to running out of file descriptors, e.g. while
+// opening connections to many StoreAPIs at once. The zero value does not retry such requests.
+type FDExhaustionBackoff struct {
+	// Retries is the number of times a request to a StoreAPI failing because of file descriptor exhaustion is retried.
+	Retries int
+	// Backoff is the time requests to all StoreAPIs are paused for once file descriptors are exhausted, doubled with
+	// every retry of the same request.
+	Backoff time.Duration
+}
+
+// IsFDExhaustion returns true if the given error is caused by the process or the system running out of file
+// descriptors.
+func IsFDExhaustion(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	return strings.Contains(err.Error(), fdExhaustionMessage)
+}
+
+// fdExhaustionGate retries requests failing because of file descriptor exhaustion. Requests of all fan-outs wait
+// while any of them backs off, so that descriptors are released by finishing requests before new ones are opened.
+type fdExhaustionGate struct {
+	cfg FDExhaustionBackoff
+
+	mtx   sync.Mutex
+	until time.Time
+
+	exhausted prometheus.Counter
+	retries   prometheus.Counter
+}
+
+func newFDExhaustionGate(cfg FDExhaustionBackoff, reg prometheus.Registerer) *fdExhaustionGate {
+	return &fdExhaustionGate{
+		cfg: cfg,
+		exhausted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_proxy_store_fd_exhaustion_errors_total",
+			Help: "Total number of requests to StoreAPIs that failed because the process ran out of file descriptors.",
+		}),
+		retries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_proxy_store_fd_exhaustion_retries_total",
+			Help: "Total number of requests to StoreAPIs retried after backing off because the process ran out of file descriptors.",
+		}),
+	}
+}
+
+// do calls f, retrying it after backing off while it fails because of file descriptor exhaustion. Once retries are
+// used up, the error is wrapped in a message explaining how to prevent it. A nil gate just calls f.
+func (g *fdExhaustionGate) do(ctx context.Context, f func() error) error {
+	if g == nil {
+		return f()
+	}
+	for attempt := 0; ; attempt++ {
+		if err := g.wait(ctx); err != nil {
+			return err
+		}
+		err := f()
+		if !IsFDExhaustion(err) {
+			return err
+		}
+		if attempt >= g.cfg.Retries {
+			return g.wrap(err)
+		}
+		g.exhausted.Inc()
+		g.retries.Inc()
+		g.backoff(g.cfg.Backoff << uint(attempt))
+	}
+}
+
+// wrap wraps errors caused by file descriptor exhaustion, which can't be retried anymore, in a message explaining how
+// to prevent them. Other errors are returned as they are.
+func (g *fdExhaustionGate) wrap(err error) error {
+	if !IsFDExhaustion(err) {
+		return err
+	}
+	if g != nil {
+		g.exhausted.Inc()
+	}
+	return errors.Wrap(err, "out of file descriptors; raise the open files limit (ulimit -n) of the querier, or lower the number of connections to each StoreAPI (--store.connection-pool-size) or of concurrent selects (--query.max-concurrent-select)")
+}
+
+// seriesClient returns the given Series stream retrying its request while it fails because of file descriptor
+// exhaustion before any response is received. gRPC dials StoreAPIs lazily, so such failures are usually returned by
+// the first Recv rather than by opening the stream. Later failures can't be retried, as responses were already passed
+// on, so they are only wrapped.
+func (g *fdExhaustionGate) seriesClient(ctx context.Context, sc storepb.Store_SeriesClient, open func() (storepb.Store_SeriesClient, error)) storepb.Store_SeriesClient {
+	if g == nil {
+		return sc
+	}
+	return &fdExhaustionSeriesClient{Store_SeriesClient: sc, ctx: ctx, gate: g, open: open}
+}
+
+type fdExhaustionSeriesClient struct {
+	storepb.Store_SeriesClient
+
+	ctx      context.Context
+	gate     *fdExhaustionGate
+	open     func() (storepb.Store_SeriesClient, error)
+	received bool
+}
+
+func (c *fdExhaustionSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	if c.received {
+		r, err := c.Store_SeriesClient.Recv()
+		return r, c.gate.wrap(err)
+	}
+	c.received = true
+
+	var (
+		r      *storepb.SeriesResponse
+		opened = true
+	)
+	err := c.gate.do(c.ctx, func() (err error) {
+		if !opened {
+			if c.Store_SeriesClient, err = c.open(); err != nil {
+				return err
+			}
+		}
+		opened = false
+		r, err = c.Store_SeriesClient.Recv()
+		return err
+	})
+	return r, err
+}
+
+// backoff pauses requests for the given duration, unless they are paused for longer already.
+func (g *fdExhaustionGate) backoff(d time.Duration) {
+	until := time.Now().Add(d)
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if until.After(g.until) {
+		g.until = until
+	}
+}
+
+// wait returns once requests are not paused anymore.
+func (g *fdExhaustionGate) wait(ctx context.Context) error {
+	g.mtx.Lock()
+	d := time.Until(g.until)
+	g.mtx.Unlock()
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestIsFDExhaustion(t *testing.T) {
+	for _, tcase := range []struct {
+		err error
+		exp bool
+	}{
+		{err: nil, exp: false},
+		{err: errors.New("connection refused"), exp: false},
+		{err: status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing dial tcp 10.0.0.1:10901: connect: connection refused\""), exp: false},
+		{err: syscall.EMFILE, exp: true},
+		{err: syscall.ENFILE, exp: true},
+		{err: errors.Wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}, "fetch series"), exp: true},
+		// gRPC reports dial errors as text only.
+		{err: errors.Wrap(status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing dial tcp 10.0.0.1:10901: socket: too many open files\""), "fetch series"), exp: true},
+	} {
+		testutil.Equals(t, tcase.exp, IsFDExhaustion(tcase.err), "%v", tcase.err)
+	}
+}
+
+// fdExhaustingStoreAPI fails the given number of Series, LabelNames and LabelValuesStream requests with file
+// descriptor exhaustion.
+type fdExhaustingStoreAPI struct {
+	mockedStoreAPI
+
+	mtx      sync.Mutex
+	failures int
+	// failRecv fails streams by their first Recv rather than by opening them, as gRPC does for dial errors.
+	failRecv bool
+	calls    []time.Time
+}
+
+func (s *fdExhaustingStoreAPI) fail() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.calls = append(s.calls, time.Now())
+	if s.failures == 0 {
+		return nil
+	}
+	s.failures--
+	return status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing dial tcp 10.0.0.1:10901: socket: too many open files\"")
+}
+
+func (s *fdExhaustingStoreAPI) Series(ctx context.Context, req *storepb.SeriesRequest, opts ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	if err := s.fail(); err != nil {
+		if s.failRecv {
+			return &StoreSeriesClient{ctx: ctx, injectedError: err}, nil
+		}
+		return nil, err
+	}
+	return s.mockedStoreAPI.Series(ctx, req, opts...)
+}
+
+func (s *fdExhaustingStoreAPI) LabelValuesStream(ctx context.Context, req *storepb.LabelValuesRequest, opts ...grpc.CallOption) (storepb.Store_LabelValuesStreamClient, error) {
+	if err := s.fail(); err != nil {
+		if s.failRecv {
+			return &fdExhaustedLabelValuesStreamClient{err: err}, nil
+		}
+		return nil, err
+	}
+	return s.mockedStoreAPI.LabelValuesStream(ctx, req, opts...)
+}
+
+type fdExhaustedLabelValuesStreamClient struct {
+	storepb.Store_LabelValuesStreamClient
+
+	err error
+}
+
+func (c *fdExhaustedLabelValuesStreamClient) Recv() (*storepb.LabelValuesStreamResponse, error) {
+	return nil, c.err
+}
+
+func (s *fdExhaustingStoreAPI) LabelNames(ctx context.Context, req *storepb.LabelNamesRequest, opts ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return s.mockedStoreAPI.LabelNames(ctx, req, opts...)
+}
+
+func TestProxyStore_FDExhaustion(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	const backoff = 50 * time.Millisecond
+	newProxy := func(failures, retries int) (*ProxyStore, *fdExhaustingStoreAPI) {
+		api := &fdExhaustingStoreAPI{
+			mockedStoreAPI: mockedStoreAPI{
+				RespSeries:            []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}})},
+				RespLabelNames:        &storepb.LabelNamesResponse{Names: []string{"a"}},
+				RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{{Values: []string{"b"}}},
+			},
+			failures: failures,
+		}
+		cls := []Client{&testClient{StoreClient: api, minTime: 1, maxTime: 300, name: "store-1"}}
+		return NewProxyStore(nil, nil, func() []Client { return cls }, component.Query, nil, 0, ProxyStoreOpts{FDExhaustionBackoff: FDExhaustionBackoff{Retries: retries, Backoff: backoff}}), api
+	}
+	series := func(q *ProxyStore, partialResponseDisabled bool) (*storeSeriesServer, error) {
+		s := newStoreSeriesServer(context.Background())
+		return s, q.Series(&storepb.SeriesRequest{
+			MinTime:                 1,
+			MaxTime:                 300,
+			Matchers:                []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+			PartialResponseDisabled: partialResponseDisabled,
+		}, s)
+	}
+
+	t.Run("retried after backoff", func(t *testing.T) {
+		q, api := newProxy(2, 2)
+		s, err := series(q, true)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(s.SeriesSet))
+		testutil.Equals(t, 0, len(s.Warnings))
+
+		testutil.Equals(t, 3, len(api.calls))
+		testutil.Assert(t, api.calls[1].Sub(api.calls[0]) >= backoff, "expected backoff before first retry")
+		testutil.Assert(t, api.calls[2].Sub(api.calls[1]) >= 2*backoff, "expected doubled backoff before second retry")
+		testutil.Equals(t, 2.0, promtest.ToFloat64(q.fdExhaustionGate.exhausted))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(q.fdExhaustionGate.retries))
+	})
+	t.Run("clear error once retries are used up", func(t *testing.T) {
+		q, api := newProxy(2, 1)
+		_, err := series(q, true)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "out of file descriptors; raise the open files limit (ulimit -n) of the querier"), "unexpected error %v", err)
+		testutil.Equals(t, codes.Unavailable, status.Code(errors.Cause(err)))
+		testutil.Equals(t, 2, len(api.calls))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(q.fdExhaustionGate.exhausted))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(q.fdExhaustionGate.retries))
+	})
+	t.Run("error with partial response", func(t *testing.T) {
+		q, _ := newProxy(1, 0)
+		_, err := series(q, false)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "out of file descriptors"), "unexpected error %v", err)
+	})
+	t.Run("retried after failed receive", func(t *testing.T) {
+		q, api := newProxy(1, 1)
+		api.failRecv = true
+		s, err := series(q, true)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(s.SeriesSet))
+		testutil.Equals(t, 2, len(api.calls))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(q.fdExhaustionGate.retries))
+	})
+	t.Run("clear error of failed receive once retries are used up", func(t *testing.T) {
+		q, api := newProxy(2, 1)
+		api.failRecv = true
+		_, err := series(q, false)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "out of file descriptors; raise the open files limit (ulimit -n) of the querier"), "unexpected error %v", err)
+		testutil.Equals(t, 2, len(api.calls))
+	})
+	t.Run("label names retried", func(t *testing.T) {
+		q, api := newProxy(1, 1)
+		resp, err := q.LabelNames(context.Background(), &storepb.LabelNamesRequest{Start: 1, End: 300, PartialResponseDisabled: true})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"a"}, resp.Names)
+		testutil.Equals(t, 2, len(api.calls))
+	})
+	t.Run("label values stream retried", func(t *testing.T) {
+		for _, failRecv := range []bool{false, true} {
+			q, api := newProxy(1, 1)
+			api.failRecv = failRecv
+			s := newStoreLabelValuesStreamServer(context.Background())
+			testutil.Ok(t, q.LabelValuesStream(&storepb.LabelValuesRequest{Label: "a", Start: 1, End: 300, PartialResponseDisabled: true}, s))
+			testutil.Equals(t, []string{"b"}, s.Values)
+			testutil.Equals(t, 2, len(api.calls))
+		}
+	})
+	t.Run("label values stream error once retries are used up", func(t *testing.T) {
+		q, api := newProxy(2, 1)
+		api.failRecv = true
+		s := newStoreLabelValuesStreamServer(context.Background())
+		err := q.LabelValuesStream(&storepb.LabelValuesRequest{Label: "a", Start: 1, End: 300}, s)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "out of file descriptors; raise the open files limit (ulimit -n) of the querier"), "unexpected error %v", err)
+	})
+	t.Run("requests of other fan-outs wait for backoff", func(t *testing.T) {
+		q, api := newProxy(0, 1)
+		q.fdExhaustionGate.backoff(backoff)
+		start := time.Now()
+		_, err := series(q, true)
+		testutil.Ok(t, err)
+		testutil.Assert(t, api.calls[0].Sub(start) >= backoff-time.Millisecond, "expected request to wait for backoff")
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// LabelValueLengthMode decides what happens to series with too long label values.
+type LabelValueLengthMode string
+
+const (
+	// LabelValueLengthTruncate truncates too long label values.
+	LabelValueLengthTruncate LabelValueLengthMode = "truncate"
+	// LabelValueLengthReject drops series with too long label values.
+	LabelValueLengthReject LabelValueLengthMode = "reject"
+)
+
+// truncatedValueHashLen is the length of the suffix replacing the end of truncated label values: a separator and
+// the hex encoded hash of the whole value.
+const truncatedValueHashLen = 17
+
+// MinTruncatedLabelValueLength is the minimum maximum label value length in the truncate mode, so that a meaningful
+// prefix of truncated values is kept next to their hash.
+const MinTruncatedLabelValueLength = 2 * truncatedValueHashLen
+
+// LabelValueLengthGuard protects memory from series with huge label values, e.g. produced by a misbehaving exporter,
+// by truncating such values or dropping such series.
+//
+// Truncated values keep their prefix and end with the hash of the whole value, so that series differing only after
+// the prefix do not collide. Values are truncated on the UTF-8 character boundary, so they stay valid.
+type LabelValueLengthGuard struct {
+	maxLength int
+	mode      LabelValueLengthMode
+
+	truncated prometheus.Counter
+	rejected  prometheus.Counter
+}
+
+// NewLabelValueLengthGuard returns a guard of the given maximum label value length in bytes.
+func NewLabelValueLengthGuard(reg prometheus.Registerer, maxLength int, mode LabelValueLengthMode) (*LabelValueLengthGuard, error) {
+	switch mode {
+	case LabelValueLengthTruncate:
+		if maxLength < MinTruncatedLabelValueLength {
+			return nil, errors.Errorf("maximum label value length %d is lower than the minimum %d of the %s mode", maxLength, MinTruncatedLabelValueLength, mode)
+		}
+	case LabelValueLengthReject:
+		if maxLength <= 0 {
+			return nil, errors.Errorf("maximum label value length has to be positive, got %d", maxLength)
+		}
+	default:
+		return nil, errors.Errorf("unknown label value length mode %q, expected %q or %q", mode, LabelValueLengthTruncate, LabelValueLengthReject)
+	}
+
+	return &LabelValueLengthGuard{
+		maxLength: maxLength,
+		mode:      mode,
+		truncated: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "label_value_length_truncated_series_total",
+			Help: "Total number of series with label values longer than the maximum length that were truncated.",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "label_value_length_rejected_series_total",
+			Help: "Total number of series with label values longer than the maximum length that were dropped.",
+		}),
+	}, nil
+}
+
+// Apply returns the labels of the series with too long values truncated, or rejected set to true if the series has to
+// be dropped. Given labels are not modified. Nil guard accepts all series.
+func (g *LabelValueLengthGuard) Apply(lset labels.Labels) (res labels.Labels, truncated, rejected bool) {
+	if g == nil {
+		return lset, false, false
+	}
+	for i, l := range lset {
+		if len(l.Value) <= g.maxLength {
+			continue
+		}
+		if g.mode == LabelValueLengthReject {
+			g.rejected.Inc()
+			return nil, false, true
+		}
+
+		if !truncated {
+			truncated = true
+			res = make(labels.Labels, len(lset))
+			copy(res, lset)
+		}
+		res[i].Value = g.truncate(l.Value)
+	}
+	if !truncated {
+		return lset, false, false
+	}
+	g.truncated.Inc()
+	return res, true, false
+}
+
+func (g *LabelValueLengthGuard) truncate(v string) string {
+	n := g.maxLength - truncatedValueHashLen
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s~%016x", v[:n], xxhash.Sum64String(v))
+}
+
+// Warning returns the warning about the given number of series of a response that were truncated or dropped.
+func (g *LabelValueLengthGuard) Warning(series int) string {
+	if g.mode == LabelValueLengthReject {
+		return fmt.Sprintf("%d series with label values longer than %d bytes were dropped", series, g.maxLength)
+	}
+	return fmt.Sprintf("label values of %d series were truncated to %d bytes", series, g.maxLength)
+}
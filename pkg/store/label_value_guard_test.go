@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestNewLabelValueLengthGuard(t *testing.T) {
+	_, err := NewLabelValueLengthGuard(nil, MinTruncatedLabelValueLength, LabelValueLengthTruncate)
+	testutil.Ok(t, err)
+	_, err = NewLabelValueLengthGuard(nil, 1, LabelValueLengthReject)
+	testutil.Ok(t, err)
+
+	_, err = NewLabelValueLengthGuard(nil, MinTruncatedLabelValueLength-1, LabelValueLengthTruncate)
+	testutil.NotOk(t, err)
+	_, err = NewLabelValueLengthGuard(nil, 0, LabelValueLengthReject)
+	testutil.NotOk(t, err)
+	_, err = NewLabelValueLengthGuard(nil, 100, "drop")
+	testutil.NotOk(t, err)
+}
+
+func TestLabelValueLengthGuard_Truncate(t *testing.T) {
+	g, err := NewLabelValueLengthGuard(nil, 40, LabelValueLengthTruncate)
+	testutil.Ok(t, err)
+
+	short := labels.FromStrings("a", "1", "b", strings.Repeat("x", 40))
+	res, truncated, rejected := g.Apply(short)
+	testutil.Assert(t, !truncated && !rejected, "expected series within limit to be kept as is")
+	testutil.Equals(t, short, res)
+
+	long1 := labels.FromStrings("a", "1", "b", strings.Repeat("x", 100)+"1")
+	long2 := labels.FromStrings("a", "1", "b", strings.Repeat("x", 100)+"2")
+	orig := labels.FromStrings("a", "1", "b", strings.Repeat("x", 100)+"1")
+
+	res1, truncated, rejected := g.Apply(long1)
+	testutil.Assert(t, truncated && !rejected, "expected series to be truncated")
+	testutil.Equals(t, orig, long1)
+	testutil.Equals(t, "1", res1.Get("a"))
+	testutil.Assert(t, len(res1.Get("b")) <= 40, "expected value within limit, got %d bytes", len(res1.Get("b")))
+	testutil.Assert(t, strings.HasPrefix(res1.Get("b"), strings.Repeat("x", 23)+"~"), "expected prefix to be kept, got %q", res1.Get("b"))
+
+	// Values differing after the kept prefix must not collide.
+	res2, _, _ := g.Apply(long2)
+	testutil.Assert(t, res1.Get("b") != res2.Get("b"), "expected truncated values to differ")
+
+	// Truncation is deterministic, so the same series from different sources stay the same series.
+	again, _, _ := g.Apply(long1)
+	testutil.Equals(t, res1, again)
+
+	// Truncated values stay within the limit and so are not truncated again.
+	_, truncated, _ = g.Apply(res1)
+	testutil.Assert(t, !truncated, "expected truncated series not to be truncated again")
+
+	testutil.Equals(t, 3.0, promtest.ToFloat64(g.truncated))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(g.rejected))
+
+	t.Run("multi-byte characters", func(t *testing.T) {
+		res, truncated, _ := g.Apply(labels.FromStrings("a", strings.Repeat("ż", 100)))
+		testutil.Assert(t, truncated, "expected series to be truncated")
+		testutil.Assert(t, utf8.ValidString(res.Get("a")), "expected valid UTF-8, got %q", res.Get("a"))
+		testutil.Assert(t, len(res.Get("a")) <= 40, "expected value within limit, got %d bytes", len(res.Get("a")))
+	})
+}
+
+func TestLabelValueLengthGuard_Reject(t *testing.T) {
+	g, err := NewLabelValueLengthGuard(nil, 10, LabelValueLengthReject)
+	testutil.Ok(t, err)
+
+	short := labels.FromStrings("a", strings.Repeat("x", 10))
+	res, truncated, rejected := g.Apply(short)
+	testutil.Assert(t, !truncated && !rejected, "expected series within limit to be kept as is")
+	testutil.Equals(t, short, res)
+
+	_, truncated, rejected = g.Apply(labels.FromStrings("a", "1", "b", strings.Repeat("x", 11)))
+	testutil.Assert(t, !truncated && rejected, "expected series to be rejected")
+
+	testutil.Equals(t, 0.0, promtest.ToFloat64(g.truncated))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.rejected))
+}
@@ -0,0 +1,191 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"container/heap"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// labelValuesBatchSize is the maximum number of label values sent in a single LabelValuesStream response.
+const labelValuesBatchSize = 1000
+
+// sendLabelValues streams the given label values response in batches. Warnings are sent with the first batch.
+func sendLabelValues(srv storepb.Store_LabelValuesStreamServer, resp *storepb.LabelValuesResponse) error {
+	values, warnings := resp.Values, resp.Warnings
+	for {
+		n := len(values)
+		if n > labelValuesBatchSize {
+			n = labelValuesBatchSize
+		}
+		if err := srv.Send(&storepb.LabelValuesStreamResponse{Values: values[:n], Warnings: warnings}); err != nil {
+			return errors.Wrap(err, "send label values")
+		}
+		values, warnings = values[n:], nil
+		if len(values) == 0 {
+			return nil
+		}
+	}
+}
+
+// sendMergedLabelValues merges sorted label values of the given sets, e.g. of blocks or tenants of a single store, and
+// sends them in batches while merging. Any error of a set fails the whole stream.
+func sendMergedLabelValues(srv storepb.Store_LabelValuesStreamServer, sets []*labelValuesSet) error {
+	return mergeLabelValues(sets, labelValuesBatchSize, true, PartialResponsePolicy{}, func(values, warnings []string) error {
+		if err := srv.Send(&storepb.LabelValuesStreamResponse{Values: values, Warnings: warnings}); err != nil {
+			return errors.Wrap(err, "send label values")
+		}
+		return nil
+	})
+}
+
+// labelValuesSet iterates over sorted label values received in batches from a single store.
+type labelValuesSet struct {
+	name string
+	recv func() (*storepb.LabelValuesStreamResponse, error)
+
+	batch    []string
+	cur      string
+	warnings []string
+	err      error
+}
+
+// newSliceLabelValuesSet returns a set of the given sorted label values and warnings.
+func newSliceLabelValuesSet(name string, values, warnings []string) *labelValuesSet {
+	return &labelValuesSet{
+		name: name,
+		recv: unaryLabelValuesRecv(&storepb.LabelValuesResponse{Values: values, Warnings: warnings}),
+	}
+}
+
+// unaryLabelValuesRecv returns receive function of a set holding the given response only.
+func unaryLabelValuesRecv(resp *storepb.LabelValuesResponse) func() (*storepb.LabelValuesStreamResponse, error) {
+	done := false
+	return func() (*storepb.LabelValuesStreamResponse, error) {
+		if done {
+			return nil, io.EOF
+		}
+		done = true
+		return &storepb.LabelValuesStreamResponse{Values: resp.Values, Warnings: resp.Warnings}, nil
+	}
+}
+
+func (s *labelValuesSet) Next() bool {
+	for len(s.batch) == 0 {
+		resp, err := s.recv()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.warnings = append(s.warnings, resp.Warnings...)
+		s.batch = resp.Values
+		// Values are expected sorted, but older stores do not guarantee it within a response.
+		if !sort.StringsAreSorted(s.batch) {
+			sort.Strings(s.batch)
+		}
+	}
+	if s.batch[0] < s.cur {
+		s.err = errors.Errorf("label values of store %s are not sorted: %q after %q", s.name, s.batch[0], s.cur)
+		return false
+	}
+	s.cur, s.batch = s.batch[0], s.batch[1:]
+	return true
+}
+
+func (s *labelValuesSet) At() string { return s.cur }
+
+// labelValuesHeap orders label values sets by their current value.
+type labelValuesHeap []*labelValuesSet
+
+func (h labelValuesHeap) Len() int            { return len(h) }
+func (h labelValuesHeap) Less(i, j int) bool  { return h[i].At() < h[j].At() }
+func (h labelValuesHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *labelValuesHeap) Push(x interface{}) { *h = append(*h, x.(*labelValuesSet)) }
+func (h *labelValuesHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// mergeLabelValues merges sorted label values of all sets into sorted, deduplicated batches of up to batchSize values
+// passed to send, together with warnings collected since the previous batch. Only the current batch of each set is
+// held in memory. A failed set fails the merge if partial response is disabled or the policy does not tolerate its error,
+// otherwise it is reported as warning.
+func mergeLabelValues(
+	sets []*labelValuesSet,
+	batchSize int,
+	partialResponseDisabled bool,
+	policy PartialResponsePolicy,
+	send func(values, warnings []string) error,
+) error {
+	var (
+		h        = make(labelValuesHeap, 0, len(sets))
+		batch    = make([]string, 0, batchSize)
+		warnings []string
+		last     string
+		started  bool
+	)
+	next := func(s *labelValuesSet) (bool, error) {
+		ok := s.Next()
+		warnings = append(warnings, s.warnings...)
+		s.warnings = nil
+		if !ok && s.err != nil {
+			err := errors.Wrapf(s.err, "fetch label values from store %s", s.name)
+			if partialResponseDisabled || !policy.Tolerates(err) {
+				return false, err
+			}
+			warnings = append(warnings, err.Error())
+		}
+		return ok, nil
+	}
+
+	for _, s := range sets {
+		ok, err := next(s)
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, s)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		s := h[0]
+		if v := s.At(); !started || v != last {
+			batch = append(batch, v)
+			last, started = v, true
+		}
+		if len(batch) == batchSize {
+			if err := send(batch, warnings); err != nil {
+				return err
+			}
+			batch, warnings = make([]string, 0, batchSize), nil
+		}
+
+		ok, err := next(s)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	if len(batch) > 0 || len(warnings) > 0 {
+		return send(batch, warnings)
+	}
+	return nil
+}
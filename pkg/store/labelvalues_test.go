@@ -0,0 +1,96 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/strutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestMergeLabelValues(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 100; i++ {
+		var (
+			all  [][]string
+			sets []*labelValuesSet
+		)
+		for j, n := 0, r.Intn(5); j < n; j++ {
+			uniq := map[string]struct{}{}
+			for k := r.Intn(50); k > 0; k-- {
+				uniq[fmt.Sprintf("%03d", r.Intn(100))] = struct{}{}
+			}
+			values := make([]string, 0, len(uniq))
+			for v := range uniq {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+			all = append(all, values)
+
+			// Split values into random batches, including empty ones.
+			var resps []*storepb.LabelValuesStreamResponse
+			for rest := values; len(rest) > 0; {
+				n := r.Intn(len(rest) + 1)
+				resps = append(resps, &storepb.LabelValuesStreamResponse{Values: rest[:n]})
+				rest = rest[n:]
+			}
+			recv := unaryLabelValuesRecv(&storepb.LabelValuesResponse{})
+			if len(resps) > 0 {
+				recv = (&storeLabelValuesStreamClient{respSet: resps}).Recv
+			}
+			sets = append(sets, &labelValuesSet{name: fmt.Sprint(j), recv: recv})
+		}
+
+		batchSize := 1 + r.Intn(10)
+		var merged []string
+		testutil.Ok(t, mergeLabelValues(sets, batchSize, true, PartialResponsePolicy{}, func(values, _ []string) error {
+			testutil.Assert(t, len(values) <= batchSize, "batch of %d values exceeds batch size %d", len(values), batchSize)
+			merged = append(merged, values...)
+			return nil
+		}))
+		testutil.Equals(t, strutil.MergeSlices(all...), merged)
+	}
+}
+
+func TestMergeLabelValues_Unsorted(t *testing.T) {
+	set := &labelValuesSet{name: "a", recv: (&storeLabelValuesStreamClient{respSet: []*storepb.LabelValuesStreamResponse{
+		{Values: []string{"b", "a"}},
+		{Values: []string{"a"}},
+	}}).Recv}
+
+	// Values within a single batch are sorted, but not across batches.
+	testutil.NotOk(t, mergeLabelValues([]*labelValuesSet{set}, 10, true, PartialResponsePolicy{}, func(_, _ []string) error { return nil }))
+}
+
+func TestSendMergedLabelValues(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 1600; i++ {
+		v := fmt.Sprintf("%04d", i)
+		if i%2 == 0 {
+			a = append(a, v)
+		}
+		if i%3 == 0 {
+			b = append(b, v)
+		}
+	}
+
+	srv := newStoreLabelValuesStreamServer(context.Background())
+	testutil.Ok(t, sendMergedLabelValues(srv, []*labelValuesSet{
+		newSliceLabelValuesSet("a", a, []string{"warning a"}),
+		newSliceLabelValuesSet("b", b, nil),
+	}))
+	testutil.Equals(t, strutil.MergeSlices(a, b), srv.Values)
+	testutil.Equals(t, []string{"warning a"}, srv.Warnings)
+
+	// Values are sent in batches while merging.
+	testutil.Equals(t, 2, len(srv.Batches))
+	testutil.Equals(t, labelValuesBatchSize, len(srv.Batches[0]))
+}
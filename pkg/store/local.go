@@ -235,9 +235,27 @@ func (s *LocalStore) LabelNames(_ context.Context, _ *storepb.LabelNamesRequest)
 func (s *LocalStore) LabelValues(_ context.Context, r *storepb.LabelValuesRequest) (
 	*storepb.LabelValuesResponse, error,
 ) {
+	match, newMatchers, err := matchesExternalLabels(r.Matchers, s.extLabels)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &storepb.LabelValuesResponse{}, nil
+	}
+	matchers, err := storepb.TranslateFromPromMatchers(newMatchers...)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	vals := map[string]struct{}{}
+Outer:
 	for _, series := range s.series {
 		lbls := labelpb.LabelsToPromLabels(series.Labels)
+		for _, m := range matchers {
+			if !m.Matches(lbls.Get(m.Name)) {
+				continue Outer
+			}
+		}
 		val := lbls.Get(r.Label)
 		if val == "" {
 			continue
@@ -251,6 +269,15 @@ func (s *LocalStore) LabelValues(_ context.Context, r *storepb.LabelValuesReques
 	return resp, nil
 }
 
+// LabelValuesStream streams all known label values for a given label name.
+func (s *LocalStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	resp, err := s.LabelValues(srv.Context(), req)
+	if err != nil {
+		return err
+	}
+	return sendLabelValues(srv, resp)
+}
+
 func (s *LocalStore) Close() (err error) {
 	return s.c.Close()
 }
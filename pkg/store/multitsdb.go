@@ -341,3 +341,26 @@ func (s *MultiTSDBStore) LabelValues(ctx context.Context, req *storepb.LabelValu
 		Warnings: keys(warnings),
 	}, nil
 }
+
+// LabelValuesStream streams all known label values for a given label name. Sorted values of tenants are merged batch
+// by batch, so that batches are sent while merging and merged values of all tenants are never held in memory at once.
+func (s *MultiTSDBStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	span, ctx := tracing.StartSpan(srv.Context(), "multitsdb_label_values_stream")
+	defer span.Finish()
+
+	stores := s.tsdbStores()
+	sets := make([]*labelValuesSet, 0, len(stores))
+	for tenant, store := range stores {
+		r, err := store.LabelValues(ctx, req)
+		if err != nil {
+			return errors.Wrapf(err, "get label values for tenant %s", tenant)
+		}
+
+		warnings := make([]string, 0, len(r.Warnings))
+		for _, w := range r.Warnings {
+			warnings = append(warnings, prefixTenantWarning(tenant, w))
+		}
+		sets = append(sets, newSliceLabelValuesSet(tenant, r.Values, warnings))
+	}
+	return sendMergedLabelValues(srv, sets)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StoreErrorCategory is a category of errors of StoreAPIs, which partial response policy is decided by.
+type StoreErrorCategory int
+
+const (
+	// StoreUnavailable means the StoreAPI could not be reached or did not respond in time, which is likely transient.
+	StoreUnavailable StoreErrorCategory = iota
+	// StoreFailed means the StoreAPI failed or rejected the request, e.g. because a limit was exceeded or the request
+	// was invalid, which likely happens again for the same request.
+	StoreFailed
+	// QuerierExhausted means the request could not be sent because the querier itself ran out of file descriptors.
+	// Requests to all StoreAPIs fail likewise, so results would be silently missing data of arbitrary StoreAPIs.
+	QuerierExhausted
+)
+
+func (c StoreErrorCategory) String() string {
+	switch c {
+	case StoreUnavailable:
+		return "unavailable"
+	case StoreFailed:
+		return "failed"
+	case QuerierExhausted:
+		return "querier_exhausted"
+	}
+	return "unknown"
+}
+
+// ClassifyStoreError returns the category of the given error of a StoreAPI request. Running out of file descriptors
+// means the querier is exhausted, even if reported as a gRPC Unavailable error of dialing the StoreAPI. Timeouts,
+// cancellations and other gRPC Unavailable errors mean the StoreAPI is unavailable, any other error means the StoreAPI
+// failed.
+func ClassifyStoreError(err error) StoreErrorCategory {
+	if IsFDExhaustion(err) {
+		return QuerierExhausted
+	}
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded || cause == context.Canceled {
+		return StoreUnavailable
+	}
+	if s, ok := status.FromError(cause); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+			return StoreUnavailable
+		}
+	}
+	return StoreFailed
+}
+
+// PartialResponsePolicy decides which errors of StoreAPIs are tolerated as warnings of a partial response, if partial
+// response is enabled for the request. Other errors fail the request. The zero value tolerates all errors.
+type PartialResponsePolicy struct {
+	// FailOnUnavailable fails requests if any StoreAPI is unavailable.
+	FailOnUnavailable bool
+	// FailOnStoreFailure fails requests if any StoreAPI failed, e.g. because of a limit.
+	FailOnStoreFailure bool
+}
+
+// Tolerates returns true if the given StoreAPI error can be returned as a warning of partial response. Errors of the
+// querier running out of file descriptors are never tolerated.
+func (p PartialResponsePolicy) Tolerates(err error) bool {
+	switch ClassifyStoreError(err) {
+	case QuerierExhausted:
+		return false
+	case StoreUnavailable:
+		return !p.FailOnUnavailable
+	default:
+		return !p.FailOnStoreFailure
+	}
+}
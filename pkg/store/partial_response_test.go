@@ -0,0 +1,56 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestClassifyStoreError(t *testing.T) {
+	for _, tcase := range []struct {
+		err      error
+		expected StoreErrorCategory
+	}{
+		{err: status.Error(codes.Unavailable, "connection refused"), expected: StoreUnavailable},
+		{err: status.Error(codes.DeadlineExceeded, "deadline exceeded"), expected: StoreUnavailable},
+		{err: status.Error(codes.Canceled, "canceled"), expected: StoreUnavailable},
+		{err: errors.Wrap(status.Error(codes.Unavailable, "connection refused"), "fetch series"), expected: StoreUnavailable},
+		{err: errors.Wrap(context.DeadlineExceeded, "failed to receive any data in 1s"), expected: StoreUnavailable},
+		{err: errors.Wrap(syscall.EMFILE, "dial tcp"), expected: QuerierExhausted},
+		{err: status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing dial tcp: socket: too many open files\""), expected: QuerierExhausted},
+		{err: status.Error(codes.ResourceExhausted, "exceeded sample limit"), expected: StoreFailed},
+		{err: errors.Wrap(status.Error(codes.InvalidArgument, "bad matcher"), "fetch series"), expected: StoreFailed},
+		{err: status.Error(codes.Internal, "expanding series"), expected: StoreFailed},
+		{err: errors.New("error!"), expected: StoreFailed},
+	} {
+		testutil.Equals(t, tcase.expected, ClassifyStoreError(tcase.err), tcase.err.Error())
+	}
+}
+
+func TestPartialResponsePolicy_Tolerates(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	failed := status.Error(codes.ResourceExhausted, "exceeded sample limit")
+	exhausted := errors.Wrap(syscall.EMFILE, "dial tcp")
+
+	p := PartialResponsePolicy{}
+	testutil.Assert(t, p.Tolerates(unavailable), "zero policy should tolerate unavailable store")
+	testutil.Assert(t, p.Tolerates(failed), "zero policy should tolerate failed store")
+	testutil.Assert(t, !p.Tolerates(exhausted), "expected exhausted querier never tolerated")
+
+	p = PartialResponsePolicy{FailOnStoreFailure: true}
+	testutil.Assert(t, p.Tolerates(unavailable), "expected unavailable store tolerated")
+	testutil.Assert(t, !p.Tolerates(failed), "expected failed store not tolerated")
+
+	p = PartialResponsePolicy{FailOnUnavailable: true}
+	testutil.Assert(t, !p.Tolerates(unavailable), "expected unavailable store not tolerated")
+	testutil.Assert(t, p.Tolerates(failed), "expected failed store tolerated")
+}
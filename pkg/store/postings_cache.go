@@ -0,0 +1,186 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ExpandedPostingsCache remembers series matching a set of matchers in a block for a short time, so that repeated
+// queries with the same, possibly complex, matchers, e.g. from dashboards, do not resolve and intersect the same
+// postings again. Blocks are immutable, so entries of a block are valid until it is unloaded, when they are removed.
+type ExpandedPostingsCache struct {
+	mtx sync.Mutex
+
+	lru      *lru.LRU
+	ttl      time.Duration
+	maxBytes int64
+	curBytes int64
+	// keys holds keys of entries of each block.
+	keys map[ulid.ULID]map[expandedPostingsKey]struct{}
+	now  func() time.Time
+
+	requests      prometheus.Counter
+	hits          prometheus.Counter
+	added         prometheus.Counter
+	evicted       prometheus.Counter
+	invalidations prometheus.Counter
+	currentBytes  prometheus.Gauge
+}
+
+type expandedPostingsKey struct {
+	block    ulid.ULID
+	matchers string
+}
+
+type expandedPostingsEntry struct {
+	postings []uint64
+	expires  time.Time
+}
+
+// NewExpandedPostingsCache returns ExpandedPostingsCache holding entries for at most ttl and at most maxBytes of
+// postings in total.
+func NewExpandedPostingsCache(reg prometheus.Registerer, ttl time.Duration, maxBytes int64) (*ExpandedPostingsCache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("expanded postings cache size must be positive")
+	}
+	c := &ExpandedPostingsCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		keys:     map[ulid.ULID]map[expandedPostingsKey]struct{}{},
+		now:      time.Now,
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_requests_total",
+			Help: "Total number of requests to the expanded postings cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_hits_total",
+			Help: "Total number of requests to the expanded postings cache answered without resolving postings.",
+		}),
+		added: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_items_added_total",
+			Help: "Total number of items added to the expanded postings cache.",
+		}),
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_items_evicted_total",
+			Help: "Total number of items evicted from the expanded postings cache due to its size limit.",
+		}),
+		invalidations: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_items_invalidated_total",
+			Help: "Total number of items removed from the expanded postings cache due to unloaded blocks or expired TTL.",
+		}),
+		currentBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_bucket_store_expanded_postings_cache_bytes",
+			Help: "Current size of postings in the expanded postings cache.",
+		}),
+	}
+
+	// Size is limited by bytes only.
+	l, err := lru.NewLRU(int(^uint(0)>>1), c.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+	return c, nil
+}
+
+func (c *ExpandedPostingsCache) onEvict(k, v interface{}) {
+	key := k.(expandedPostingsKey)
+	c.curBytes -= postingsSize(v.(expandedPostingsEntry).postings)
+	c.currentBytes.Set(float64(c.curBytes))
+
+	keys := c.keys[key.block]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(c.keys, key.block)
+	}
+}
+
+func postingsSize(ps []uint64) int64 {
+	return int64(8 * len(ps))
+}
+
+// expandedPostingsMatchersKey returns key identifying the given matchers regardless of their order.
+func expandedPostingsMatchersKey(ms []*labels.Matcher) string {
+	strs := make([]string, 0, len(ms))
+	for _, m := range ms {
+		strs = append(strs, m.String())
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, "\xff")
+}
+
+// Get returns postings of series of the given block matching the given matchers, if cached. Returned postings must
+// not be modified.
+func (c *ExpandedPostingsCache) Get(id ulid.ULID, ms []*labels.Matcher) ([]uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.requests.Inc()
+
+	key := expandedPostingsKey{block: id, matchers: expandedPostingsMatchersKey(ms)}
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(expandedPostingsEntry)
+	if c.now().After(e.expires) {
+		c.lru.Remove(key)
+		c.invalidations.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	return e.postings, true
+}
+
+// Set caches postings of series of the given block matching the given matchers. The postings must not be modified
+// afterwards. Postings larger than the whole cache are not cached.
+func (c *ExpandedPostingsCache) Set(id ulid.ULID, ms []*labels.Matcher, ps []uint64) {
+	size := postingsSize(ps)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := expandedPostingsKey{block: id, matchers: expandedPostingsMatchersKey(ms)}
+	// Replace the entry if present, so its TTL is refreshed.
+	c.lru.Remove(key)
+	for c.curBytes+size > c.maxBytes {
+		if _, _, ok := c.lru.RemoveOldest(); !ok {
+			break
+		}
+		c.evicted.Inc()
+	}
+	c.lru.Add(key, expandedPostingsEntry{postings: ps, expires: c.now().Add(c.ttl)})
+	c.curBytes += size
+	c.currentBytes.Set(float64(c.curBytes))
+	if _, ok := c.keys[id]; !ok {
+		c.keys[id] = map[expandedPostingsKey]struct{}{}
+	}
+	c.keys[id][key] = struct{}{}
+	c.added.Inc()
+}
+
+// InvalidateBlock removes all entries of the given block.
+func (c *ExpandedPostingsCache) InvalidateBlock(id ulid.ULID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for key := range c.keys[id] {
+		c.lru.Remove(key)
+		c.invalidations.Inc()
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestExpandedPostingsCache(t *testing.T) {
+	block1, block2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	ms := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "a", "1"),
+		labels.MustNewMatcher(labels.MatchRegexp, "b", "2|3"),
+	}
+	reversed := []*labels.Matcher{ms[1], ms[0]}
+
+	c, err := NewExpandedPostingsCache(prometheus.NewRegistry(), time.Minute, 64)
+	testutil.Ok(t, err)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	_, ok := c.Get(block1, ms)
+	testutil.Assert(t, !ok, "expected miss in empty cache")
+
+	c.Set(block1, ms, []uint64{1, 2, 3})
+	ps, ok := c.Get(block1, reversed)
+	testutil.Assert(t, ok, "expected hit regardless of order of matchers")
+	testutil.Equals(t, []uint64{1, 2, 3}, ps)
+	_, ok = c.Get(block2, ms)
+	testutil.Assert(t, !ok, "expected miss for other block")
+	testutil.Equals(t, 3.0, promtest.ToFloat64(c.requests))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(c.hits))
+
+	t.Run("size is bounded", func(t *testing.T) {
+		// 5 postings of block2 fit with 3 of block1 into 64 bytes, another 3 don't.
+		c.Set(block2, ms, []uint64{1, 2, 3, 4, 5})
+		testutil.Equals(t, 64.0, promtest.ToFloat64(c.currentBytes))
+		c.Set(block2, ms[:1], []uint64{1, 2, 3})
+		testutil.Equals(t, 1.0, promtest.ToFloat64(c.evicted))
+		_, ok := c.Get(block1, ms)
+		testutil.Assert(t, !ok, "expected least recently used entry evicted")
+		testutil.Equals(t, 64.0, promtest.ToFloat64(c.currentBytes))
+
+		// Postings larger than the cache are not cached.
+		c.Set(block1, ms, make([]uint64, 9))
+		_, ok = c.Get(block1, ms)
+		testutil.Assert(t, !ok, "expected too large postings not cached")
+	})
+	t.Run("block invalidation", func(t *testing.T) {
+		c.InvalidateBlock(block2)
+		_, ok := c.Get(block2, ms)
+		testutil.Assert(t, !ok, "expected entries of invalidated block removed")
+		_, ok = c.Get(block2, ms[:1])
+		testutil.Assert(t, !ok, "expected entries of invalidated block removed")
+		testutil.Equals(t, 0.0, promtest.ToFloat64(c.currentBytes))
+	})
+	t.Run("expiration", func(t *testing.T) {
+		c.Set(block1, ms, []uint64{1})
+		now = now.Add(time.Minute)
+		_, ok := c.Get(block1, ms)
+		testutil.Assert(t, ok, "expected hit within TTL")
+		now = now.Add(time.Second)
+		_, ok = c.Get(block1, ms)
+		testutil.Assert(t, !ok, "expected miss after TTL")
+	})
+}
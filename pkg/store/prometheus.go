@@ -494,6 +494,36 @@ func (p *PrometheusStore) LabelNames(ctx context.Context, r *storepb.LabelNamesR
 func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
 	externalLset := p.externalLabels()
 
+	match, matchers, err := matchesExternalLabels(r.Matchers, externalLset)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &storepb.LabelValuesResponse{}, nil
+	}
+
+	if len(matchers) > 0 {
+		// Prometheus label values API does not support matchers, gather values of matching series instead.
+		labelMaps, err := p.client.SeriesInGRPC(ctx, p.base, matchers, r.Start, r.End)
+		if err != nil {
+			return nil, err
+		}
+		vals := map[string]struct{}{}
+		for _, lbm := range labelMaps {
+			// External label has priority.
+			v := externalLset.Get(r.Label)
+			if v == "" {
+				v = lbm[r.Label]
+			}
+			if v != "" {
+				vals[v] = struct{}{}
+			}
+		}
+		res := keys(vals)
+		sort.Strings(res)
+		return &storepb.LabelValuesResponse{Values: res}, nil
+	}
+
 	// First check for matching external label which has priority.
 	if l := externalLset.Get(r.Label); l != "" {
 		return &storepb.LabelValuesResponse{Values: []string{l}}, nil
@@ -506,3 +536,12 @@ func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValue
 	sort.Strings(vals)
 	return &storepb.LabelValuesResponse{Values: vals}, nil
 }
+
+// LabelValuesStream streams all known label values for a given label name.
+func (p *PrometheusStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	resp, err := p.LabelValues(srv.Context(), req)
+	if err != nil {
+		return err
+	}
+	return sendLabelValues(srv, resp)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +22,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/strutil"
@@ -28,6 +31,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -36,6 +40,91 @@ type ctxKey int
 // StoreMatcherKey is the context key for the store's allow list.
 const StoreMatcherKey = ctxKey(0)
 
+// FanoutTrackerKey is the context key for the *FanoutTracker recording StoreAPIs queried during Series fan-out.
+const FanoutTrackerKey = ctxKey(1)
+
+// NoCacheMetadataKey is the gRPC metadata key of requests skipping lookups of caches, e.g. to debug behavior against
+// fresh data. Such requests still populate caches.
+const NoCacheMetadataKey = "thanos-nocache"
+
+// WithNoCache returns the context of requests to StoreAPIs skipping lookups of caches.
+func WithNoCache(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, NoCacheMetadataKey, "true")
+}
+
+// IsNoCache returns true if requests sent with the given context skip lookups of caches.
+func IsNoCache(ctx context.Context) bool {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return len(md.Get(NoCacheMetadataKey)) > 0
+}
+
+// isNoCacheRequest returns true if the received request asked to skip lookups of caches.
+func isNoCacheRequest(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(NoCacheMetadataKey)) > 0
+}
+
+// FanoutStoreStatus is the status of a single StoreAPI queried during Series fan-out.
+type FanoutStoreStatus struct {
+	Name      string
+	LabelSets []labels.Labels
+	Failed    bool
+}
+
+// FanoutTracker records StoreAPIs queried during Series fan-out and whether they failed. It is safe for concurrent use,
+// so a single tracker can be shared by all selects of a query.
+type FanoutTracker struct {
+	mtx    sync.Mutex
+	stores map[string]*FanoutStoreStatus
+}
+
+// NewFanoutTracker returns an empty FanoutTracker.
+func NewFanoutTracker() *FanoutTracker {
+	return &FanoutTracker{stores: map[string]*FanoutStoreStatus{}}
+}
+
+func fanoutTrackerFromContext(ctx context.Context) *FanoutTracker {
+	t, _ := ctx.Value(FanoutTrackerKey).(*FanoutTracker)
+	return t
+}
+
+func (t *FanoutTracker) queried(st Client) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if _, ok := t.stores[st.String()]; !ok {
+		t.stores[st.String()] = &FanoutStoreStatus{Name: st.String(), LabelSets: st.LabelSets()}
+	}
+}
+
+func (t *FanoutTracker) failed(name string) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if s, ok := t.stores[name]; ok {
+		s.Failed = true
+	}
+}
+
+// Stores returns statuses of all queried StoreAPIs sorted by name.
+func (t *FanoutTracker) Stores() []FanoutStoreStatus {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ret := make([]FanoutStoreStatus, 0, len(t.stores))
+	for _, s := range t.stores {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
 // Client holds meta information about a store.
 type Client interface {
 	// Client to access the store.
@@ -61,10 +150,29 @@ type ProxyStore struct {
 
 	responseTimeout time.Duration
 	metrics         *proxyStoreMetrics
+	// mergeBufferPool provides chunk slices for merging series returned by multiple StoreAPIs.
+	mergeBufferPool *pool.InstrumentedPool
+
+	// warnCoverageGaps enables warnings about parts of the requested time range not covered by any StoreAPI.
+	warnCoverageGaps bool
+	// dropDuplicateBlocks enables dropping chunks of blocks returned by more than one StoreAPI.
+	dropDuplicateBlocks bool
+	// partialResponsePolicy decides which StoreAPI errors are tolerated if partial response is enabled.
+	partialResponsePolicy PartialResponsePolicy
+	// fdExhaustionGate retries requests to StoreAPIs failing because the process ran out of file descriptors.
+	fdExhaustionGate *fdExhaustionGate
 }
 
 type proxyStoreMetrics struct {
 	emptyStreamResponses prometheus.Counter
+	duplicateBlockChunks prometheus.Counter
+}
+
+// newMergeBufferPool returns the pool of chunk slices of series merged from three or more StoreAPIs.
+func newMergeBufferPool(reg prometheus.Registerer) *pool.InstrumentedPool {
+	return pool.NewInstrumentedPool(extprom.WrapRegistererWithPrefix("thanos_proxy_store_merge_buffer_", reg), func() interface{} {
+		return &[]storepb.AggrChunk{}
+	})
 }
 
 func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
@@ -74,6 +182,10 @@ func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
 		Name: "thanos_proxy_store_empty_stream_responses_total",
 		Help: "Total number of empty responses received.",
 	})
+	m.duplicateBlockChunks = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_proxy_store_duplicate_block_chunks_total",
+		Help: "Total number of chunks dropped because their block was returned by more than one StoreAPI. Counted only if dropping duplicate blocks is enabled.",
+	})
 
 	return &m
 }
@@ -84,6 +196,21 @@ func RegisterStoreServer(storeSrv storepb.StoreServer) func(*grpc.Server) {
 	}
 }
 
+// ProxyStoreOpts configures optional behaviour of a ProxyStore. Zero value disables all of it.
+type ProxyStoreOpts struct {
+	// WarnCoverageGaps enables warnings about parts of the requested time range not covered by any StoreAPI.
+	WarnCoverageGaps bool
+	// DropDuplicateBlocks enables dropping chunks of blocks returned by more than one StoreAPI, e.g. by overlapping
+	// store gateways during resharding, when series of StoreAPIs are merged. StoreAPIs are asked for chunk sources
+	// to tell blocks apart.
+	DropDuplicateBlocks bool
+	// PartialResponsePolicy decides which StoreAPI errors are tolerated if partial response is enabled.
+	PartialResponsePolicy PartialResponsePolicy
+	// FDExhaustionBackoff configures retries of requests to StoreAPIs failing because the process ran out of file
+	// descriptors.
+	FDExhaustionBackoff FDExhaustionBackoff
+}
+
 // NewProxyStore returns a new ProxyStore that uses the given clients that implements storeAPI to fan-in all series to the client.
 // Note that there is no deduplication support. Deduplication should be done on the highest level (just before PromQL).
 func NewProxyStore(
@@ -93,6 +220,7 @@ func NewProxyStore(
 	component component.StoreAPI,
 	selectorLabels labels.Labels,
 	responseTimeout time.Duration,
+	opts ProxyStoreOpts,
 ) *ProxyStore {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -100,12 +228,17 @@ func NewProxyStore(
 
 	metrics := newProxyStoreMetrics(reg)
 	s := &ProxyStore{
-		logger:          logger,
-		stores:          stores,
-		component:       component,
-		selectorLabels:  selectorLabels,
-		responseTimeout: responseTimeout,
-		metrics:         metrics,
+		logger:                logger,
+		stores:                stores,
+		component:             component,
+		selectorLabels:        selectorLabels,
+		responseTimeout:       responseTimeout,
+		metrics:               metrics,
+		mergeBufferPool:       newMergeBufferPool(reg),
+		warnCoverageGaps:      opts.WarnCoverageGaps,
+		dropDuplicateBlocks:   opts.DropDuplicateBlocks,
+		partialResponsePolicy: opts.PartialResponsePolicy,
+		fdExhaustionGate:      newFDExhaustionGate(opts.FDExhaustionBackoff, reg),
 	}
 	return s
 }
@@ -166,6 +299,60 @@ func (s *ProxyStore) Info(_ context.Context, _ *storepb.InfoRequest) (*storepb.I
 	return res, nil
 }
 
+// removeDuplicateBlocks returns chunks without chunks of blocks returned by more than one StoreAPI, and the number of
+// dropped chunks. For each such block, only chunks of the StoreAPI with the lowest name are kept, so that the choice is
+// deterministic. Chunks without block ID, e.g. of sidecars, are always kept.
+func removeDuplicateBlocks(chks []storepb.AggrChunk) ([]storepb.AggrChunk, int) {
+	var (
+		stores map[string]string
+		dup    bool
+	)
+	for _, c := range chks {
+		if c.Source == nil || c.Source.BlockId == "" {
+			continue
+		}
+		if stores == nil {
+			stores = map[string]string{}
+		}
+		st, ok := stores[c.Source.BlockId]
+		if !ok {
+			stores[c.Source.BlockId] = c.Source.Store
+			continue
+		}
+		if st != c.Source.Store {
+			dup = true
+			if c.Source.Store < st {
+				stores[c.Source.BlockId] = c.Source.Store
+			}
+		}
+	}
+	if !dup {
+		return chks, 0
+	}
+
+	ret := make([]storepb.AggrChunk, 0, len(chks))
+	for _, c := range chks {
+		if c.Source != nil && c.Source.BlockId != "" && stores[c.Source.BlockId] != c.Source.Store {
+			continue
+		}
+		ret = append(ret, c)
+	}
+	return ret, len(chks) - len(ret)
+}
+
+// removeDuplicateBlocks drops chunks of blocks returned by more than one StoreAPI from the merged chunks of a series
+// and counts them. Sources of chunks are removed unless the client asked for them.
+func (s *ProxyStore) removeDuplicateBlocks(chks []storepb.AggrChunk, keepSources bool) []storepb.AggrChunk {
+	chks, dropped := removeDuplicateBlocks(chks)
+	s.metrics.duplicateBlockChunks.Add(float64(dropped))
+	if !keepSources {
+		for i := range chks {
+			chks[i].Source = nil
+		}
+	}
+	return chks
+}
+
 // cancelableRespSender is a response channel that does need to be exhausted on cancel.
 type cancelableRespSender struct {
 	ctx context.Context
@@ -201,10 +388,12 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 	}
 
 	g, gctx := errgroup.WithContext(srv.Context())
+	tracker := fanoutTrackerFromContext(gctx)
 
 	// Allow to buffer max 10 series response.
 	// Each might be quite large (multi chunk long series given by sidecar).
 	respSender, respCh := newCancelableRespChannel(gctx, 10)
+	chunkSources := r.ChunkSources
 
 	g.Go(func() error {
 		// This go routine is responsible for calling store's Series concurrently. Merged results
@@ -214,6 +403,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 		var (
 			seriesSet      []storepb.SeriesSet
 			storeDebugMsgs []string
+			covered        []timeRange
 			r              = &storepb.SeriesRequest{
 				MinTime:                 r.MinTime,
 				MaxTime:                 r.MaxTime,
@@ -222,6 +412,9 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 				MaxResolutionWindow:     r.MaxResolutionWindow,
 				SkipChunks:              r.SkipChunks,
 				PartialResponseDisabled: r.PartialResponseDisabled,
+				TailOnly:                r.TailOnly,
+				ChunkSources:            r.ChunkSources || s.dropDuplicateBlocks,
+				WarnCoverageGaps:        r.WarnCoverageGaps || s.warnCoverageGaps,
 			}
 			wg = &sync.WaitGroup{}
 		)
@@ -251,6 +444,10 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 				continue
 			}
 			storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s queried", st))
+			tracker.queried(st)
+
+			storeMinTime, storeMaxTime := st.TimeRange()
+			covered = append(covered, timeRange{mint: storeMinTime, maxt: storeMaxTime})
 
 			// This is used to cancel this stream when one operations takes too long.
 			seriesCtx, closeSeries := context.WithCancel(gctx)
@@ -259,25 +456,39 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 			})
 			defer closeSeries()
 
-			sc, err := st.Series(seriesCtx, r)
+			openSeries := func() (storepb.Store_SeriesClient, error) { return st.Series(seriesCtx, r) }
+			var sc storepb.Store_SeriesClient
+			err := s.fdExhaustionGate.do(seriesCtx, func() (err error) {
+				sc, err = openSeries()
+				return err
+			})
 			if err != nil {
 				storeID := labelpb.PromLabelSetsToString(st.LabelSets())
 				if storeID == "" {
 					storeID = "Store Gateway"
 				}
 				err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
+				tracker.failed(st.String())
 				if r.PartialResponseDisabled {
 					level.Error(s.logger).Log("err", err, "msg", "partial response disabled; aborting request")
 					return err
 				}
+				if !s.partialResponsePolicy.Tolerates(err) {
+					level.Error(s.logger).Log("err", err, "msg", "store error not tolerated by partial response policy; aborting request", "category", ClassifyStoreError(err))
+					return err
+				}
 				respSender.send(storepb.NewWarnSeriesResponse(err))
 				continue
 			}
 
 			// Schedule streamSeriesSet that translates gRPC streamed response
 			// into seriesSet (if series) or respCh if warnings.
-			seriesSet = append(seriesSet, startStreamSeriesSet(seriesCtx, s.logger, closeSeries,
-				wg, sc, respSender, st.String(), !r.PartialResponseDisabled, s.responseTimeout, s.metrics.emptyStreamResponses))
+			var set storepb.SeriesSet = startStreamSeriesSet(seriesCtx, s.logger, closeSeries,
+				wg, s.fdExhaustionGate.seriesClient(seriesCtx, sc, openSeries), respSender, st.String(), !r.PartialResponseDisabled, s.partialResponsePolicy, s.responseTimeout, s.metrics.emptyStreamResponses)
+			if r.ChunkSources {
+				set = storepb.NewChunkSourceSeriesSet(set, storepb.ChunkSource{Store: st.String()})
+			}
+			seriesSet = append(seriesSet, set)
 		}
 
 		level.Debug(s.logger).Log("msg", strings.Join(storeDebugMsgs, ";"))
@@ -289,13 +500,22 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 			return nil
 		}
 
+		if r.WarnCoverageGaps {
+			for _, w := range storeCoverageWarnings(r.MinTime, r.MaxTime, covered) {
+				respSender.send(storepb.NewWarnSeriesResponse(w))
+			}
+		}
+
 		// TODO(bwplotka): Currently we stream into big frames. Consider ensuring 1MB maximum.
 		// This however does not matter much when used with QueryAPI. Matters for federated Queries a lot.
 		// https://github.com/thanos-io/thanos/issues/2332
 		// Series are not necessarily merged across themselves.
-		mergedSet := storepb.MergeSeriesSets(seriesSet...)
+		mergedSet := storepb.MergeSeriesSetsWithPool(s.mergeBufferPool, seriesSet...)
 		for mergedSet.Next() {
 			lset, chk := mergedSet.At()
+			if s.dropDuplicateBlocks {
+				chk = s.removeDuplicateBlocks(chk, chunkSources)
+			}
 			respSender.send(storepb.NewSeriesResponse(&storepb.Series{Labels: labelpb.LabelsFromPromLabels(lset), Chunks: chk}))
 		}
 		return mergedSet.Err()
@@ -318,6 +538,27 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 	return nil
 }
 
+// MatchingStores returns StoreAPIs a Series request with the given time range and matchers is sent to, and the ones
+// pruned as their time range, external labels or the store debug matchers of the context can't match it.
+func (s *ProxyStore) MatchingStores(ctx context.Context, mint, maxt int64, matchers []storepb.LabelMatcher) (matching, pruned []Client, err error) {
+	match, newMatchers, err := matchesExternalLabels(matchers, s.selectorLabels)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var storeDebugMatchers [][]*labels.Matcher
+	if value, ok := ctx.Value(StoreMatcherKey).([][]*labels.Matcher); ok {
+		storeDebugMatchers = value
+	}
+	for _, st := range s.stores() {
+		if ok, _ := storeMatches(st, mint, maxt, storeDebugMatchers, newMatchers...); !match || !ok {
+			pruned = append(pruned, st)
+			continue
+		}
+		matching = append(matching, st)
+	}
+	return matching, pruned, nil
+}
+
 type directSender interface {
 	send(*storepb.SeriesResponse)
 }
@@ -339,6 +580,7 @@ type streamSeriesSet struct {
 
 	name            string
 	partialResponse bool
+	policy          PartialResponsePolicy
 
 	responseTimeout time.Duration
 	closeSeries     context.CancelFunc
@@ -368,6 +610,7 @@ func startStreamSeriesSet(
 	warnCh directSender,
 	name string,
 	partialResponse bool,
+	policy PartialResponsePolicy,
 	responseTimeout time.Duration,
 	emptyStreamResponses prometheus.Counter,
 ) *streamSeriesSet {
@@ -380,6 +623,7 @@ func startStreamSeriesSet(
 		recvCh:          make(chan *storepb.Series, 10),
 		name:            name,
 		partialResponse: partialResponse,
+		policy:          policy,
 		responseTimeout: responseTimeout,
 	}
 
@@ -453,8 +697,9 @@ func startStreamSeriesSet(
 func (s *streamSeriesSet) handleErr(err error, done chan struct{}) {
 	defer close(done)
 	s.closeSeries()
+	fanoutTrackerFromContext(s.ctx).failed(s.name)
 
-	if s.partialResponse {
+	if s.partialResponse && s.policy.Tolerates(err) {
 		level.Warn(s.logger).Log("err", err, "msg", "returning partial response")
 		s.warnCh.send(storepb.NewWarnSeriesResponse(err))
 		return
@@ -567,14 +812,18 @@ func (s *ProxyStore) LabelNames(ctx context.Context, r *storepb.LabelNamesReques
 		storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s queried", st))
 
 		g.Go(func() error {
-			resp, err := st.LabelNames(gctx, &storepb.LabelNamesRequest{
-				PartialResponseDisabled: r.PartialResponseDisabled,
-				Start:                   r.Start,
-				End:                     r.End,
+			var resp *storepb.LabelNamesResponse
+			err := s.fdExhaustionGate.do(gctx, func() (err error) {
+				resp, err = st.LabelNames(gctx, &storepb.LabelNamesRequest{
+					PartialResponseDisabled: r.PartialResponseDisabled,
+					Start:                   r.Start,
+					End:                     r.End,
+				})
+				return err
 			})
 			if err != nil {
 				err = errors.Wrapf(err, "fetch label names from store %s", st)
-				if r.PartialResponseDisabled {
+				if r.PartialResponseDisabled || !s.partialResponsePolicy.Tolerates(err) {
 					return err
 				}
 
@@ -616,6 +865,10 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 		storeDebugMsgs []string
 	)
 
+	if _, err := storepb.TranslateFromPromMatchers(r.Matchers...); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	for _, st := range s.stores() {
 		store := st
 		var ok bool
@@ -627,7 +880,7 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 				}
 			}
 			// We can skip error, we already translated matchers once.
-			ok, _ = storeMatches(st, r.Start, r.End, storeDebugMatcher)
+			ok, _ = storeMatches(st, r.Start, r.End, storeDebugMatcher, r.Matchers...)
 		})
 		if !ok {
 			storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s filtered out", st))
@@ -636,15 +889,20 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 		storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s queried", st))
 
 		g.Go(func() error {
-			resp, err := store.LabelValues(gctx, &storepb.LabelValuesRequest{
-				Label:                   r.Label,
-				PartialResponseDisabled: r.PartialResponseDisabled,
-				Start:                   r.Start,
-				End:                     r.End,
+			var resp *storepb.LabelValuesResponse
+			err := s.fdExhaustionGate.do(gctx, func() (err error) {
+				resp, err = store.LabelValues(gctx, &storepb.LabelValuesRequest{
+					Label:                   r.Label,
+					PartialResponseDisabled: r.PartialResponseDisabled,
+					Start:                   r.Start,
+					End:                     r.End,
+					Matchers:                r.Matchers,
+				})
+				return err
 			})
 			if err != nil {
 				err = errors.Wrapf(err, "fetch label values from store %s", store)
-				if r.PartialResponseDisabled {
+				if r.PartialResponseDisabled || !s.partialResponsePolicy.Tolerates(err) {
 					return err
 				}
 
@@ -673,3 +931,116 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 		Warnings: warnings,
 	}, nil
 }
+
+// LabelValuesStream streams all known label values for a given label name, merged incrementally from streams of all
+// matching stores, so that values of all stores are never held in memory at once. Stores not supporting streaming are
+// queried with LabelValues instead.
+func (s *ProxyStore) LabelValuesStream(r *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	var (
+		ctx, cancel    = context.WithCancel(srv.Context())
+		stores         []Client
+		wg             sync.WaitGroup
+		storeDebugMsgs []string
+	)
+	defer cancel()
+
+	if _, err := storepb.TranslateFromPromMatchers(r.Matchers...); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	for _, st := range s.stores() {
+		store := st
+		var ok bool
+		tracing.DoInSpan(ctx, "store_matches", func(ctx context.Context) {
+			var storeDebugMatcher [][]*labels.Matcher
+			if ctxVal := ctx.Value(StoreMatcherKey); ctxVal != nil {
+				if value, ok := ctxVal.([][]*labels.Matcher); ok {
+					storeDebugMatcher = value
+				}
+			}
+			// We can skip error, we already translated matchers once.
+			ok, _ = storeMatches(st, r.Start, r.End, storeDebugMatcher, r.Matchers...)
+		})
+		if !ok {
+			storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s filtered out", st))
+			continue
+		}
+		storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s queried", st))
+
+		stores = append(stores, store)
+	}
+
+	req := &storepb.LabelValuesRequest{
+		Label:                   r.Label,
+		PartialResponseDisabled: r.PartialResponseDisabled,
+		Start:                   r.Start,
+		End:                     r.End,
+		Matchers:                r.Matchers,
+	}
+	// First batches of all stores are fetched concurrently.
+	sets := make([]*labelValuesSet, len(stores))
+	for i, st := range stores {
+		wg.Add(1)
+		go func(i int, st Client) {
+			defer wg.Done()
+			sets[i] = openLabelValuesSet(ctx, s.fdExhaustionGate, st, req)
+		}(i, st)
+	}
+	wg.Wait()
+	level.Debug(s.logger).Log("msg", strings.Join(storeDebugMsgs, ";"))
+
+	return mergeLabelValues(sets, labelValuesBatchSize, r.PartialResponseDisabled, s.partialResponsePolicy, func(values, warnings []string) error {
+		return srv.Send(&storepb.LabelValuesStreamResponse{Values: values, Warnings: warnings})
+	})
+}
+
+// openLabelValuesSet opens label values stream of the given store and receives its first batch. Stores not supporting
+// streaming yet are queried with LabelValues instead. Opening the set is retried while it fails because of file
+// descriptor exhaustion.
+func openLabelValuesSet(ctx context.Context, gate *fdExhaustionGate, store Client, r *storepb.LabelValuesRequest) *labelValuesSet {
+	set := &labelValuesSet{name: store.String()}
+	first := func(resp *storepb.LabelValuesStreamResponse, err error) {
+		next := set.recv
+		set.recv = func() (*storepb.LabelValuesStreamResponse, error) {
+			set.recv = next
+			return resp, err
+		}
+	}
+
+	var (
+		cl      storepb.Store_LabelValuesStreamClient
+		resp    *storepb.LabelValuesStreamResponse
+		openErr error
+	)
+	err := gate.do(ctx, func() (err error) {
+		if cl, openErr = store.LabelValuesStream(ctx, r); openErr != nil {
+			return openErr
+		}
+		resp, err = cl.Recv()
+		return err
+	})
+	if openErr != nil {
+		first(nil, err)
+		return set
+	}
+	set.recv = func() (*storepb.LabelValuesStreamResponse, error) {
+		resp, err := cl.Recv()
+		return resp, gate.wrap(err)
+	}
+	if status.Code(err) != codes.Unimplemented {
+		first(resp, err)
+		return set
+	}
+
+	var unaryResp *storepb.LabelValuesResponse
+	err = gate.do(ctx, func() (err error) {
+		unaryResp, err = store.LabelValues(ctx, r)
+		return err
+	})
+	if err != nil {
+		first(nil, err)
+		return set
+	}
+	set.recv = unaryLabelValuesRecv(unaryResp)
+	return set
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -40,6 +41,7 @@ type testClient struct {
 	labelSets []labels.Labels
 	minTime   int64
 	maxTime   int64
+	name      string
 }
 
 func (c testClient) LabelSets() []labels.Labels {
@@ -51,6 +53,9 @@ func (c testClient) TimeRange() (int64, int64) {
 }
 
 func (c testClient) String() string {
+	if c.name != "" {
+		return c.name
+	}
 	return "test"
 }
 
@@ -68,7 +73,7 @@ func TestProxyStore_Info(t *testing.T) {
 		nil,
 		func() []Client { return nil },
 		component.Query,
-		nil, 0*time.Second,
+		nil, 0*time.Second, ProxyStoreOpts{},
 	)
 
 	resp, err := q.Info(ctx, &storepb.InfoRequest{})
@@ -477,6 +482,7 @@ func TestProxyStore_Series(t *testing.T) {
 				component.Query,
 				tc.selectorLabels,
 				0*time.Second,
+				ProxyStoreOpts{},
 			)
 
 			ctx := context.Background()
@@ -501,6 +507,182 @@ func TestProxyStore_Series(t *testing.T) {
 	}
 }
 
+func TestProxyStore_Series_FanoutTracker(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	cls := []Client{
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespSeries: []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}})},
+			},
+			labelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "1")},
+			minTime:   1,
+			maxTime:   300,
+			name:      "replica-1",
+		},
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespError: errors.New("connection refused"),
+			},
+			labelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "2")},
+			minTime:   1,
+			maxTime:   300,
+			name:      "replica-2",
+		},
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				injectedError: errors.New("stream broken"),
+			},
+			labelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "3")},
+			minTime:   1,
+			maxTime:   300,
+			name:      "replica-3",
+		},
+		&testClient{
+			StoreClient: &mockedStoreAPI{},
+			labelSets:   []labels.Labels{labels.FromStrings("cluster", "x", "replica", "4")},
+			minTime:     500,
+			maxTime:     600,
+			name:        "replica-4",
+		},
+	}
+	q := NewProxyStore(nil,
+		nil,
+		func() []Client { return cls },
+		component.Query,
+		nil,
+		0*time.Second,
+		ProxyStoreOpts{},
+	)
+
+	tracker := NewFanoutTracker()
+	s := newStoreSeriesServer(context.WithValue(context.Background(), FanoutTrackerKey, tracker))
+	testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+		MinTime:  1,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+	}, s))
+	testutil.Equals(t, 2, len(s.Warnings))
+
+	// Replica 4 is filtered out by its time range, so it is not reported.
+	testutil.Equals(t, []FanoutStoreStatus{
+		{Name: "replica-1", LabelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "1")}},
+		{Name: "replica-2", LabelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "2")}, Failed: true},
+		{Name: "replica-3", LabelSets: []labels.Labels{labels.FromStrings("cluster", "x", "replica", "3")}, Failed: true},
+	}, tracker.Stores())
+}
+
+func TestProxyStore_Series_ChunkSources(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	withBlock := storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}})
+	withBlock.GetSeries().Chunks[0].Source = &storepb.ChunkSource{BlockId: "block-1"}
+	storeA := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{withBlock}}
+	storeB := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{2, 2}})}}
+	cls := []Client{
+		&testClient{StoreClient: storeA, minTime: 1, maxTime: 300, name: "store-a"},
+		&testClient{StoreClient: storeB, minTime: 1, maxTime: 300, name: "store-b"},
+	}
+	q := NewProxyStore(nil,
+		nil,
+		func() []Client { return cls },
+		component.Query,
+		nil,
+		0*time.Second,
+		ProxyStoreOpts{},
+	)
+
+	s := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+		MinTime:      1,
+		MaxTime:      300,
+		Matchers:     []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+		ChunkSources: true,
+	}, s))
+	testutil.Assert(t, storeA.LastSeriesReq.ChunkSources, "chunk sources not requested from store")
+
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, 2, len(s.SeriesSet[0].Chunks))
+	testutil.Equals(t, &storepb.ChunkSource{Store: "store-a", BlockId: "block-1"}, s.SeriesSet[0].Chunks[0].Source)
+	testutil.Equals(t, &storepb.ChunkSource{Store: "store-b"}, s.SeriesSet[0].Chunks[1].Source)
+}
+
+func TestProxyStore_Series_DropDuplicateBlocks(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	for _, tcase := range []struct {
+		drop, chunkSources bool
+		expected           []*storepb.ChunkSource
+	}{
+		{
+			// Identical chunks of the same block from different StoreAPIs are all passed on.
+			chunkSources: true,
+			expected: []*storepb.ChunkSource{
+				{Store: "store-c"},
+				{Store: "store-a", BlockId: "block-1"},
+				{Store: "store-b", BlockId: "block-1"},
+				{Store: "store-b", BlockId: "block-2"},
+			},
+		},
+		{
+			// Only the copy of the StoreAPI with the lowest name is kept, chunks without block ID are kept.
+			drop:     true,
+			expected: []*storepb.ChunkSource{nil, nil, nil},
+		},
+		{
+			drop:         true,
+			chunkSources: true,
+			expected: []*storepb.ChunkSource{
+				{Store: "store-c"},
+				{Store: "store-a", BlockId: "block-1"},
+				{Store: "store-b", BlockId: "block-2"},
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("drop=%v,chunkSources=%v", tcase.drop, tcase.chunkSources), func(t *testing.T) {
+			withBlocks := func(resp *storepb.SeriesResponse, blocks ...string) *storepb.SeriesResponse {
+				for i, b := range blocks {
+					resp.GetSeries().Chunks[i].Source = &storepb.ChunkSource{BlockId: b}
+				}
+				return resp
+			}
+			// Store B serves a copy of block 1, e.g. during resharding. Sidecar C has the same samples.
+			storeA := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+				withBlocks(storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}}), "block-1"),
+			}}
+			storeB := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+				withBlocks(storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}}, []sample{{5, 5}}), "block-1", "block-2"),
+			}}
+			storeC := &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+				storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}}),
+			}}
+			cls := []Client{
+				&testClient{StoreClient: storeB, minTime: 1, maxTime: 300, name: "store-b"},
+				&testClient{StoreClient: storeA, minTime: 1, maxTime: 300, name: "store-a"},
+				&testClient{StoreClient: storeC, minTime: 1, maxTime: 300, name: "store-c"},
+			}
+			q := NewProxyStore(nil, nil, func() []Client { return cls }, component.Query, nil, 0*time.Second, ProxyStoreOpts{DropDuplicateBlocks: tcase.drop})
+
+			s := newStoreSeriesServer(context.Background())
+			testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+				MinTime:      1,
+				MaxTime:      300,
+				Matchers:     []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+				ChunkSources: tcase.chunkSources,
+			}, s))
+			testutil.Equals(t, tcase.drop || tcase.chunkSources, storeA.LastSeriesReq.ChunkSources)
+
+			testutil.Equals(t, 1, len(s.SeriesSet))
+			var srcs []*storepb.ChunkSource
+			for _, c := range s.SeriesSet[0].Chunks {
+				srcs = append(srcs, c.Source)
+			}
+			testutil.Equals(t, tcase.expected, srcs)
+			testutil.Equals(t, float64(4-len(tcase.expected)), promtest.ToFloat64(q.metrics.duplicateBlockChunks))
+		})
+	}
+}
+
 func TestProxyStore_SeriesSlowStores(t *testing.T) {
 	enable := os.Getenv("THANOS_ENABLE_STORE_READ_TIMEOUT_TESTS")
 	if enable == "" {
@@ -1000,6 +1182,7 @@ func TestProxyStore_SeriesSlowStores(t *testing.T) {
 				component.Query,
 				tc.selectorLabels,
 				4*time.Second,
+				ProxyStoreOpts{},
 			)
 
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -1049,6 +1232,7 @@ func TestProxyStore_Series_RequestParamsProxied(t *testing.T) {
 		component.Query,
 		nil,
 		0*time.Second,
+		ProxyStoreOpts{},
 	)
 
 	ctx := context.Background()
@@ -1070,6 +1254,83 @@ func TestProxyStore_Series_RequestParamsProxied(t *testing.T) {
 	testutil.Assert(t, proto.Equal(req, m.LastSeriesReq), "request was not proxied properly to underlying storeAPI: %s vs %s", req, m.LastSeriesReq)
 }
 
+func TestProxyStore_Series_CoverageGapWarnings(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	newClient := func(mint, maxt int64) Client {
+		return &testClient{
+			StoreClient: &mockedStoreAPI{
+				RespSeries: []*storepb.SeriesResponse{
+					storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{mint, 1}}),
+				},
+			},
+			minTime: mint,
+			maxTime: maxt,
+		}
+	}
+	req := &storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+	}
+
+	for _, tcase := range []struct {
+		title            string
+		warnCoverageGaps bool
+		mint, maxt       int64
+		expectedWarnings []string
+	}{
+		{
+			title:            "covered range",
+			warnCoverageGaps: true,
+			mint:             1000,
+			maxt:             1999,
+		},
+		{
+			title:            "gaps before, between and after stores",
+			warnCoverageGaps: true,
+			mint:             0,
+			maxt:             5000,
+			expectedWarnings: []string{
+				"no StoreAPI has data for time range 1970-01-01T00:00:00Z - 1970-01-01T00:00:00.999Z of the query: data older than 1970-01-01T00:00:01Z is no longer available, e.g. due to retention",
+				"no StoreAPI has data for time range 1970-01-01T00:00:02Z - 1970-01-01T00:00:02.999Z of the query: data in this range is not available",
+				"no StoreAPI has data for time range 1970-01-01T00:00:04Z - 1970-01-01T00:00:05Z of the query: data newer than 1970-01-01T00:00:04Z is not available yet",
+			},
+		},
+		{
+			title: "gaps without warnings enabled",
+			mint:  0,
+			maxt:  5000,
+		},
+	} {
+		if ok := t.Run(tcase.title, func(t *testing.T) {
+			cls := []Client{newClient(1000, 2000), newClient(3000, 4000)}
+			q := NewProxyStore(nil,
+				nil,
+				func() []Client { return cls },
+				component.Query,
+				nil,
+				0*time.Second,
+				ProxyStoreOpts{WarnCoverageGaps: tcase.warnCoverageGaps},
+			)
+
+			s := newStoreSeriesServer(context.Background())
+			r := *req
+			r.MinTime, r.MaxTime = tcase.mint, tcase.maxt
+			testutil.Ok(t, q.Series(&r, s))
+			testutil.Equals(t, 1, len(s.SeriesSet))
+			testutil.Equals(t, tcase.expectedWarnings, s.Warnings)
+
+			// Queried stores are asked to warn about their own gaps, e.g. between blocks, as well.
+			for _, cl := range cls {
+				if lastReq := cl.(*testClient).StoreClient.(*mockedStoreAPI).LastSeriesReq; lastReq != nil {
+					testutil.Equals(t, tcase.warnCoverageGaps, lastReq.WarnCoverageGaps)
+				}
+			}
+		}); !ok {
+			return
+		}
+	}
+}
+
 func TestProxyStore_Series_RegressionFillResponseChannel(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
 
@@ -1109,6 +1370,7 @@ func TestProxyStore_Series_RegressionFillResponseChannel(t *testing.T) {
 		component.Query,
 		labels.FromStrings("fed", "a"),
 		0*time.Second,
+		ProxyStoreOpts{},
 	)
 
 	ctx := context.Background()
@@ -1136,11 +1398,14 @@ func TestProxyStore_LabelValues(t *testing.T) {
 	}
 	cls := []Client{
 		&testClient{StoreClient: m1},
-		&testClient{StoreClient: &mockedStoreAPI{
-			RespLabelValues: &storepb.LabelValuesResponse{
-				Values: []string{"3", "4"},
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespLabelValues: &storepb.LabelValuesResponse{
+					Values: []string{"3", "4"},
+				},
 			},
-		}},
+			labelSets: []labels.Labels{labels.FromStrings("ext", "b")},
+		},
 		&testClient{StoreClient: &mockedStoreAPI{
 			RespLabelValues: &storepb.LabelValuesResponse{
 				Values: []string{"5", "6"},
@@ -1155,6 +1420,7 @@ func TestProxyStore_LabelValues(t *testing.T) {
 		component.Query,
 		nil,
 		0*time.Second,
+		ProxyStoreOpts{},
 	)
 
 	ctx := context.Background()
@@ -1184,6 +1450,254 @@ func TestProxyStore_LabelValues(t *testing.T) {
 
 	testutil.Equals(t, []string{"1", "2", "3", "4"}, resp.Values)
 	testutil.Equals(t, 1, len(resp.Warnings))
+
+	// Matchers are pushed down and stores with not matching external labels are skipped.
+	req = &storepb.LabelValuesRequest{
+		Label:                   "a",
+		PartialResponseDisabled: true,
+		Start:                   timestamp.FromTime(minTime),
+		End:                     timestamp.FromTime(maxTime),
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "1"},
+			{Type: storepb.LabelMatcher_NEQ, Name: "ext", Value: "b"},
+		},
+	}
+	resp, err = q.LabelValues(ctx, req)
+	testutil.Ok(t, err)
+	testutil.Assert(t, proto.Equal(req, m1.LastLabelValuesReq), "request was not proxied properly to underlying storeAPI: %s vs %s", req, m1.LastLabelValuesReq)
+
+	testutil.Equals(t, []string{"1", "2", "5", "6"}, resp.Values)
+
+	// Invalid matchers are rejected.
+	_, err = q.LabelValues(ctx, &storepb.LabelValuesRequest{
+		Label:    "a",
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "b", Value: "("}},
+	})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestProxyStore_LabelValuesStream(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	m1 := &mockedStoreAPI{
+		RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{
+			{Values: []string{"1", "3"}, Warnings: []string{"warning"}},
+			{Values: []string{"5", "7"}},
+		},
+	}
+	cls := []Client{
+		&testClient{StoreClient: m1, labelSets: []labels.Labels{labels.FromStrings("ext", "a")}},
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{
+					{Values: []string{"2", "3"}},
+					{Values: []string{"4"}},
+					{Values: []string{"8"}},
+				},
+			},
+			labelSets: []labels.Labels{labels.FromStrings("ext", "a")},
+		},
+		// Store not supporting streaming yet.
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespLabelValues: &storepb.LabelValuesResponse{Values: []string{"6", "1"}},
+			},
+			labelSets: []labels.Labels{labels.FromStrings("ext", "a")},
+		},
+		&testClient{
+			StoreClient: &mockedStoreAPI{
+				RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{{Values: []string{"9"}}},
+			},
+			labelSets: []labels.Labels{labels.FromStrings("ext", "b")},
+		},
+	}
+	q := NewProxyStore(nil,
+		nil,
+		func() []Client { return cls },
+		component.Query,
+		nil,
+		0*time.Second,
+		ProxyStoreOpts{},
+	)
+
+	ctx := context.Background()
+	req := &storepb.LabelValuesRequest{
+		Label:                   "a",
+		PartialResponseDisabled: true,
+		Start:                   timestamp.FromTime(minTime),
+		End:                     timestamp.FromTime(maxTime),
+	}
+	srv := newStoreLabelValuesStreamServer(ctx)
+	testutil.Ok(t, q.LabelValuesStream(req, srv))
+	testutil.Assert(t, proto.Equal(req, m1.LastLabelValuesReq), "request was not proxied properly to underlying storeAPI: %s vs %s", req, m1.LastLabelValuesReq)
+	testutil.Equals(t, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}, srv.Values)
+	testutil.Equals(t, []string{"warning"}, srv.Warnings)
+
+	// Streaming merge returns the same result as merge of whole responses.
+	for _, cl := range cls {
+		m := cl.(*testClient).StoreClient.(*mockedStoreAPI)
+		if m.RespLabelValues != nil {
+			continue
+		}
+		m.RespLabelValues = &storepb.LabelValuesResponse{}
+		for _, r := range m.RespLabelValuesStream {
+			m.RespLabelValues.Values = append(m.RespLabelValues.Values, r.Values...)
+			m.RespLabelValues.Warnings = append(m.RespLabelValues.Warnings, r.Warnings...)
+		}
+	}
+	resp, err := q.LabelValues(ctx, req)
+	testutil.Ok(t, err)
+	testutil.Equals(t, resp.Values, srv.Values)
+	testutil.Equals(t, resp.Warnings, srv.Warnings)
+
+	// Matchers are pushed down and stores with not matching external labels are skipped.
+	req.Matchers = []storepb.LabelMatcher{{Name: "ext", Value: "b", Type: storepb.LabelMatcher_EQ}}
+	srv = newStoreLabelValuesStreamServer(ctx)
+	testutil.Ok(t, q.LabelValuesStream(req, srv))
+	testutil.Equals(t, []string{"9"}, srv.Values)
+}
+
+func TestProxyStore_LabelValuesStream_PartialResponse(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	cls := []Client{
+		&testClient{StoreClient: &mockedStoreAPI{
+			RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{{Values: []string{"1"}}},
+		}},
+		&testClient{StoreClient: &mockedStoreAPI{RespError: errors.New("error!")}},
+	}
+	q := NewProxyStore(nil,
+		nil,
+		func() []Client { return cls },
+		component.Query,
+		nil,
+		0*time.Second,
+		ProxyStoreOpts{},
+	)
+	req := &storepb.LabelValuesRequest{
+		Label: "a",
+		Start: timestamp.FromTime(minTime),
+		End:   timestamp.FromTime(maxTime),
+	}
+
+	srv := newStoreLabelValuesStreamServer(context.Background())
+	testutil.Ok(t, q.LabelValuesStream(req, srv))
+	testutil.Equals(t, []string{"1"}, srv.Values)
+	testutil.Equals(t, 1, len(srv.Warnings))
+
+	req.PartialResponseDisabled = true
+	testutil.NotOk(t, q.LabelValuesStream(req, newStoreLabelValuesStreamServer(context.Background())))
+}
+
+func TestProxyStore_PartialResponsePolicy(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	for _, tcase := range []struct {
+		name string
+		// store returns the failing store.
+		store func() *mockedStoreAPI
+		// failsWith is the policy that makes requests fail because of the store.
+		failsWith PartialResponsePolicy
+	}{
+		{
+			name: "unreachable store",
+			store: func() *mockedStoreAPI {
+				return &mockedStoreAPI{RespError: status.Error(codes.Unavailable, "connection refused")}
+			},
+			failsWith: PartialResponsePolicy{FailOnUnavailable: true},
+		},
+		{
+			name: "store timing out while streaming",
+			store: func() *mockedStoreAPI {
+				return &mockedStoreAPI{injectedError: status.Error(codes.DeadlineExceeded, "deadline exceeded")}
+			},
+			failsWith: PartialResponsePolicy{FailOnUnavailable: true},
+		},
+		{
+			name: "store exceeding limit",
+			store: func() *mockedStoreAPI {
+				return &mockedStoreAPI{RespError: status.Error(codes.ResourceExhausted, "exceeded sample limit")}
+			},
+			failsWith: PartialResponsePolicy{FailOnStoreFailure: true},
+		},
+		{
+			name: "store failing while streaming",
+			store: func() *mockedStoreAPI {
+				return &mockedStoreAPI{injectedError: status.Error(codes.ResourceExhausted, "exceeded sample limit")}
+			},
+			failsWith: PartialResponsePolicy{FailOnStoreFailure: true},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// Tolerating policy is the one failing with the other category only.
+			tolerates := PartialResponsePolicy{FailOnUnavailable: !tcase.failsWith.FailOnUnavailable, FailOnStoreFailure: !tcase.failsWith.FailOnStoreFailure}
+			for _, policy := range []PartialResponsePolicy{{}, tolerates, tcase.failsWith} {
+				failing := tcase.store()
+				cls := []Client{
+					&testClient{
+						StoreClient: &mockedStoreAPI{
+							RespSeries:            []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}})},
+							RespLabelNames:        &storepb.LabelNamesResponse{Names: []string{"a"}},
+							RespLabelValues:       &storepb.LabelValuesResponse{Values: []string{"b"}},
+							RespLabelValuesStream: []*storepb.LabelValuesStreamResponse{{Values: []string{"b"}}},
+						},
+						minTime: math.MinInt64,
+						maxTime: math.MaxInt64,
+					},
+					&testClient{StoreClient: failing, minTime: math.MinInt64, maxTime: math.MaxInt64},
+				}
+				q := NewProxyStore(nil, nil, func() []Client { return cls }, component.Query, nil, 0*time.Second, ProxyStoreOpts{PartialResponsePolicy: policy})
+				fail := policy == tcase.failsWith
+
+				srv := newStoreSeriesServer(context.Background())
+				err := q.Series(&storepb.SeriesRequest{
+					MinTime:  1,
+					MaxTime:  300,
+					Matchers: []storepb.LabelMatcher{{Name: "a", Value: "b", Type: storepb.LabelMatcher_EQ}},
+				}, srv)
+				if fail {
+					testutil.NotOk(t, err)
+				} else {
+					testutil.Ok(t, err)
+					testutil.Equals(t, 1, len(srv.SeriesSet))
+					testutil.Equals(t, 1, len(srv.Warnings))
+				}
+
+				// Label requests are failed by stores failing to respond only.
+				if failing.injectedError != nil {
+					continue
+				}
+				names, err := q.LabelNames(context.Background(), &storepb.LabelNamesRequest{Start: 1, End: 300})
+				if fail {
+					testutil.NotOk(t, err)
+				} else {
+					testutil.Ok(t, err)
+					testutil.Equals(t, []string{"a"}, names.Names)
+					testutil.Equals(t, 1, len(names.Warnings))
+				}
+
+				values, err := q.LabelValues(context.Background(), &storepb.LabelValuesRequest{Label: "a", Start: 1, End: 300})
+				if fail {
+					testutil.NotOk(t, err)
+				} else {
+					testutil.Ok(t, err)
+					testutil.Equals(t, []string{"b"}, values.Values)
+					testutil.Equals(t, 1, len(values.Warnings))
+				}
+
+				vsrv := newStoreLabelValuesStreamServer(context.Background())
+				err = q.LabelValuesStream(&storepb.LabelValuesRequest{Label: "a", Start: 1, End: 300}, vsrv)
+				if fail {
+					testutil.NotOk(t, err)
+				} else {
+					testutil.Ok(t, err)
+					testutil.Equals(t, []string{"b"}, vsrv.Values)
+					testutil.Equals(t, 1, len(vsrv.Warnings))
+				}
+			}
+		})
+	}
 }
 
 func TestProxyStore_LabelNames(t *testing.T) {
@@ -1352,6 +1866,7 @@ func TestProxyStore_LabelNames(t *testing.T) {
 				component.Query,
 				nil,
 				0*time.Second,
+				ProxyStoreOpts{},
 			)
 
 			ctx := context.Background()
@@ -1574,6 +2089,33 @@ func (s *storeSeriesServer) Context() context.Context {
 	return s.ctx
 }
 
+// storeLabelValuesStreamServer is test gRPC storeAPI label values stream server.
+type storeLabelValuesStreamServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_LabelValuesStreamServer
+
+	ctx context.Context
+
+	Batches  [][]string
+	Values   []string
+	Warnings []string
+}
+
+func newStoreLabelValuesStreamServer(ctx context.Context) *storeLabelValuesStreamServer {
+	return &storeLabelValuesStreamServer{ctx: ctx}
+}
+
+func (s *storeLabelValuesStreamServer) Send(r *storepb.LabelValuesStreamResponse) error {
+	s.Batches = append(s.Batches, r.Values)
+	s.Values = append(s.Values, r.Values...)
+	s.Warnings = append(s.Warnings, r.Warnings...)
+	return nil
+}
+
+func (s *storeLabelValuesStreamServer) Context() context.Context {
+	return s.ctx
+}
+
 // mockedStoreAPI is test gRPC store API client.
 type mockedStoreAPI struct {
 	RespSeries      []*storepb.SeriesResponse
@@ -1581,6 +2123,8 @@ type mockedStoreAPI struct {
 	RespLabelNames  *storepb.LabelNamesResponse
 	RespError       error
 	RespDuration    time.Duration
+	// RespLabelValuesStream is streamed by LabelValuesStream. If nil, streaming is unimplemented like in older stores.
+	RespLabelValuesStream []*storepb.LabelValuesStreamResponse
 	// Index of series in store to slow response.
 	SlowSeriesIndex int
 
@@ -1615,6 +2159,36 @@ func (s *mockedStoreAPI) LabelValues(_ context.Context, req *storepb.LabelValues
 	return s.RespLabelValues, s.RespError
 }
 
+func (s *mockedStoreAPI) LabelValuesStream(ctx context.Context, req *storepb.LabelValuesRequest, _ ...grpc.CallOption) (storepb.Store_LabelValuesStreamClient, error) {
+	s.LastLabelValuesReq = req
+
+	return &storeLabelValuesStreamClient{ctx: ctx, respSet: s.RespLabelValuesStream}, s.RespError
+}
+
+// storeLabelValuesStreamClient is test gRPC storeAPI label values stream client.
+type storeLabelValuesStreamClient struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_LabelValuesStreamClient
+	ctx     context.Context
+	respSet []*storepb.LabelValuesStreamResponse
+}
+
+func (c *storeLabelValuesStreamClient) Recv() (*storepb.LabelValuesStreamResponse, error) {
+	if c.respSet == nil {
+		return nil, status.Error(codes.Unimplemented, "not implemented")
+	}
+	if len(c.respSet) == 0 {
+		return nil, io.EOF
+	}
+	resp := c.respSet[0]
+	c.respSet = c.respSet[1:]
+	return resp, nil
+}
+
+func (c *storeLabelValuesStreamClient) Context() context.Context {
+	return c.ctx
+}
+
 // StoreSeriesClient is test gRPC storeAPI series client.
 type StoreSeriesClient struct {
 	// This field just exist to pseudo-implement the unused methods of the interface.
@@ -13,6 +13,8 @@ import (
 	"github.com/gogo/protobuf/types"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 )
 
@@ -74,6 +76,17 @@ func EmptySeriesSet() SeriesSet {
 // as well as single SeriesSet alone). If the chunk ranges overlap, the *exact* chunk duplicates will be removed
 // (except one), and any other overlaps will be appended into on chunks slice.
 func MergeSeriesSets(all ...SeriesSet) SeriesSet {
+	return mergeSeriesSets(nil, true, all...)
+}
+
+// MergeSeriesSetsWithPool works like MergeSeriesSets, but reuses chunk slices of series merged by nested merges of
+// three or more series sets from the given pool, which has to return *[]AggrChunk. Chunks of the returned series
+// set itself are never reused, so they can be retained by the caller.
+func MergeSeriesSetsWithPool(p *pool.InstrumentedPool, all ...SeriesSet) SeriesSet {
+	return mergeSeriesSets(p, true, all...)
+}
+
+func mergeSeriesSets(p *pool.InstrumentedPool, root bool, all ...SeriesSet) SeriesSet {
 	switch len(all) {
 	case 0:
 		return emptySeriesSet{}
@@ -82,10 +95,15 @@ func MergeSeriesSets(all ...SeriesSet) SeriesSet {
 	}
 	h := len(all) / 2
 
-	return newMergedSeriesSet(
-		MergeSeriesSets(all[:h]...),
-		MergeSeriesSets(all[h:]...),
+	s := newMergedSeriesSet(
+		mergeSeriesSets(p, false, all[:h]...),
+		mergeSeriesSets(p, false, all[h:]...),
 	)
+	if !root {
+		// Chunks of nested merges are copied or taken over by the parent merge before they move on.
+		s.pool = p
+	}
+	return s
 }
 
 // SeriesSet is a set of series and their corresponding chunks.
@@ -96,6 +114,45 @@ type SeriesSet interface {
 	Err() error
 }
 
+// chunkSourceSeriesSet fills in the source of all chunks of the wrapped series set.
+type chunkSourceSeriesSet struct {
+	SeriesSet
+	src ChunkSource
+
+	lset   labels.Labels
+	chunks []AggrChunk
+}
+
+// NewChunkSourceSeriesSet returns series set filling in the fields of the chunk source missing in chunks of the given
+// series set, e.g. the store name of chunks annotated with their block ID. Chunks are modified in place.
+func NewChunkSourceSeriesSet(set SeriesSet, src ChunkSource) SeriesSet {
+	return &chunkSourceSeriesSet{SeriesSet: set, src: src}
+}
+
+func (s *chunkSourceSeriesSet) Next() bool {
+	if !s.SeriesSet.Next() {
+		return false
+	}
+	s.lset, s.chunks = s.SeriesSet.At()
+	for i := range s.chunks {
+		src := s.src
+		if s.chunks[i].Source != nil {
+			if s.chunks[i].Source.Store != "" {
+				src.Store = s.chunks[i].Source.Store
+			}
+			if s.chunks[i].Source.BlockId != "" {
+				src.BlockId = s.chunks[i].Source.BlockId
+			}
+		}
+		s.chunks[i].Source = &src
+	}
+	return true
+}
+
+func (s *chunkSourceSeriesSet) At() (labels.Labels, []AggrChunk) {
+	return s.lset, s.chunks
+}
+
 // mergedSeriesSet takes two series sets as a single series set.
 type mergedSeriesSet struct {
 	a, b SeriesSet
@@ -103,6 +160,12 @@ type mergedSeriesSet struct {
 	lset         labels.Labels
 	chunks       []AggrChunk
 	adone, bdone bool
+
+	// pool, if not nil, is used for chunk slices of merged series.
+	pool *pool.InstrumentedPool
+	// pooled is the chunk slice obtained from the pool, if chunks are held in it. It is returned to the pool on the
+	// next call of Next, unless the parent merge took it over.
+	pooled *[]AggrChunk
 }
 
 func newMergedSeriesSet(a, b SeriesSet) *mergedSeriesSet {
@@ -139,6 +202,10 @@ func (s *mergedSeriesSet) compare() int {
 }
 
 func (s *mergedSeriesSet) Next() bool {
+	if s.pooled != nil {
+		s.pool.Put(s.pooled)
+		s.pooled = nil
+	}
 	if s.adone && s.bdone || s.Err() != nil {
 		return false
 	}
@@ -146,11 +213,13 @@ func (s *mergedSeriesSet) Next() bool {
 	d := s.compare()
 	if d > 0 {
 		s.lset, s.chunks = s.b.At()
+		s.pooled = s.takePooled(s.b)
 		s.bdone = !s.b.Next()
 		return true
 	}
 	if d < 0 {
 		s.lset, s.chunks = s.a.At()
+		s.pooled = s.takePooled(s.a)
 		s.adone = !s.a.Next()
 		return true
 	}
@@ -162,9 +231,14 @@ func (s *mergedSeriesSet) Next() bool {
 	_, chksB := s.b.At()
 	s.lset = lset
 
-	// Slice reuse is not generally safe with nested merge iterators.
-	// We err on the safe side an create a new slice.
-	s.chunks = make([]AggrChunk, 0, len(chksA)+len(chksB))
+	// Slice reuse is not generally safe with nested merge iterators. Unless the slice comes from the pool, which
+	// only nested merges use, we err on the safe side an create a new slice.
+	if s.pool != nil {
+		s.pooled = s.pool.Get().(*[]AggrChunk)
+		s.chunks = (*s.pooled)[:0]
+	} else {
+		s.chunks = make([]AggrChunk, 0, len(chksA)+len(chksB))
+	}
 
 	b := 0
 Outer:
@@ -187,7 +261,11 @@ Outer:
 				continue
 			}
 
-			// Exact duplicated chunks, discard one from b.
+			// Exact duplicated chunks, discard one from b unless it comes from a different source. Callers asking for
+			// chunk sources need to see all of them, duplicates are removed on select layer anyway.
+			if !sameChunkSource(chksA[a].Source, chksB[b].Source) {
+				s.chunks = append(s.chunks, chksB[b])
+			}
 			b++
 		}
 	}
@@ -195,12 +273,40 @@ Outer:
 	if b < len(chksB) {
 		s.chunks = append(s.chunks, chksB[b:]...)
 	}
+	if s.pooled != nil {
+		// Keep the slice grown by appends for reuse.
+		*s.pooled = s.chunks
+	}
 
 	s.adone = !s.a.Next()
 	s.bdone = !s.b.Next()
 	return true
 }
 
+// sameChunkSource returns true if both sources are unset or point to the same store and block.
+func sameChunkSource(a, b *ChunkSource) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Store == b.Store && a.BlockId == b.BlockId
+}
+
+// takePooled takes over the pooled chunk slice of the given series set, if any, so that it is not reused while the
+// chunks are passed on.
+func (s *mergedSeriesSet) takePooled(set SeriesSet) *[]AggrChunk {
+	m, ok := set.(*mergedSeriesSet)
+	if !ok || m.pooled == nil {
+		return nil
+	}
+	pooled := m.pooled
+	m.pooled = nil
+	if s.pool == nil {
+		// Chunks are returned to the caller, who may retain them, so they must never be reused.
+		return nil
+	}
+	return pooled
+}
+
 // uniqueSeriesSet takes one series set and ensures each iteration contains single, full series.
 type uniqueSeriesSet struct {
 	SeriesSet
@@ -10,9 +10,11 @@ import (
 	"testing"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -332,10 +334,113 @@ func TestMergeSeriesSets(t *testing.T) {
 				input = append(input, newListSeriesSet(t, iss))
 			}
 			testutil.Equals(t, tcase.expected, expandSeriesSet(t, MergeSeriesSets(input...)))
+
+			input = input[:0]
+			for _, iss := range tcase.in {
+				input = append(input, newListSeriesSet(t, iss))
+			}
+			p := pool.NewInstrumentedPool(nil, func() interface{} { return &[]AggrChunk{} })
+			testutil.Equals(t, tcase.expected, expandSeriesSet(t, retainSeriesSet(t, MergeSeriesSetsWithPool(p, input...))))
 		})
 	}
 }
 
+// retainSeriesSet returns the series set of all series of the given one, retained before expanding their chunks.
+func retainSeriesSet(t *testing.T, set SeriesSet) SeriesSet {
+	var series []Series
+	for set.Next() {
+		lset, chks := set.At()
+		series = append(series, Series{Labels: labelpb.LabelsFromPromLabels(lset), Chunks: chks})
+	}
+	testutil.Ok(t, set.Err())
+	return &listSeriesSet{series: series, idx: -1}
+}
+
+func TestMergeSeriesSetsWithPool(t *testing.T) {
+	chunks := func(mints ...int64) [][]sample {
+		var res [][]sample
+		for _, mint := range mints {
+			res = append(res, []sample{{mint, float64(mint)}, {mint + 1, float64(mint + 1)}})
+		}
+		return res
+	}
+	in := [][]rawSeries{
+		{{lset: labels.FromStrings("a", "1"), chunks: chunks(10)}, {lset: labels.FromStrings("a", "2"), chunks: chunks(10)}},
+		{{lset: labels.FromStrings("a", "1"), chunks: chunks(20)}, {lset: labels.FromStrings("a", "2"), chunks: chunks(20)}},
+		{{lset: labels.FromStrings("a", "1"), chunks: chunks(30)}, {lset: labels.FromStrings("a", "3"), chunks: chunks(30)}},
+		{{lset: labels.FromStrings("a", "1"), chunks: chunks(40)}},
+	}
+	var input []SeriesSet
+	for _, iss := range in {
+		input = append(input, newListSeriesSet(t, iss))
+	}
+
+	reg := prometheus.NewRegistry()
+	p := pool.NewInstrumentedPool(reg, func() interface{} { return &[]AggrChunk{} })
+	testutil.Equals(t, []rawSeries{
+		{lset: labels.FromStrings("a", "1"), chunks: chunks(10, 20, 30, 40)},
+		{lset: labels.FromStrings("a", "2"), chunks: chunks(10, 20)},
+		{lset: labels.FromStrings("a", "3"), chunks: chunks(30)},
+	}, expandSeriesSet(t, retainSeriesSet(t, MergeSeriesSetsWithPool(p, input...))))
+
+	// Both nested merges obtain a slice for the series present in all sets and return it once the outermost merge
+	// copied it. The slice of the series present in the first two sets only is passed on to the caller, so it is
+	// never returned.
+	testutil.Equals(t, 3.0, metricValue(t, reg, "pool_gets_total"))
+	testutil.Equals(t, 2.0, metricValue(t, reg, "pool_puts_total"))
+	testutil.Equals(t, metricValue(t, reg, "pool_puts_total"), metricValue(t, reg, "pool_objects")+metricValue(t, reg, "pool_gets_total")-metricValue(t, reg, "pool_allocations_total"))
+}
+
+func TestMergeSeriesSets_ChunkSources(t *testing.T) {
+	lset := labels.FromStrings("a", "1")
+	withSource := func(src *ChunkSource) SeriesSet {
+		set := newListSeriesSet(t, []rawSeries{{lset: lset, chunks: [][]sample{{{1, 1}, {2, 2}}}}})
+		if src != nil {
+			return NewChunkSourceSeriesSet(set, *src)
+		}
+		return set
+	}
+	sources := func(set SeriesSet) (ret []*ChunkSource) {
+		for set.Next() {
+			_, chks := set.At()
+			for _, c := range chks {
+				ret = append(ret, c.Source)
+			}
+		}
+		testutil.Ok(t, set.Err())
+		return ret
+	}
+
+	t.Run("no sources", func(t *testing.T) {
+		testutil.Equals(t, []*ChunkSource{nil}, sources(MergeSeriesSets(withSource(nil), withSource(nil))))
+	})
+	t.Run("same source", func(t *testing.T) {
+		src := &ChunkSource{Store: "store-1", BlockId: "block-1"}
+		testutil.Equals(t, []*ChunkSource{src}, sources(MergeSeriesSets(withSource(src), withSource(src))))
+	})
+	t.Run("different sources", func(t *testing.T) {
+		src1 := &ChunkSource{Store: "store-1", BlockId: "block-1"}
+		src2 := &ChunkSource{Store: "store-2", BlockId: "block-1"}
+		testutil.Equals(t, []*ChunkSource{src2, src1}, sources(MergeSeriesSets(withSource(src1), withSource(src2))))
+	})
+}
+
+func metricValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		if c := mf.GetMetric()[0].GetCounter(); c != nil {
+			return c.GetValue()
+		}
+		return mf.GetMetric()[0].GetGauge().GetValue()
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
 func TestMergeSeriesSetError(t *testing.T) {
 	var input []SeriesSet
 	for _, iss := range [][]rawSeries{{{
@@ -280,6 +280,15 @@ type SeriesRequest struct {
 	// The content of this field and whether it's supported depends on the
 	// implementation of a specific store.
 	Hints *types.Any `protobuf:"bytes,9,opt,name=hints,proto3" json:"hints,omitempty"`
+	// tail_only asks to return only the tail chunks of each series needed to find its latest sample not newer than
+	// max_time. Stores may ignore it and return more chunks, e.g. the whole series.
+	TailOnly bool `protobuf:"varint,10,opt,name=tail_only,json=tailOnly,proto3" json:"tail_only,omitempty"`
+	// chunk_sources asks stores to set the source of each returned chunk, e.g. the block it was read from. It is meant
+	// for debugging only, as it increases the size of responses.
+	ChunkSources bool `protobuf:"varint,11,opt,name=chunk_sources,json=chunkSources,proto3" json:"chunk_sources,omitempty"`
+	// warn_coverage_gaps asks stores to warn about parts of the requested time range they are expected to have data for,
+	// but do not, e.g. gaps between blocks of the Store Gateway.
+	WarnCoverageGaps bool `protobuf:"varint,12,opt,name=warn_coverage_gaps,json=warnCoverageGaps,proto3" json:"warn_coverage_gaps,omitempty"`
 }
 
 func (m *SeriesRequest) Reset()         { *m = SeriesRequest{} }
@@ -499,6 +508,8 @@ type LabelValuesRequest struct {
 	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,3,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
 	Start                   int64                   `protobuf:"varint,4,opt,name=start,proto3" json:"start,omitempty"`
 	End                     int64                   `protobuf:"varint,5,opt,name=end,proto3" json:"end,omitempty"`
+	// matchers restricts returned values to the ones of series matching all given matchers. All values are returned if empty.
+	Matchers []LabelMatcher `protobuf:"bytes,6,rep,name=matchers,proto3" json:"matchers"`
 }
 
 func (m *LabelValuesRequest) Reset()         { *m = LabelValuesRequest{} }
@@ -572,6 +583,45 @@ func (m *LabelValuesResponse) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_LabelValuesResponse proto.InternalMessageInfo
 
+type LabelValuesStreamResponse struct {
+	// values is a batch of sorted label values. All values of a batch are greater than values of previous batches.
+	Values   []string `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	Warnings []string `protobuf:"bytes,2,rep,name=warnings,proto3" json:"warnings,omitempty"`
+}
+
+func (m *LabelValuesStreamResponse) Reset()         { *m = LabelValuesStreamResponse{} }
+func (m *LabelValuesStreamResponse) String() string { return proto.CompactTextString(m) }
+func (*LabelValuesStreamResponse) ProtoMessage()    {}
+func (*LabelValuesStreamResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a938d55a388af629, []int{10}
+}
+func (m *LabelValuesStreamResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *LabelValuesStreamResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_LabelValuesStreamResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *LabelValuesStreamResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LabelValuesStreamResponse.Merge(m, src)
+}
+func (m *LabelValuesStreamResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *LabelValuesStreamResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_LabelValuesStreamResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LabelValuesStreamResponse proto.InternalMessageInfo
+
 func init() {
 	proto.RegisterEnum("thanos.StoreType", StoreType_name, StoreType_value)
 	proto.RegisterEnum("thanos.Aggr", Aggr_name, Aggr_value)
@@ -585,77 +635,85 @@ func init() {
 	proto.RegisterType((*LabelNamesResponse)(nil), "thanos.LabelNamesResponse")
 	proto.RegisterType((*LabelValuesRequest)(nil), "thanos.LabelValuesRequest")
 	proto.RegisterType((*LabelValuesResponse)(nil), "thanos.LabelValuesResponse")
+	proto.RegisterType((*LabelValuesStreamResponse)(nil), "thanos.LabelValuesStreamResponse")
 }
 
 func init() { proto.RegisterFile("store/storepb/rpc.proto", fileDescriptor_a938d55a388af629) }
 
 var fileDescriptor_a938d55a388af629 = []byte{
-	// 1039 bytes of a gzipped FileDescriptorProto
+	// 1139 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0x4b, 0x6f, 0x23, 0x45,
-	0x10, 0xf6, 0x78, 0xfc, 0x2c, 0x27, 0x61, 0xb6, 0xe3, 0x64, 0x27, 0x5e, 0xc9, 0xb1, 0x2c, 0x21,
-	0x59, 0xd1, 0x62, 0x83, 0x57, 0x20, 0xf1, 0xb8, 0xd8, 0x8e, 0x43, 0x22, 0x36, 0x0e, 0xb4, 0xe3,
-	0x0d, 0x0f, 0x21, 0x6b, 0xec, 0xf4, 0x8e, 0x87, 0x8c, 0x67, 0x86, 0xe9, 0x36, 0x89, 0xaf, 0x70,
-	0x47, 0x1c, 0xf9, 0x43, 0x48, 0x39, 0xee, 0x81, 0x03, 0xe2, 0xb0, 0x82, 0xe4, 0xc8, 0x9f, 0x40,
-	0xfd, 0x18, 0xc7, 0x13, 0xb2, 0xb9, 0x84, 0x8b, 0xd5, 0x55, 0x5f, 0x55, 0x75, 0xd5, 0x57, 0x55,
-	0xed, 0x81, 0xc7, 0x94, 0xf9, 0x21, 0x69, 0x88, 0xdf, 0x60, 0xd4, 0x08, 0x83, 0x71, 0x3d, 0x08,
-	0x7d, 0xe6, 0xa3, 0x0c, 0x9b, 0x58, 0x9e, 0x4f, 0x4b, 0x5b, 0x71, 0x03, 0x36, 0x0f, 0x08, 0x95,
-	0x26, 0xa5, 0xa2, 0xed, 0xdb, 0xbe, 0x38, 0x36, 0xf8, 0x49, 0x69, 0x2b, 0x71, 0x87, 0x20, 0xf4,
-	0xa7, 0xb7, 0xfc, 0x54, 0x48, 0xd7, 0x1a, 0x11, 0xf7, 0x36, 0x64, 0xfb, 0xbe, 0xed, 0x92, 0x86,
-	0x90, 0x46, 0xb3, 0x97, 0x0d, 0xcb, 0x9b, 0x4b, 0xa8, 0xfa, 0x16, 0xac, 0x9e, 0x84, 0x0e, 0x23,
-	0x98, 0xd0, 0xc0, 0xf7, 0x28, 0xa9, 0xfe, 0xa4, 0xc1, 0x8a, 0xd2, 0x7c, 0x3f, 0x23, 0x94, 0xa1,
-	0x16, 0x00, 0x73, 0xa6, 0x84, 0x92, 0xd0, 0x21, 0xd4, 0xd4, 0x2a, 0x7a, 0xad, 0xd0, 0x7c, 0xc2,
-	0xbd, 0xa7, 0x84, 0x4d, 0xc8, 0x8c, 0x0e, 0xc7, 0x7e, 0x30, 0xaf, 0x1f, 0x3b, 0x53, 0xd2, 0x17,
-	0x26, 0xed, 0xd4, 0xe5, 0xeb, 0xed, 0x04, 0x5e, 0x72, 0x42, 0x9b, 0x90, 0x61, 0xc4, 0xb3, 0x3c,
-	0x66, 0x26, 0x2b, 0x5a, 0x2d, 0x8f, 0x95, 0x84, 0x4c, 0xc8, 0x86, 0x24, 0x70, 0x9d, 0xb1, 0x65,
-	0xea, 0x15, 0xad, 0xa6, 0xe3, 0x48, 0xac, 0xae, 0x42, 0xe1, 0xc0, 0x7b, 0xe9, 0xab, 0x1c, 0xaa,
-	0xbf, 0x26, 0x61, 0x45, 0xca, 0x32, 0x4b, 0xf4, 0x1d, 0x64, 0x44, 0xa1, 0x51, 0x42, 0x1b, 0x75,
-	0x49, 0x6c, 0x7d, 0x6f, 0xe6, 0xba, 0x1d, 0x3f, 0x98, 0x3f, 0xe7, 0x68, 0xfb, 0x63, 0x9e, 0xca,
-	0x9f, 0xaf, 0xb7, 0x9f, 0xd9, 0x0e, 0x9b, 0xcc, 0x46, 0xf5, 0xb1, 0x3f, 0x6d, 0x48, 0xc3, 0x77,
-	0x1c, 0x5f, 0x9d, 0x1a, 0xc1, 0x99, 0xdd, 0x88, 0x71, 0x57, 0x17, 0xce, 0x58, 0xdd, 0x80, 0xb6,
-	0x20, 0x37, 0x75, 0xbc, 0x21, 0xaf, 0x47, 0xe4, 0xaf, 0xe3, 0xec, 0xd4, 0xf1, 0x78, 0xc1, 0x02,
-	0xb2, 0x2e, 0x24, 0xa4, 0x2a, 0x98, 0x5a, 0x17, 0x02, 0x6a, 0x40, 0x5e, 0x04, 0x3d, 0x9e, 0x07,
-	0xc4, 0x4c, 0x55, 0xb4, 0xda, 0x5a, 0xf3, 0x51, 0x94, 0x64, 0x3f, 0x02, 0xf0, 0x8d, 0x0d, 0x7a,
-	0x1f, 0x40, 0x5c, 0x38, 0xa4, 0x84, 0x51, 0x33, 0x2d, 0xca, 0x32, 0x22, 0x0f, 0x91, 0x51, 0x9f,
-	0x30, 0x45, 0x6e, 0xde, 0x55, 0x32, 0xad, 0xfe, 0xa6, 0xc3, 0xaa, 0x24, 0x3e, 0x6a, 0xd8, 0x72,
-	0xbe, 0xda, 0x9b, 0xf3, 0x4d, 0xc6, 0xf3, 0xfd, 0x80, 0x43, 0x6c, 0x3c, 0x21, 0x21, 0x35, 0x75,
-	0x71, 0x79, 0x31, 0x76, 0xf9, 0xa1, 0x04, 0x55, 0x02, 0x0b, 0x5b, 0xd4, 0x84, 0x0d, 0x1e, 0x32,
-	0x24, 0xd4, 0x77, 0x67, 0xcc, 0xf1, 0xbd, 0xe1, 0xb9, 0xe3, 0x9d, 0xfa, 0xe7, 0xa2, 0x66, 0x1d,
-	0xaf, 0x4f, 0xad, 0x0b, 0xbc, 0xc0, 0x4e, 0x04, 0x84, 0x9e, 0x02, 0x58, 0xb6, 0x1d, 0x12, 0xdb,
-	0x62, 0x44, 0x96, 0xba, 0xd6, 0x5c, 0x89, 0x6e, 0x6b, 0xd9, 0x76, 0x88, 0x97, 0x70, 0xf4, 0x11,
-	0x6c, 0x05, 0x56, 0xc8, 0x1c, 0xcb, 0xe5, 0xb7, 0x88, 0xfe, 0x0f, 0x4f, 0x1d, 0x6a, 0x8d, 0x5c,
-	0x72, 0x6a, 0x66, 0x2a, 0x5a, 0x2d, 0x87, 0x1f, 0x2b, 0x83, 0x68, 0x3e, 0x76, 0x15, 0x8c, 0xbe,
-	0xb9, 0xc3, 0x97, 0xb2, 0xd0, 0x62, 0xc4, 0x9e, 0x9b, 0x59, 0xd1, 0x95, 0xed, 0xe8, 0xe2, 0xcf,
-	0xe3, 0x31, 0xfa, 0xca, 0xec, 0x3f, 0xc1, 0x23, 0x00, 0x6d, 0x43, 0x81, 0x9e, 0x39, 0xc1, 0x70,
-	0x3c, 0x99, 0x79, 0x67, 0xd4, 0xcc, 0x89, 0x54, 0x80, 0xab, 0x3a, 0x42, 0x83, 0x76, 0x20, 0x3d,
-	0x71, 0x3c, 0x46, 0xcd, 0x7c, 0x45, 0x13, 0x84, 0xca, 0x3d, 0xac, 0x47, 0x7b, 0x58, 0x6f, 0x79,
-	0x73, 0x2c, 0x4d, 0xaa, 0x3f, 0x6b, 0xb0, 0x16, 0xf5, 0x51, 0x0d, 0x79, 0x0d, 0x32, 0x8b, 0xad,
-	0xe3, 0xfe, 0x6b, 0x8b, 0xf9, 0x11, 0xda, 0xfd, 0x04, 0x56, 0x38, 0x2a, 0x41, 0xf6, 0xdc, 0x0a,
-	0x3d, 0xc7, 0xb3, 0xe5, 0x86, 0xed, 0x27, 0x70, 0xa4, 0x40, 0x4f, 0xa3, 0x24, 0xf4, 0x37, 0x27,
-	0xb1, 0x9f, 0x50, 0x69, 0xb4, 0x73, 0x90, 0x09, 0x09, 0x9d, 0xb9, 0xac, 0xfa, 0xbb, 0x06, 0x8f,
-	0x44, 0xe7, 0x7b, 0xd6, 0xf4, 0x66, 0xb8, 0xee, 0x6d, 0x86, 0xf6, 0x80, 0x66, 0x24, 0x1f, 0xd8,
-	0x8c, 0x22, 0xa4, 0x29, 0xb3, 0x42, 0xa6, 0xf6, 0x50, 0x0a, 0xc8, 0x00, 0x9d, 0x78, 0xa7, 0x6a,
-	0x16, 0xf9, 0xb1, 0xba, 0x07, 0x68, 0xb9, 0x2a, 0x45, 0x75, 0x11, 0xd2, 0x1e, 0x57, 0x88, 0xe7,
-	0x24, 0x8f, 0xa5, 0x80, 0x4a, 0x90, 0x53, 0x2c, 0x52, 0x33, 0x29, 0x80, 0x85, 0x5c, 0xfd, 0x47,
-	0x53, 0x81, 0x5e, 0x58, 0xee, 0xec, 0x86, 0x9f, 0x22, 0xa4, 0xc5, 0x6e, 0x0a, 0x2e, 0xf2, 0x58,
-	0x0a, 0xf7, 0xb3, 0x96, 0x7c, 0x00, 0x6b, 0xfa, 0xff, 0xc5, 0x5a, 0xea, 0x0e, 0xd6, 0xd2, 0x37,
-	0xac, 0x1d, 0xc0, 0x7a, 0xac, 0x58, 0x45, 0xdb, 0x26, 0x64, 0x7e, 0x10, 0x1a, 0xc5, 0x9b, 0x92,
-	0xee, 0x23, 0x6e, 0xe7, 0x5b, 0xc8, 0x2f, 0xde, 0x3f, 0x54, 0x80, 0xec, 0xa0, 0xf7, 0x59, 0xef,
-	0xe8, 0xa4, 0x67, 0x24, 0x50, 0x1e, 0xd2, 0x5f, 0x0c, 0xba, 0xf8, 0x2b, 0x43, 0x43, 0x39, 0x48,
-	0xe1, 0xc1, 0xf3, 0xae, 0x91, 0xe4, 0x16, 0xfd, 0x83, 0xdd, 0x6e, 0xa7, 0x85, 0x0d, 0x9d, 0x5b,
-	0xf4, 0x8f, 0x8f, 0x70, 0xd7, 0x48, 0x71, 0x3d, 0xee, 0x76, 0xba, 0x07, 0x2f, 0xba, 0x46, 0x9a,
-	0xeb, 0x77, 0xbb, 0xed, 0xc1, 0xa7, 0x46, 0x66, 0xa7, 0x0d, 0x29, 0xfe, 0x82, 0xa0, 0x2c, 0xe8,
-	0xb8, 0x75, 0x22, 0xa3, 0x76, 0x8e, 0x06, 0xbd, 0x63, 0x43, 0xe3, 0xba, 0xfe, 0xe0, 0xd0, 0x48,
-	0xf2, 0xc3, 0xe1, 0x41, 0xcf, 0xd0, 0xc5, 0xa1, 0xf5, 0xa5, 0x0c, 0x27, 0xac, 0xba, 0xd8, 0x48,
-	0x37, 0x7f, 0x4c, 0x42, 0x5a, 0xe4, 0x88, 0xde, 0x83, 0x14, 0xff, 0xdf, 0x41, 0xeb, 0x11, 0xc3,
-	0x4b, 0xff, 0x4a, 0xa5, 0x62, 0x5c, 0xa9, 0x38, 0xf9, 0x10, 0x32, 0x72, 0x3f, 0xd1, 0x46, 0x7c,
-	0x5f, 0x23, 0xb7, 0xcd, 0xdb, 0x6a, 0xe9, 0xf8, 0xae, 0x86, 0x3a, 0x00, 0x37, 0xb3, 0x89, 0xb6,
-	0x62, 0xef, 0xef, 0xf2, 0x16, 0x96, 0x4a, 0x77, 0x41, 0xea, 0xfe, 0x3d, 0x28, 0x2c, 0xb5, 0x0a,
-	0xc5, 0x4d, 0x63, 0xc3, 0x5a, 0x7a, 0x72, 0x27, 0x26, 0xe3, 0x34, 0x7b, 0xb0, 0x26, 0xbe, 0x03,
-	0xf8, 0x14, 0x4a, 0x32, 0x3e, 0x81, 0x02, 0x26, 0x53, 0x9f, 0x11, 0xa1, 0x47, 0x8b, 0xf2, 0x97,
-	0x3f, 0x17, 0x4a, 0x1b, 0xb7, 0xb4, 0xea, 0xb3, 0x22, 0xd1, 0x7e, 0xfb, 0xf2, 0xef, 0x72, 0xe2,
-	0xf2, 0xaa, 0xac, 0xbd, 0xba, 0x2a, 0x6b, 0x7f, 0x5d, 0x95, 0xb5, 0x5f, 0xae, 0xcb, 0x89, 0x57,
-	0xd7, 0xe5, 0xc4, 0x1f, 0xd7, 0xe5, 0xc4, 0xd7, 0x59, 0xf5, 0x65, 0x33, 0xca, 0x88, 0x77, 0xe9,
-	0xd9, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xb6, 0xf4, 0xa4, 0xff, 0x43, 0x09, 0x00, 0x00,
+	0x10, 0xf6, 0x78, 0xfc, 0x2c, 0x27, 0x61, 0xb6, 0xd7, 0xc9, 0x4e, 0x1c, 0xc9, 0x31, 0x46, 0x48,
+	0x56, 0x14, 0xec, 0xc5, 0x2b, 0x90, 0x78, 0x5c, 0x6c, 0xc7, 0xd9, 0x44, 0x6c, 0x1c, 0x68, 0xc7,
+	0x1b, 0x1e, 0x42, 0xd6, 0xd8, 0xe9, 0x1d, 0x0f, 0x99, 0x17, 0xd3, 0xed, 0x4d, 0x7c, 0xe6, 0x8e,
+	0x38, 0x72, 0xe7, 0x37, 0xf0, 0x1f, 0x72, 0xdc, 0x03, 0x87, 0x15, 0x87, 0x15, 0x24, 0x7f, 0x04,
+	0x75, 0x4f, 0x8f, 0xe3, 0x09, 0xd9, 0x08, 0x29, 0x5c, 0xac, 0xae, 0xef, 0xab, 0xae, 0xae, 0xfa,
+	0xba, 0xab, 0x3c, 0xf0, 0x88, 0x32, 0x2f, 0x20, 0x0d, 0xf1, 0xeb, 0x8f, 0x1a, 0x81, 0x3f, 0xae,
+	0xfb, 0x81, 0xc7, 0x3c, 0x94, 0x61, 0x13, 0xc3, 0xf5, 0x68, 0x69, 0x3d, 0xee, 0xc0, 0x66, 0x3e,
+	0xa1, 0xa1, 0x4b, 0xa9, 0x68, 0x7a, 0xa6, 0x27, 0x96, 0x0d, 0xbe, 0x92, 0x68, 0x25, 0xbe, 0xc1,
+	0x0f, 0x3c, 0xe7, 0xc6, 0x3e, 0x19, 0xd2, 0x36, 0x46, 0xc4, 0xbe, 0x49, 0x99, 0x9e, 0x67, 0xda,
+	0xa4, 0x21, 0xac, 0xd1, 0xf4, 0x45, 0xc3, 0x70, 0x67, 0x21, 0x55, 0x7d, 0x07, 0x96, 0x8f, 0x03,
+	0x8b, 0x11, 0x4c, 0xa8, 0xef, 0xb9, 0x94, 0x54, 0x7f, 0x52, 0x60, 0x49, 0x22, 0x3f, 0x4e, 0x09,
+	0x65, 0xa8, 0x05, 0xc0, 0x2c, 0x87, 0x50, 0x12, 0x58, 0x84, 0xea, 0x4a, 0x45, 0xad, 0x15, 0x9a,
+	0x1b, 0x7c, 0xb7, 0x43, 0xd8, 0x84, 0x4c, 0xe9, 0x70, 0xec, 0xf9, 0xb3, 0xfa, 0x91, 0xe5, 0x90,
+	0xbe, 0x70, 0x69, 0xa7, 0x2e, 0xde, 0x6c, 0x26, 0xf0, 0xc2, 0x26, 0xb4, 0x06, 0x19, 0x46, 0x5c,
+	0xc3, 0x65, 0x7a, 0xb2, 0xa2, 0xd4, 0xf2, 0x58, 0x5a, 0x48, 0x87, 0x6c, 0x40, 0x7c, 0xdb, 0x1a,
+	0x1b, 0xba, 0x5a, 0x51, 0x6a, 0x2a, 0x8e, 0xcc, 0xea, 0x32, 0x14, 0xf6, 0xdd, 0x17, 0x9e, 0xcc,
+	0xa1, 0xfa, 0x6b, 0x12, 0x96, 0x42, 0x3b, 0xcc, 0x12, 0xfd, 0x00, 0x19, 0x51, 0x68, 0x94, 0xd0,
+	0x6a, 0x3d, 0x14, 0xb6, 0xbe, 0x3b, 0xb5, 0xed, 0x8e, 0xe7, 0xcf, 0x9e, 0x71, 0xb6, 0xfd, 0x19,
+	0x4f, 0xe5, 0xcf, 0x37, 0x9b, 0x4f, 0x4c, 0x8b, 0x4d, 0xa6, 0xa3, 0xfa, 0xd8, 0x73, 0x1a, 0xa1,
+	0xe3, 0x07, 0x96, 0x27, 0x57, 0x0d, 0xff, 0xd4, 0x6c, 0xc4, 0xb4, 0xab, 0x8b, 0xcd, 0x58, 0x9e,
+	0x80, 0xd6, 0x21, 0xe7, 0x58, 0xee, 0x90, 0xd7, 0x23, 0xf2, 0x57, 0x71, 0xd6, 0xb1, 0x5c, 0x5e,
+	0xb0, 0xa0, 0x8c, 0xf3, 0x90, 0x92, 0x15, 0x38, 0xc6, 0xb9, 0xa0, 0x1a, 0x90, 0x17, 0x41, 0x8f,
+	0x66, 0x3e, 0xd1, 0x53, 0x15, 0xa5, 0xb6, 0xd2, 0x7c, 0x10, 0x25, 0xd9, 0x8f, 0x08, 0x7c, 0xed,
+	0x83, 0x3e, 0x02, 0x10, 0x07, 0x0e, 0x29, 0x61, 0x54, 0x4f, 0x8b, 0xb2, 0xb4, 0x68, 0x87, 0xc8,
+	0xa8, 0x4f, 0x98, 0x14, 0x37, 0x6f, 0x4b, 0x9b, 0x56, 0x7f, 0x4f, 0xc1, 0x72, 0x28, 0x7c, 0x74,
+	0x61, 0x8b, 0xf9, 0x2a, 0x6f, 0xcf, 0x37, 0x19, 0xcf, 0xf7, 0x63, 0x4e, 0xb1, 0xf1, 0x84, 0x04,
+	0x54, 0x57, 0xc5, 0xe1, 0xc5, 0xd8, 0xe1, 0x07, 0x21, 0x29, 0x13, 0x98, 0xfb, 0xa2, 0x26, 0xac,
+	0xf2, 0x90, 0x01, 0xa1, 0x9e, 0x3d, 0x65, 0x96, 0xe7, 0x0e, 0xcf, 0x2c, 0xf7, 0xc4, 0x3b, 0x13,
+	0x35, 0xab, 0xf8, 0xa1, 0x63, 0x9c, 0xe3, 0x39, 0x77, 0x2c, 0x28, 0xb4, 0x0d, 0x60, 0x98, 0x66,
+	0x40, 0x4c, 0x83, 0x91, 0xb0, 0xd4, 0x95, 0xe6, 0x52, 0x74, 0x5a, 0xcb, 0x34, 0x03, 0xbc, 0xc0,
+	0xa3, 0x4f, 0x61, 0xdd, 0x37, 0x02, 0x66, 0x19, 0xf6, 0x30, 0x90, 0xf7, 0x3f, 0x3c, 0xb1, 0xa8,
+	0x31, 0xb2, 0xc9, 0x89, 0x9e, 0xa9, 0x28, 0xb5, 0x1c, 0x7e, 0x24, 0x1d, 0xa2, 0xf7, 0xb1, 0x23,
+	0x69, 0xf4, 0xdd, 0x2d, 0x7b, 0x29, 0x0b, 0x0c, 0x46, 0xcc, 0x99, 0x9e, 0x15, 0xb7, 0xb2, 0x19,
+	0x1d, 0xfc, 0x65, 0x3c, 0x46, 0x5f, 0xba, 0xfd, 0x2b, 0x78, 0x44, 0xa0, 0x4d, 0x28, 0xd0, 0x53,
+	0xcb, 0x1f, 0x8e, 0x27, 0x53, 0xf7, 0x94, 0xea, 0x39, 0x91, 0x0a, 0x70, 0xa8, 0x23, 0x10, 0xb4,
+	0x05, 0xe9, 0x89, 0xe5, 0x32, 0xaa, 0xe7, 0x2b, 0x8a, 0x10, 0x34, 0xec, 0xc3, 0x7a, 0xd4, 0x87,
+	0xf5, 0x96, 0x3b, 0xc3, 0xa1, 0x0b, 0xda, 0x80, 0x3c, 0x33, 0x2c, 0x7b, 0xe8, 0xb9, 0xf6, 0x4c,
+	0x07, 0x11, 0x2a, 0xc7, 0x81, 0x43, 0xd7, 0x9e, 0xa1, 0xf7, 0x60, 0x59, 0x1c, 0x32, 0xa4, 0xde,
+	0x34, 0x18, 0x13, 0xaa, 0x17, 0x84, 0xc3, 0x92, 0x00, 0xfb, 0x21, 0x86, 0xb6, 0x01, 0x9d, 0x19,
+	0x81, 0x3b, 0x1c, 0x7b, 0x2f, 0x49, 0x60, 0x98, 0x64, 0x68, 0x1a, 0x3e, 0xd5, 0x97, 0x84, 0xa7,
+	0xc6, 0x99, 0x8e, 0x24, 0x9e, 0x1a, 0x3e, 0xad, 0xfe, 0xac, 0xc0, 0x4a, 0xf4, 0x6e, 0x64, 0x53,
+	0xd5, 0x20, 0x33, 0xef, 0x72, 0x9e, 0xef, 0xca, 0xfc, 0xbd, 0x0a, 0x74, 0x2f, 0x81, 0x25, 0x8f,
+	0x4a, 0x90, 0xe5, 0x01, 0x2d, 0xd7, 0x0c, 0x3b, 0x7a, 0x2f, 0x81, 0x23, 0x00, 0x6d, 0x47, 0x45,
+	0xab, 0x6f, 0x2f, 0x7a, 0x2f, 0x21, 0xcb, 0x6e, 0xe7, 0x20, 0x13, 0x10, 0x3a, 0xb5, 0x59, 0xf5,
+	0x0f, 0x05, 0x1e, 0x88, 0x97, 0xd6, 0x33, 0x9c, 0xeb, 0xc7, 0x7c, 0xe7, 0xe5, 0x2b, 0xf7, 0xb8,
+	0xfc, 0xe4, 0x3d, 0x2f, 0xbf, 0x08, 0x69, 0xca, 0x8c, 0x80, 0xc9, 0xbe, 0x0f, 0x0d, 0xa4, 0x81,
+	0x4a, 0xdc, 0x13, 0xf9, 0xf6, 0xf9, 0xb2, 0xba, 0x0b, 0x68, 0xb1, 0x2a, 0x29, 0x75, 0x11, 0xd2,
+	0x2e, 0x07, 0xc4, 0xf8, 0xca, 0xe3, 0xd0, 0x40, 0x25, 0xc8, 0x49, 0x15, 0xa9, 0x9e, 0x14, 0xc4,
+	0xdc, 0xae, 0xfe, 0x96, 0x94, 0x81, 0x9e, 0x1b, 0xf6, 0xf4, 0x5a, 0x9f, 0x22, 0xa4, 0xc5, 0x2c,
+	0x10, 0x5a, 0xe4, 0x71, 0x68, 0xdc, 0xad, 0x5a, 0xf2, 0x1e, 0xaa, 0xa9, 0xff, 0x97, 0x6a, 0xa9,
+	0x5b, 0x54, 0x4b, 0xcf, 0x55, 0x8b, 0x4d, 0xa3, 0xcc, 0x7f, 0x9f, 0x46, 0xd5, 0x7d, 0x78, 0x18,
+	0x13, 0x49, 0xca, 0xbd, 0x06, 0x99, 0x97, 0x02, 0x91, 0x7a, 0x4b, 0xeb, 0x4e, 0xc1, 0x0f, 0x61,
+	0x7d, 0x21, 0x54, 0x9f, 0x05, 0xc4, 0x70, 0xee, 0x13, 0x70, 0xeb, 0x7b, 0xc8, 0xcf, 0x07, 0x3f,
+	0x2a, 0x40, 0x76, 0xd0, 0xfb, 0xa2, 0x77, 0x78, 0xdc, 0xd3, 0x12, 0x28, 0x0f, 0xe9, 0xaf, 0x06,
+	0x5d, 0xfc, 0x8d, 0xa6, 0xa0, 0x1c, 0xa4, 0xf0, 0xe0, 0x59, 0x57, 0x4b, 0x72, 0x8f, 0xfe, 0xfe,
+	0x4e, 0xb7, 0xd3, 0xc2, 0x9a, 0xca, 0x3d, 0xfa, 0x47, 0x87, 0xb8, 0xab, 0xa5, 0x38, 0x8e, 0xbb,
+	0x9d, 0xee, 0xfe, 0xf3, 0xae, 0x96, 0xe6, 0xf8, 0x4e, 0xb7, 0x3d, 0x78, 0xaa, 0x65, 0xb6, 0xda,
+	0x90, 0xe2, 0xa3, 0x13, 0x65, 0x41, 0xc5, 0xad, 0xe3, 0x30, 0x6a, 0xe7, 0x70, 0xd0, 0x3b, 0xd2,
+	0x14, 0x8e, 0xf5, 0x07, 0x07, 0x5a, 0x92, 0x2f, 0x0e, 0xf6, 0x7b, 0x9a, 0x2a, 0x16, 0xad, 0xaf,
+	0xc3, 0x70, 0xc2, 0xab, 0x8b, 0xb5, 0x74, 0xf3, 0x75, 0x12, 0xd2, 0x22, 0x47, 0xf4, 0x21, 0xa4,
+	0xf8, 0x1f, 0x2e, 0x7a, 0x18, 0xc9, 0xbe, 0xf0, 0x77, 0x5c, 0x2a, 0xc6, 0x41, 0xa9, 0xc9, 0x27,
+	0x90, 0x09, 0x07, 0x05, 0x5a, 0x8d, 0x0f, 0x8e, 0x68, 0xdb, 0xda, 0x4d, 0x38, 0xdc, 0xf8, 0x58,
+	0x41, 0x1d, 0x80, 0xeb, 0x26, 0x41, 0xeb, 0xb1, 0xab, 0x5e, 0x1c, 0x07, 0xa5, 0xd2, 0x6d, 0x94,
+	0x3c, 0x7f, 0x17, 0x0a, 0x0b, 0x17, 0x86, 0xe2, 0xae, 0xb1, 0xae, 0x29, 0x6d, 0xdc, 0xca, 0xc9,
+	0x38, 0x47, 0xf0, 0x60, 0x01, 0x0e, 0x2f, 0xfe, 0xce, 0x68, 0xef, 0xde, 0xc2, 0xc5, 0xdf, 0xcb,
+	0x63, 0xa5, 0xd9, 0x83, 0x15, 0xf1, 0x59, 0xc5, 0x9b, 0x2c, 0x94, 0xf8, 0x73, 0x28, 0x60, 0xe2,
+	0x78, 0x8c, 0x08, 0x1c, 0xcd, 0x45, 0x5d, 0xfc, 0xfa, 0x2a, 0xad, 0xde, 0x40, 0xe5, 0x57, 0x5a,
+	0xa2, 0xfd, 0xfe, 0xc5, 0xdf, 0xe5, 0xc4, 0xc5, 0x65, 0x59, 0x79, 0x75, 0x59, 0x56, 0xfe, 0xba,
+	0x2c, 0x2b, 0xbf, 0x5c, 0x95, 0x13, 0xaf, 0xae, 0xca, 0x89, 0xd7, 0x57, 0xe5, 0xc4, 0xb7, 0x59,
+	0xf9, 0xa1, 0x38, 0xca, 0x88, 0xb1, 0xfb, 0xe4, 0x9f, 0x01, 0x00, 0x34, 0xeb, 0x25, 0xf0, 0x92,
+	0x0a, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -688,6 +746,9 @@ type StoreClient interface {
 	LabelNames(ctx context.Context, in *LabelNamesRequest, opts ...grpc.CallOption) (*LabelNamesResponse, error)
 	/// LabelValues returns all label values for given label name.
 	LabelValues(ctx context.Context, in *LabelValuesRequest, opts ...grpc.CallOption) (*LabelValuesResponse, error)
+	/// LabelValuesStream returns the same label values as LabelValues, but streamed in sorted batches, so neither the store
+	/// nor the caller have to hold all values of high cardinality labels in a single message.
+	LabelValuesStream(ctx context.Context, in *LabelValuesRequest, opts ...grpc.CallOption) (Store_LabelValuesStreamClient, error)
 }
 
 type storeClient struct {
@@ -757,6 +818,38 @@ func (c *storeClient) LabelValues(ctx context.Context, in *LabelValuesRequest, o
 	return out, nil
 }
 
+func (c *storeClient) LabelValuesStream(ctx context.Context, in *LabelValuesRequest, opts ...grpc.CallOption) (Store_LabelValuesStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Store_serviceDesc.Streams[1], "/thanos.Store/LabelValuesStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storeLabelValuesStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Store_LabelValuesStreamClient interface {
+	Recv() (*LabelValuesStreamResponse, error)
+	grpc.ClientStream
+}
+
+type storeLabelValuesStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *storeLabelValuesStreamClient) Recv() (*LabelValuesStreamResponse, error) {
+	m := new(LabelValuesStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // StoreServer is the server API for Store service.
 type StoreServer interface {
 	/// Info returns meta information about a store e.g labels that makes that store unique as well as time range that is
@@ -777,6 +870,9 @@ type StoreServer interface {
 	LabelNames(context.Context, *LabelNamesRequest) (*LabelNamesResponse, error)
 	/// LabelValues returns all label values for given label name.
 	LabelValues(context.Context, *LabelValuesRequest) (*LabelValuesResponse, error)
+	/// LabelValuesStream returns the same label values as LabelValues, but streamed in sorted batches, so neither the store
+	/// nor the caller have to hold all values of high cardinality labels in a single message.
+	LabelValuesStream(*LabelValuesRequest, Store_LabelValuesStreamServer) error
 }
 
 // UnimplementedStoreServer can be embedded to have forward compatible implementations.
@@ -795,6 +891,9 @@ func (*UnimplementedStoreServer) LabelNames(ctx context.Context, req *LabelNames
 func (*UnimplementedStoreServer) LabelValues(ctx context.Context, req *LabelValuesRequest) (*LabelValuesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method LabelValues not implemented")
 }
+func (*UnimplementedStoreServer) LabelValuesStream(req *LabelValuesRequest, srv Store_LabelValuesStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method LabelValuesStream not implemented")
+}
 
 func RegisterStoreServer(s *grpc.Server, srv StoreServer) {
 	s.RegisterService(&_Store_serviceDesc, srv)
@@ -875,6 +974,27 @@ func _Store_LabelValues_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Store_LabelValuesStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LabelValuesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StoreServer).LabelValuesStream(m, &storeLabelValuesStreamServer{stream})
+}
+
+type Store_LabelValuesStreamServer interface {
+	Send(*LabelValuesStreamResponse) error
+	grpc.ServerStream
+}
+
+type storeLabelValuesStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *storeLabelValuesStreamServer) Send(m *LabelValuesStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _Store_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "thanos.Store",
 	HandlerType: (*StoreServer)(nil),
@@ -898,6 +1018,11 @@ var _Store_serviceDesc = grpc.ServiceDesc{
 			Handler:       _Store_Series_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "LabelValuesStream",
+			Handler:       _Store_LabelValuesStream_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "store/storepb/rpc.proto",
 }
@@ -1157,6 +1282,36 @@ func (m *SeriesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.WarnCoverageGaps {
+		i--
+		if m.WarnCoverageGaps {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x60
+	}
+	if m.ChunkSources {
+		i--
+		if m.ChunkSources {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x58
+	}
+	if m.TailOnly {
+		i--
+		if m.TailOnly {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x50
+	}
 	if m.Hints != nil {
 		{
 			size, err := m.Hints.MarshalToSizedBuffer(dAtA[:i])
@@ -1441,6 +1596,20 @@ func (m *LabelValuesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Matchers) > 0 {
+		for iNdEx := len(m.Matchers) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Matchers[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRpc(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x32
+		}
+	}
 	if m.End != 0 {
 		i = encodeVarintRpc(dAtA, i, uint64(m.End))
 		i--
@@ -1517,6 +1686,47 @@ func (m *LabelValuesResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *LabelValuesStreamResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *LabelValuesStreamResponse) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *LabelValuesStreamResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Warnings) > 0 {
+		for iNdEx := len(m.Warnings) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Warnings[iNdEx])
+			copy(dAtA[i:], m.Warnings[iNdEx])
+			i = encodeVarintRpc(dAtA, i, uint64(len(m.Warnings[iNdEx])))
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if len(m.Values) > 0 {
+		for iNdEx := len(m.Values) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Values[iNdEx])
+			copy(dAtA[i:], m.Values[iNdEx])
+			i = encodeVarintRpc(dAtA, i, uint64(len(m.Values[iNdEx])))
+			i--
+			dAtA[i] = 0xa
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintRpc(dAtA []byte, offset int, v uint64) int {
 	offset -= sovRpc(v)
 	base := offset
@@ -1639,6 +1849,15 @@ func (m *SeriesRequest) Size() (n int) {
 		l = m.Hints.Size()
 		n += 1 + l + sovRpc(uint64(l))
 	}
+	if m.TailOnly {
+		n += 2
+	}
+	if m.ChunkSources {
+		n += 2
+	}
+	if m.WarnCoverageGaps {
+		n += 2
+	}
 	return n
 }
 
@@ -1752,6 +1971,12 @@ func (m *LabelValuesRequest) Size() (n int) {
 	if m.End != 0 {
 		n += 1 + sovRpc(uint64(m.End))
 	}
+	if len(m.Matchers) > 0 {
+		for _, e := range m.Matchers {
+			l = e.Size()
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1776,6 +2001,27 @@ func (m *LabelValuesResponse) Size() (n int) {
 	return n
 }
 
+func (m *LabelValuesStreamResponse) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.Values) > 0 {
+		for _, s := range m.Values {
+			l = len(s)
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
+	if len(m.Warnings) > 0 {
+		for _, s := range m.Warnings {
+			l = len(s)
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovRpc(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -2488,6 +2734,66 @@ func (m *SeriesRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TailOnly", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.TailOnly = bool(v != 0)
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChunkSources", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ChunkSources = bool(v != 0)
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WarnCoverageGaps", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.WarnCoverageGaps = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -3052,6 +3358,40 @@ func (m *LabelValuesRequest) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Matchers", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Matchers = append(m.Matchers, LabelMatcher{})
+			if err := m.Matchers[len(m.Matchers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -3193,6 +3533,123 @@ func (m *LabelValuesResponse) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *LabelValuesStreamResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRpc
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: LabelValuesStreamResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: LabelValuesStreamResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Values", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Values = append(m.Values, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Warnings", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Warnings = append(m.Warnings, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRpc(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipRpc(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -198,6 +198,8 @@ type AggrChunk struct {
 	Min     *Chunk `protobuf:"bytes,6,opt,name=min,proto3" json:"min,omitempty"`
 	Max     *Chunk `protobuf:"bytes,7,opt,name=max,proto3" json:"max,omitempty"`
 	Counter *Chunk `protobuf:"bytes,8,opt,name=counter,proto3" json:"counter,omitempty"`
+	// source of the chunk, set only if requested by SeriesRequest.chunk_sources.
+	Source *ChunkSource `protobuf:"bytes,9,opt,name=source,proto3" json:"source,omitempty"`
 }
 
 func (m *AggrChunk) Reset()         { *m = AggrChunk{} }
@@ -273,6 +275,47 @@ func (m *LabelMatcher) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_LabelMatcher proto.InternalMessageInfo
 
+// ChunkSource identifies where a chunk comes from.
+type ChunkSource struct {
+	// store is the name of the StoreAPI returning the chunk, set by the querier.
+	Store string `protobuf:"bytes,1,opt,name=store,proto3" json:"store,omitempty"`
+	// block_id is the ID of the block the chunk was read from, if any.
+	BlockId string `protobuf:"bytes,2,opt,name=block_id,json=blockId,proto3" json:"block_id,omitempty"`
+}
+
+func (m *ChunkSource) Reset()         { *m = ChunkSource{} }
+func (m *ChunkSource) String() string { return proto.CompactTextString(m) }
+func (*ChunkSource) ProtoMessage()    {}
+func (*ChunkSource) Descriptor() ([]byte, []int) {
+	return fileDescriptor_121fba57de02d8e0, []int{4}
+}
+func (m *ChunkSource) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *ChunkSource) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_ChunkSource.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *ChunkSource) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ChunkSource.Merge(m, src)
+}
+func (m *ChunkSource) XXX_Size() int {
+	return m.Size()
+}
+func (m *ChunkSource) XXX_DiscardUnknown() {
+	xxx_messageInfo_ChunkSource.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ChunkSource proto.InternalMessageInfo
+
 func init() {
 	proto.RegisterEnum("thanos.PartialResponseStrategy", PartialResponseStrategy_name, PartialResponseStrategy_value)
 	proto.RegisterEnum("thanos.Chunk_Encoding", Chunk_Encoding_name, Chunk_Encoding_value)
@@ -281,45 +324,49 @@ func init() {
 	proto.RegisterType((*Series)(nil), "thanos.Series")
 	proto.RegisterType((*AggrChunk)(nil), "thanos.AggrChunk")
 	proto.RegisterType((*LabelMatcher)(nil), "thanos.LabelMatcher")
+	proto.RegisterType((*ChunkSource)(nil), "thanos.ChunkSource")
 }
 
 func init() { proto.RegisterFile("store/storepb/types.proto", fileDescriptor_121fba57de02d8e0) }
 
 var fileDescriptor_121fba57de02d8e0 = []byte{
-	// 530 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x93, 0xd1, 0x6e, 0xd3, 0x3c,
-	0x14, 0xc7, 0xe3, 0x24, 0x4d, 0x5b, 0x6f, 0xdf, 0xa7, 0x60, 0x06, 0x64, 0xbb, 0x48, 0xab, 0x20,
-	0x44, 0x35, 0x69, 0x89, 0xd4, 0x5d, 0x72, 0xd5, 0x4e, 0xe5, 0x0a, 0x36, 0xe6, 0x55, 0x02, 0x21,
-	0x24, 0xe4, 0x76, 0x56, 0x6a, 0x96, 0xd8, 0x51, 0xe2, 0x40, 0xfb, 0x16, 0x20, 0x9e, 0x81, 0x77,
-	0xe9, 0xe5, 0x2e, 0x11, 0x17, 0x13, 0xb4, 0x2f, 0x82, 0xec, 0xa4, 0x40, 0xa5, 0xde, 0x44, 0x27,
-	0xe7, 0xff, 0x3b, 0xe7, 0x6f, 0x1f, 0x1d, 0xc3, 0xc3, 0x42, 0x8a, 0x9c, 0x46, 0xfa, 0x9b, 0x4d,
-	0x22, 0xb9, 0xc8, 0x68, 0x11, 0x66, 0xb9, 0x90, 0x02, 0x39, 0x72, 0x46, 0xb8, 0x28, 0x8e, 0x0e,
-	0x62, 0x11, 0x0b, 0x9d, 0x8a, 0x54, 0x54, 0xa9, 0x47, 0x75, 0x61, 0x42, 0x26, 0x34, 0xd9, 0x2e,
-	0x0c, 0xde, 0xc1, 0xc6, 0xd9, 0xac, 0xe4, 0x37, 0xe8, 0x18, 0xda, 0x2a, 0xef, 0x81, 0x2e, 0xe8,
-	0xfd, 0xdf, 0x7f, 0x18, 0x56, 0x0d, 0x43, 0x2d, 0x86, 0x23, 0x3e, 0x15, 0xd7, 0x8c, 0xc7, 0x58,
-	0x33, 0x08, 0x41, 0xfb, 0x9a, 0x48, 0xe2, 0x99, 0x5d, 0xd0, 0xdb, 0xc7, 0x3a, 0x0e, 0xee, 0xc3,
-	0xd6, 0x86, 0x42, 0x4d, 0x68, 0xbd, 0xb9, 0xc0, 0xae, 0x11, 0x7c, 0x03, 0xd0, 0xb9, 0xa2, 0x39,
-	0xa3, 0x05, 0xfa, 0x00, 0x1d, 0xed, 0x5f, 0x78, 0xa0, 0x6b, 0xf5, 0xf6, 0xfa, 0x0f, 0x36, 0x0e,
-	0xcf, 0xcb, 0x24, 0x39, 0x13, 0xd9, 0xe2, 0x85, 0x52, 0x87, 0xcf, 0x96, 0x77, 0x1d, 0xe3, 0xc7,
-	0x5d, 0xe7, 0x34, 0x66, 0x72, 0x56, 0x4e, 0xc2, 0xa9, 0x48, 0xa3, 0x0a, 0x3c, 0x61, 0xa2, 0x8e,
-	0xa2, 0xec, 0x26, 0x8e, 0xb6, 0xae, 0x14, 0xea, 0x62, 0x5c, 0x3b, 0xa0, 0x08, 0x3a, 0x53, 0x75,
-	0xee, 0xc2, 0x33, 0xb5, 0xd7, 0xbd, 0x8d, 0xd7, 0x20, 0x8e, 0x73, 0x7d, 0xa3, 0xa1, 0xad, 0x7c,
-	0x70, 0x8d, 0x05, 0x5f, 0x4d, 0xd8, 0xfe, 0xa3, 0xa1, 0x43, 0xd8, 0x4a, 0x19, 0x7f, 0x2f, 0x59,
-	0x5a, 0x8d, 0xc3, 0xc2, 0xcd, 0x94, 0xf1, 0x31, 0x4b, 0xa9, 0x96, 0xc8, 0xbc, 0x92, 0xcc, 0x5a,
-	0x22, 0x73, 0x2d, 0x75, 0xa0, 0x95, 0x93, 0x4f, 0x9e, 0xd5, 0x05, 0xbd, 0xbd, 0xfe, 0x7f, 0x5b,
-	0xf3, 0xc3, 0x4a, 0x41, 0x8f, 0x61, 0x63, 0x2a, 0x4a, 0x2e, 0x3d, 0x7b, 0x17, 0x52, 0x69, 0xaa,
-	0x4b, 0x51, 0xa6, 0x5e, 0x63, 0x67, 0x97, 0xa2, 0x4c, 0x15, 0x90, 0x32, 0xee, 0x39, 0x3b, 0x81,
-	0x94, 0x71, 0x0d, 0x90, 0xb9, 0xd7, 0xdc, 0x0d, 0x90, 0x39, 0x7a, 0x0a, 0x9b, 0xda, 0x8b, 0xe6,
-	0x5e, 0x6b, 0x17, 0xb4, 0x51, 0x83, 0x2f, 0x00, 0xee, 0xeb, 0xc1, 0xbe, 0x24, 0x72, 0x3a, 0xa3,
-	0x39, 0x3a, 0xd9, 0xda, 0x91, 0xc3, 0x4d, 0xd9, 0xbf, 0x4c, 0x38, 0x5e, 0x64, 0xf4, 0xef, 0x9a,
-	0x70, 0x52, 0x0f, 0xaa, 0x8d, 0x75, 0x8c, 0x0e, 0x60, 0xe3, 0x23, 0x49, 0x4a, 0xaa, 0xe7, 0xd4,
-	0xc6, 0xd5, 0x4f, 0xd0, 0x83, 0xb6, 0xaa, 0x43, 0x0e, 0x34, 0x47, 0x97, 0xae, 0xa1, 0x16, 0xe8,
-	0x7c, 0x74, 0xe9, 0x02, 0x95, 0xc0, 0x23, 0xd7, 0xd4, 0x09, 0x3c, 0x72, 0xad, 0xe3, 0x10, 0x3e,
-	0x7a, 0x45, 0x72, 0xc9, 0x48, 0x82, 0x69, 0x91, 0x09, 0x5e, 0xd0, 0x2b, 0x99, 0x13, 0x49, 0xe3,
-	0x05, 0x6a, 0x41, 0xfb, 0xf5, 0x00, 0x9f, 0xbb, 0x06, 0x6a, 0xc3, 0xc6, 0x60, 0x78, 0x81, 0xc7,
-	0x2e, 0x18, 0x3e, 0x59, 0xfe, 0xf2, 0x8d, 0xe5, 0xca, 0x07, 0xb7, 0x2b, 0x1f, 0xfc, 0x5c, 0xf9,
-	0xe0, 0xf3, 0xda, 0x37, 0x6e, 0xd7, 0xbe, 0xf1, 0x7d, 0xed, 0x1b, 0x6f, 0x9b, 0xf5, 0x5b, 0x9a,
-	0x38, 0xfa, 0x35, 0x9c, 0xfe, 0x0e, 0x00, 0x00, 0xff, 0xff, 0x31, 0xba, 0x19, 0x3e, 0x63, 0x03,
+	// 578 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x93, 0xd1, 0x6a, 0xd4, 0x4c,
+	0x14, 0xc7, 0x33, 0x49, 0x36, 0xd9, 0x4c, 0xfb, 0x7d, 0xc4, 0x69, 0xd5, 0xb4, 0x17, 0xe9, 0x12,
+	0x11, 0x97, 0x4a, 0x13, 0x68, 0x2f, 0x05, 0xa1, 0x5b, 0x56, 0x10, 0xb4, 0xb5, 0xd3, 0x82, 0x22,
+	0x42, 0x99, 0xcd, 0x0e, 0xd9, 0xb1, 0x49, 0x26, 0x24, 0x13, 0xdd, 0x7d, 0x0b, 0x7d, 0x08, 0xdf,
+	0xc3, 0xcb, 0x5e, 0xf6, 0x52, 0xbc, 0x28, 0xda, 0x7d, 0x11, 0x99, 0x49, 0x56, 0xbb, 0xb0, 0x37,
+	0xe1, 0xcc, 0xf9, 0xff, 0xce, 0xf9, 0x4f, 0x4e, 0x4e, 0xe0, 0x56, 0x25, 0x78, 0x49, 0x23, 0xf5,
+	0x2c, 0x46, 0x91, 0x98, 0x15, 0xb4, 0x0a, 0x8b, 0x92, 0x0b, 0x8e, 0x2c, 0x31, 0x21, 0x39, 0xaf,
+	0xb6, 0x37, 0x13, 0x9e, 0x70, 0x95, 0x8a, 0x64, 0xd4, 0xa8, 0xdb, 0x6d, 0x61, 0x4a, 0x46, 0x34,
+	0x5d, 0x2e, 0x0c, 0x3e, 0xc0, 0xce, 0xd1, 0xa4, 0xce, 0x2f, 0xd1, 0x2e, 0x34, 0x65, 0xde, 0x03,
+	0x3d, 0xd0, 0xff, 0x7f, 0xff, 0x41, 0xd8, 0x34, 0x0c, 0x95, 0x18, 0x0e, 0xf3, 0x98, 0x8f, 0x59,
+	0x9e, 0x60, 0xc5, 0x20, 0x04, 0xcd, 0x31, 0x11, 0xc4, 0xd3, 0x7b, 0xa0, 0xbf, 0x8e, 0x55, 0x1c,
+	0x6c, 0xc0, 0xee, 0x82, 0x42, 0x36, 0x34, 0xde, 0x9d, 0x60, 0x57, 0x0b, 0xbe, 0x01, 0x68, 0x9d,
+	0xd1, 0x92, 0xd1, 0x0a, 0x7d, 0x84, 0x96, 0xf2, 0xaf, 0x3c, 0xd0, 0x33, 0xfa, 0x6b, 0xfb, 0xf7,
+	0x17, 0x0e, 0x2f, 0xea, 0x34, 0x3d, 0xe2, 0xc5, 0xec, 0x95, 0x54, 0x07, 0xcf, 0xae, 0x6e, 0x76,
+	0xb4, 0x9f, 0x37, 0x3b, 0x07, 0x09, 0x13, 0x93, 0x7a, 0x14, 0xc6, 0x3c, 0x8b, 0x1a, 0x70, 0x8f,
+	0xf1, 0x36, 0x8a, 0x8a, 0xcb, 0x24, 0x5a, 0x7a, 0xa5, 0x50, 0x15, 0xe3, 0xd6, 0x01, 0x45, 0xd0,
+	0x8a, 0xe5, 0xbd, 0x2b, 0x4f, 0x57, 0x5e, 0xf7, 0x16, 0x5e, 0x87, 0x49, 0x52, 0xaa, 0x37, 0x1a,
+	0x98, 0xd2, 0x07, 0xb7, 0x58, 0xf0, 0x5d, 0x87, 0xce, 0x5f, 0x0d, 0x6d, 0xc1, 0x6e, 0xc6, 0xf2,
+	0x0b, 0xc1, 0xb2, 0x66, 0x1c, 0x06, 0xb6, 0x33, 0x96, 0x9f, 0xb3, 0x8c, 0x2a, 0x89, 0x4c, 0x1b,
+	0x49, 0x6f, 0x25, 0x32, 0x55, 0xd2, 0x0e, 0x34, 0x4a, 0xf2, 0xd9, 0x33, 0x7a, 0xa0, 0xbf, 0xb6,
+	0xff, 0xdf, 0xd2, 0xfc, 0xb0, 0x54, 0xd0, 0x23, 0xd8, 0x89, 0x79, 0x9d, 0x0b, 0xcf, 0x5c, 0x85,
+	0x34, 0x9a, 0xec, 0x52, 0xd5, 0x99, 0xd7, 0x59, 0xd9, 0xa5, 0xaa, 0x33, 0x09, 0x64, 0x2c, 0xf7,
+	0xac, 0x95, 0x40, 0xc6, 0x72, 0x05, 0x90, 0xa9, 0x67, 0xaf, 0x06, 0xc8, 0x14, 0x3d, 0x81, 0xb6,
+	0xf2, 0xa2, 0xa5, 0xd7, 0x5d, 0x05, 0x2d, 0x54, 0xf4, 0x14, 0x5a, 0x15, 0xaf, 0xcb, 0x98, 0x7a,
+	0x8e, 0xe2, 0x36, 0x96, 0xb8, 0x33, 0x25, 0xe1, 0x16, 0x09, 0xbe, 0x02, 0xb8, 0xae, 0xbe, 0xc2,
+	0x6b, 0x22, 0xe2, 0x09, 0x2d, 0xd1, 0xde, 0xd2, 0x42, 0x6d, 0x2d, 0x6a, 0xef, 0x32, 0xe1, 0xf9,
+	0xac, 0xa0, 0xff, 0x76, 0x2a, 0x27, 0xed, 0x54, 0x1d, 0xac, 0x62, 0xb4, 0x09, 0x3b, 0x9f, 0x48,
+	0x5a, 0x53, 0x35, 0x54, 0x07, 0x37, 0x87, 0xa0, 0x0f, 0x4d, 0x59, 0x87, 0x2c, 0xa8, 0x0f, 0x4f,
+	0x5d, 0x4d, 0x6e, 0xdb, 0xf1, 0xf0, 0xd4, 0x05, 0x32, 0x81, 0x87, 0xae, 0xae, 0x12, 0x78, 0xe8,
+	0x1a, 0xc1, 0x73, 0xb8, 0x76, 0xe7, 0xaa, 0xb2, 0x9d, 0xda, 0x1a, 0x75, 0x25, 0x07, 0x37, 0x07,
+	0xf9, 0x49, 0x47, 0x29, 0x8f, 0x2f, 0x2f, 0xd8, 0xb8, 0x35, 0xb7, 0xd5, 0xf9, 0xe5, 0x78, 0x37,
+	0x84, 0x0f, 0xdf, 0x90, 0x52, 0x30, 0x92, 0x62, 0x5a, 0x15, 0x3c, 0xaf, 0xe8, 0x99, 0x28, 0x89,
+	0xa0, 0xc9, 0x0c, 0x75, 0xa1, 0xf9, 0xf6, 0x10, 0x1f, 0xbb, 0x1a, 0x72, 0x60, 0xe7, 0x70, 0x70,
+	0x82, 0xcf, 0x5d, 0x30, 0x78, 0x7c, 0xf5, 0xdb, 0xd7, 0xae, 0x6e, 0x7d, 0x70, 0x7d, 0xeb, 0x83,
+	0x5f, 0xb7, 0x3e, 0xf8, 0x32, 0xf7, 0xb5, 0xeb, 0xb9, 0xaf, 0xfd, 0x98, 0xfb, 0xda, 0x7b, 0xbb,
+	0xfd, 0x71, 0x47, 0x96, 0xfa, 0xf5, 0x0e, 0xfe, 0x0c, 0x00, 0xcb, 0x29, 0x57, 0xa8, 0xd0, 0x03,
 	0x00, 0x00,
 }
 
@@ -429,6 +476,18 @@ func (m *AggrChunk) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Source != nil {
+		{
+			size, err := m.Source.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintTypes(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x4a
+	}
 	if m.Counter != nil {
 		{
 			size, err := m.Counter.MarshalToSizedBuffer(dAtA[:i])
@@ -556,6 +615,43 @@ func (m *LabelMatcher) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *ChunkSource) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *ChunkSource) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *ChunkSource) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.BlockId) > 0 {
+		i -= len(m.BlockId)
+		copy(dAtA[i:], m.BlockId)
+		i = encodeVarintTypes(dAtA, i, uint64(len(m.BlockId)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if len(m.Store) > 0 {
+		i -= len(m.Store)
+		copy(dAtA[i:], m.Store)
+		i = encodeVarintTypes(dAtA, i, uint64(len(m.Store)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintTypes(dAtA []byte, offset int, v uint64) int {
 	offset -= sovTypes(v)
 	base := offset
@@ -640,6 +736,10 @@ func (m *AggrChunk) Size() (n int) {
 		l = m.Counter.Size()
 		n += 1 + l + sovTypes(uint64(l))
 	}
+	if m.Source != nil {
+		l = m.Source.Size()
+		n += 1 + l + sovTypes(uint64(l))
+	}
 	return n
 }
 
@@ -663,6 +763,23 @@ func (m *LabelMatcher) Size() (n int) {
 	return n
 }
 
+func (m *ChunkSource) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Store)
+	if l > 0 {
+		n += 1 + l + sovTypes(uint64(l))
+	}
+	l = len(m.BlockId)
+	if l > 0 {
+		n += 1 + l + sovTypes(uint64(l))
+	}
+	return n
+}
+
 func sovTypes(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -1179,6 +1296,42 @@ func (m *AggrChunk) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Source", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Source == nil {
+				m.Source = &ChunkSource{}
+			}
+			if err := m.Source.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipTypes(dAtA[iNdEx:])
@@ -1339,6 +1492,123 @@ func (m *LabelMatcher) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *ChunkSource) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowTypes
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: ChunkSource: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: ChunkSource: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Store", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Store = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlockId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.BlockId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipTypes(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipTypes(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
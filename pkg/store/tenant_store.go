@@ -0,0 +1,166 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/objstore/client"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// DefaultTenantHeader is the default header, or gRPC metadata key, carrying the tenant of the request.
+const DefaultTenantHeader = "THANOS-TENANT"
+
+// TenantBucketConfig maps a tenant to the bucket holding its blocks.
+type TenantBucketConfig struct {
+	Tenant string              `yaml:"tenant"`
+	Bucket client.BucketConfig `yaml:"bucket"`
+}
+
+// ParseTenantBucketsConfig parses the YAML list of tenants and their buckets.
+func ParseTenantBucketsConfig(confYaml []byte) ([]TenantBucketConfig, error) {
+	var conf []TenantBucketConfig
+	if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse tenant buckets config")
+	}
+
+	seen := map[string]struct{}{}
+	for _, c := range conf {
+		if c.Tenant == "" {
+			return nil, errors.New("empty tenant in tenant buckets config")
+		}
+		// Tenant is used as directory name for its blocks.
+		if c.Tenant == "." || c.Tenant == ".." || strings.ContainsAny(c.Tenant, `/\`) {
+			return nil, errors.Errorf("invalid tenant %q in tenant buckets config", c.Tenant)
+		}
+		if _, ok := seen[c.Tenant]; ok {
+			return nil, errors.Errorf("duplicate tenant %q in tenant buckets config", c.Tenant)
+		}
+		seen[c.Tenant] = struct{}{}
+	}
+	return conf, nil
+}
+
+// TenantStore implements the store API by routing each request to the store of its tenant only, e.g. a BucketStore
+// of the tenant's bucket. The tenant is taken from the tenant header of the request metadata, which is expected to be
+// set by a trusted client, e.g. Querier or an authenticating proxy. Label matchers of requests are never used to
+// determine the tenant, as they are controlled by end users. Requests without a known tenant are rejected.
+type TenantStore struct {
+	header string
+	stores map[string]storepb.StoreServer
+}
+
+// NewTenantStore returns a store routing requests to the given stores by their tenant.
+func NewTenantStore(header string, stores map[string]storepb.StoreServer) *TenantStore {
+	return &TenantStore{
+		header: strings.ToLower(header),
+		stores: stores,
+	}
+}
+
+// tenantStore returns the store of the tenant of the request.
+func (s *TenantStore) tenantStore(ctx context.Context) (storepb.StoreServer, error) {
+	var tenant string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(s.header); len(vals) > 0 {
+			tenant = vals[0]
+		}
+	}
+	if tenant == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "no tenant specified by %s header", s.header)
+	}
+
+	st, ok := s.stores[tenant]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "unknown tenant %q", tenant)
+	}
+	return st, nil
+}
+
+// Info returns merged information about stores of all tenants, so the store is queried for any of them.
+func (s *TenantStore) Info(ctx context.Context, req *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	tenants := make([]string, 0, len(s.stores))
+	for tenant := range s.stores {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var (
+		resp *storepb.InfoResponse
+		seen = map[string]struct{}{}
+	)
+	for _, tenant := range tenants {
+		info, err := s.stores[tenant].Info(ctx, req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get info for tenant %s", tenant)
+		}
+		if resp == nil {
+			resp = &storepb.InfoResponse{StoreType: info.StoreType, MinTime: info.MinTime, MaxTime: info.MaxTime}
+		}
+		if info.MinTime < resp.MinTime {
+			resp.MinTime = info.MinTime
+		}
+		if info.MaxTime > resp.MaxTime {
+			resp.MaxTime = info.MaxTime
+		}
+		// Label sets shared by tenants, like the compatibility label, are advertised once.
+		for _, ls := range info.LabelSets {
+			k := storepb.LabelsToPromLabelsUnsafe(ls.Labels).String()
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			resp.LabelSets = append(resp.LabelSets, ls)
+		}
+	}
+	if resp == nil {
+		return &storepb.InfoResponse{StoreType: storepb.StoreType_STORE}, nil
+	}
+	return resp, nil
+}
+
+// Series returns series of the tenant of the request.
+func (s *TenantStore) Series(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	st, err := s.tenantStore(srv.Context())
+	if err != nil {
+		return err
+	}
+	return st.Series(req, srv)
+}
+
+// LabelNames returns label names of the tenant of the request.
+func (s *TenantStore) LabelNames(ctx context.Context, req *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	st, err := s.tenantStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st.LabelNames(ctx, req)
+}
+
+// LabelValues returns label values of the tenant of the request.
+func (s *TenantStore) LabelValues(ctx context.Context, req *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	st, err := s.tenantStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st.LabelValues(ctx, req)
+}
+
+// LabelValuesStream streams label values of the tenant of the request.
+func (s *TenantStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	st, err := s.tenantStore(srv.Context())
+	if err != nil {
+		return err
+	}
+	return st.LabelValuesStream(req, srv)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/objstore/client"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// tenantTestStore serves a single series, label name and label value equal to its tenant.
+type tenantTestStore struct {
+	storepb.StoreServer
+
+	tenant string
+	info   storepb.InfoResponse
+}
+
+func (s *tenantTestStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	info := s.info
+	return &info, nil
+}
+
+func (s *tenantTestStore) Series(_ *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	return srv.Send(storepb.NewSeriesResponse(&storepb.Series{Labels: []storepb.Label{{Name: "tenant", Value: s.tenant}}}))
+}
+
+func (s *tenantTestStore) LabelNames(context.Context, *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	return &storepb.LabelNamesResponse{Names: []string{s.tenant}}, nil
+}
+
+func (s *tenantTestStore) LabelValues(context.Context, *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	return &storepb.LabelValuesResponse{Values: []string{s.tenant}}, nil
+}
+
+func TestTenantStore(t *testing.T) {
+	compat := storepb.LabelSet{Labels: []storepb.Label{{Name: CompatibilityTypeLabelName, Value: "store"}}}
+	s := NewTenantStore(DefaultTenantHeader, map[string]storepb.StoreServer{
+		"a": &tenantTestStore{tenant: "a", info: storepb.InfoResponse{
+			StoreType: storepb.StoreType_STORE,
+			MinTime:   100,
+			MaxTime:   200,
+			LabelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "tenant", Value: "a"}}}, compat},
+		}},
+		"b": &tenantTestStore{tenant: "b", info: storepb.InfoResponse{
+			StoreType: storepb.StoreType_STORE,
+			MinTime:   50,
+			MaxTime:   150,
+			LabelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "tenant", Value: "b"}}}, compat},
+		}},
+	})
+	withTenant := func(tenant string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("thanos-tenant", tenant))
+	}
+	tenantMatcher := func(tenant string) []storepb.LabelMatcher {
+		return []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "tenant", Value: tenant}}
+	}
+	expectCode := func(t *testing.T, code codes.Code, err error) {
+		testutil.NotOk(t, err)
+		testutil.Equals(t, code, status.Code(err))
+	}
+
+	t.Run("info merges all tenants", func(t *testing.T) {
+		info, err := s.Info(context.Background(), &storepb.InfoRequest{})
+		testutil.Ok(t, err)
+		testutil.Equals(t, &storepb.InfoResponse{
+			StoreType: storepb.StoreType_STORE,
+			MinTime:   50,
+			MaxTime:   200,
+			LabelSets: []storepb.LabelSet{
+				{Labels: []storepb.Label{{Name: "tenant", Value: "a"}}},
+				compat,
+				{Labels: []storepb.Label{{Name: "tenant", Value: "b"}}},
+			},
+		}, info)
+	})
+	t.Run("requests are served only from the store of their tenant", func(t *testing.T) {
+		for _, tenant := range []string{"a", "b"} {
+			srv := newStoreSeriesServer(withTenant(tenant))
+			testutil.Ok(t, s.Series(&storepb.SeriesRequest{}, srv))
+			testutil.Equals(t, []storepb.Series{{Labels: []storepb.Label{{Name: "tenant", Value: tenant}}}}, srv.SeriesSet)
+
+			names, err := s.LabelNames(withTenant(tenant), &storepb.LabelNamesRequest{})
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{tenant}, names.Names)
+
+			values, err := s.LabelValues(withTenant(tenant), &storepb.LabelValuesRequest{Label: "tenant"})
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{tenant}, values.Values)
+		}
+	})
+	t.Run("label matchers do not select tenant", func(t *testing.T) {
+		// Matchers are controlled by end users, so a tenant cannot read data of other tenants by matching their label.
+		srv := newStoreSeriesServer(withTenant("a"))
+		testutil.Ok(t, s.Series(&storepb.SeriesRequest{Matchers: tenantMatcher("b")}, srv))
+		testutil.Equals(t, []storepb.Series{{Labels: []storepb.Label{{Name: "tenant", Value: "a"}}}}, srv.SeriesSet)
+
+		values, err := s.LabelValues(withTenant("a"), &storepb.LabelValuesRequest{Label: "tenant", Matchers: tenantMatcher("b")})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"a"}, values.Values)
+	})
+	t.Run("missing tenant", func(t *testing.T) {
+		expectCode(t, codes.InvalidArgument, s.Series(&storepb.SeriesRequest{}, newStoreSeriesServer(context.Background())))
+
+		// Tenant matcher does not replace the header.
+		expectCode(t, codes.InvalidArgument, s.Series(&storepb.SeriesRequest{Matchers: tenantMatcher("b")}, newStoreSeriesServer(context.Background())))
+
+		_, err := s.LabelNames(context.Background(), &storepb.LabelNamesRequest{})
+		expectCode(t, codes.InvalidArgument, err)
+	})
+	t.Run("unknown tenant", func(t *testing.T) {
+		expectCode(t, codes.PermissionDenied, s.Series(&storepb.SeriesRequest{}, newStoreSeriesServer(withTenant("c"))))
+
+		_, err := s.LabelNames(withTenant("c"), &storepb.LabelNamesRequest{})
+		expectCode(t, codes.PermissionDenied, err)
+	})
+}
+
+func TestParseTenantBucketsConfig(t *testing.T) {
+	conf, err := ParseTenantBucketsConfig([]byte(`
+- tenant: a
+  bucket:
+    type: FILESYSTEM
+    config:
+      directory: /tmp/a
+- tenant: b
+  bucket:
+    type: FILESYSTEM
+    config:
+      directory: /tmp/b
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(conf))
+	testutil.Equals(t, "a", conf[0].Tenant)
+	testutil.Equals(t, client.FILESYSTEM, conf[0].Bucket.Type)
+	testutil.Equals(t, "b", conf[1].Tenant)
+
+	for _, invalid := range []string{
+		`- bucket: {type: FILESYSTEM}`,
+		`[{tenant: a, bucket: {type: FILESYSTEM}}, {tenant: a, bucket: {type: FILESYSTEM}}]`,
+		`- {tenant: ../a, bucket: {type: FILESYSTEM}}`,
+		`- {tenant: a, unknown: field}`,
+	} {
+		_, err := ParseTenantBucketsConfig([]byte(invalid))
+		testutil.NotOk(t, err, invalid)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"io"
 	"math"
+	"sort"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -219,15 +220,54 @@ func (s *TSDBStore) LabelNames(ctx context.Context, r *storepb.LabelNamesRequest
 func (s *TSDBStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest) (
 	*storepb.LabelValuesResponse, error,
 ) {
+	match, newMatchers, err := matchesExternalLabels(r.Matchers, s.externalLabels)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return &storepb.LabelValuesResponse{}, nil
+	}
+
 	q, err := s.db.ChunkQuerier(ctx, r.Start, r.End)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	defer runutil.CloseWithLogOnErr(s.logger, q, "close tsdb querier label values")
 
-	res, _, err := q.LabelValues(r.Label)
+	if len(newMatchers) == 0 {
+		res, _, err := q.LabelValues(r.Label)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &storepb.LabelValuesResponse{Values: res}, nil
+	}
+
+	matchers, err := storepb.TranslateFromPromMatchers(newMatchers...)
 	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Only values of series matching given matchers are returned.
+	vals := map[string]struct{}{}
+	set := q.Select(false, nil, matchers...)
+	for set.Next() {
+		if v := set.At().Labels().Get(r.Label); v != "" {
+			vals[v] = struct{}{}
+		}
+	}
+	if err := set.Err(); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	res := keys(vals)
+	sort.Strings(res)
 	return &storepb.LabelValuesResponse{Values: res}, nil
 }
+
+// LabelValuesStream streams all known label values for a given label name.
+func (s *TSDBStore) LabelValuesStream(req *storepb.LabelValuesRequest, srv storepb.Store_LabelValuesStreamServer) error {
+	resp, err := s.LabelValues(srv.Context(), req)
+	if err != nil {
+		return err
+	}
+	return sendLabelValues(srv, resp)
+}
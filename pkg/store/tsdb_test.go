@@ -389,6 +389,69 @@ func TestTSDBStore_LabelValues(t *testing.T) {
 	}
 }
 
+func TestTSDBStore_LabelValues_Matchers(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	now := time.Now()
+	appender := db.Appender(context.Background())
+	for _, lset := range []labels.Labels{
+		labels.FromStrings("foo", "test"),
+		labels.FromStrings("foo", "test1"),
+		labels.FromStrings("foo", "test2", "bar", "baz"),
+	} {
+		_, err = appender.Add(lset, now.Unix(), 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, appender.Commit())
+
+	tsdbStore := NewTSDBStore(nil, nil, db, component.Rule, labels.FromStrings("region", "eu-west"))
+	for _, tc := range []struct {
+		title          string
+		matchers       []storepb.LabelMatcher
+		expectedValues []string
+	}{
+		{
+			title:          "no matchers",
+			expectedValues: []string{"test", "test1", "test2"},
+		},
+		{
+			title:          "scope values by matchers",
+			matchers:       []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "bar", Value: "baz"}},
+			expectedValues: []string{"test2"},
+		},
+		{
+			title:          "scope values by matchers including external labels",
+			matchers:       []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "foo", Value: "test1|test2"}, {Type: storepb.LabelMatcher_EQ, Name: "region", Value: "eu-west"}},
+			expectedValues: []string{"test1", "test2"},
+		},
+		{
+			title:    "matchers not matching external labels",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "region", Value: "us-east"}},
+		},
+	} {
+		if ok := t.Run(tc.title, func(t *testing.T) {
+			resp, err := tsdbStore.LabelValues(ctx, &storepb.LabelValuesRequest{
+				Label:    "foo",
+				Start:    timestamp.FromTime(minTime),
+				End:      timestamp.FromTime(maxTime),
+				Matchers: tc.matchers,
+			})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expectedValues, resp.Values)
+			testutil.Equals(t, 0, len(resp.Warnings))
+		}); !ok {
+			return
+		}
+	}
+}
+
 // Regression test for https://github.com/thanos-io/thanos/issues/1038.
 func TestTSDBStore_Series_SplitSamplesIntoChunksWithMaxSizeOf120(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
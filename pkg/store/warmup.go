@@ -0,0 +1,187 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// WarmupQuery is a representative query replayed by the warmup.
+type WarmupQuery struct {
+	// Selector is the series selector of the query, e.g. `http_requests_total{job="api"}`.
+	Selector string `yaml:"selector"`
+	// Range is the time range of the query, ending at the time of the warmup.
+	Range model.Duration `yaml:"range"`
+	// MaxResolution is the maximum resolution of data of the query, e.g. 1h to warm downsampled blocks only.
+	MaxResolution model.Duration `yaml:"max_resolution"`
+	// SkipChunks warms index caches only, without fetching chunks.
+	SkipChunks bool `yaml:"skip_chunks"`
+}
+
+// WarmupConfig configures queries replayed by a store at startup, before it is ready, to populate its caches.
+type WarmupConfig struct {
+	Queries []WarmupQuery `yaml:"queries"`
+	// Concurrency is the number of queries replayed concurrently.
+	Concurrency int `yaml:"concurrency"`
+	// Timeout limits the time of the whole warmup. The store becomes ready once it is exceeded, even if some queries
+	// were not replayed.
+	Timeout model.Duration `yaml:"timeout"`
+}
+
+var defaultWarmupConfig = WarmupConfig{
+	Concurrency: 4,
+	Timeout:     model.Duration(5 * time.Minute),
+}
+
+type warmupRequest struct {
+	query    WarmupQuery
+	matchers []storepb.LabelMatcher
+}
+
+// Warmer replays representative queries against a store, e.g. after a restart, so that index-headers, index cache
+// items and chunks touched by them are loaded before the store serves real queries. Unlike loading all blocks
+// blindly, it warms only data accessed by the configured queries.
+type Warmer struct {
+	logger      log.Logger
+	reqs        []warmupRequest
+	concurrency int
+	timeout     time.Duration
+
+	queries  *prometheus.CounterVec
+	duration prometheus.Gauge
+}
+
+// NewWarmer parses the YAML warmup config and returns the warmer replaying its queries.
+func NewWarmer(logger log.Logger, reg prometheus.Registerer, confYaml []byte) (*Warmer, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	conf := defaultWarmupConfig
+	if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse warmup config")
+	}
+	if conf.Concurrency <= 0 {
+		return nil, errors.Errorf("warmup concurrency has to be positive, got %d", conf.Concurrency)
+	}
+	if conf.Timeout <= 0 {
+		return nil, errors.Errorf("warmup timeout has to be positive, got %s", conf.Timeout)
+	}
+
+	w := &Warmer{
+		logger:      logger,
+		concurrency: conf.Concurrency,
+		timeout:     time.Duration(conf.Timeout),
+		queries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_warmup_queries_total",
+			Help: "Total number of queries replayed by the warmup at startup, by result.",
+		}, []string{"result"}),
+		duration: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_bucket_store_warmup_duration_seconds",
+			Help: "Duration of the last warmup at startup.",
+		}),
+	}
+	for _, q := range conf.Queries {
+		ms, err := parser.ParseMetricSelector(q.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse selector %q of warmup query", q.Selector)
+		}
+		sms, err := storepb.TranslatePromMatchers(ms...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "translate selector %q of warmup query", q.Selector)
+		}
+		if q.Range <= 0 {
+			return nil, errors.Errorf("range of warmup query %q has to be positive, got %s", q.Selector, q.Range)
+		}
+		w.reqs = append(w.reqs, warmupRequest{query: q, matchers: sms})
+	}
+	w.queries.WithLabelValues("success")
+	w.queries.WithLabelValues("failure")
+	return w, nil
+}
+
+// Warmup replays all queries against the given store and returns once they are done or the warmup timed out. Failed
+// queries are logged and counted only, as the store can serve queries without warm caches as well.
+func (w *Warmer) Warmup(ctx context.Context, srv storepb.StoreServer) {
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		reqs = make(chan warmupRequest)
+	)
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for r := range reqs {
+				if err := w.replay(ctx, srv, r, begin); err != nil {
+					w.queries.WithLabelValues("failure").Inc()
+					level.Warn(w.logger).Log("msg", "warmup query failed", "selector", r.query.Selector, "err", err)
+					continue
+				}
+				w.queries.WithLabelValues("success").Inc()
+			}
+		}()
+	}
+Queries:
+	for _, r := range w.reqs {
+		select {
+		case reqs <- r:
+		case <-ctx.Done():
+			break Queries
+		}
+	}
+	close(reqs)
+	wg.Wait()
+
+	w.duration.Set(time.Since(begin).Seconds())
+	if ctx.Err() != nil {
+		level.Warn(w.logger).Log("msg", "warmup timed out, some queries were not replayed", "timeout", w.timeout)
+		return
+	}
+	level.Info(w.logger).Log("msg", "warmup done", "queries", len(w.reqs), "duration", time.Since(begin).String())
+}
+
+func (w *Warmer) replay(ctx context.Context, srv storepb.StoreServer, r warmupRequest, now time.Time) error {
+	return srv.Series(&storepb.SeriesRequest{
+		MinTime:             timestamp.FromTime(now.Add(-time.Duration(r.query.Range))),
+		MaxTime:             timestamp.FromTime(now),
+		Matchers:            r.matchers,
+		MaxResolutionWindow: time.Duration(r.query.MaxResolution).Milliseconds(),
+		// Aggregates requested by Querier by default, which are also used by most downsampled queries.
+		Aggregates: []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM},
+		SkipChunks: r.query.SkipChunks,
+	}, &discardSeriesServer{ctx: ctx})
+}
+
+// discardSeriesServer discards all responses of a Series call.
+type discardSeriesServer struct {
+	storepb.Store_SeriesServer
+
+	ctx context.Context
+}
+
+func (s *discardSeriesServer) Send(*storepb.SeriesResponse) error {
+	return s.ctx.Err()
+}
+
+func (s *discardSeriesServer) Context() context.Context {
+	return s.ctx
+}
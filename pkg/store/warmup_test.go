@@ -0,0 +1,103 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/oklog/ulid"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestNewWarmer(t *testing.T) {
+	w, err := NewWarmer(nil, nil, []byte(`
+queries:
+- selector: 'up{job="api"}'
+  range: 6h
+- selector: '{__name__=~"http_.*"}'
+  range: 30d
+  max_resolution: 1h
+  skip_chunks: true
+concurrency: 2
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(w.reqs))
+	testutil.Equals(t, 2, w.concurrency)
+	testutil.Equals(t, defaultWarmupConfig.Timeout, model.Duration(w.timeout))
+
+	for _, tcase := range []struct {
+		name string
+		conf string
+	}{
+		{name: "invalid selector", conf: `{queries: [{selector: "up{", range: 1h}]}`},
+		{name: "no range", conf: `{queries: [{selector: "up"}]}`},
+		{name: "no concurrency", conf: `{concurrency: 0}`},
+		{name: "unknown field", conf: `{queries: [{selector: "up", range: 1h, step: 1m}]}`},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := NewWarmer(nil, nil, []byte(tcase.conf))
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+// countingCache counts items stored in the index cache.
+type countingCache struct {
+	noopCache
+
+	mtx      sync.Mutex
+	postings int
+	series   int
+}
+
+func (c *countingCache) StorePostings(context.Context, ulid.ULID, labels.Label, []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.postings++
+}
+
+func (c *countingCache) StoreSeries(context.Context, ulid.ULID, uint64, []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.series++
+}
+
+func TestWarmer_Warmup_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := objstore.NewInMemBucket()
+
+	dir, err := ioutil.TempDir("", "test_warmer_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	cache := &countingCache{}
+	s.cache.SwapWith(cache)
+
+	w, err := NewWarmer(s.logger, nil, []byte(`
+queries:
+- selector: '{a="1"}'
+  range: 1h
+- selector: '{a="3"}'
+  range: 1h
+`))
+	testutil.Ok(t, err)
+
+	// Caches are populated by the time the warmup returns, i.e. before the store is marked as ready.
+	w.Warmup(ctx, s.store)
+	testutil.Assert(t, cache.postings > 0, "expected postings to be cached")
+	testutil.Assert(t, cache.series > 0, "expected series to be cached")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(w.queries.WithLabelValues("success")))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(w.queries.WithLabelValues("failure")))
+}